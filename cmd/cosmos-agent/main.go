@@ -4,6 +4,7 @@ import (
 	"context"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
 	"time"
 
@@ -11,6 +12,7 @@ import (
 	"github.com/metorial/fleet/cosmos/internal/agent/database"
 	agentgrpc "github.com/metorial/fleet/cosmos/internal/agent/grpc"
 	"github.com/metorial/fleet/cosmos/internal/agent/health"
+	"github.com/metorial/fleet/cosmos/internal/agent/metrics"
 	"github.com/metorial/fleet/cosmos/internal/agent/reconciler"
 	"github.com/metorial/fleet/cosmos/internal/util"
 	log "github.com/sirupsen/logrus"
@@ -44,14 +46,17 @@ func main() {
 			log.Info("Initializing Vault certificate manager")
 
 			certMgr, err := util.NewVaultCertManager(&util.VaultCertConfig{
-				VaultAddr:  config.VaultAddr,
-				VaultToken: config.VaultToken,
-				PKIPath:    config.VaultPKIPath,
-				Role:       config.VaultPKIRole,
-				CertPath:   config.TLSCertPath,
-				KeyPath:    config.TLSKeyPath,
-				CAPath:     config.TLSCAPath,
-				TTL:        config.CertTTL,
+				VaultAddr:   config.VaultAddr,
+				VaultToken:  config.VaultToken,
+				RoleID:      config.VaultRoleID,
+				SecretID:    config.VaultSecretID,
+				AppRolePath: config.VaultAppRolePath,
+				PKIPath:     config.VaultPKIPath,
+				Role:        config.VaultPKIRole,
+				CertPath:    config.TLSCertPath,
+				KeyPath:     config.TLSKeyPath,
+				CAPath:      config.TLSCAPath,
+				TTL:         config.CertTTL,
 			})
 			if err != nil {
 				log.WithError(err).Fatal("Failed to create Vault certificate manager")
@@ -60,7 +65,7 @@ func main() {
 			shouldRenew, err := certMgr.ShouldRenew(config.CertRenewBefore)
 			if err != nil || shouldRenew {
 				log.Info("Obtaining certificate from Vault")
-				if err := certMgr.ObtainCertificate(); err != nil {
+				if err := certMgr.ObtainCertificateWithRetry(config.VaultRetryAttempts, config.VaultRetryBackoff); err != nil {
 					log.WithError(err).Fatal("Failed to obtain certificate")
 				}
 			}
@@ -93,9 +98,41 @@ func main() {
 	}
 
 	componentMgr := component.NewManager(db, config.DataDir)
+	componentMgr.SetDownloadOptions(component.DownloadOptions{
+		Concurrency:       config.DownloadConcurrency,
+		ChunkSize:         config.DownloadChunkSize,
+		ParallelThreshold: config.DownloadParallelThreshold,
+		Timeout:           config.DownloadTimeout,
+		StallTimeout:      config.DownloadStallTimeout,
+		MinFreeSpace:      config.DownloadMinFreeSpace,
+		CacheMaxSize:      config.DownloadCacheMaxSize,
+		CacheMaxAge:       config.DownloadCacheMaxAge,
+	})
+	componentMgr.SetRetryPolicy(component.RetryPolicy{
+		MaxAttempts: config.DownloadRetryAttempts,
+		BaseDelay:   config.DownloadRetryDelay,
+	})
+	componentMgr.SetCgroupRoot(config.CgroupRoot)
+	if err := componentMgr.SetScriptExecution(component.ScriptExecution{
+		Mode:          config.UnmanagedScriptMode,
+		TargetPID:     config.UnmanagedScriptTarget,
+		Namespaces:    config.UnmanagedScriptNamespaces,
+		WorkingDir:    config.UnmanagedScriptWorkingDir,
+		HostScriptDir: config.UnmanagedScriptHostDir,
+		Timeout:       config.UnmanagedScriptTimeout,
+	}); err != nil {
+		log.WithError(err).Fatal("Invalid unmanaged script configuration")
+	}
 	log.Info("Component manager initialized")
 
+	unmanagedScripts, nsenterErr := componentMgr.UnmanagedScriptsSupported()
+	if !unmanagedScripts {
+		log.WithError(nsenterErr).Warn("Unmanaged scripts are not supported on this node and will be rejected")
+	}
+
 	healthChecker := health.NewChecker(db, componentMgr.IsProcessRunning)
+	healthChecker.SetLogReader(componentMgr.ReadComponentLog)
+	healthChecker.SetJitter(config.HealthCheckJitter)
 	log.Info("Health checker initialized")
 
 	var grpcTLS *util.TLSConfigWrapper
@@ -107,11 +144,20 @@ func main() {
 		ControllerURL:     config.ControllerURL,
 		Tags:              config.Tags,
 		DB:                db,
+		DataDir:           config.DataDir,
 		ReconnectInterval: 5 * time.Second,
+		Metadata: map[string]string{
+			"unmanaged_scripts": strconv.FormatBool(unmanagedScripts),
+		},
 	}
 
 	if grpcTLS != nil {
 		grpcConfig.TLSConfig = grpcTLS.Config
+		// The controller only accepts the hostname the certificate was
+		// issued for
+		if grpcTLS.CertMgr != nil {
+			grpcConfig.Hostname = grpcTLS.CertMgr.Hostname()
+		}
 	}
 
 	grpcClient, err := agentgrpc.NewClient(grpcConfig)
@@ -131,6 +177,12 @@ func main() {
 		GRPCClient:        grpcClient,
 		ReconcileInterval: config.ReconcileInterval,
 		HeartbeatInterval: config.HeartbeatInterval,
+		RestartPolicy: reconciler.RestartPolicy{
+			BaseDelay:   config.RestartBackoff,
+			MaxDelay:    config.RestartMaxBackoff,
+			MaxRestarts: config.RestartMaxCount,
+			Window:      config.RestartWindow,
+		},
 	}
 
 	rec := reconciler.NewReconciler(reconcilerConfig)
@@ -139,6 +191,28 @@ func main() {
 	}
 	log.Info("Reconciler started")
 
+	var metricsServer *metrics.Server
+	if config.MetricsEnabled {
+		metricsServer = metrics.NewServer(&metrics.ServerConfig{
+			DB:            db,
+			HealthChecker: healthChecker,
+			Reconciler:    rec,
+			GRPCClient:    grpcClient,
+			BindAddr:      config.MetricsBindAddr,
+			Port:          config.AgentPort,
+		})
+
+		if err := metricsServer.Start(); err != nil {
+			log.WithError(err).Warn("Failed to start metrics server")
+			metricsServer = nil
+		} else {
+			log.WithFields(log.Fields{
+				"bind": config.MetricsBindAddr,
+				"port": config.AgentPort,
+			}).Info("Metrics server started")
+		}
+	}
+
 	log.Info("Cosmos Agent is running")
 
 	waitForShutdown(func() {
@@ -147,6 +221,12 @@ func main() {
 		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 		defer cancel()
 
+		if metricsServer != nil {
+			if err := metricsServer.Stop(); err != nil {
+				log.WithError(err).Warn("Error stopping metrics server")
+			}
+		}
+
 		if err := rec.Stop(); err != nil {
 			log.WithError(err).Warn("Error stopping reconciler")
 		}
@@ -155,6 +235,10 @@ func main() {
 			log.WithError(err).Warn("Error stopping gRPC client")
 		}
 
+		if tlsConfig != nil && tlsConfig.CertMgr != nil {
+			tlsConfig.CertMgr.Stop()
+		}
+
 		if err := db.Close(); err != nil {
 			log.WithError(err).Warn("Error closing database")
 		}
@@ -9,10 +9,13 @@ import (
 
 	"github.com/metorial/fleet/cosmos/internal/controller/api"
 	"github.com/metorial/fleet/cosmos/internal/controller/database"
+	"github.com/metorial/fleet/cosmos/internal/controller/events"
 	grpcserver "github.com/metorial/fleet/cosmos/internal/controller/grpc"
 	"github.com/metorial/fleet/cosmos/internal/controller/jobs"
+	"github.com/metorial/fleet/cosmos/internal/controller/leader"
 	"github.com/metorial/fleet/cosmos/internal/controller/managers"
 	"github.com/metorial/fleet/cosmos/internal/controller/reconciler"
+	"github.com/metorial/fleet/cosmos/internal/controller/types"
 	"github.com/metorial/fleet/cosmos/internal/util"
 	log "github.com/sirupsen/logrus"
 )
@@ -33,6 +36,13 @@ func main() {
 	}
 	defer db.Close()
 
+	if config.DatabaseAutoMigrate {
+		log.Warn("Running AutoMigrate on the database; use versioned migrations outside development")
+		if err := db.AutoMigrate(); err != nil {
+			log.WithError(err).Fatal("Failed to auto-migrate database")
+		}
+	}
+
 	log.Info("Database connected and migrated")
 
 	var tlsConfig *util.TLSConfigWrapper
@@ -41,14 +51,17 @@ func main() {
 			log.Info("Initializing Vault certificate manager")
 
 			certMgr, err := util.NewVaultCertManager(&util.VaultCertConfig{
-				VaultAddr:  config.VaultAddr,
-				VaultToken: config.VaultToken,
-				PKIPath:    config.VaultPKIPath,
-				Role:       config.VaultPKIRole,
-				CertPath:   config.TLSCertPath,
-				KeyPath:    config.TLSKeyPath,
-				CAPath:     config.TLSCAPath,
-				TTL:        config.CertTTL,
+				VaultAddr:   config.VaultAddr,
+				VaultToken:  config.VaultToken,
+				RoleID:      config.VaultRoleID,
+				SecretID:    config.VaultSecretID,
+				AppRolePath: config.VaultAppRolePath,
+				PKIPath:     config.VaultPKIPath,
+				Role:        config.VaultPKIRole,
+				CertPath:    config.TLSCertPath,
+				KeyPath:     config.TLSKeyPath,
+				CAPath:      config.TLSCAPath,
+				TTL:         config.CertTTL,
 			})
 			if err != nil {
 				log.WithError(err).Fatal("Failed to create Vault certificate manager")
@@ -57,7 +70,7 @@ func main() {
 			shouldRenew, err := certMgr.ShouldRenew(config.CertRenewBefore)
 			if err != nil || shouldRenew {
 				log.Info("Obtaining certificate from Vault")
-				if err := certMgr.ObtainCertificate(); err != nil {
+				if err := certMgr.ObtainCertificateWithRetry(config.VaultRetryAttempts, config.VaultRetryBackoff); err != nil {
 					log.WithError(err).Fatal("Failed to obtain certificate")
 				}
 			}
@@ -94,9 +107,14 @@ func main() {
 		grpcTLS = tlsConfig
 	}
 
+	// Deployment progress from the reconciler and agents, streamed by the API
+	bus := events.NewBus()
+
 	grpcServerConfig := &grpcserver.ServerConfig{
-		DB:   db,
-		Port: config.GRPCPort,
+		DB:           db,
+		Events:       bus,
+		Port:         config.GRPCPort,
+		AgentTimeout: config.AgentTimeout,
 	}
 
 	if grpcTLS != nil {
@@ -104,36 +122,161 @@ func main() {
 	}
 
 	grpcServer := grpcserver.NewServer(grpcServerConfig)
-	if err := grpcServer.Start(); err != nil {
-		log.WithError(err).Fatal("Failed to start gRPC server")
-	}
-	log.WithField("port", config.GRPCPort).Info("gRPC server started")
 
-	scriptMgr := managers.NewScriptManager(config.CommandCoreURL)
+	scriptMgr := managers.NewScriptManager(&managers.ScriptManagerConfig{
+		CommandCoreURL: config.CommandCoreURL,
+		Timeout:        config.CommandCoreTimeout,
+		MaxRetries:     config.CommandCoreRetries,
+		RetryBackoff:   config.CommandCoreRetryBackoff,
+	})
 	programMgr := managers.NewProgramManager()
-	serviceMgr := managers.NewServiceManager(config.NomadAddr)
+	serviceMgr := managers.NewServiceManager(&managers.ServiceManagerConfig{
+		NomadAddr:     config.NomadAddr,
+		Namespace:     config.NomadNamespace,
+		Region:        config.NomadRegion,
+		Token:         config.NomadToken,
+		DeployTimeout: config.DeploymentTimeout,
+	})
 
-	rec := reconciler.NewReconciler(&reconciler.ReconcilerConfig{
+	reconcilerConfig := &reconciler.ReconcilerConfig{
 		DB:         db,
 		GRPCServer: grpcServer,
+		Events:     bus,
 		ScriptMgr:  scriptMgr,
 		ProgramMgr: programMgr,
 		ServiceMgr: serviceMgr,
-	})
 
-	apiServer := api.NewServer(&api.ServerConfig{
+		DeploymentTimeout: config.DeploymentTimeout,
+	}
+
+	if config.K8sAPIServer != "" {
+		k8sMgr, err := managers.NewKubernetesManager(&managers.KubernetesManagerConfig{
+			APIServer: config.K8sAPIServer,
+			Token:     config.K8sToken,
+			CAPath:    config.K8sCAPath,
+			Namespace: config.K8sNamespace,
+		})
+		if err != nil {
+			log.WithError(err).Fatal("Failed to create Kubernetes manager")
+		}
+		reconcilerConfig.K8sMgr = k8sMgr
+	}
+
+	if config.DefaultHealthCheckType != "" {
+		reconcilerConfig.DefaultHealthCheck = &types.HealthCheckConfig{
+			Type:            config.DefaultHealthCheckType,
+			Endpoint:        config.DefaultHealthCheckEndpoint,
+			IntervalSeconds: int32(config.DefaultHealthCheckInterval.Seconds()),
+			TimeoutSeconds:  int32(config.DefaultHealthCheckTimeout.Seconds()),
+			Retries:         int32(config.DefaultHealthCheckRetries),
+		}
+		reconcilerConfig.DefaultHealthCheckTypes = config.DefaultHealthCheckComponentTypes
+
+		log.WithFields(log.Fields{
+			"type":            config.DefaultHealthCheckType,
+			"component_types": config.DefaultHealthCheckComponentTypes,
+		}).Info("Default health check enabled")
+	}
+
+	rec := reconciler.NewReconciler(reconcilerConfig)
+
+	// Agents that reconnect may have lost or missed deployments
+	grpcServer.SetConnectHandler(rec.SyncNode)
+
+	var elector *leader.Elector
+	if config.LeaderElection {
+		grpcServer.SetLeaderCheck(func() bool {
+			return elector != nil && elector.IsLeader()
+		})
+	}
+
+	if err := grpcServer.Start(); err != nil {
+		log.WithError(err).Fatal("Failed to start gRPC server")
+	}
+	log.WithField("port", config.GRPCPort).Info("gRPC server started")
+
+	var jobsMgr *jobs.JobsManager
+
+	// startLeading runs the background jobs and the pending deployment loop
+	// until ctx is cancelled. Only one controller runs these at a time.
+	startLeading := func(ctx context.Context) {
+		jobsMgr = jobs.NewJobsManager(&jobs.JobsConfig{
+			DB:                  db,
+			CommandCoreURL:      config.CommandCoreURL,
+			NodeSource:          config.NodeSource,
+			ConsulAddr:          config.ConsulAddr,
+			AgentTimeout:        config.AgentTimeout,
+			NodeSyncInterval:    config.NodeSyncInterval,
+			CleanupInterval:     config.CleanupInterval,
+			DeploymentRetention: config.DeploymentRetention,
+		})
+		jobsMgr.Start()
+
+		go func() {
+			// Revert what an earlier leader left half-applied before new
+			// deployments compute their plans
+			rec.RecoverInterruptedDeployments()
+			rec.RunPendingDeployments(ctx, 10*time.Second)
+		}()
+	}
+
+	stopLeading := func() {
+		grpcServer.CloseStreams()
+		if jobsMgr != nil {
+			jobsMgr.Stop()
+			jobsMgr = nil
+		}
+	}
+
+	apiConfig := &api.ServerConfig{
 		DB:         db,
 		Reconciler: rec,
+		Agents:     grpcServer,
+		Events:     bus,
 		Port:       config.HTTPPort,
-	})
+
+		AuthEnabled: config.APIAuthEnabled,
+		AuthToken:   config.APIToken,
+	}
+
+	if config.LeaderElection {
+		elector = leader.NewElector(&leader.ElectorConfig{
+			DB:               db,
+			ID:               config.ControllerID,
+			LeaseDuration:    config.LeaderLeaseDuration,
+			OnStartedLeading: startLeading,
+			OnStoppedLeading: stopLeading,
+		})
+		apiConfig.Leader = elector
+	}
+
+	if !config.APIAuthEnabled {
+		log.Warn("API authentication is disabled; set COSMOS_API_AUTH_ENABLED to require bearer tokens")
+	}
+
+	if config.APIBootstrapKey != "" {
+		created, err := db.BootstrapAPIKey(config.APIBootstrapKey)
+		if err != nil {
+			log.WithError(err).Fatal("Failed to store bootstrap API key")
+		}
+		if created {
+			log.Info("Stored bootstrap admin API key")
+		}
+	}
+
+	apiServer := api.NewServer(apiConfig)
 
 	if err := apiServer.Start(); err != nil {
 		log.WithError(err).Fatal("Failed to start API server")
 	}
 	log.WithField("port", config.HTTPPort).Info("API server started")
 
-	jobsMgr := jobs.NewJobsManager(db, config.CommandCoreURL)
-	jobsMgr.Start()
+	leaderCtx, stopLeaderWork := context.WithCancel(context.Background())
+	if elector != nil {
+		elector.Start()
+	} else {
+		startLeading(leaderCtx)
+	}
 
 	log.Info("Cosmos Controller is running")
 
@@ -143,7 +286,12 @@ func main() {
 		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 		defer cancel()
 
-		jobsMgr.Stop()
+		if elector != nil {
+			elector.Stop()
+		} else {
+			stopLeaderWork()
+			stopLeading()
+		}
 
 		if err := apiServer.Stop(); err != nil {
 			log.WithError(err).Warn("Error stopping API server")
@@ -153,6 +301,10 @@ func main() {
 			log.WithError(err).Warn("Error stopping gRPC server")
 		}
 
+		if tlsConfig != nil && tlsConfig.CertMgr != nil {
+			tlsConfig.CertMgr.Stop()
+		}
+
 		if err := db.Close(); err != nil {
 			log.WithError(err).Warn("Error closing database")
 		}
@@ -0,0 +1,155 @@
+package component
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// cacheDir holds downloaded archives by hash, so a second deployment of the
+// same artifact, by the same component or another, doesn't download it again
+func (m *Manager) cacheDir() string {
+	return filepath.Join(m.dataDir, "cache")
+}
+
+// cacheable reports whether hash can name a file in the cache
+func cacheable(hash string) bool {
+	return hash != "" && hash != "." && hash != ".." && filepath.Base(hash) == hash && !strings.HasPrefix(hash, ".")
+}
+
+// acquireCachedArchive returns the cached archive with the given hash. The
+// file is hashed again first, so a corrupted copy is dropped and downloaded
+// again. The archive isn't evicted until release is called.
+func (m *Manager) acquireCachedArchive(hash string) (path string, release func(), ok bool) {
+	if !cacheable(hash) {
+		return "", nil, false
+	}
+	path = filepath.Join(m.cacheDir(), hash)
+
+	m.cacheMu.Lock()
+	if info, err := os.Stat(path); err != nil || !info.Mode().IsRegular() {
+		m.cacheMu.Unlock()
+		return "", nil, false
+	}
+	m.cacheInUse[hash]++
+	m.cacheMu.Unlock()
+	release = func() { m.releaseCachedArchive(hash) }
+
+	file, err := os.Open(path)
+	if err != nil {
+		release()
+		return "", nil, false
+	}
+	actualHash, err := hashFile(file)
+	file.Close()
+	if err != nil || actualHash != hash {
+		log.WithFields(log.Fields{
+			"hash":   hash,
+			"actual": actualHash,
+		}).Warn("Cached archive is corrupt, downloading it again")
+		m.cacheMu.Lock()
+		os.Remove(path)
+		m.cacheMu.Unlock()
+		release()
+		return "", nil, false
+	}
+
+	// Eviction goes by when an archive was last used
+	now := time.Now()
+	os.Chtimes(path, now, now)
+
+	return path, release, true
+}
+
+// cacheArchive moves a downloaded and verified archive into the cache and
+// evicts what no longer fits. It returns the archive's new path, and release
+// to call once the archive has been extracted; when the archive can't be
+// cached it stays where it is and release removes it.
+func (m *Manager) cacheArchive(filePath, hash string) (string, func()) {
+	remove := func() { os.Remove(filePath) }
+	if !cacheable(hash) {
+		return filePath, remove
+	}
+
+	if err := os.MkdirAll(m.cacheDir(), 0755); err != nil {
+		log.WithError(err).Warn("Failed to create download cache")
+		return filePath, remove
+	}
+
+	path := filepath.Join(m.cacheDir(), hash)
+	m.cacheMu.Lock()
+	if err := moveFile(filePath, path); err != nil {
+		m.cacheMu.Unlock()
+		log.WithError(err).WithField("hash", hash).Warn("Failed to cache archive")
+		return filePath, remove
+	}
+	m.cacheInUse[hash]++
+	m.cacheMu.Unlock()
+
+	m.evictCache()
+	return path, func() { m.releaseCachedArchive(hash) }
+}
+
+func (m *Manager) releaseCachedArchive(hash string) {
+	m.cacheMu.Lock()
+	defer m.cacheMu.Unlock()
+	if m.cacheInUse[hash]--; m.cacheInUse[hash] <= 0 {
+		delete(m.cacheInUse, hash)
+	}
+}
+
+// evictCache removes archives unused for longer than CacheMaxAge, then the
+// least recently used until the cache is within CacheMaxSize. Archives being
+// deployed are kept.
+func (m *Manager) evictCache() {
+	m.cacheMu.Lock()
+	defer m.cacheMu.Unlock()
+
+	entries, err := os.ReadDir(m.cacheDir())
+	if err != nil {
+		return
+	}
+
+	type cachedFile struct {
+		name    string
+		size    int64
+		modTime time.Time
+	}
+	var files []cachedFile
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		files = append(files, cachedFile{entry.Name(), info.Size(), info.ModTime()})
+	}
+
+	// Newest first, so the oldest are removed once the total is over
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].modTime.After(files[j].modTime)
+	})
+
+	var total int64
+	for _, file := range files {
+		expired := time.Since(file.modTime) > m.downloadOpts.CacheMaxAge
+		if m.cacheInUse[file.name] > 0 || (!expired && total+file.size <= m.downloadOpts.CacheMaxSize) {
+			total += file.size
+			continue
+		}
+
+		if err := os.Remove(filepath.Join(m.cacheDir(), file.name)); err != nil {
+			log.WithError(err).WithField("hash", file.name).Warn("Failed to evict cached archive")
+			total += file.size
+			continue
+		}
+		log.WithFields(log.Fields{
+			"hash":    file.name,
+			"size":    file.size,
+			"expired": expired,
+		}).Info("Evicted cached archive")
+	}
+}
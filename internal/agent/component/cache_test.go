@@ -0,0 +1,106 @@
+package component
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/metorial/fleet/cosmos/internal/agent/database"
+)
+
+func TestDeployProgramsShareCachedArchive(t *testing.T) {
+	dataDir := t.TempDir()
+	db, err := database.NewAgentDB(dataDir)
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	defer db.Close()
+
+	archive := []byte("#!/bin/sh\nexec sleep 300\n")
+	var downloads atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Not counting the size probe made before each download
+		if r.Header.Get("Range") != "bytes=0-0" {
+			downloads.Add(1)
+		}
+		http.ServeContent(w, r, "app", time.Time{}, bytes.NewReader(archive))
+	}))
+	defer server.Close()
+
+	m := NewManager(db, dataDir)
+	m.SetDownloadOptions(DownloadOptions{MinFreeSpace: 1})
+
+	for _, name := range []string{"first", "second"} {
+		if err := m.DeployProgram(&database.Component{Name: name, Type: "program", Hash: hashOf(archive), ContentURL: server.URL}); err != nil {
+			t.Fatalf("Failed to deploy %s: %v", name, err)
+		}
+		defer m.StopComponent(name)
+	}
+	if got := downloads.Load(); got != 1 {
+		t.Errorf("Expected the shared archive to be downloaded once, got %d downloads", got)
+	}
+
+	// A corrupted copy isn't reused
+	cached := filepath.Join(dataDir, "cache", hashOf(archive))
+	if err := os.WriteFile(cached, []byte("corrupt"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.DeployProgram(&database.Component{Name: "third", Type: "program", Hash: hashOf(archive), ContentURL: server.URL}); err != nil {
+		t.Fatalf("Failed to deploy third: %v", err)
+	}
+	defer m.StopComponent("third")
+	if got := downloads.Load(); got != 2 {
+		t.Errorf("Expected the corrupted archive to be downloaded again, got %d downloads", got)
+	}
+	if data, err := os.ReadFile(cached); err != nil || !bytes.Equal(data, archive) {
+		t.Errorf("Expected the cache to hold the archive again, got %q (%v)", data, err)
+	}
+}
+
+func TestEvictCache(t *testing.T) {
+	m := NewManager(nil, t.TempDir())
+	m.SetDownloadOptions(DownloadOptions{CacheMaxSize: 250, CacheMaxAge: time.Hour})
+	if err := os.MkdirAll(m.cacheDir(), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// Last used the given time ago
+	files := map[string]time.Duration{
+		"newest":   time.Minute,
+		"newer":    2 * time.Minute,
+		"older":    3 * time.Minute,
+		"expired":  2 * time.Hour,
+		"deployed": 3 * time.Hour,
+	}
+	for name, age := range files {
+		path := filepath.Join(m.cacheDir(), name)
+		if err := os.WriteFile(path, []byte(strings.Repeat("x", 100)), 0644); err != nil {
+			t.Fatal(err)
+		}
+		used := time.Now().Add(-age)
+		if err := os.Chtimes(path, used, used); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m.cacheInUse["deployed"] = 1
+
+	m.evictCache()
+
+	// The newest that fit within the size are kept along with the one in use
+	for name := range files {
+		_, err := os.Stat(filepath.Join(m.cacheDir(), name))
+		kept := name == "newest" || name == "newer" || name == "deployed"
+		if kept && err != nil {
+			t.Errorf("Expected %s to be kept, got %v", name, err)
+		}
+		if !kept && !os.IsNotExist(err) {
+			t.Errorf("Expected %s to be evicted, got %v", name, err)
+		}
+	}
+}
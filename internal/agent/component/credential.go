@@ -0,0 +1,107 @@
+package component
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/metorial/fleet/cosmos/internal/agent/database"
+)
+
+// componentCredential resolves the user and group a component runs as. It
+// returns nil when the component runs as the agent's own user.
+func componentCredential(component *database.Component) (*syscall.Credential, error) {
+	if component.RunAsUser == "" && component.RunAsGroup == "" {
+		return nil, nil
+	}
+
+	credential := &syscall.Credential{Uid: uint32(os.Getuid()), Gid: uint32(os.Getgid())}
+
+	if component.RunAsUser != "" {
+		u, err := lookupUser(component.RunAsUser)
+		if err != nil {
+			return nil, fmt.Errorf("run_as_user %q does not exist on this node", component.RunAsUser)
+		}
+		uid, _ := strconv.ParseUint(u.Uid, 10, 32)
+		gid, _ := strconv.ParseUint(u.Gid, 10, 32)
+		credential.Uid = uint32(uid)
+		credential.Gid = uint32(gid)
+
+		// The user's supplementary groups replace the agent's, as if it
+		// had logged in
+		groupIDs, _ := u.GroupIds()
+		for _, id := range groupIDs {
+			if gid, err := strconv.ParseUint(id, 10, 32); err == nil && uint32(gid) != credential.Gid {
+				credential.Groups = append(credential.Groups, uint32(gid))
+			}
+		}
+	}
+
+	if component.RunAsGroup != "" {
+		g, err := lookupGroup(component.RunAsGroup)
+		if err != nil {
+			return nil, fmt.Errorf("run_as_group %q does not exist on this node", component.RunAsGroup)
+		}
+		gid, _ := strconv.ParseUint(g.Gid, 10, 32)
+		credential.Gid = uint32(gid)
+	}
+
+	return credential, nil
+}
+
+// lookupUser finds a user by name, or by id when name is numeric
+func lookupUser(name string) (*user.User, error) {
+	if _, err := strconv.ParseUint(name, 10, 32); err == nil {
+		return user.LookupId(name)
+	}
+	return user.Lookup(name)
+}
+
+// lookupGroup finds a group by name, or by id when name is numeric
+func lookupGroup(name string) (*user.Group, error) {
+	if _, err := strconv.ParseUint(name, 10, 32); err == nil {
+		return user.LookupGroupId(name)
+	}
+	return user.LookupGroup(name)
+}
+
+// chownComponentFiles gives the component's user its log file and its files:
+// the deployed version of a program, which is also its working directory, or
+// a script's file. The scripts directory is shared, so it stays the agent's.
+func (m *Manager) chownComponentFiles(component *database.Component, logPath string, credential *syscall.Credential) error {
+	uid, gid := int(credential.Uid), int(credential.Gid)
+
+	if err := os.Chown(logPath, uid, gid); err != nil {
+		return fmt.Errorf("failed to chown log file: %w", err)
+	}
+
+	programDir := filepath.Join(m.dataDir, "programs", component.Name)
+	if !strings.HasPrefix(component.Executable, programDir+string(filepath.Separator)) {
+		if err := os.Chown(component.Executable, uid, gid); err != nil {
+			return fmt.Errorf("failed to chown %s: %w", component.Executable, err)
+		}
+		return nil
+	}
+
+	versionDir, err := filepath.EvalSymlinks(filepath.Join(programDir, currentVersionLink))
+	if err != nil {
+		// Programs deployed before versions had directories of their own
+		versionDir = programDir
+	}
+
+	err = filepath.WalkDir(versionDir, func(path string, _ fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Lchown(path, uid, gid)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to chown program files: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package component
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/metorial/fleet/cosmos/internal/agent/database"
+)
+
+func TestComponentCredential(t *testing.T) {
+	credential, err := componentCredential(&database.Component{Name: "app"})
+	if err != nil || credential != nil {
+		t.Errorf("Expected no credential without run_as_user, got %v (%v)", credential, err)
+	}
+
+	credential, err = componentCredential(&database.Component{Name: "app", RunAsUser: "65534", RunAsGroup: "0"})
+	if err != nil {
+		t.Skipf("No user 65534 on this node: %v", err)
+	}
+	if credential.Uid != 65534 || credential.Gid != 0 {
+		t.Errorf("Expected uid 65534 and gid 0, got %d and %d", credential.Uid, credential.Gid)
+	}
+
+	_, err = componentCredential(&database.Component{Name: "app", RunAsUser: "no-such-user"})
+	if err == nil || err.Error() != `run_as_user "no-such-user" does not exist on this node` {
+		t.Errorf("Expected a missing user to be reported, got %v", err)
+	}
+	_, err = componentCredential(&database.Component{Name: "app", RunAsGroup: "no-such-group"})
+	if err == nil || err.Error() != `run_as_group "no-such-group" does not exist on this node` {
+		t.Errorf("Expected a missing group to be reported, got %v", err)
+	}
+}
+
+func TestStartComponentRunsAsUser(t *testing.T) {
+	if runtime.GOOS != "linux" || os.Geteuid() != 0 {
+		t.Skip("switching users needs root on Linux")
+	}
+	credential, err := componentCredential(&database.Component{RunAsUser: "nobody"})
+	if err != nil {
+		t.Skipf("No nobody user on this node: %v", err)
+	}
+
+	// The component's user must be able to reach its files
+	dataDir := t.TempDir()
+	for dir := dataDir; strings.HasPrefix(dir, os.TempDir()+"/"); dir = filepath.Dir(dir) {
+		if err := os.Chmod(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	db, err := database.NewAgentDB(dataDir)
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	defer db.Close()
+
+	programDir := filepath.Join(dataDir, "programs", "app")
+	versionDir := filepath.Join(programDir, "v1")
+	if err := os.MkdirAll(versionDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	// The program proves it can write to its working directory
+	script := "#!/bin/sh\nid -u > uid\nexec sleep 300\n"
+	if err := os.WriteFile(filepath.Join(versionDir, "app"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("v1", filepath.Join(programDir, currentVersionLink)); err != nil {
+		t.Fatal(err)
+	}
+
+	component := &database.Component{
+		Name:       "app",
+		Type:       "program",
+		Hash:       "h",
+		Executable: filepath.Join(programDir, currentVersionLink, "app"),
+		RunAsUser:  "nobody",
+	}
+	if err := db.UpsertComponent(component); err != nil {
+		t.Fatalf("Failed to store component: %v", err)
+	}
+
+	m := NewManager(db, dataDir)
+	if err := m.StartComponent("app"); err != nil {
+		t.Fatalf("Failed to start component: %v", err)
+	}
+	defer m.StopComponent("app")
+
+	var uid string
+	deadline := time.Now().Add(5 * time.Second)
+	for uid == "" {
+		if time.Now().After(deadline) {
+			t.Fatal("Program never wrote its uid")
+		}
+		if data, err := os.ReadFile(filepath.Join(versionDir, "uid")); err == nil {
+			uid = strings.TrimSpace(string(data))
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if uid != strconv.Itoa(int(credential.Uid)) {
+		t.Errorf("Expected the program to run as uid %d, got %s", credential.Uid, uid)
+	}
+
+	for _, path := range []string{versionDir, filepath.Join(dataDir, "logs", "app.log")} {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if owner := info.Sys().(*syscall.Stat_t).Uid; owner != credential.Uid {
+			t.Errorf("Expected %s to be owned by uid %d, got %d", path, credential.Uid, owner)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package component
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// extractionSpaceFactor is how many times an artifact's size the data dir
+// must have free for it, since an extracted archive can be several times
+// larger than the download
+const extractionSpaceFactor = 3
+
+// statfs is syscall.Statfs, replaceable in tests
+var statfs = syscall.Statfs
+
+// insufficientSpaceError means a download was refused because it would leave
+// too little free space. Retrying won't help, so it fails immediately.
+type insufficientSpaceError struct {
+	dir  string
+	need uint64
+	free uint64
+}
+
+func (e *insufficientSpaceError) Error() string {
+	return fmt.Sprintf("not enough disk space in %s: need %d bytes, %d free", e.dir, e.need, e.free)
+}
+
+// checkDiskSpace refuses a download of size bytes unless the system temp
+// dir, where it lands, has room for it and the data dir has room for the
+// extracted program with MinFreeSpace to spare. Filesystems that can't be
+// inspected don't block the download.
+func (m *Manager) checkDiskSpace(size int64) error {
+	if size <= 0 {
+		return nil
+	}
+
+	tempDir := os.TempDir()
+	download := uint64(size)
+
+	if m.dataDir == "" {
+		return requireFreeSpace(tempDir, download)
+	}
+
+	need := download*extractionSpaceFactor + uint64(max(m.downloadOpts.MinFreeSpace, 0))
+	if sameFilesystem(tempDir, m.dataDir) {
+		return requireFreeSpace(m.dataDir, need+download)
+	}
+
+	if err := requireFreeSpace(tempDir, download); err != nil {
+		return err
+	}
+	return requireFreeSpace(m.dataDir, need)
+}
+
+func requireFreeSpace(dir string, need uint64) error {
+	var stat syscall.Statfs_t
+	if err := statfs(dir, &stat); err != nil {
+		log.WithError(err).WithField("dir", dir).Warn("Failed to check free disk space")
+		return nil
+	}
+
+	free := uint64(stat.Bavail) * uint64(stat.Bsize)
+	if free < need {
+		return &insufficientSpaceError{dir: dir, need: need, free: free}
+	}
+	return nil
+}
+
+func sameFilesystem(a, b string) bool {
+	infoA, errA := os.Stat(a)
+	infoB, errB := os.Stat(b)
+	if errA != nil || errB != nil {
+		return false
+	}
+
+	statA, okA := infoA.Sys().(*syscall.Stat_t)
+	statB, okB := infoB.Sys().(*syscall.Stat_t)
+	return okA && okB && statA.Dev == statB.Dev
+}
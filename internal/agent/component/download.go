@@ -0,0 +1,698 @@
+package component
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/metorial/fleet/cosmos/internal/agent/database"
+	log "github.com/sirupsen/logrus"
+)
+
+// DownloadOptions tunes how artifacts are fetched. Files larger than
+// ParallelThreshold are downloaded as concurrent byte ranges when the server
+// supports it. Timeout bounds the whole download; StallTimeout bounds how
+// long a request may go without receiving data. Downloads are refused when
+// they would leave less than MinFreeSpace bytes free in the data dir once
+// extracted. Downloaded archives are cached by hash; archives unused for
+// CacheMaxAge are evicted, as are the least recently used once the cache
+// holds more than CacheMaxSize bytes.
+type DownloadOptions struct {
+	Concurrency       int
+	ChunkSize         int64
+	ParallelThreshold int64
+	Timeout           time.Duration
+	StallTimeout      time.Duration
+	MinFreeSpace      int64
+	CacheMaxSize      int64
+	CacheMaxAge       time.Duration
+}
+
+var defaultDownloadOptions = DownloadOptions{
+	Concurrency:       4,
+	ChunkSize:         16 * 1024 * 1024,
+	ParallelThreshold: 64 * 1024 * 1024,
+	Timeout:           10 * time.Minute,
+	StallTimeout:      30 * time.Second,
+	MinFreeSpace:      256 * 1024 * 1024,
+	CacheMaxSize:      2 * 1024 * 1024 * 1024,
+	CacheMaxAge:       7 * 24 * time.Hour,
+}
+
+// RetryPolicy controls how failed downloads are retried. The delay before
+// each retry doubles from BaseDelay up to MaxDelay.
+type RetryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+var defaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 4,
+	BaseDelay:   time.Second,
+	MaxDelay:    30 * time.Second,
+}
+
+// errRangesUnsupported means the server ignored a Range request, so the
+// download falls back to a single stream
+var errRangesUnsupported = errors.New("server does not support range requests")
+
+// statusError is an unexpected HTTP status from the artifact server
+type statusError struct {
+	code int
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("download failed with status: %d", e.code)
+}
+
+// retryable reports whether a failed attempt is worth repeating. Client
+// errors such as 403 or 404 won't fix themselves, so they fail immediately.
+func retryable(err error) bool {
+	var spaceErr *insufficientSpaceError
+	if errors.As(err, &spaceErr) {
+		return false
+	}
+
+	var statusErr *statusError
+	if errors.As(err, &statusErr) {
+		return statusErr.code >= 500 ||
+			statusErr.code == http.StatusRequestTimeout ||
+			statusErr.code == http.StatusTooManyRequests
+	}
+	return true
+}
+
+func (m *Manager) SetDownloadOptions(opts DownloadOptions) {
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = defaultDownloadOptions.Concurrency
+	}
+	if opts.ChunkSize <= 0 {
+		opts.ChunkSize = defaultDownloadOptions.ChunkSize
+	}
+	if opts.ParallelThreshold <= 0 {
+		opts.ParallelThreshold = defaultDownloadOptions.ParallelThreshold
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = defaultDownloadOptions.Timeout
+	}
+	if opts.StallTimeout <= 0 {
+		opts.StallTimeout = defaultDownloadOptions.StallTimeout
+	}
+	if opts.MinFreeSpace <= 0 {
+		opts.MinFreeSpace = defaultDownloadOptions.MinFreeSpace
+	}
+	if opts.CacheMaxSize <= 0 {
+		opts.CacheMaxSize = defaultDownloadOptions.CacheMaxSize
+	}
+	if opts.CacheMaxAge <= 0 {
+		opts.CacheMaxAge = defaultDownloadOptions.CacheMaxAge
+	}
+	m.downloadOpts = opts
+}
+
+func (m *Manager) SetRetryPolicy(policy RetryPolicy) {
+	if policy.MaxAttempts <= 0 {
+		policy.MaxAttempts = defaultRetryPolicy.MaxAttempts
+	}
+	if policy.BaseDelay <= 0 {
+		policy.BaseDelay = defaultRetryPolicy.BaseDelay
+	}
+	if policy.MaxDelay <= 0 {
+		policy.MaxDelay = defaultRetryPolicy.MaxDelay
+	}
+	m.retryPolicy = policy
+}
+
+// fetchFile downloads url into file and returns its SHA-256. Failed attempts
+// are retried per the retry policy; when the server accepts ranges, a retry
+// resumes from the bytes already written instead of starting over. Errors
+// caused by the overall timeout are returned as such rather than as the
+// transport error they produced.
+func (m *Manager) fetchFile(ctx context.Context, url string, headers http.Header, file *os.File) (string, error) {
+	policy := m.retryPolicy
+	delay := policy.BaseDelay
+
+	// resumable is set once a streamed response advertises byte ranges, so
+	// the partial file left by a failed attempt can be continued
+	resumable := false
+
+	for attempt := 1; ; attempt++ {
+		err := m.fetchAttempt(ctx, url, headers, file, &resumable)
+		if err == nil {
+			break
+		}
+
+		if cause := context.Cause(ctx); cause != nil {
+			return "", cause
+		}
+
+		if attempt >= policy.MaxAttempts || !retryable(err) {
+			return "", err
+		}
+
+		log.WithError(err).WithFields(log.Fields{
+			"url":          url,
+			"attempt":      attempt,
+			"max_attempts": policy.MaxAttempts,
+			"retry_in":     delay,
+			"resume":       resumable,
+		}).Warn("Download failed, retrying")
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return "", context.Cause(ctx)
+		}
+		delay = min(delay*2, policy.MaxDelay)
+	}
+
+	// Hash the assembled file rather than the last response, which may only
+	// have carried the tail of it
+	hash, err := hashFile(file)
+	if err != nil {
+		return "", fmt.Errorf("failed to hash file: %w", err)
+	}
+
+	return hash, nil
+}
+
+// fetchAttempt makes one pass at the download. It continues a partial file
+// when the previous attempt left one the server can resume, and otherwise
+// starts over.
+func (m *Manager) fetchAttempt(ctx context.Context, url string, headers http.Header, file *os.File, resumable *bool) error {
+	if *resumable {
+		info, err := file.Stat()
+		if err != nil {
+			return fmt.Errorf("failed to stat partial file: %w", err)
+		}
+		if info.Size() > 0 {
+			return m.downloadStream(ctx, url, headers, file, info.Size(), resumable)
+		}
+	}
+
+	if err := resetFile(file); err != nil {
+		return err
+	}
+
+	handled, err := m.downloadParallel(ctx, url, headers, file)
+	if err != nil || handled {
+		// Ranged chunks leave holes on failure, so they can't be resumed
+		*resumable = false
+		return err
+	}
+
+	return m.downloadStream(ctx, url, headers, file, 0, resumable)
+}
+
+func resetFile(file *os.File) error {
+	if err := file.Truncate(0); err != nil {
+		return fmt.Errorf("failed to reset file: %w", err)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to reset file: %w", err)
+	}
+	return nil
+}
+
+// stallWatchdog cancels a request when no data arrives for the stall timeout.
+// The timer runs from before the request is sent so a server that never
+// responds is caught too.
+type stallWatchdog struct {
+	timeout time.Duration
+	timer   *time.Timer
+}
+
+func newStallWatchdog(timeout time.Duration, cancel context.CancelCauseFunc) *stallWatchdog {
+	return &stallWatchdog{
+		timeout: timeout,
+		timer: time.AfterFunc(timeout, func() {
+			cancel(fmt.Errorf("download stalled: no data received for %s", timeout))
+		}),
+	}
+}
+
+func (w *stallWatchdog) reader(r io.Reader) io.Reader {
+	return readerFunc(func(p []byte) (int, error) {
+		n, err := r.Read(p)
+		if n > 0 {
+			w.timer.Reset(w.timeout)
+		}
+		return n, err
+	})
+}
+
+func (w *stallWatchdog) stop() {
+	w.timer.Stop()
+}
+
+type readerFunc func(p []byte) (int, error)
+
+func (f readerFunc) Read(p []byte) (int, error) {
+	return f(p)
+}
+
+// requestError returns why a request was cancelled (timeout or stall) if it
+// was, or err otherwise
+func requestError(ctx context.Context, err error) error {
+	if cause := context.Cause(ctx); cause != nil {
+		return cause
+	}
+	return err
+}
+
+// downloadStream fetches url as a single response, appending to file from
+// offset. A non-zero offset is requested with a Range header; if the server
+// answers with the whole file instead, the file is rewritten from the start.
+// resumable records whether the server advertised byte ranges.
+func (m *Manager) downloadStream(ctx context.Context, url string, headers http.Header, file *os.File, offset int64, resumable *bool) error {
+	reqCtx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	watchdog := newStallWatchdog(m.downloadOpts.StallTimeout, cancel)
+	defer watchdog.stop()
+
+	req, err := newDownloadRequest(reqCtx, url, headers)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	resp, err := m.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to download: %w", requestError(reqCtx, err))
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case offset > 0 && resp.StatusCode == http.StatusPartialContent:
+		if !strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", offset)) {
+			*resumable = false
+			return fmt.Errorf("unexpected Content-Range in resumed download: %q", resp.Header.Get("Content-Range"))
+		}
+		log.WithFields(log.Fields{
+			"url":    url,
+			"offset": offset,
+		}).Info("Resuming download")
+
+	case offset > 0 && resp.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+		*resumable = false
+		return fmt.Errorf("server rejected resume from byte %d", offset)
+
+	case resp.StatusCode == http.StatusOK:
+		// Servers without ranges can only be sized by the response itself
+		if err := m.checkDiskSpace(resp.ContentLength); err != nil {
+			return err
+		}
+		*resumable = resp.Header.Get("Accept-Ranges") == "bytes"
+		if offset > 0 {
+			log.WithField("url", url).Warn("Server ignored resume request, restarting download")
+			offset = 0
+			if err := resetFile(file); err != nil {
+				return err
+			}
+		}
+
+	default:
+		return &statusError{code: resp.StatusCode}
+	}
+
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to seek file: %w", err)
+	}
+
+	progress := progressFrom(ctx)
+	if resp.ContentLength > 0 {
+		progress.start(offset+resp.ContentLength, offset)
+	} else {
+		progress.start(0, offset)
+	}
+
+	if _, err := io.Copy(file, io.TeeReader(watchdog.reader(resp.Body), progress)); err != nil {
+		return fmt.Errorf("failed to save file: %w", requestError(reqCtx, err))
+	}
+
+	return nil
+}
+
+// probeRangeSupport requests the first byte of url. A 206 response carries
+// the full size in Content-Range. A GET is used rather than HEAD because
+// signed object storage URLs are only valid for the method they were signed
+// for.
+func (m *Manager) probeRangeSupport(ctx context.Context, url string, headers http.Header) (int64, bool) {
+	reqCtx, cancel := context.WithTimeout(ctx, m.downloadOpts.StallTimeout)
+	defer cancel()
+
+	req, err := newDownloadRequest(reqCtx, url, headers)
+	if err != nil {
+		return 0, false
+	}
+	req.Header.Set("Range", "bytes=0-0")
+
+	resp, err := m.httpClient.Do(req)
+	if err != nil {
+		return 0, false
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1))
+
+	if resp.StatusCode != http.StatusPartialContent {
+		return 0, false
+	}
+
+	// Content-Range: bytes 0-0/<size>
+	contentRange := resp.Header.Get("Content-Range")
+	idx := strings.LastIndex(contentRange, "/")
+	if idx < 0 {
+		return 0, false
+	}
+
+	size, err := strconv.ParseInt(contentRange[idx+1:], 10, 64)
+	if err != nil || size <= 0 {
+		return 0, false
+	}
+
+	return size, true
+}
+
+// downloadRanges fetches url into file as concurrent chunks. The caller
+// verifies the assembled file's hash.
+func (m *Manager) downloadRanges(ctx context.Context, url string, headers http.Header, file *os.File, size int64) error {
+	opts := m.downloadOpts
+
+	if err := file.Truncate(size); err != nil {
+		return fmt.Errorf("failed to allocate file: %w", err)
+	}
+	progressFrom(ctx).start(size, 0)
+
+	type chunk struct{ start, end int64 }
+
+	chunks := make(chan chunk)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+	)
+
+	fail := func(err error) {
+		errOnce.Do(func() {
+			firstErr = err
+			cancel()
+		})
+	}
+
+	for i := 0; i < opts.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for c := range chunks {
+				if err := m.fetchRange(ctx, url, headers, file, c.start, c.end); err != nil {
+					fail(err)
+					return
+				}
+			}
+		}()
+	}
+
+	go func() {
+		defer close(chunks)
+		for start := int64(0); start < size; start += opts.ChunkSize {
+			end := min(start+opts.ChunkSize, size) - 1
+			select {
+			case chunks <- chunk{start, end}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	wg.Wait()
+	return firstErr
+}
+
+func (m *Manager) fetchRange(ctx context.Context, url string, headers http.Header, file *os.File, start, end int64) error {
+	reqCtx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	watchdog := newStallWatchdog(m.downloadOpts.StallTimeout, cancel)
+	defer watchdog.stop()
+
+	req, err := newDownloadRequest(reqCtx, url, headers)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+
+	resp, err := m.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to download range %d-%d: %w", start, end, requestError(reqCtx, err))
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		return errRangesUnsupported
+	default:
+		return fmt.Errorf("range %d-%d: %w", start, end, &statusError{code: resp.StatusCode})
+	}
+
+	written, err := io.Copy(io.NewOffsetWriter(file, start), io.TeeReader(watchdog.reader(resp.Body), progressFrom(ctx)))
+	if err != nil {
+		return fmt.Errorf("failed to save range %d-%d: %w", start, end, requestError(reqCtx, err))
+	}
+
+	if written != end-start+1 {
+		return fmt.Errorf("short read for range %d-%d: got %d bytes", start, end, written)
+	}
+
+	return nil
+}
+
+func hashFile(file *os.File) (string, error) {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// downloadParallel tries a ranged download. It returns handled=false when
+// the file is small or the server doesn't support ranges, so the caller
+// should use a single stream instead.
+func (m *Manager) downloadParallel(ctx context.Context, url string, headers http.Header, file *os.File) (bool, error) {
+	size, ok := m.probeRangeSupport(ctx, url, headers)
+	if !ok {
+		return false, nil
+	}
+	if err := m.checkDiskSpace(size); err != nil {
+		return true, err
+	}
+	if size < m.downloadOpts.ParallelThreshold {
+		return false, nil
+	}
+
+	log.WithFields(log.Fields{
+		"url":         url,
+		"size":        size,
+		"chunk_size":  m.downloadOpts.ChunkSize,
+		"concurrency": m.downloadOpts.Concurrency,
+	}).Info("Downloading file in parallel ranges")
+
+	if err := m.downloadRanges(ctx, url, headers, file, size); err != nil {
+		if errors.Is(err, errRangesUnsupported) {
+			log.WithField("url", url).Warn("Server ignored range request, falling back to single stream")
+			if err := resetFile(file); err != nil {
+				return true, err
+			}
+			return false, nil
+		}
+		return true, err
+	}
+
+	return true, nil
+}
+
+// downloadSources lists where the component's archive can be fetched from.
+// content_url is tried first. Mirrors follow in the order given, or, when
+// any mirror has a weight, in a random order biased by weight so repeated
+// deployments spread their load across mirrors.
+func (m *Manager) downloadSources(component *database.Component) ([]string, error) {
+	mirrors, err := m.db.GetContentMirrors(component)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get content mirrors: %w", err)
+	}
+
+	var sources []string
+	if component.ContentURL != "" {
+		sources = append(sources, component.ContentURL)
+	}
+
+	for _, mirror := range orderMirrors(mirrors) {
+		sources = append(sources, mirror.URL)
+	}
+
+	return sources, nil
+}
+
+// contentHeaders returns the custom headers the component's content_url
+// must be fetched with
+func (m *Manager) contentHeaders(component *database.Component) (http.Header, error) {
+	values, err := m.db.GetContentURLHeaders(component)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get content_url headers: %w", err)
+	}
+	if len(values) == 0 {
+		return nil, nil
+	}
+
+	headers := make(http.Header, len(values))
+	for name, value := range values {
+		headers.Set(name, value)
+	}
+	return headers, nil
+}
+
+// sameHost reports whether both URLs point at the same scheme and host, so
+// credentials meant for one can be sent to the other
+func sameHost(a, b string) bool {
+	if a == "" || b == "" {
+		return false
+	}
+
+	ua, err := url.Parse(a)
+	if err != nil {
+		return false
+	}
+	ub, err := url.Parse(b)
+	if err != nil {
+		return false
+	}
+	return ua.Scheme == ub.Scheme && strings.EqualFold(ua.Host, ub.Host)
+}
+
+// orderMirrors returns mirrors as given when none is weighted, and otherwise
+// draws them one at a time with probability proportional to weight. Mirrors
+// without a weight count as weight 1.
+func orderMirrors(mirrors []database.ContentMirror) []database.ContentMirror {
+	weighted := false
+	for _, mirror := range mirrors {
+		if mirror.Weight > 0 {
+			weighted = true
+			break
+		}
+	}
+	if !weighted {
+		return mirrors
+	}
+
+	remaining := append([]database.ContentMirror(nil), mirrors...)
+	ordered := make([]database.ContentMirror, 0, len(mirrors))
+
+	for len(remaining) > 0 {
+		total := 0
+		for _, mirror := range remaining {
+			total += max(mirror.Weight, 1)
+		}
+
+		pick := rand.Intn(total)
+		for i, mirror := range remaining {
+			pick -= max(mirror.Weight, 1)
+			if pick < 0 {
+				ordered = append(ordered, mirror)
+				remaining = append(remaining[:i], remaining[i+1:]...)
+				break
+			}
+		}
+	}
+
+	return ordered
+}
+
+// downloadFromSources downloads the archive from the first source that
+// succeeds and passes the hash check, returning the file and the source used.
+// headers are sent to the first source only, so credentials for the primary
+// artifact store don't leak to mirrors.
+func (m *Manager) downloadFromSources(sources []string, headers http.Header, expectedHash string, progress *downloadProgress) (string, string, error) {
+	var errs []error
+	for i, url := range sources {
+		var sourceHeaders http.Header
+		if i == 0 {
+			sourceHeaders = headers
+		}
+
+		path, err := m.downloadFile(url, sourceHeaders, expectedHash, progress)
+		if err == nil {
+			return path, url, nil
+		}
+
+		errs = append(errs, fmt.Errorf("%s: %w", url, err))
+
+		// A mirror serves the same artifact, which won't fit either
+		var spaceErr *insufficientSpaceError
+		if errors.As(err, &spaceErr) {
+			break
+		}
+
+		if i < len(sources)-1 {
+			log.WithError(err).WithFields(log.Fields{
+				"url":  url,
+				"next": sources[i+1],
+			}).Warn("Download from source failed, trying next mirror")
+		}
+	}
+
+	if len(errs) == 1 {
+		return "", "", errors.Unwrap(errs[0])
+	}
+	return "", "", fmt.Errorf("all %d sources failed: %w", len(sources), errors.Join(errs...))
+}
+
+// newDownloadRequest builds a GET for url carrying the component's custom
+// headers, such as credentials for a private artifact store
+func newDownloadRequest(ctx context.Context, url string, headers http.Header) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	for name, values := range headers {
+		req.Header[name] = append([]string(nil), values...)
+	}
+
+	return req, nil
+}
+
+// redactHeaders lists header names for logging with their values hidden
+func redactHeaders(headers http.Header) map[string]string {
+	if len(headers) == 0 {
+		return nil
+	}
+
+	redacted := make(map[string]string, len(headers))
+	for name := range headers {
+		redacted[name] = "REDACTED"
+	}
+	return redacted
+}
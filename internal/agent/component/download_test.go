@@ -0,0 +1,622 @@
+package component
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/metorial/fleet/cosmos/internal/agent/database"
+)
+
+func newTestManager(opts DownloadOptions) *Manager {
+	m := &Manager{httpClient: &http.Client{}}
+	m.SetDownloadOptions(opts)
+	return m
+}
+
+func hashOf(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// slowHandler writes data in chunks with a delay between each
+func slowHandler(data []byte, chunkSize int, delay time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		for i := 0; i < len(data); i += chunkSize {
+			end := min(i+chunkSize, len(data))
+			if _, err := w.Write(data[i:end]); err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+
+			select {
+			case <-time.After(delay):
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}
+}
+
+func TestDownloadFileTimeouts(t *testing.T) {
+	data := []byte(strings.Repeat("cosmos", 100))
+
+	tests := []struct {
+		name        string
+		handler     http.HandlerFunc
+		opts        DownloadOptions
+		expectError string
+	}{
+		{
+			name:    "slow but steady download completes",
+			handler: slowHandler(data, 100, 20*time.Millisecond),
+			opts:    DownloadOptions{Timeout: 5 * time.Second, StallTimeout: time.Second},
+		},
+		{
+			name:        "overall timeout",
+			handler:     slowHandler(data, 10, 50*time.Millisecond),
+			opts:        DownloadOptions{Timeout: 200 * time.Millisecond, StallTimeout: time.Second},
+			expectError: "download timed out after 200ms",
+		},
+		{
+			name:        "stalled transfer",
+			handler:     slowHandler(data, 300, 2*time.Second),
+			opts:        DownloadOptions{Timeout: 5 * time.Second, StallTimeout: 200 * time.Millisecond},
+			expectError: "download stalled: no data received for 200ms",
+		},
+		{
+			name: "server never responds",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				<-r.Context().Done()
+			},
+			opts:        DownloadOptions{Timeout: 5 * time.Second, StallTimeout: 200 * time.Millisecond},
+			expectError: "download stalled",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(tt.handler)
+			defer server.Close()
+
+			m := newTestManager(tt.opts)
+
+			path, err := m.downloadFile(server.URL, nil, hashOf(data), nil)
+
+			if tt.expectError == "" {
+				if err != nil {
+					t.Fatalf("Expected download to succeed, got: %v", err)
+				}
+				defer os.Remove(path)
+
+				content, err := os.ReadFile(path)
+				if err != nil {
+					t.Fatalf("Failed to read downloaded file: %v", err)
+				}
+				if hashOf(content) != hashOf(data) {
+					t.Errorf("Downloaded content does not match")
+				}
+				return
+			}
+
+			if err == nil {
+				os.Remove(path)
+				t.Fatalf("Expected error containing %q, got nil", tt.expectError)
+			}
+			if !strings.Contains(err.Error(), tt.expectError) {
+				t.Errorf("Expected error containing %q, got: %v", tt.expectError, err)
+			}
+			if path != "" {
+				t.Errorf("Expected no file path on failure, got %s", path)
+			}
+		})
+	}
+}
+
+func TestDownloadFileHashMismatch(t *testing.T) {
+	data := []byte("expected content")
+
+	server := httptest.NewServer(slowHandler(data, 4, time.Millisecond))
+	defer server.Close()
+
+	m := newTestManager(DownloadOptions{Timeout: 5 * time.Second, StallTimeout: time.Second})
+
+	_, err := m.downloadFile(server.URL, nil, hashOf([]byte("other content")), nil)
+	if err == nil || !strings.Contains(err.Error(), "hash mismatch") {
+		t.Errorf("Expected hash mismatch error, got: %v", err)
+	}
+}
+
+// flakyHandler serves data with byte range support, but the first failures
+// downloads drop the connection after sending half of what was asked for.
+// Range probes always succeed. It records the Range header of every request.
+func flakyHandler(data []byte, failures int, ranges *[]string) http.HandlerFunc {
+	var mu sync.Mutex
+	return func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		*ranges = append(*ranges, r.Header.Get("Range"))
+		probe := r.Header.Get("Range") == "bytes=0-0"
+		fail := !probe && failures > 0
+		if fail {
+			failures--
+		}
+		mu.Unlock()
+
+		start := 0
+		status := http.StatusOK
+		if header := r.Header.Get("Range"); header != "" {
+			fmt.Sscanf(header, "bytes=%d-", &start)
+			status = http.StatusPartialContent
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, len(data)-1, len(data)))
+		}
+
+		body := data[start:]
+		w.Header().Set("Accept-Ranges", "bytes")
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.WriteHeader(status)
+
+		if fail {
+			w.Write(body[:len(body)/2])
+			w.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler)
+		}
+		w.Write(body)
+	}
+}
+
+func TestDownloadFileRetriesAndResumes(t *testing.T) {
+	data := []byte(strings.Repeat("cosmos", 1000))
+
+	var ranges []string
+	server := httptest.NewServer(flakyHandler(data, 2, &ranges))
+	defer server.Close()
+
+	m := newTestManager(DownloadOptions{Timeout: 5 * time.Second, StallTimeout: time.Second})
+	m.SetRetryPolicy(RetryPolicy{MaxAttempts: 3, BaseDelay: 10 * time.Millisecond})
+
+	path, err := m.downloadFile(server.URL, nil, hashOf(data), nil)
+	if err != nil {
+		t.Fatalf("Expected download to succeed after retries, got: %v", err)
+	}
+	defer os.Remove(path)
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read downloaded file: %v", err)
+	}
+	if hashOf(content) != hashOf(data) {
+		t.Errorf("Downloaded content does not match")
+	}
+
+	// The first request is the range probe, the second the full stream,
+	// and each retry resumes from where the previous attempt stopped
+	expected := []string{"bytes=0-0", "", fmt.Sprintf("bytes=%d-", len(data)/2), fmt.Sprintf("bytes=%d-", len(data)*3/4)}
+	if len(ranges) != len(expected) {
+		t.Fatalf("Expected requests with ranges %q, got %q", expected, ranges)
+	}
+	for i := range expected {
+		if ranges[i] != expected[i] {
+			t.Errorf("Request %d: expected range %q, got %q", i, expected[i], ranges[i])
+		}
+	}
+}
+
+func TestDownloadFileInParallelRanges(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789abcdef"), 4000)
+
+	tests := []struct {
+		name          string
+		threshold     int64
+		ignoreChunks  bool
+		wantParallel  bool
+		wantStreaming bool
+	}{
+		{name: "large file", threshold: 1024, wantParallel: true},
+		{name: "below the threshold", threshold: int64(len(data)) + 1, wantStreaming: true},
+		// The server honours the probe but not the chunk requests
+		{name: "ranges ignored", threshold: 1024, ignoreChunks: true, wantStreaming: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var ranges []string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				header := r.Header.Get("Range")
+				mu.Lock()
+				ranges = append(ranges, header)
+				mu.Unlock()
+
+				if tt.ignoreChunks && header != "bytes=0-0" {
+					w.Write(data)
+					return
+				}
+				http.ServeContent(w, r, "app", time.Time{}, bytes.NewReader(data))
+			}))
+			defer server.Close()
+
+			m := newTestManager(DownloadOptions{Concurrency: 3, ChunkSize: 10000, ParallelThreshold: tt.threshold, Timeout: 5 * time.Second, StallTimeout: time.Second})
+			m.SetRetryPolicy(RetryPolicy{MaxAttempts: 1})
+
+			path, err := m.downloadFile(server.URL, nil, hashOf(data), nil)
+			if err != nil {
+				t.Fatalf("Download failed: %v", err)
+			}
+			defer os.Remove(path)
+
+			content, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("Failed to read downloaded file: %v", err)
+			}
+			if !bytes.Equal(content, data) {
+				t.Fatalf("Downloaded content does not match: got %d bytes", len(content))
+			}
+
+			chunks := map[string]bool{}
+			streamed := false
+			for _, header := range ranges[1:] {
+				if header == "" {
+					streamed = true
+				} else {
+					chunks[header] = true
+				}
+			}
+			if ranges[0] != "bytes=0-0" {
+				t.Errorf("Expected the first request to probe for ranges, got %q", ranges[0])
+			}
+			if streamed != tt.wantStreaming {
+				t.Errorf("Expected streaming to be %v, got ranges %q", tt.wantStreaming, ranges)
+			}
+			if tt.wantParallel {
+				want := []string{"bytes=0-9999", "bytes=10000-19999", "bytes=20000-29999", "bytes=30000-39999", "bytes=40000-49999", "bytes=50000-59999", "bytes=60000-63999"}
+				if len(chunks) != len(want) || len(ranges) != len(want)+1 {
+					t.Fatalf("Expected chunks %q, got ranges %q", want, ranges)
+				}
+				for _, header := range want {
+					if !chunks[header] {
+						t.Errorf("Expected chunk %q to be requested, got ranges %q", header, ranges)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestSetDownloadOptionsDefaults(t *testing.T) {
+	m := newTestManager(DownloadOptions{Concurrency: 8})
+	if m.downloadOpts.Concurrency != 8 {
+		t.Errorf("Expected the configured concurrency to be kept, got %d", m.downloadOpts.Concurrency)
+	}
+	if m.downloadOpts.ChunkSize != defaultDownloadOptions.ChunkSize || m.downloadOpts.ParallelThreshold != defaultDownloadOptions.ParallelThreshold {
+		t.Errorf("Expected unset sizes to fall back to the defaults, got %+v", m.downloadOpts)
+	}
+}
+
+func TestDownloadFileGivesUpAfterMaxAttempts(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	m := newTestManager(DownloadOptions{Timeout: 5 * time.Second, StallTimeout: time.Second})
+	m.SetRetryPolicy(RetryPolicy{MaxAttempts: 3, BaseDelay: 10 * time.Millisecond})
+
+	_, err := m.downloadFile(server.URL, nil, "", nil)
+	if err == nil || !strings.Contains(err.Error(), "status: 503") {
+		t.Fatalf("Expected 503 error, got: %v", err)
+	}
+
+	// Each attempt probes for range support before streaming
+	if requests != 6 {
+		t.Errorf("Expected 3 attempts (6 requests), got %d requests", requests)
+	}
+}
+
+func TestDownloadFileDoesNotRetryClientErrors(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	m := newTestManager(DownloadOptions{Timeout: 5 * time.Second, StallTimeout: time.Second})
+	m.SetRetryPolicy(RetryPolicy{MaxAttempts: 3, BaseDelay: 10 * time.Millisecond})
+
+	if _, err := m.downloadFile(server.URL, nil, "", nil); err == nil {
+		t.Fatal("Expected download to fail")
+	}
+	if requests != 2 {
+		t.Errorf("Expected a single attempt (2 requests), got %d requests", requests)
+	}
+}
+
+func TestDownloadFileSendsContentHeaders(t *testing.T) {
+	data := bytes.Repeat([]byte("private artifact "), 4096)
+	unauthorized := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret-token" {
+			unauthorized++
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		http.ServeContent(w, r, "artifact", time.Time{}, bytes.NewReader(data))
+	}))
+	defer server.Close()
+
+	m := newTestManager(DownloadOptions{Timeout: 5 * time.Second, StallTimeout: time.Second})
+
+	if _, err := m.downloadFile(server.URL, nil, hashOf(data), nil); err == nil {
+		t.Fatal("Expected download without credentials to fail")
+	}
+
+	unauthorized = 0
+	headers := http.Header{"Authorization": []string{"Bearer secret-token"}}
+	path, err := m.downloadFile(server.URL, headers, hashOf(data), nil)
+	if err != nil {
+		t.Fatalf("Download with credentials failed: %v", err)
+	}
+	defer os.Remove(path)
+
+	if unauthorized != 0 {
+		t.Errorf("Expected every request to carry the headers, %d did not", unauthorized)
+	}
+}
+
+func TestRedactHeaders(t *testing.T) {
+	redacted := redactHeaders(http.Header{"Authorization": []string{"Bearer secret-token"}})
+	if redacted["Authorization"] != "REDACTED" {
+		t.Errorf("Expected the value to be redacted, got %q", redacted["Authorization"])
+	}
+}
+
+func TestDownloadFromSourcesFallsBackToMirror(t *testing.T) {
+	data := []byte("program archive")
+
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer down.Close()
+
+	corrupt := httptest.NewServer(slowHandler([]byte("corrupted archive"), 64, time.Millisecond))
+	defer corrupt.Close()
+
+	good := httptest.NewServer(slowHandler(data, 64, time.Millisecond))
+	defer good.Close()
+
+	m := newTestManager(DownloadOptions{Timeout: 5 * time.Second, StallTimeout: time.Second})
+
+	path, source, err := m.downloadFromSources([]string{down.URL, corrupt.URL, good.URL}, nil, hashOf(data), nil)
+	if err != nil {
+		t.Fatalf("Expected download from mirror to succeed, got: %v", err)
+	}
+	defer os.Remove(path)
+
+	if source != good.URL {
+		t.Errorf("Expected source %s, got %s", good.URL, source)
+	}
+
+	_, _, err = m.downloadFromSources([]string{down.URL, corrupt.URL}, nil, hashOf(data), nil)
+	if err == nil || !strings.Contains(err.Error(), "all 2 sources failed") {
+		t.Errorf("Expected all sources to fail, got: %v", err)
+	}
+}
+
+func TestOrderMirrors(t *testing.T) {
+	unweighted := []database.ContentMirror{{URL: "a"}, {URL: "b"}, {URL: "c"}}
+	ordered := orderMirrors(unweighted)
+	for i := range unweighted {
+		if ordered[i].URL != unweighted[i].URL {
+			t.Fatalf("Expected unweighted mirrors in listed order, got %v", ordered)
+		}
+	}
+
+	weighted := []database.ContentMirror{{URL: "heavy", Weight: 9}, {URL: "light", Weight: 1}}
+	first := map[string]int{}
+	for i := 0; i < 1000; i++ {
+		ordered := orderMirrors(weighted)
+		if len(ordered) != 2 {
+			t.Fatalf("Expected 2 mirrors, got %d", len(ordered))
+		}
+		first[ordered[0].URL]++
+	}
+
+	if first["heavy"] < 800 || first["light"] == 0 {
+		t.Errorf("Expected the heavy mirror first about 90%% of the time, got %v", first)
+	}
+}
+
+// withFreeSpace makes every filesystem report free bytes available
+func withFreeSpace(t *testing.T, free uint64) {
+	original := statfs
+	statfs = func(path string, stat *syscall.Statfs_t) error {
+		stat.Bsize = 4096
+		stat.Bavail = free / 4096
+		return nil
+	}
+	t.Cleanup(func() { statfs = original })
+}
+
+func TestDeployProgramRejectedWithoutDiskSpace(t *testing.T) {
+	dataDir := t.TempDir()
+	db, err := database.NewAgentDB(dataDir)
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	defer db.Close()
+
+	archive := []byte("#!/bin/sh\n" + strings.Repeat("# padding\n", 50000) + "exit 0\n")
+
+	var mu sync.Mutex
+	var ranges []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		ranges = append(ranges, r.Header.Get("Range"))
+		mu.Unlock()
+		http.ServeContent(w, r, "app", time.Time{}, bytes.NewReader(archive))
+	}))
+	defer server.Close()
+
+	// Room for the download but not for extracting it with the floor spare
+	withFreeSpace(t, uint64(len(archive))*2)
+
+	m := NewManager(db, dataDir)
+	m.SetDownloadOptions(DownloadOptions{MinFreeSpace: 1})
+	err = m.DeployProgram(&database.Component{Name: "app", Type: "program", Hash: hashOf(archive), ContentURL: server.URL})
+	if err == nil || !strings.Contains(err.Error(), "not enough disk space in") {
+		t.Fatalf("Expected the deployment to be rejected for disk space, got %v", err)
+	}
+
+	// Only the size probe reached the server, and only once: running out of
+	// space isn't retried
+	if len(ranges) != 1 || ranges[0] != "bytes=0-0" {
+		t.Errorf("Expected a single size probe before rejecting, got ranges %q", ranges)
+	}
+	if _, err := os.Stat(filepath.Join(dataDir, "programs", "app")); !os.IsNotExist(err) {
+		t.Errorf("Expected nothing to be extracted, got %v", err)
+	}
+
+	withFreeSpace(t, uint64(len(archive))*8)
+	if err := m.DeployProgram(&database.Component{Name: "app", Type: "program", Hash: hashOf(archive), ContentURL: server.URL}); err != nil {
+		t.Fatalf("Expected the deployment to succeed with enough space, got %v", err)
+	}
+	m.StopComponent("app")
+}
+
+func TestDownloadWithoutRangesCheckedByContentLength(t *testing.T) {
+	data := bytes.Repeat([]byte("x"), 1<<20)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Write(data)
+	}))
+	defer server.Close()
+
+	withFreeSpace(t, 1024)
+
+	m := newTestManager(DownloadOptions{Timeout: 5 * time.Second, StallTimeout: time.Second})
+	m.SetRetryPolicy(RetryPolicy{MaxAttempts: 3, BaseDelay: 10 * time.Millisecond})
+
+	_, err := m.downloadFile(server.URL, nil, hashOf(data), nil)
+	var spaceErr *insufficientSpaceError
+	if !errors.As(err, &spaceErr) || spaceErr.need != uint64(len(data)) || spaceErr.free != 0 {
+		t.Errorf("Expected the streamed download to be refused by its Content-Length, got %v", err)
+	}
+}
+
+// phaseRecorder is a ProgressReporter that records the phases reported
+type phaseRecorder struct {
+	mu     sync.Mutex
+	phases []string
+}
+
+func (r *phaseRecorder) ReportProgress(componentName, status, message string) {}
+
+func (r *phaseRecorder) ReportPhase(componentName, phase string, percent int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.phases = append(r.phases, fmt.Sprintf("%s %d", phase, percent))
+}
+
+func TestDownloadFileReportsProgress(t *testing.T) {
+	data := bytes.Repeat([]byte("cosmos"), 200000)
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		opts    DownloadOptions
+	}{
+		{
+			name: "streamed",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+				slowHandler(data, 60000, time.Millisecond)(w, r)
+			},
+			opts: DownloadOptions{Timeout: 5 * time.Second, StallTimeout: time.Second},
+		},
+		{
+			name: "parallel ranges",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				http.ServeContent(w, r, "artifact", time.Time{}, bytes.NewReader(data))
+			},
+			opts: DownloadOptions{Timeout: 5 * time.Second, StallTimeout: time.Second, ParallelThreshold: 1, ChunkSize: 100000},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(tt.handler)
+			defer server.Close()
+
+			m := newTestManager(tt.opts)
+
+			var percents []int
+			progress := &downloadProgress{report: func(percent int) {
+				percents = append(percents, percent)
+			}}
+			path, err := m.downloadFile(server.URL, nil, hashOf(data), progress)
+			if err != nil {
+				t.Fatalf("Expected download to succeed, got: %v", err)
+			}
+			defer os.Remove(path)
+
+			if len(percents) < 2 || percents[len(percents)-1] != 100 {
+				t.Fatalf("Expected progress to be reported up to 100%%, got %v", percents)
+			}
+			for i := 1; i < len(percents); i++ {
+				if percents[i]/progressStep <= percents[i-1]/progressStep {
+					t.Errorf("Expected each report to pass another %d%%, got %v", progressStep, percents)
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestDeployProgramReportsPhases(t *testing.T) {
+	dataDir := t.TempDir()
+	db, err := database.NewAgentDB(dataDir)
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	defer db.Close()
+
+	archive := []byte("#!/bin/sh\n" + strings.Repeat("# padding\n", 50000) + "exec sleep 300\n")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(archive)))
+		slowHandler(archive, 100000, time.Millisecond)(w, r)
+	}))
+	defer server.Close()
+
+	m := NewManager(db, dataDir)
+	m.SetDownloadOptions(DownloadOptions{MinFreeSpace: 1})
+	recorder := &phaseRecorder{}
+	m.SetProgressReporter(recorder)
+
+	if err := m.DeployProgram(&database.Component{Name: "app", Type: "program", Hash: hashOf(archive), ContentURL: server.URL}); err != nil {
+		t.Fatalf("Failed to deploy program: %v", err)
+	}
+	defer m.StopComponent("app")
+
+	phases := recorder.phases
+	if len(phases) < 4 || phases[0] != "downloading 0" {
+		t.Fatalf("Expected the download to be reported from 0%%, got %v", phases)
+	}
+	if got := phases[len(phases)-3:]; got[0] != "downloading 100" || got[1] != "extracting -1" || got[2] != "starting -1" {
+		t.Errorf("Expected the download to finish before extracting and starting, got %v", phases)
+	}
+}
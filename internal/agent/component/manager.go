@@ -4,40 +4,94 @@ import (
 	"archive/tar"
 	"archive/zip"
 	"compress/gzip"
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
+	"github.com/klauspost/compress/zstd"
 	"github.com/metorial/fleet/cosmos/internal/agent/database"
+	"github.com/metorial/fleet/cosmos/internal/util"
 	log "github.com/sirupsen/logrus"
+	"github.com/ulikunitz/xz"
 )
 
 // ProgressReporter is an interface for reporting deployment progress
 type ProgressReporter interface {
 	ReportProgress(componentName, status, message string)
+	// ReportPhase reports the phase a program's deployment is in and how
+	// far through it is, as a percentage or -1 when that isn't known
+	ReportPhase(componentName, phase string, percent int)
 }
 
+// restartHistoryLimit bounds the restart events kept per component
+const restartHistoryLimit = 20
+
+// maxLogTailBytes bounds how much of a log file TailComponentLog reads
+const maxLogTailBytes = 1024 * 1024
+
 type Manager struct {
 	db               *database.AgentDB
 	dataDir          string
 	progressReporter ProgressReporter
+
+	// scriptExecution is how unmanaged scripts run, and nsenterErr records
+	// why they can't run on this node, if so
+	scriptExecution ScriptExecution
+	nsenterErr      error
+
+	downloadOpts DownloadOptions
+	retryPolicy  RetryPolicy
+	httpClient   *http.Client
+
+	// cacheInUse counts the deployments using each cached archive, which
+	// keeps it from being evicted
+	cacheMu    sync.Mutex
+	cacheInUse map[string]int
+
+	// cgroupRoot holds the cgroups of components with memory or CPU limits
+	cgroupRoot string
 }
 
 func NewManager(db *database.AgentDB, dataDir string) *Manager {
 	return &Manager{
-		db:      db,
-		dataDir: dataDir,
+		db:              db,
+		dataDir:         dataDir,
+		nsenterErr:      defaultScriptExecution.check(),
+		scriptExecution: defaultScriptExecution,
+		downloadOpts:    defaultDownloadOptions,
+		retryPolicy:     defaultRetryPolicy,
+		httpClient:      &http.Client{},
+		cacheInUse:      make(map[string]int),
+		cgroupRoot:      defaultCgroupRoot,
 	}
 }
 
+// SetCgroupRoot sets the cgroup v2 directory components with memory or CPU
+// limits get their cgroups in
+func (m *Manager) SetCgroupRoot(root string) {
+	if root != "" {
+		m.cgroupRoot = root
+	}
+}
+
+// UnmanagedScriptsSupported reports whether this node can execute unmanaged
+// scripts in the host namespaces, and the reason when it can't.
+func (m *Manager) UnmanagedScriptsSupported() (bool, error) {
+	return m.nsenterErr == nil, m.nsenterErr
+}
+
 func (m *Manager) SetProgressReporter(reporter ProgressReporter) {
 	m.progressReporter = reporter
 }
@@ -45,37 +99,114 @@ func (m *Manager) SetProgressReporter(reporter ProgressReporter) {
 func (m *Manager) DeployProgram(component *database.Component) error {
 	log.WithField("component", component.Name).Info("Deploying program")
 
-	if component.ContentURL == "" {
-		return fmt.Errorf("content_url is required for programs")
+	if err := util.ValidateComponentName(component.Name); err != nil {
+		return err
+	}
+
+	sources, err := m.downloadSources(component)
+	if err != nil {
+		return err
+	}
+	if len(sources) == 0 {
+		return fmt.Errorf("content_url or content_mirrors is required for programs")
+	}
+
+	// Fail before downloading anything if the program couldn't be started
+	if _, err := componentCredential(component); err != nil {
+		return err
 	}
 
 	existing, err := m.db.GetComponent(component.Name)
-	if err == nil && existing.Hash == component.Hash {
-		log.WithField("component", component.Name).Info("Component already deployed with same hash")
+	if err == nil && database.SameSpec(existing, component) {
+		log.WithField("component", component.Name).Info("Component already deployed with the same spec")
 		return nil
 	}
 
-	filePath, err := m.downloadFile(component.ContentURL, component.Hash)
+	headers, err := m.contentHeaders(component)
 	if err != nil {
-		return fmt.Errorf("download failed: %w", err)
+		return err
+	}
+
+	// Headers belong to content_url and must not reach a mirror listed first
+	var sourceHeaders http.Header
+	if component.ContentURL != "" {
+		sourceHeaders = headers
+	}
+
+	filePath, release, cached := m.acquireCachedArchive(component.Hash)
+	if cached {
+		log.WithFields(log.Fields{
+			"component": component.Name,
+			"hash":      component.Hash,
+		}).Info("Using cached archive")
+		if m.progressReporter != nil {
+			m.progressReporter.ReportProgress(component.Name, "downloaded", "Using cached archive")
+		}
+	} else {
+		m.reportPhase(component.Name, PhaseDownloading, 0)
+		progress := &downloadProgress{report: func(percent int) {
+			m.reportPhase(component.Name, PhaseDownloading, percent)
+		}}
+
+		downloaded, source, err := m.downloadFromSources(sources, sourceHeaders, component.Hash, progress)
+		if err != nil {
+			return fmt.Errorf("download failed: %w", err)
+		}
+		filePath, release = m.cacheArchive(downloaded, component.Hash)
+
+		if m.progressReporter != nil {
+			m.progressReporter.ReportProgress(component.Name, "downloaded", fmt.Sprintf("Downloaded archive from %s", source))
+		}
 	}
-	defer os.Remove(filePath)
+	defer release()
 
-	extractDir := filepath.Join(m.dataDir, "programs", component.Name)
+	// Nothing may reach the programs directory until the archive is trusted
+	var signatureHeaders http.Header
+	if sameHost(component.SignatureURL, component.ContentURL) {
+		signatureHeaders = headers
+	}
+	if err := m.verifyArchive(context.Background(), filePath, component.PublicKey, component.SignatureURL, signatureHeaders); err != nil {
+		return fmt.Errorf("signature verification failed: %w", err)
+	}
+	if component.PublicKey != "" {
+		log.WithField("component", component.Name).Info("Archive signature verified")
+	}
+
+	// Each version is extracted into its own directory, so none of the
+	// previous version's files linger in the new one
+	if filepath.Base(component.Hash) != component.Hash || component.Hash == "." || component.Hash == ".." || component.Hash == currentVersionLink {
+		return fmt.Errorf("invalid hash %q", component.Hash)
+	}
+	programDir := filepath.Join(m.dataDir, "programs", component.Name)
+	extractDir := filepath.Join(programDir, component.Hash)
+
+	// Left over by an earlier attempt that failed partway
+	if err := os.RemoveAll(extractDir); err != nil {
+		return fmt.Errorf("failed to clear extract directory: %w", err)
+	}
 	if err := os.MkdirAll(extractDir, 0755); err != nil {
 		return fmt.Errorf("failed to create extract directory: %w", err)
 	}
 
+	m.reportPhase(component.Name, PhaseExtracting, -1)
 	if err := m.extractArchive(filePath, extractDir, component.ContentURLEncoding); err != nil {
+		os.RemoveAll(extractDir)
 		return fmt.Errorf("extraction failed: %w", err)
 	}
 
-	executable, err := m.findExecutable(extractDir, component.Name)
+	executable, err := m.findExecutable(extractDir, component.Name, component.Entrypoint)
 	if err != nil {
+		os.RemoveAll(extractDir)
 		return fmt.Errorf("finding executable failed: %w", err)
 	}
 
-	component.Executable = executable
+	// The program runs through the current link, which keeps its path the
+	// same across versions
+	relative, err := filepath.Rel(extractDir, executable)
+	if err != nil {
+		return fmt.Errorf("finding executable failed: %w", err)
+	}
+	component.Executable = filepath.Join(programDir, currentVersionLink, relative)
 
 	if existing != nil {
 		if err := m.StopComponent(component.Name); err != nil {
@@ -83,10 +214,17 @@ func (m *Manager) DeployProgram(component *database.Component) error {
 		}
 	}
 
+	if err := switchSymlink(filepath.Join(programDir, currentVersionLink), component.Hash); err != nil {
+		return fmt.Errorf("failed to switch to the new version: %w", err)
+	}
+
 	if err := m.db.UpsertComponent(component); err != nil {
 		return fmt.Errorf("failed to save component: %w", err)
 	}
 
+	pruneProgramVersions(programDir, component.Hash)
+
+	m.reportPhase(component.Name, PhaseStarting, -1)
 	if err := m.StartComponent(component.Name); err != nil {
 		return fmt.Errorf("failed to start component: %w", err)
 	}
@@ -102,17 +240,31 @@ func (m *Manager) DeployScript(component *database.Component) error {
 		log.WithField("component", component.Name).Info("Deploying unmanaged script")
 	}
 
+	if err := util.ValidateComponentName(component.Name); err != nil {
+		return err
+	}
+
 	if component.Content == "" {
 		return fmt.Errorf("content is required for scripts")
 	}
 
+	if !component.Managed && m.nsenterErr != nil {
+		return fmt.Errorf("unmanaged scripts are not supported on this node: %w", m.nsenterErr)
+	}
+
+	if component.Managed {
+		if _, err := componentCredential(component); err != nil {
+			return err
+		}
+	}
+
 	scriptDir := filepath.Join(m.dataDir, "scripts")
 	if err := os.MkdirAll(scriptDir, 0755); err != nil {
 		return fmt.Errorf("failed to create script directory: %w", err)
 	}
 
 	scriptPath := filepath.Join(scriptDir, component.Name+".sh")
-	if err := os.WriteFile(scriptPath, []byte(component.Content), 0755); err != nil {
+	if err := writeFileAtomic(scriptPath, []byte(component.Content), 0755); err != nil {
 		return fmt.Errorf("failed to write script: %w", err)
 	}
 
@@ -137,52 +289,124 @@ func (m *Manager) DeployScript(component *database.Component) error {
 	return nil
 }
 
-func (m *Manager) executeUnmanagedScript(component *database.Component) error {
-	env, err := m.db.GetEnvMap(component)
-	if err != nil {
-		return fmt.Errorf("failed to get environment: %w", err)
+// currentVersionLink is the symlink in a program's directory that points at
+// the directory of its deployed version
+const currentVersionLink = "current"
+
+// switchSymlink points link at target, replacing whatever link pointed at in
+// a single rename so the link is never missing
+func switchSymlink(link, target string) error {
+	// Programs extracted before versions had directories of their own may
+	// have left a file or directory by that name
+	if info, err := os.Lstat(link); err == nil && info.Mode()&os.ModeSymlink == 0 {
+		if err := os.RemoveAll(link); err != nil {
+			return err
+		}
 	}
 
-	args, err := m.db.GetArgsSlice(component)
+	tmp := fmt.Sprintf("%s.%d.tmp", link, time.Now().UnixNano())
+	if err := os.Symlink(target, tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, link); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// pruneProgramVersions removes everything in a program's directory but the
+// kept version and the current link: earlier versions, and the files of
+// programs extracted before versions had directories of their own
+func pruneProgramVersions(programDir, keep string) {
+	entries, err := os.ReadDir(programDir)
 	if err != nil {
-		return fmt.Errorf("failed to get args: %w", err)
+		log.WithError(err).WithField("dir", programDir).Warn("Failed to list program versions")
+		return
 	}
 
-	hostScriptPath := filepath.Join("/opt/cosmos-agent/scripts", component.Name+".sh")
+	for _, entry := range entries {
+		if entry.Name() == keep || entry.Name() == currentVersionLink {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(programDir, entry.Name())); err != nil {
+			log.WithError(err).WithField("path", entry.Name()).Warn("Failed to remove old program version")
+		}
+	}
+}
 
-	// Use nsenter to enter host namespaces and execute the script
-	// -t 1 = target PID 1 (init/systemd on host)
-	// -m = mount namespace
-	// -u = UTS namespace
-	// -i = IPC namespace
-	// -n = network namespace
-	// -p = PID namespace
-	// We use bash -c to set the working directory since -w flag may not be available
-	scriptCmd := fmt.Sprintf("cd /home/ubuntu && bash %s", hostScriptPath)
-	if len(args) > 0 {
-		for _, arg := range args {
-			scriptCmd += fmt.Sprintf(" %s", arg)
+// writeFileAtomic writes data to a temporary file next to path, verifies the
+// written content, and renames it into place so a crash mid-write never
+// leaves a truncated file at path. Each write gets its own temporary file, so concurrent writers of the same
+// path can't corrupt each other's content.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) (err error) {
+	tmpFile, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	tmpPath := tmpFile.Name()
+	defer func() {
+		if err != nil {
+			tmpFile.Close()
+			os.Remove(tmpPath)
 		}
+	}()
+
+	if _, err := tmpFile.Write(data); err != nil {
+		return fmt.Errorf("failed to write temporary file: %w", err)
 	}
 
-	nsenterArgs := []string{
-		"-t", "1",
-		"-m", "-u", "-i", "-n", "-p",
-		"--",
-		"bash", "-c", scriptCmd,
+	if err := tmpFile.Sync(); err != nil {
+		return fmt.Errorf("failed to sync temporary file: %w", err)
 	}
 
-	cmd := exec.Command("nsenter", nsenterArgs...)
+	if err := tmpFile.Close(); err != nil {
+		return fmt.Errorf("failed to close temporary file: %w", err)
+	}
 
-	envVars := []string{
-		"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin",
-		"HOME=/root",
-		"USER=root",
+	written, err := readFile(tmpPath)
+	if err != nil {
+		return fmt.Errorf("failed to read back temporary file: %w", err)
 	}
-	for k, v := range env {
-		envVars = append(envVars, fmt.Sprintf("%s=%s", k, v))
+
+	expectedHash := sha256.Sum256(data)
+	actualHash := sha256.Sum256(written)
+	if expectedHash != actualHash {
+		return fmt.Errorf("content hash mismatch after write: expected %s, got %s",
+			hex.EncodeToString(expectedHash[:]), hex.EncodeToString(actualHash[:]))
+	}
+
+	if err := os.Chmod(tmpPath, perm); err != nil {
+		return fmt.Errorf("failed to set permissions: %w", err)
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("failed to replace file: %w", err)
+	}
+
+	return nil
+}
+
+func (m *Manager) executeUnmanagedScript(component *database.Component) error {
+	status, _ := m.db.GetComponentStatus(component.Name)
+	if err := m.waitForDependencies(component, status); err != nil {
+		return err
+	}
+
+	env, err := m.db.GetEnvMap(component)
+	if err != nil {
+		return fmt.Errorf("failed to get environment: %w", err)
+	}
+
+	args, err := m.db.GetArgsSlice(component)
+	if err != nil {
+		return fmt.Errorf("failed to get args: %w", err)
+	}
+
+	cmd := m.scriptExecution.command(component.Executable, component.WorkingDir, args, env)
+	if cmd.Err != nil {
+		return fmt.Errorf("cannot run unmanaged scripts in %s mode: %w", m.scriptExecution.Mode, cmd.Err)
 	}
-	cmd.Env = envVars
 
 	logDir := filepath.Join(m.dataDir, "logs")
 	os.MkdirAll(logDir, 0755)
@@ -201,6 +425,12 @@ func (m *Manager) executeUnmanagedScript(component *database.Component) error {
 	cmd.Stdout = logFile
 	cmd.Stderr = logFile
 
+	// Only this run's output is reported
+	var startOffset int64
+	if info, err := logFile.Stat(); err == nil {
+		startOffset = info.Size()
+	}
+
 	log.WithField("component", component.Name).Info("Executing unmanaged script")
 
 	// Start the process
@@ -219,7 +449,10 @@ func (m *Manager) executeUnmanagedScript(component *database.Component) error {
 	ticker := time.NewTicker(3 * time.Second)
 	defer ticker.Stop()
 
-	var lastOffset int64 = 0
+	timeout := time.NewTimer(m.scriptExecution.Timeout)
+	defer timeout.Stop()
+
+	lastOffset := startOffset
 
 	for {
 		select {
@@ -242,6 +475,21 @@ func (m *Manager) executeUnmanagedScript(component *database.Component) error {
 			log.WithField("component", component.Name).Info("Unmanaged script executed successfully")
 			return nil
 
+		case <-timeout.C:
+			signalProcessGroup(cmd.Process.Pid, syscall.SIGKILL)
+			<-done
+
+			log.WithFields(log.Fields{
+				"component": component.Name,
+				"timeout":   m.scriptExecution.Timeout,
+			}).Warn("Unmanaged script timed out and was killed")
+
+			output := m.scriptOutput(logFilePath, startOffset)
+			if output == "" {
+				return fmt.Errorf("script timed out after %s with no output", m.scriptExecution.Timeout)
+			}
+			return fmt.Errorf("script timed out after %s; output so far:\n%s", m.scriptExecution.Timeout, output)
+
 		case <-ticker.C:
 			// Read incremental output
 			output, newOffset := m.readLogTail(logFilePath, lastOffset)
@@ -266,6 +514,85 @@ func (m *Manager) executeUnmanagedScript(component *database.Component) error {
 	}
 }
 
+// maxScriptOutputBytes bounds the output of a failed script included in its
+// failure
+const maxScriptOutputBytes = 4096
+
+// scriptOutput returns what a script has written since offset, keeping the
+// last maxScriptOutputBytes of it
+func (m *Manager) scriptOutput(filePath string, offset int64) string {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return ""
+	}
+	if start := info.Size() - maxScriptOutputBytes; start > offset {
+		offset = start
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return ""
+	}
+
+	data, _ := io.ReadAll(io.LimitReader(file, maxScriptOutputBytes))
+	return strings.TrimSpace(string(data))
+}
+
+// ReadComponentLog reads new output from a component's log file starting at
+// the given offset, returning the content and the offset to resume from.
+func (m *Manager) ReadComponentLog(name string, offset int64) (string, int64) {
+	return m.readLogTail(filepath.Join(m.dataDir, "logs", name+".log"), offset)
+}
+
+// TailComponentLog returns the last lines of a component's log file, reading
+// at most the final maxLogTailBytes of it
+func (m *Manager) TailComponentLog(name string, lines int) (string, error) {
+	if err := util.ValidateComponentName(name); err != nil {
+		return "", err
+	}
+
+	file, err := os.Open(filepath.Join(m.dataDir, "logs", name+".log"))
+	if err != nil {
+		return "", fmt.Errorf("failed to open log file: %w", err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return "", fmt.Errorf("failed to stat log file: %w", err)
+	}
+
+	offset := max(info.Size()-maxLogTailBytes, 0)
+	data := make([]byte, info.Size()-offset)
+	if _, err := file.ReadAt(data, offset); err != nil && err != io.EOF {
+		return "", fmt.Errorf("failed to read log file: %w", err)
+	}
+
+	return lastLines(string(data), lines, offset > 0), nil
+}
+
+// lastLines keeps the final n lines of text. When text starts mid-file its
+// first, likely partial, line is dropped.
+func lastLines(text string, n int, partial bool) string {
+	text = strings.TrimSuffix(text, "\n")
+	if text == "" {
+		return ""
+	}
+
+	split := strings.Split(text, "\n")
+	if partial && len(split) > 1 {
+		split = split[1:]
+	}
+	if n > 0 && len(split) > n {
+		split = split[len(split)-n:]
+	}
+	return strings.Join(split, "\n") + "\n"
+}
+
 // readLogTail reads new content from a log file starting at the given offset
 func (m *Manager) readLogTail(filePath string, offset int64) (string, int64) {
 	file, err := os.Open(filePath)
@@ -306,6 +633,10 @@ func (m *Manager) StartComponent(name string) error {
 		return nil
 	}
 
+	if err := m.waitForDependencies(component, status); err != nil {
+		return err
+	}
+
 	env, err := m.db.GetEnvMap(component)
 	if err != nil {
 		return fmt.Errorf("failed to get environment: %w", err)
@@ -316,6 +647,11 @@ func (m *Manager) StartComponent(name string) error {
 		return fmt.Errorf("failed to get args: %w", err)
 	}
 
+	credential, err := componentCredential(component)
+	if err != nil {
+		return err
+	}
+
 	cmd := exec.Command(component.Executable, args...)
 
 	envVars := os.Environ()
@@ -324,39 +660,80 @@ func (m *Manager) StartComponent(name string) error {
 	}
 	cmd.Env = envVars
 	cmd.Dir = filepath.Dir(component.Executable)
+	if component.WorkingDir != "" {
+		if info, err := os.Stat(component.WorkingDir); err != nil || !info.IsDir() {
+			return fmt.Errorf("working directory %s does not exist", component.WorkingDir)
+		}
+		cmd.Dir = component.WorkingDir
+	}
+	// Run in a new process group so stopping the component also stops
+	// anything it forked
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true, Credential: credential}
+
+	limits, err := m.prepareResourceLimits(component, cmd)
+	if err != nil {
+		return fmt.Errorf("failed to apply resource limits: %w", err)
+	}
 
 	logDir := filepath.Join(m.dataDir, "logs")
 	os.MkdirAll(logDir, 0755)
 
+	logPath := filepath.Join(logDir, name+".log")
 	logFile, err := os.OpenFile(
-		filepath.Join(logDir, name+".log"),
+		logPath,
 		os.O_CREATE|os.O_WRONLY|os.O_APPEND,
 		0644,
 	)
 	if err != nil {
+		limits.release()
 		return fmt.Errorf("failed to open log file: %w", err)
 	}
 
+	if credential != nil {
+		if err := m.chownComponentFiles(component, logPath, credential); err != nil {
+			logFile.Close()
+			limits.release()
+			return err
+		}
+	}
+
 	cmd.Stdout = logFile
 	cmd.Stderr = logFile
 
+	var logStartOffset int64
+	if info, err := logFile.Stat(); err == nil {
+		logStartOffset = info.Size()
+	}
+
 	if err := cmd.Start(); err != nil {
 		logFile.Close()
+		limits.release()
 		return fmt.Errorf("failed to start process: %w", err)
 	}
 
+	if err := limits.start(cmd.Process.Pid); err != nil {
+		// Don't leave the component running without its limits
+		signalProcessGroup(cmd.Process.Pid, syscall.SIGKILL)
+		cmd.Wait()
+		logFile.Close()
+		limits.release()
+		return fmt.Errorf("failed to apply resource limits: %w", err)
+	}
+
 	now := time.Now()
 	status.Status = "running"
 	status.PID = cmd.Process.Pid
 	status.LastStartedAt = &now
+	status.LogStartOffset = logStartOffset
 	status.LastCheckedAt = time.Now()
 	status.Message = "Process started successfully"
+	status.StoppedByController = false
 
 	if err := m.db.UpsertComponentStatus(status); err != nil {
 		return fmt.Errorf("failed to update status: %w", err)
 	}
 
-	go m.monitorProcess(name, cmd, logFile)
+	go m.monitorProcess(name, cmd, logFile, limits)
 
 	log.WithFields(log.Fields{
 		"component": name,
@@ -376,18 +753,13 @@ func (m *Manager) StopComponent(name string) error {
 		return nil
 	}
 
-	if !m.IsProcessRunning(status.PID) {
+	if !m.isProcessGroupRunning(status.PID) {
 		status.Status = "stopped"
 		m.db.UpsertComponentStatus(status)
 		return nil
 	}
 
-	process, err := os.FindProcess(status.PID)
-	if err != nil {
-		return fmt.Errorf("failed to find process: %w", err)
-	}
-
-	if err := process.Signal(syscall.SIGTERM); err != nil {
+	if err := signalProcessGroup(status.PID, syscall.SIGTERM); err != nil {
 		return fmt.Errorf("failed to send SIGTERM: %w", err)
 	}
 
@@ -399,13 +771,13 @@ func (m *Manager) StopComponent(name string) error {
 		select {
 		case <-timeout:
 			log.WithField("component", name).Warn("Process did not stop gracefully, sending SIGKILL")
-			process.Kill()
+			signalProcessGroup(status.PID, syscall.SIGKILL)
 			status.Status = "stopped"
 			status.Message = "Forcefully killed after timeout"
 			m.db.UpsertComponentStatus(status)
 			return nil
 		case <-ticker.C:
-			if !m.IsProcessRunning(status.PID) {
+			if !m.isProcessGroupRunning(status.PID) {
 				status.Status = "stopped"
 				status.Message = "Stopped gracefully"
 				m.db.UpsertComponentStatus(status)
@@ -416,13 +788,30 @@ func (m *Manager) StopComponent(name string) error {
 	}
 }
 
-func (m *Manager) RestartComponent(name string) error {
-	log.WithField("component", name).Info("Restarting component")
+// RestartComponent stops and starts a component, recording the restart and
+// its reason in the component's restart history
+func (m *Manager) RestartComponent(name, reason string) error {
+	log.WithFields(log.Fields{
+		"component": name,
+		"reason":    reason,
+	}).Info("Restarting component")
 
+	now := time.Now()
 	status, _ := m.db.GetComponentStatus(name)
 	status.RestartCount++
+	status.LastRestartAt = &now
 	m.db.UpsertComponentStatus(status)
 
+	event := &database.RestartEvent{
+		ComponentName: name,
+		Timestamp:     now,
+		Reason:        reason,
+		ExitCode:      status.ExitCode,
+	}
+	if err := m.db.RecordRestart(event, restartHistoryLimit); err != nil {
+		log.WithError(err).WithField("component", name).Warn("Failed to record restart")
+	}
+
 	if err := m.StopComponent(name); err != nil {
 		log.WithError(err).Warn("Failed to stop component, continuing with start")
 	}
@@ -442,8 +831,7 @@ func (m *Manager) RemoveComponent(name string) error {
 	component, err := m.db.GetComponent(name)
 	if err == nil {
 		if strings.HasPrefix(component.Executable, filepath.Join(m.dataDir, "programs")) {
-			programDir := filepath.Dir(component.Executable)
-			os.RemoveAll(programDir)
+			os.RemoveAll(filepath.Join(m.dataDir, "programs", name))
 		} else if strings.HasPrefix(component.Executable, filepath.Join(m.dataDir, "scripts")) {
 			os.Remove(component.Executable)
 		}
@@ -471,16 +859,46 @@ func (m *Manager) IsProcessRunning(pid int) bool {
 	return err == nil
 }
 
-func (m *Manager) monitorProcess(name string, cmd *exec.Cmd, logFile *os.File) {
+// signalProcessGroup signals the process group led by pid. Processes started
+// before components ran in their own group are signalled directly.
+func signalProcessGroup(pid int, sig syscall.Signal) error {
+	err := syscall.Kill(-pid, sig)
+	if errors.Is(err, syscall.ESRCH) {
+		return syscall.Kill(pid, sig)
+	}
+	return err
+}
+
+// isProcessGroupRunning reports whether any process in the group led by pid
+// is still alive, falling back to pid itself when there is no such group
+func (m *Manager) isProcessGroupRunning(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+
+	err := syscall.Kill(-pid, syscall.Signal(0))
+	if errors.Is(err, syscall.ESRCH) {
+		return m.IsProcessRunning(pid)
+	}
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+func (m *Manager) monitorProcess(name string, cmd *exec.Cmd, logFile *os.File, limits *resourceLimits) {
 	defer logFile.Close()
 
 	err := cmd.Wait()
+	oomKilled := limits.oomKilled()
+	limits.release()
 
 	status, _ := m.db.GetComponentStatus(name)
 	status.Status = "stopped"
 	status.LastCheckedAt = time.Now()
+	status.ExitCode = cmd.ProcessState.ExitCode()
 
-	if err != nil {
+	if oomKilled {
+		status.Message = "Process was killed for exceeding its memory limit"
+		log.WithField("component", name).Warn("Component killed for exceeding its memory limit")
+	} else if err != nil {
 		status.Message = fmt.Sprintf("Process exited with error: %v", err)
 		log.WithFields(log.Fields{
 			"component": name,
@@ -494,8 +912,13 @@ func (m *Manager) monitorProcess(name string, cmd *exec.Cmd, logFile *os.File) {
 	m.db.UpsertComponentStatus(status)
 }
 
-func (m *Manager) downloadFile(url, expectedHash string) (string, error) {
-	log.WithField("url", url).Info("Downloading file")
+// downloadFile downloads url to a temporary file and checks its hash. The
+// download's progress is reported to progress, if set.
+func (m *Manager) downloadFile(url string, headers http.Header, expectedHash string, progress *downloadProgress) (string, error) {
+	log.WithFields(log.Fields{
+		"url":     url,
+		"headers": redactHeaders(headers),
+	}).Info("Downloading file")
 
 	tmpFile, err := os.CreateTemp("", "cosmos-download-*")
 	if err != nil {
@@ -503,27 +926,20 @@ func (m *Manager) downloadFile(url, expectedHash string) (string, error) {
 	}
 	defer tmpFile.Close()
 
-	resp, err := http.Get(url)
-	if err != nil {
-		os.Remove(tmpFile.Name())
-		return "", fmt.Errorf("failed to download: %w", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		os.Remove(tmpFile.Name())
-		return "", fmt.Errorf("download failed with status: %d", resp.StatusCode)
+	timeout := m.downloadOpts.Timeout
+	ctx, cancel := context.WithTimeoutCause(context.Background(), timeout,
+		fmt.Errorf("download timed out after %s", timeout))
+	defer cancel()
+	if progress != nil {
+		ctx = withDownloadProgress(ctx, progress)
 	}
 
-	hasher := sha256.New()
-	writer := io.MultiWriter(tmpFile, hasher)
-
-	if _, err := io.Copy(writer, resp.Body); err != nil {
+	actualHash, err := m.fetchFile(ctx, url, headers, tmpFile)
+	if err != nil {
 		os.Remove(tmpFile.Name())
-		return "", fmt.Errorf("failed to save file: %w", err)
+		return "", err
 	}
 
-	actualHash := hex.EncodeToString(hasher.Sum(nil))
 	if actualHash != expectedHash {
 		os.Remove(tmpFile.Name())
 		return "", fmt.Errorf("hash mismatch: expected %s, got %s", expectedHash, actualHash)
@@ -542,32 +958,121 @@ func (m *Manager) extractArchive(filePath, destDir, encoding string) error {
 
 	switch encoding {
 	case "tar.gz", "tgz":
-		return m.extractTarGz(filePath, destDir)
+		return m.extractTar(filePath, destDir, gzipReader)
+	case "tar.zst", "tzst":
+		return m.extractTar(filePath, destDir, zstdReader)
+	case "tar.xz", "txz":
+		return m.extractTar(filePath, destDir, xzReader)
+	case "zst":
+		return m.decompressFile(filePath, destDir, zstdReader)
+	case "xz":
+		return m.decompressFile(filePath, destDir, xzReader)
 	case "zip":
 		return m.extractZip(filePath, destDir)
 	case "plain", "":
+		// Copied rather than moved, since the archive stays in the cache
 		baseName := filepath.Base(filePath)
 		destPath := filepath.Join(destDir, baseName)
-		return os.Rename(filePath, destPath)
+		if err := copyFile(filePath, destPath); err != nil {
+			return err
+		}
+		// A plain artifact is the program itself, like a decompressed one
+		return os.Chmod(destPath, 0755)
 	default:
 		return fmt.Errorf("unsupported encoding: %s", encoding)
 	}
 }
 
-func (m *Manager) extractTarGz(filePath, destDir string) error {
+// renameFile is os.Rename, replaceable in tests
+var renameFile = os.Rename
+
+// readFile is os.ReadFile, replaceable in tests
+var readFile = os.ReadFile
+
+// moveFile renames src to dst, falling back to copying when they are on
+// different filesystems (downloads land in the system temp dir, which is
+// often a tmpfs separate from the data dir). The copy keeps src's mode.
+func moveFile(src, dst string) error {
+	err := renameFile(src, dst)
+	if err == nil || !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+
+	if err := copyFile(src, dst); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+// copyFile copies src to dst with src's mode
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return fmt.Errorf("failed to copy %s to %s: %w", src, dst, err)
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(dst)
+		return err
+	}
+
+	// The umask may have narrowed the mode OpenFile applied
+	return os.Chmod(dst, info.Mode().Perm())
+}
+
+// decompressor wraps a compressed stream with a reader of its contents
+type decompressor func(r io.Reader) (io.ReadCloser, error)
+
+func gzipReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+func zstdReader(r io.Reader) (io.ReadCloser, error) {
+	decoder, err := zstd.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return decoder.IOReadCloser(), nil
+}
+
+func xzReader(r io.Reader) (io.ReadCloser, error) {
+	xzr, err := xz.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(xzr), nil
+}
+
+func (m *Manager) extractTar(filePath, destDir string, decompress decompressor) error {
 	file, err := os.Open(filePath)
 	if err != nil {
 		return err
 	}
 	defer file.Close()
 
-	gzr, err := gzip.NewReader(file)
+	dr, err := decompress(file)
 	if err != nil {
 		return err
 	}
-	defer gzr.Close()
+	defer dr.Close()
 
-	tr := tar.NewReader(gzr)
+	tr := tar.NewReader(dr)
 
 	for {
 		header, err := tr.Next()
@@ -580,9 +1085,12 @@ func (m *Manager) extractTarGz(filePath, destDir string) error {
 
 		target := filepath.Join(destDir, header.Name)
 
-		if !strings.HasPrefix(target, filepath.Clean(destDir)+string(os.PathSeparator)) {
+		if !withinDir(destDir, target) {
 			return fmt.Errorf("illegal file path: %s", header.Name)
 		}
+		if err := checkNoSymlinks(destDir, target); err != nil {
+			return err
+		}
 
 		switch header.Typeflag {
 		case tar.TypeDir:
@@ -593,8 +1101,13 @@ func (m *Manager) extractTarGz(filePath, destDir string) error {
 			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
 				return err
 			}
+			// A file replaces a link of the same name rather than being
+			// written to wherever the link points
+			if err := removeSymlink(target); err != nil {
+				return err
+			}
 
-			outFile, err := os.OpenFile(target, os.O_CREATE|os.O_RDWR, os.FileMode(header.Mode))
+			outFile, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(header.Mode))
 			if err != nil {
 				return err
 			}
@@ -604,12 +1117,138 @@ func (m *Manager) extractTarGz(filePath, destDir string) error {
 				return err
 			}
 			outFile.Close()
+
+			// OpenFile applies the umask and leaves an existing file's mode
+			// alone, so set the archived permissions explicitly
+			if err := os.Chmod(target, header.FileInfo().Mode().Perm()); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			// Relative links resolve from the link's own directory
+			linkTarget := header.Linkname
+			if !filepath.IsAbs(linkTarget) {
+				linkTarget = filepath.Join(filepath.Dir(target), linkTarget)
+			}
+			if !withinDir(destDir, linkTarget) {
+				return fmt.Errorf("illegal symlink target: %s -> %s", header.Name, header.Linkname)
+			}
+
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			if err := os.RemoveAll(target); err != nil {
+				return err
+			}
+			if err := os.Symlink(header.Linkname, target); err != nil {
+				return err
+			}
+		case tar.TypeLink:
+			// Hard link names are relative to the archive root
+			linkTarget := filepath.Join(destDir, header.Linkname)
+			if !withinDir(destDir, linkTarget) {
+				return fmt.Errorf("illegal hard link target: %s -> %s", header.Name, header.Linkname)
+			}
+			// A hard link to a symlink copies its target, which may resolve
+			// outside the destination from the new link's directory
+			if err := checkNoSymlinks(destDir, linkTarget); err != nil {
+				return err
+			}
+			if info, err := os.Lstat(linkTarget); err == nil && info.Mode()&os.ModeSymlink != 0 {
+				return fmt.Errorf("illegal hard link to symlink: %s -> %s", header.Name, header.Linkname)
+			}
+
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			if err := os.RemoveAll(target); err != nil {
+				return err
+			}
+			if err := os.Link(linkTarget, target); err != nil {
+				return err
+			}
+		default:
+			log.WithFields(log.Fields{
+				"entry": header.Name,
+				"type":  string(header.Typeflag),
+			}).Warn("Skipping unsupported archive entry")
 		}
 	}
 
 	return nil
 }
 
+// withinDir reports whether path is inside dir, guarding extraction against
+// entries and links that escape the destination
+func withinDir(dir, path string) bool {
+	return strings.HasPrefix(filepath.Clean(path), filepath.Clean(dir)+string(os.PathSeparator))
+}
+
+// checkNoSymlinks refuses a path inside dir whose existing parent
+// directories include a symlink. withinDir only compares the text of paths,
+// so an entry written through a link extracted earlier, or a chain of them,
+// could still land outside dir.
+func checkNoSymlinks(dir, path string) error {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return fmt.Errorf("illegal file path: %s", path)
+	}
+
+	current := dir
+	parts := strings.Split(rel, string(os.PathSeparator))
+	for _, part := range parts[:len(parts)-1] {
+		current = filepath.Join(current, part)
+		info, err := os.Lstat(current)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("illegal file path through symlink: %s", rel)
+		}
+	}
+	return nil
+}
+
+// removeSymlink removes path if it is a symlink
+func removeSymlink(path string) error {
+	info, err := os.Lstat(path)
+	if err != nil || info.Mode()&os.ModeSymlink == 0 {
+		return nil
+	}
+	return os.Remove(path)
+}
+
+// decompressFile handles a single compressed binary (no tar), writing it
+// into destDir under the download's base name like a plain file
+func (m *Manager) decompressFile(filePath, destDir string, decompress decompressor) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	dr, err := decompress(file)
+	if err != nil {
+		return err
+	}
+	defer dr.Close()
+
+	destPath := filepath.Join(destDir, filepath.Base(filePath))
+	outFile, err := os.OpenFile(destPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0755)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(outFile, dr); err != nil {
+		outFile.Close()
+		return err
+	}
+
+	return outFile.Close()
+}
+
 func (m *Manager) extractZip(filePath, destDir string) error {
 	r, err := zip.OpenReader(filePath)
 	if err != nil {
@@ -620,9 +1259,12 @@ func (m *Manager) extractZip(filePath, destDir string) error {
 	for _, f := range r.File {
 		target := filepath.Join(destDir, f.Name)
 
-		if !strings.HasPrefix(target, filepath.Clean(destDir)+string(os.PathSeparator)) {
+		if !withinDir(destDir, target) {
 			return fmt.Errorf("illegal file path: %s", f.Name)
 		}
+		if err := checkNoSymlinks(destDir, target); err != nil {
+			return err
+		}
 
 		if f.FileInfo().IsDir() {
 			os.MkdirAll(target, 0755)
@@ -656,25 +1298,29 @@ func (m *Manager) extractZip(filePath, destDir string) error {
 	return nil
 }
 
-func (m *Manager) findExecutable(dir, componentName string) (string, error) {
-	var executable string
+// findExecutable picks the program binary in an extracted archive. An
+// explicit entrypoint is used as given. Otherwise the executables found are
+// considered in sorted order: a file named after the component wins, then a
+// lone top-level binary, then the only executable in the archive. Anything
+// else is ambiguous and needs an entrypoint.
+func (m *Manager) findExecutable(dir, componentName, entrypoint string) (string, error) {
+	if entrypoint != "" {
+		return resolveEntrypoint(dir, entrypoint)
+	}
+
+	var candidates []string
 
 	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
 
-		if info.IsDir() {
-			return nil
-		}
-
-		if info.Mode()&0111 != 0 {
-			if executable == "" || filepath.Base(path) == componentName {
-				executable = path
-				if filepath.Base(path) == componentName {
-					return filepath.SkipDir
-				}
+		if info.Mode().IsRegular() && info.Mode()&0111 != 0 {
+			rel, err := filepath.Rel(dir, path)
+			if err != nil {
+				return err
 			}
+			candidates = append(candidates, rel)
 		}
 
 		return nil
@@ -684,9 +1330,73 @@ func (m *Manager) findExecutable(dir, componentName string) (string, error) {
 		return "", err
 	}
 
-	if executable == "" {
+	if len(candidates) == 0 {
 		return "", fmt.Errorf("no executable found in %s", dir)
 	}
 
-	return executable, nil
+	sort.Strings(candidates)
+
+	if match, ok := pickShallowest(candidates, func(rel string) bool {
+		return filepath.Base(rel) == componentName
+	}); ok {
+		return filepath.Join(dir, match), nil
+	}
+
+	if match, ok := pickShallowest(candidates, func(rel string) bool {
+		return !strings.Contains(rel, string(os.PathSeparator))
+	}); ok {
+		return filepath.Join(dir, match), nil
+	}
+
+	if len(candidates) == 1 {
+		return filepath.Join(dir, candidates[0]), nil
+	}
+
+	return "", fmt.Errorf("found %d executables in %s, set an entrypoint to choose one: %s",
+		len(candidates), dir, strings.Join(candidates, ", "))
+}
+
+// pickShallowest returns the candidate matching match that is nearest the
+// archive root, if exactly one is
+func pickShallowest(candidates []string, match func(string) bool) (string, bool) {
+	best := ""
+	bestDepth := -1
+	tied := false
+
+	for _, rel := range candidates {
+		if !match(rel) {
+			continue
+		}
+
+		depth := strings.Count(rel, string(os.PathSeparator))
+		switch {
+		case bestDepth < 0 || depth < bestDepth:
+			best, bestDepth, tied = rel, depth, false
+		case depth == bestDepth:
+			tied = true
+		}
+	}
+
+	return best, bestDepth >= 0 && !tied
+}
+
+// resolveEntrypoint checks that entrypoint names an executable file inside dir
+func resolveEntrypoint(dir, entrypoint string) (string, error) {
+	path := filepath.Join(dir, entrypoint)
+	if !withinDir(dir, path) {
+		return "", fmt.Errorf("entrypoint %s is outside the program directory", entrypoint)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", fmt.Errorf("entrypoint %s not found in archive: %w", entrypoint, err)
+	}
+	if !info.Mode().IsRegular() {
+		return "", fmt.Errorf("entrypoint %s is not a regular file", entrypoint)
+	}
+	if info.Mode()&0111 == 0 {
+		return "", fmt.Errorf("entrypoint %s is not executable", entrypoint)
+	}
+
+	return path, nil
 }
@@ -0,0 +1,889 @@
+package component
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/metorial/fleet/cosmos/internal/agent/database"
+	"github.com/ulikunitz/xz"
+)
+
+type tarEntry struct {
+	name     string
+	content  string
+	typeflag byte
+	linkname string
+	mode     int64
+}
+
+func buildTar(t *testing.T, entries []tarEntry) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, entry := range entries {
+		header := &tar.Header{
+			Name:     entry.name,
+			Mode:     0755,
+			Size:     int64(len(entry.content)),
+			Typeflag: tar.TypeReg,
+			Linkname: entry.linkname,
+		}
+		if entry.mode != 0 {
+			header.Mode = entry.mode
+		}
+		if entry.typeflag != 0 {
+			header.Typeflag = entry.typeflag
+			header.Size = 0
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatalf("Failed to write tar header: %v", err)
+		}
+		if _, err := tw.Write([]byte(entry.content)); err != nil {
+			t.Fatalf("Failed to write tar entry: %v", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Failed to close tar writer: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func compress(t *testing.T, format string, data []byte) []byte {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	var err error
+
+	switch format {
+	case "gz":
+		w = gzip.NewWriter(&buf)
+	case "zst":
+		w, err = zstd.NewWriter(&buf)
+	case "xz":
+		w, err = xz.NewWriter(&buf)
+	default:
+		t.Fatalf("Unknown format: %s", format)
+	}
+	if err != nil {
+		t.Fatalf("Failed to create %s writer: %v", format, err)
+	}
+
+	if _, err := w.Write(data); err != nil {
+		t.Fatalf("Failed to compress: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Failed to finish compression: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func writeFixture(t *testing.T, data []byte) string {
+	path := filepath.Join(t.TempDir(), "cosmos-download-fixture")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatalf("Failed to write fixture: %v", err)
+	}
+	return path
+}
+
+func TestExtractArchiveFormats(t *testing.T) {
+	archive := buildTar(t, []tarEntry{
+		{name: "bin/app", content: "#!/bin/sh\necho app\n"},
+		{name: "README", content: "docs"},
+	})
+
+	tests := []struct {
+		encoding string
+		format   string
+	}{
+		{encoding: "tar.gz", format: "gz"},
+		{encoding: "tgz", format: "gz"},
+		{encoding: "tar.zst", format: "zst"},
+		{encoding: "tzst", format: "zst"},
+		{encoding: "tar.xz", format: "xz"},
+		{encoding: "txz", format: "xz"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.encoding, func(t *testing.T) {
+			m := &Manager{}
+			fixture := writeFixture(t, compress(t, tt.format, archive))
+			destDir := t.TempDir()
+
+			if err := m.extractArchive(fixture, destDir, tt.encoding); err != nil {
+				t.Fatalf("Extraction failed: %v", err)
+			}
+
+			content, err := os.ReadFile(filepath.Join(destDir, "bin", "app"))
+			if err != nil {
+				t.Fatalf("Expected extracted bin/app: %v", err)
+			}
+			if string(content) != "#!/bin/sh\necho app\n" {
+				t.Errorf("Unexpected content: %q", content)
+			}
+
+			if _, err := os.Stat(filepath.Join(destDir, "README")); err != nil {
+				t.Errorf("Expected extracted README: %v", err)
+			}
+		})
+	}
+}
+
+func TestExtractArchiveSingleCompressedFile(t *testing.T) {
+	binary := []byte("\x7fELF fake binary")
+
+	for _, format := range []string{"zst", "xz"} {
+		t.Run(format, func(t *testing.T) {
+			m := &Manager{}
+			fixture := writeFixture(t, compress(t, format, binary))
+			destDir := t.TempDir()
+
+			if err := m.extractArchive(fixture, destDir, format); err != nil {
+				t.Fatalf("Decompression failed: %v", err)
+			}
+
+			content, err := os.ReadFile(filepath.Join(destDir, filepath.Base(fixture)))
+			if err != nil {
+				t.Fatalf("Expected decompressed file: %v", err)
+			}
+			if !bytes.Equal(content, binary) {
+				t.Errorf("Unexpected content: %q", content)
+			}
+		})
+	}
+}
+
+func TestExtractArchiveRejectsPathTraversal(t *testing.T) {
+	archive := buildTar(t, []tarEntry{{name: "../escape", content: "bad"}})
+
+	for _, tt := range []struct{ encoding, format string }{
+		{"tar.gz", "gz"},
+		{"tar.zst", "zst"},
+		{"tar.xz", "xz"},
+	} {
+		t.Run(tt.encoding, func(t *testing.T) {
+			m := &Manager{}
+			fixture := writeFixture(t, compress(t, tt.format, archive))
+			destDir := t.TempDir()
+
+			err := m.extractArchive(fixture, destDir, tt.encoding)
+			if err == nil || !strings.Contains(err.Error(), "illegal file path") {
+				t.Errorf("Expected illegal file path error, got: %v", err)
+			}
+		})
+	}
+}
+
+func TestExtractArchiveUnsupportedEncoding(t *testing.T) {
+	m := &Manager{}
+	err := m.extractArchive(writeFixture(t, []byte("data")), t.TempDir(), "rar")
+	if err == nil || !strings.Contains(err.Error(), "unsupported encoding") {
+		t.Errorf("Expected unsupported encoding error, got: %v", err)
+	}
+}
+
+func TestExtractArchivePreservesLinksAndModes(t *testing.T) {
+	archive := buildTar(t, []tarEntry{
+		{name: "lib/libfoo.so.1.2", content: "shared library", mode: 0644},
+		{name: "lib/libfoo.so", typeflag: tar.TypeSymlink, linkname: "libfoo.so.1.2"},
+		{name: "bin/app", content: "#!/bin/sh\n", mode: 0750},
+		{name: "bin/app-alias", typeflag: tar.TypeLink, linkname: "bin/app"},
+	})
+
+	m := &Manager{}
+	fixture := writeFixture(t, compress(t, "gz", archive))
+	destDir := t.TempDir()
+
+	if err := m.extractArchive(fixture, destDir, "tar.gz"); err != nil {
+		t.Fatalf("Extraction failed: %v", err)
+	}
+
+	link := filepath.Join(destDir, "lib", "libfoo.so")
+	target, err := os.Readlink(link)
+	if err != nil {
+		t.Fatalf("Expected symlink to be restored: %v", err)
+	}
+	if target != "libfoo.so.1.2" {
+		t.Errorf("Expected symlink to point at libfoo.so.1.2, got %s", target)
+	}
+	if content, err := os.ReadFile(link); err != nil || string(content) != "shared library" {
+		t.Errorf("Expected symlink to resolve to the library, got %q (%v)", content, err)
+	}
+
+	info, err := os.Stat(filepath.Join(destDir, "bin", "app"))
+	if err != nil {
+		t.Fatalf("Expected bin/app: %v", err)
+	}
+	if info.Mode().Perm() != 0750 {
+		t.Errorf("Expected mode 0750, got %o", info.Mode().Perm())
+	}
+
+	alias, err := os.Stat(filepath.Join(destDir, "bin", "app-alias"))
+	if err != nil {
+		t.Fatalf("Expected hard link bin/app-alias: %v", err)
+	}
+	if !os.SameFile(info, alias) {
+		t.Error("Expected bin/app-alias to be a hard link to bin/app")
+	}
+}
+
+func TestExtractArchiveRejectsEscapingLinks(t *testing.T) {
+	tests := []struct {
+		name  string
+		entry tarEntry
+	}{
+		{name: "relative symlink", entry: tarEntry{name: "lib/evil", typeflag: tar.TypeSymlink, linkname: "../../etc/passwd"}},
+		{name: "absolute symlink", entry: tarEntry{name: "evil", typeflag: tar.TypeSymlink, linkname: "/etc/passwd"}},
+		{name: "hard link", entry: tarEntry{name: "evil", typeflag: tar.TypeLink, linkname: "../outside"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &Manager{}
+			fixture := writeFixture(t, compress(t, "gz", buildTar(t, []tarEntry{tt.entry})))
+
+			err := m.extractArchive(fixture, t.TempDir(), "tar.gz")
+			if err == nil || !strings.Contains(err.Error(), "illegal") {
+				t.Errorf("Expected illegal link error, got: %v", err)
+			}
+		})
+	}
+}
+
+func TestExtractArchiveRejectsWritesThroughSymlinks(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []tarEntry
+	}{
+		{name: "chained symlinks", entries: []tarEntry{
+			{name: "r/", typeflag: tar.TypeDir},
+			{name: "p/q/", typeflag: tar.TypeDir},
+			{name: "p/q/a", typeflag: tar.TypeSymlink, linkname: "../../r"},
+			{name: "p/q/a/b", typeflag: tar.TypeSymlink, linkname: "../.."},
+			{name: "p/q/a/b/escaped.txt", content: "escaped"},
+		}},
+		{name: "directory through symlink", entries: []tarEntry{
+			{name: "r/", typeflag: tar.TypeDir},
+			{name: "a", typeflag: tar.TypeSymlink, linkname: "r"},
+			{name: "a/escaped/", typeflag: tar.TypeDir},
+		}},
+		{name: "hard link to symlink", entries: []tarEntry{
+			{name: "d/e/", typeflag: tar.TypeDir},
+			{name: "d/e/l", typeflag: tar.TypeSymlink, linkname: "../../x"},
+			{name: "escaped", typeflag: tar.TypeLink, linkname: "d/e/l"},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &Manager{}
+			fixture := writeFixture(t, compress(t, "gz", buildTar(t, tt.entries)))
+			parent := t.TempDir()
+			destDir := filepath.Join(parent, "extract")
+			if err := os.Mkdir(destDir, 0755); err != nil {
+				t.Fatal(err)
+			}
+
+			err := m.extractArchive(fixture, destDir, "tar.gz")
+			if err == nil || !strings.Contains(err.Error(), "illegal") {
+				t.Errorf("Expected the write through a symlink to be refused, got: %v", err)
+			}
+			if entries := dirEntries(t, parent); len(entries) != 1 || entries[0] != "extract" {
+				t.Errorf("Expected nothing written outside the extract dir, got %v", entries)
+			}
+		})
+	}
+}
+
+func TestExtractArchiveReplacesSymlinkWithFile(t *testing.T) {
+	m := &Manager{}
+	fixture := writeFixture(t, compress(t, "gz", buildTar(t, []tarEntry{
+		{name: "target", content: "original"},
+		{name: "app", typeflag: tar.TypeSymlink, linkname: "target"},
+		{name: "app", content: "replacement"},
+	})))
+	destDir := t.TempDir()
+
+	if err := m.extractArchive(fixture, destDir, "tar.gz"); err != nil {
+		t.Fatalf("Failed to extract: %v", err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(destDir, "target")); string(data) != "original" {
+		t.Errorf("Expected the link target to be left alone, got %q", data)
+	}
+	if info, err := os.Lstat(filepath.Join(destDir, "app")); err != nil || !info.Mode().IsRegular() {
+		t.Errorf("Expected the link to be replaced by a file, got %v (%v)", info, err)
+	}
+}
+
+func TestExtractArchivePlainKeepsArchive(t *testing.T) {
+	binary := []byte("#!/bin/sh\necho plain\n")
+	fixture := writeFixture(t, binary)
+	destDir := t.TempDir()
+
+	m := &Manager{}
+	if err := m.extractArchive(fixture, destDir, "plain"); err != nil {
+		t.Fatalf("Expected plain extraction to succeed, got: %v", err)
+	}
+
+	destPath := filepath.Join(destDir, filepath.Base(fixture))
+	content, err := os.ReadFile(destPath)
+	if err != nil {
+		t.Fatalf("Expected copied file: %v", err)
+	}
+	if !bytes.Equal(content, binary) {
+		t.Errorf("Unexpected content: %q", content)
+	}
+
+	info, err := os.Stat(destPath)
+	if err != nil {
+		t.Fatalf("Failed to stat copied file: %v", err)
+	}
+	if info.Mode()&0111 == 0 {
+		t.Errorf("Expected copied file to be executable, got mode %v", info.Mode())
+	}
+
+	// The archive may be the cached copy, which later deployments reuse
+	if data, err := os.ReadFile(fixture); err != nil || !bytes.Equal(data, binary) {
+		t.Errorf("Expected the archive to be kept, got %q (%v)", data, err)
+	}
+}
+
+func TestMoveFileAcrossFilesystems(t *testing.T) {
+	original := renameFile
+	renameFile = func(oldpath, newpath string) error {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.EXDEV}
+	}
+	defer func() { renameFile = original }()
+
+	binary := []byte("#!/bin/sh\necho plain\n")
+	fixture := writeFixture(t, binary)
+	if err := os.Chmod(fixture, 0750); err != nil {
+		t.Fatal(err)
+	}
+	destPath := filepath.Join(t.TempDir(), "dest")
+
+	if err := moveFile(fixture, destPath); err != nil {
+		t.Fatalf("Expected copy fallback to succeed, got: %v", err)
+	}
+
+	content, err := os.ReadFile(destPath)
+	if err != nil {
+		t.Fatalf("Expected moved file: %v", err)
+	}
+	if !bytes.Equal(content, binary) {
+		t.Errorf("Unexpected content: %q", content)
+	}
+
+	info, err := os.Stat(destPath)
+	if err != nil {
+		t.Fatalf("Failed to stat moved file: %v", err)
+	}
+	if info.Mode().Perm() != 0750 {
+		t.Errorf("Expected moved file to keep its mode, got %v", info.Mode())
+	}
+
+	if _, err := os.Stat(fixture); !os.IsNotExist(err) {
+		t.Errorf("Expected source file to be removed after copy, got: %v", err)
+	}
+}
+
+func TestMoveFilePropagatesOtherRenameErrors(t *testing.T) {
+	original := renameFile
+	renameFile = func(oldpath, newpath string) error {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.EACCES}
+	}
+	defer func() { renameFile = original }()
+
+	fixture := writeFixture(t, []byte("data"))
+	err := moveFile(fixture, filepath.Join(t.TempDir(), "dest"))
+	if !errors.Is(err, syscall.EACCES) {
+		t.Errorf("Expected EACCES to be returned, got: %v", err)
+	}
+}
+
+// dirEntries lists the names in dir
+func dirEntries(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("Failed to read dir: %v", err)
+	}
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	return names
+}
+
+func TestWriteFileAtomicReplacesFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "setup.sh")
+	if err := os.WriteFile(path, []byte("old"), 0644); err != nil {
+		t.Fatalf("Failed to write existing file: %v", err)
+	}
+
+	if err := writeFileAtomic(path, []byte("echo new\n"), 0755); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil || string(data) != "echo new\n" {
+		t.Errorf("Expected the new content, got %q (%v)", data, err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0755 {
+		t.Errorf("Expected mode 0755, got %v (%v)", info.Mode().Perm(), err)
+	}
+	if names := dirEntries(t, dir); len(names) != 1 {
+		t.Errorf("Expected no temporary files to be left, got %v", names)
+	}
+}
+
+func TestWriteFileAtomicConcurrentWriters(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "setup.sh")
+
+	contents := make(map[string]bool)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		content := strings.Repeat(strconv.Itoa(i), 64*1024)
+		contents[content] = true
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := writeFileAtomic(path, []byte(content), 0755); err != nil {
+				t.Errorf("Failed to write file: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read file: %v", err)
+	}
+	if !contents[string(data)] {
+		t.Error("Expected the file to hold exactly one writer's content")
+	}
+	if names := dirEntries(t, dir); len(names) != 1 {
+		t.Errorf("Expected no temporary files to be left, got %v", names)
+	}
+}
+
+func TestWriteFileAtomicRemovesTemporaryFileOnFailure(t *testing.T) {
+	dir := t.TempDir()
+	// A directory can't be replaced by a file, so the rename fails
+	path := filepath.Join(dir, "setup.sh")
+	if err := os.MkdirAll(filepath.Join(path, "child"), 0755); err != nil {
+		t.Fatalf("Failed to create dir: %v", err)
+	}
+
+	err := writeFileAtomic(path, []byte("echo hi\n"), 0755)
+	if err == nil || !strings.Contains(err.Error(), "failed to replace file") {
+		t.Fatalf("Expected the rename to fail, got %v", err)
+	}
+	if names := dirEntries(t, dir); len(names) != 1 || names[0] != "setup.sh" {
+		t.Errorf("Expected the temporary file to be removed, got %v", names)
+	}
+}
+
+func TestWriteFileAtomicRejectsCorruptedWrite(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "setup.sh")
+	if err := os.WriteFile(path, []byte("echo old\n"), 0755); err != nil {
+		t.Fatalf("Failed to write existing file: %v", err)
+	}
+
+	// The disk hands back something other than what was written
+	readFile = func(name string) ([]byte, error) { return []byte("echo corrupt\n"), nil }
+	t.Cleanup(func() { readFile = os.ReadFile })
+
+	err := writeFileAtomic(path, []byte("echo new\n"), 0755)
+	if err == nil || !strings.Contains(err.Error(), "content hash mismatch") {
+		t.Fatalf("Expected a hash mismatch, got %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil || string(data) != "echo old\n" {
+		t.Errorf("Expected the existing file to be kept, got %q (%v)", data, err)
+	}
+	if names := dirEntries(t, dir); len(names) != 1 {
+		t.Errorf("Expected the temporary file to be removed, got %v", names)
+	}
+}
+
+func TestDeployProgramPrunesOldVersions(t *testing.T) {
+	dataDir := t.TempDir()
+	db, err := database.NewAgentDB(dataDir)
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	defer db.Close()
+
+	v1 := compress(t, "gz", buildTar(t, []tarEntry{
+		{name: "app", content: "#!/bin/sh\nexec sleep 300\n"},
+		{name: "legacy.conf", content: "only in v1", mode: 0644},
+	}))
+	v2 := compress(t, "gz", buildTar(t, []tarEntry{
+		{name: "app", content: "#!/bin/sh\nexec sleep 301\n"},
+	}))
+
+	var mu sync.Mutex
+	archive := v1
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		w.Write(archive)
+	}))
+	defer server.Close()
+
+	m := NewManager(db, dataDir)
+	defer m.StopComponent("app")
+	programDir := filepath.Join(dataDir, "programs", "app")
+
+	deploy := func(data []byte) {
+		t.Helper()
+		mu.Lock()
+		archive = data
+		mu.Unlock()
+		err := m.DeployProgram(&database.Component{Name: "app", Type: "program", Hash: hashOf(data), ContentURL: server.URL, ContentURLEncoding: "tar.gz"})
+		if err != nil {
+			t.Fatalf("Failed to deploy: %v", err)
+		}
+	}
+
+	deploy(v1)
+	if _, err := os.Stat(filepath.Join(programDir, hashOf(v1), "legacy.conf")); err != nil {
+		t.Fatalf("Expected v1 in its own directory: %v", err)
+	}
+
+	deploy(v2)
+
+	want := []string{currentVersionLink, hashOf(v2)}
+	sort.Strings(want)
+	if got := dirEntries(t, programDir); strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("Expected only the current link and v2, got %v", got)
+	}
+	if target, err := os.Readlink(filepath.Join(programDir, currentVersionLink)); err != nil || target != hashOf(v2) {
+		t.Errorf("Expected the current link to point at v2, got %q (%v)", target, err)
+	}
+
+	component, err := db.GetComponent("app")
+	if err != nil {
+		t.Fatalf("Failed to get component: %v", err)
+	}
+	if component.Executable != filepath.Join(programDir, currentVersionLink, "app") {
+		t.Errorf("Expected the executable to run through the current link, got %s", component.Executable)
+	}
+	content, err := os.ReadFile(component.Executable)
+	if err != nil || !strings.Contains(string(content), "sleep 301") {
+		t.Errorf("Expected the executable to be v2, got %q (%v)", content, err)
+	}
+}
+
+func writeExecutables(t *testing.T, dir string, files map[string]os.FileMode) {
+	for name, mode := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Failed to create dir: %v", err)
+		}
+		if err := os.WriteFile(path, []byte("#!/bin/sh\n"), mode); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+}
+
+func TestFindExecutable(t *testing.T) {
+	tests := []struct {
+		name        string
+		files       map[string]os.FileMode
+		entrypoint  string
+		expected    string
+		expectError string
+	}{
+		{
+			name:     "exact name match wins",
+			files:    map[string]os.FileMode{"aaa-wrapper": 0755, "bin/myapp": 0755},
+			expected: "bin/myapp",
+		},
+		{
+			name:     "shallowest exact match",
+			files:    map[string]os.FileMode{"myapp": 0755, "tools/myapp": 0755},
+			expected: "myapp",
+		},
+		{
+			name:     "lone top-level binary",
+			files:    map[string]os.FileMode{"server": 0755, "scripts/helper.sh": 0755},
+			expected: "server",
+		},
+		{
+			name:     "only executable",
+			files:    map[string]os.FileMode{"bin/server": 0755, "README": 0644},
+			expected: "bin/server",
+		},
+		{
+			name:        "ambiguous",
+			files:       map[string]os.FileMode{"bin/a": 0755, "bin/b": 0755},
+			expectError: "set an entrypoint to choose one: bin/a, bin/b",
+		},
+		{
+			name:        "no executables",
+			files:       map[string]os.FileMode{"README": 0644},
+			expectError: "no executable found",
+		},
+		{
+			name:       "explicit entrypoint",
+			files:      map[string]os.FileMode{"bin/a": 0755, "bin/b": 0755},
+			entrypoint: "bin/b",
+			expected:   "bin/b",
+		},
+		{
+			name:        "entrypoint not executable",
+			files:       map[string]os.FileMode{"bin/a": 0644},
+			entrypoint:  "bin/a",
+			expectError: "not executable",
+		},
+		{
+			name:        "entrypoint missing",
+			files:       map[string]os.FileMode{"bin/a": 0755},
+			entrypoint:  "bin/missing",
+			expectError: "not found in archive",
+		},
+		{
+			name:        "entrypoint outside directory",
+			files:       map[string]os.FileMode{"bin/a": 0755},
+			entrypoint:  "../a",
+			expectError: "outside the program directory",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeExecutables(t, dir, tt.files)
+
+			m := &Manager{}
+			path, err := m.findExecutable(dir, "myapp", tt.entrypoint)
+
+			if tt.expectError != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.expectError) {
+					t.Errorf("Expected error containing %q, got path %q, err %v", tt.expectError, path, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if path != filepath.Join(dir, tt.expected) {
+				t.Errorf("Expected %s, got %s", filepath.Join(dir, tt.expected), path)
+			}
+		})
+	}
+}
+
+func TestStopComponentKillsChildren(t *testing.T) {
+	dataDir := t.TempDir()
+	db, err := database.NewAgentDB(dataDir)
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	defer db.Close()
+
+	programDir := filepath.Join(dataDir, "programs", "forker")
+	if err := os.MkdirAll(programDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	childPIDFile := filepath.Join(programDir, "child.pid")
+	script := filepath.Join(programDir, "forker")
+	if err := os.WriteFile(script, []byte("#!/bin/sh\nsleep 300 &\necho $! > "+childPIDFile+"\nwait\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.UpsertComponent(&database.Component{Name: "forker", Type: "program", Hash: "h", Executable: script}); err != nil {
+		t.Fatalf("Failed to store component: %v", err)
+	}
+
+	m := NewManager(db, dataDir)
+	if err := m.StartComponent("forker"); err != nil {
+		t.Fatalf("Failed to start component: %v", err)
+	}
+
+	var childPID int
+	deadline := time.Now().Add(5 * time.Second)
+	for childPID == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Child process never started")
+		}
+		if data, err := os.ReadFile(childPIDFile); err == nil {
+			childPID, _ = strconv.Atoi(strings.TrimSpace(string(data)))
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	if err := m.StopComponent("forker"); err != nil {
+		t.Fatalf("Failed to stop component: %v", err)
+	}
+
+	deadline = time.Now().Add(5 * time.Second)
+	for processAlive(childPID) {
+		if time.Now().After(deadline) {
+			syscall.Kill(childPID, syscall.SIGKILL)
+			t.Fatalf("Child process %d survived StopComponent", childPID)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestStartComponentUsesWorkingDir(t *testing.T) {
+	dataDir := t.TempDir()
+	db, err := database.NewAgentDB(dataDir)
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	defer db.Close()
+
+	scriptDir := filepath.Join(dataDir, "scripts")
+	if err := os.MkdirAll(scriptDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	workingDir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	script := filepath.Join(scriptDir, "pwd.sh")
+	if err := os.WriteFile(script, []byte("#!/bin/sh\npwd -P > "+filepath.Join(dataDir, "cwd")+"\nexec sleep 300\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	component := &database.Component{Name: "pwd", Type: "script", Hash: "h", Executable: script, Managed: true, WorkingDir: workingDir}
+	if err := db.UpsertComponent(component); err != nil {
+		t.Fatalf("Failed to store component: %v", err)
+	}
+
+	m := NewManager(db, dataDir)
+	if err := m.StartComponent("pwd"); err != nil {
+		t.Fatalf("Failed to start component: %v", err)
+	}
+	defer m.StopComponent("pwd")
+
+	var cwd string
+	deadline := time.Now().Add(5 * time.Second)
+	for cwd == "" {
+		if time.Now().After(deadline) {
+			t.Fatal("Component never wrote its working directory")
+		}
+		if data, err := os.ReadFile(filepath.Join(dataDir, "cwd")); err == nil {
+			cwd = strings.TrimSpace(string(data))
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if cwd != workingDir {
+		t.Errorf("Expected the working directory to be %s, got %s", workingDir, cwd)
+	}
+
+	// A working directory that doesn't exist fails the start
+	component.WorkingDir = filepath.Join(workingDir, "missing")
+	component.Name = "missing"
+	if err := db.UpsertComponent(component); err != nil {
+		t.Fatalf("Failed to store component: %v", err)
+	}
+	err = m.StartComponent("missing")
+	if err == nil || !strings.Contains(err.Error(), "working directory") {
+		t.Errorf("Expected a missing working directory to be reported, got %v", err)
+	}
+}
+
+// processAlive treats zombies as gone, since only their parent can reap them
+func processAlive(pid int) bool {
+	if syscall.Kill(pid, syscall.Signal(0)) != nil {
+		return false
+	}
+	stat, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return false
+	}
+	fields := strings.Fields(string(stat[bytes.LastIndexByte(stat, ')')+1:]))
+	return len(fields) == 0 || fields[0] != "Z"
+}
+
+func TestTailComponentLog(t *testing.T) {
+	dataDir := t.TempDir()
+	m := &Manager{dataDir: dataDir}
+
+	logDir := filepath.Join(dataDir, "logs")
+	if err := os.MkdirAll(logDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(logDir, "app.log"), []byte("one\ntwo\nthree\nfour\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := m.TailComponentLog("app", 2)
+	if err != nil {
+		t.Fatalf("TailComponentLog failed: %v", err)
+	}
+	if got != "three\nfour\n" {
+		t.Errorf("Expected the last two lines, got %q", got)
+	}
+
+	if _, err := m.TailComponentLog("missing", 10); err == nil {
+		t.Error("Expected an error for a component without a log")
+	}
+	if _, err := m.TailComponentLog("../etc/passwd", 10); err == nil {
+		t.Error("Expected an error for an invalid component name")
+	}
+}
+
+func TestLastLinesDropsPartialFirstLine(t *testing.T) {
+	if got := lastLines("tial line\nfull line\n", 10, true); got != "full line\n" {
+		t.Errorf("Expected the partial line to be dropped, got %q", got)
+	}
+}
+
+func TestDeployRejectsInvalidComponentNames(t *testing.T) {
+	dataDir := t.TempDir()
+	m := NewManager(nil, dataDir)
+
+	tests := []struct {
+		name      string
+		component *database.Component
+	}{
+		{"program escaping the programs directory", &database.Component{Name: "../../etc", Type: "program", ContentURL: "https://example.com/app.tar.gz"}},
+		{"script with a path separator", &database.Component{Name: "a/b", Type: "script", Content: "echo hi"}},
+		{"managed script with an empty name", &database.Component{Name: "", Type: "script", Content: "echo hi", Managed: true}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var err error
+			if tt.component.Type == "program" {
+				err = m.DeployProgram(tt.component)
+			} else {
+				err = m.DeployScript(tt.component)
+			}
+			if err == nil || !strings.Contains(err.Error(), "component name") {
+				t.Errorf("Expected the name to be rejected, got %v", err)
+			}
+		})
+	}
+
+	entries, err := os.ReadDir(dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("Expected nothing to be written for invalid names, got %d entries", len(entries))
+	}
+}
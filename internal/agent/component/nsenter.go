@@ -0,0 +1,188 @@
+package component
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"time"
+)
+
+// Unmanaged script execution modes
+const (
+	// ScriptModeNsenter runs unmanaged scripts in the host's namespaces,
+	// for agents running in a container
+	ScriptModeNsenter = "nsenter"
+	// ScriptModeDirect runs unmanaged scripts as children of the agent, for
+	// agents running on the host itself
+	ScriptModeDirect = "direct"
+)
+
+// ScriptExecution controls how unmanaged scripts are run
+type ScriptExecution struct {
+	Mode string
+	// TargetPID is the process whose namespaces scripts enter, normally
+	// the host's init
+	TargetPID int
+	// Namespaces are the namespaces entered: mount, uts, ipc, net, pid,
+	// user or cgroup
+	Namespaces []string
+	// WorkingDir is where scripts run unless their component sets a
+	// working directory
+	WorkingDir string
+	// HostScriptDir is where the host sees the agent's scripts directory
+	HostScriptDir string
+	// Timeout is how long a script may run before it is killed
+	Timeout time.Duration
+}
+
+var defaultScriptExecution = ScriptExecution{
+	Mode:          ScriptModeNsenter,
+	TargetPID:     1,
+	Namespaces:    []string{"mount", "uts", "ipc", "net", "pid"},
+	WorkingDir:    "/home/ubuntu",
+	HostScriptDir: "/opt/cosmos-agent/scripts",
+	Timeout:       30 * time.Minute,
+}
+
+// nsenterFlags are the nsenter flags that enter each namespace
+var nsenterFlags = map[string]string{
+	"mount":  "-m",
+	"uts":    "-u",
+	"ipc":    "-i",
+	"net":    "-n",
+	"pid":    "-p",
+	"user":   "-U",
+	"cgroup": "-C",
+}
+
+// hostBaseEnv is the environment scripts start with in the host namespaces,
+// where the agent's own environment doesn't apply
+var hostBaseEnv = []string{
+	"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin",
+	"HOME=/root",
+	"USER=root",
+}
+
+// SetScriptExecution sets how unmanaged scripts are run. Unset fields keep
+// their defaults.
+func (m *Manager) SetScriptExecution(execution ScriptExecution) error {
+	if execution.Mode == "" {
+		execution.Mode = defaultScriptExecution.Mode
+	}
+	if execution.Mode != ScriptModeNsenter && execution.Mode != ScriptModeDirect {
+		return fmt.Errorf("invalid unmanaged script mode %q: must be %s or %s", execution.Mode, ScriptModeNsenter, ScriptModeDirect)
+	}
+	if execution.TargetPID <= 0 {
+		execution.TargetPID = defaultScriptExecution.TargetPID
+	}
+	if len(execution.Namespaces) == 0 {
+		execution.Namespaces = defaultScriptExecution.Namespaces
+	}
+	for _, namespace := range execution.Namespaces {
+		if _, ok := nsenterFlags[namespace]; !ok {
+			return fmt.Errorf("invalid namespace %q: must be mount, uts, ipc, net, pid, user or cgroup", namespace)
+		}
+	}
+	if execution.WorkingDir == "" {
+		execution.WorkingDir = defaultScriptExecution.WorkingDir
+	}
+	if execution.HostScriptDir == "" {
+		execution.HostScriptDir = defaultScriptExecution.HostScriptDir
+	}
+	if execution.Timeout <= 0 {
+		execution.Timeout = defaultScriptExecution.Timeout
+	}
+
+	m.scriptExecution = execution
+	m.nsenterErr = execution.check()
+	return nil
+}
+
+// check verifies that unmanaged scripts can be executed. In nsenter mode,
+// nsenter must be installed and the target must be outside the agent's own
+// namespaces, so PID 1 must be the host init rather than the agent's
+// container init. A target sharing the agent's mount namespace would run
+// scripts inside the container instead of on the host.
+func (s ScriptExecution) check() error {
+	if s.Mode == ScriptModeDirect {
+		if _, err := exec.LookPath("bash"); err != nil {
+			return fmt.Errorf("bash not found in PATH")
+		}
+		return nil
+	}
+
+	if _, err := exec.LookPath("nsenter"); err != nil {
+		return fmt.Errorf("nsenter not found in PATH; install util-linux in the agent image")
+	}
+
+	if os.Getpid() == s.TargetPID {
+		return fmt.Errorf("agent is running as PID %d, so it cannot enter the host namespaces; run the agent container with the host PID namespace (pid: host)", s.TargetPID)
+	}
+
+	nsPath := fmt.Sprintf("/proc/%d/ns/mnt", s.TargetPID)
+	targetNS, err := os.Readlink(nsPath)
+	if err != nil {
+		return fmt.Errorf("cannot access %s (%v); the agent needs to run as root with the host PID namespace", nsPath, err)
+	}
+
+	selfNS, err := os.Readlink("/proc/self/ns/mnt")
+	if err != nil {
+		return fmt.Errorf("cannot access /proc/self/ns/mnt: %w", err)
+	}
+	if targetNS == selfNS {
+		return fmt.Errorf("PID %d shares the agent's mount namespace, so scripts would not run on the host; run the agent container with the host PID namespace (pid: host)", s.TargetPID)
+	}
+
+	return nil
+}
+
+// command builds the command an unmanaged script runs as. In nsenter mode
+// the host's copy of the script runs in the target's namespaces with a basic
+// environment; in direct mode the agent's copy runs with the agent's
+// environment. Args are passed to the script as they are, never through a
+// shell. The script gets a process group of its own so it can be killed
+// with everything it started.
+func (s ScriptExecution) command(scriptPath, workingDir string, args []string, env map[string]string) *exec.Cmd {
+	if workingDir == "" {
+		workingDir = s.WorkingDir
+	}
+
+	keys := make([]string, 0, len(env))
+	for k := range env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	componentEnv := make([]string, 0, len(keys))
+	for _, k := range keys {
+		componentEnv = append(componentEnv, fmt.Sprintf("%s=%s", k, env[k]))
+	}
+
+	if s.Mode == ScriptModeDirect {
+		cmd := exec.Command("bash", append([]string{scriptPath}, args...)...)
+		cmd.Dir = workingDir
+		cmd.Env = append(os.Environ(), componentEnv...)
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+		return cmd
+	}
+
+	nsenterArgs := []string{"-t", fmt.Sprint(s.TargetPID)}
+	for _, namespace := range s.Namespaces {
+		nsenterArgs = append(nsenterArgs, nsenterFlags[namespace])
+	}
+
+	// The shell changes directory itself since nsenter's -w flag may not be
+	// available; the directory, script and args are its positional
+	// parameters
+	hostScriptPath := filepath.Join(s.HostScriptDir, filepath.Base(scriptPath))
+	nsenterArgs = append(nsenterArgs, "--",
+		"bash", "-c", `cd -- "$1" && shift && exec bash "$@"`, "cosmos-script", workingDir, hostScriptPath)
+	nsenterArgs = append(nsenterArgs, args...)
+
+	cmd := exec.Command("nsenter", nsenterArgs...)
+	cmd.Env = append(append([]string{}, hostBaseEnv...), componentEnv...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	return cmd
+}
@@ -0,0 +1,165 @@
+package component
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/metorial/fleet/cosmos/internal/agent/database"
+)
+
+func TestUnmanagedScriptCommandNsenter(t *testing.T) {
+	m := &Manager{}
+	if err := m.SetScriptExecution(ScriptExecution{TargetPID: 42, Namespaces: []string{"mount", "net"}}); err != nil {
+		t.Fatalf("Failed to set script execution: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		workingDir string
+		args       []string
+		wantTail   []string
+	}{
+		{"defaults", "", nil, []string{"/home/ubuntu", "/opt/cosmos-agent/scripts/setup.sh"}},
+		{"working dir and args", "/srv/it's here", []string{"--name", "a b; rm -rf /"},
+			[]string{"/srv/it's here", "/opt/cosmos-agent/scripts/setup.sh", "--name", "a b; rm -rf /"}},
+	}
+
+	for _, tt := range tests {
+		cmd := m.scriptExecution.command("/var/lib/cosmos/scripts/setup.sh", tt.workingDir, tt.args, map[string]string{"B": "2", "A": "1"})
+
+		want := append([]string{"nsenter", "-t", "42", "-m", "-n", "--",
+			"bash", "-c", `cd -- "$1" && shift && exec bash "$@"`, "cosmos-script"}, tt.wantTail...)
+		if !slices.Equal(cmd.Args, want) {
+			t.Errorf("%s: expected args %q, got %q", tt.name, want, cmd.Args)
+		}
+
+		// The host's environment, not the agent's, plus the component's
+		wantEnv := append(append([]string{}, hostBaseEnv...), "A=1", "B=2")
+		if !slices.Equal(cmd.Env, wantEnv) {
+			t.Errorf("%s: expected env %q, got %q", tt.name, wantEnv, cmd.Env)
+		}
+	}
+}
+
+func TestUnmanagedScriptCommandDirect(t *testing.T) {
+	t.Setenv("COSMOS_TEST_AGENT_ENV", "kept")
+
+	m := &Manager{}
+	if err := m.SetScriptExecution(ScriptExecution{Mode: ScriptModeDirect, WorkingDir: "/tmp"}); err != nil {
+		t.Fatalf("Failed to set script execution: %v", err)
+	}
+	if err := m.nsenterErr; err != nil {
+		t.Errorf("Expected direct mode to only need bash, got %v", err)
+	}
+
+	cmd := m.scriptExecution.command("/var/lib/cosmos/scripts/setup.sh", "", []string{"--fast"}, map[string]string{"A": "1"})
+
+	if want := []string{"bash", "/var/lib/cosmos/scripts/setup.sh", "--fast"}; !slices.Equal(cmd.Args, want) {
+		t.Errorf("Expected args %q, got %q", want, cmd.Args)
+	}
+	if cmd.Dir != "/tmp" {
+		t.Errorf("Expected the default working dir, got %q", cmd.Dir)
+	}
+	if !slices.Contains(cmd.Env, "COSMOS_TEST_AGENT_ENV=kept") || cmd.Env[len(cmd.Env)-1] != "A=1" {
+		t.Errorf("Expected the agent's environment plus the component's, got %q", cmd.Env)
+	}
+
+	cmd = m.scriptExecution.command("/var/lib/cosmos/scripts/setup.sh", "/srv/app", nil, nil)
+	if cmd.Dir != "/srv/app" {
+		t.Errorf("Expected the component's working dir, got %q", cmd.Dir)
+	}
+}
+
+func TestSetScriptExecutionRejectsInvalidSettings(t *testing.T) {
+	m := &Manager{}
+
+	err := m.SetScriptExecution(ScriptExecution{Mode: "chroot"})
+	if err == nil || !strings.Contains(err.Error(), `invalid unmanaged script mode "chroot"`) {
+		t.Errorf("Expected an unknown mode to be rejected, got %v", err)
+	}
+	err = m.SetScriptExecution(ScriptExecution{Namespaces: []string{"mount", "time"}})
+	if err == nil || !strings.Contains(err.Error(), `invalid namespace "time"`) {
+		t.Errorf("Expected an unknown namespace to be rejected, got %v", err)
+	}
+}
+
+func TestScriptExecutionCheck(t *testing.T) {
+	bin := t.TempDir()
+	t.Setenv("PATH", bin)
+
+	err := defaultScriptExecution.check()
+	if err == nil || !strings.Contains(err.Error(), "nsenter not found in PATH") {
+		t.Errorf("Expected a missing nsenter to be reported, got %v", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(bin, "nsenter"), []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	self := defaultScriptExecution
+	self.TargetPID = os.Getpid()
+	err = self.check()
+	if err == nil || !strings.Contains(err.Error(), "cannot enter the host namespaces") {
+		t.Errorf("Expected the agent's own PID as the target to be rejected, got %v", err)
+	}
+
+	// The test binary's parent runs in the same mount namespace, as the init
+	// of the agent's container would without the host PID namespace
+	shared := defaultScriptExecution
+	shared.TargetPID = os.Getppid()
+	err = shared.check()
+	if err == nil || !strings.Contains(err.Error(), "shares the agent's mount namespace") {
+		t.Errorf("Expected a target in the agent's mount namespace to be rejected, got %v", err)
+	}
+}
+
+func TestUnmanagedScriptTimesOut(t *testing.T) {
+	dataDir := t.TempDir()
+	db, err := database.NewAgentDB(dataDir)
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	defer db.Close()
+
+	m := NewManager(db, dataDir)
+	if err := m.SetScriptExecution(ScriptExecution{Mode: ScriptModeDirect, WorkingDir: dataDir, Timeout: 500 * time.Millisecond}); err != nil {
+		t.Fatalf("Failed to set script execution: %v", err)
+	}
+
+	childPIDFile := filepath.Join(dataDir, "child.pid")
+	started := time.Now()
+	err = m.DeployScript(&database.Component{
+		Name:    "hang",
+		Type:    "script",
+		Hash:    "h",
+		Content: "echo starting up\nsleep 300 &\necho $! > " + childPIDFile + "\nwait\n",
+	})
+	if err == nil || !strings.Contains(err.Error(), "script timed out after 500ms") {
+		t.Fatalf("Expected the script to time out, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "output so far:\nstarting up") {
+		t.Errorf("Expected the partial output in the failure, got %v", err)
+	}
+	if elapsed := time.Since(started); elapsed > 10*time.Second {
+		t.Errorf("Expected the script to be killed at its timeout, took %s", elapsed)
+	}
+
+	data, err := os.ReadFile(childPIDFile)
+	if err != nil {
+		t.Fatalf("Failed to read child PID: %v", err)
+	}
+	childPID, _ := strconv.Atoi(strings.TrimSpace(string(data)))
+	deadline := time.Now().Add(5 * time.Second)
+	for processAlive(childPID) {
+		if time.Now().After(deadline) {
+			syscall.Kill(childPID, syscall.SIGKILL)
+			t.Fatalf("Child process %d survived the timeout", childPID)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
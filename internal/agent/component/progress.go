@@ -0,0 +1,81 @@
+package component
+
+import (
+	"context"
+	"sync"
+)
+
+// Deployment phases reported with ReportPhase
+const (
+	PhaseDownloading = "downloading"
+	PhaseExtracting  = "extracting"
+	PhaseStarting    = "starting"
+)
+
+// progressStep is how far a download gets between progress reports, in
+// percentage points
+const progressStep = 10
+
+// downloadProgress counts the bytes of a download as they are written and
+// reports each progressStep of the total. A retry that starts over sets the
+// count back; nothing is reported again until it passes the last report.
+type downloadProgress struct {
+	mu       sync.Mutex
+	total    int64
+	written  int64
+	reported int
+	report   func(percent int)
+}
+
+type downloadProgressKey struct{}
+
+// withDownloadProgress attaches progress to the downloads made with ctx
+func withDownloadProgress(ctx context.Context, progress *downloadProgress) context.Context {
+	return context.WithValue(ctx, downloadProgressKey{}, progress)
+}
+
+// progressFrom returns the download progress attached to ctx. Downloads
+// without one are counted by a tracker that reports nothing.
+func progressFrom(ctx context.Context) *downloadProgress {
+	if progress, ok := ctx.Value(downloadProgressKey{}).(*downloadProgress); ok {
+		return progress
+	}
+	return &downloadProgress{}
+}
+
+// start sets the size of the download, or 0 when it is unknown, and how much
+// of it is already on disk
+func (p *downloadProgress) start(total, written int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.total = total
+	p.written = written
+}
+
+// Write counts bytes written to the downloaded file
+func (p *downloadProgress) Write(b []byte) (int, error) {
+	// Reports are made under the lock so ranges written in parallel can't
+	// report out of order
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.written += int64(len(b))
+	if p.report == nil || p.total <= 0 {
+		return len(b), nil
+	}
+
+	percent := int(min(p.written*100/p.total, 100))
+	if percent >= p.reported+progressStep {
+		p.reported = percent - percent%progressStep
+		p.report(percent)
+	}
+	return len(b), nil
+}
+
+// reportPhase tells the progress reporter a component's deployment reached a
+// phase, with the phase's percentage or -1
+func (m *Manager) reportPhase(componentName, phase string, percent int) {
+	if m.progressReporter != nil {
+		m.progressReporter.ReportPhase(componentName, phase, percent)
+	}
+}
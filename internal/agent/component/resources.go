@@ -0,0 +1,210 @@
+package component
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/metorial/fleet/cosmos/internal/agent/database"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// defaultCgroupRoot is the cgroup v2 directory components' cgroups are
+// created in. Its parent must be able to delegate the memory and cpu
+// controllers, which the top of the hierarchy always can.
+const defaultCgroupRoot = "/sys/fs/cgroup/cosmos"
+
+// cgroupCPUPeriod is the cpu.max period, in microseconds
+const cgroupCPUPeriod = 100000
+
+// resourceLimits are the limits applied to one run of a program. The memory
+// and CPU limits are enforced by a cgroup when the node has cgroup v2, so
+// exceeding the memory limit OOM-kills only that component. Otherwise the
+// memory limit falls back to an address space rlimit and the CPU limit isn't
+// enforced.
+type resourceLimits struct {
+	component string
+	// cgroup is the component's cgroup directory, if it has one
+	cgroup   string
+	cgroupFD *os.File
+	// oomKills is the cgroup's OOM kill count before the process started
+	oomKills int
+	rlimits  map[int]uint64
+}
+
+// prepareResourceLimits creates the component's cgroup if its limits need one
+// and arranges for cmd to start in it. The rest of the limits are rlimits,
+// applied by start once the process exists.
+func (m *Manager) prepareResourceLimits(component *database.Component, cmd *exec.Cmd) (*resourceLimits, error) {
+	limits := &resourceLimits{component: component.Name, rlimits: make(map[int]uint64)}
+
+	if component.MaxOpenFiles > 0 {
+		limits.rlimits[unix.RLIMIT_NOFILE] = uint64(component.MaxOpenFiles)
+	}
+
+	if component.MemoryLimit == 0 && component.CPULimit == 0 {
+		return limits, nil
+	}
+
+	dir, err := m.createCgroup(component)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"component": component.Name,
+			"error":     err,
+		}).Warn("Cgroups unavailable, limiting memory with rlimits and leaving CPU unlimited")
+
+		if component.MemoryLimit > 0 {
+			limits.rlimits[unix.RLIMIT_AS] = uint64(component.MemoryLimit)
+		}
+		return limits, nil
+	}
+
+	fd, err := os.Open(dir)
+	if err != nil {
+		os.Remove(dir)
+		return nil, fmt.Errorf("failed to open cgroup: %w", err)
+	}
+
+	limits.cgroup = dir
+	limits.cgroupFD = fd
+	limits.oomKills = limits.oomKillCount()
+	cmd.SysProcAttr.UseCgroupFD = true
+	cmd.SysProcAttr.CgroupFD = int(fd.Fd())
+
+	return limits, nil
+}
+
+// createCgroup creates or reuses the component's cgroup under the cgroup
+// root and writes its limits
+func (m *Manager) createCgroup(component *database.Component) (string, error) {
+	parent := filepath.Dir(m.cgroupRoot)
+	controllers, err := os.ReadFile(filepath.Join(parent, "cgroup.controllers"))
+	if err != nil {
+		return "", fmt.Errorf("%s is not a cgroup v2 hierarchy", parent)
+	}
+	for _, controller := range []string{"memory", "cpu"} {
+		if !strings.Contains(" "+strings.TrimSpace(string(controllers))+" ", " "+controller+" ") {
+			return "", fmt.Errorf("the %s controller isn't available in %s", controller, parent)
+		}
+	}
+
+	// Controllers are delegated down both levels; a cgroup can't delegate
+	// a controller its parent doesn't
+	if err := os.MkdirAll(m.cgroupRoot, 0755); err != nil {
+		return "", fmt.Errorf("failed to create %s: %w", m.cgroupRoot, err)
+	}
+	for _, dir := range []string{parent, m.cgroupRoot} {
+		if err := os.WriteFile(filepath.Join(dir, "cgroup.subtree_control"), []byte("+memory +cpu"), 0644); err != nil {
+			return "", fmt.Errorf("failed to enable controllers in %s: %w", dir, err)
+		}
+	}
+
+	dir := filepath.Join(m.cgroupRoot, component.Name)
+	if err := os.Mkdir(dir, 0755); err != nil && !errors.Is(err, os.ErrExist) {
+		return "", fmt.Errorf("failed to create cgroup: %w", err)
+	}
+
+	memoryMax := "max"
+	if component.MemoryLimit > 0 {
+		memoryMax = strconv.FormatInt(component.MemoryLimit, 10)
+	}
+	cpuMax := "max"
+	if component.CPULimit > 0 {
+		cpuMax = strconv.FormatInt(int64(component.CPULimit*cgroupCPUPeriod), 10)
+	}
+
+	settings := []struct{ file, value string }{
+		{"memory.max", memoryMax},
+		// Swapping would only postpone the OOM kill
+		{"memory.swap.max", "0"},
+		// An OOM kill takes the whole component down rather than leaving
+		// it running without one of its processes
+		{"memory.oom.group", "1"},
+		{"cpu.max", fmt.Sprintf("%s %d", cpuMax, cgroupCPUPeriod)},
+	}
+	for _, setting := range settings {
+		path := filepath.Join(dir, setting.file)
+		// memory.swap.max is missing when the kernel has no swap
+		if _, err := os.Stat(path); err != nil && setting.file == "memory.swap.max" {
+			continue
+		}
+		if err := os.WriteFile(path, []byte(setting.value), 0644); err != nil {
+			os.Remove(dir)
+			return "", fmt.Errorf("failed to write %s: %w", path, err)
+		}
+	}
+
+	return dir, nil
+}
+
+// start applies the rlimits to the started process. The process runs briefly
+// before they apply, so only what it starts after that inherits them.
+func (l *resourceLimits) start(pid int) error {
+	if l.cgroupFD != nil {
+		l.cgroupFD.Close()
+		l.cgroupFD = nil
+	}
+
+	for resource, value := range l.rlimits {
+		limit := &unix.Rlimit{Cur: value, Max: value}
+		if err := unix.Prlimit(pid, resource, limit, nil); err != nil {
+			return fmt.Errorf("failed to set %s: %w", rlimitName(resource), err)
+		}
+	}
+	return nil
+}
+
+// oomKilled reports whether the kernel killed the component for exceeding
+// its memory limit
+func (l *resourceLimits) oomKilled() bool {
+	return l.cgroup != "" && l.oomKillCount() > l.oomKills
+}
+
+// oomKillCount reads how many processes in the cgroup were OOM-killed
+func (l *resourceLimits) oomKillCount() int {
+	events, err := os.ReadFile(filepath.Join(l.cgroup, "memory.events"))
+	if err != nil {
+		return 0
+	}
+	for _, line := range strings.Split(string(events), "\n") {
+		if count, ok := strings.CutPrefix(line, "oom_kill "); ok {
+			n, _ := strconv.Atoi(count)
+			return n
+		}
+	}
+	return 0
+}
+
+// release removes the cgroup once the process has exited. Processes the
+// component left behind keep the cgroup, and are counted against its limits
+// the next time it starts.
+func (l *resourceLimits) release() {
+	if l.cgroupFD != nil {
+		l.cgroupFD.Close()
+		l.cgroupFD = nil
+	}
+	if l.cgroup == "" {
+		return
+	}
+	if err := os.Remove(l.cgroup); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.WithFields(log.Fields{
+			"component": l.component,
+			"error":     err,
+		}).Debug("Cgroup still in use after the component exited")
+	}
+}
+
+func rlimitName(resource int) string {
+	switch resource {
+	case unix.RLIMIT_NOFILE:
+		return "max_open_files"
+	case unix.RLIMIT_AS:
+		return "memory_limit"
+	}
+	return fmt.Sprintf("rlimit %d", resource)
+}
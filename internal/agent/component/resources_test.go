@@ -0,0 +1,118 @@
+package component
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/metorial/fleet/cosmos/internal/agent/database"
+)
+
+// startLimitedProgram starts a program with the given limits. The cgroup
+// root isn't a cgroup hierarchy, so the memory limit is an rlimit.
+func startLimitedProgram(t *testing.T, script string, component database.Component) (*Manager, *database.AgentDB, string) {
+	t.Helper()
+	if runtime.GOOS != "linux" {
+		t.Skip("resource limits are only applied on Linux")
+	}
+
+	dataDir := t.TempDir()
+	db, err := database.NewAgentDB(dataDir)
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	programDir := filepath.Join(dataDir, "programs", component.Name)
+	if err := os.MkdirAll(programDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	component.Type = "program"
+	component.Hash = "h"
+	component.Executable = filepath.Join(programDir, component.Name)
+	if err := os.WriteFile(component.Executable, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.UpsertComponent(&component); err != nil {
+		t.Fatalf("Failed to store component: %v", err)
+	}
+
+	m := NewManager(db, dataDir)
+	m.SetCgroupRoot(filepath.Join(t.TempDir(), "cosmos"))
+	if err := m.StartComponent(component.Name); err != nil {
+		t.Fatalf("Failed to start component: %v", err)
+	}
+	t.Cleanup(func() { m.StopComponent(component.Name) })
+
+	return m, db, programDir
+}
+
+// processLimit reads a soft limit from /proc/<pid>/limits
+func processLimit(t *testing.T, pid int, name string) string {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "limits"))
+	if err != nil {
+		t.Fatalf("Failed to read limits: %v", err)
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if rest, ok := strings.CutPrefix(line, name); ok {
+			return strings.Fields(rest)[0]
+		}
+	}
+	t.Fatalf("No %q limit in %s", name, data)
+	return ""
+}
+
+func TestStartComponentAppliesRlimits(t *testing.T) {
+	_, db, _ := startLimitedProgram(t, "#!/bin/sh\nexec sleep 300\n", database.Component{
+		Name:         "bounded",
+		MemoryLimit:  64 << 20,
+		MaxOpenFiles: 256,
+	})
+
+	status, err := db.GetComponentStatus("bounded")
+	if err != nil {
+		t.Fatalf("Failed to get status: %v", err)
+	}
+
+	if got := processLimit(t, status.PID, "Max open files"); got != "256" {
+		t.Errorf("Expected max open files to be 256, got %s", got)
+	}
+	if got := processLimit(t, status.PID, "Max address space"); got != strconv.Itoa(64<<20) {
+		t.Errorf("Expected the address space to be limited to 64MiB, got %s", got)
+	}
+}
+
+func TestMemoryLimitedProgramCannotExceedLimit(t *testing.T) {
+	// The program waits to be told to go so the limit is in place, then
+	// buffers 256MiB in tail, which keeps the whole line in memory
+	script := "#!/bin/sh\n" +
+		"while [ ! -e go ]; do sleep 0.05; done\n" +
+		"head -c 268435456 /dev/zero | tail > /dev/null 2>&1\n" +
+		"echo $? > result\n" +
+		"exec sleep 300\n"
+	_, _, programDir := startLimitedProgram(t, script, database.Component{Name: "hungry", MemoryLimit: 64 << 20})
+
+	if err := os.WriteFile(filepath.Join(programDir, "go"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		data, err := os.ReadFile(filepath.Join(programDir, "result"))
+		if err == nil && len(data) > 0 {
+			if code := strings.TrimSpace(string(data)); code == "0" {
+				t.Error("Expected the allocation over the memory limit to fail")
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Program never finished allocating")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
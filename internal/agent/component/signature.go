@@ -0,0 +1,198 @@
+package component
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+const (
+	// maxSignatureSize bounds a downloaded signature file
+	maxSignatureSize = 64 * 1024
+
+	signatureFetchTimeout = 30 * time.Second
+)
+
+// errMissingSignature means a public key is configured but no signature
+// could be obtained, so the archive can't be trusted
+var errMissingSignature = errors.New("signature required but missing")
+
+// verifyArchive checks the downloaded archive against the component's
+// detached signature. It does nothing when no public key is configured.
+func (m *Manager) verifyArchive(ctx context.Context, filePath, publicKey, signatureURL string, headers http.Header) error {
+	if publicKey == "" {
+		return nil
+	}
+
+	if signatureURL == "" {
+		return fmt.Errorf("%w: public_key is set but signature_url is not", errMissingSignature)
+	}
+
+	key, keyID, err := parsePublicKey(publicKey)
+	if err != nil {
+		return fmt.Errorf("invalid public key: %w", err)
+	}
+
+	signature, err := m.fetchSignature(ctx, signatureURL, headers)
+	if err != nil {
+		return err
+	}
+
+	return verifyFileSignature(filePath, key, keyID, signature)
+}
+
+func (m *Manager) fetchSignature(ctx context.Context, url string, headers http.Header) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, signatureFetchTimeout)
+	defer cancel()
+
+	req, err := newDownloadRequest(ctx, url, headers)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create signature request: %w", err)
+	}
+
+	resp, err := m.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download signature: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("%w: %s returned 404", errMissingSignature, url)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("signature download failed with status: %d", resp.StatusCode)
+	}
+
+	signature, err := io.ReadAll(io.LimitReader(resp.Body, maxSignatureSize))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read signature: %w", err)
+	}
+	if len(bytes.TrimSpace(signature)) == 0 {
+		return nil, fmt.Errorf("%w: %s is empty", errMissingSignature, url)
+	}
+
+	return signature, nil
+}
+
+// parsePublicKey accepts an ed25519 key as a minisign public key (with or
+// without its comment line), a PEM "PUBLIC KEY" block, or the base64 of the
+// raw 32 bytes. Minisign keys also return their key ID.
+func parsePublicKey(value string) (ed25519.PublicKey, []byte, error) {
+	value = strings.TrimSpace(value)
+
+	if block, _ := pem.Decode([]byte(value)); block != nil {
+		parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, nil, err
+		}
+		key, ok := parsed.(ed25519.PublicKey)
+		if !ok {
+			return nil, nil, fmt.Errorf("PEM key is %T, not ed25519", parsed)
+		}
+		return key, nil, nil
+	}
+
+	data, err := base64.StdEncoding.DecodeString(lastLine(value))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to decode key: %w", err)
+	}
+
+	switch {
+	case len(data) == ed25519.PublicKeySize:
+		return ed25519.PublicKey(data), nil, nil
+	case len(data) == 2+8+ed25519.PublicKeySize && string(data[:2]) == "Ed":
+		return ed25519.PublicKey(data[10:]), data[2:10], nil
+	default:
+		return nil, nil, fmt.Errorf("unrecognized key of %d bytes", len(data))
+	}
+}
+
+// verifyFileSignature checks a minisign signature file or a raw ed25519
+// signature (binary or base64) over the file's contents. For minisign only
+// the file signature is checked, not the trusted comment.
+func verifyFileSignature(filePath string, key ed25519.PublicKey, keyID, signature []byte) error {
+	sig := signature
+	prehashed := false
+
+	if text := strings.TrimSpace(string(signature)); strings.HasPrefix(text, "untrusted comment:") {
+		lines := strings.Split(text, "\n")
+		if len(lines) < 2 {
+			return fmt.Errorf("malformed minisign signature")
+		}
+
+		data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[1]))
+		if err != nil || len(data) != 2+8+ed25519.SignatureSize {
+			return fmt.Errorf("malformed minisign signature")
+		}
+
+		switch string(data[:2]) {
+		case "Ed":
+		case "ED":
+			prehashed = true
+		default:
+			return fmt.Errorf("unsupported minisign algorithm %q", data[:2])
+		}
+
+		if keyID != nil && !bytes.Equal(keyID, data[2:10]) {
+			return fmt.Errorf("signature was made with a different key")
+		}
+		sig = data[10:]
+	} else if len(sig) != ed25519.SignatureSize {
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(sig)))
+		if err != nil || len(decoded) != ed25519.SignatureSize {
+			return fmt.Errorf("unrecognized signature format")
+		}
+		sig = decoded
+	}
+
+	message, err := signedMessage(filePath, prehashed)
+	if err != nil {
+		return err
+	}
+
+	if !ed25519.Verify(key, message, sig) {
+		return fmt.Errorf("signature verification failed")
+	}
+
+	return nil
+}
+
+// signedMessage returns what the signature covers: the file itself, or its
+// BLAKE2b-512 digest for prehashed minisign signatures
+func signedMessage(filePath string, prehashed bool) ([]byte, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	if !prehashed {
+		return io.ReadAll(file)
+	}
+
+	hasher, err := blake2b.New512(nil)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(hasher, file); err != nil {
+		return nil, err
+	}
+	return hasher.Sum(nil), nil
+}
+
+func lastLine(value string) string {
+	lines := strings.Split(strings.TrimSpace(value), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
@@ -0,0 +1,183 @@
+package component
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/metorial/fleet/cosmos/internal/agent/database"
+	"golang.org/x/crypto/blake2b"
+)
+
+// minisignPair returns a minisign-format public key and a signer producing
+// minisign signature files with the same key ID
+func minisignPair(pub ed25519.PublicKey, priv ed25519.PrivateKey) (string, func([]byte, bool) []byte) {
+	keyID := []byte("cosmosid")
+
+	publicKey := "untrusted comment: minisign public key\n" +
+		base64.StdEncoding.EncodeToString(append(append([]byte("Ed"), keyID...), pub...))
+
+	sign := func(data []byte, prehash bool) []byte {
+		alg := "Ed"
+		message := data
+		if prehash {
+			alg = "ED"
+			sum := blake2b.Sum512(data)
+			message = sum[:]
+		}
+		sig := ed25519.Sign(priv, message)
+		line := base64.StdEncoding.EncodeToString(append(append([]byte(alg), keyID...), sig...))
+		return []byte("untrusted comment: signature from minisign secret key\n" + line + "\n")
+	}
+
+	return publicKey, sign
+}
+
+func TestVerifyArchive(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	otherPub, _, _ := ed25519.GenerateKey(rand.Reader)
+
+	archive := []byte("program archive contents")
+	rawKey := base64.StdEncoding.EncodeToString(pub)
+	minisignKey, minisign := minisignPair(pub, priv)
+
+	tests := []struct {
+		name        string
+		publicKey   string
+		signature   []byte
+		noSignature bool
+		content     []byte
+		expectError string
+	}{
+		{
+			name:      "raw base64 signature",
+			publicKey: rawKey,
+			signature: []byte(base64.StdEncoding.EncodeToString(ed25519.Sign(priv, archive))),
+		},
+		{
+			name:      "raw binary signature",
+			publicKey: rawKey,
+			signature: ed25519.Sign(priv, archive),
+		},
+		{
+			name:      "minisign signature",
+			publicKey: minisignKey,
+			signature: minisign(archive, false),
+		},
+		{
+			name:      "prehashed minisign signature",
+			publicKey: minisignKey,
+			signature: minisign(archive, true),
+		},
+		{
+			name:        "tampered archive",
+			publicKey:   rawKey,
+			signature:   ed25519.Sign(priv, archive),
+			content:     []byte("program archive contents, modified"),
+			expectError: "signature verification failed",
+		},
+		{
+			name:        "wrong key",
+			publicKey:   base64.StdEncoding.EncodeToString(otherPub),
+			signature:   ed25519.Sign(priv, archive),
+			expectError: "signature verification failed",
+		},
+		{
+			name:        "missing signature",
+			publicKey:   rawKey,
+			noSignature: true,
+			expectError: "signature required but missing",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.noSignature {
+					http.NotFound(w, r)
+					return
+				}
+				w.Write(tt.signature)
+			}))
+			defer server.Close()
+
+			content := archive
+			if tt.content != nil {
+				content = tt.content
+			}
+			path := writeFixture(t, content)
+
+			m := newTestManager(DownloadOptions{})
+			err := m.verifyArchive(t.Context(), path, tt.publicKey, server.URL, nil)
+
+			if tt.expectError == "" {
+				if err != nil {
+					t.Errorf("Expected signature to verify, got: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.expectError) {
+				t.Errorf("Expected error containing %q, got: %v", tt.expectError, err)
+			}
+		})
+	}
+}
+
+func TestVerifyArchiveRequiresSignatureURL(t *testing.T) {
+	pub, _, _ := ed25519.GenerateKey(rand.Reader)
+
+	m := newTestManager(DownloadOptions{})
+	err := m.verifyArchive(t.Context(), writeFixture(t, []byte("data")), base64.StdEncoding.EncodeToString(pub), "", nil)
+	if !errors.Is(err, errMissingSignature) {
+		t.Errorf("Expected missing signature error, got: %v", err)
+	}
+}
+
+func TestDeployProgramAbortsOnBadSignature(t *testing.T) {
+	dataDir := t.TempDir()
+	db, err := database.NewAgentDB(dataDir)
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	defer db.Close()
+
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	archive := []byte("#!/bin/sh\necho hi\n")
+	signature := ed25519.Sign(priv, []byte("something else"))
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/app.sig" {
+			w.Write(signature)
+			return
+		}
+		w.Write(archive)
+	}))
+	defer server.Close()
+
+	m := NewManager(db, dataDir)
+	err = m.DeployProgram(&database.Component{
+		Name:         "signed-app",
+		Type:         "program",
+		Hash:         hashOf(archive),
+		ContentURL:   server.URL + "/app",
+		SignatureURL: server.URL + "/app.sig",
+		PublicKey:    base64.StdEncoding.EncodeToString(pub),
+	})
+	if err == nil || !strings.Contains(err.Error(), "signature verification failed") {
+		t.Fatalf("Expected signature failure, got: %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dataDir, "programs", "signed-app")); !os.IsNotExist(err) {
+		t.Errorf("Expected nothing written to the programs directory, got: %v", err)
+	}
+}
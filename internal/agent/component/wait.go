@@ -0,0 +1,116 @@
+package component
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/metorial/fleet/cosmos/internal/agent/database"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultWaitForTimeout = 60 * time.Second
+	waitForProbeInterval  = 2 * time.Second
+	waitForProbeTimeout   = 2 * time.Second
+)
+
+// waitForDependencies blocks until every wait_for endpoint of the component
+// is reachable, reporting a "waiting" status meanwhile. It fails the start if
+// an endpoint doesn't come up within its timeout.
+func (m *Manager) waitForDependencies(component *database.Component, status *database.ComponentStatus) error {
+	endpoints, err := m.db.GetWaitFor(component)
+	if err != nil {
+		return fmt.Errorf("failed to get wait_for endpoints: %w", err)
+	}
+
+	for _, endpoint := range endpoints {
+		timeout := defaultWaitForTimeout
+		if endpoint.TimeoutSeconds > 0 {
+			timeout = time.Duration(endpoint.TimeoutSeconds) * time.Second
+		}
+
+		message := fmt.Sprintf("Waiting for %s %s", endpoint.Type, endpoint.Endpoint)
+		status.Status = "waiting"
+		status.Message = message
+		status.LastCheckedAt = time.Now()
+		m.db.UpsertComponentStatus(status)
+
+		if m.progressReporter != nil {
+			m.progressReporter.ReportProgress(component.Name, "waiting", message)
+		}
+
+		log.WithFields(log.Fields{
+			"component": component.Name,
+			"type":      endpoint.Type,
+			"endpoint":  endpoint.Endpoint,
+			"timeout":   timeout,
+		}).Info("Waiting for dependency")
+
+		if err := waitForEndpoint(endpoint, timeout); err != nil {
+			status.Status = "failed"
+			status.Message = err.Error()
+			status.LastCheckedAt = time.Now()
+			m.db.UpsertComponentStatus(status)
+			return err
+		}
+	}
+
+	return nil
+}
+
+func waitForEndpoint(endpoint database.WaitForEndpoint, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+
+	var lastErr error
+	for {
+		lastErr = probeEndpoint(endpoint)
+		if lastErr == nil {
+			return nil
+		}
+
+		if time.Now().Add(waitForProbeInterval).After(deadline) {
+			return fmt.Errorf("timed out after %s waiting for %s %s: %w", timeout, endpoint.Type, endpoint.Endpoint, lastErr)
+		}
+
+		time.Sleep(waitForProbeInterval)
+	}
+}
+
+func probeEndpoint(endpoint database.WaitForEndpoint) error {
+	ctx, cancel := context.WithTimeout(context.Background(), waitForProbeTimeout)
+	defer cancel()
+
+	switch endpoint.Type {
+	case "tcp":
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "tcp", endpoint.Endpoint)
+		if err != nil {
+			return err
+		}
+		conn.Close()
+		return nil
+
+	case "http":
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint.Endpoint, nil)
+		if err != nil {
+			return err
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+			return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+		}
+		return nil
+
+	default:
+		return fmt.Errorf("unsupported wait_for type: %s", endpoint.Type)
+	}
+}
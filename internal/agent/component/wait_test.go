@@ -0,0 +1,123 @@
+package component
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/metorial/fleet/cosmos/internal/agent/database"
+)
+
+// statusRecorder is a ProgressReporter that records the statuses reported
+type statusRecorder struct {
+	statuses []string
+}
+
+func (r *statusRecorder) ReportProgress(componentName, status, message string) {
+	r.statuses = append(r.statuses, status)
+}
+
+func (r *statusRecorder) ReportPhase(componentName, phase string, percent int) {}
+
+// closedAddress returns a local address nothing is listening on
+func closedAddress(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+	return addr
+}
+
+func TestProbeEndpoint(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/ready":
+			w.WriteHeader(http.StatusNoContent)
+		case "/moved":
+			w.WriteHeader(http.StatusNotModified)
+		default:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name      string
+		endpoint  database.WaitForEndpoint
+		wantError string
+	}{
+		{"tcp listening", database.WaitForEndpoint{Type: "tcp", Endpoint: listener.Addr().String()}, ""},
+		{"tcp refused", database.WaitForEndpoint{Type: "tcp", Endpoint: closedAddress(t)}, "connection refused"},
+		{"http ready", database.WaitForEndpoint{Type: "http", Endpoint: server.URL + "/ready"}, ""},
+		{"http below 400", database.WaitForEndpoint{Type: "http", Endpoint: server.URL + "/moved"}, ""},
+		{"http unavailable", database.WaitForEndpoint{Type: "http", Endpoint: server.URL + "/starting"}, "unexpected status code: 503"},
+		{"http refused", database.WaitForEndpoint{Type: "http", Endpoint: "http://" + closedAddress(t)}, "connection refused"},
+		{"unsupported type", database.WaitForEndpoint{Type: "udp", Endpoint: listener.Addr().String()}, "unsupported wait_for type: udp"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := probeEndpoint(tt.endpoint)
+			if tt.wantError == "" {
+				if err != nil {
+					t.Errorf("Expected the endpoint to be reachable, got %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantError) {
+				t.Errorf("Expected an error containing %q, got %v", tt.wantError, err)
+			}
+		})
+	}
+}
+
+func TestWaitForDependenciesFailsStartAfterTimeout(t *testing.T) {
+	dataDir := t.TempDir()
+	db, err := database.NewAgentDB(dataDir)
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	defer db.Close()
+
+	m := NewManager(db, dataDir)
+	progress := &statusRecorder{}
+	m.SetProgressReporter(progress)
+
+	component := &database.Component{Name: "app", Type: "program"}
+	addr := closedAddress(t)
+	// A timeout shorter than the probe interval gives up after the first probe
+	db.SetWaitFor(component, []database.WaitForEndpoint{{Type: "tcp", Endpoint: addr, TimeoutSeconds: 1}})
+	status := &database.ComponentStatus{ComponentName: "app", Status: "starting"}
+
+	started := time.Now()
+	err = m.waitForDependencies(component, status)
+	if err == nil || !strings.Contains(err.Error(), "timed out after 1s waiting for tcp "+addr) {
+		t.Fatalf("Expected the wait to time out, got %v", err)
+	}
+	if elapsed := time.Since(started); elapsed > waitForProbeInterval {
+		t.Errorf("Expected to give up without sleeping, took %s", elapsed)
+	}
+
+	stored, err := db.GetComponentStatus("app")
+	if err != nil {
+		t.Fatalf("Failed to get status: %v", err)
+	}
+	if stored.Status != "failed" || !strings.Contains(stored.Message, "timed out") {
+		t.Errorf("Expected a failed status, got %s: %s", stored.Status, stored.Message)
+	}
+	if !slices.Contains(progress.statuses, "waiting") {
+		t.Errorf("Expected a waiting status to be reported, got %v", progress.statuses)
+	}
+}
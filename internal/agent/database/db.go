@@ -22,11 +22,62 @@ type Component struct {
 	ContentURLEncoding string
 	Content            string
 	Executable         string
+	Entrypoint         string
+	SignatureURL       string
+	PublicKey          string
 	Env                string `gorm:"type:text"` // JSON string
 	Args               string `gorm:"type:text"` // JSON string
+	WaitFor            string `gorm:"type:text"` // JSON string
+	ContentMirrors     string `gorm:"type:text"` // JSON string
+	ContentURLHeaders  string `gorm:"type:text"` // JSON string
+	Canary             string `gorm:"type:text"` // JSON string
 	Managed            bool   `gorm:"default:false"`
-	CreatedAt          time.Time
-	UpdatedAt          time.Time
+
+	// Limits applied when the program starts; zero means unlimited
+	MemoryLimit  int64   // bytes
+	CPULimit     float64 // cores
+	MaxOpenFiles int64
+
+	// RunAsUser and RunAsGroup are names or numeric ids; empty keeps the
+	// agent's own
+	RunAsUser  string
+	RunAsGroup string
+	// WorkingDir overrides the executable's directory as the working
+	// directory
+	WorkingDir string
+
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// SameSpec reports whether two versions of a component were deployed with
+// the same settings. The executable and timestamps are set by the agent.
+func SameSpec(a, b *Component) bool {
+	x, y := *a, *b
+	x.Executable, y.Executable = "", ""
+	x.CreatedAt, y.CreatedAt = time.Time{}, time.Time{}
+	x.UpdatedAt, y.UpdatedAt = time.Time{}, time.Time{}
+	return x == y
+}
+
+// WaitForEndpoint is an external dependency probed before a component starts
+type WaitForEndpoint struct {
+	Type           string `json:"type"`
+	Endpoint       string `json:"endpoint"`
+	TimeoutSeconds int    `json:"timeout_seconds,omitempty"`
+}
+
+// ContentMirror is an alternative download location for a program archive
+type ContentMirror struct {
+	URL    string `json:"url"`
+	Weight int    `json:"weight,omitempty"`
+}
+
+// CanaryConfig is the canary analysis applied when the component is updated
+type CanaryConfig struct {
+	WindowSeconds         int `json:"window_seconds,omitempty"`
+	MaxDegradationPercent int `json:"max_degradation_percent,omitempty"`
+	MinSamples            int `json:"min_samples,omitempty"`
 }
 
 type ComponentStatus struct {
@@ -36,8 +87,25 @@ type ComponentStatus struct {
 	PID           int
 	LastStartedAt *time.Time
 	LastCheckedAt time.Time
+	LastRestartAt *time.Time
 	RestartCount  int `gorm:"default:0"`
-	UpdatedAt     time.Time
+	ExitCode      int
+	// StoppedByController keeps a component down until it is started again
+	StoppedByController bool `gorm:"default:false"`
+	// LogStartOffset is the size of the log file when the component last
+	// started. Log checks ignore output before it.
+	LogStartOffset int64
+	UpdatedAt      time.Time
+}
+
+// RestartEvent records a single component restart. History is pruned to the
+// most recent entries per component.
+type RestartEvent struct {
+	ID            uint   `gorm:"primaryKey;autoIncrement"`
+	ComponentName string `gorm:"not null;index"`
+	Timestamp     time.Time
+	Reason        string
+	ExitCode      int
 }
 
 type HealthCheck struct {
@@ -49,7 +117,36 @@ type HealthCheck struct {
 	Retries             int `gorm:"default:3"`
 	LastCheckAt         *time.Time
 	LastResult          string
+	LastMessage         string
 	ConsecutiveFailures int `gorm:"default:0"`
+
+	// Log checks: Pattern marks the component ready, ErrorPattern unhealthy
+	Pattern      string
+	ErrorPattern string
+	LogOffset    int64
+	LogMatchedAt *time.Time
+
+	// Port-only checks: the endpoint is resolved against localhost
+	Port   int
+	Scheme string
+	Path   string
+
+	// TLS makes grpc checks connect over TLS
+	TLS bool
+
+	// HTTP checks: method, headers, body match and allowed status codes
+	Method         string
+	Headers        string `gorm:"type:text"` // JSON string
+	ExpectedBody   string
+	ExpectedStatus string `gorm:"type:text"` // JSON string
+
+	// RestartOnUnhealthy restarts a running managed component once it has
+	// failed Retries checks in a row
+	RestartOnUnhealthy bool
+
+	// StartPeriodSeconds is how long after the component starts failed
+	// checks are not counted
+	StartPeriodSeconds int
 }
 
 type DeploymentLog struct {
@@ -61,17 +158,36 @@ type DeploymentLog struct {
 	Timestamp     time.Time `gorm:"not null"`
 }
 
+// OutboxMessage is a message for the controller that hasn't been delivered
+// yet. Payload is the marshalled protobuf message.
+type OutboxMessage struct {
+	ID        uint   `gorm:"primaryKey;autoIncrement"`
+	Payload   []byte `gorm:"not null"`
+	CreatedAt time.Time
+}
+
 func NewAgentDB(dataDir string) (*AgentDB, error) {
-	dbPath := fmt.Sprintf("%s/agent.db", dataDir)
+	// WAL lets the health checker and heartbeat read while a deployment
+	// writes, and busy_timeout waits for a lock instead of failing with
+	// "database is locked"
+	dsn := fmt.Sprintf("%s/agent.db?_journal_mode=WAL&_busy_timeout=5000&_synchronous=NORMAL", dataDir)
 
-	db, err := gorm.Open(sqlite.Open(dbPath), &gorm.Config{
+	db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{
 		Logger: logger.Default.LogMode(logger.Silent),
 	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to open database: %w", err)
 	}
 
-	if err := db.AutoMigrate(&Component{}, &ComponentStatus{}, &HealthCheck{}, &DeploymentLog{}); err != nil {
+	// SQLite has a single writer. One connection queues the agent's writers
+	// in the pool, where they can't deadlock upgrading read transactions.
+	sqlDB, err := db.DB()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get database handle: %w", err)
+	}
+	sqlDB.SetMaxOpenConns(1)
+
+	if err := db.AutoMigrate(&Component{}, &ComponentStatus{}, &HealthCheck{}, &DeploymentLog{}, &RestartEvent{}, &OutboxMessage{}); err != nil {
 		return nil, fmt.Errorf("failed to migrate database: %w", err)
 	}
 
@@ -109,6 +225,9 @@ func (db *AgentDB) DeleteComponent(name string) error {
 		if err := tx.Delete(&HealthCheck{}, "component_name = ?", name).Error; err != nil {
 			return err
 		}
+		if err := tx.Delete(&RestartEvent{}, "component_name = ?", name).Error; err != nil {
+			return err
+		}
 		return nil
 	})
 }
@@ -133,6 +252,35 @@ func (db *AgentDB) GetComponentStatus(name string) (*ComponentStatus, error) {
 	return &status, nil
 }
 
+// RecordRestart stores a restart event and prunes the component's history to
+// the keep most recent events
+func (db *AgentDB) RecordRestart(event *RestartEvent, keep int) error {
+	if event.Timestamp.IsZero() {
+		event.Timestamp = time.Now()
+	}
+
+	return db.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(event).Error; err != nil {
+			return err
+		}
+
+		keepIDs := tx.Model(&RestartEvent{}).Select("id").
+			Where("component_name = ?", event.ComponentName).
+			Order("timestamp DESC, id DESC").Limit(keep)
+
+		return tx.Where("component_name = ? AND id NOT IN (?)", event.ComponentName, keepIDs).
+			Delete(&RestartEvent{}).Error
+	})
+}
+
+// GetRestartHistory returns the most recent restart events, newest first
+func (db *AgentDB) GetRestartHistory(name string, limit int) ([]RestartEvent, error) {
+	var events []RestartEvent
+	err := db.db.Where("component_name = ?", name).
+		Order("timestamp DESC, id DESC").Limit(limit).Find(&events).Error
+	return events, err
+}
+
 func (db *AgentDB) UpsertHealthCheck(check *HealthCheck) error {
 	return db.db.Save(check).Error
 }
@@ -153,6 +301,31 @@ func (db *AgentDB) LogDeployment(log *DeploymentLog) error {
 	return db.db.Create(log).Error
 }
 
+// EnqueueOutbox stores an undelivered message, dropping the oldest ones
+// beyond the keep most recent
+func (db *AgentDB) EnqueueOutbox(payload []byte, keep int) error {
+	return db.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&OutboxMessage{Payload: payload, CreatedAt: time.Now()}).Error; err != nil {
+			return err
+		}
+
+		keepIDs := tx.Model(&OutboxMessage{}).Select("id").Order("id DESC").Limit(keep)
+		return tx.Where("id NOT IN (?)", keepIDs).Delete(&OutboxMessage{}).Error
+	})
+}
+
+// ListOutbox returns up to limit undelivered messages, oldest first
+func (db *AgentDB) ListOutbox(limit int) ([]OutboxMessage, error) {
+	var messages []OutboxMessage
+	err := db.db.Order("id ASC").Limit(limit).Find(&messages).Error
+	return messages, err
+}
+
+// DeleteOutbox removes a message once it has been delivered
+func (db *AgentDB) DeleteOutbox(id uint) error {
+	return db.db.Delete(&OutboxMessage{}, id).Error
+}
+
 func (db *AgentDB) GetEnvMap(component *Component) (map[string]string, error) {
 	if component.Env == "" {
 		return make(map[string]string), nil
@@ -177,6 +350,132 @@ func (db *AgentDB) GetArgsSlice(component *Component) ([]string, error) {
 	return args, nil
 }
 
+func (db *AgentDB) GetWaitFor(component *Component) ([]WaitForEndpoint, error) {
+	if component.WaitFor == "" {
+		return nil, nil
+	}
+
+	var waitFor []WaitForEndpoint
+	if err := json.Unmarshal([]byte(component.WaitFor), &waitFor); err != nil {
+		return nil, err
+	}
+	return waitFor, nil
+}
+
+func (db *AgentDB) SetWaitFor(component *Component, waitFor []WaitForEndpoint) error {
+	data, err := json.Marshal(waitFor)
+	if err != nil {
+		return err
+	}
+	component.WaitFor = string(data)
+	return nil
+}
+
+func (db *AgentDB) GetCanary(component *Component) (*CanaryConfig, error) {
+	if component.Canary == "" {
+		return nil, nil
+	}
+
+	var canary CanaryConfig
+	if err := json.Unmarshal([]byte(component.Canary), &canary); err != nil {
+		return nil, err
+	}
+	return &canary, nil
+}
+
+func (db *AgentDB) SetCanary(component *Component, canary *CanaryConfig) error {
+	data, err := json.Marshal(canary)
+	if err != nil {
+		return err
+	}
+	component.Canary = string(data)
+	return nil
+}
+
+func (db *AgentDB) GetContentMirrors(component *Component) ([]ContentMirror, error) {
+	if component.ContentMirrors == "" {
+		return nil, nil
+	}
+
+	var mirrors []ContentMirror
+	if err := json.Unmarshal([]byte(component.ContentMirrors), &mirrors); err != nil {
+		return nil, err
+	}
+	return mirrors, nil
+}
+
+func (db *AgentDB) SetContentMirrors(component *Component, mirrors []ContentMirror) error {
+	data, err := json.Marshal(mirrors)
+	if err != nil {
+		return err
+	}
+	component.ContentMirrors = string(data)
+	return nil
+}
+
+func (db *AgentDB) GetContentURLHeaders(component *Component) (map[string]string, error) {
+	if component.ContentURLHeaders == "" {
+		return nil, nil
+	}
+
+	var headers map[string]string
+	if err := json.Unmarshal([]byte(component.ContentURLHeaders), &headers); err != nil {
+		return nil, err
+	}
+	return headers, nil
+}
+
+func (db *AgentDB) SetContentURLHeaders(component *Component, headers map[string]string) error {
+	data, err := json.Marshal(headers)
+	if err != nil {
+		return err
+	}
+	component.ContentURLHeaders = string(data)
+	return nil
+}
+
+func (db *AgentDB) GetHealthCheckHeaders(check *HealthCheck) (map[string]string, error) {
+	if check.Headers == "" {
+		return nil, nil
+	}
+
+	var headers map[string]string
+	if err := json.Unmarshal([]byte(check.Headers), &headers); err != nil {
+		return nil, err
+	}
+	return headers, nil
+}
+
+func (db *AgentDB) SetHealthCheckHeaders(check *HealthCheck, headers map[string]string) error {
+	data, err := json.Marshal(headers)
+	if err != nil {
+		return err
+	}
+	check.Headers = string(data)
+	return nil
+}
+
+func (db *AgentDB) GetExpectedStatus(check *HealthCheck) ([]int, error) {
+	if check.ExpectedStatus == "" {
+		return nil, nil
+	}
+
+	var codes []int
+	if err := json.Unmarshal([]byte(check.ExpectedStatus), &codes); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+func (db *AgentDB) SetExpectedStatus(check *HealthCheck, codes []int) error {
+	data, err := json.Marshal(codes)
+	if err != nil {
+		return err
+	}
+	check.ExpectedStatus = string(data)
+	return nil
+}
+
 func (db *AgentDB) SetEnvMap(component *Component, env map[string]string) error {
 	data, err := json.Marshal(env)
 	if err != nil {
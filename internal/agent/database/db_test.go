@@ -0,0 +1,167 @@
+package database
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNewAgentDBUsesWAL(t *testing.T) {
+	db, err := NewAgentDB(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	defer db.Close()
+
+	var mode string
+	if err := db.db.Raw("PRAGMA journal_mode").Scan(&mode).Error; err != nil {
+		t.Fatalf("Failed to read journal mode: %v", err)
+	}
+	if mode != "wal" {
+		t.Errorf("Expected WAL journal mode, got %q", mode)
+	}
+}
+
+func TestConcurrentAccess(t *testing.T) {
+	db, err := NewAgentDB(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	defer db.Close()
+
+	const workers = 8
+	const iterations = 50
+
+	var wg sync.WaitGroup
+	errs := make(chan error, workers*iterations)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			name := fmt.Sprintf("component-%d", w%3)
+			for i := 0; i < iterations; i++ {
+				if err := db.UpsertComponent(&Component{Name: name, Type: "program", Hash: fmt.Sprint(i)}); err != nil {
+					errs <- fmt.Errorf("upsert component: %w", err)
+				}
+				if err := db.UpsertComponentStatus(&ComponentStatus{ComponentName: name, Status: "running"}); err != nil {
+					errs <- fmt.Errorf("upsert status: %w", err)
+				}
+				if err := db.RecordRestart(&RestartEvent{ComponentName: name, Timestamp: time.Now()}, 20); err != nil {
+					errs <- fmt.Errorf("record restart: %w", err)
+				}
+				if err := db.EnqueueOutbox([]byte("message"), 100); err != nil {
+					errs <- fmt.Errorf("enqueue outbox: %w", err)
+				}
+				if _, err := db.GetAllComponents(); err != nil {
+					errs <- fmt.Errorf("list components: %w", err)
+				}
+				if _, err := db.GetRestartHistory(name, 20); err != nil {
+					errs <- fmt.Errorf("restart history: %w", err)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+
+	components, err := db.GetAllComponents()
+	if err != nil {
+		t.Fatalf("Failed to list components: %v", err)
+	}
+	if len(components) != 3 {
+		t.Errorf("Expected 3 components, got %d", len(components))
+	}
+}
+
+func TestRecordRestartKeepsRecentHistory(t *testing.T) {
+	db, err := NewAgentDB(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	defer db.Close()
+
+	start := time.Now().Add(-time.Hour)
+	for i := 0; i < 5; i++ {
+		event := &RestartEvent{ComponentName: "web", Timestamp: start.Add(time.Duration(i) * time.Minute), Reason: fmt.Sprintf("crash %d", i), ExitCode: i}
+		if err := db.RecordRestart(event, 3); err != nil {
+			t.Fatalf("Failed to record restart: %v", err)
+		}
+	}
+	if err := db.RecordRestart(&RestartEvent{ComponentName: "worker", Reason: "unhealthy"}, 3); err != nil {
+		t.Fatalf("Failed to record restart: %v", err)
+	}
+
+	tests := []struct {
+		component   string
+		wantReasons []string
+	}{
+		{"web", []string{"crash 4", "crash 3", "crash 2"}},
+		{"worker", []string{"unhealthy"}},
+		{"missing", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.component, func(t *testing.T) {
+			history, err := db.GetRestartHistory(tt.component, 10)
+			if err != nil {
+				t.Fatalf("Failed to get restart history: %v", err)
+			}
+
+			var reasons []string
+			for _, event := range history {
+				reasons = append(reasons, event.Reason)
+			}
+			if fmt.Sprint(reasons) != fmt.Sprint(tt.wantReasons) {
+				t.Errorf("Expected %v newest first, got %v", tt.wantReasons, reasons)
+			}
+		})
+	}
+
+	// An event without a timestamp is stamped when it is recorded
+	if history, _ := db.GetRestartHistory("worker", 1); len(history) != 1 || history[0].Timestamp.IsZero() {
+		t.Errorf("Expected the restart to be timestamped, got %+v", history)
+	}
+
+	if err := db.DeleteComponent("web"); err != nil {
+		t.Fatalf("Failed to delete component: %v", err)
+	}
+	if history, _ := db.GetRestartHistory("web", 10); len(history) != 0 {
+		t.Errorf("Expected deleting the component to clear its history, got %d events", len(history))
+	}
+}
+
+func TestSameSpec(t *testing.T) {
+	base := func(modify func(c *Component)) *Component {
+		c := &Component{Name: "web", Type: "program", Hash: "v1", ContentURL: "https://example.com/web.tar.gz",
+			Env: `{"A":"1"}`, Executable: "/data/programs/web/current/web", UpdatedAt: time.Now()}
+		modify(c)
+		return c
+	}
+	stored := base(func(c *Component) {})
+
+	tests := []struct {
+		name   string
+		modify func(c *Component)
+		same   bool
+	}{
+		// A deployment doesn't carry the executable the agent resolved
+		{"redeploy", func(c *Component) { c.Executable = ""; c.UpdatedAt = time.Time{} }, true},
+		{"hash", func(c *Component) { c.Hash = "v2" }, false},
+		{"env", func(c *Component) { c.Env = `{"A":"2"}` }, false},
+		{"args", func(c *Component) { c.Args = `["--verbose"]` }, false},
+		{"run as user", func(c *Component) { c.RunAsUser = "nobody" }, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if same := SameSpec(stored, base(tt.modify)); same != tt.same {
+				t.Errorf("Expected SameSpec to be %v", tt.same)
+			}
+		})
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"crypto/tls"
 	"fmt"
+	"math/rand"
 	"os"
 	"strings"
 	"sync"
@@ -17,7 +18,19 @@ import (
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/keepalive"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// reportedRestartHistory is how many recent restarts are sent with each status
+const reportedRestartHistory = 10
+
+// outboxLimit bounds the undelivered messages kept while the controller is
+// unreachable; the oldest are dropped first
+const (
+	outboxLimit = 10000
+	outboxBatch = 100
 )
 
 type Client struct {
@@ -25,17 +38,24 @@ type Client struct {
 	hostname      string
 	tlsConfig     *tls.Config
 	db            *database.AgentDB
+	dataDir       string
 	tags          []string
 
+	metadataMu sync.RWMutex
+	metadata   map[string]string
+
 	conn   *grpc.ClientConn
 	stream pb.CosmosController_StreamAgentMessagesClient
 
-	mu                sync.RWMutex
-	connected         bool
-	reconnectInterval time.Duration
+	mu                   sync.RWMutex
+	connected            bool
+	reconnectInterval    time.Duration
+	maxReconnectInterval time.Duration
+	reconnectAttempts    int
 
 	outgoingCh chan *pb.AgentMessage
 	incomingCh chan *pb.ControllerMessage
+	flushCh    chan struct{}
 
 	ctx    context.Context
 	cancel context.CancelFunc
@@ -47,7 +67,13 @@ type ClientConfig struct {
 	Tags              string
 	TLSConfig         *tls.Config
 	DB                *database.AgentDB
+	DataDir           string
 	ReconnectInterval time.Duration
+	Metadata          map[string]string
+
+	// Reconnects back off exponentially from ReconnectInterval up to
+	// MaxReconnectInterval
+	MaxReconnectInterval time.Duration
 }
 
 func NewClient(config *ClientConfig) (*Client, error) {
@@ -65,21 +91,38 @@ func NewClient(config *ClientConfig) (*Client, error) {
 		reconnectInterval = 5 * time.Second
 	}
 
+	maxReconnectInterval := config.MaxReconnectInterval
+	if maxReconnectInterval == 0 {
+		maxReconnectInterval = 2 * time.Minute
+	}
+	if maxReconnectInterval < reconnectInterval {
+		maxReconnectInterval = reconnectInterval
+	}
+
 	tags := parseTags(config.Tags)
 
+	metadata := make(map[string]string, len(config.Metadata))
+	for k, v := range config.Metadata {
+		metadata[k] = v
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 
 	return &Client{
-		controllerURL:     config.ControllerURL,
-		hostname:          hostname,
-		tlsConfig:         config.TLSConfig,
-		db:                config.DB,
-		tags:              tags,
-		reconnectInterval: reconnectInterval,
-		outgoingCh:        make(chan *pb.AgentMessage, 100),
-		incomingCh:        make(chan *pb.ControllerMessage, 100),
-		ctx:               ctx,
-		cancel:            cancel,
+		controllerURL:        config.ControllerURL,
+		hostname:             hostname,
+		tlsConfig:            config.TLSConfig,
+		db:                   config.DB,
+		dataDir:              config.DataDir,
+		tags:                 tags,
+		metadata:             metadata,
+		reconnectInterval:    reconnectInterval,
+		maxReconnectInterval: maxReconnectInterval,
+		outgoingCh:           make(chan *pb.AgentMessage, 100),
+		incomingCh:           make(chan *pb.ControllerMessage, 100),
+		flushCh:              make(chan struct{}, 1),
+		ctx:                  ctx,
+		cancel:               cancel,
 	}, nil
 }
 
@@ -106,6 +149,25 @@ func parseTags(tagsStr string) []string {
 	return tags
 }
 
+// SetMetadata sets a key reported to the controller in every heartbeat
+func (c *Client) SetMetadata(key, value string) {
+	c.metadataMu.Lock()
+	defer c.metadataMu.Unlock()
+	c.metadata[key] = value
+}
+
+func (c *Client) heartbeatMetadata() map[string]string {
+	c.metadataMu.RLock()
+	defer c.metadataMu.RUnlock()
+
+	metadata := make(map[string]string, len(c.metadata)+1)
+	for k, v := range c.metadata {
+		metadata[k] = v
+	}
+	metadata["log_level"] = log.GetLevel().String()
+	return metadata
+}
+
 func (c *Client) Start() error {
 	log.WithField("controller", c.controllerURL).Info("Starting gRPC client")
 
@@ -144,20 +206,29 @@ func (c *Client) connectionManager() {
 		}
 
 		if err := c.connect(); err != nil {
-			log.WithError(err).Warn("Failed to connect to controller")
 			c.setConnected(false)
 
+			delay := c.nextReconnectDelay()
+			log.WithError(err).WithField("retry_in", delay).Warn("Failed to connect to controller")
+
 			select {
 			case <-c.ctx.Done():
 				return
-			case <-time.After(c.reconnectInterval):
+			case <-time.After(delay):
 				continue
 			}
 		}
 
+		c.resetReconnectDelay()
 		c.setConnected(true)
 		log.Info("Connected to controller")
 
+		// Deliver what queued up while disconnected
+		select {
+		case c.flushCh <- struct{}{}:
+		default:
+		}
+
 		if err := c.receiveLoop(); err != nil {
 			log.WithError(err).Warn("Connection lost to controller")
 		}
@@ -168,13 +239,47 @@ func (c *Client) connectionManager() {
 		select {
 		case <-c.ctx.Done():
 			return
-		case <-time.After(c.reconnectInterval):
+		case <-time.After(c.nextReconnectDelay()):
 		}
 	}
 }
 
+// nextReconnectDelay returns how long to wait before the next connection
+// attempt. The delay doubles with each consecutive failure up to the
+// maximum, and half of it is random so a fleet of agents doesn't reconnect
+// in lockstep after a controller outage.
+func (c *Client) nextReconnectDelay() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delay := c.reconnectInterval
+	for i := 0; i < c.reconnectAttempts && delay < c.maxReconnectInterval; i++ {
+		delay *= 2
+	}
+	delay = min(delay, c.maxReconnectInterval)
+	c.reconnectAttempts++
+
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(delay-half)+1))
+}
+
+// resetReconnectDelay starts the backoff over after a successful connection
+func (c *Client) resetReconnectDelay() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.reconnectAttempts = 0
+}
+
 func (c *Client) connect() error {
-	var opts []grpc.DialOption
+	// Ping the controller so a dead connection is noticed without waiting
+	// for the next send to fail
+	opts := []grpc.DialOption{
+		grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:                30 * time.Second,
+			Timeout:             10 * time.Second,
+			PermitWithoutStream: true,
+		}),
+	}
 
 	if c.tlsConfig != nil {
 		creds := credentials.NewTLS(c.tlsConfig)
@@ -224,27 +329,110 @@ func (c *Client) sendLoop() {
 		select {
 		case <-c.ctx.Done():
 			return
+		case <-c.flushCh:
+			c.flushOutbox()
 		case msg, ok := <-c.outgoingCh:
 			if !ok {
 				return
 			}
 
-			if !c.IsConnected() {
-				log.Debug("Not connected, dropping message")
-				continue
+			c.send(msg)
+		}
+	}
+}
+
+// isDurable reports whether a message must survive a disconnect. Heartbeats
+// and health results are superseded by the next ones, and log responses
+// answer requests that have timed out by the time the agent reconnects.
+func isDurable(msg *pb.AgentMessage) bool {
+	switch msg.Message.(type) {
+	case *pb.AgentMessage_DeploymentResult, *pb.AgentMessage_ComponentStatus:
+		return true
+	default:
+		return false
+	}
+}
+
+// send delivers a message to the controller. Durable messages go through the
+// outbox so they're delivered in order once connected; others are dropped
+// while disconnected.
+func (c *Client) send(msg *pb.AgentMessage) {
+	if c.db != nil && isDurable(msg) {
+		payload, err := proto.Marshal(msg)
+		if err != nil {
+			log.WithError(err).Warn("Failed to encode message")
+			return
+		}
+
+		if err := c.db.EnqueueOutbox(payload, outboxLimit); err != nil {
+			log.WithError(err).Warn("Failed to store undelivered message")
+			if c.IsConnected() {
+				c.sendNow(msg)
 			}
+			return
+		}
+
+		c.flushOutbox()
+		return
+	}
+
+	if !c.IsConnected() {
+		log.Debug("Not connected, dropping message")
+		return
+	}
+
+	c.sendNow(msg)
+}
+
+// sendNow sends a message on the current stream, reporting whether it was sent
+func (c *Client) sendNow(msg *pb.AgentMessage) bool {
+	c.mu.RLock()
+	stream := c.stream
+	c.mu.RUnlock()
 
-			c.mu.RLock()
-			stream := c.stream
-			c.mu.RUnlock()
+	if stream == nil {
+		return false
+	}
+
+	if err := stream.Send(msg); err != nil {
+		log.WithError(err).Warn("Failed to send message")
+		c.setConnected(false)
+		return false
+	}
+
+	return true
+}
+
+// flushOutbox sends stored messages oldest first, removing each once it has
+// been sent. It stops at the first failure so the order is kept for the next
+// attempt.
+func (c *Client) flushOutbox() {
+	for c.IsConnected() {
+		messages, err := c.db.ListOutbox(outboxBatch)
+		if err != nil {
+			log.WithError(err).Warn("Failed to read undelivered messages")
+			return
+		}
 
-			if stream == nil {
+		if len(messages) == 0 {
+			return
+		}
+
+		for _, stored := range messages {
+			msg := &pb.AgentMessage{}
+			if err := proto.Unmarshal(stored.Payload, msg); err != nil {
+				log.WithError(err).WithField("id", stored.ID).Warn("Discarding unreadable stored message")
+				c.db.DeleteOutbox(stored.ID)
 				continue
 			}
 
-			if err := stream.Send(msg); err != nil {
-				log.WithError(err).Warn("Failed to send message")
-				c.setConnected(false)
+			if !c.sendNow(msg) {
+				return
+			}
+
+			if err := c.db.DeleteOutbox(stored.ID); err != nil {
+				log.WithError(err).WithField("id", stored.ID).Warn("Failed to remove delivered message")
+				return
 			}
 		}
 	}
@@ -300,11 +488,12 @@ func (c *Client) SendHeartbeat() error {
 		}
 
 		pbStatus := &pb.ComponentStatus{
-			Name:         comp.Name,
-			Status:       status.Status,
-			Message:      status.Message,
-			Pid:          int32(status.PID),
-			RestartCount: int32(status.RestartCount),
+			Name:           comp.Name,
+			Status:         status.Status,
+			Message:        status.Message,
+			Pid:            int32(status.PID),
+			RestartCount:   int32(status.RestartCount),
+			RestartHistory: c.restartHistory(comp.Name),
 		}
 
 		if status.LastStartedAt != nil {
@@ -320,8 +509,10 @@ func (c *Client) SendHeartbeat() error {
 		Message: &pb.AgentMessage_Heartbeat{
 			Heartbeat: &pb.AgentHeartbeat{
 				AgentVersion:      agent.Version,
+				Metadata:          c.heartbeatMetadata(),
 				ComponentStatuses: componentStatuses,
 				Tags:              c.tags,
+				SystemMetrics:     readSystemMetrics(c.dataDir),
 			},
 		},
 	}
@@ -334,6 +525,32 @@ func (c *Client) SendHeartbeat() error {
 	}
 }
 
+// restartHistory returns the most recent restarts of a component for status
+// reports, newest first
+func (c *Client) restartHistory(componentName string) []*pb.RestartEvent {
+	events, err := c.db.GetRestartHistory(componentName, reportedRestartHistory)
+	if err != nil {
+		log.WithError(err).WithField("component", componentName).Warn("Failed to get restart history")
+		return nil
+	}
+
+	history := make([]*pb.RestartEvent, 0, len(events))
+	for _, event := range events {
+		history = append(history, &pb.RestartEvent{
+			Timestamp: event.Timestamp.Unix(),
+			Reason:    event.Reason,
+			ExitCode:  int32(event.ExitCode),
+		})
+	}
+	return history
+}
+
+// QueueDepth returns the number of messages waiting to be sent to and
+// processed from the controller
+func (c *Client) QueueDepth() (outgoing, incoming int) {
+	return len(c.outgoingCh), len(c.incomingCh)
+}
+
 func (c *Client) SendComponentStatus(componentName string) error {
 	component, err := c.db.GetComponent(componentName)
 	if err != nil {
@@ -346,11 +563,12 @@ func (c *Client) SendComponentStatus(componentName string) error {
 	}
 
 	pbStatus := &pb.ComponentStatus{
-		Name:         component.Name,
-		Status:       status.Status,
-		Message:      status.Message,
-		Pid:          int32(status.PID),
-		RestartCount: int32(status.RestartCount),
+		Name:           component.Name,
+		Status:         status.Status,
+		Message:        status.Message,
+		Pid:            int32(status.PID),
+		RestartCount:   int32(status.RestartCount),
+		RestartHistory: c.restartHistory(component.Name),
 	}
 
 	if status.LastStartedAt != nil {
@@ -397,17 +615,52 @@ func (c *Client) SendHealthCheckResult(componentName, checkType, result, message
 }
 
 func (c *Client) SendDeploymentResult(componentName, operation, result, message string) error {
+	return c.sendDeploymentResult(&pb.DeploymentResult{
+		ComponentName: componentName,
+		Operation:     operation,
+		Result:        result,
+		Message:       message,
+		Timestamp:     time.Now().Unix(),
+	})
+}
+
+// SendDeploymentProgress reports the phase a deployment is in, with its
+// percentage or -1 when that isn't known
+func (c *Client) SendDeploymentProgress(componentName, phase string, percent int) error {
+	message := strings.ToUpper(phase[:1]) + phase[1:]
+	if percent >= 0 {
+		message = fmt.Sprintf("%s (%d%%)", message, percent)
+	}
+
+	return c.sendDeploymentResult(&pb.DeploymentResult{
+		ComponentName:   componentName,
+		Operation:       "deploy",
+		Result:          "progress",
+		Message:         message,
+		Timestamp:       time.Now().Unix(),
+		Phase:           phase,
+		ProgressPercent: int32(percent),
+	})
+}
+
+// SendControlResult answers a controller ComponentControl request
+func (c *Client) SendControlResult(requestID, componentName, action, result, message string) error {
+	return c.sendDeploymentResult(&pb.DeploymentResult{
+		ComponentName: componentName,
+		Operation:     action,
+		Result:        result,
+		Message:       message,
+		Timestamp:     time.Now().Unix(),
+		RequestId:     requestID,
+	})
+}
+
+func (c *Client) sendDeploymentResult(result *pb.DeploymentResult) error {
 	msg := &pb.AgentMessage{
 		Hostname:  c.hostname,
 		Timestamp: time.Now().Unix(),
 		Message: &pb.AgentMessage_DeploymentResult{
-			DeploymentResult: &pb.DeploymentResult{
-				ComponentName: componentName,
-				Operation:     operation,
-				Result:        result,
-				Message:       message,
-				Timestamp:     time.Now().Unix(),
-			},
+			DeploymentResult: result,
 		},
 	}
 
@@ -441,6 +694,30 @@ func (c *Client) SendLogChunk(componentName, logData string, offset int64) error
 	}
 }
 
+// SendLogResponse answers a controller LogRequest. errMsg is set instead of
+// logData when the log couldn't be read.
+func (c *Client) SendLogResponse(requestID, componentName, logData, errMsg string) error {
+	msg := &pb.AgentMessage{
+		Hostname:  c.hostname,
+		Timestamp: time.Now().Unix(),
+		Message: &pb.AgentMessage_LogResponse{
+			LogResponse: &pb.LogResponse{
+				RequestId:     requestID,
+				ComponentName: componentName,
+				LogData:       logData,
+				Error:         errMsg,
+			},
+		},
+	}
+
+	select {
+	case c.outgoingCh <- msg:
+		return nil
+	case <-time.After(time.Second):
+		return fmt.Errorf("timeout sending log response")
+	}
+}
+
 func (c *Client) ReceiveMessages() <-chan *pb.ControllerMessage {
 	return c.incomingCh
 }
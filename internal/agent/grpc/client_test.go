@@ -2,11 +2,15 @@ package grpc
 
 import (
 	"context"
+	"errors"
 	"os"
+	"runtime"
 	"testing"
 	"time"
 
 	"github.com/metorial/fleet/cosmos/internal/agent/database"
+	pb "github.com/metorial/fleet/cosmos/internal/proto"
+	"google.golang.org/grpc"
 )
 
 func setupTestDB(t *testing.T) (*database.AgentDB, func()) {
@@ -384,3 +388,215 @@ func TestStopClient(t *testing.T) {
 		t.Fatal("Client stop timeout")
 	}
 }
+
+func TestReconnectBackoff(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	client, err := NewClient(&ClientConfig{
+		ControllerURL:        "localhost:9091",
+		Hostname:             "test-agent",
+		DB:                   db,
+		ReconnectInterval:    time.Second,
+		MaxReconnectInterval: 10 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+
+	// Each delay is jittered within the upper half of its backoff step
+	steps := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second}
+
+	var previous time.Duration
+	for i, step := range steps {
+		delay := client.nextReconnectDelay()
+		if delay < step/2 || delay > step {
+			t.Errorf("Attempt %d: expected delay in [%s, %s], got %s", i+1, step/2, step, delay)
+		}
+		// A doubled step's range starts where the previous one ends
+		if i > 0 && step >= 2*steps[i-1] && delay < previous {
+			t.Errorf("Attempt %d: expected delay not to shrink, got %s after %s", i+1, delay, previous)
+		}
+		previous = delay
+	}
+
+	client.resetReconnectDelay()
+	if delay := client.nextReconnectDelay(); delay > time.Second {
+		t.Errorf("Expected delay to reset to the base after connecting, got %s", delay)
+	}
+}
+
+// fakeStream records sent messages and fails once failAfter have been sent
+type fakeStream struct {
+	grpc.ClientStream
+	sent      []*pb.AgentMessage
+	failAfter int
+}
+
+func (s *fakeStream) Send(msg *pb.AgentMessage) error {
+	if s.failAfter >= 0 && len(s.sent) >= s.failAfter {
+		return errors.New("stream broken")
+	}
+	s.sent = append(s.sent, msg)
+	return nil
+}
+
+func (s *fakeStream) Recv() (*pb.ControllerMessage, error) {
+	return nil, errors.New("not implemented")
+}
+
+func TestOutboxDeliversAfterReconnect(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	client, err := NewClient(&ClientConfig{ControllerURL: "localhost:9091", Hostname: "test-agent", DB: db})
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+
+	result := func(component string) *pb.AgentMessage {
+		return &pb.AgentMessage{
+			Hostname: "test-agent",
+			Message: &pb.AgentMessage_DeploymentResult{
+				DeploymentResult: &pb.DeploymentResult{ComponentName: component, Operation: "deploy", Result: "success"},
+			},
+		}
+	}
+
+	// Offline: results are stored, heartbeats are dropped
+	for _, name := range []string{"a", "b", "c"} {
+		client.send(result(name))
+	}
+	client.send(&pb.AgentMessage{Message: &pb.AgentMessage_Heartbeat{Heartbeat: &pb.AgentHeartbeat{}}})
+
+	stored, err := db.ListOutbox(outboxBatch)
+	if err != nil {
+		t.Fatalf("Failed to list outbox: %v", err)
+	}
+	if len(stored) != 3 {
+		t.Fatalf("Expected 3 stored messages while offline, got %d", len(stored))
+	}
+
+	// The stream breaks after the first message; the rest stay queued
+	stream := &fakeStream{failAfter: 1}
+	client.stream = stream
+	client.setConnected(true)
+	client.flushOutbox()
+
+	if len(stream.sent) != 1 {
+		t.Fatalf("Expected 1 message sent before the stream broke, got %d", len(stream.sent))
+	}
+	if stored, _ = db.ListOutbox(outboxBatch); len(stored) != 2 {
+		t.Fatalf("Expected 2 messages left after a failed send, got %d", len(stored))
+	}
+
+	stream = &fakeStream{failAfter: -1}
+	client.stream = stream
+	client.setConnected(true)
+	client.flushOutbox()
+
+	var names []string
+	for _, msg := range stream.sent {
+		names = append(names, msg.GetDeploymentResult().ComponentName)
+	}
+	if len(names) != 2 || names[0] != "b" || names[1] != "c" {
+		t.Errorf("Expected backlog b, c delivered in order, got %v", names)
+	}
+
+	if stored, _ = db.ListOutbox(outboxBatch); len(stored) != 0 {
+		t.Errorf("Expected outbox to be empty after flushing, got %d", len(stored))
+	}
+
+	// Connected: new results go out right away
+	client.send(result("d"))
+	if len(stream.sent) != 3 || stream.sent[2].GetDeploymentResult().ComponentName != "d" {
+		t.Errorf("Expected new result to be sent while connected")
+	}
+}
+
+func TestOutboxDropsOldestBeyondLimit(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	for _, payload := range []string{"1", "2", "3", "4"} {
+		if err := db.EnqueueOutbox([]byte(payload), 3); err != nil {
+			t.Fatalf("Failed to enqueue: %v", err)
+		}
+	}
+
+	stored, err := db.ListOutbox(10)
+	if err != nil {
+		t.Fatalf("Failed to list outbox: %v", err)
+	}
+	if len(stored) != 3 || string(stored[0].Payload) != "2" {
+		t.Errorf("Expected the oldest message to be dropped, got %d messages", len(stored))
+	}
+}
+
+func TestHeartbeatIncludesSystemMetrics(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("system metrics are read from /proc")
+	}
+
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	client, err := NewClient(&ClientConfig{ControllerURL: "localhost:9091", Hostname: "test-agent", DB: db, DataDir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+
+	if err := client.SendHeartbeat(); err != nil {
+		t.Fatalf("SendHeartbeat failed: %v", err)
+	}
+
+	msg := <-client.outgoingCh
+	metrics := msg.GetHeartbeat().GetSystemMetrics()
+	if metrics == nil {
+		t.Fatal("Expected heartbeat to carry system metrics")
+	}
+
+	if metrics.CpuCount <= 0 {
+		t.Errorf("Expected a CPU count, got %d", metrics.CpuCount)
+	}
+	if metrics.LoadAverage < 0 {
+		t.Errorf("Expected a non-negative load average, got %f", metrics.LoadAverage)
+	}
+	if metrics.MemoryTotalBytes == 0 || metrics.MemoryUsedBytes == 0 || metrics.MemoryUsedBytes > metrics.MemoryTotalBytes {
+		t.Errorf("Expected memory used within total, got %d of %d", metrics.MemoryUsedBytes, metrics.MemoryTotalBytes)
+	}
+	if metrics.DiskTotalBytes == 0 || metrics.DiskFreeBytes == 0 || metrics.DiskFreeBytes > metrics.DiskTotalBytes {
+		t.Errorf("Expected disk free within total, got %d of %d", metrics.DiskFreeBytes, metrics.DiskTotalBytes)
+	}
+}
+
+func TestRestartHistoryIsReportedNewestFirst(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	client, err := NewClient(&ClientConfig{ControllerURL: "localhost:9091", Hostname: "test-agent", DB: db})
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+
+	if history := client.restartHistory("web"); len(history) != 0 {
+		t.Errorf("Expected no history before any restart, got %v", history)
+	}
+
+	start := time.Unix(1700000000, 0)
+	for i := 0; i < reportedRestartHistory+2; i++ {
+		event := &database.RestartEvent{ComponentName: "web", Timestamp: start.Add(time.Duration(i) * time.Second), Reason: "Component failed", ExitCode: i}
+		if err := db.RecordRestart(event, 20); err != nil {
+			t.Fatalf("Failed to record restart: %v", err)
+		}
+	}
+
+	history := client.restartHistory("web")
+	if len(history) != reportedRestartHistory {
+		t.Fatalf("Expected %d events, got %d", reportedRestartHistory, len(history))
+	}
+	newest := history[0]
+	if newest.Timestamp != start.Unix()+int64(reportedRestartHistory+1) || newest.ExitCode != int32(reportedRestartHistory+1) || newest.Reason != "Component failed" {
+		t.Errorf("Expected the newest restart first, got %+v", newest)
+	}
+}
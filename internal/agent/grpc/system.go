@@ -0,0 +1,77 @@
+package grpc
+
+import (
+	"bufio"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+
+	pb "github.com/metorial/fleet/cosmos/internal/proto"
+	log "github.com/sirupsen/logrus"
+)
+
+// readSystemMetrics reads the node's load, memory and the disk usage of the
+// filesystem holding dataDir. Values that can't be read are left at zero.
+func readSystemMetrics(dataDir string) *pb.SystemMetrics {
+	metrics := &pb.SystemMetrics{CpuCount: int32(runtime.NumCPU())}
+
+	if data, err := os.ReadFile("/proc/loadavg"); err == nil {
+		if fields := strings.Fields(string(data)); len(fields) > 0 {
+			metrics.LoadAverage, _ = strconv.ParseFloat(fields[0], 64)
+		}
+	}
+
+	if total, available, err := readMemInfo(); err == nil {
+		metrics.MemoryTotalBytes = total
+		if available < total {
+			metrics.MemoryUsedBytes = total - available
+		}
+	} else {
+		log.WithError(err).Debug("Failed to read memory usage")
+	}
+
+	if dataDir != "" {
+		var stat syscall.Statfs_t
+		if err := syscall.Statfs(dataDir, &stat); err == nil {
+			metrics.DiskFreeBytes = stat.Bavail * uint64(stat.Bsize)
+			metrics.DiskTotalBytes = stat.Blocks * uint64(stat.Bsize)
+		} else {
+			log.WithError(err).Debug("Failed to read disk usage")
+		}
+	}
+
+	return metrics
+}
+
+// readMemInfo returns the total and available memory in bytes
+func readMemInfo() (total, available uint64, err error) {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+
+		kb, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+
+		switch fields[0] {
+		case "MemTotal:":
+			total = kb * 1024
+		case "MemAvailable:":
+			available = kb * 1024
+		}
+	}
+
+	return total, available, scanner.Err()
+}
@@ -2,21 +2,67 @@ package health
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"hash/fnv"
+	"io"
 	"net"
 	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/metorial/fleet/cosmos/internal/agent/database"
 	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 )
 
 type Checker struct {
 	db             *database.AgentDB
 	httpClient     *http.Client
 	checkProcessFn func(int) bool
+	readLogFn      func(string, int64) (string, int64)
+	jitter         float64
+
+	countsMu sync.Mutex
+	counts   map[string]ResultCounts
+	history  map[string][]Result
+}
+
+// defaultJitter is the fraction of the interval checks are spread by
+const defaultJitter = 0.1
+
+// historyLimit bounds the results kept per component for SuccessRate
+const historyLimit = 1000
+
+// Result is a single pass or fail of a component's health check
+type Result struct {
+	Time    time.Time
+	Success bool
 }
 
+// ResultCounts is the number of passed and failed checks of a component since
+// the agent started
+type ResultCounts struct {
+	Success int64
+	Failure int64
+}
+
+// errCheckPending is returned by checks that can't decide yet, such as a log
+// check still waiting for its ready pattern. It doesn't count as a failure.
+var errCheckPending = errors.New("health check pending")
+
 func NewChecker(db *database.AgentDB, checkProcessFn func(int) bool) *Checker {
 	return &Checker{
 		db: db,
@@ -27,9 +73,22 @@ func NewChecker(db *database.AgentDB, checkProcessFn func(int) bool) *Checker {
 			},
 		},
 		checkProcessFn: checkProcessFn,
+		jitter:         defaultJitter,
 	}
 }
 
+// SetJitter sets how far, as a percentage of the interval, each component's
+// next check is moved from the exact interval. 0 disables jitter.
+func (c *Checker) SetJitter(percent int) {
+	c.jitter = float64(min(max(percent, 0), 100)) / 100
+}
+
+// SetLogReader sets the function used by log checks to read new component
+// output from an offset, returning the content and the next offset.
+func (c *Checker) SetLogReader(fn func(componentName string, offset int64) (string, int64)) {
+	c.readLogFn = fn
+}
+
 func (c *Checker) RunHealthCheck(ctx context.Context, componentName string) error {
 	check, err := c.db.GetHealthCheck(componentName)
 	if err != nil {
@@ -45,11 +104,17 @@ func (c *Checker) RunHealthCheck(ctx context.Context, componentName string) erro
 
 	switch check.Type {
 	case "http":
-		checkErr = c.performHTTPCheck(ctx, check.Endpoint, check.TimeoutSeconds)
+		checkErr = c.performHTTPCheck(ctx, resolveEndpoint(check), check)
 	case "tcp":
-		checkErr = c.performTCPCheck(ctx, check.Endpoint, check.TimeoutSeconds)
+		checkErr = c.performTCPCheck(ctx, resolveEndpoint(check), check.TimeoutSeconds)
+	case "grpc":
+		checkErr = c.performGRPCCheck(ctx, resolveEndpoint(check), check.TimeoutSeconds, check.TLS)
 	case "process":
 		checkErr = c.performProcessCheck(componentName)
+	case "log":
+		checkErr = c.performLogCheck(check)
+	case "exec":
+		checkErr = c.performExecCheck(ctx, check)
 	default:
 		return fmt.Errorf("unsupported health check type: %s", check.Type)
 	}
@@ -57,10 +122,31 @@ func (c *Checker) RunHealthCheck(ctx context.Context, componentName string) erro
 	now := time.Now()
 	check.LastCheckAt = &now
 
+	// A slow starting component isn't failing yet
+	if checkErr != nil && inStartPeriod(check, c.startedAt(componentName), now) {
+		checkErr = fmt.Errorf("%w: in start period: %v", errCheckPending, checkErr)
+	}
+
+	if errors.Is(checkErr, errCheckPending) {
+		check.LastResult = "pending"
+		result = checkErr.Error()
+		check.LastMessage = result
+		log.WithFields(log.Fields{
+			"component": componentName,
+			"type":      check.Type,
+		}).Debug(result)
+
+		if err := c.db.UpsertHealthCheck(check); err != nil {
+			return fmt.Errorf("failed to update health check: %w", err)
+		}
+		return nil
+	}
+
 	if checkErr != nil {
 		check.LastResult = "failure"
 		check.ConsecutiveFailures++
 		result = fmt.Sprintf("Health check failed: %v", checkErr)
+		check.LastMessage = checkErr.Error()
 		log.WithFields(log.Fields{
 			"component":            componentName,
 			"type":                 check.Type,
@@ -70,6 +156,7 @@ func (c *Checker) RunHealthCheck(ctx context.Context, componentName string) erro
 		check.LastResult = "success"
 		check.ConsecutiveFailures = 0
 		result = "Health check passed"
+		check.LastMessage = ""
 		log.WithFields(log.Fields{
 			"component": componentName,
 			"type":      check.Type,
@@ -80,31 +167,168 @@ func (c *Checker) RunHealthCheck(ctx context.Context, componentName string) erro
 		return fmt.Errorf("failed to update health check: %w", err)
 	}
 
+	c.recordResult(componentName, checkErr == nil)
+
 	return checkErr
 }
 
-func (c *Checker) performHTTPCheck(ctx context.Context, endpoint string, timeoutSeconds int) error {
-	if timeoutSeconds > 0 {
+func (c *Checker) recordResult(componentName string, success bool) {
+	c.countsMu.Lock()
+	defer c.countsMu.Unlock()
+
+	if c.counts == nil {
+		c.counts = make(map[string]ResultCounts)
+	}
+
+	counts := c.counts[componentName]
+	if success {
+		counts.Success++
+	} else {
+		counts.Failure++
+	}
+	c.counts[componentName] = counts
+
+	if c.history == nil {
+		c.history = make(map[string][]Result)
+	}
+
+	history := append(c.history[componentName], Result{Time: time.Now(), Success: success})
+	if len(history) > historyLimit {
+		history = history[len(history)-historyLimit:]
+	}
+	c.history[componentName] = history
+}
+
+// SuccessRate returns the fraction of a component's checks that passed in
+// [from, to) and the number of checks that covers. Pending checks aren't
+// counted. The rate is 0 when there were no checks.
+func (c *Checker) SuccessRate(componentName string, from, to time.Time) (float64, int) {
+	c.countsMu.Lock()
+	defer c.countsMu.Unlock()
+
+	total, passed := 0, 0
+	for _, result := range c.history[componentName] {
+		if result.Time.Before(from) || !result.Time.Before(to) {
+			continue
+		}
+		total++
+		if result.Success {
+			passed++
+		}
+	}
+
+	if total == 0 {
+		return 0, 0
+	}
+	return float64(passed) / float64(total), total
+}
+
+// ResultCounts returns a snapshot of check results per component
+func (c *Checker) ResultCounts() map[string]ResultCounts {
+	c.countsMu.Lock()
+	defer c.countsMu.Unlock()
+
+	snapshot := make(map[string]ResultCounts, len(c.counts))
+	for name, counts := range c.counts {
+		snapshot[name] = counts
+	}
+	return snapshot
+}
+
+// resolveEndpoint returns the address to probe. A full endpoint is used as-is;
+// otherwise a port-only check targets localhost on this node.
+func resolveEndpoint(check *database.HealthCheck) string {
+	if check.Endpoint != "" || check.Port <= 0 {
+		return check.Endpoint
+	}
+
+	hostPort := net.JoinHostPort("localhost", strconv.Itoa(check.Port))
+	if check.Type == "tcp" || check.Type == "grpc" {
+		return hostPort
+	}
+
+	scheme := check.Scheme
+	if scheme == "" {
+		scheme = "http"
+	}
+
+	path := check.Path
+	if path != "" && !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+
+	return fmt.Sprintf("%s://%s%s", scheme, hostPort, path)
+}
+
+// maxHealthBody bounds how much of a response body is matched against
+// ExpectedBody
+const maxHealthBody = 1 << 20
+
+// performHTTPCheck sends the check's request (GET by default) and requires an
+// allowed status code, any 2xx unless ExpectedStatus lists them, and a body
+// matching ExpectedBody when it is set
+func (c *Checker) performHTTPCheck(ctx context.Context, endpoint string, check *database.HealthCheck) error {
+	if check.TimeoutSeconds > 0 {
 		var cancel context.CancelFunc
-		ctx, cancel = context.WithTimeout(ctx, time.Duration(timeoutSeconds)*time.Second)
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(check.TimeoutSeconds)*time.Second)
 		defer cancel()
 	}
 
-	req, err := http.NewRequestWithContext(ctx, "GET", endpoint, nil)
+	headers, err := c.db.GetHealthCheckHeaders(check)
+	if err != nil {
+		return fmt.Errorf("invalid headers: %w", err)
+	}
+
+	expectedStatus, err := c.db.GetExpectedStatus(check)
+	if err != nil {
+		return fmt.Errorf("invalid expected status: %w", err)
+	}
+
+	method := check.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, nil)
 	if err != nil {
 		return fmt.Errorf("failed to create request: %w", err)
 	}
 
+	for name, value := range headers {
+		if strings.EqualFold(name, "Host") {
+			req.Host = value
+			continue
+		}
+		req.Header.Set(name, value)
+	}
+
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
 		return fmt.Errorf("request failed: %w", err)
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+	if len(expectedStatus) > 0 {
+		if !slices.Contains(expectedStatus, resp.StatusCode) {
+			return fmt.Errorf("unexpected status code: %d (expected %v)", resp.StatusCode, expectedStatus)
+		}
+	} else if resp.StatusCode < 200 || resp.StatusCode >= 300 {
 		return fmt.Errorf("unhealthy status code: %d", resp.StatusCode)
 	}
 
+	if check.ExpectedBody == "" {
+		return nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxHealthBody))
+	if err != nil {
+		return fmt.Errorf("failed to read response body: %w", err)
+	}
+
+	if !matchPattern(check.ExpectedBody, string(body)) {
+		return fmt.Errorf("response body does not match %q", check.ExpectedBody)
+	}
+
 	return nil
 }
 
@@ -127,6 +351,40 @@ func (c *Checker) performTCPCheck(ctx context.Context, endpoint string, timeoutS
 	return nil
 }
 
+// performGRPCCheck calls the standard grpc.health.v1 Check for the whole
+// server; only SERVING is healthy
+func (c *Checker) performGRPCCheck(ctx context.Context, endpoint string, timeoutSeconds int, useTLS bool) error {
+	timeout := time.Duration(timeoutSeconds) * time.Second
+	if timeoutSeconds <= 0 {
+		timeout = 5 * time.Second
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	creds := insecure.NewCredentials()
+	if useTLS {
+		creds = credentials.NewTLS(&tls.Config{MinVersion: tls.VersionTLS12})
+	}
+
+	conn, err := grpc.NewClient(endpoint, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return fmt.Errorf("failed to create client: %w", err)
+	}
+	defer conn.Close()
+
+	resp, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{})
+	if err != nil {
+		return fmt.Errorf("health check call failed: %w", err)
+	}
+
+	if resp.Status != healthpb.HealthCheckResponse_SERVING {
+		return fmt.Errorf("unhealthy status: %s", resp.Status)
+	}
+
+	return nil
+}
+
 func (c *Checker) performProcessCheck(componentName string) error {
 	status, err := c.db.GetComponentStatus(componentName)
 	if err != nil {
@@ -148,6 +406,137 @@ func (c *Checker) performProcessCheck(componentName string) error {
 	return nil
 }
 
+// maxExecOutput bounds the command output kept in a failed exec check's message
+const maxExecOutput = 4 * 1024
+
+// performExecCheck runs the command line in Endpoint through sh, healthy when
+// it exits 0. The command gets the component's environment and, for
+// programs, runs in the program's directory. Output is included in the error.
+func (c *Checker) performExecCheck(ctx context.Context, check *database.HealthCheck) error {
+	if check.Endpoint == "" {
+		return fmt.Errorf("exec check requires a command in endpoint")
+	}
+
+	timeout := time.Duration(check.TimeoutSeconds) * time.Second
+	if check.TimeoutSeconds <= 0 {
+		timeout = 5 * time.Second
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "sh", "-c", check.Endpoint)
+	cmd.Env = os.Environ()
+
+	if component, err := c.db.GetComponent(check.ComponentName); err == nil {
+		env, err := c.db.GetEnvMap(component)
+		if err != nil {
+			return fmt.Errorf("failed to get environment: %w", err)
+		}
+		for k, v := range env {
+			cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", k, v))
+		}
+		if component.Executable != "" {
+			cmd.Dir = filepath.Dir(component.Executable)
+		}
+	}
+
+	// Kill anything the command started too, and don't wait on output pipes
+	// held open by orphans once it's gone
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	cmd.WaitDelay = time.Second
+
+	output, err := cmd.CombinedOutput()
+	text := strings.TrimSpace(string(output))
+	if len(text) > maxExecOutput {
+		text = "..." + text[len(text)-maxExecOutput:]
+	}
+
+	switch {
+	case ctx.Err() == context.DeadlineExceeded:
+		err = fmt.Errorf("command timed out after %s", timeout)
+	case err == nil:
+		return nil
+	}
+
+	if text != "" {
+		return fmt.Errorf("%v: %s", err, text)
+	}
+	return err
+}
+
+// performLogCheck scans output written since the last check. The component is
+// healthy once Pattern has appeared since it last started, and unhealthy if
+// ErrorPattern appears or Pattern isn't seen within TimeoutSeconds of start.
+func (c *Checker) performLogCheck(check *database.HealthCheck) error {
+	if c.readLogFn == nil {
+		return fmt.Errorf("log reader not configured")
+	}
+
+	if check.Pattern == "" && check.ErrorPattern == "" {
+		return fmt.Errorf("log check requires a pattern or error_pattern")
+	}
+
+	status, err := c.db.GetComponentStatus(check.ComponentName)
+	if err != nil {
+		return fmt.Errorf("failed to get component status: %w", err)
+	}
+
+	// Output from before the component last started, and any error in it,
+	// belongs to an earlier run
+	if check.LogOffset < status.LogStartOffset {
+		check.LogOffset = status.LogStartOffset
+		check.LogMatchedAt = nil
+	}
+
+	for {
+		output, newOffset := c.readLogFn(check.ComponentName, check.LogOffset)
+		if output == "" {
+			break
+		}
+		check.LogOffset = newOffset
+
+		if check.ErrorPattern != "" && matchPattern(check.ErrorPattern, output) {
+			check.LogMatchedAt = nil
+			return fmt.Errorf("error pattern %q found in output", check.ErrorPattern)
+		}
+
+		if check.Pattern != "" && matchPattern(check.Pattern, output) {
+			now := time.Now()
+			check.LogMatchedAt = &now
+		}
+	}
+
+	if check.Pattern == "" {
+		return nil
+	}
+
+	startedAt := status.LastStartedAt
+	if check.LogMatchedAt != nil && (startedAt == nil || !check.LogMatchedAt.Before(*startedAt)) {
+		return nil
+	}
+
+	timeout := time.Duration(check.TimeoutSeconds) * time.Second
+	if startedAt != nil && timeout > 0 && time.Since(*startedAt) > timeout {
+		return fmt.Errorf("pattern %q not found within %v of start", check.Pattern, timeout)
+	}
+
+	return fmt.Errorf("%w: waiting for pattern %q", errCheckPending, check.Pattern)
+}
+
+// matchPattern treats the pattern as a regular expression, falling back to a
+// plain substring match when it doesn't compile.
+func matchPattern(pattern, text string) bool {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return strings.Contains(text, pattern)
+	}
+	return re.MatchString(text)
+}
+
 func (c *Checker) CheckAllComponents(ctx context.Context) error {
 	components, err := c.db.GetAllComponents()
 	if err != nil {
@@ -165,7 +554,7 @@ func (c *Checker) CheckAllComponents(ctx context.Context) error {
 			continue
 		}
 
-		if !c.shouldRunCheck(check) {
+		if !c.shouldRunCheck(check, c.startedAt(component.Name)) {
 			continue
 		}
 
@@ -177,16 +566,39 @@ func (c *Checker) CheckAllComponents(ctx context.Context) error {
 	return nil
 }
 
-func (c *Checker) shouldRunCheck(check *database.HealthCheck) bool {
+// shouldRunCheck reports whether a check is due. A component that started
+// after the last check is checked right away instead of waiting a full
+// interval.
+func (c *Checker) shouldRunCheck(check *database.HealthCheck, startedAt *time.Time) bool {
 	if check.LastCheckAt == nil {
 		return true
 	}
 
+	if startedAt != nil && check.LastCheckAt.Before(*startedAt) {
+		return true
+	}
+
 	interval := time.Duration(check.IntervalSeconds) * time.Second
-	nextCheck := check.LastCheckAt.Add(interval)
+	nextCheck := check.LastCheckAt.Add(interval + c.checkJitter(check.ComponentName, interval))
 	return time.Now().After(nextCheck)
 }
 
+// checkJitter returns the offset applied to a component's check interval.
+// It's derived from the component name, so it stays the same across
+// reconciles and agent restarts while differing between components.
+func (c *Checker) checkJitter(componentName string, interval time.Duration) time.Duration {
+	if c.jitter <= 0 || interval <= 0 {
+		return 0
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(componentName))
+
+	// Map the hash onto [-1, 1)
+	spread := float64(h.Sum32())/float64(1<<31) - 1
+	return time.Duration(spread * c.jitter * float64(interval))
+}
+
 func (c *Checker) GetFailedComponents() ([]*database.HealthCheck, error) {
 	components, err := c.db.GetAllComponents()
 	if err != nil {
@@ -206,6 +618,10 @@ func (c *Checker) GetFailedComponents() ([]*database.HealthCheck, error) {
 			continue
 		}
 
+		if inStartPeriod(check, c.startedAt(component.Name), time.Now()) {
+			continue
+		}
+
 		if check.ConsecutiveFailures >= check.Retries && check.Retries > 0 {
 			failed = append(failed, check)
 		}
@@ -214,6 +630,25 @@ func (c *Checker) GetFailedComponents() ([]*database.HealthCheck, error) {
 	return failed, nil
 }
 
+// startedAt returns when the component was last started, or nil if it isn't
+// known
+func (c *Checker) startedAt(componentName string) *time.Time {
+	status, err := c.db.GetComponentStatus(componentName)
+	if err != nil {
+		return nil
+	}
+	return status.LastStartedAt
+}
+
+// inStartPeriod reports whether the component started less than the check's
+// StartPeriodSeconds ago
+func inStartPeriod(check *database.HealthCheck, startedAt *time.Time, now time.Time) bool {
+	if check.StartPeriodSeconds <= 0 || startedAt == nil {
+		return false
+	}
+	return now.Before(startedAt.Add(time.Duration(check.StartPeriodSeconds) * time.Second))
+}
+
 func (c *Checker) ResetFailureCount(componentName string) error {
 	check, err := c.db.GetHealthCheck(componentName)
 	if err != nil {
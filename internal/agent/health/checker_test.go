@@ -2,13 +2,18 @@ package health
 
 import (
 	"context"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/metorial/fleet/cosmos/internal/agent/database"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 )
 
 func setupTestDB(t *testing.T) (*database.AgentDB, func()) {
@@ -120,6 +125,93 @@ func TestHTTPHealthCheck(t *testing.T) {
 	}
 }
 
+func TestHTTPHealthCheckRequestAndBody(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Authorization") != "Bearer probe" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status": "ready", "version": "1.2.3"}`))
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name           string
+		method         string
+		headers        map[string]string
+		expectedBody   string
+		expectedStatus []int
+		shouldFail     bool
+	}{
+		{
+			name:         "JSON body matches",
+			method:       http.MethodPost,
+			headers:      map[string]string{"Authorization": "Bearer probe"},
+			expectedBody: `"status":\s*"ready"`,
+		},
+		{
+			name:         "JSON body does not match",
+			method:       http.MethodPost,
+			headers:      map[string]string{"Authorization": "Bearer probe"},
+			expectedBody: `"status": "draining"`,
+			shouldFail:   true,
+		},
+		{
+			name:       "Default GET is unauthorized",
+			shouldFail: true,
+		},
+		{
+			name:           "Expected 401",
+			expectedStatus: []int{401},
+		},
+		{
+			name:           "Expected 401 but got 200",
+			method:         http.MethodPost,
+			headers:        map[string]string{"Authorization": "Bearer probe"},
+			expectedStatus: []int{401},
+			shouldFail:     true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checker := NewChecker(db, func(pid int) bool { return true })
+
+			check := &database.HealthCheck{
+				ComponentName:   "test-http-request",
+				Type:            "http",
+				Endpoint:        server.URL,
+				IntervalSeconds: 30,
+				TimeoutSeconds:  5,
+				Retries:         3,
+				Method:          tt.method,
+				ExpectedBody:    tt.expectedBody,
+			}
+			if tt.headers != nil {
+				db.SetHealthCheckHeaders(check, tt.headers)
+			}
+			if tt.expectedStatus != nil {
+				db.SetExpectedStatus(check, tt.expectedStatus)
+			}
+			if err := db.UpsertHealthCheck(check); err != nil {
+				t.Fatalf("Failed to insert health check: %v", err)
+			}
+
+			err := checker.RunHealthCheck(context.Background(), "test-http-request")
+			if tt.shouldFail && err == nil {
+				t.Error("Expected health check to fail, but it succeeded")
+			}
+			if !tt.shouldFail && err != nil {
+				t.Errorf("Expected health check to succeed, but it failed: %v", err)
+			}
+		})
+	}
+}
+
 func TestTCPHealthCheck(t *testing.T) {
 	db, cleanup := setupTestDB(t)
 	defer cleanup()
@@ -164,6 +256,59 @@ func TestTCPHealthCheck(t *testing.T) {
 	}
 }
 
+func TestPortOnlyHealthCheck(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	var requestedPath string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestedPath = r.URL.Path
+		w.WriteHeader(200)
+	}))
+	defer server.Close()
+
+	port := server.Listener.Addr().(*net.TCPAddr).Port
+
+	mockProcessCheck := func(pid int) bool { return true }
+	checker := NewChecker(db, mockProcessCheck)
+
+	tests := []struct {
+		name      string
+		checkType string
+		path      string
+	}{
+		{name: "http with path", checkType: "http", path: "health"},
+		{name: "tcp", checkType: "tcp"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			componentName := "test-port-" + tt.checkType
+			check := &database.HealthCheck{
+				ComponentName:   componentName,
+				Type:            tt.checkType,
+				Port:            port,
+				Path:            tt.path,
+				IntervalSeconds: 30,
+				TimeoutSeconds:  5,
+				Retries:         3,
+			}
+
+			if err := db.UpsertHealthCheck(check); err != nil {
+				t.Fatalf("Failed to insert health check: %v", err)
+			}
+
+			if err := checker.RunHealthCheck(context.Background(), componentName); err != nil {
+				t.Errorf("Port-only health check failed: %v", err)
+			}
+
+			if tt.checkType == "http" && requestedPath != "/health" {
+				t.Errorf("Expected request to /health, got %s", requestedPath)
+			}
+		})
+	}
+}
+
 func TestTCPHealthCheckFailure(t *testing.T) {
 	db, cleanup := setupTestDB(t)
 	defer cleanup()
@@ -203,6 +348,124 @@ func TestTCPHealthCheckFailure(t *testing.T) {
 	}
 }
 
+func TestGRPCHealthCheck(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+
+	healthServer := health.NewServer()
+	server := grpc.NewServer()
+	healthpb.RegisterHealthServer(server, healthServer)
+	go server.Serve(listener)
+	defer server.Stop()
+
+	// Grab a port with nothing listening on it
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	unreachable := closed.Addr().String()
+	closed.Close()
+
+	tests := []struct {
+		name       string
+		endpoint   string
+		status     healthpb.HealthCheckResponse_ServingStatus
+		shouldFail bool
+	}{
+		{"Serving", listener.Addr().String(), healthpb.HealthCheckResponse_SERVING, false},
+		{"Not serving", listener.Addr().String(), healthpb.HealthCheckResponse_NOT_SERVING, true},
+		{"Unreachable", unreachable, healthpb.HealthCheckResponse_SERVING, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			healthServer.SetServingStatus("", tt.status)
+
+			checker := NewChecker(db, func(pid int) bool { return true })
+
+			check := &database.HealthCheck{
+				ComponentName:   "test-grpc-component",
+				Type:            "grpc",
+				Endpoint:        tt.endpoint,
+				IntervalSeconds: 30,
+				TimeoutSeconds:  1,
+				Retries:         3,
+			}
+			if err := db.UpsertHealthCheck(check); err != nil {
+				t.Fatalf("Failed to insert health check: %v", err)
+			}
+
+			err := checker.RunHealthCheck(context.Background(), "test-grpc-component")
+			if tt.shouldFail && err == nil {
+				t.Error("Expected gRPC health check to fail, but it succeeded")
+			}
+			if !tt.shouldFail && err != nil {
+				t.Errorf("Expected gRPC health check to succeed, but it failed: %v", err)
+			}
+		})
+	}
+}
+
+func TestExecHealthCheck(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	tests := []struct {
+		name        string
+		command     string
+		timeout     int
+		shouldFail  bool
+		wantMessage string
+	}{
+		{"Exit zero", "echo ok", 5, false, ""},
+		{"Non-zero exit", "echo 'database unreachable' >&2; exit 3", 5, true, "database unreachable"},
+		{"Timed out", "sleep 10", 1, true, "timed out"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checker := NewChecker(db, func(pid int) bool { return true })
+
+			check := &database.HealthCheck{
+				ComponentName:   "test-exec-component",
+				Type:            "exec",
+				Endpoint:        tt.command,
+				IntervalSeconds: 30,
+				TimeoutSeconds:  tt.timeout,
+				Retries:         3,
+			}
+			if err := db.UpsertHealthCheck(check); err != nil {
+				t.Fatalf("Failed to insert health check: %v", err)
+			}
+
+			start := time.Now()
+			err := checker.RunHealthCheck(context.Background(), "test-exec-component")
+			if tt.shouldFail && err == nil {
+				t.Fatal("Expected exec health check to fail, but it succeeded")
+			}
+			if !tt.shouldFail && err != nil {
+				t.Fatalf("Expected exec health check to succeed, but it failed: %v", err)
+			}
+			if elapsed := time.Since(start); elapsed > 5*time.Second {
+				t.Errorf("Health check took %s, expected the timeout to stop it", elapsed)
+			}
+
+			updatedCheck, err := db.GetHealthCheck("test-exec-component")
+			if err != nil {
+				t.Fatalf("Failed to get updated health check: %v", err)
+			}
+			if !strings.Contains(updatedCheck.LastMessage, tt.wantMessage) {
+				t.Errorf("Expected LastMessage to contain %q, got %q", tt.wantMessage, updatedCheck.LastMessage)
+			}
+		})
+	}
+}
+
 func TestProcessHealthCheck(t *testing.T) {
 	db, cleanup := setupTestDB(t)
 	defer cleanup()
@@ -276,6 +539,130 @@ func TestProcessHealthCheck(t *testing.T) {
 	}
 }
 
+func TestLogHealthCheck(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	tests := []struct {
+		name           string
+		output         string
+		pattern        string
+		errorPattern   string
+		startedAgo     time.Duration
+		logStartOffset int64
+		shouldFail     bool
+		expectedResult string
+	}{
+		{
+			name:           "Ready pattern found",
+			output:         "booting\nserver started on :8080\n",
+			pattern:        "server started",
+			startedAgo:     time.Second,
+			expectedResult: "success",
+		},
+		{
+			name:           "Ready regex found",
+			output:         "listening on port 9000\n",
+			pattern:        `listening on port \d+`,
+			startedAgo:     time.Second,
+			expectedResult: "success",
+		},
+		{
+			name:           "Waiting within timeout",
+			output:         "booting\n",
+			pattern:        "server started",
+			startedAgo:     time.Second,
+			expectedResult: "pending",
+		},
+		{
+			name:           "Pattern not seen before timeout",
+			output:         "booting\n",
+			pattern:        "server started",
+			startedAgo:     time.Minute,
+			shouldFail:     true,
+			expectedResult: "failure",
+		},
+		{
+			name:           "Error pattern found",
+			output:         "server started\nFATAL: out of memory\n",
+			pattern:        "server started",
+			errorPattern:   "FATAL",
+			startedAgo:     time.Second,
+			shouldFail:     true,
+			expectedResult: "failure",
+		},
+		{
+			name:           "Error pattern from an earlier run ignored",
+			output:         "FATAL: out of memory\nserver started\n",
+			pattern:        "server started",
+			errorPattern:   "FATAL",
+			startedAgo:     time.Second,
+			logStartOffset: int64(len("FATAL: out of memory\n")),
+			expectedResult: "success",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			startedAt := time.Now().Add(-tt.startedAgo)
+			status := &database.ComponentStatus{
+				ComponentName:  "test-log-component",
+				Status:         "running",
+				LastStartedAt:  &startedAt,
+				LastCheckedAt:  time.Now(),
+				LogStartOffset: tt.logStartOffset,
+			}
+			if err := db.UpsertComponentStatus(status); err != nil {
+				t.Fatalf("Failed to insert component status: %v", err)
+			}
+
+			check := &database.HealthCheck{
+				ComponentName:   "test-log-component",
+				Type:            "log",
+				IntervalSeconds: 30,
+				TimeoutSeconds:  10,
+				Retries:         3,
+				Pattern:         tt.pattern,
+				ErrorPattern:    tt.errorPattern,
+			}
+			if err := db.UpsertHealthCheck(check); err != nil {
+				t.Fatalf("Failed to insert health check: %v", err)
+			}
+
+			checker := NewChecker(db, func(pid int) bool { return true })
+			checker.SetLogReader(func(name string, offset int64) (string, int64) {
+				if offset >= int64(len(tt.output)) {
+					return "", offset
+				}
+				return tt.output[offset:], int64(len(tt.output))
+			})
+
+			err := checker.RunHealthCheck(context.Background(), "test-log-component")
+
+			if tt.shouldFail && err == nil {
+				t.Error("Expected log health check to fail, but it succeeded")
+			}
+
+			if !tt.shouldFail && err != nil {
+				t.Errorf("Expected log health check to succeed, but it failed: %v", err)
+			}
+
+			updatedCheck, err := db.GetHealthCheck("test-log-component")
+			if err != nil {
+				t.Fatalf("Failed to get updated health check: %v", err)
+			}
+
+			if updatedCheck.LastResult != tt.expectedResult {
+				t.Errorf("Expected LastResult '%s', got '%s'", tt.expectedResult, updatedCheck.LastResult)
+			}
+
+			if updatedCheck.LogOffset != int64(len(tt.output)) {
+				t.Errorf("Expected LogOffset %d, got %d", len(tt.output), updatedCheck.LogOffset)
+			}
+		})
+	}
+}
+
 func TestConsecutiveFailures(t *testing.T) {
 	db, cleanup := setupTestDB(t)
 	defer cleanup()
@@ -510,10 +897,176 @@ func TestShouldRunCheck(t *testing.T) {
 				LastCheckAt:     tt.lastCheckAt,
 			}
 
-			result := checker.shouldRunCheck(check)
+			result := checker.shouldRunCheck(check, nil)
 			if result != tt.shouldRun {
 				t.Errorf("Expected shouldRunCheck to be %v, got %v", tt.shouldRun, result)
 			}
 		})
 	}
 }
+
+func TestSuccessRate(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	checker := NewChecker(db, func(pid int) bool { return true })
+
+	if rate, samples := checker.SuccessRate("test-rate", time.Now().Add(-time.Hour), time.Now()); rate != 0 || samples != 0 {
+		t.Errorf("Expected no samples for an unchecked component, got rate %v over %d", rate, samples)
+	}
+
+	for _, success := range []bool{true, true, true, false} {
+		checker.recordResult("test-rate", success)
+	}
+	boundary := time.Now()
+	time.Sleep(time.Millisecond)
+	for _, success := range []bool{false, false} {
+		checker.recordResult("test-rate", success)
+	}
+
+	rate, samples := checker.SuccessRate("test-rate", boundary.Add(-time.Hour), boundary)
+	if samples != 4 || rate != 0.75 {
+		t.Errorf("Expected rate 0.75 over 4 checks before the boundary, got %v over %d", rate, samples)
+	}
+
+	rate, samples = checker.SuccessRate("test-rate", boundary, time.Now().Add(time.Second))
+	if samples != 2 || rate != 0 {
+		t.Errorf("Expected rate 0 over 2 checks after the boundary, got %v over %d", rate, samples)
+	}
+}
+
+func TestStartPeriodSuppressesFailures(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	tests := []struct {
+		name         string
+		startedAgo   time.Duration
+		startPeriod  int
+		wantFailures int
+	}{
+		{name: "Within start period", startedAgo: 10 * time.Second, startPeriod: 60, wantFailures: 0},
+		{name: "After start period", startedAgo: 2 * time.Minute, startPeriod: 60, wantFailures: 3},
+		{name: "No start period", startedAgo: 10 * time.Second, startPeriod: 0, wantFailures: 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name := "test-start-" + strings.ReplaceAll(strings.ToLower(tt.name), " ", "-")
+
+			if err := db.UpsertComponent(&database.Component{Name: name, Type: "program", Hash: "h"}); err != nil {
+				t.Fatalf("Failed to insert component: %v", err)
+			}
+
+			startedAt := time.Now().Add(-tt.startedAgo)
+			status := &database.ComponentStatus{ComponentName: name, Status: "running", PID: 1234, LastStartedAt: &startedAt, LastCheckedAt: time.Now()}
+			if err := db.UpsertComponentStatus(status); err != nil {
+				t.Fatalf("Failed to insert component status: %v", err)
+			}
+
+			check := &database.HealthCheck{ComponentName: name, Type: "process", IntervalSeconds: 30, Retries: 3, StartPeriodSeconds: tt.startPeriod}
+			if err := db.UpsertHealthCheck(check); err != nil {
+				t.Fatalf("Failed to insert health check: %v", err)
+			}
+
+			checker := NewChecker(db, func(pid int) bool { return false })
+			for i := 0; i < 3; i++ {
+				checker.RunHealthCheck(context.Background(), name)
+			}
+
+			updated, err := db.GetHealthCheck(name)
+			if err != nil {
+				t.Fatalf("Failed to get health check: %v", err)
+			}
+
+			if updated.ConsecutiveFailures != tt.wantFailures {
+				t.Errorf("Expected %d consecutive failures, got %d", tt.wantFailures, updated.ConsecutiveFailures)
+			}
+
+			if tt.wantFailures == 0 && updated.LastResult != "pending" {
+				t.Errorf("Expected failures in the start period to be pending, got %q", updated.LastResult)
+			}
+
+			failed, err := checker.GetFailedComponents()
+			if err != nil {
+				t.Fatalf("Failed to get failed components: %v", err)
+			}
+
+			reported := false
+			for _, f := range failed {
+				reported = reported || f.ComponentName == name
+			}
+			if reported != (tt.wantFailures >= 3) {
+				t.Errorf("Expected failed component reported = %v, got %v", tt.wantFailures >= 3, reported)
+			}
+		})
+	}
+}
+
+func TestGetFailedComponentsSkipsStartPeriod(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	// Failures left over from the previous process must not restart the
+	// new one while it boots
+	if err := db.UpsertComponent(&database.Component{Name: "restarted", Type: "program", Hash: "h"}); err != nil {
+		t.Fatalf("Failed to insert component: %v", err)
+	}
+
+	startedAt := time.Now()
+	if err := db.UpsertComponentStatus(&database.ComponentStatus{ComponentName: "restarted", Status: "running", LastStartedAt: &startedAt, LastCheckedAt: startedAt}); err != nil {
+		t.Fatalf("Failed to insert component status: %v", err)
+	}
+
+	check := &database.HealthCheck{ComponentName: "restarted", Type: "process", Retries: 3, ConsecutiveFailures: 5, StartPeriodSeconds: 60}
+	if err := db.UpsertHealthCheck(check); err != nil {
+		t.Fatalf("Failed to insert health check: %v", err)
+	}
+
+	failed, err := NewChecker(db, nil).GetFailedComponents()
+	if err != nil {
+		t.Fatalf("Failed to get failed components: %v", err)
+	}
+	if len(failed) != 0 {
+		t.Errorf("Expected no failed components during the start period, got %d", len(failed))
+	}
+}
+
+func TestCheckJitterSpreadsComponents(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	checker := NewChecker(db, nil)
+	interval := 30 * time.Second
+
+	for _, name := range []string{"api", "worker"} {
+		jitter := checker.checkJitter(name, interval)
+		if jitter < -3*time.Second || jitter > 3*time.Second {
+			t.Errorf("Expected jitter for %s within 10%% of the interval, got %s", name, jitter)
+		}
+		if again := checker.checkJitter(name, interval); again != jitter {
+			t.Errorf("Expected stable jitter for %s, got %s then %s", name, jitter, again)
+		}
+	}
+
+	// Both components were last checked at the same time; reconciling every
+	// second around the interval, there must be ticks where only one is due
+	lastCheck := time.Now()
+	apart := 0
+	for elapsed := 26 * time.Second; elapsed <= 34*time.Second; elapsed += time.Second {
+		checkedAt := lastCheck.Add(-elapsed)
+		api := checker.shouldRunCheck(&database.HealthCheck{ComponentName: "api", IntervalSeconds: 30, LastCheckAt: &checkedAt}, nil)
+		worker := checker.shouldRunCheck(&database.HealthCheck{ComponentName: "worker", IntervalSeconds: 30, LastCheckAt: &checkedAt}, nil)
+		if api != worker {
+			apart++
+		}
+	}
+	if apart == 0 {
+		t.Error("Expected components with the same interval not to always be due on the same tick")
+	}
+
+	checker.SetJitter(0)
+	if jitter := checker.checkJitter("api", interval); jitter != 0 {
+		t.Errorf("Expected no jitter when disabled, got %s", jitter)
+	}
+}
@@ -0,0 +1,290 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/metorial/fleet/cosmos/internal/agent"
+	"github.com/metorial/fleet/cosmos/internal/agent/database"
+	agentgrpc "github.com/metorial/fleet/cosmos/internal/agent/grpc"
+	"github.com/metorial/fleet/cosmos/internal/agent/health"
+	"github.com/metorial/fleet/cosmos/internal/agent/reconciler"
+	log "github.com/sirupsen/logrus"
+)
+
+// Server exposes agent metrics in the Prometheus text format on /metrics and
+// a small status page on /
+type Server struct {
+	db            *database.AgentDB
+	healthChecker *health.Checker
+	reconciler    *reconciler.Reconciler
+	grpcClient    *agentgrpc.Client
+	addr          string
+	server        *http.Server
+}
+
+type ServerConfig struct {
+	DB            *database.AgentDB
+	HealthChecker *health.Checker
+	Reconciler    *reconciler.Reconciler
+	GRPCClient    *agentgrpc.Client
+	BindAddr      string
+	Port          string
+}
+
+func NewServer(config *ServerConfig) *Server {
+	bindAddr := config.BindAddr
+	if bindAddr == "" {
+		bindAddr = "127.0.0.1"
+	}
+
+	return &Server{
+		db:            config.DB,
+		healthChecker: config.HealthChecker,
+		reconciler:    config.Reconciler,
+		grpcClient:    config.GRPCClient,
+		addr:          net.JoinHostPort(bindAddr, config.Port),
+	}
+}
+
+func (s *Server) Start() error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", s.handleMetrics)
+	mux.HandleFunc("/", s.handleStatus)
+
+	s.server = &http.Server{
+		Addr:         s.addr,
+		Handler:      mux,
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 10 * time.Second,
+	}
+
+	listener, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", s.addr, err)
+	}
+
+	go func() {
+		if err := s.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.WithError(err).Error("Metrics server error")
+		}
+	}()
+
+	return nil
+}
+
+func (s *Server) Stop() error {
+	if s.server == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	return s.server.Shutdown(ctx)
+}
+
+type componentSnapshot struct {
+	Name         string
+	Type         string
+	Status       string
+	PID          int
+	RestartCount int
+	HealthResult string
+	Checks       health.ResultCounts
+}
+
+func (s *Server) snapshot() ([]componentSnapshot, error) {
+	components, err := s.db.GetAllComponents()
+	if err != nil {
+		return nil, err
+	}
+
+	var counts map[string]health.ResultCounts
+	if s.healthChecker != nil {
+		counts = s.healthChecker.ResultCounts()
+	}
+
+	snapshots := make([]componentSnapshot, 0, len(components))
+	for _, comp := range components {
+		snap := componentSnapshot{
+			Name:   comp.Name,
+			Type:   comp.Type,
+			Checks: counts[comp.Name],
+		}
+
+		if status, err := s.db.GetComponentStatus(comp.Name); err == nil {
+			snap.Status = status.Status
+			snap.PID = status.PID
+			snap.RestartCount = status.RestartCount
+		}
+
+		if check, err := s.db.GetHealthCheck(comp.Name); err == nil && check != nil {
+			snap.HealthResult = check.LastResult
+		}
+
+		snapshots = append(snapshots, snap)
+	}
+
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].Name < snapshots[j].Name
+	})
+
+	return snapshots, nil
+}
+
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	components, err := s.snapshot()
+	if err != nil {
+		log.WithError(err).Warn("Failed to collect metrics")
+		http.Error(w, "failed to collect metrics", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	up, down := 0, 0
+	for _, comp := range components {
+		if comp.Status == "running" {
+			up++
+		} else {
+			down++
+		}
+	}
+
+	writeMetric(w, "cosmos_agent_info", "gauge", "Agent build information",
+		sample{labels: map[string]string{"version": agent.Version}, value: 1})
+
+	writeMetric(w, "cosmos_agent_components", "gauge", "Components by state",
+		sample{labels: map[string]string{"state": "up"}, value: float64(up)},
+		sample{labels: map[string]string{"state": "down"}, value: float64(down)})
+
+	var upSamples, restartSamples, checkSamples []sample
+	for _, comp := range components {
+		labels := map[string]string{"component": comp.Name, "type": comp.Type}
+
+		value := 0.0
+		if comp.Status == "running" {
+			value = 1
+		}
+		upSamples = append(upSamples, sample{labels: labels, value: value})
+		restartSamples = append(restartSamples, sample{labels: labels, value: float64(comp.RestartCount)})
+		checkSamples = append(checkSamples,
+			sample{labels: map[string]string{"component": comp.Name, "result": "success"}, value: float64(comp.Checks.Success)},
+			sample{labels: map[string]string{"component": comp.Name, "result": "failure"}, value: float64(comp.Checks.Failure)})
+	}
+
+	writeMetric(w, "cosmos_agent_component_up", "gauge", "Whether the component is running", upSamples...)
+	// Deployments reset the restart count, so it is exported as a gauge
+	writeMetric(w, "cosmos_agent_component_restarts", "gauge", "Component restarts since the component was last deployed", restartSamples...)
+	writeMetric(w, "cosmos_agent_health_checks_total", "counter", "Health check results by component", checkSamples...)
+
+	if s.reconciler != nil {
+		stats := s.reconciler.Stats()
+		writeMetric(w, "cosmos_agent_reconcile_duration_seconds", "summary", "Reconcile loop duration",
+			sample{suffix: "_sum", value: stats.TotalSeconds},
+			sample{suffix: "_count", value: float64(stats.Count)})
+		writeMetric(w, "cosmos_agent_reconcile_last_duration_seconds", "gauge", "Duration of the most recent reconcile",
+			sample{value: stats.LastSeconds})
+	}
+
+	if s.grpcClient != nil {
+		outgoing, incoming := s.grpcClient.QueueDepth()
+		connected := 0.0
+		if s.grpcClient.IsConnected() {
+			connected = 1
+		}
+
+		writeMetric(w, "cosmos_agent_message_queue_depth", "gauge", "Messages waiting in the controller stream queues",
+			sample{labels: map[string]string{"direction": "outgoing"}, value: float64(outgoing)},
+			sample{labels: map[string]string{"direction": "incoming"}, value: float64(incoming)})
+		writeMetric(w, "cosmos_agent_controller_connected", "gauge", "Whether the agent is connected to the controller",
+			sample{value: connected})
+	}
+}
+
+type sample struct {
+	suffix string
+	labels map[string]string
+	value  float64
+}
+
+func writeMetric(w io.Writer, name, metricType, help string, samples ...sample) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, metricType)
+
+	for _, s := range samples {
+		fmt.Fprintf(w, "%s%s%s %g\n", name, s.suffix, formatLabels(s.labels), s.value)
+	}
+}
+
+func formatLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, len(keys))
+	for _, key := range keys {
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(labels[key])
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, key, value))
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var statusTemplate = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Cosmos Agent</title></head>
+<body>
+<h1>Cosmos Agent {{.Version}}</h1>
+<p>Controller connected: {{.Connected}}</p>
+<table border="1" cellpadding="4">
+<tr><th>Component</th><th>Type</th><th>Status</th><th>PID</th><th>Restarts</th><th>Health</th></tr>
+{{range .Components}}<tr><td>{{.Name}}</td><td>{{.Type}}</td><td>{{.Status}}</td><td>{{.PID}}</td><td>{{.RestartCount}}</td><td>{{.HealthResult}}</td></tr>
+{{end}}</table>
+<p><a href="/metrics">metrics</a></p>
+</body>
+</html>
+`))
+
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+
+	components, err := s.snapshot()
+	if err != nil {
+		log.WithError(err).Warn("Failed to collect component status")
+		http.Error(w, "failed to collect component status", http.StatusInternalServerError)
+		return
+	}
+
+	data := struct {
+		Version    string
+		Connected  bool
+		Components []componentSnapshot
+	}{
+		Version:    agent.Version,
+		Connected:  s.grpcClient != nil && s.grpcClient.IsConnected(),
+		Components: components,
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := statusTemplate.Execute(w, data); err != nil {
+		log.WithError(err).Warn("Failed to render status page")
+	}
+}
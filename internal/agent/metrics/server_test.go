@@ -0,0 +1,132 @@
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/metorial/fleet/cosmos/internal/agent/database"
+	"github.com/metorial/fleet/cosmos/internal/agent/health"
+)
+
+func newTestServer(t *testing.T) *Server {
+	db, err := database.NewAgentDB(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	seed := []struct {
+		component *database.Component
+		status    *database.ComponentStatus
+	}{
+		{&database.Component{Name: "web", Type: "program", Hash: "v1"}, &database.ComponentStatus{ComponentName: "web", Status: "running", PID: 100, RestartCount: 2}},
+		{&database.Component{Name: "setup", Type: "script", Hash: "v1"}, &database.ComponentStatus{ComponentName: "setup", Status: "stopped"}},
+	}
+	for _, s := range seed {
+		if err := db.UpsertComponent(s.component); err != nil {
+			t.Fatalf("Failed to create component: %v", err)
+		}
+		if err := db.UpsertComponentStatus(s.status); err != nil {
+			t.Fatalf("Failed to create status: %v", err)
+		}
+	}
+	if err := db.UpsertHealthCheck(&database.HealthCheck{ComponentName: "web", Type: "process"}); err != nil {
+		t.Fatalf("Failed to create health check: %v", err)
+	}
+
+	checker := health.NewChecker(db, func(pid int) bool { return pid == 100 })
+	for i := 0; i < 3; i++ {
+		if err := checker.RunHealthCheck(context.Background(), "web"); err != nil {
+			t.Fatalf("Health check failed: %v", err)
+		}
+	}
+
+	return NewServer(&ServerConfig{DB: db, HealthChecker: checker, Port: "0"})
+}
+
+func TestHandleMetrics(t *testing.T) {
+	s := newTestServer(t)
+
+	w := httptest.NewRecorder()
+	s.handleMetrics(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	body := w.Body.String()
+
+	tests := []struct {
+		name string
+		line string
+	}{
+		{"components up", `cosmos_agent_components{state="up"} 1`},
+		{"components down", `cosmos_agent_components{state="down"} 1`},
+		{"running component", `cosmos_agent_component_up{component="web",type="program"} 1`},
+		{"stopped component", `cosmos_agent_component_up{component="setup",type="script"} 0`},
+		{"restarts type", "# TYPE cosmos_agent_component_restarts gauge"},
+		{"restarts", `cosmos_agent_component_restarts{component="web",type="program"} 2`},
+		{"passed checks", `cosmos_agent_health_checks_total{component="web",result="success"} 3`},
+		{"failed checks", `cosmos_agent_health_checks_total{component="web",result="failure"} 0`},
+		{"components without checks", `cosmos_agent_health_checks_total{component="setup",result="success"} 0`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if !strings.Contains(body, tt.line+"\n") {
+				t.Errorf("Expected %q in metrics:\n%s", tt.line, body)
+			}
+		})
+	}
+
+	// Only the collectors that were configured are reported
+	for _, name := range []string{"cosmos_agent_reconcile_duration_seconds", "cosmos_agent_controller_connected"} {
+		if strings.Contains(body, name) {
+			t.Errorf("Expected no %s without its source", name)
+		}
+	}
+}
+
+func TestFormatLabels(t *testing.T) {
+	tests := []struct {
+		name   string
+		labels map[string]string
+		want   string
+	}{
+		{"none", nil, ""},
+		{"sorted", map[string]string{"type": "program", "component": "web"}, `{component="web",type="program"}`},
+		{"escaped", map[string]string{"component": "a\"b\\c\nd"}, `{component="a\"b\\c\nd"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := formatLabels(tt.labels); got != tt.want {
+				t.Errorf("Expected %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestHandleStatus(t *testing.T) {
+	s := newTestServer(t)
+
+	w := httptest.NewRecorder()
+	s.handleStatus(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", w.Code)
+	}
+	body := w.Body.String()
+	if !strings.Contains(body, "<td>web</td><td>program</td><td>running</td><td>100</td><td>2</td><td>success</td>") {
+		t.Errorf("Expected a row for web, got:\n%s", body)
+	}
+	if !strings.Contains(body, "Controller connected: false") {
+		t.Errorf("Expected the agent to be reported as disconnected, got:\n%s", body)
+	}
+
+	w = httptest.NewRecorder()
+	s.handleStatus(w, httptest.NewRequest(http.MethodGet, "/favicon.ico", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for other paths, got %d", w.Code)
+	}
+}
@@ -0,0 +1,113 @@
+package reconciler
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/metorial/fleet/cosmos/internal/agent/database"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultCanaryWindow         = 5 * time.Minute
+	defaultCanaryMaxDegradation = 20
+	defaultCanaryMinSamples     = 3
+)
+
+// runCanaryAnalysis watches an updated component for the canary window and
+// compares its health check success rate with the window before the update.
+// If the rate dropped by more than the allowed points, the previous version
+// is redeployed. The decision is reported to the controller either way.
+func (r *Reconciler) runCanaryAnalysis(previous *database.Component, hash string, canary *database.CanaryConfig, updatedAt time.Time) {
+	if r.healthChecker == nil {
+		return
+	}
+
+	name := previous.Name
+
+	window := defaultCanaryWindow
+	if canary.WindowSeconds > 0 {
+		window = time.Duration(canary.WindowSeconds) * time.Second
+	}
+	maxDegradation := canary.MaxDegradationPercent
+	if maxDegradation <= 0 {
+		maxDegradation = defaultCanaryMaxDegradation
+	}
+	minSamples := canary.MinSamples
+	if minSamples <= 0 {
+		minSamples = defaultCanaryMinSamples
+	}
+
+	baseline, baselineSamples := r.healthChecker.SuccessRate(name, updatedAt.Add(-window), updatedAt)
+	if baselineSamples == 0 {
+		// Without history for the old version, any failure counts against
+		// the new one
+		baseline = 1
+	}
+
+	log.WithFields(log.Fields{
+		"component":        name,
+		"window":           window,
+		"baseline":         baseline,
+		"baseline_samples": baselineSamples,
+	}).Info("Starting canary analysis")
+
+	select {
+	case <-time.After(time.Until(updatedAt.Add(window))):
+	case <-r.ctx.Done():
+		return
+	}
+
+	current, err := r.db.GetComponent(name)
+	if err != nil || current.Hash != hash {
+		log.WithField("component", name).Info("Component changed during canary analysis, skipping decision")
+		return
+	}
+
+	rate, samples := r.healthChecker.SuccessRate(name, updatedAt, updatedAt.Add(window))
+	if samples < minSamples {
+		r.reportCanary(name, "inconclusive", fmt.Sprintf(
+			"Canary analysis inconclusive: %d health checks in %s, need %d", samples, window, minSamples))
+		return
+	}
+
+	degradation := (baseline - rate) * 100
+	if degradation <= float64(maxDegradation) {
+		r.reportCanary(name, "passed", fmt.Sprintf(
+			"Canary analysis passed: success rate %.0f%% (baseline %.0f%%)", rate*100, baseline*100))
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"component":   name,
+		"rate":        rate,
+		"baseline":    baseline,
+		"degradation": degradation,
+	}).Warn("Canary analysis failed, rolling back")
+
+	if _, err := r.deploy(previous); err != nil {
+		r.reportCanary(name, "failure", fmt.Sprintf(
+			"Canary analysis failed (success rate %.0f%%, baseline %.0f%%) and rollback failed: %v", rate*100, baseline*100, err))
+		return
+	}
+
+	r.grpcClient.SendComponentStatus(name)
+	r.reportCanary(name, "rolled_back", fmt.Sprintf(
+		"Canary analysis failed: success rate %.0f%% vs baseline %.0f%%, rolled back to %s", rate*100, baseline*100, previous.Hash))
+}
+
+func (r *Reconciler) reportCanary(componentName, result, message string) {
+	log.WithFields(log.Fields{
+		"component": componentName,
+		"result":    result,
+	}).Info(message)
+
+	r.grpcClient.SendDeploymentResult(componentName, "canary", result, message)
+
+	r.db.LogDeployment(&database.DeploymentLog{
+		ComponentName: componentName,
+		Operation:     "canary",
+		Status:        result,
+		Message:       message,
+	})
+}
@@ -0,0 +1,58 @@
+package reconciler
+
+import "sync"
+
+// componentQueues runs work on one worker per component. A long deployment
+// of one component doesn't hold up messages for the others, while messages
+// for the same component still run one at a time in the order they arrived.
+// Workers exit once their queue drains, so idle components cost nothing.
+type componentQueues struct {
+	mu      sync.Mutex
+	pending map[string][]func()
+	wg      sync.WaitGroup
+}
+
+func newComponentQueues() *componentQueues {
+	return &componentQueues{
+		pending: make(map[string][]func()),
+	}
+}
+
+// enqueue schedules fn after any work already queued for the component
+func (q *componentQueues) enqueue(componentName string, fn func()) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	queue, running := q.pending[componentName]
+	q.pending[componentName] = append(queue, fn)
+	if running {
+		return
+	}
+
+	q.wg.Add(1)
+	go q.work(componentName)
+}
+
+func (q *componentQueues) work(componentName string) {
+	defer q.wg.Done()
+
+	for {
+		q.mu.Lock()
+		queue := q.pending[componentName]
+		if len(queue) == 0 {
+			delete(q.pending, componentName)
+			q.mu.Unlock()
+			return
+		}
+		fn := queue[0]
+		q.pending[componentName] = queue[1:]
+		q.mu.Unlock()
+
+		fn()
+	}
+}
+
+// wait blocks until every queued piece of work has finished
+func (q *componentQueues) wait() {
+	q.wg.Wait()
+}
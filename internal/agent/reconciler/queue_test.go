@@ -0,0 +1,51 @@
+package reconciler
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestComponentQueuesPreserveOrderPerComponent(t *testing.T) {
+	q := newComponentQueues()
+
+	var mu sync.Mutex
+	var order []int
+
+	for i := 0; i < 50; i++ {
+		q.enqueue("web", func() {
+			mu.Lock()
+			order = append(order, i)
+			mu.Unlock()
+		})
+	}
+	q.wait()
+
+	if len(order) != 50 {
+		t.Fatalf("Expected 50 messages handled, got %d", len(order))
+	}
+	for i, got := range order {
+		if got != i {
+			t.Fatalf("Expected messages in arrival order, got %v", order)
+		}
+	}
+}
+
+func TestComponentQueuesDoNotBlockOtherComponents(t *testing.T) {
+	q := newComponentQueues()
+
+	release := make(chan struct{})
+	done := make(chan struct{})
+
+	q.enqueue("slow", func() { <-release })
+	q.enqueue("fast", func() { close(done) })
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Message for another component was blocked by a slow one")
+	}
+
+	close(release)
+	q.wait()
+}
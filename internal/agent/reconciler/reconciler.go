@@ -25,10 +25,16 @@ type Reconciler struct {
 	interval          time.Duration
 	heartbeatInterval time.Duration
 	logStreamInterval time.Duration
+	restartPolicy     RestartPolicy
 
 	logOffsets map[string]int64
 	logMu      sync.RWMutex
 
+	statsMu sync.Mutex
+	stats   ReconcileStats
+
+	queues *componentQueues
+
 	ctx    context.Context
 	cancel context.CancelFunc
 }
@@ -40,6 +46,7 @@ type ReconcilerConfig struct {
 	GRPCClient        *agentgrpc.Client
 	ReconcileInterval time.Duration
 	HeartbeatInterval time.Duration
+	RestartPolicy     RestartPolicy
 }
 
 func NewReconciler(config *ReconcilerConfig) *Reconciler {
@@ -65,6 +72,8 @@ func NewReconciler(config *ReconcilerConfig) *Reconciler {
 		interval:          interval,
 		heartbeatInterval: heartbeatInterval,
 		logStreamInterval: logStreamInterval,
+		restartPolicy:     config.RestartPolicy.withDefaults(),
+		queues:            newComponentQueues(),
 		logOffsets:        make(map[string]int64),
 		ctx:               ctx,
 		cancel:            cancel,
@@ -86,6 +95,11 @@ func (r *Reconciler) ReportProgress(componentName, status, message string) {
 	)
 }
 
+// ReportPhase implements the ProgressReporter interface
+func (r *Reconciler) ReportPhase(componentName, phase string, percent int) {
+	r.grpcClient.SendDeploymentProgress(componentName, phase, percent)
+}
+
 func (r *Reconciler) Start() error {
 	log.WithFields(log.Fields{
 		"reconcile_interval":  r.interval,
@@ -225,14 +239,35 @@ func (r *Reconciler) readLogChunk(filePath string, offset int64) (string, int64,
 	return "", offset, nil
 }
 
+// ReconcileStats summarizes reconcile loop timings since the agent started
+type ReconcileStats struct {
+	Count        int64
+	TotalSeconds float64
+	LastSeconds  float64
+}
+
+func (r *Reconciler) Stats() ReconcileStats {
+	r.statsMu.Lock()
+	defer r.statsMu.Unlock()
+	return r.stats
+}
+
 func (r *Reconciler) reconcile() {
 	log.Debug("Running reconciliation")
+	start := time.Now()
 
 	r.checkComponentHealth()
 
 	r.restartFailedComponents()
 
 	r.runHealthChecks()
+
+	elapsed := time.Since(start).Seconds()
+	r.statsMu.Lock()
+	r.stats.Count++
+	r.stats.TotalSeconds += elapsed
+	r.stats.LastSeconds = elapsed
+	r.statsMu.Unlock()
 }
 
 func (r *Reconciler) checkComponentHealth() {
@@ -288,10 +323,37 @@ func (r *Reconciler) restartFailedComponents() {
 			continue
 		}
 
+		if status.StoppedByController {
+			continue
+		}
+
 		if status.Status == "stopped" || status.Status == "failed" {
+			now := time.Now()
+			restarts := r.recentRestarts(status, now)
+			if restarts >= r.restartPolicy.MaxRestarts {
+				r.markCrashed(status, restarts)
+				continue
+			}
+
+			if status.LastRestartAt != nil {
+				if next := status.LastRestartAt.Add(r.restartPolicy.backoff(restarts)); now.Before(next) {
+					log.WithFields(log.Fields{
+						"component":  comp.Name,
+						"restarts":   restarts,
+						"next_after": next,
+					}).Debug("Waiting for restart backoff")
+					continue
+				}
+			}
+
 			log.WithField("component", comp.Name).Info("Restarting failed component")
 
-			if err := r.componentMgr.RestartComponent(comp.Name); err != nil {
+			reason := status.Message
+			if reason == "" {
+				reason = fmt.Sprintf("Component %s", status.Status)
+			}
+
+			if err := r.componentMgr.RestartComponent(comp.Name, reason); err != nil {
 				log.WithError(err).WithField("component", comp.Name).Error("Failed to restart component")
 
 				r.grpcClient.SendDeploymentResult(
@@ -335,12 +397,16 @@ func (r *Reconciler) runHealthChecks() {
 			"consecutive_failures": check.ConsecutiveFailures,
 		}).Warn("Component failing health checks")
 
-		r.grpcClient.SendHealthCheckResult(
-			check.ComponentName,
-			check.Type,
-			"failure",
-			fmt.Sprintf("Failed %d consecutive health checks", check.ConsecutiveFailures),
-		)
+		message := fmt.Sprintf("Failed %d consecutive health checks", check.ConsecutiveFailures)
+		if check.LastMessage != "" {
+			message += ": " + check.LastMessage
+		}
+
+		r.grpcClient.SendHealthCheckResult(check.ComponentName, check.Type, "failure", message)
+
+		if check.RestartOnUnhealthy {
+			r.restartUnhealthyComponent(check, message)
+		}
 	}
 }
 
@@ -366,14 +432,23 @@ func (r *Reconciler) processControllerMessages() {
 	}
 }
 
+// handleControllerMessage dispatches component messages to that component's
+// queue so they run in order without blocking other components. Messages
+// that aren't about a component are handled inline.
 func (r *Reconciler) handleControllerMessage(msg *pb.ControllerMessage) {
 	switch m := msg.Message.(type) {
 	case *pb.ControllerMessage_Deployment:
-		r.handleDeployment(m.Deployment)
+		r.queues.enqueue(m.Deployment.ComponentName, func() { r.handleDeployment(m.Deployment) })
 	case *pb.ControllerMessage_Removal:
-		r.handleRemoval(m.Removal)
+		r.queues.enqueue(m.Removal.ComponentName, func() { r.handleRemoval(m.Removal) })
 	case *pb.ControllerMessage_HealthConfig:
-		r.handleHealthConfig(m.HealthConfig)
+		r.queues.enqueue(m.HealthConfig.ComponentName, func() { r.handleHealthConfig(m.HealthConfig) })
+	case *pb.ControllerMessage_Control:
+		r.queues.enqueue(m.Control.ComponentName, func() { r.handleControl(m.Control) })
+	case *pb.ControllerMessage_LogLevel:
+		r.handleLogLevel(m.LogLevel)
+	case *pb.ControllerMessage_LogRequest:
+		r.handleLogRequest(m.LogRequest)
 	case *pb.ControllerMessage_Ack:
 		log.WithField("message", m.Ack.Message).Debug("Received acknowledgment")
 	default:
@@ -383,27 +458,30 @@ func (r *Reconciler) handleControllerMessage(msg *pb.ControllerMessage) {
 
 func (r *Reconciler) handleDeployment(deployment *pb.ComponentDeployment) {
 	log.WithFields(log.Fields{
-		"component": deployment.ComponentName,
-		"type":      deployment.ComponentType,
-		"hash":      deployment.Hash,
+		"component":     deployment.ComponentName,
+		"type":          deployment.ComponentType,
+		"hash":          deployment.Hash,
+		"deployment_id": deployment.DeploymentId,
+		"request_id":    deployment.RequestId,
 	}).Info("Received deployment request")
 
-	// Send "received" status
-	r.grpcClient.SendDeploymentResult(
-		deployment.ComponentName,
-		"deploy",
-		"received",
-		"Deployment request received by agent",
-	)
-
 	comp := &database.Component{
 		Name:               deployment.ComponentName,
 		Type:               deployment.ComponentType,
 		Hash:               deployment.Hash,
 		ContentURL:         deployment.ContentUrl,
 		ContentURLEncoding: deployment.ContentUrlEncoding,
+		Entrypoint:         deployment.Entrypoint,
+		SignatureURL:       deployment.SignatureUrl,
+		PublicKey:          deployment.PublicKey,
 		Content:            deployment.Content,
 		Managed:            deployment.Managed,
+		MemoryLimit:        deployment.MemoryLimit,
+		CPULimit:           deployment.CpuLimit,
+		MaxOpenFiles:       deployment.MaxOpenFiles,
+		RunAsUser:          deployment.RunAsUser,
+		RunAsGroup:         deployment.RunAsGroup,
+		WorkingDir:         deployment.WorkingDir,
 	}
 
 	if len(deployment.Env) > 0 {
@@ -414,8 +492,64 @@ func (r *Reconciler) handleDeployment(deployment *pb.ComponentDeployment) {
 		r.db.SetArgsSlice(comp, deployment.Args)
 	}
 
-	var err error
-	var operation string
+	if len(deployment.ContentUrlHeaders) > 0 {
+		r.db.SetContentURLHeaders(comp, deployment.ContentUrlHeaders)
+	}
+
+	if len(deployment.WaitFor) > 0 {
+		waitFor := make([]database.WaitForEndpoint, 0, len(deployment.WaitFor))
+		for _, wait := range deployment.WaitFor {
+			waitFor = append(waitFor, database.WaitForEndpoint{
+				Type:           wait.Type,
+				Endpoint:       wait.Endpoint,
+				TimeoutSeconds: int(wait.TimeoutSeconds),
+			})
+		}
+		r.db.SetWaitFor(comp, waitFor)
+	}
+
+	if len(deployment.ContentMirrors) > 0 {
+		mirrors := make([]database.ContentMirror, 0, len(deployment.ContentMirrors))
+		for _, mirror := range deployment.ContentMirrors {
+			mirrors = append(mirrors, database.ContentMirror{
+				URL:    mirror.Url,
+				Weight: int(mirror.Weight),
+			})
+		}
+		r.db.SetContentMirrors(comp, mirrors)
+	}
+
+	var canary *database.CanaryConfig
+	if deployment.Canary != nil {
+		canary = &database.CanaryConfig{
+			WindowSeconds:         int(deployment.Canary.WindowSeconds),
+			MaxDegradationPercent: int(deployment.Canary.MaxDegradationPercent),
+			MinSamples:            int(deployment.Canary.MinSamples),
+		}
+		r.db.SetCanary(comp, canary)
+	}
+
+	if deployment.Resync {
+		if existing, err := r.db.GetComponent(deployment.ComponentName); err == nil && database.SameSpec(existing, comp) {
+			// Already converged; report the actual state instead
+			r.grpcClient.SendComponentStatus(deployment.ComponentName)
+			return
+		}
+		log.WithField("component", deployment.ComponentName).Info("Component missing or outdated, deploying desired state")
+	}
+
+	// Send "received" status
+	r.grpcClient.SendDeploymentResult(
+		deployment.ComponentName,
+		"deploy",
+		"received",
+		"Deployment request received by agent",
+	)
+
+	// Keep the version being replaced so canary analysis can roll back to it
+	previous, _ := r.db.GetComponent(deployment.ComponentName)
+
+	r.resetRestartState(deployment.ComponentName)
 
 	// Send "started" status
 	r.grpcClient.SendDeploymentResult(
@@ -425,17 +559,7 @@ func (r *Reconciler) handleDeployment(deployment *pb.ComponentDeployment) {
 		"Starting deployment execution",
 	)
 
-	switch deployment.ComponentType {
-	case "program":
-		operation = "deploy-program"
-		err = r.componentMgr.DeployProgram(comp)
-	case "script":
-		operation = "deploy-script"
-		err = r.componentMgr.DeployScript(comp)
-	default:
-		operation = "deploy"
-		err = fmt.Errorf("unsupported component type: %s", deployment.ComponentType)
-	}
+	operation, err := r.deploy(comp)
 
 	if err != nil {
 		log.WithError(err).WithField("component", deployment.ComponentName).Error("Deployment failed")
@@ -476,6 +600,23 @@ func (r *Reconciler) handleDeployment(deployment *pb.ComponentDeployment) {
 		if deployment.HealthCheck != nil {
 			r.handleHealthConfig(deployment.HealthCheck)
 		}
+
+		if canary != nil && previous != nil && previous.Hash != comp.Hash {
+			go r.runCanaryAnalysis(previous, comp.Hash, canary, time.Now())
+		}
+	}
+}
+
+// deploy installs and starts a component, returning the operation name used
+// in deployment results
+func (r *Reconciler) deploy(comp *database.Component) (string, error) {
+	switch comp.Type {
+	case "program":
+		return "deploy-program", r.componentMgr.DeployProgram(comp)
+	case "script":
+		return "deploy-script", r.componentMgr.DeployScript(comp)
+	default:
+		return "deploy", fmt.Errorf("unsupported component type: %s", comp.Type)
 	}
 }
 
@@ -526,6 +667,7 @@ func (r *Reconciler) handleHealthConfig(config *pb.HealthCheckConfig) {
 		"component": config.ComponentName,
 		"type":      config.Type,
 		"endpoint":  config.Endpoint,
+		"port":      config.Port,
 	}).Debug("Updating health check configuration")
 
 	check := &database.HealthCheck{
@@ -535,9 +677,142 @@ func (r *Reconciler) handleHealthConfig(config *pb.HealthCheckConfig) {
 		IntervalSeconds: int(config.IntervalSeconds),
 		TimeoutSeconds:  int(config.TimeoutSeconds),
 		Retries:         int(config.Retries),
+		Pattern:         config.Pattern,
+		ErrorPattern:    config.ErrorPattern,
+		Port:            int(config.Port),
+		Scheme:          config.Scheme,
+		Path:            config.Path,
+		TLS:             config.Tls,
+		Method:          config.Method,
+		ExpectedBody:    config.ExpectedBody,
+
+		RestartOnUnhealthy: config.RestartOnUnhealthy,
+		StartPeriodSeconds: int(config.StartPeriodSeconds),
+	}
+
+	// The same configuration comes again with every deployment and resync.
+	// Keep what the checker recorded so the log isn't scanned from the start.
+	if existing, err := r.db.GetHealthCheck(config.ComponentName); err == nil && existing != nil {
+		check.LogOffset = existing.LogOffset
+		if existing.Pattern == check.Pattern {
+			check.LogMatchedAt = existing.LogMatchedAt
+		}
+		check.LastCheckAt = existing.LastCheckAt
+		check.LastResult = existing.LastResult
+		check.LastMessage = existing.LastMessage
+		check.ConsecutiveFailures = existing.ConsecutiveFailures
+	}
+
+	if len(config.Headers) > 0 {
+		r.db.SetHealthCheckHeaders(check, config.Headers)
+	}
+
+	if len(config.ExpectedStatus) > 0 {
+		codes := make([]int, len(config.ExpectedStatus))
+		for i, code := range config.ExpectedStatus {
+			codes[i] = int(code)
+		}
+		r.db.SetExpectedStatus(check, codes)
 	}
 
 	if err := r.db.UpsertHealthCheck(check); err != nil {
 		log.WithError(err).Warn("Failed to update health check configuration")
 	}
 }
+
+func (r *Reconciler) handleLogLevel(change *pb.LogLevelChange) {
+	level, err := log.ParseLevel(change.Level)
+	if err != nil {
+		log.WithError(err).WithField("level", change.Level).Warn("Ignoring invalid log level from controller")
+		return
+	}
+
+	log.SetLevel(level)
+	log.WithField("level", level.String()).Info("Log level changed by controller")
+
+	if err := r.grpcClient.SendHeartbeat(); err != nil {
+		log.WithError(err).Debug("Failed to send heartbeat after log level change")
+	}
+}
+
+func (r *Reconciler) handleLogRequest(request *pb.LogRequest) {
+	logData, err := r.componentMgr.TailComponentLog(request.ComponentName, int(request.Lines))
+
+	errMsg := ""
+	if err != nil {
+		log.WithError(err).WithField("component", request.ComponentName).Warn("Failed to read log for controller")
+		errMsg = err.Error()
+	}
+
+	if err := r.grpcClient.SendLogResponse(request.RequestId, request.ComponentName, logData, errMsg); err != nil {
+		log.WithError(err).WithField("component", request.ComponentName).Warn("Failed to send log response")
+	}
+}
+
+// handleControl restarts, stops or starts a component on the controller's
+// request. A stopped component stays down until it is started again.
+func (r *Reconciler) handleControl(control *pb.ComponentControl) {
+	name := control.ComponentName
+	log.WithFields(log.Fields{
+		"component": name,
+		"action":    control.Action,
+	}).Info("Received component control")
+
+	var err error
+	message := ""
+	if _, lookupErr := r.db.GetComponent(name); lookupErr != nil {
+		err = fmt.Errorf("component not found: %w", lookupErr)
+	} else {
+		switch control.Action {
+		case "restart":
+			r.resetRestartState(name)
+			err = r.componentMgr.RestartComponent(name, "Restart requested by controller")
+			message = "Component restarted"
+		case "stop":
+			err = r.stopByController(name)
+			message = "Component stopped"
+		case "start":
+			r.resetRestartState(name)
+			err = r.componentMgr.StartComponent(name)
+			message = "Component started"
+		default:
+			err = fmt.Errorf("unknown action %q", control.Action)
+		}
+	}
+
+	result := "success"
+	if err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"component": name,
+			"action":    control.Action,
+		}).Error("Component control failed")
+		result = "failure"
+		message = err.Error()
+	}
+
+	r.grpcClient.SendControlResult(control.RequestId, name, control.Action, result, message)
+	r.grpcClient.SendComponentStatus(name)
+
+	r.db.LogDeployment(&database.DeploymentLog{
+		ComponentName: name,
+		Operation:     control.Action,
+		Status:        result,
+		Message:       message,
+	})
+}
+
+// stopByController marks the component before stopping it so neither the
+// exit monitor nor the restart loop brings it back
+func (r *Reconciler) stopByController(name string) error {
+	status, err := r.db.GetComponentStatus(name)
+	if err != nil {
+		return err
+	}
+
+	status.StoppedByController = true
+	if err := r.db.UpsertComponentStatus(status); err != nil {
+		return fmt.Errorf("failed to update status: %w", err)
+	}
+
+	return r.componentMgr.StopComponent(name)
+}
@@ -0,0 +1,59 @@
+package reconciler
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/metorial/fleet/cosmos/internal/agent/database"
+	"github.com/metorial/fleet/cosmos/internal/agent/health"
+	pb "github.com/metorial/fleet/cosmos/internal/proto"
+)
+
+func TestHealthConfigResendKeepsLogOffset(t *testing.T) {
+	db, err := database.NewAgentDB(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	defer db.Close()
+
+	startedAt := time.Now().Add(-time.Minute)
+	if err := db.UpsertComponentStatus(&database.ComponentStatus{ComponentName: "app", Status: "running", LastStartedAt: &startedAt}); err != nil {
+		t.Fatalf("Failed to insert component status: %v", err)
+	}
+
+	output := "FATAL: lost connection\nreconnected\n"
+	checker := health.NewChecker(db, func(pid int) bool { return true })
+	checker.SetLogReader(func(name string, offset int64) (string, int64) {
+		if offset >= int64(len(output)) {
+			return "", offset
+		}
+		return output[offset:], int64(len(output))
+	})
+
+	r := &Reconciler{db: db}
+	config := &pb.HealthCheckConfig{ComponentName: "app", Type: "log", ErrorPattern: "FATAL", IntervalSeconds: 30}
+
+	r.handleHealthConfig(config)
+	if err := checker.RunHealthCheck(context.Background(), "app"); err == nil {
+		t.Fatal("Expected the error line to fail the check")
+	}
+
+	// The controller sends the same configuration again, such as on resync
+	r.handleHealthConfig(config)
+
+	check, err := db.GetHealthCheck("app")
+	if err != nil {
+		t.Fatalf("Failed to get health check: %v", err)
+	}
+	if check.LogOffset != int64(len(output)) {
+		t.Errorf("Expected the log offset to stay at %d, got %d", len(output), check.LogOffset)
+	}
+	if check.ConsecutiveFailures != 1 {
+		t.Errorf("Expected the failure to be kept, got %d consecutive failures", check.ConsecutiveFailures)
+	}
+
+	if err := checker.RunHealthCheck(context.Background(), "app"); err != nil {
+		t.Errorf("Expected the error line not to be read again, got %v", err)
+	}
+}
@@ -0,0 +1,178 @@
+package reconciler
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/metorial/fleet/cosmos/internal/agent/database"
+	log "github.com/sirupsen/logrus"
+)
+
+// RestartPolicy controls how exited managed components are restarted. Each
+// restart waits BaseDelay doubled for every recent restart, up to MaxDelay.
+// A component restarted MaxRestarts times within Window is marked crashed
+// and left alone until a new deployment arrives.
+type RestartPolicy struct {
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	MaxRestarts int
+	Window      time.Duration
+}
+
+var defaultRestartPolicy = RestartPolicy{
+	BaseDelay:   5 * time.Second,
+	MaxDelay:    5 * time.Minute,
+	MaxRestarts: 5,
+	Window:      10 * time.Minute,
+}
+
+func (p RestartPolicy) withDefaults() RestartPolicy {
+	if p.BaseDelay <= 0 {
+		p.BaseDelay = defaultRestartPolicy.BaseDelay
+	}
+	if p.MaxDelay <= 0 {
+		p.MaxDelay = defaultRestartPolicy.MaxDelay
+	}
+	if p.MaxDelay < p.BaseDelay {
+		p.MaxDelay = p.BaseDelay
+	}
+	if p.MaxRestarts <= 0 {
+		p.MaxRestarts = defaultRestartPolicy.MaxRestarts
+	}
+	if p.Window <= 0 {
+		p.Window = defaultRestartPolicy.Window
+	}
+	return p
+}
+
+// backoff returns how long to wait after the last restart when the component
+// has already been restarted the given number of times
+func (p RestartPolicy) backoff(restarts int) time.Duration {
+	delay := p.BaseDelay
+	for i := 0; i < restarts && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, p.MaxDelay)
+}
+
+// recentRestarts counts restarts since the last deployment that happened
+// within the policy window. RestartCount is reset by deployments, and the
+// window lets a component that has been stable for a while start over.
+func (r *Reconciler) recentRestarts(status *database.ComponentStatus, now time.Time) int {
+	events, err := r.db.GetRestartHistory(status.ComponentName, r.restartPolicy.MaxRestarts)
+	if err != nil {
+		log.WithError(err).WithField("component", status.ComponentName).Warn("Failed to get restart history")
+		return status.RestartCount
+	}
+
+	recent := 0
+	for _, event := range events {
+		if event.Timestamp.After(now.Add(-r.restartPolicy.Window)) {
+			recent++
+		}
+	}
+	return min(recent, status.RestartCount)
+}
+
+// markCrashed stops auto-restarting a component stuck in a crash loop and
+// reports it to the controller
+func (r *Reconciler) markCrashed(status *database.ComponentStatus, restarts int) {
+	status.Status = "crashed"
+	status.Message = fmt.Sprintf("Restarted %d times within %s; not restarting until the next deployment", restarts, r.restartPolicy.Window)
+	status.LastCheckedAt = time.Now()
+	if err := r.db.UpsertComponentStatus(status); err != nil {
+		log.WithError(err).WithField("component", status.ComponentName).Warn("Failed to mark component crashed")
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"component": status.ComponentName,
+		"restarts":  restarts,
+		"window":    r.restartPolicy.Window,
+	}).Error("Component is crash looping, giving up on restarts")
+
+	r.grpcClient.SendComponentStatus(status.ComponentName)
+
+	r.db.LogDeployment(&database.DeploymentLog{
+		ComponentName: status.ComponentName,
+		Operation:     "restart",
+		Status:        "crashed",
+		Message:       status.Message,
+	})
+}
+
+// unhealthyRestartTarget returns the status of a component that should be
+// restarted for failing its health check: it must be managed, running and
+// not stopped by the controller
+func (r *Reconciler) unhealthyRestartTarget(name string) (*database.ComponentStatus, bool) {
+	comp, err := r.db.GetComponent(name)
+	if err != nil || !comp.Managed {
+		return nil, false
+	}
+
+	status, err := r.db.GetComponentStatus(name)
+	if err != nil || status.Status != "running" || status.StoppedByController {
+		return nil, false
+	}
+
+	return status, true
+}
+
+// restartUnhealthyComponent restarts a component whose process is alive but
+// keeps failing its health check. Restarts count towards the crash loop
+// limit like those of exited components.
+func (r *Reconciler) restartUnhealthyComponent(check *database.HealthCheck, reason string) {
+	status, ok := r.unhealthyRestartTarget(check.ComponentName)
+	if !ok {
+		return
+	}
+
+	if restarts := r.recentRestarts(status, time.Now()); restarts >= r.restartPolicy.MaxRestarts {
+		r.markCrashed(status, restarts)
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"component":            check.ComponentName,
+		"consecutive_failures": check.ConsecutiveFailures,
+	}).Warn("Restarting unhealthy component")
+
+	// Start counting again for the new process
+	if err := r.healthChecker.ResetFailureCount(check.ComponentName); err != nil {
+		log.WithError(err).WithField("component", check.ComponentName).Warn("Failed to reset health check failures")
+	}
+
+	r.db.LogDeployment(&database.DeploymentLog{
+		ComponentName: check.ComponentName,
+		Operation:     "restart",
+		Status:        "unhealthy",
+		Message:       reason,
+	})
+
+	if err := r.componentMgr.RestartComponent(check.ComponentName, reason); err != nil {
+		log.WithError(err).WithField("component", check.ComponentName).Error("Failed to restart unhealthy component")
+		r.grpcClient.SendDeploymentResult(check.ComponentName, "restart", "failure", fmt.Sprintf("Failed to restart unhealthy component: %v", err))
+		return
+	}
+
+	r.grpcClient.SendDeploymentResult(check.ComponentName, "restart", "success", "Restarted after failing health checks")
+}
+
+// resetRestartState clears the restart backoff and crash state of a
+// component when a new deployment arrives for it
+func (r *Reconciler) resetRestartState(name string) {
+	status, err := r.db.GetComponentStatus(name)
+	if err != nil || (status.RestartCount == 0 && status.Status != "crashed") {
+		return
+	}
+
+	status.RestartCount = 0
+	status.LastRestartAt = nil
+	if status.Status == "crashed" {
+		status.Status = "stopped"
+	}
+
+	if err := r.db.UpsertComponentStatus(status); err != nil {
+		log.WithError(err).WithField("component", name).Warn("Failed to reset restart state")
+	}
+}
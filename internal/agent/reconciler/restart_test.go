@@ -0,0 +1,96 @@
+package reconciler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/metorial/fleet/cosmos/internal/agent/database"
+)
+
+func TestRestartPolicyBackoff(t *testing.T) {
+	policy := RestartPolicy{BaseDelay: time.Second, MaxDelay: 10 * time.Second}.withDefaults()
+
+	tests := []struct {
+		restarts int
+		want     time.Duration
+	}{
+		{0, time.Second},
+		{1, 2 * time.Second},
+		{3, 8 * time.Second},
+		{4, 10 * time.Second},
+		{50, 10 * time.Second},
+	}
+
+	for _, tt := range tests {
+		if got := policy.backoff(tt.restarts); got != tt.want {
+			t.Errorf("backoff(%d) = %s, want %s", tt.restarts, got, tt.want)
+		}
+	}
+}
+
+func TestRecentRestarts(t *testing.T) {
+	db, err := database.NewAgentDB(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	defer db.Close()
+
+	now := time.Now()
+	for _, age := range []time.Duration{time.Hour, 3 * time.Minute, 2 * time.Minute, time.Minute} {
+		if err := db.RecordRestart(&database.RestartEvent{ComponentName: "app", Timestamp: now.Add(-age)}, 20); err != nil {
+			t.Fatalf("Failed to record restart: %v", err)
+		}
+	}
+
+	r := &Reconciler{db: db, restartPolicy: RestartPolicy{Window: 10 * time.Minute}.withDefaults()}
+
+	if got := r.recentRestarts(&database.ComponentStatus{ComponentName: "app", RestartCount: 4}, now); got != 3 {
+		t.Errorf("Expected 3 restarts within the window, got %d", got)
+	}
+
+	// A deployment resets RestartCount, so older restarts no longer count
+	if got := r.recentRestarts(&database.ComponentStatus{ComponentName: "app", RestartCount: 1}, now); got != 1 {
+		t.Errorf("Expected restarts before the last deployment to be ignored, got %d", got)
+	}
+}
+
+func TestUnhealthyRestartTarget(t *testing.T) {
+	db, err := database.NewAgentDB(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	defer db.Close()
+
+	components := []struct {
+		name    string
+		managed bool
+		status  database.ComponentStatus
+		want    bool
+	}{
+		{"healthy-process", true, database.ComponentStatus{Status: "running"}, true},
+		{"unmanaged", false, database.ComponentStatus{Status: "running"}, false},
+		{"exited", true, database.ComponentStatus{Status: "stopped"}, false},
+		{"stopped-by-controller", true, database.ComponentStatus{Status: "running", StoppedByController: true}, false},
+	}
+
+	for _, c := range components {
+		if err := db.UpsertComponent(&database.Component{Name: c.name, Type: "program", Hash: "h", Managed: c.managed}); err != nil {
+			t.Fatalf("Failed to store component: %v", err)
+		}
+		c.status.ComponentName = c.name
+		if err := db.UpsertComponentStatus(&c.status); err != nil {
+			t.Fatalf("Failed to store status: %v", err)
+		}
+	}
+
+	r := &Reconciler{db: db}
+	for _, c := range components {
+		if _, got := r.unhealthyRestartTarget(c.name); got != c.want {
+			t.Errorf("unhealthyRestartTarget(%q) = %v, want %v", c.name, got, c.want)
+		}
+	}
+
+	if _, ok := r.unhealthyRestartTarget("missing"); ok {
+		t.Error("Expected unknown component not to be restarted")
+	}
+}
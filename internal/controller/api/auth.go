@@ -0,0 +1,225 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/metorial/fleet/cosmos/internal/controller/database"
+	log "github.com/sirupsen/logrus"
+)
+
+// APIKeyStore looks up API keys by their hash
+type APIKeyStore interface {
+	GetAPIKeyByHash(hash string) (*database.APIKey, error)
+}
+
+// staticTokenName identifies requests authenticated with the static API token
+const staticTokenName = "api-token"
+
+type apiKeyNameKey struct{}
+
+// apiKeyName returns the name of the key the request authenticated with, or
+// "" when authentication is disabled
+func apiKeyName(r *http.Request) string {
+	name, _ := r.Context().Value(apiKeyNameKey{}).(string)
+	return name
+}
+
+// authMiddleware rejects requests without a valid bearer token when
+// authentication is enabled. The health check stays open for load balancers.
+func (s *Server) authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.authEnabled || r.Method == http.MethodOptions || r.URL.Path == "/api/v1/health" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		token, ok := bearerToken(r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="cosmos"`)
+			respondError(w, http.StatusUnauthorized, "Missing bearer token")
+			return
+		}
+
+		name, scope, err := s.tokenKey(token)
+		if err != nil {
+			requestLog(r).WithError(err).Error("Failed to look up API key")
+			respondError(w, http.StatusInternalServerError, "Failed to check credentials")
+			return
+		}
+		if scope == "" {
+			requestLog(r).WithField("path", r.URL.Path).Warn("Rejected request with invalid token")
+			w.Header().Set("WWW-Authenticate", `Bearer realm="cosmos", error="invalid_token"`)
+			respondError(w, http.StatusUnauthorized, "Invalid bearer token")
+			return
+		}
+
+		if scope != database.ScopeAdmin && requiresAdmin(r) {
+			requestLog(r).WithFields(log.Fields{
+				"method": r.Method,
+				"path":   r.URL.Path,
+				"scope":  scope,
+			}).Warn("Rejected request outside the key's scope")
+			respondError(w, http.StatusForbidden, "This API key is read-only")
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiKeyNameKey{}, name)))
+	})
+}
+
+// bearerToken returns the token of an "Authorization: Bearer" header
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
+
+// requiresAdmin reports whether a request needs an admin key: anything but a
+// read, and all key management
+func requiresAdmin(r *http.Request) bool {
+	if strings.HasPrefix(r.URL.Path, "/api/v1/api-keys") {
+		return true
+	}
+	return r.Method != http.MethodGet && r.Method != http.MethodHead
+}
+
+// tokenKey checks a token against the static token, which has the admin
+// scope, and the stored API keys. It returns the key's name and scope, or an
+// empty scope for an unknown token.
+func (s *Server) tokenKey(token string) (name, scope string, err error) {
+	if s.apiToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(s.apiToken)) == 1 {
+		return staticTokenName, database.ScopeAdmin, nil
+	}
+
+	if s.apiKeys == nil {
+		return "", "", nil
+	}
+
+	key, err := s.apiKeys.GetAPIKeyByHash(database.HashAPIKey(token))
+	if err != nil {
+		if errors.Is(err, database.ErrNotFound) {
+			return "", "", nil
+		}
+		return "", "", err
+	}
+	return key.Name, key.Scope, nil
+}
+
+type CreateAPIKeyRequest struct {
+	Name  string `json:"name"`
+	Scope string `json:"scope"`
+}
+
+// CreateAPIKeyResponse is the only time the key itself is returned
+type CreateAPIKeyResponse struct {
+	database.APIKey
+	Key string `json:"key"`
+}
+
+// newAPIKey returns a random key
+func newAPIKey() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return "cosmos_" + hex.EncodeToString(buf), nil
+}
+
+func (s *Server) handleCreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	var req CreateAPIKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, fmt.Sprintf("Invalid request body: %v", err))
+		return
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		respondError(w, http.StatusBadRequest, "name is required")
+		return
+	}
+	if req.Scope != database.ScopeRead && req.Scope != database.ScopeAdmin {
+		respondError(w, http.StatusBadRequest, fmt.Sprintf("scope must be %q or %q", database.ScopeRead, database.ScopeAdmin))
+		return
+	}
+
+	key, err := newAPIKey()
+	if err != nil {
+		requestLog(r).WithError(err).Error("Failed to generate API key")
+		respondError(w, http.StatusInternalServerError, "Failed to generate API key")
+		return
+	}
+
+	record := &database.APIKey{
+		ID:        uuid.New(),
+		Name:      req.Name,
+		KeyHash:   database.HashAPIKey(key),
+		Scope:     req.Scope,
+		CreatedAt: time.Now(),
+	}
+	if err := s.db.CreateAPIKey(record); err != nil {
+		requestLog(r).WithError(err).Error("Failed to create API key")
+		respondError(w, http.StatusInternalServerError, "Failed to create API key")
+		return
+	}
+
+	requestLog(r).WithFields(log.Fields{
+		"key_id": record.ID,
+		"name":   record.Name,
+		"scope":  record.Scope,
+	}).Info("API key created")
+
+	respondJSON(w, http.StatusCreated, CreateAPIKeyResponse{APIKey: *record, Key: key})
+}
+
+func (s *Server) handleListAPIKeys(w http.ResponseWriter, r *http.Request) {
+	keys, err := s.db.ListAPIKeys()
+	if err != nil {
+		requestLog(r).WithError(err).Error("Failed to list API keys")
+		respondError(w, http.StatusInternalServerError, "Failed to list API keys")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, keys)
+}
+
+func (s *Server) handleDeleteAPIKey(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid API key ID")
+		return
+	}
+
+	key, err := s.db.GetAPIKey(id)
+	if err != nil {
+		respondLookupError(w, err, "API key")
+		return
+	}
+
+	if _, err := s.db.DeleteAPIKey(id); err != nil {
+		requestLog(r).WithError(err).Error("Failed to delete API key")
+		respondError(w, http.StatusInternalServerError, "Failed to delete API key")
+		return
+	}
+
+	requestLog(r).WithFields(log.Fields{
+		"key_id": key.ID,
+		"name":   key.Name,
+	}).Info("API key revoked")
+
+	respondJSON(w, http.StatusOK, key)
+}
@@ -0,0 +1,111 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/metorial/fleet/cosmos/internal/controller/database"
+)
+
+type fakeKeys map[string]*database.APIKey
+
+func (f fakeKeys) GetAPIKeyByHash(hash string) (*database.APIKey, error) {
+	key, ok := f[hash]
+	if !ok {
+		return nil, fmt.Errorf("api key: %w", database.ErrNotFound)
+	}
+	return key, nil
+}
+
+func TestAuthMiddleware(t *testing.T) {
+	keys := fakeKeys{
+		database.HashAPIKey("stored-key"): {Name: "ci", Scope: database.ScopeAdmin},
+		database.HashAPIKey("read-key"):   {Name: "dashboard", Scope: database.ScopeRead},
+	}
+
+	tests := []struct {
+		name       string
+		disabled   bool
+		method     string
+		path       string
+		header     string
+		wantStatus int
+	}{
+		{name: "static token", path: "/api/v1/deployments", header: "Bearer static-token", wantStatus: http.StatusOK},
+		{name: "stored key", path: "/api/v1/deployments", header: "Bearer stored-key", wantStatus: http.StatusOK},
+		{name: "missing token", path: "/api/v1/deployments", wantStatus: http.StatusUnauthorized},
+		{name: "invalid token", path: "/api/v1/deployments", header: "Bearer nope", wantStatus: http.StatusUnauthorized},
+		{name: "wrong scheme", path: "/api/v1/deployments", header: "Basic static-token", wantStatus: http.StatusUnauthorized},
+		{name: "health is open", path: "/api/v1/health", wantStatus: http.StatusOK},
+		{name: "disabled", disabled: true, path: "/api/v1/deployments", wantStatus: http.StatusOK},
+		{name: "read key lists deployments", path: "/api/v1/deployments", header: "Bearer read-key", wantStatus: http.StatusOK},
+		{name: "read key cannot deploy", method: http.MethodPost, path: "/api/v1/deployments", header: "Bearer read-key", wantStatus: http.StatusForbidden},
+		{name: "read key cannot list keys", path: "/api/v1/api-keys", header: "Bearer read-key", wantStatus: http.StatusForbidden},
+		{name: "admin key deploys", method: http.MethodPost, path: "/api/v1/deployments", header: "Bearer stored-key", wantStatus: http.StatusOK},
+		{name: "static token deploys", method: http.MethodPost, path: "/api/v1/deployments", header: "Bearer static-token", wantStatus: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{authEnabled: !tt.disabled, apiToken: "static-token", apiKeys: keys}
+			handler := s.authMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}))
+
+			method := tt.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			req := httptest.NewRequest(method, tt.path, nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			rec := httptest.NewRecorder()
+
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("Expected status %d, got %d", tt.wantStatus, rec.Code)
+			}
+			if rec.Code == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") == "" {
+				t.Error("Expected a WWW-Authenticate header on 401")
+			}
+		})
+	}
+}
+
+func TestAuthMiddlewareRecordsKeyName(t *testing.T) {
+	keys := fakeKeys{database.HashAPIKey("stored-key"): {Name: "ci", Scope: database.ScopeAdmin}}
+
+	tests := []struct {
+		name     string
+		disabled bool
+		header   string
+		wantName string
+	}{
+		{name: "static token", header: "Bearer static-token", wantName: staticTokenName},
+		{name: "stored key", header: "Bearer stored-key", wantName: "ci"},
+		{name: "disabled", disabled: true, header: "Bearer stored-key", wantName: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{authEnabled: !tt.disabled, apiToken: "static-token", apiKeys: keys}
+
+			var got string
+			handler := s.authMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = apiKeyName(r)
+			}))
+
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/deployments", nil)
+			req.Header.Set("Authorization", tt.header)
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+
+			if got != tt.wantName {
+				t.Errorf("Expected key name %q, got %q", tt.wantName, got)
+			}
+		})
+	}
+}
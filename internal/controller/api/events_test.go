@@ -0,0 +1,95 @@
+package api
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/metorial/fleet/cosmos/internal/controller/database"
+	"github.com/metorial/fleet/cosmos/internal/controller/database/dbtest"
+	"github.com/metorial/fleet/cosmos/internal/controller/events"
+)
+
+func TestDeploymentEventsStream(t *testing.T) {
+	dsn := dbtest.URL(t)
+
+	db, err := database.NewControllerDB(dsn)
+	if err != nil {
+		t.Fatalf("Failed to create test database: %v", err)
+	}
+	defer db.Close()
+
+	deployment := &database.Deployment{ID: uuid.New(), Configuration: []byte(`{}`), Status: "running", CreatedAt: time.Now()}
+	if err := db.CreateDeployment(deployment); err != nil {
+		t.Fatalf("Failed to create deployment: %v", err)
+	}
+
+	bus := events.NewBus()
+	s := &Server{db: db, events: bus, eventPoll: 50 * time.Millisecond}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/deployments/{id}/events", s.handleDeploymentEvents)
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/deployments/" + deployment.ID.String() + "/events")
+	if err != nil {
+		t.Fatalf("Failed to open event stream: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if got := resp.Header.Get("Content-Type"); got != "text/event-stream" {
+		t.Fatalf("Expected an event stream, got %q", got)
+	}
+
+	// The handler subscribes before answering, so this isn't lost
+	bus.Publish(events.Event{DeploymentID: deployment.ID, Type: events.TypeLog, Data: &database.DeploymentLog{
+		DeploymentID: deployment.ID, ComponentName: "web", Operation: "deploy", Status: "initiated",
+	}})
+
+	lines := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		close(lines)
+	}()
+
+	waitFor := func(prefix string) string {
+		t.Helper()
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case line, ok := <-lines:
+				if !ok {
+					t.Fatalf("Stream ended before %q", prefix)
+				}
+				if strings.HasPrefix(line, prefix) {
+					return line
+				}
+			case <-timeout:
+				t.Fatalf("Timed out waiting for %q", prefix)
+			}
+		}
+	}
+
+	waitFor("event: log")
+	if data := waitFor("data: "); !strings.Contains(data, `"initiated"`) {
+		t.Errorf("Expected the log row in the event, got %s", data)
+	}
+
+	if err := db.UpdateDeploymentStatus(deployment.ID, "completed", ""); err != nil {
+		t.Fatalf("Failed to complete deployment: %v", err)
+	}
+
+	waitFor("event: done")
+	if data := waitFor("data: "); !strings.Contains(data, `"completed"`) {
+		t.Errorf("Expected the finished deployment in the final event, got %s", data)
+	}
+}
@@ -0,0 +1,110 @@
+package api
+
+import (
+	"fmt"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+
+	"github.com/metorial/fleet/cosmos/internal/controller/database"
+)
+
+// pageParams are accepted by every list endpoint
+var pageParams = []string{"paginated", "limit", "offset"}
+
+var (
+	componentParams = append([]string{"type", "handler", "tag", "name_prefix", "sort", "order"}, pageParams...)
+	nodeParams      = append([]string{"online", "tag", "has_agent", "sort", "order"}, pageParams...)
+)
+
+// checkParams rejects query parameters the endpoint doesn't know, so a typo
+// doesn't silently return everything
+func checkParams(query url.Values, allowed []string) error {
+	var unknown []string
+	for name := range query {
+		if !slices.Contains(allowed, name) {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("unknown query parameter %q", unknown[0])
+	}
+	return nil
+}
+
+// sortOrder reads the sort and order parameters. An empty sort means the
+// endpoint's default.
+func sortOrder(query url.Values, columns ...string) (string, bool, error) {
+	column := query.Get("sort")
+	if column != "" && !slices.Contains(columns, column) {
+		return "", false, fmt.Errorf("sort must be one of %v", columns)
+	}
+
+	switch query.Get("order") {
+	case "", "asc":
+		return column, false, nil
+	case "desc":
+		return column, true, nil
+	default:
+		return "", false, fmt.Errorf(`order must be "asc" or "desc"`)
+	}
+}
+
+// componentFilter reads the filters of the components list: type, handler,
+// tag, name_prefix and sorting by name or created_at
+func componentFilter(query url.Values) (database.ComponentFilter, error) {
+	if err := checkParams(query, componentParams); err != nil {
+		return database.ComponentFilter{}, err
+	}
+
+	column, desc, err := sortOrder(query, "name", "created_at")
+	if err != nil {
+		return database.ComponentFilter{}, err
+	}
+
+	return database.ComponentFilter{
+		Type:       query.Get("type"),
+		Handler:    query.Get("handler"),
+		Tag:        query.Get("tag"),
+		NamePrefix: query.Get("name_prefix"),
+		Sort:       column,
+		Desc:       desc,
+	}, nil
+}
+
+// nodeFilter reads the filters of the nodes list: online, tag (repeatable,
+// any of them matches), has_agent and sorting by name or last_seen
+func nodeFilter(query url.Values) (database.NodeFilter, error) {
+	if err := checkParams(query, nodeParams); err != nil {
+		return database.NodeFilter{}, err
+	}
+
+	column, desc, err := sortOrder(query, "name", "last_seen")
+	if err != nil {
+		return database.NodeFilter{}, err
+	}
+
+	filter := database.NodeFilter{
+		OnlineOnly: query.Get("online") == "true",
+		Sort:       column,
+		Desc:       desc,
+	}
+
+	for _, tag := range query["tag"] {
+		if tag != "" {
+			filter.Tags = append(filter.Tags, tag)
+		}
+	}
+
+	if value := query.Get("has_agent"); value != "" {
+		hasAgent, err := strconv.ParseBool(value)
+		if err != nil {
+			return database.NodeFilter{}, fmt.Errorf("has_agent must be true or false")
+		}
+		filter.HasAgent = &hasAgent
+	}
+
+	return filter, nil
+}
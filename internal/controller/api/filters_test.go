@@ -0,0 +1,78 @@
+package api
+
+import (
+	"fmt"
+	"net/url"
+	"testing"
+
+	"github.com/metorial/fleet/cosmos/internal/controller/database"
+)
+
+func TestComponentFilter(t *testing.T) {
+	tests := []struct {
+		query   string
+		want    database.ComponentFilter
+		wantErr bool
+	}{
+		{query: "", want: database.ComponentFilter{}},
+		{query: "type=script", want: database.ComponentFilter{Type: "script"}},
+		{query: "handler=agent&tag=web", want: database.ComponentFilter{Handler: "agent", Tag: "web"}},
+		{query: "type=program&handler=agent&tag=web&name_prefix=api-", want: database.ComponentFilter{Type: "program", Handler: "agent", Tag: "web", NamePrefix: "api-"}},
+		{query: "sort=created_at&order=desc", want: database.ComponentFilter{Sort: "created_at", Desc: true}},
+		{query: "tag=web&paginated=true&limit=5", want: database.ComponentFilter{Tag: "web"}},
+		{query: "sort=hash", wantErr: true},
+		{query: "order=sideways", wantErr: true},
+		{query: "typ=script", wantErr: true},
+		{query: "has_agent=true", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		query, _ := url.ParseQuery(tt.query)
+		got, err := componentFilter(query)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("componentFilter(%q) error = %v, wantErr %v", tt.query, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && got != tt.want {
+			t.Errorf("componentFilter(%q) = %+v, want %+v", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestNodeFilter(t *testing.T) {
+	tests := []struct {
+		query   string
+		want    string
+		wantErr bool
+	}{
+		{query: "", want: "online=false tags=[] has_agent=<nil> sort= desc=false"},
+		{query: "tag=gpu", want: "online=false tags=[gpu] has_agent=<nil> sort= desc=false"},
+		{query: "tag=gpu&tag=edge&has_agent=true", want: "online=false tags=[gpu edge] has_agent=true sort= desc=false"},
+		{query: "has_agent=false&online=true", want: "online=true tags=[] has_agent=false sort= desc=false"},
+		{query: "tag=gpu&sort=last_seen&order=desc", want: "online=false tags=[gpu] has_agent=<nil> sort=last_seen desc=true"},
+		{query: "has_agent=maybe", wantErr: true},
+		{query: "sort=created_at", wantErr: true},
+		{query: "type=script", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		query, _ := url.ParseQuery(tt.query)
+		filter, err := nodeFilter(query)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("nodeFilter(%q) error = %v, wantErr %v", tt.query, err, tt.wantErr)
+			continue
+		}
+		if tt.wantErr {
+			continue
+		}
+
+		hasAgent := "<nil>"
+		if filter.HasAgent != nil {
+			hasAgent = fmt.Sprint(*filter.HasAgent)
+		}
+		got := fmt.Sprintf("online=%v tags=%v has_agent=%s sort=%s desc=%v", filter.OnlineOnly, filter.Tags, hasAgent, filter.Sort, filter.Desc)
+		if got != tt.want {
+			t.Errorf("nodeFilter(%q) = %s, want %s", tt.query, got, tt.want)
+		}
+	}
+}
@@ -4,37 +4,87 @@ import (
 	"context"
 	"embed"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/fs"
 	"net/http"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 	"github.com/metorial/fleet/cosmos/internal/controller/database"
+	"github.com/metorial/fleet/cosmos/internal/controller/events"
+	grpcserver "github.com/metorial/fleet/cosmos/internal/controller/grpc"
+	"github.com/metorial/fleet/cosmos/internal/controller/reconciler"
 	"github.com/metorial/fleet/cosmos/internal/controller/types"
+	"github.com/metorial/fleet/cosmos/internal/models"
+	"github.com/metorial/fleet/cosmos/internal/util"
 	log "github.com/sirupsen/logrus"
 )
 
 //go:embed static/*
 var staticFiles embed.FS
 
+const defaultEventPoll = 2 * time.Second
+
 type ReconcilerInterface interface {
 	ProcessDeployment(deploymentID uuid.UUID, config types.ConfigurationRequest) error
+	RemoveComponents(deploymentID uuid.UUID, components []database.Component) map[string]error
+	RedeployToNode(deploymentID uuid.UUID, component *database.Component, hostname string) error
+	CancelDeployment(deploymentID uuid.UUID) bool
+	DrainNode(hostname string) (map[string]error, error)
+	SyncNode(hostname string)
+}
+
+// AgentMessenger sends control messages to connected agents
+type AgentMessenger interface {
+	SendLogLevel(hostname, level string) error
+	RequestLogs(ctx context.Context, hostname, componentName string, lines int) (string, error)
+	SendControl(ctx context.Context, hostname, action, componentName string) (string, error)
+}
+
+// LeaderStatus reports whether this controller is the elected leader
+type LeaderStatus interface {
+	IsLeader() bool
+	Leader() string
+	ID() string
 }
 
 type Server struct {
 	db         *database.ControllerDB
 	reconciler ReconcilerInterface
+	agents     AgentMessenger
+	leader     LeaderStatus
+	events     *events.Bus
 	port       int
 	server     *http.Server
+
+	// eventPoll is how often a deployment event stream checks whether the
+	// deployment has finished
+	eventPoll time.Duration
+
+	authEnabled bool
+	apiToken    string
+	apiKeys     APIKeyStore
 }
 
 type ServerConfig struct {
 	DB         *database.ControllerDB
 	Reconciler ReconcilerInterface
+	Agents     AgentMessenger
+	Leader     LeaderStatus
+	Events     *events.Bus
 	Port       int
+
+	// AuthEnabled requires a bearer token on every API route except the
+	// health check. The token is either AuthToken or an API key stored in
+	// the database.
+	AuthEnabled bool
+	AuthToken   string
 }
 
 type DeploymentResponse struct {
@@ -47,11 +97,25 @@ type ErrorResponse struct {
 	Error string `json:"error"`
 }
 
+// ValidationErrorResponse lists every problem with a rejected configuration
+type ValidationErrorResponse struct {
+	Error  string                 `json:"error"`
+	Errors types.ValidationErrors `json:"errors"`
+}
+
 func NewServer(config *ServerConfig) *Server {
 	return &Server{
 		db:         config.DB,
 		reconciler: config.Reconciler,
+		agents:     config.Agents,
+		leader:     config.Leader,
+		events:     config.Events,
 		port:       config.Port,
+		eventPoll:  defaultEventPoll,
+
+		authEnabled: config.AuthEnabled,
+		apiToken:    config.AuthToken,
+		apiKeys:     config.DB,
 	}
 }
 
@@ -59,21 +123,42 @@ func (s *Server) Start() error {
 	router := mux.NewRouter()
 
 	api := router.PathPrefix("/api/v1").Subrouter()
+	api.Use(s.authMiddleware)
 
 	api.HandleFunc("/health", s.handleHealth).Methods("GET")
 	api.HandleFunc("/deployments", s.handleCreateDeployment).Methods("POST")
 	api.HandleFunc("/deployments", s.handleListDeployments).Methods("GET")
 	api.HandleFunc("/deployments/{id}", s.handleGetDeployment).Methods("GET")
+	api.HandleFunc("/deployments/{id}", s.handleCancelDeployment).Methods("DELETE")
+	api.HandleFunc("/deployments/{id}/events", s.handleDeploymentEvents).Methods("GET")
+	api.HandleFunc("/deployments/{id}/approve", s.handleApproveDeployment).Methods("POST")
+	api.HandleFunc("/deployments/{id}/reject", s.handleRejectDeployment).Methods("POST")
+	api.HandleFunc("/deployments/{id}/{decision:promote|abort}", s.handleCanaryDecision).Methods("POST")
 	api.HandleFunc("/components", s.handleListComponents).Methods("GET")
+	api.HandleFunc("/components", s.handleBulkRemoveComponents).Methods("DELETE")
 	api.HandleFunc("/components/{name}", s.handleGetComponent).Methods("GET")
 	api.HandleFunc("/components/{name}/deployments", s.handleGetComponentDeployments).Methods("GET")
+	api.HandleFunc("/components/{name}/history", s.handleGetComponentHistory).Methods("GET")
+	api.HandleFunc("/components/{name}/restart", s.handleRestartComponent).Methods("POST")
 	api.HandleFunc("/nodes", s.handleListNodes).Methods("GET")
 	api.HandleFunc("/nodes/{hostname}", s.handleGetNode).Methods("GET")
 	api.HandleFunc("/nodes/{hostname}/components", s.handleGetNodeComponents).Methods("GET")
+	api.HandleFunc("/nodes/{hostname}/drift", s.handleGetNodeDrift).Methods("GET")
+	api.HandleFunc("/nodes/{hostname}/log-level", s.handleSetNodeLogLevel).Methods("POST")
+	api.HandleFunc("/nodes/{hostname}/tags", s.handleSetNodeTags).Methods("PUT")
+	api.HandleFunc("/nodes/{hostname}/tags", s.handleUpdateNodeTags).Methods("PATCH")
+	api.HandleFunc("/nodes/{hostname}/drain", s.handleDrainNode).Methods("POST")
+	api.HandleFunc("/nodes/{hostname}/uncordon", s.handleUncordonNode).Methods("POST")
+	api.HandleFunc("/nodes/{hostname}/components/{name}/clear", s.handleClearNodeComponent).Methods("POST")
+	api.HandleFunc("/nodes/{hostname}/components/{name}/logs", s.handleGetNodeComponentLiveLogs).Methods("GET")
+	api.HandleFunc("/nodes/{hostname}/components/{name}/{action:restart|stop|start}", s.handleControlNodeComponent).Methods("POST")
 	api.HandleFunc("/agents", s.handleListAgents).Methods("GET")
 	api.HandleFunc("/agents/{hostname}", s.handleGetAgent).Methods("GET")
 	api.HandleFunc("/logs/{component_name}", s.handleGetComponentLogs).Methods("GET")
 	api.HandleFunc("/logs/{component_name}/{node_hostname}", s.handleGetComponentNodeLogs).Methods("GET")
+	api.HandleFunc("/api-keys", s.handleCreateAPIKey).Methods("POST")
+	api.HandleFunc("/api-keys", s.handleListAPIKeys).Methods("GET")
+	api.HandleFunc("/api-keys/{id}", s.handleDeleteAPIKey).Methods("DELETE")
 
 	// Serve static files from embedded filesystem
 	staticFS, err := fs.Sub(staticFiles, "static")
@@ -83,6 +168,7 @@ func (s *Server) Start() error {
 	router.PathPrefix("/static/").Handler(http.StripPrefix("/static/", http.FileServer(http.FS(staticFS))))
 	router.HandleFunc("/", s.handleIndex).Methods("GET")
 
+	router.Use(requestIDMiddleware)
 	router.Use(loggingMiddleware)
 	router.Use(corsMiddleware)
 
@@ -117,7 +203,7 @@ func (s *Server) Stop() error {
 func (s *Server) handleIndex(w http.ResponseWriter, r *http.Request) {
 	data, err := staticFiles.ReadFile("static/index.html")
 	if err != nil {
-		log.WithError(err).Error("Failed to read index.html")
+		requestLog(r).WithError(err).Error("Failed to read index.html")
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
@@ -126,9 +212,19 @@ func (s *Server) handleIndex(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
-	respondJSON(w, http.StatusOK, map[string]string{
+	response := map[string]string{
 		"status": "healthy",
-	})
+	}
+
+	if s.leader != nil {
+		response["controller_id"] = s.leader.ID()
+		response["role"] = "follower"
+		if s.leader.IsLeader() {
+			response["role"] = "leader"
+		}
+	}
+
+	respondJSON(w, http.StatusOK, response)
 }
 
 func (s *Server) handleCreateDeployment(w http.ResponseWriter, r *http.Request) {
@@ -139,13 +235,23 @@ func (s *Server) handleCreateDeployment(w http.ResponseWriter, r *http.Request)
 	}
 
 	for i := range req.Components {
-		if req.Components[i].Type == "service" && req.Components[i].NomadJob == "" && req.Components[i].NomadJobData != nil {
-			job, err := json.Marshal(req.Components[i].NomadJobData)
-			if err != nil {
-				respondError(w, http.StatusInternalServerError, "Failed to serialize configuration")
-				return
-			}
-			req.Components[i].NomadJob = string(job)
+		req.Components[i].Name = util.NormalizeComponentName(req.Components[i].Name)
+	}
+
+	if errs := types.ValidateConfiguration(&req); len(errs) > 0 {
+		respondJSON(w, http.StatusBadRequest, ValidationErrorResponse{Error: "Invalid configuration", Errors: errs})
+		return
+	}
+
+	// nomad_job_data is the canonical form of a JSON job spec; inline
+	// nomad_job strings are converted so they are only parsed once. HCL jobs
+	// stay in nomad_job for Nomad to parse.
+	for i := range req.Components {
+		comp := &req.Components[i]
+		if comp.Type == "service" && !comp.UsesKubernetes() && comp.NomadJobData == nil && comp.NomadJob != "" && !comp.NomadJobIsHCL() {
+			job := json.RawMessage(comp.NomadJob)
+			comp.NomadJobData = &job
+			comp.NomadJob = ""
 		}
 	}
 
@@ -157,276 +263,1572 @@ func (s *Server) handleCreateDeployment(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	status := "pending"
+	if req.RequireApproval {
+		status = "pending-approval"
+	}
+
 	deployment := &database.Deployment{
 		ID:            uuid.New(),
 		Configuration: configJSON,
-		Status:        "pending",
+		Status:        status,
 		CreatedAt:     time.Now(),
+		RequestID:     util.RequestIDFromContext(r.Context()),
 	}
 
 	if err := s.db.CreateDeployment(deployment); err != nil {
-		log.WithError(err).Error("Failed to create deployment")
+		requestLog(r).WithError(err).Error("Failed to create deployment")
 		respondError(w, http.StatusInternalServerError, "Failed to create deployment")
 		return
 	}
 
+	if req.RequireApproval {
+		respondJSON(w, http.StatusCreated, DeploymentResponse{
+			ID:      deployment.ID,
+			Status:  status,
+			Message: "Deployment awaiting approval",
+		})
+		return
+	}
+
+	s.launchDeployment(w, http.StatusCreated, deployment.ID, req)
+}
+
+// launchDeployment starts processing a pending deployment, or leaves it
+// queued for the leader when this controller is a follower
+func (s *Server) launchDeployment(w http.ResponseWriter, statusCode int, id uuid.UUID, req types.ConfigurationRequest) {
+	if s.leader != nil && !s.leader.IsLeader() {
+		respondJSON(w, http.StatusAccepted, DeploymentResponse{
+			ID:      id,
+			Status:  "pending",
+			Message: "Deployment queued for the leader controller",
+		})
+		return
+	}
+
 	go func() {
-		if err := s.reconciler.ProcessDeployment(deployment.ID, req); err != nil {
-			log.WithError(err).WithField("deployment_id", deployment.ID).Error("Deployment failed")
-			s.db.UpdateDeploymentStatus(deployment.ID, "failed", err.Error())
-		} else {
-			s.db.UpdateDeploymentStatus(deployment.ID, "completed", "")
+		err := s.reconciler.ProcessDeployment(id, req)
+		if errors.Is(err, reconciler.ErrDeploymentClaimed) || errors.Is(err, reconciler.ErrDeploymentCancelled) {
+			return
+		}
+		if err != nil {
+			log.WithError(err).WithField("deployment_id", id).Error("Deployment failed")
+			s.db.UpdateDeploymentStatus(id, "failed", err.Error())
 		}
 	}()
 
-	respondJSON(w, http.StatusCreated, DeploymentResponse{
-		ID:      deployment.ID,
+	respondJSON(w, statusCode, DeploymentResponse{
+		ID:      id,
 		Status:  "pending",
 		Message: "Deployment queued for processing",
 	})
 }
 
-func (s *Server) handleListDeployments(w http.ResponseWriter, r *http.Request) {
-	limitStr := r.URL.Query().Get("limit")
-	offsetStr := r.URL.Query().Get("offset")
-
-	limit := 50
-	offset := 0
+// ReviewRequest is the body of an approval, rejection or canary decision.
+// With authentication enabled the reviewer is the name of the API key the
+// request was made with, and Reviewer is ignored.
+type ReviewRequest struct {
+	Reviewer string `json:"reviewer,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+}
 
-	if limitStr != "" {
-		if l, err := strconv.Atoi(limitStr); err == nil && l > 0 {
-			limit = l
-		}
+func decodeReviewRequest(r *http.Request) (ReviewRequest, error) {
+	var req ReviewRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		return req, err
 	}
-
-	if offsetStr != "" {
-		if o, err := strconv.Atoi(offsetStr); err == nil && o >= 0 {
-			offset = o
-		}
+	if name := apiKeyName(r); name != "" {
+		req.Reviewer = name
+	}
+	if req.Reviewer == "" {
+		return req, fmt.Errorf("reviewer is required")
 	}
+	return req, nil
+}
 
-	deployments, err := s.db.ListDeployments(limit, offset)
+func (s *Server) handleApproveDeployment(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.Parse(mux.Vars(r)["id"])
 	if err != nil {
-		log.WithError(err).Error("Failed to list deployments")
-		respondError(w, http.StatusInternalServerError, "Failed to list deployments")
+		respondError(w, http.StatusBadRequest, "Invalid deployment ID")
 		return
 	}
 
-	respondJSON(w, http.StatusOK, deployments)
-}
-
-func (s *Server) handleGetDeployment(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	idStr := vars["id"]
-
-	id, err := uuid.Parse(idStr)
+	review, err := decodeReviewRequest(r)
 	if err != nil {
-		respondError(w, http.StatusBadRequest, "Invalid deployment ID")
+		respondError(w, http.StatusBadRequest, fmt.Sprintf("Invalid request body: %v", err))
 		return
 	}
 
 	deployment, err := s.db.GetDeployment(id)
 	if err != nil {
-		respondError(w, http.StatusNotFound, "Deployment not found")
+		respondLookupError(w, err, "Deployment")
 		return
 	}
 
-	logs, _ := s.db.GetDeploymentLogs(id, 100)
+	var req types.ConfigurationRequest
+	if err := json.Unmarshal(deployment.Configuration, &req); err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to parse deployment configuration")
+		return
+	}
 
-	response := map[string]interface{}{
-		"deployment": deployment,
-		"logs":       logs,
+	approved, err := s.db.ApproveDeployment(id, review.Reviewer)
+	if err != nil {
+		requestLog(r).WithError(err).Error("Failed to approve deployment")
+		respondError(w, http.StatusInternalServerError, "Failed to approve deployment")
+		return
+	}
+	if !approved {
+		respondError(w, http.StatusConflict, fmt.Sprintf("Deployment is %s, not awaiting approval", deployment.Status))
+		return
 	}
 
-	respondJSON(w, http.StatusOK, response)
+	requestLog(r).WithFields(log.Fields{
+		"deployment_id": id,
+		"approved_by":   review.Reviewer,
+	}).Info("Deployment approved")
+
+	s.launchDeployment(w, http.StatusOK, id, req)
 }
 
-func (s *Server) handleListComponents(w http.ResponseWriter, r *http.Request) {
-	components, err := s.db.ListComponents()
+func (s *Server) handleRejectDeployment(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.Parse(mux.Vars(r)["id"])
 	if err != nil {
-		log.WithError(err).Error("Failed to list components")
-		respondError(w, http.StatusInternalServerError, "Failed to list components")
+		respondError(w, http.StatusBadRequest, "Invalid deployment ID")
 		return
 	}
 
-	respondJSON(w, http.StatusOK, components)
-}
+	review, err := decodeReviewRequest(r)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, fmt.Sprintf("Invalid request body: %v", err))
+		return
+	}
 
-func (s *Server) handleGetComponent(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	name := vars["name"]
+	deployment, err := s.db.GetDeployment(id)
+	if err != nil {
+		respondLookupError(w, err, "Deployment")
+		return
+	}
 
-	component, err := s.db.GetComponent(name)
+	rejected, err := s.db.RejectDeployment(id, review.Reviewer, review.Reason)
 	if err != nil {
-		respondError(w, http.StatusNotFound, "Component not found")
+		requestLog(r).WithError(err).Error("Failed to reject deployment")
+		respondError(w, http.StatusInternalServerError, "Failed to reject deployment")
+		return
+	}
+	if !rejected {
+		respondError(w, http.StatusConflict, fmt.Sprintf("Deployment is %s, not awaiting approval", deployment.Status))
 		return
 	}
 
-	respondJSON(w, http.StatusOK, component)
+	requestLog(r).WithFields(log.Fields{
+		"deployment_id": id,
+		"rejected_by":   review.Reviewer,
+	}).Info("Deployment rejected")
+
+	respondJSON(w, http.StatusOK, DeploymentResponse{
+		ID:      id,
+		Status:  "rejected",
+		Message: "Deployment rejected",
+	})
 }
 
-func (s *Server) handleGetComponentDeployments(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	name := vars["name"]
+// handleCanaryDecision ends the canary bake of a running deployment early,
+// either promoting the rollout to the remaining nodes or aborting it
+func (s *Server) handleCanaryDecision(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid deployment ID")
+		return
+	}
+	decision := mux.Vars(r)["decision"]
 
-	deployments, err := s.db.GetComponentDeployments(name)
+	review, err := decodeReviewRequest(r)
 	if err != nil {
-		log.WithError(err).Error("Failed to get component deployments")
-		respondError(w, http.StatusInternalServerError, "Failed to get component deployments")
+		respondError(w, http.StatusBadRequest, fmt.Sprintf("Invalid request body: %v", err))
 		return
 	}
 
-	respondJSON(w, http.StatusOK, deployments)
-}
+	deployment, err := s.db.GetDeployment(id)
+	if err != nil {
+		respondLookupError(w, err, "Deployment")
+		return
+	}
 
-func (s *Server) handleListNodes(w http.ResponseWriter, r *http.Request) {
-	onlineOnly := r.URL.Query().Get("online") == "true"
+	var req types.ConfigurationRequest
+	if err := json.Unmarshal(deployment.Configuration, &req); err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to parse deployment configuration")
+		return
+	}
+	if !hasCanary(req) {
+		respondError(w, http.StatusConflict, "Deployment has no canary phase")
+		return
+	}
 
-	nodes, err := s.db.ListNodes(onlineOnly)
+	decided, err := s.db.DecideCanary(id, decision, review.Reviewer)
 	if err != nil {
-		log.WithError(err).Error("Failed to list nodes")
-		respondError(w, http.StatusInternalServerError, "Failed to list nodes")
+		requestLog(r).WithError(err).Error("Failed to record canary decision")
+		respondError(w, http.StatusInternalServerError, "Failed to record canary decision")
+		return
+	}
+	if !decided {
+		respondError(w, http.StatusConflict, fmt.Sprintf("Deployment is %s, not running", deployment.Status))
 		return
 	}
 
-	respondJSON(w, http.StatusOK, nodes)
+	requestLog(r).WithFields(log.Fields{
+		"deployment_id": id,
+		"decision":      decision,
+		"decided_by":    review.Reviewer,
+	}).Info("Canary decision recorded")
+
+	respondJSON(w, http.StatusOK, DeploymentResponse{
+		ID:      id,
+		Status:  deployment.Status,
+		Message: fmt.Sprintf("Canary %s requested", decision),
+	})
+}
+
+// hasCanary reports whether any component of a deployment starts with a
+// canary phase
+func hasCanary(req types.ConfigurationRequest) bool {
+	for _, comp := range req.Components {
+		rollout := comp.Rollout
+		if rollout == nil {
+			rollout = req.Rollout
+		}
+		if rollout.Canaries() > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Page is what the list endpoints return when called with paginated=true.
+// Without the flag they keep answering with a bare array so existing clients
+// don't break; only deployments are limited then.
+type Page struct {
+	Items  interface{} `json:"items"`
+	Total  int64       `json:"total"`
+	Limit  int         `json:"limit"`
+	Offset int         `json:"offset"`
 }
 
-func (s *Server) handleGetNode(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	hostname := vars["hostname"]
+const defaultPageLimit = 50
 
-	node, err := s.db.GetNode(hostname)
-	if err != nil {
-		respondError(w, http.StatusNotFound, "Node not found")
-		return
+// pagination reads the paginated flag and the limit and offset parameters.
+// Invalid values fall back to the defaults.
+func pagination(r *http.Request) (paginated bool, limit, offset int) {
+	query := r.URL.Query()
+	paginated = query.Get("paginated") == "true"
+	limit = defaultPageLimit
+
+	if l, err := strconv.Atoi(query.Get("limit")); err == nil && l > 0 {
+		limit = l
+	}
+	if o, err := strconv.Atoi(query.Get("offset")); err == nil && o >= 0 {
+		offset = o
 	}
 
-	respondJSON(w, http.StatusOK, node)
+	return paginated, limit, offset
 }
 
-func (s *Server) handleGetNodeComponents(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	hostname := vars["hostname"]
+func (s *Server) handleListDeployments(w http.ResponseWriter, r *http.Request) {
+	paginated, limit, offset := pagination(r)
 
-	deployments, err := s.db.GetNodeDeployments(hostname)
+	deployments, err := s.db.ListDeployments(limit, offset)
 	if err != nil {
-		log.WithError(err).Error("Failed to get node components")
-		respondError(w, http.StatusInternalServerError, "Failed to get node components")
+		requestLog(r).WithError(err).Error("Failed to list deployments")
+		respondError(w, http.StatusInternalServerError, "Failed to list deployments")
 		return
 	}
 
-	respondJSON(w, http.StatusOK, deployments)
-}
-
-func (s *Server) handleListAgents(w http.ResponseWriter, r *http.Request) {
-	onlineOnly := r.URL.Query().Get("online") == "true"
+	if !paginated {
+		respondJSON(w, http.StatusOK, deployments)
+		return
+	}
 
-	agents, err := s.db.ListAgents(onlineOnly)
+	total, err := s.db.CountDeployments()
 	if err != nil {
-		log.WithError(err).Error("Failed to list agents")
-		respondError(w, http.StatusInternalServerError, "Failed to list agents")
+		requestLog(r).WithError(err).Error("Failed to count deployments")
+		respondError(w, http.StatusInternalServerError, "Failed to list deployments")
 		return
 	}
 
-	respondJSON(w, http.StatusOK, agents)
+	respondJSON(w, http.StatusOK, Page{Items: deployments, Total: total, Limit: limit, Offset: offset})
 }
 
-func (s *Server) handleGetAgent(w http.ResponseWriter, r *http.Request) {
+func (s *Server) handleGetDeployment(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
-	hostname := vars["hostname"]
+	idStr := vars["id"]
 
-	agent, err := s.db.GetAgent(hostname)
+	id, err := uuid.Parse(idStr)
 	if err != nil {
-		respondError(w, http.StatusNotFound, "Agent not found")
+		respondError(w, http.StatusBadRequest, "Invalid deployment ID")
 		return
 	}
 
-	respondJSON(w, http.StatusOK, agent)
-}
+	deployment, err := s.db.GetDeployment(id)
+	if err != nil {
+		respondLookupError(w, err, "Deployment")
+		return
+	}
 
-func (s *Server) handleGetComponentLogs(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	componentName := vars["component_name"]
+	logs, _ := s.db.GetDeploymentLogs(id, 100)
 
-	sinceStr := r.URL.Query().Get("since")
-	limitStr := r.URL.Query().Get("limit")
+	statuses, err := s.db.GetDeploymentComponentStatuses(id)
+	if err != nil {
+		requestLog(r).WithError(err).WithField("deployment_id", id).Warn("Failed to get deployment component statuses")
+	}
 
-	var since time.Time
-	if sinceStr != "" {
-		if s, err := time.Parse(time.RFC3339, sinceStr); err == nil {
-			since = s
-		}
+	response := map[string]interface{}{
+		"deployment": deployment,
+		"logs":       logs,
+		"status":     summarizeDeployment(deployment, statuses),
 	}
 
-	limit := 1000
-	if limitStr != "" {
-		if l, err := strconv.Atoi(limitStr); err == nil && l > 0 {
-			limit = l
-		}
+	respondJSON(w, http.StatusOK, response)
+}
+
+// isTerminalDeploymentStatus reports whether a deployment has finished
+func isTerminalDeploymentStatus(status string) bool {
+	switch status {
+	case "completed", "failed", "partial", "rolled_back", "cancelled", "rejected":
+		return true
+	default:
+		return false
 	}
+}
 
-	logs, err := s.db.GetComponentLogsByComponent(componentName, since, limit)
+// handleDeploymentEvents streams a deployment's logs and node status changes
+// as server-sent events, ending with a "done" event carrying the deployment
+// once it has finished. Only changes written by this controller are
+// streamed; the final event is found by polling the database.
+func (s *Server) handleDeploymentEvents(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.Parse(mux.Vars(r)["id"])
 	if err != nil {
-		log.WithError(err).Error("Failed to get component logs")
-		respondError(w, http.StatusInternalServerError, "Failed to get component logs")
+		respondError(w, http.StatusBadRequest, "Invalid deployment ID")
 		return
 	}
 
-	respondJSON(w, http.StatusOK, logs)
-}
-
-func (s *Server) handleGetComponentNodeLogs(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	componentName := vars["component_name"]
-	nodeHostname := vars["node_hostname"]
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		respondError(w, http.StatusInternalServerError, "Streaming is not supported")
+		return
+	}
 
-	sinceStr := r.URL.Query().Get("since")
-	limitStr := r.URL.Query().Get("limit")
+	// Subscribe first so nothing written after the lookup is missed
+	ch, unsubscribe := s.events.Subscribe(id)
+	defer unsubscribe()
 
-	var since time.Time
-	if sinceStr != "" {
-		if s, err := time.Parse(time.RFC3339, sinceStr); err == nil {
-			since = s
-		}
+	deployment, err := s.db.GetDeployment(id)
+	if err != nil {
+		respondLookupError(w, err, "Deployment")
+		return
 	}
 
-	limit := 1000
-	if limitStr != "" {
-		if l, err := strconv.Atoi(limitStr); err == nil && l > 0 {
-			limit = l
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	send := func(event string, data interface{}) bool {
+		payload, err := json.Marshal(data)
+		if err != nil {
+			requestLog(r).WithError(err).Warn("Failed to encode deployment event")
+			return true
+		}
+		if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, payload); err != nil {
+			return false
 		}
+		flusher.Flush()
+		return true
 	}
 
-	logs, err := s.db.GetComponentLogs(componentName, nodeHostname, since, limit)
-	if err != nil {
-		log.WithError(err).Error("Failed to get component logs")
-		respondError(w, http.StatusInternalServerError, "Failed to get component logs")
+	if isTerminalDeploymentStatus(deployment.Status) {
+		send("done", deployment)
 		return
 	}
 
-	respondJSON(w, http.StatusOK, logs)
-}
+	ticker := time.NewTicker(s.eventPoll)
+	defer ticker.Stop()
 
-func respondJSON(w http.ResponseWriter, status int, data interface{}) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(status)
-	json.NewEncoder(w).Encode(data)
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event := <-ch:
+			if !send(event.Type, event.Data) {
+				return
+			}
+		case <-ticker.C:
+			deployment, err := s.db.GetDeployment(id)
+			if err != nil {
+				requestLog(r).WithError(err).WithField("deployment_id", id).Warn("Failed to check deployment status")
+				continue
+			}
+			if isTerminalDeploymentStatus(deployment.Status) {
+				send("done", deployment)
+				return
+			}
+		}
+	}
 }
 
-func respondError(w http.ResponseWriter, status int, message string) {
-	respondJSON(w, status, ErrorResponse{Error: message})
-}
+// handleCancelDeployment stops a pending or running deployment. Nothing more
+// is sent to the nodes, but operations agents already received still run.
+func (s *Server) handleCancelDeployment(w http.ResponseWriter, r *http.Request) {
+	id, err := uuid.Parse(mux.Vars(r)["id"])
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid deployment ID")
+		return
+	}
 
-func loggingMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		start := time.Now()
+	deployment, err := s.db.GetDeployment(id)
+	if err != nil {
+		respondLookupError(w, err, "Deployment")
+		return
+	}
+
+	message := "Cancelled via API"
+	cancelled, err := s.db.CancelDeployment(id, message)
+	if err != nil {
+		requestLog(r).WithError(err).Error("Failed to cancel deployment")
+		respondError(w, http.StatusInternalServerError, "Failed to cancel deployment")
+		return
+	}
+	if !cancelled {
+		respondError(w, http.StatusConflict, fmt.Sprintf("Deployment is %s, not pending or running", deployment.Status))
+		return
+	}
+
+	signalled := s.reconciler.CancelDeployment(id)
+
+	cancelLog := &database.DeploymentLog{
+		DeploymentID: id,
+		Operation:    "cancel",
+		Status:       "cancelled",
+		Message:      message,
+	}
+	s.db.LogDeployment(cancelLog)
+	s.events.Publish(events.Event{DeploymentID: id, Type: events.TypeLog, Data: cancelLog})
+
+	requestLog(r).WithFields(log.Fields{
+		"deployment_id": id,
+		"was_status":    deployment.Status,
+		"signalled":     signalled,
+	}).Info("Deployment cancelled")
+
+	deployment, err = s.db.GetDeployment(id)
+	if err != nil {
+		respondLookupError(w, err, "Deployment")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, deployment)
+}
+
+// summarizeDeployment aggregates the per-node states of a deployment. Nodes
+// that are running (or stopped, for a stop) count as deployed, failed and
+// rolled back ones as failed, and the rest as still pending.
+func summarizeDeployment(deployment *database.Deployment, statuses []models.ComponentStatus) models.DeploymentStatus {
+	components := make(map[string]bool)
+	nodes := make(map[string]bool)
+	summary := models.DeploymentSummary{}
+
+	for _, status := range statuses {
+		components[status.ComponentName] = true
+		nodes[status.NodeHostname] = true
+
+		switch status.Status {
+		case "running", "stopped":
+			summary.Deployed++
+		case "failed", "rolled_back":
+			summary.Failed++
+		default:
+			summary.Pending++
+		}
+	}
+
+	summary.TotalComponents = len(components)
+	summary.TotalNodes = len(nodes)
+
+	if statuses == nil {
+		statuses = []models.ComponentStatus{}
+	}
+
+	return models.DeploymentStatus{
+		ID:              deployment.ID,
+		Status:          deployment.Status,
+		CreatedAt:       deployment.CreatedAt,
+		StartedAt:       deployment.StartedAt,
+		CompletedAt:     deployment.CompletedAt,
+		ComponentStatus: statuses,
+		Summary:         summary,
+	}
+}
+
+func (s *Server) handleListComponents(w http.ResponseWriter, r *http.Request) {
+	filter, err := componentFilter(r.URL.Query())
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	paginated, limit, offset := pagination(r)
+	if paginated {
+		filter.Limit, filter.Offset = limit, offset
+	}
+
+	components, err := s.db.ListComponentsFiltered(filter)
+	if err != nil {
+		requestLog(r).WithError(err).Error("Failed to list components")
+		respondError(w, http.StatusInternalServerError, "Failed to list components")
+		return
+	}
+
+	if !paginated {
+		respondJSON(w, http.StatusOK, components)
+		return
+	}
+
+	total, err := s.db.CountComponentsFiltered(filter)
+	if err != nil {
+		requestLog(r).WithError(err).Error("Failed to count components")
+		respondError(w, http.StatusInternalServerError, "Failed to list components")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, Page{Items: components, Total: total, Limit: limit, Offset: offset})
+}
+
+type ComponentRemovalResult struct {
+	Component string `json:"component"`
+	Status    string `json:"status"`
+	Error     string `json:"error,omitempty"`
+}
+
+type BulkRemovalResponse struct {
+	DeploymentID uuid.UUID                `json:"deployment_id"`
+	Tag          string                   `json:"tag"`
+	Results      []ComponentRemovalResult `json:"results"`
+}
+
+// handleBulkRemoveComponents removes every component carrying the given tag.
+// The confirm=true parameter is required to guard against accidental deletes.
+func (s *Server) handleBulkRemoveComponents(w http.ResponseWriter, r *http.Request) {
+	tag := r.URL.Query().Get("tag")
+	if tag == "" {
+		respondError(w, http.StatusBadRequest, "tag parameter is required")
+		return
+	}
+
+	if r.URL.Query().Get("confirm") != "true" {
+		respondError(w, http.StatusBadRequest, "Bulk removal requires confirm=true")
+		return
+	}
+
+	if s.leader != nil && !s.leader.IsLeader() {
+		respondError(w, http.StatusServiceUnavailable, fmt.Sprintf("Bulk removal must be sent to the leader controller (%s)", s.leader.Leader()))
+		return
+	}
+
+	components, err := s.db.ListComponentsByTag(tag)
+	if err != nil {
+		requestLog(r).WithError(err).Error("Failed to list components by tag")
+		respondError(w, http.StatusInternalServerError, "Failed to list components")
+		return
+	}
+
+	names := make([]string, 0, len(components))
+	for _, comp := range components {
+		names = append(names, comp.Name)
+	}
+
+	configJSON, err := json.Marshal(map[string]interface{}{
+		"operation":          "bulk-remove",
+		"tag":                tag,
+		"removed_components": names,
+	})
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to serialize configuration")
+		return
+	}
+
+	deployment := &database.Deployment{
+		ID:            uuid.New(),
+		Configuration: configJSON,
+		Status:        "running",
+		CreatedAt:     time.Now(),
+		CreatedBy:     "bulk-remove",
+		RequestID:     util.RequestIDFromContext(r.Context()),
+	}
+
+	if err := s.db.CreateDeployment(deployment); err != nil {
+		requestLog(r).WithError(err).Error("Failed to create deployment")
+		respondError(w, http.StatusInternalServerError, "Failed to create deployment")
+		return
+	}
+
+	errs := s.reconciler.RemoveComponents(deployment.ID, components)
+
+	response := BulkRemovalResponse{
+		DeploymentID: deployment.ID,
+		Tag:          tag,
+		Results:      make([]ComponentRemovalResult, 0, len(names)),
+	}
+
+	for _, name := range names {
+		result := ComponentRemovalResult{Component: name, Status: "removed"}
+		if err := errs[name]; err != nil {
+			result.Status = "failed"
+			result.Error = err.Error()
+		}
+		response.Results = append(response.Results, result)
+	}
+
+	respondJSON(w, http.StatusOK, response)
+}
+
+func (s *Server) handleGetComponent(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name := vars["name"]
+
+	component, err := s.db.GetComponent(name)
+	if err != nil {
+		respondLookupError(w, err, "Component")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, component)
+}
+
+func (s *Server) handleGetComponentDeployments(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name := vars["name"]
+
+	deployments, err := s.db.GetComponentDeployments(name)
+	if err != nil {
+		requestLog(r).WithError(err).Error("Failed to get component deployments")
+		respondError(w, http.StatusInternalServerError, "Failed to get component deployments")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, deployments)
+}
+
+func (s *Server) handleGetComponentHistory(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name := vars["name"]
+	_, limit, _ := pagination(r)
+
+	history, err := s.db.GetComponentHistory(name, limit)
+	if err != nil {
+		requestLog(r).WithError(err).Error("Failed to get component history")
+		respondError(w, http.StatusInternalServerError, "Failed to get component history")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, history)
+}
+
+func (s *Server) handleListNodes(w http.ResponseWriter, r *http.Request) {
+	filter, err := nodeFilter(r.URL.Query())
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	paginated, limit, offset := pagination(r)
+	if paginated {
+		filter.Limit, filter.Offset = limit, offset
+	}
+
+	nodes, err := s.db.ListNodesFiltered(filter)
+	if err != nil {
+		requestLog(r).WithError(err).Error("Failed to list nodes")
+		respondError(w, http.StatusInternalServerError, "Failed to list nodes")
+		return
+	}
+
+	if !paginated {
+		respondJSON(w, http.StatusOK, nodes)
+		return
+	}
+
+	total, err := s.db.CountNodesFiltered(filter)
+	if err != nil {
+		requestLog(r).WithError(err).Error("Failed to count nodes")
+		respondError(w, http.StatusInternalServerError, "Failed to list nodes")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, Page{Items: nodes, Total: total, Limit: limit, Offset: offset})
+}
+
+func (s *Server) handleGetNode(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	hostname := vars["hostname"]
+
+	node, err := s.db.GetNode(hostname)
+	if err != nil {
+		respondLookupError(w, err, "Node")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, node)
+}
+
+type NodeTagsRequest struct {
+	Tags []string `json:"tags"`
+}
+
+type NodeTagsPatch struct {
+	Add    []string `json:"add"`
+	Remove []string `json:"remove"`
+}
+
+// cleanTags trims tags and rejects empty ones
+func cleanTags(tags []string) ([]string, error) {
+	cleaned := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		tag = strings.TrimSpace(tag)
+		if tag == "" {
+			return nil, fmt.Errorf("tags must not be empty")
+		}
+		cleaned = append(cleaned, tag)
+	}
+	return cleaned, nil
+}
+
+// handleSetNodeTags replaces a node's tags. The tags are kept by the
+// command-core sync, which only adds the tags it reports.
+func (s *Server) handleSetNodeTags(w http.ResponseWriter, r *http.Request) {
+	hostname := mux.Vars(r)["hostname"]
+
+	var req NodeTagsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, fmt.Sprintf("Invalid request body: %v", err))
+		return
+	}
+
+	tags, err := cleanTags(req.Tags)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	node, err := s.db.SetNodeTags(hostname, tags)
+	if err != nil {
+		respondLookupError(w, err, "Node")
+		return
+	}
+
+	requestLog(r).WithFields(log.Fields{
+		"hostname": hostname,
+		"tags":     node.Tags,
+	}).Info("Node tags set")
+
+	respondJSON(w, http.StatusOK, node)
+}
+
+// handleUpdateNodeTags adds and removes tags on a node
+func (s *Server) handleUpdateNodeTags(w http.ResponseWriter, r *http.Request) {
+	hostname := mux.Vars(r)["hostname"]
+
+	var req NodeTagsPatch
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, fmt.Sprintf("Invalid request body: %v", err))
+		return
+	}
+
+	add, err := cleanTags(req.Add)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	remove, err := cleanTags(req.Remove)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(add) == 0 && len(remove) == 0 {
+		respondError(w, http.StatusBadRequest, "add or remove is required")
+		return
+	}
+
+	node, err := s.db.UpdateNodeTags(hostname, add, remove)
+	if err != nil {
+		respondLookupError(w, err, "Node")
+		return
+	}
+
+	requestLog(r).WithFields(log.Fields{
+		"hostname": hostname,
+		"added":    add,
+		"removed":  remove,
+	}).Info("Node tags updated")
+
+	respondJSON(w, http.StatusOK, node)
+}
+
+func (s *Server) handleGetNodeComponents(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	hostname := vars["hostname"]
+
+	deployments, err := s.db.GetNodeDeployments(hostname)
+	if err != nil {
+		requestLog(r).WithError(err).Error("Failed to get node components")
+		respondError(w, http.StatusInternalServerError, "Failed to get node components")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, deployments)
+}
+
+type DriftEntry struct {
+	Component string `json:"component"`
+	Status    string `json:"status,omitempty"`
+	Message   string `json:"message,omitempty"`
+}
+
+type NodeDriftResponse struct {
+	Hostname string       `json:"hostname"`
+	InSync   bool         `json:"in_sync"`
+	Desired  []string     `json:"desired"`
+	Running  []string     `json:"running"`
+	Missing  []DriftEntry `json:"missing"`
+	Extra    []DriftEntry `json:"extra"`
+}
+
+// handleGetNodeDrift compares the agent components a node should run (by tag)
+// with what it reports. Missing components are desired but not running;
+// extra components are reported but no longer target the node.
+func (s *Server) handleGetNodeDrift(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	hostname := vars["hostname"]
+
+	node, err := s.db.GetNode(hostname)
+	if err != nil {
+		respondLookupError(w, err, "Node")
+		return
+	}
+
+	components, err := s.db.ListComponents()
+	if err != nil {
+		requestLog(r).WithError(err).Error("Failed to list components")
+		respondError(w, http.StatusInternalServerError, "Failed to list components")
+		return
+	}
+
+	deployments, err := s.db.GetNodeDeployments(hostname)
+	if err != nil {
+		requestLog(r).WithError(err).Error("Failed to get node components")
+		respondError(w, http.StatusInternalServerError, "Failed to get node components")
+		return
+	}
+
+	reported := make(map[string]database.ComponentDeployment, len(deployments))
+	for _, dep := range deployments {
+		reported[dep.ComponentName] = dep
+	}
+
+	response := NodeDriftResponse{
+		Hostname: hostname,
+		Desired:  []string{},
+		Running:  []string{},
+		Missing:  []DriftEntry{},
+		Extra:    []DriftEntry{},
+	}
+
+	desired := make(map[string]bool)
+	for _, comp := range components {
+		if comp.Handler != "agent" || !targetsNode(comp.Tags, node.Tags) {
+			continue
+		}
+
+		desired[comp.Name] = true
+		response.Desired = append(response.Desired, comp.Name)
+
+		dep, ok := reported[comp.Name]
+		if !ok {
+			response.Missing = append(response.Missing, DriftEntry{Component: comp.Name, Message: "Not reported by node"})
+			continue
+		}
+
+		if dep.Status == "running" {
+			response.Running = append(response.Running, comp.Name)
+		} else {
+			response.Missing = append(response.Missing, DriftEntry{Component: comp.Name, Status: dep.Status, Message: dep.Message})
+		}
+	}
+
+	for _, dep := range deployments {
+		if desired[dep.ComponentName] {
+			continue
+		}
+
+		if dep.Status == "running" {
+			response.Running = append(response.Running, dep.ComponentName)
+		}
+		response.Extra = append(response.Extra, DriftEntry{Component: dep.ComponentName, Status: dep.Status, Message: dep.Message})
+	}
+
+	response.InSync = len(response.Missing) == 0 && len(response.Extra) == 0
+
+	respondJSON(w, http.StatusOK, response)
+}
+
+// targetsNode reports whether a component with the given tags is placed on a
+// node with nodeTags. Components without tags target every node.
+func targetsNode(componentTags, nodeTags []string) bool {
+	if len(componentTags) == 0 {
+		return true
+	}
+
+	for _, tag := range componentTags {
+		for _, nodeTag := range nodeTags {
+			if tag == nodeTag {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+const (
+	defaultLogLines = 200
+	maxLogLines     = 5000
+
+	// logRequestTimeout bounds how long a live log request waits for the agent
+	logRequestTimeout = 10 * time.Second
+)
+
+// handleGetNodeComponentLiveLogs fetches the tail of a component's log
+// directly from the agent rather than from the logs stored by the controller
+func (s *Server) handleGetNodeComponentLiveLogs(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	hostname := vars["hostname"]
+	componentName := vars["name"]
+
+	lines := defaultLogLines
+	if value := r.URL.Query().Get("lines"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 || parsed > maxLogLines {
+			respondError(w, http.StatusBadRequest, fmt.Sprintf("lines must be between 1 and %d", maxLogLines))
+			return
+		}
+		lines = parsed
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), logRequestTimeout)
+	defer cancel()
+
+	logData, err := s.agents.RequestLogs(ctx, hostname, componentName, lines)
+	if err != nil {
+		switch {
+		case errors.Is(err, grpcserver.ErrAgentNotConnected):
+			respondError(w, http.StatusServiceUnavailable, "Agent not connected")
+		case errors.Is(err, context.DeadlineExceeded):
+			respondError(w, http.StatusGatewayTimeout, "Timed out waiting for agent")
+		default:
+			requestLog(r).WithError(err).WithFields(log.Fields{
+				"hostname":  hostname,
+				"component": componentName,
+			}).Error("Failed to fetch logs from agent")
+			respondError(w, http.StatusBadGateway, err.Error())
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(logData))
+}
+
+// controlRequestTimeout covers a graceful stop followed by a start
+const controlRequestTimeout = 60 * time.Second
+
+type ControlResponse struct {
+	Hostname  string `json:"hostname"`
+	Component string `json:"component"`
+	Action    string `json:"action"`
+	Message   string `json:"message"`
+}
+
+// handleControlNodeComponent restarts, stops or starts a component on one
+// node and reports the agent's result
+func (s *Server) handleControlNodeComponent(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	hostname := vars["hostname"]
+	componentName := vars["name"]
+	action := vars["action"]
+
+	ctx, cancel := context.WithTimeout(r.Context(), controlRequestTimeout)
+	defer cancel()
+
+	message, err := s.agents.SendControl(ctx, hostname, action, componentName)
+	if err != nil {
+		switch {
+		case errors.Is(err, grpcserver.ErrAgentNotConnected):
+			respondError(w, http.StatusServiceUnavailable, "Agent not connected")
+		case errors.Is(err, context.DeadlineExceeded):
+			respondError(w, http.StatusGatewayTimeout, "Timed out waiting for agent")
+		default:
+			requestLog(r).WithError(err).WithFields(log.Fields{
+				"hostname":  hostname,
+				"component": componentName,
+				"action":    action,
+			}).Error("Component control failed")
+			respondError(w, http.StatusBadGateway, err.Error())
+		}
+		return
+	}
+
+	respondJSON(w, http.StatusOK, ControlResponse{
+		Hostname:  hostname,
+		Component: componentName,
+		Action:    action,
+		Message:   message,
+	})
+}
+
+type NodeControlResult struct {
+	Hostname string `json:"hostname"`
+	// Status is restarted, not_connected, not_deployed, timeout or failed
+	Status  string `json:"status"`
+	Message string `json:"message,omitempty"`
+}
+
+type ComponentRestartResponse struct {
+	Component string              `json:"component"`
+	Restarted int                 `json:"restarted"`
+	Failed    int                 `json:"failed"`
+	Results   []NodeControlResult `json:"results"`
+}
+
+// handleRestartComponent restarts a component on every node it is deployed
+// to, or on the subset given by ?nodes=host1,host2, and reports the outcome
+// per node
+func (s *Server) handleRestartComponent(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+
+	if _, err := s.db.GetComponent(name); err != nil {
+		respondLookupError(w, err, "Component")
+		return
+	}
+
+	deployments, err := s.db.GetComponentDeployments(name)
+	if err != nil {
+		requestLog(r).WithError(err).Error("Failed to get component deployments")
+		respondError(w, http.StatusInternalServerError, "Failed to get component deployments")
+		return
+	}
+
+	var only []string
+	if nodes := r.URL.Query().Get("nodes"); nodes != "" {
+		only = strings.Split(nodes, ",")
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), controlRequestTimeout)
+	defer cancel()
+
+	response := ComponentRestartResponse{
+		Component: name,
+		Results:   s.restartOnNodes(ctx, name, restartTargets(deployments, only)),
+	}
+	for _, result := range response.Results {
+		if result.Status == "restarted" {
+			response.Restarted++
+		} else {
+			response.Failed++
+		}
+	}
+
+	requestLog(r).WithFields(log.Fields{
+		"component": name,
+		"restarted": response.Restarted,
+		"failed":    response.Failed,
+	}).Info("Component restarted across nodes")
+
+	respondJSON(w, http.StatusOK, response)
+}
+
+// restartTargets returns the nodes to restart on: those the component is
+// deployed to, narrowed to only when it is set. Requested nodes that don't
+// run the component are returned with deployed false.
+func restartTargets(deployments []database.ComponentDeployment, only []string) map[string]bool {
+	targets := make(map[string]bool)
+
+	if len(only) == 0 {
+		for _, dep := range deployments {
+			targets[dep.NodeHostname] = true
+		}
+		return targets
+	}
+
+	for _, hostname := range only {
+		if hostname = strings.TrimSpace(hostname); hostname != "" {
+			targets[hostname] = false
+		}
+	}
+	for _, dep := range deployments {
+		if _, ok := targets[dep.NodeHostname]; ok {
+			targets[dep.NodeHostname] = true
+		}
+	}
+	return targets
+}
+
+// restartOnNodes sends a restart to the agent of each deployed target at the
+// same time and collects the results, sorted by hostname
+func (s *Server) restartOnNodes(ctx context.Context, name string, targets map[string]bool) []NodeControlResult {
+	results := make(chan NodeControlResult, len(targets))
+
+	for hostname, deployed := range targets {
+		if !deployed {
+			results <- NodeControlResult{Hostname: hostname, Status: "not_deployed", Message: "Component is not deployed to this node"}
+			continue
+		}
+
+		go func(hostname string) {
+			message, err := s.agents.SendControl(ctx, hostname, "restart", name)
+			switch {
+			case err == nil:
+				results <- NodeControlResult{Hostname: hostname, Status: "restarted", Message: message}
+			case errors.Is(err, grpcserver.ErrAgentNotConnected):
+				results <- NodeControlResult{Hostname: hostname, Status: "not_connected", Message: "Agent not connected"}
+			case errors.Is(err, context.DeadlineExceeded):
+				results <- NodeControlResult{Hostname: hostname, Status: "timeout", Message: "Timed out waiting for agent"}
+			default:
+				results <- NodeControlResult{Hostname: hostname, Status: "failed", Message: err.Error()}
+			}
+		}(hostname)
+	}
+
+	collected := make([]NodeControlResult, 0, len(targets))
+	for range targets {
+		collected = append(collected, <-results)
+	}
+
+	sort.Slice(collected, func(i, j int) bool { return collected[i].Hostname < collected[j].Hostname })
+	return collected
+}
+
+type LogLevelRequest struct {
+	Level string `json:"level"`
+}
+
+type DrainResponse struct {
+	Hostname string                   `json:"hostname"`
+	Draining bool                     `json:"draining"`
+	Message  string                   `json:"message,omitempty"`
+	Results  []ComponentRemovalResult `json:"results,omitempty"`
+}
+
+// handleDrainNode stops new deployments to a node and removes the agent
+// components running on it, e.g. before maintenance
+func (s *Server) handleDrainNode(w http.ResponseWriter, r *http.Request) {
+	hostname := mux.Vars(r)["hostname"]
+
+	found, err := s.db.SetNodeDraining(hostname, true)
+	if err != nil {
+		requestLog(r).WithError(err).WithField("hostname", hostname).Error("Failed to mark node draining")
+		respondError(w, http.StatusInternalServerError, "Failed to drain node")
+		return
+	}
+	if !found {
+		respondError(w, http.StatusNotFound, "Node not found")
+		return
+	}
+
+	errs, err := s.reconciler.DrainNode(hostname)
+	if err != nil {
+		requestLog(r).WithError(err).WithField("hostname", hostname).Error("Failed to drain node")
+		respondError(w, http.StatusInternalServerError, fmt.Sprintf("Node marked draining, but removing its components failed: %v", err))
+		return
+	}
+
+	response := DrainResponse{Hostname: hostname, Draining: true, Results: make([]ComponentRemovalResult, 0, len(errs))}
+	for name, err := range errs {
+		result := ComponentRemovalResult{Component: name, Status: "removed"}
+		if err != nil {
+			result.Status = "failed"
+			result.Error = err.Error()
+		}
+		response.Results = append(response.Results, result)
+	}
+	sort.Slice(response.Results, func(i, j int) bool { return response.Results[i].Component < response.Results[j].Component })
+
+	requestLog(r).WithFields(log.Fields{
+		"hostname":   hostname,
+		"components": len(response.Results),
+	}).Info("Node drained")
+
+	respondJSON(w, http.StatusOK, response)
+}
+
+// handleUncordonNode lets a drained node take deployments again and
+// redeploys the components it was running
+func (s *Server) handleUncordonNode(w http.ResponseWriter, r *http.Request) {
+	hostname := mux.Vars(r)["hostname"]
+
+	found, err := s.db.SetNodeDraining(hostname, false)
+	if err != nil {
+		requestLog(r).WithError(err).WithField("hostname", hostname).Error("Failed to uncordon node")
+		respondError(w, http.StatusInternalServerError, "Failed to uncordon node")
+		return
+	}
+	if !found {
+		respondError(w, http.StatusNotFound, "Node not found")
+		return
+	}
+
+	go s.reconciler.SyncNode(hostname)
+
+	requestLog(r).WithField("hostname", hostname).Info("Node uncordoned")
+
+	respondJSON(w, http.StatusOK, DrainResponse{
+		Hostname: hostname,
+		Draining: false,
+		Message:  "Node uncordoned; redeploying its components",
+	})
+}
+
+func (s *Server) handleSetNodeLogLevel(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	hostname := vars["hostname"]
+
+	var req LogLevelRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, fmt.Sprintf("Invalid request body: %v", err))
+		return
+	}
+
+	level, err := log.ParseLevel(req.Level)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, fmt.Sprintf("Invalid log level: %s", req.Level))
+		return
+	}
+
+	if err := s.agents.SendLogLevel(hostname, level.String()); err != nil {
+		if errors.Is(err, grpcserver.ErrAgentNotConnected) {
+			respondError(w, http.StatusServiceUnavailable, "Agent not connected")
+			return
+		}
+		requestLog(r).WithError(err).WithField("hostname", hostname).Error("Failed to send log level change")
+		respondError(w, http.StatusInternalServerError, "Failed to send log level change")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]string{
+		"hostname": hostname,
+		"level":    level.String(),
+	})
+}
+
+type ClearComponentResponse struct {
+	Component    string                        `json:"component"`
+	Node         string                        `json:"node"`
+	Cleared      *database.ComponentDeployment `json:"cleared"`
+	DeploymentID *uuid.UUID                    `json:"deployment_id,omitempty"`
+	Message      string                        `json:"message,omitempty"`
+}
+
+// handleClearNodeComponent deletes a component's deployment record on one
+// node, e.g. one stuck in "deploying" because the agent never reported back.
+// With redeploy=true the component is sent to that node again.
+func (s *Server) handleClearNodeComponent(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	hostname := vars["hostname"]
+	name := vars["name"]
+	redeploy := r.URL.Query().Get("redeploy") == "true"
+
+	if redeploy && s.leader != nil && !s.leader.IsLeader() {
+		respondError(w, http.StatusServiceUnavailable, fmt.Sprintf("Redeploy must be sent to the leader controller (%s)", s.leader.Leader()))
+		return
+	}
+
+	existing, err := s.db.GetComponentDeployment(name, hostname)
+	if err != nil {
+		respondLookupError(w, err, "Component deployment")
+		return
+	}
+
+	if err := s.db.DeleteComponentDeployments(name, hostname); err != nil {
+		requestLog(r).WithError(err).Error("Failed to clear component deployment")
+		respondError(w, http.StatusInternalServerError, "Failed to clear component deployment")
+		return
+	}
+
+	requestLog(r).WithFields(log.Fields{
+		"component": name,
+		"node":      hostname,
+		"status":    existing.Status,
+	}).Warn("Cleared component deployment record")
+
+	response := ClearComponentResponse{
+		Component: name,
+		Node:      hostname,
+		Cleared:   existing,
+	}
+
+	if !redeploy {
+		respondJSON(w, http.StatusOK, response)
+		return
+	}
+
+	component, err := s.db.GetComponent(name)
+	if errors.Is(err, database.ErrNotFound) {
+		response.Message = "Cleared, but the component no longer exists so it was not redeployed"
+		respondJSON(w, http.StatusOK, response)
+		return
+	}
+	if err != nil {
+		requestLog(r).WithError(err).Error("Failed to get component for redeploy")
+		respondError(w, http.StatusInternalServerError, "Cleared, but failed to look up the component to redeploy")
+		return
+	}
+
+	configJSON, err := json.Marshal(map[string]interface{}{
+		"operation": "redeploy",
+		"component": name,
+		"node":      hostname,
+	})
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to serialize configuration")
+		return
+	}
+
+	deployment := &database.Deployment{
+		ID:            uuid.New(),
+		Configuration: configJSON,
+		Status:        "running",
+		CreatedAt:     time.Now(),
+		CreatedBy:     "clear-redeploy",
+		RequestID:     util.RequestIDFromContext(r.Context()),
+	}
+
+	if err := s.db.CreateDeployment(deployment); err != nil {
+		requestLog(r).WithError(err).Error("Failed to create deployment")
+		respondError(w, http.StatusInternalServerError, "Failed to create deployment")
+		return
+	}
+
+	response.DeploymentID = &deployment.ID
+
+	if err := s.reconciler.RedeployToNode(deployment.ID, component, hostname); err != nil {
+		response.Message = fmt.Sprintf("Cleared, but redeploy failed: %v", err)
+		respondJSON(w, http.StatusOK, response)
+		return
+	}
+
+	response.Message = "Cleared and redeployed"
+	respondJSON(w, http.StatusOK, response)
+}
+
+func (s *Server) handleListAgents(w http.ResponseWriter, r *http.Request) {
+	if staleStr := r.URL.Query().Get("stale_for"); staleStr != "" {
+		staleFor, err := time.ParseDuration(staleStr)
+		if err != nil || staleFor <= 0 {
+			respondError(w, http.StatusBadRequest, "Invalid stale_for duration")
+			return
+		}
+		s.listStaleAgents(w, r, time.Now().Add(-staleFor))
+		return
+	}
+
+	onlineOnly := r.URL.Query().Get("online") == "true"
+	paginated, limit, offset := pagination(r)
+
+	if !paginated {
+		agents, err := s.db.ListAgents(onlineOnly)
+		if err != nil {
+			requestLog(r).WithError(err).Error("Failed to list agents")
+			respondError(w, http.StatusInternalServerError, "Failed to list agents")
+			return
+		}
+
+		respondJSON(w, http.StatusOK, agents)
+		return
+	}
+
+	agents, err := s.db.ListAgentsPage(onlineOnly, limit, offset)
+	if err != nil {
+		requestLog(r).WithError(err).Error("Failed to list agents")
+		respondError(w, http.StatusInternalServerError, "Failed to list agents")
+		return
+	}
+
+	total, err := s.db.CountAgents(onlineOnly)
+	if err != nil {
+		requestLog(r).WithError(err).Error("Failed to count agents")
+		respondError(w, http.StatusInternalServerError, "Failed to list agents")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, Page{Items: agents, Total: total, Limit: limit, Offset: offset})
+}
+
+func (s *Server) listStaleAgents(w http.ResponseWriter, r *http.Request, heartbeatBefore time.Time) {
+	paginated, limit, offset := pagination(r)
+
+	if !paginated {
+		agents, err := s.db.ListStaleAgents(heartbeatBefore)
+		if err != nil {
+			requestLog(r).WithError(err).Error("Failed to list stale agents")
+			respondError(w, http.StatusInternalServerError, "Failed to list stale agents")
+			return
+		}
+
+		respondJSON(w, http.StatusOK, agents)
+		return
+	}
+
+	agents, err := s.db.ListStaleAgentsPage(heartbeatBefore, limit, offset)
+	if err != nil {
+		requestLog(r).WithError(err).Error("Failed to list stale agents")
+		respondError(w, http.StatusInternalServerError, "Failed to list stale agents")
+		return
+	}
+
+	total, err := s.db.CountStaleAgents(heartbeatBefore)
+	if err != nil {
+		requestLog(r).WithError(err).Error("Failed to count stale agents")
+		respondError(w, http.StatusInternalServerError, "Failed to list stale agents")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, Page{Items: agents, Total: total, Limit: limit, Offset: offset})
+}
+
+func (s *Server) handleGetAgent(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	hostname := vars["hostname"]
+
+	agent, err := s.db.GetAgent(hostname)
+	if err != nil {
+		respondLookupError(w, err, "Agent")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, agent)
+}
+
+func (s *Server) handleGetComponentLogs(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	componentName := vars["component_name"]
+
+	sinceStr := r.URL.Query().Get("since")
+	limitStr := r.URL.Query().Get("limit")
+
+	var since time.Time
+	if sinceStr != "" {
+		if s, err := time.Parse(time.RFC3339, sinceStr); err == nil {
+			since = s
+		}
+	}
+
+	limit := 1000
+	if limitStr != "" {
+		if l, err := strconv.Atoi(limitStr); err == nil && l > 0 {
+			limit = l
+		}
+	}
+
+	logs, err := s.db.GetComponentLogsByComponent(componentName, since, limit)
+	if err != nil {
+		requestLog(r).WithError(err).Error("Failed to get component logs")
+		respondError(w, http.StatusInternalServerError, "Failed to get component logs")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, logs)
+}
+
+func (s *Server) handleGetComponentNodeLogs(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	componentName := vars["component_name"]
+	nodeHostname := vars["node_hostname"]
+
+	sinceStr := r.URL.Query().Get("since")
+	limitStr := r.URL.Query().Get("limit")
+
+	var since time.Time
+	if sinceStr != "" {
+		if s, err := time.Parse(time.RFC3339, sinceStr); err == nil {
+			since = s
+		}
+	}
+
+	limit := 1000
+	if limitStr != "" {
+		if l, err := strconv.Atoi(limitStr); err == nil && l > 0 {
+			limit = l
+		}
+	}
+
+	logs, err := s.db.GetComponentLogs(componentName, nodeHostname, since, limit)
+	if err != nil {
+		requestLog(r).WithError(err).Error("Failed to get component logs")
+		respondError(w, http.StatusInternalServerError, "Failed to get component logs")
+		return
+	}
+
+	respondJSON(w, http.StatusOK, logs)
+}
+
+func respondJSON(w http.ResponseWriter, status int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(data)
+}
+
+func respondError(w http.ResponseWriter, status int, message string) {
+	respondJSON(w, status, ErrorResponse{Error: message})
+}
+
+// respondLookupError answers a failed single-record lookup: 404 when the
+// record doesn't exist, 500 when the database itself failed
+func respondLookupError(w http.ResponseWriter, err error, resource string) {
+	if errors.Is(err, database.ErrNotFound) {
+		respondError(w, http.StatusNotFound, resource+" not found")
+		return
+	}
+
+	log.WithError(err).WithField("resource", resource).Error("Database lookup failed")
+	respondError(w, http.StatusInternalServerError, "Failed to get "+strings.ToLower(resource))
+}
+
+// requestIDMiddleware gives every request an ID, keeping the client's own if
+// it sent a usable one, and returns it in the response headers
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(util.RequestIDHeader)
+		if !util.ValidRequestID(id) {
+			id = util.NewRequestID()
+		}
+
+		w.Header().Set(util.RequestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(util.WithRequestID(r.Context(), id)))
+	})
+}
+
+// requestLog returns a logger tagged with the request's ID
+func requestLog(r *http.Request) *log.Entry {
+	return log.WithField("request_id", util.RequestIDFromContext(r.Context()))
+}
+
+func loggingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
 
 		wrapped := &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
 
 		next.ServeHTTP(wrapped, r)
 
-		log.WithFields(log.Fields{
+		requestLog(r).WithFields(log.Fields{
 			"method":      r.Method,
 			"path":        r.URL.Path,
 			"status":      wrapped.statusCode,
@@ -439,8 +1841,9 @@ func loggingMiddleware(next http.Handler) http.Handler {
 func corsMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, "+util.RequestIDHeader)
+		w.Header().Set("Access-Control-Expose-Headers", util.RequestIDHeader)
 
 		if r.Method == "OPTIONS" {
 			w.WriteHeader(http.StatusOK)
@@ -460,3 +1863,10 @@ func (rw *responseWriter) WriteHeader(code int) {
 	rw.statusCode = code
 	rw.ResponseWriter.WriteHeader(code)
 }
+
+// Flush lets streaming handlers flush through the logging middleware
+func (rw *responseWriter) Flush() {
+	if flusher, ok := rw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
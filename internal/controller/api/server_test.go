@@ -0,0 +1,828 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/metorial/fleet/cosmos/internal/controller/database"
+	"github.com/metorial/fleet/cosmos/internal/controller/database/dbtest"
+	grpcserver "github.com/metorial/fleet/cosmos/internal/controller/grpc"
+	"github.com/metorial/fleet/cosmos/internal/controller/types"
+	"github.com/metorial/fleet/cosmos/internal/models"
+	"github.com/metorial/fleet/cosmos/internal/util"
+)
+
+func TestRespondLookupError(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		wantStatus int
+		wantError  string
+	}{
+		{
+			name:       "record not found",
+			err:        fmt.Errorf("component web: %w", database.ErrNotFound),
+			wantStatus: http.StatusNotFound,
+			wantError:  "Component not found",
+		},
+		{
+			name:       "database failure",
+			err:        errors.New("sql: database is closed"),
+			wantStatus: http.StatusInternalServerError,
+			wantError:  "Failed to get component",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			respondLookupError(rec, tt.err, "Component")
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("Expected status %d, got %d", tt.wantStatus, rec.Code)
+			}
+
+			var body ErrorResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+				t.Fatalf("Failed to decode response: %v", err)
+			}
+			if body.Error != tt.wantError {
+				t.Errorf("Expected error %q, got %q", tt.wantError, body.Error)
+			}
+		})
+	}
+}
+
+type fakeAgents struct {
+	logs string
+	err  error
+
+	hostname  string
+	component string
+	lines     int
+	action    string
+}
+
+func (f *fakeAgents) SendLogLevel(hostname, level string) error {
+	return f.err
+}
+
+func (f *fakeAgents) SendControl(ctx context.Context, hostname, action, componentName string) (string, error) {
+	f.hostname, f.component, f.action = hostname, componentName, action
+	return "done", f.err
+}
+
+func (f *fakeAgents) RequestLogs(ctx context.Context, hostname, componentName string, lines int) (string, error) {
+	f.hostname, f.component, f.lines = hostname, componentName, lines
+	return f.logs, f.err
+}
+
+func TestHandleGetNodeComponentLiveLogs(t *testing.T) {
+	tests := []struct {
+		name       string
+		query      string
+		agents     *fakeAgents
+		wantStatus int
+		wantLines  int
+	}{
+		{
+			name:       "default lines",
+			agents:     &fakeAgents{logs: "hello\n"},
+			wantStatus: http.StatusOK,
+			wantLines:  defaultLogLines,
+		},
+		{
+			name:       "explicit lines",
+			query:      "?lines=50",
+			agents:     &fakeAgents{logs: "hello\n"},
+			wantStatus: http.StatusOK,
+			wantLines:  50,
+		},
+		{
+			name:       "invalid lines",
+			query:      "?lines=abc",
+			agents:     &fakeAgents{},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "agent disconnected",
+			agents:     &fakeAgents{err: fmt.Errorf("no stream: %w", grpcserver.ErrAgentNotConnected)},
+			wantStatus: http.StatusServiceUnavailable,
+			wantLines:  defaultLogLines,
+		},
+		{
+			name:       "agent timeout",
+			agents:     &fakeAgents{err: context.DeadlineExceeded},
+			wantStatus: http.StatusGatewayTimeout,
+			wantLines:  defaultLogLines,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{agents: tt.agents}
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/nodes/node-1/components/web/logs"+tt.query, nil)
+			req = mux.SetURLVars(req, map[string]string{"hostname": "node-1", "name": "web"})
+			rec := httptest.NewRecorder()
+
+			s.handleGetNodeComponentLiveLogs(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("Expected status %d, got %d", tt.wantStatus, rec.Code)
+			}
+			if tt.agents.lines != tt.wantLines {
+				t.Errorf("Expected %d lines requested, got %d", tt.wantLines, tt.agents.lines)
+			}
+			if tt.wantStatus == http.StatusOK {
+				if rec.Body.String() != "hello\n" {
+					t.Errorf("Expected log body, got %q", rec.Body.String())
+				}
+				if tt.agents.hostname != "node-1" || tt.agents.component != "web" {
+					t.Errorf("Requested logs from %s/%s", tt.agents.hostname, tt.agents.component)
+				}
+			}
+		})
+	}
+}
+
+func TestHandleControlNodeComponent(t *testing.T) {
+	tests := []struct {
+		name       string
+		agents     *fakeAgents
+		wantStatus int
+	}{
+		{name: "success", agents: &fakeAgents{}, wantStatus: http.StatusOK},
+		{name: "agent disconnected", agents: &fakeAgents{err: grpcserver.ErrAgentNotConnected}, wantStatus: http.StatusServiceUnavailable},
+		{name: "agent failure", agents: &fakeAgents{err: errors.New("agent failed to stop component: not found")}, wantStatus: http.StatusBadGateway},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{agents: tt.agents}
+			req := httptest.NewRequest(http.MethodPost, "/api/v1/nodes/node-1/components/web/stop", nil)
+			req = mux.SetURLVars(req, map[string]string{"hostname": "node-1", "name": "web", "action": "stop"})
+			rec := httptest.NewRecorder()
+
+			s.handleControlNodeComponent(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("Expected status %d, got %d", tt.wantStatus, rec.Code)
+			}
+			if tt.agents.action != "stop" || tt.agents.component != "web" {
+				t.Errorf("Sent %q for %q", tt.agents.action, tt.agents.component)
+			}
+		})
+	}
+}
+
+func TestRequestIDMiddleware(t *testing.T) {
+	var seen string
+	handler := requestIDMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = util.RequestIDFromContext(r.Context())
+	}))
+
+	tests := []struct {
+		name   string
+		header string
+		keep   bool
+	}{
+		{name: "generated", header: "", keep: false},
+		{name: "client supplied", header: "client-req-42", keep: true},
+		{name: "invalid", header: "bad id\nwith newline", keep: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/health", nil)
+			if tt.header != "" {
+				req.Header.Set(util.RequestIDHeader, tt.header)
+			}
+			rec := httptest.NewRecorder()
+
+			handler.ServeHTTP(rec, req)
+
+			got := rec.Header().Get(util.RequestIDHeader)
+			if got == "" || got != seen {
+				t.Fatalf("Expected response header %q to match the request context %q", got, seen)
+			}
+			if tt.keep != (got == tt.header) {
+				t.Errorf("Request ID %q for header %q, keep = %v", got, tt.header, tt.keep)
+			}
+		})
+	}
+}
+
+func TestPagination(t *testing.T) {
+	tests := []struct {
+		query      string
+		paginated  bool
+		wantLimit  int
+		wantOffset int
+	}{
+		{"", false, defaultPageLimit, 0},
+		{"?paginated=true&limit=10&offset=20", true, 10, 20},
+		{"?paginated=true&limit=0&offset=-1", true, defaultPageLimit, 0},
+		{"?limit=abc", false, defaultPageLimit, 0},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/components"+tt.query, nil)
+		paginated, limit, offset := pagination(req)
+		if paginated != tt.paginated || limit != tt.wantLimit || offset != tt.wantOffset {
+			t.Errorf("pagination(%q) = %v, %d, %d, want %v, %d, %d", tt.query, paginated, limit, offset, tt.paginated, tt.wantLimit, tt.wantOffset)
+		}
+	}
+}
+
+// fakeFleet answers control requests for the connected hostnames and records
+// which hosts were asked
+type fakeFleet struct {
+	fakeAgents
+	connected map[string]bool
+
+	mu      sync.Mutex
+	targets []string
+}
+
+func (f *fakeFleet) SendControl(ctx context.Context, hostname, action, componentName string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.targets = append(f.targets, action+":"+componentName+"@"+hostname)
+
+	if !f.connected[hostname] {
+		return "", grpcserver.ErrAgentNotConnected
+	}
+	return "done", nil
+}
+
+func TestRestartComponentTargetsDeployedNodes(t *testing.T) {
+	deployments := []database.ComponentDeployment{
+		{ComponentName: "web", NodeHostname: "node-1"},
+		{ComponentName: "web", NodeHostname: "node-2"},
+		{ComponentName: "web", NodeHostname: "node-3"},
+	}
+
+	tests := []struct {
+		name        string
+		only        []string
+		wantSent    []string
+		wantResults string
+	}{
+		{
+			name:        "all nodes",
+			wantSent:    []string{"restart:web@node-1", "restart:web@node-2", "restart:web@node-3"},
+			wantResults: "node-1=restarted node-2=restarted node-3=not_connected",
+		},
+		{
+			name:        "subset",
+			only:        []string{"node-2", " node-4"},
+			wantSent:    []string{"restart:web@node-2"},
+			wantResults: "node-2=restarted node-4=not_deployed",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fleet := &fakeFleet{connected: map[string]bool{"node-1": true, "node-2": true}}
+			s := &Server{agents: fleet}
+
+			results := s.restartOnNodes(context.Background(), "web", restartTargets(deployments, tt.only))
+
+			sort.Strings(fleet.targets)
+			if fmt.Sprint(fleet.targets) != fmt.Sprint(tt.wantSent) {
+				t.Errorf("Sent %v, want %v", fleet.targets, tt.wantSent)
+			}
+
+			var got []string
+			for _, result := range results {
+				got = append(got, result.Hostname+"="+result.Status)
+			}
+			if strings.Join(got, " ") != tt.wantResults {
+				t.Errorf("Results %v, want %s", got, tt.wantResults)
+			}
+		})
+	}
+}
+
+func TestSummarizeDeployment(t *testing.T) {
+	deployment := &database.Deployment{ID: uuid.New(), Status: "running"}
+	statuses := []models.ComponentStatus{
+		{ComponentName: "web", NodeHostname: "node-1", Status: "running"},
+		{ComponentName: "web", NodeHostname: "node-2", Status: "failed"},
+		{ComponentName: "worker", NodeHostname: "node-1", Status: "deploying"},
+		{ComponentName: "worker", NodeHostname: "node-3", Status: "rolled_back"},
+	}
+
+	got := summarizeDeployment(deployment, statuses)
+
+	want := models.DeploymentSummary{TotalComponents: 2, TotalNodes: 3, Deployed: 1, Failed: 2, Pending: 1}
+	if got.Summary != want {
+		t.Errorf("Expected summary %+v, got %+v", want, got.Summary)
+	}
+	if got.ID != deployment.ID || got.Status != "running" || len(got.ComponentStatus) != len(statuses) {
+		t.Errorf("Expected deployment fields and statuses to be carried over, got %+v", got)
+	}
+
+	empty := summarizeDeployment(deployment, nil)
+	if empty.ComponentStatus == nil {
+		t.Error("Expected an empty component status list rather than null")
+	}
+}
+
+func TestListStaleAgentsPaginates(t *testing.T) {
+	dsn := dbtest.URL(t)
+
+	db, err := database.NewControllerDB(dsn)
+	if err != nil {
+		t.Fatalf("Failed to create test database: %v", err)
+	}
+	defer db.Close()
+
+	// Heartbeats far older than anything other tests leave behind, so these
+	// are the only agents past the threshold
+	longAgo := time.Now().AddDate(-20, 0, 0)
+	for i := 1; i <= 3; i++ {
+		agent := &database.Agent{
+			Hostname:      fmt.Sprintf("stale-page-%d", i),
+			LastHeartbeat: longAgo.Add(time.Duration(i) * time.Minute),
+			Online:        true,
+		}
+		if err := db.UpsertAgent(agent); err != nil {
+			t.Fatalf("Failed to create agent: %v", err)
+		}
+	}
+
+	s := &Server{db: db}
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/agents?stale_for=87600h&paginated=true&limit=2&offset=1", nil)
+	rec := httptest.NewRecorder()
+	s.handleListAgents(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	var page struct {
+		Items  []database.Agent `json:"items"`
+		Total  int64            `json:"total"`
+		Limit  int              `json:"limit"`
+		Offset int              `json:"offset"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &page); err != nil {
+		t.Fatalf("Expected a page envelope, got %s", rec.Body.String())
+	}
+
+	if page.Total != 3 || page.Limit != 2 || page.Offset != 1 {
+		t.Errorf("Expected total 3, limit 2, offset 1, got %d, %d, %d", page.Total, page.Limit, page.Offset)
+	}
+	if len(page.Items) != 2 || page.Items[0].Hostname != "stale-page-2" || page.Items[1].Hostname != "stale-page-3" {
+		t.Errorf("Expected stale-page-2 and stale-page-3, got %+v", page.Items)
+	}
+}
+
+// fakeReconciler records the deployments it was asked to process, the
+// components it was asked to remove, failing the removals in removeErrs, and
+// the nodes it was asked to redeploy to
+type fakeReconciler struct {
+	ReconcilerInterface
+	processed   chan uuid.UUID
+	removed     []string
+	removeErrs  map[string]error
+	redeployed  []string
+	redeployErr error
+}
+
+func (f *fakeReconciler) ProcessDeployment(deploymentID uuid.UUID, config types.ConfigurationRequest) error {
+	f.processed <- deploymentID
+	return nil
+}
+
+func (f *fakeReconciler) RemoveComponents(deploymentID uuid.UUID, components []database.Component) map[string]error {
+	results := make(map[string]error, len(components))
+	for _, comp := range components {
+		f.removed = append(f.removed, comp.Name)
+		results[comp.Name] = f.removeErrs[comp.Name]
+	}
+	return results
+}
+
+func (f *fakeReconciler) RedeployToNode(deploymentID uuid.UUID, component *database.Component, hostname string) error {
+	f.redeployed = append(f.redeployed, component.Name+"@"+hostname)
+	return f.redeployErr
+}
+
+type fakeLeader struct {
+	leader bool
+}
+
+func (f fakeLeader) IsLeader() bool { return f.leader }
+func (f fakeLeader) Leader() string { return "controller-a" }
+func (f fakeLeader) ID() string     { return "controller-b" }
+
+func TestReviewDeployment(t *testing.T) {
+	dsn := dbtest.URL(t)
+
+	db, err := database.NewControllerDB(dsn)
+	if err != nil {
+		t.Fatalf("Failed to create test database: %v", err)
+	}
+	defer db.Close()
+
+	keys := fakeKeys{database.HashAPIKey("ci-key"): {Name: "ci", Scope: database.ScopeAdmin}}
+
+	tests := []struct {
+		name           string
+		action         string
+		status         string
+		authDisabled   bool
+		wantCode       int
+		wantStatus     string
+		wantReviewer   string
+		wantProcessing bool
+	}{
+		{name: "approve", action: "approve", status: "pending-approval", wantCode: http.StatusOK, wantStatus: "pending", wantReviewer: "ci", wantProcessing: true},
+		{name: "reject", action: "reject", status: "pending-approval", wantCode: http.StatusOK, wantStatus: "rejected", wantReviewer: "ci"},
+		{name: "approve without auth", action: "approve", status: "pending-approval", authDisabled: true, wantCode: http.StatusOK, wantStatus: "pending", wantReviewer: "someone", wantProcessing: true},
+		{name: "approve running", action: "approve", status: "running", wantCode: http.StatusConflict, wantStatus: "running"},
+		{name: "reject completed", action: "reject", status: "completed", wantCode: http.StatusConflict, wantStatus: "completed"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			deployment := &database.Deployment{ID: uuid.New(), Configuration: []byte("{}"), Status: tt.status, CreatedAt: time.Now()}
+			if err := db.CreateDeployment(deployment); err != nil {
+				t.Fatalf("Failed to create deployment: %v", err)
+			}
+			// An approved deployment with an empty configuration must not be
+			// picked up by another test's reconciler
+			t.Cleanup(func() { db.CancelDeployment(deployment.ID, "test finished") })
+
+			rec := &fakeReconciler{processed: make(chan uuid.UUID, 1)}
+			s := &Server{db: db, reconciler: rec, authEnabled: !tt.authDisabled, apiKeys: keys}
+
+			handler := s.handleApproveDeployment
+			if tt.action == "reject" {
+				handler = s.handleRejectDeployment
+			}
+
+			// The body's reviewer only counts when requests aren't authenticated
+			req := httptest.NewRequest(http.MethodPost, "/api/v1/deployments/"+deployment.ID.String()+"/"+tt.action, strings.NewReader(`{"reviewer":"someone"}`))
+			req.Header.Set("Authorization", "Bearer ci-key")
+			req = mux.SetURLVars(req, map[string]string{"id": deployment.ID.String()})
+			w := httptest.NewRecorder()
+			s.authMiddleware(http.HandlerFunc(handler)).ServeHTTP(w, req)
+
+			if w.Code != tt.wantCode {
+				t.Fatalf("Expected %d, got %d: %s", tt.wantCode, w.Code, w.Body.String())
+			}
+
+			stored, err := db.GetDeployment(deployment.ID)
+			if err != nil {
+				t.Fatalf("Failed to get deployment: %v", err)
+			}
+			if stored.Status != tt.wantStatus || stored.ApprovedBy != tt.wantReviewer {
+				t.Errorf("Expected status %s reviewed by %q, got %s by %q", tt.wantStatus, tt.wantReviewer, stored.Status, stored.ApprovedBy)
+			}
+
+			wait := 100 * time.Millisecond
+			if tt.wantProcessing {
+				wait = time.Second
+			}
+			select {
+			case id := <-rec.processed:
+				if !tt.wantProcessing || id != deployment.ID {
+					t.Errorf("Unexpected processing of deployment %s", id)
+				}
+			case <-time.After(wait):
+				if tt.wantProcessing {
+					t.Error("Expected the approved deployment to be processed")
+				}
+			}
+		})
+	}
+}
+
+func TestBulkRemoveComponentsRejectsUnsafeRequests(t *testing.T) {
+	tests := []struct {
+		name      string
+		query     string
+		leader    LeaderStatus
+		wantCode  int
+		wantError string
+	}{
+		{name: "no tag", query: "confirm=true", wantCode: http.StatusBadRequest, wantError: "tag parameter is required"},
+		{name: "not confirmed", query: "tag=web", wantCode: http.StatusBadRequest, wantError: "Bulk removal requires confirm=true"},
+		{name: "confirm must be true", query: "tag=web&confirm=yes", wantCode: http.StatusBadRequest, wantError: "Bulk removal requires confirm=true"},
+		{name: "follower", query: "tag=web&confirm=true", leader: fakeLeader{leader: false}, wantCode: http.StatusServiceUnavailable, wantError: "controller-a"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := &fakeReconciler{}
+			s := &Server{reconciler: rec, leader: tt.leader}
+
+			w := httptest.NewRecorder()
+			s.handleBulkRemoveComponents(w, httptest.NewRequest(http.MethodDelete, "/api/v1/components?"+tt.query, nil))
+
+			if w.Code != tt.wantCode {
+				t.Fatalf("Expected %d, got %d: %s", tt.wantCode, w.Code, w.Body.String())
+			}
+			var body ErrorResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || !strings.Contains(body.Error, tt.wantError) {
+				t.Errorf("Expected an error containing %q, got %s", tt.wantError, w.Body.String())
+			}
+			if len(rec.removed) != 0 {
+				t.Errorf("Expected nothing to be removed, got %v", rec.removed)
+			}
+		})
+	}
+}
+
+func TestBulkRemoveComponentsByTag(t *testing.T) {
+	dsn := dbtest.URL(t)
+
+	db, err := database.NewControllerDB(dsn)
+	if err != nil {
+		t.Fatalf("Failed to create test database: %v", err)
+	}
+	defer db.Close()
+
+	prefix := "test-" + uuid.New().String()[:8] + "-"
+	tag := prefix + "tag"
+	components := []*database.Component{
+		{Name: prefix + "b", Type: "script", Handler: "agent", Hash: "v1", Tags: []string{tag}},
+		{Name: prefix + "a", Type: "script", Handler: "agent", Hash: "v1", Tags: []string{"other", tag}},
+		{Name: prefix + "untagged", Type: "script", Handler: "agent", Hash: "v1", Tags: []string{"other"}},
+	}
+	for _, comp := range components {
+		if err := db.UpsertComponent(comp); err != nil {
+			t.Fatalf("Failed to create component: %v", err)
+		}
+		defer db.DeleteComponent(comp.Name)
+	}
+
+	rec := &fakeReconciler{removeErrs: map[string]error{prefix + "b": errors.New("agent unreachable")}}
+	s := &Server{db: db, reconciler: rec, leader: fakeLeader{leader: true}}
+
+	w := httptest.NewRecorder()
+	s.handleBulkRemoveComponents(w, httptest.NewRequest(http.MethodDelete, "/api/v1/components?tag="+tag+"&confirm=true", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var response BulkRemovalResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	defer db.CancelDeployment(response.DeploymentID, "test finished")
+
+	want := []ComponentRemovalResult{
+		{Component: prefix + "a", Status: "removed"},
+		{Component: prefix + "b", Status: "failed", Error: "agent unreachable"},
+	}
+	if len(response.Results) != len(want) {
+		t.Fatalf("Expected %v, got %v", want, response.Results)
+	}
+	for i := range want {
+		if response.Results[i] != want[i] {
+			t.Errorf("Expected %+v, got %+v", want[i], response.Results[i])
+		}
+	}
+	if len(rec.removed) != 2 {
+		t.Errorf("Expected only the tagged components to be removed, got %v", rec.removed)
+	}
+
+	deployment, err := db.GetDeployment(response.DeploymentID)
+	if err != nil {
+		t.Fatalf("Failed to get deployment: %v", err)
+	}
+	if deployment.CreatedBy != "bulk-remove" || !strings.Contains(string(deployment.Configuration), prefix+"a") {
+		t.Errorf("Expected a bulk-remove deployment listing the components, got %s by %s", deployment.Configuration, deployment.CreatedBy)
+	}
+}
+
+func TestClearNodeComponent(t *testing.T) {
+	dsn := dbtest.URL(t)
+
+	db, err := database.NewControllerDB(dsn)
+	if err != nil {
+		t.Fatalf("Failed to create test database: %v", err)
+	}
+	defer db.Close()
+
+	tests := []struct {
+		name           string
+		query          string
+		noRecord       bool
+		noComponent    bool
+		redeployErr    error
+		leader         LeaderStatus
+		wantCode       int
+		wantMessage    string
+		wantRedeployed bool
+		wantCleared    bool
+	}{
+		{name: "clear", wantCode: http.StatusOK, wantCleared: true},
+		{name: "no record", noRecord: true, wantCode: http.StatusNotFound},
+		{name: "redeploy", query: "?redeploy=true", wantCode: http.StatusOK, wantMessage: "Cleared and redeployed", wantRedeployed: true, wantCleared: true},
+		{name: "redeploy fails", query: "?redeploy=true", redeployErr: errors.New("node offline"), wantCode: http.StatusOK, wantMessage: "redeploy failed: node offline", wantRedeployed: true, wantCleared: true},
+		{name: "redeploy a removed component", query: "?redeploy=true", noComponent: true, wantCode: http.StatusOK, wantMessage: "no longer exists", wantCleared: true},
+		{name: "redeploy on a follower", query: "?redeploy=true", leader: fakeLeader{leader: false}, wantCode: http.StatusServiceUnavailable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name := "test-" + uuid.New().String()[:8] + "-app"
+			if !tt.noComponent {
+				if err := db.UpsertComponent(&database.Component{Name: name, Type: "program", Handler: "agent", Hash: "v1"}); err != nil {
+					t.Fatalf("Failed to create component: %v", err)
+				}
+				t.Cleanup(func() { db.DeleteComponent(name) })
+			}
+			if !tt.noRecord {
+				if err := db.UpsertComponentDeployment(&database.ComponentDeployment{ComponentName: name, NodeHostname: "node-1", Status: "deploying"}); err != nil {
+					t.Fatalf("Failed to record deployment: %v", err)
+				}
+				t.Cleanup(func() { db.DeleteComponentDeployments(name, "node-1") })
+			}
+
+			rec := &fakeReconciler{redeployErr: tt.redeployErr}
+			s := &Server{db: db, reconciler: rec, leader: tt.leader}
+
+			req := httptest.NewRequest(http.MethodPost, "/api/v1/nodes/node-1/components/"+name+"/clear"+tt.query, nil)
+			req = mux.SetURLVars(req, map[string]string{"hostname": "node-1", "name": name})
+			w := httptest.NewRecorder()
+			s.handleClearNodeComponent(w, req)
+
+			if w.Code != tt.wantCode {
+				t.Fatalf("Expected %d, got %d: %s", tt.wantCode, w.Code, w.Body.String())
+			}
+
+			if tt.wantCode == http.StatusOK {
+				var response ClearComponentResponse
+				if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+					t.Fatalf("Failed to decode response: %v", err)
+				}
+				if response.Cleared == nil || response.Cleared.Status != "deploying" || !strings.Contains(response.Message, tt.wantMessage) {
+					t.Errorf("Expected the cleared record and %q, got %+v", tt.wantMessage, response)
+				}
+				if response.DeploymentID != nil {
+					defer db.CancelDeployment(*response.DeploymentID, "test finished")
+				}
+				if (response.DeploymentID != nil) != tt.wantRedeployed {
+					t.Errorf("Expected a redeploy deployment to be %v, got %v", tt.wantRedeployed, response.DeploymentID)
+				}
+			}
+
+			if redeployed := len(rec.redeployed) == 1 && rec.redeployed[0] == name+"@node-1"; redeployed != tt.wantRedeployed {
+				t.Errorf("Expected redeploying to be %v, got %v", tt.wantRedeployed, rec.redeployed)
+			}
+
+			_, err := db.GetComponentDeployment(name, "node-1")
+			if cleared := errors.Is(err, database.ErrNotFound); cleared != (tt.wantCleared || tt.noRecord) {
+				t.Errorf("Expected the record to be cleared: %v, got %v", tt.wantCleared, err)
+			}
+		})
+	}
+}
+
+func TestTargetsNode(t *testing.T) {
+	tests := []struct {
+		name          string
+		componentTags []string
+		nodeTags      []string
+		want          bool
+	}{
+		{"untagged component", nil, []string{"web"}, true},
+		{"untagged component and node", nil, nil, true},
+		{"shared tag", []string{"db", "web"}, []string{"eu-west", "web"}, true},
+		{"no shared tag", []string{"db"}, []string{"web"}, false},
+		{"untagged node", []string{"db"}, nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := targetsNode(tt.componentTags, tt.nodeTags); got != tt.want {
+				t.Errorf("Expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestGetNodeDrift(t *testing.T) {
+	dsn := dbtest.URL(t)
+
+	db, err := database.NewControllerDB(dsn)
+	if err != nil {
+		t.Fatalf("Failed to create test database: %v", err)
+	}
+	defer db.Close()
+
+	prefix := "test-" + uuid.New().String()[:8] + "-"
+	hostname, tag := prefix+"node", prefix+"tag"
+	if err := db.UpsertNode(&database.Node{Hostname: hostname, Tags: []string{tag}, Online: true, HasAgent: true}); err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+
+	components := []*database.Component{
+		{Name: prefix + "running", Type: "program", Handler: "agent", Hash: "v1", Tags: []string{tag}},
+		{Name: prefix + "failed", Type: "program", Handler: "agent", Hash: "v1", Tags: []string{tag}},
+		{Name: prefix + "unreported", Type: "program", Handler: "agent", Hash: "v1", Tags: []string{tag}},
+		{Name: prefix + "elsewhere", Type: "program", Handler: "agent", Hash: "v1", Tags: []string{prefix + "other"}},
+		// Services run through Nomad, so the agent never reports them
+		{Name: prefix + "service", Type: "service", Handler: "nomad", Hash: "v1", Tags: []string{tag}},
+	}
+	for _, comp := range components {
+		if err := db.UpsertComponent(comp); err != nil {
+			t.Fatalf("Failed to create component: %v", err)
+		}
+		defer db.DeleteComponent(comp.Name)
+	}
+
+	reports := []database.ComponentDeployment{
+		{ComponentName: prefix + "running", NodeHostname: hostname, Status: "running"},
+		{ComponentName: prefix + "failed", NodeHostname: hostname, Status: "failed", Message: "exit status 1"},
+		{ComponentName: prefix + "elsewhere", NodeHostname: hostname, Status: "running"},
+		{ComponentName: prefix + "removed", NodeHostname: hostname, Status: "stopped"},
+	}
+	for i := range reports {
+		if err := db.UpsertComponentDeployment(&reports[i]); err != nil {
+			t.Fatalf("Failed to record deployment: %v", err)
+		}
+		defer db.DeleteComponentDeployments(reports[i].ComponentName, hostname)
+	}
+
+	s := &Server{db: db}
+	get := func(hostname string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/nodes/"+hostname+"/drift", nil)
+		req = mux.SetURLVars(req, map[string]string{"hostname": hostname})
+		w := httptest.NewRecorder()
+		s.handleGetNodeDrift(w, req)
+		return w
+	}
+
+	if w := get(prefix + "missing-node"); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown node, got %d", w.Code)
+	}
+
+	w := get(hostname)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var drift NodeDriftResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &drift); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+
+	// Components other tests left without tags target every node, so only
+	// this test's components are compared
+	ours := func(names []string) []string {
+		var filtered []string
+		for _, name := range names {
+			if strings.HasPrefix(name, prefix) {
+				filtered = append(filtered, strings.TrimPrefix(name, prefix))
+			}
+		}
+		sort.Strings(filtered)
+		return filtered
+	}
+	entries := func(list []DriftEntry) []string {
+		names := make([]string, 0, len(list))
+		for _, entry := range list {
+			names = append(names, entry.Component+":"+entry.Status)
+		}
+		return ours(names)
+	}
+
+	tests := []struct {
+		name string
+		got  []string
+		want []string
+	}{
+		{"desired", ours(drift.Desired), []string{"failed", "running", "unreported"}},
+		{"running", ours(drift.Running), []string{"elsewhere", "running"}},
+		{"missing", entries(drift.Missing), []string{"failed:failed", "unreported:"}},
+		{"extra", entries(drift.Extra), []string{"elsewhere:running", "removed:stopped"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if strings.Join(tt.got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("Expected %v, got %v", tt.want, tt.got)
+			}
+		})
+	}
+
+	if drift.Hostname != hostname || drift.InSync {
+		t.Errorf("Expected %s to be out of sync, got %+v", hostname, drift)
+	}
+}
@@ -193,6 +193,7 @@ async function showDeploymentDetails(deploymentId) {
 
         const deployment = data.deployment;
         const logs = data.logs || [];
+        const summary = data.status ? data.status.summary : null;
 
         let config = {};
         try {
@@ -226,6 +227,12 @@ async function showDeploymentDetails(deploymentId) {
                 <div class="detail-value">${formatDate(deployment.completed_at)}</div>
             </div>
             ` : ''}
+            ${summary && summary.total_nodes > 0 ? `
+            <div class="detail-row">
+                <div class="detail-label">Nodes</div>
+                <div class="detail-value">${summary.deployed} deployed, ${summary.failed} failed, ${summary.pending} pending (${summary.total_components} components on ${summary.total_nodes} nodes)</div>
+            </div>
+            ` : ''}
             ${deployment.error_message ? `
             <div class="detail-row">
                 <div class="detail-label">Error</div>
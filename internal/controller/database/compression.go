@@ -0,0 +1,79 @@
+package database
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"gorm.io/gorm"
+)
+
+// Nomad job specs at or above this size are stored gzip-compressed
+const nomadJobCompressionThreshold = 4 * 1024
+
+func (c *Component) BeforeSave(tx *gorm.DB) error {
+	if len(c.NomadJob) < nomadJobCompressionThreshold {
+		c.NomadJobCompressed = nil
+		return nil
+	}
+
+	compressed, err := compress([]byte(c.NomadJob))
+	if err != nil {
+		return fmt.Errorf("failed to compress nomad job: %w", err)
+	}
+
+	c.NomadJobCompressed = compressed
+	c.NomadJob = ""
+
+	return nil
+}
+
+// AfterSave restores the plain spec so callers keep a usable struct
+func (c *Component) AfterSave(tx *gorm.DB) error {
+	return c.inflateNomadJob()
+}
+
+func (c *Component) AfterFind(tx *gorm.DB) error {
+	return c.inflateNomadJob()
+}
+
+func (c *Component) inflateNomadJob() error {
+	if len(c.NomadJobCompressed) == 0 {
+		return nil
+	}
+
+	job, err := decompress(c.NomadJobCompressed)
+	if err != nil {
+		return fmt.Errorf("failed to decompress nomad job: %w", err)
+	}
+
+	c.NomadJob = string(job)
+	c.NomadJobCompressed = nil
+
+	return nil
+}
+
+func compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func decompress(data []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	return io.ReadAll(zr)
+}
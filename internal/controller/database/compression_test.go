@@ -0,0 +1,107 @@
+package database
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestNomadJobCompressionHooks(t *testing.T) {
+	large := `{"ID":"web","Meta":{"blob":"` + strings.Repeat("x", nomadJobCompressionThreshold) + `"}}`
+
+	tests := []struct {
+		name           string
+		job            string
+		wantCompressed bool
+	}{
+		{"empty", "", false},
+		{"small", `{"ID":"web"}`, false},
+		{"just below the threshold", strings.Repeat("a", nomadJobCompressionThreshold-1), false},
+		{"at the threshold", strings.Repeat("a", nomadJobCompressionThreshold), true},
+		{"large", large, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Component{NomadJob: tt.job}
+			if err := c.BeforeSave(nil); err != nil {
+				t.Fatalf("BeforeSave failed: %v", err)
+			}
+
+			if compressed := len(c.NomadJobCompressed) > 0; compressed != tt.wantCompressed {
+				t.Fatalf("Expected compressed to be %v, got %d compressed bytes", tt.wantCompressed, len(c.NomadJobCompressed))
+			}
+			if tt.wantCompressed && c.NomadJob != "" {
+				t.Error("Expected the plain spec to be cleared once compressed")
+			}
+
+			if err := c.AfterFind(nil); err != nil {
+				t.Fatalf("AfterFind failed: %v", err)
+			}
+			if c.NomadJob != tt.job || c.NomadJobCompressed != nil {
+				t.Errorf("Expected the spec to round-trip, got %d bytes with %d still compressed", len(c.NomadJob), len(c.NomadJobCompressed))
+			}
+		})
+	}
+}
+
+func TestNomadJobShrinkingClearsCompressedSpec(t *testing.T) {
+	c := &Component{NomadJob: strings.Repeat("a", nomadJobCompressionThreshold)}
+	if err := c.BeforeSave(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// A later save with a small spec must not leave the old compressed one
+	// behind to be inflated over it
+	c.NomadJob = `{"ID":"web"}`
+	if err := c.BeforeSave(nil); err != nil {
+		t.Fatal(err)
+	}
+	if c.NomadJobCompressed != nil {
+		t.Error("Expected the compressed spec to be cleared")
+	}
+}
+
+func TestInflateRejectsCorruptSpec(t *testing.T) {
+	c := &Component{NomadJobCompressed: []byte("not gzip")}
+	if err := c.AfterFind(nil); err == nil || !strings.Contains(err.Error(), "failed to decompress nomad job") {
+		t.Errorf("Expected a decompression error, got %v", err)
+	}
+}
+
+func TestLargeNomadJobRoundTripsThroughDatabase(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	name := "test-" + uuid.New().String()
+	defer db.DeleteComponent(name)
+
+	job := `{"ID":"web","Meta":{"blob":"` + strings.Repeat("x", 2*nomadJobCompressionThreshold) + `"}}`
+	component := &Component{Name: name, Type: "service", Handler: "nomad", Hash: "v1", NomadJob: job}
+	if err := db.UpsertComponent(component); err != nil {
+		t.Fatalf("Failed to upsert component: %v", err)
+	}
+	if component.NomadJob != job {
+		t.Error("Expected the saved struct to keep the plain spec")
+	}
+
+	var stored Component
+	if err := db.db.Where("name = ?", name).First(&stored).Error; err != nil {
+		t.Fatalf("Failed to load component: %v", err)
+	}
+	if stored.NomadJob != job {
+		t.Errorf("Expected the spec to be inflated on load, got %d bytes", len(stored.NomadJob))
+	}
+
+	var raw struct {
+		NomadJob           string
+		NomadJobCompressed []byte
+	}
+	if err := db.db.Table("components").Select("nomad_job, nomad_job_compressed").Where("name = ?", name).Scan(&raw).Error; err != nil {
+		t.Fatalf("Failed to read raw columns: %v", err)
+	}
+	if raw.NomadJob != "" || len(raw.NomadJobCompressed) == 0 || len(raw.NomadJobCompressed) >= len(job) {
+		t.Errorf("Expected the spec to be stored compressed, got %d plain and %d compressed bytes", len(raw.NomadJob), len(raw.NomadJobCompressed))
+	}
+}
@@ -1,14 +1,23 @@
 package database
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"reflect"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/lib/pq"
+	"github.com/metorial/fleet/cosmos/internal/models"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 	"gorm.io/gorm/logger"
 )
 
@@ -16,6 +25,19 @@ type ControllerDB struct {
 	db *gorm.DB
 }
 
+// ErrNotFound is returned by the Get* methods when no matching row exists.
+// Any other error from them is a real database failure.
+var ErrNotFound = errors.New("not found")
+
+// notFound translates gorm's missing-row error into ErrNotFound and passes
+// every other error through unchanged
+func notFound(err error, format string, args ...any) error {
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return fmt.Errorf("%s: %w", fmt.Sprintf(format, args...), ErrNotFound)
+	}
+	return err
+}
+
 type Deployment struct {
 	ID            uuid.UUID       `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
 	Configuration json.RawMessage `gorm:"type:jsonb;not null" json:"configuration"`
@@ -25,6 +47,41 @@ type Deployment struct {
 	CompletedAt   *time.Time      `json:"completed_at,omitempty"`
 	CreatedBy     string          `gorm:"type:varchar(255)" json:"created_by,omitempty"`
 	ErrorMessage  string          `gorm:"type:text" json:"error_message,omitempty"`
+	ApprovedBy    string          `gorm:"type:varchar(255)" json:"approved_by,omitempty"`
+	ApprovedAt    *time.Time      `json:"approved_at,omitempty"`
+
+	// CanaryDecision is "promote" or "abort" once someone has cut a canary
+	// bake short
+	CanaryDecision  string `gorm:"type:varchar(20)" json:"canary_decision,omitempty"`
+	CanaryDecidedBy string `gorm:"type:varchar(255)" json:"canary_decided_by,omitempty"`
+
+	// RequestID is the ID of the API request that created the deployment. It
+	// is recorded in the deployment's logs and sent to the agents.
+	RequestID string `gorm:"type:varchar(128);index" json:"request_id,omitempty"`
+
+	// Plan is the DeploymentPlan stored when processing starts
+	Plan json.RawMessage `gorm:"type:jsonb" json:"plan,omitempty"`
+}
+
+// DeploymentPlan lists the components a deployment adds, updates and
+// removes. Started lists the ones whose step has begun; a deployment that
+// stops early leaves the others untouched on the nodes.
+type DeploymentPlan struct {
+	Add     []string `json:"add,omitempty"`
+	Update  []string `json:"update,omitempty"`
+	Remove  []string `json:"remove,omitempty"`
+	Started []string `json:"started,omitempty"`
+}
+
+// NotStarted returns the names whose step hasn't begun
+func (p *DeploymentPlan) NotStarted(names []string) []string {
+	var pending []string
+	for _, name := range names {
+		if !slices.Contains(p.Started, name) {
+			pending = append(pending, name)
+		}
+	}
+	return pending
 }
 
 type Component struct {
@@ -37,10 +94,35 @@ type Component struct {
 	Content            string          `gorm:"type:text" json:"content,omitempty"`
 	ContentURL         string          `gorm:"type:text" json:"content_url,omitempty"`
 	ContentURLEncoding string          `gorm:"type:varchar(20)" json:"content_url_encoding,omitempty"`
+	ContentMirrors     json.RawMessage `gorm:"type:jsonb" json:"content_mirrors,omitempty"`
+	ContentURLHeaders  json.RawMessage `gorm:"type:jsonb" json:"-"` // may hold credentials
+	Entrypoint         string          `gorm:"type:text" json:"entrypoint,omitempty"`
+	SignatureURL       string          `gorm:"type:text" json:"signature_url,omitempty"`
+	PublicKey          string          `gorm:"type:text" json:"public_key,omitempty"`
 	NomadJob           string          `gorm:"type:text" json:"nomad_job,omitempty"`
+	NomadJobCompressed []byte          `gorm:"type:bytea" json:"-"`
+	NomadJobFormat     string          `gorm:"type:varchar(10)" json:"nomad_job_format,omitempty"`
+	NomadNamespace     string          `gorm:"type:varchar(255)" json:"nomad_namespace,omitempty"`
+	NomadRegion        string          `gorm:"type:varchar(255)" json:"nomad_region,omitempty"`
+	K8sManifest        string          `gorm:"type:text" json:"k8s_manifest,omitempty"`
+	K8sNamespace       string          `gorm:"type:varchar(255)" json:"k8s_namespace,omitempty"`
+	MemoryLimit        int64           `gorm:"type:bigint" json:"memory_limit,omitempty"`
+	CPULimit           float64         `gorm:"type:double precision" json:"cpu_limit,omitempty"`
+	MaxOpenFiles       int64           `gorm:"type:bigint" json:"max_open_files,omitempty"`
+	RunAsUser          string          `gorm:"type:varchar(255)" json:"run_as_user,omitempty"`
+	RunAsGroup         string          `gorm:"type:varchar(255)" json:"run_as_group,omitempty"`
+	WorkingDir         string          `gorm:"type:text" json:"working_dir,omitempty"`
 	HealthCheck        json.RawMessage `gorm:"type:jsonb" json:"health_check,omitempty"`
 	Env                json.RawMessage `gorm:"type:jsonb" json:"env,omitempty"`
 	Args               pq.StringArray  `gorm:"type:text[]" json:"args,omitempty"`
+	Affinity           pq.StringArray  `gorm:"type:text[]" json:"affinity,omitempty"`
+	AntiAffinity       pq.StringArray  `gorm:"type:text[]" json:"anti_affinity,omitempty"`
+	DependsOn          pq.StringArray  `gorm:"type:text[]" json:"depends_on,omitempty"`
+	Replicas           int             `gorm:"default:0" json:"replicas,omitempty"`
+	WaitFor            json.RawMessage `gorm:"type:jsonb" json:"wait_for,omitempty"`
+	Canary             json.RawMessage `gorm:"type:jsonb" json:"canary,omitempty"`
+	Rollout            json.RawMessage `gorm:"type:jsonb" json:"rollout,omitempty"`
+	PreviousSpec       json.RawMessage `gorm:"type:jsonb" json:"-"` // version replaced by the last update, for rollback
 	Managed            bool            `gorm:"default:false" json:"managed"`
 	ExternalID         string          `gorm:"type:varchar(255)" json:"external_id,omitempty"`
 	DeploymentID       *uuid.UUID      `gorm:"type:uuid" json:"deployment_id,omitempty"`
@@ -48,10 +130,68 @@ type Component struct {
 	UpdatedAt          time.Time       `gorm:"not null;default:now()" json:"updated_at"`
 }
 
+// ComponentHistory is one change to a component's spec: its creation, an
+// update or a rollback. An update that keeps the content hash but changes
+// other settings, like env or args, has the same old and new hash.
+type ComponentHistory struct {
+	ID            uuid.UUID  `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	ComponentName string     `gorm:"type:varchar(255);not null;index" json:"component_name"`
+	OldHash       string     `gorm:"type:varchar(64)" json:"old_hash,omitempty"`
+	NewHash       string     `gorm:"type:varchar(64);not null" json:"new_hash"`
+	DeploymentID  *uuid.UUID `gorm:"type:uuid" json:"deployment_id,omitempty"`
+	CreatedAt     time.Time  `gorm:"not null;default:now()" json:"created_at"`
+}
+
+// componentSnapshot is the stored form of a replaced component version. The
+// fields hidden from API responses are kept so a rollback can redeploy it.
+type componentSnapshot struct {
+	Component
+	ContentURLHeaders json.RawMessage `json:"content_url_headers,omitempty"`
+}
+
+// SameSpec reports whether two versions of a component have the same spec:
+// everything a deployment sets except the deployment itself. JSON fields
+// are compared by value, since Postgres doesn't keep their formatting.
+func SameSpec(a, b Component) (bool, error) {
+	specA, err := specOf(a)
+	if err != nil {
+		return false, err
+	}
+	specB, err := specOf(b)
+	if err != nil {
+		return false, err
+	}
+	return specA == specB, nil
+}
+
+func specOf(c Component) (string, error) {
+	c.ID = uuid.Nil
+	c.DeploymentID = nil
+	c.CreatedAt = time.Time{}
+	c.UpdatedAt = time.Time{}
+	// Tags are stored as an empty array when there are none
+	if c.Tags == nil {
+		c.Tags = pq.StringArray{}
+	}
+
+	raw, err := json.Marshal(componentSnapshot{Component: c, ContentURLHeaders: c.ContentURLHeaders})
+	if err != nil {
+		return "", err
+	}
+
+	// Decoding into maps and encoding again sorts keys and drops whitespace
+	var normalized interface{}
+	if err := json.Unmarshal(raw, &normalized); err != nil {
+		return "", err
+	}
+	spec, err := json.Marshal(normalized)
+	return string(spec), err
+}
+
 type ComponentDeployment struct {
 	ID              uuid.UUID  `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
-	ComponentName   string     `gorm:"type:varchar(255);not null;index" json:"component_name"`
-	NodeHostname    string     `gorm:"type:varchar(255);not null;index" json:"node_hostname"`
+	ComponentName   string     `gorm:"type:varchar(255);not null;index;uniqueIndex:idx_component_deployments_component_node" json:"component_name"`
+	NodeHostname    string     `gorm:"type:varchar(255);not null;index;uniqueIndex:idx_component_deployments_component_node" json:"node_hostname"`
 	DeploymentID    *uuid.UUID `gorm:"type:uuid" json:"deployment_id,omitempty"`
 	Status          string     `gorm:"type:varchar(20);not null;index" json:"status"`
 	Message         string     `gorm:"type:text" json:"message,omitempty"`
@@ -62,6 +202,28 @@ type ComponentDeployment struct {
 	DeployedAt      *time.Time `json:"deployed_at,omitempty"`
 	LastUpdated     *time.Time `json:"last_updated,omitempty"`
 	CreatedAt       time.Time  `gorm:"not null;default:now()" json:"created_at"`
+
+	// Restarts as reported by the agent; the history is newest first
+	RestartCount   int             `gorm:"default:0" json:"restart_count"`
+	RestartHistory json.RawMessage `gorm:"type:jsonb" json:"restart_history,omitempty"`
+
+	// Progress of the deployment in flight, as last reported by the agent
+	Phase           string `gorm:"type:varchar(20)" json:"phase,omitempty"`
+	ProgressPercent *int   `gorm:"type:integer" json:"progress_percent,omitempty"`
+}
+
+// RestartEvent is one entry of a component deployment's restart history
+type RestartEvent struct {
+	Timestamp time.Time `json:"timestamp"`
+	Reason    string    `json:"reason,omitempty"`
+	ExitCode  int       `json:"exit_code"`
+}
+
+// ControllerLease records which controller currently holds a named lease
+type ControllerLease struct {
+	Name      string    `gorm:"type:varchar(255);primaryKey" json:"name"`
+	Holder    string    `gorm:"type:varchar(255);not null" json:"holder"`
+	ExpiresAt time.Time `gorm:"not null" json:"expires_at"`
 }
 
 type Agent struct {
@@ -74,6 +236,15 @@ type Agent struct {
 	Metadata       json.RawMessage `gorm:"type:jsonb" json:"metadata,omitempty"`
 	CreatedAt      time.Time       `gorm:"not null;default:now()" json:"created_at"`
 	UpdatedAt      time.Time       `gorm:"not null;default:now()" json:"updated_at"`
+
+	// Resource usage reported in the last heartbeat. Disk usage is for the
+	// filesystem holding the agent's data directory.
+	LoadAverage      float64 `json:"load_average"`
+	CPUCount         int     `json:"cpu_count"`
+	MemoryUsedBytes  int64   `json:"memory_used_bytes"`
+	MemoryTotalBytes int64   `json:"memory_total_bytes"`
+	DiskFreeBytes    int64   `json:"disk_free_bytes"`
+	DiskTotalBytes   int64   `json:"disk_total_bytes"`
 }
 
 type DeploymentLog struct {
@@ -89,12 +260,17 @@ type DeploymentLog struct {
 }
 
 type Node struct {
-	ID       uuid.UUID       `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
-	Hostname string          `gorm:"type:varchar(255);not null;uniqueIndex" json:"hostname"`
-	IP       string          `gorm:"type:varchar(45)" json:"ip,omitempty"`
-	Tags     pq.StringArray  `gorm:"type:text[];not null;default:'{}'" json:"tags"`
-	Online   bool            `gorm:"not null;default:false;index" json:"online"`
-	HasAgent bool            `gorm:"not null;default:false;index" json:"has_agent"`
+	ID       uuid.UUID      `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	Hostname string         `gorm:"type:varchar(255);not null;uniqueIndex" json:"hostname"`
+	IP       string         `gorm:"type:varchar(45)" json:"ip,omitempty"`
+	Tags     pq.StringArray `gorm:"type:text[];not null;default:'{}'" json:"tags"`
+	// ManualTags are the tags set through the API. They are part of Tags
+	// and survive the node sync.
+	ManualTags pq.StringArray `gorm:"type:text[];not null;default:'{}'" json:"manual_tags"`
+	Online     bool           `gorm:"not null;default:false;index" json:"online"`
+	HasAgent   bool           `gorm:"not null;default:false;index" json:"has_agent"`
+	// Draining nodes get no new deployments until they are uncordoned
+	Draining bool            `gorm:"not null;default:false" json:"draining"`
 	LastSeen *time.Time      `json:"last_seen,omitempty"`
 	Metadata json.RawMessage `gorm:"type:jsonb" json:"metadata,omitempty"`
 	SyncedAt time.Time       `gorm:"not null;default:now()" json:"synced_at"`
@@ -110,6 +286,23 @@ type ComponentLog struct {
 	CreatedAt     time.Time `gorm:"not null;default:now()" json:"created_at"`
 }
 
+// API key scopes. Read keys may only make GET requests; admin keys may also
+// deploy, change and remove things.
+const (
+	ScopeRead  = "read"
+	ScopeAdmin = "admin"
+)
+
+// APIKey is a credential for the HTTP API. Only the SHA-256 hash of the key
+// is stored.
+type APIKey struct {
+	ID        uuid.UUID `gorm:"type:uuid;primary_key;default:gen_random_uuid()" json:"id"`
+	Name      string    `gorm:"type:varchar(255);not null" json:"name"`
+	KeyHash   string    `gorm:"type:varchar(64);not null;uniqueIndex" json:"-"`
+	Scope     string    `gorm:"type:varchar(20);not null;default:admin" json:"scope"`
+	CreatedAt time.Time `gorm:"not null;default:now()" json:"created_at"`
+}
+
 func NewControllerDB(dsn string) (*ControllerDB, error) {
 	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{
 		Logger: logger.Default.LogMode(logger.Warn),
@@ -118,7 +311,17 @@ func NewControllerDB(dsn string) (*ControllerDB, error) {
 		return nil, fmt.Errorf("failed to connect to database: %w", err)
 	}
 
-	if err := db.AutoMigrate(
+	if err := migrate(db); err != nil {
+		return nil, fmt.Errorf("failed to migrate database: %w", err)
+	}
+
+	return &ControllerDB{db: db}, nil
+}
+
+// AutoMigrate brings the schema in line with the models using gorm. It is a
+// development fallback only: schema changes ship as versioned migrations.
+func (d *ControllerDB) AutoMigrate() error {
+	return d.db.AutoMigrate(
 		&Deployment{},
 		&Component{},
 		&ComponentDeployment{},
@@ -126,11 +329,10 @@ func NewControllerDB(dsn string) (*ControllerDB, error) {
 		&DeploymentLog{},
 		&Node{},
 		&ComponentLog{},
-	); err != nil {
-		return nil, fmt.Errorf("failed to migrate database: %w", err)
-	}
-
-	return &ControllerDB{db: db}, nil
+		&ControllerLease{},
+		&APIKey{},
+		&ComponentHistory{},
+	)
 }
 
 func (d *ControllerDB) Close() error {
@@ -148,7 +350,7 @@ func (d *ControllerDB) CreateDeployment(deployment *Deployment) error {
 func (d *ControllerDB) GetDeployment(id uuid.UUID) (*Deployment, error) {
 	var deployment Deployment
 	if err := d.db.First(&deployment, "id = ?", id).Error; err != nil {
-		return nil, err
+		return nil, notFound(err, "deployment %s", id)
 	}
 	return &deployment, nil
 }
@@ -159,6 +361,12 @@ func (d *ControllerDB) ListDeployments(limit, offset int) ([]Deployment, error)
 	return deployments, err
 }
 
+func (d *ControllerDB) CountDeployments() (int64, error) {
+	var count int64
+	err := d.db.Model(&Deployment{}).Count(&count).Error
+	return count, err
+}
+
 func (d *ControllerDB) UpdateDeploymentStatus(id uuid.UUID, status, errorMessage string) error {
 	updates := map[string]interface{}{
 		"status": status,
@@ -167,7 +375,7 @@ func (d *ControllerDB) UpdateDeploymentStatus(id uuid.UUID, status, errorMessage
 	if status == "running" {
 		now := time.Now()
 		updates["started_at"] = now
-	} else if status == "completed" || status == "failed" {
+	} else if status == "completed" || status == "failed" || status == "partial" || status == "rolled_back" {
 		now := time.Now()
 		updates["completed_at"] = now
 	}
@@ -176,17 +384,151 @@ func (d *ControllerDB) UpdateDeploymentStatus(id uuid.UUID, status, errorMessage
 		updates["error_message"] = errorMessage
 	}
 
-	return d.db.Model(&Deployment{}).Where("id = ?", id).Updates(updates).Error
+	// A cancelled deployment keeps that status even if processing finishes
+	return d.db.Model(&Deployment{}).Where("id = ? AND status <> ?", id, "cancelled").Updates(updates).Error
+}
+
+// CancelDeployment marks a pending or running deployment cancelled,
+// returning false if it's in any other state
+func (d *ControllerDB) CancelDeployment(id uuid.UUID, message string) (bool, error) {
+	result := d.db.Model(&Deployment{}).
+		Where("id = ? AND status IN ?", id, []string{"pending", "running"}).
+		Updates(map[string]interface{}{
+			"status":        "cancelled",
+			"completed_at":  time.Now(),
+			"error_message": message,
+		})
+	return result.RowsAffected == 1, result.Error
+}
+
+// ClaimDeployment moves a pending deployment to running, returning false if
+// it was already picked up
+func (d *ControllerDB) ClaimDeployment(id uuid.UUID) (bool, error) {
+	result := d.db.Model(&Deployment{}).
+		Where("id = ? AND status = ?", id, "pending").
+		Updates(map[string]interface{}{
+			"status":     "running",
+			"started_at": time.Now(),
+		})
+	return result.RowsAffected == 1, result.Error
+}
+
+// ApproveDeployment releases a deployment awaiting approval for processing,
+// returning false if it isn't awaiting approval
+func (d *ControllerDB) ApproveDeployment(id uuid.UUID, approver string) (bool, error) {
+	result := d.db.Model(&Deployment{}).
+		Where("id = ? AND status = ?", id, "pending-approval").
+		Updates(map[string]interface{}{
+			"status":      "pending",
+			"approved_by": approver,
+			"approved_at": time.Now(),
+		})
+	return result.RowsAffected == 1, result.Error
+}
+
+// DecideCanary records a promote or abort decision for the canary phase of a
+// running deployment, returning false if it isn't running
+func (d *ControllerDB) DecideCanary(id uuid.UUID, decision, reviewer string) (bool, error) {
+	result := d.db.Model(&Deployment{}).
+		Where("id = ? AND status = ?", id, "running").
+		Updates(map[string]interface{}{
+			"canary_decision":   decision,
+			"canary_decided_by": reviewer,
+		})
+	return result.RowsAffected == 1, result.Error
+}
+
+// RejectDeployment cancels a deployment awaiting approval, returning false if
+// it isn't awaiting approval
+func (d *ControllerDB) RejectDeployment(id uuid.UUID, reviewer, reason string) (bool, error) {
+	message := fmt.Sprintf("Rejected by %s", reviewer)
+	if reason != "" {
+		message += ": " + reason
+	}
+
+	result := d.db.Model(&Deployment{}).
+		Where("id = ? AND status = ?", id, "pending-approval").
+		Updates(map[string]interface{}{
+			"status":        "rejected",
+			"approved_by":   reviewer,
+			"approved_at":   time.Now(),
+			"completed_at":  time.Now(),
+			"error_message": message,
+		})
+	return result.RowsAffected == 1, result.Error
+}
+
+func (d *ControllerDB) ListPendingDeployments() ([]Deployment, error) {
+	var deployments []Deployment
+	err := d.db.Where("status = ?", "pending").Order("created_at").Find(&deployments).Error
+	return deployments, err
+}
+
+// ListInterruptedDeployments returns the deployments that stored a plan and
+// are still running
+func (d *ControllerDB) ListInterruptedDeployments() ([]Deployment, error) {
+	var deployments []Deployment
+	err := d.db.Where("status = ? AND plan IS NOT NULL", "running").Order("created_at").Find(&deployments).Error
+	return deployments, err
+}
+
+// ApplyDeploymentPlan stores a deployment's plan together with the component
+// changes that need no node: the components to upsert and the ones to
+// delete. Either all of it is written or none of it. The deleted components
+// count as started.
+func (d *ControllerDB) ApplyDeploymentPlan(deploymentID uuid.UUID, plan *DeploymentPlan, upserts []*Component, deletes []string) error {
+	plan.Started = append(plan.Started, deletes...)
+	data, err := json.Marshal(plan)
+	if err != nil {
+		return fmt.Errorf("failed to encode deployment plan: %w", err)
+	}
+
+	return d.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&Deployment{}).Where("id = ?", deploymentID).Update("plan", data).Error; err != nil {
+			return fmt.Errorf("failed to store deployment plan: %w", err)
+		}
+
+		for _, component := range upserts {
+			if err := upsertComponent(tx, component); err != nil {
+				return fmt.Errorf("failed to save component %s: %w", component.Name, err)
+			}
+		}
+
+		for _, name := range deletes {
+			if err := tx.Delete(&Component{}, "name = ?", name).Error; err != nil {
+				return fmt.Errorf("failed to delete component %s: %w", name, err)
+			}
+		}
+
+		return nil
+	})
+}
+
+// MarkPlanStepStarted records that a deployment began its step for a
+// component
+func (d *ControllerDB) MarkPlanStepStarted(deploymentID uuid.UUID, name string) error {
+	return d.db.Exec(`UPDATE deployments
+		SET plan = jsonb_set(plan, '{started}', COALESCE(plan->'started', '[]'::jsonb) || to_jsonb(?::text))
+		WHERE id = ? AND plan IS NOT NULL`, name, deploymentID).Error
 }
 
 func (d *ControllerDB) UpsertComponent(component *Component) error {
+	return d.db.Transaction(func(tx *gorm.DB) error {
+		return upsertComponent(tx, component)
+	})
+}
+
+func upsertComponent(tx *gorm.DB, component *Component) error {
 	// Check if component exists by name
 	var existing Component
-	err := d.db.Where("name = ?", component.Name).First(&existing).Error
+	err := tx.Where("name = ?", component.Name).First(&existing).Error
 
 	if err == gorm.ErrRecordNotFound {
 		// Component doesn't exist, create new one
-		return d.db.Create(component).Error
+		if err := tx.Create(component).Error; err != nil {
+			return err
+		}
+		return recordComponentChange(tx, component.Name, "", component.Hash, component.DeploymentID)
 	}
 
 	if err != nil {
@@ -196,13 +538,95 @@ func (d *ControllerDB) UpsertComponent(component *Component) error {
 	// Component exists, update it using the existing ID
 	component.ID = existing.ID
 	component.CreatedAt = existing.CreatedAt
-	return d.db.Save(component).Error
+
+	same, err := SameSpec(existing, *component)
+	if err != nil {
+		return fmt.Errorf("failed to compare component versions: %w", err)
+	}
+	if same {
+		component.PreviousSpec = existing.PreviousSpec
+		return tx.Save(component).Error
+	}
+
+	// Keep the version being replaced so a failed update can be rolled back
+	existing.PreviousSpec = nil
+	previous, err := json.Marshal(componentSnapshot{Component: existing, ContentURLHeaders: existing.ContentURLHeaders})
+	if err != nil {
+		return fmt.Errorf("failed to store previous version: %w", err)
+	}
+	component.PreviousSpec = previous
+
+	if err := tx.Save(component).Error; err != nil {
+		return err
+	}
+	return recordComponentChange(tx, component.Name, existing.Hash, component.Hash, component.DeploymentID)
+}
+
+// recordComponentChange adds a row to a component's history. oldHash is
+// empty when the component was created.
+func recordComponentChange(tx *gorm.DB, name, oldHash, newHash string, deploymentID *uuid.UUID) error {
+	entry := &ComponentHistory{
+		ComponentName: name,
+		OldHash:       oldHash,
+		NewHash:       newHash,
+		DeploymentID:  deploymentID,
+	}
+	if err := tx.Create(entry).Error; err != nil {
+		return fmt.Errorf("failed to record component history: %w", err)
+	}
+	return nil
+}
+
+// GetComponentHistory returns the recorded changes to a component, newest
+// first
+func (d *ControllerDB) GetComponentHistory(name string, limit int) ([]ComponentHistory, error) {
+	var history []ComponentHistory
+	err := d.db.Where("component_name = ?", name).
+		Order("created_at DESC").
+		Limit(limit).
+		Find(&history).Error
+	return history, err
+}
+
+// RollbackComponent restores the version a component had before its last
+// update and returns it. The restored version has no previous version of
+// its own, so a component can only be rolled back once per update.
+func (d *ControllerDB) RollbackComponent(name string) (*Component, error) {
+	current, err := d.GetComponent(name)
+	if err != nil {
+		return nil, err
+	}
+	if len(current.PreviousSpec) == 0 {
+		return nil, fmt.Errorf("component %s has no previous version", name)
+	}
+
+	var snapshot componentSnapshot
+	if err := json.Unmarshal(current.PreviousSpec, &snapshot); err != nil {
+		return nil, fmt.Errorf("failed to parse previous version: %w", err)
+	}
+
+	previous := snapshot.Component
+	previous.ContentURLHeaders = snapshot.ContentURLHeaders
+	previous.ID = current.ID
+	previous.CreatedAt = current.CreatedAt
+	previous.PreviousSpec = nil
+
+	err = d.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(&previous).Error; err != nil {
+			return err
+		}
+		return recordComponentChange(tx, name, current.Hash, previous.Hash, current.DeploymentID)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &previous, nil
 }
 
 func (d *ControllerDB) GetComponent(name string) (*Component, error) {
 	var component Component
 	if err := d.db.First(&component, "name = ?", name).Error; err != nil {
-		return nil, err
+		return nil, notFound(err, "component %s", name)
 	}
 	return &component, nil
 }
@@ -213,22 +637,152 @@ func (d *ControllerDB) ListComponents() ([]Component, error) {
 	return components, err
 }
 
+// ComponentFilter selects components for ListComponentsFiltered. Empty
+// fields match every component, and a zero Limit lists all of them.
+type ComponentFilter struct {
+	Type       string
+	Handler    string
+	Tag        string
+	NamePrefix string
+
+	// Sort is "name" (the default) or "created_at"
+	Sort   string
+	Desc   bool
+	Limit  int
+	Offset int
+}
+
+func (f ComponentFilter) apply(query *gorm.DB) *gorm.DB {
+	if f.Type != "" {
+		query = query.Where("type = ?", f.Type)
+	}
+	if f.Handler != "" {
+		query = query.Where("handler = ?", f.Handler)
+	}
+	if f.Tag != "" {
+		query = query.Where("? = ANY(tags)", f.Tag)
+	}
+	if f.NamePrefix != "" {
+		query = query.Where("name LIKE ? ESCAPE '\\'", escapeLike(f.NamePrefix)+"%")
+	}
+	return query
+}
+
+// escapeLike escapes the LIKE wildcards in s
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// orderBy returns the ORDER BY clause for a sort column the caller has
+// already validated
+func orderBy(column string, desc bool) string {
+	if desc {
+		return column + " DESC"
+	}
+	return column
+}
+
+func (d *ControllerDB) ListComponentsFiltered(filter ComponentFilter) ([]Component, error) {
+	sort := "name"
+	if filter.Sort == "created_at" {
+		sort = "created_at"
+	}
+
+	query := filter.apply(d.db).Order(orderBy(sort, filter.Desc))
+	if filter.Limit > 0 {
+		query = query.Limit(filter.Limit).Offset(filter.Offset)
+	}
+
+	var components []Component
+	err := query.Find(&components).Error
+	return components, err
+}
+
+// CountComponentsFiltered counts the components the filter matches,
+// ignoring its paging
+func (d *ControllerDB) CountComponentsFiltered(filter ComponentFilter) (int64, error) {
+	var count int64
+	err := filter.apply(d.db.Model(&Component{})).Count(&count).Error
+	return count, err
+}
+
+func (d *ControllerDB) ListComponentsByTag(tag string) ([]Component, error) {
+	var components []Component
+	err := d.db.Where("? = ANY(tags)", tag).Order("name").Find(&components).Error
+	return components, err
+}
+
 func (d *ControllerDB) DeleteComponent(name string) error {
 	return d.db.Delete(&Component{}, "name = ?", name).Error
 }
 
 func (d *ControllerDB) UpsertComponentDeployment(deployment *ComponentDeployment) error {
-	var existing ComponentDeployment
-	err := d.db.Where("component_name = ? AND node_hostname = ?",
-		deployment.ComponentName, deployment.NodeHostname).First(&existing).Error
+	// Reports are partial (a health result carries no status or PID), so only
+	// the non-zero fields overwrite an existing row and the rest is preserved
+	columns, err := nonZeroColumns(d.db, deployment, "id", "component_name", "node_hostname", "created_at")
+	if err != nil {
+		return err
+	}
 
-	if err == gorm.ErrRecordNotFound {
-		return d.db.Create(deployment).Error
+	onConflict := clause.OnConflict{
+		Columns: []clause.Column{{Name: "component_name"}, {Name: "node_hostname"}},
+	}
+	if len(columns) == 0 {
+		onConflict.DoNothing = true
+	} else {
+		onConflict.DoUpdates = clause.AssignmentColumns(columns)
 	}
 
-	deployment.ID = existing.ID
-	deployment.CreatedAt = existing.CreatedAt
-	return d.db.Save(deployment).Error
+	return d.db.Clauses(onConflict).Create(deployment).Error
+}
+
+// UpdateComponentDeployment sets the given columns of a component's record on
+// a node, creating the record if there is none. Columns missing from fields
+// keep their values, so each kind of agent report writes only what it owns.
+func (d *ControllerDB) UpdateComponentDeployment(componentName, nodeHostname string, fields map[string]interface{}) error {
+	values := map[string]interface{}{
+		"component_name": componentName,
+		"node_hostname":  nodeHostname,
+		"status":         "",
+	}
+	columns := make([]string, 0, len(fields))
+	for column, value := range fields {
+		values[column] = value
+		columns = append(columns, column)
+	}
+	slices.Sort(columns)
+
+	onConflict := clause.OnConflict{
+		Columns: []clause.Column{{Name: "component_name"}, {Name: "node_hostname"}},
+	}
+	if len(columns) == 0 {
+		onConflict.DoNothing = true
+	} else {
+		onConflict.DoUpdates = clause.AssignmentColumns(columns)
+	}
+
+	return d.db.Model(&ComponentDeployment{}).Clauses(onConflict).Create(values).Error
+}
+
+// nonZeroColumns returns the columns of the fields that are set in value,
+// except the ones in skip
+func nonZeroColumns(db *gorm.DB, value any, skip ...string) ([]string, error) {
+	stmt := &gorm.Statement{DB: db}
+	if err := stmt.Parse(value); err != nil {
+		return nil, err
+	}
+
+	rv := reflect.ValueOf(value)
+	var columns []string
+	for _, field := range stmt.Schema.Fields {
+		if field.DBName == "" || slices.Contains(skip, field.DBName) {
+			continue
+		}
+		if _, zero := field.ValueOf(context.Background(), rv); !zero {
+			columns = append(columns, field.DBName)
+		}
+	}
+	return columns, nil
 }
 
 func (d *ControllerDB) GetComponentDeployments(componentName string) ([]ComponentDeployment, error) {
@@ -237,6 +791,50 @@ func (d *ControllerDB) GetComponentDeployments(componentName string) ([]Componen
 	return deployments, err
 }
 
+func (d *ControllerDB) GetComponentDeployment(componentName, nodeHostname string) (*ComponentDeployment, error) {
+	var deployment ComponentDeployment
+	err := d.db.Where("component_name = ? AND node_hostname = ?", componentName, nodeHostname).First(&deployment).Error
+	if err != nil {
+		return nil, notFound(err, "component %s on node %s", componentName, nodeHostname)
+	}
+	return &deployment, nil
+}
+
+// ListDeploymentNodes returns the per-node records a deployment is tracking
+func (d *ControllerDB) ListDeploymentNodes(deploymentID uuid.UUID) ([]ComponentDeployment, error) {
+	var deployments []ComponentDeployment
+	err := d.db.Where("deployment_id = ?", deploymentID).Find(&deployments).Error
+	return deployments, err
+}
+
+// GetDeploymentComponentStatuses returns the state of each component on each
+// node a deployment is tracking
+func (d *ControllerDB) GetDeploymentComponentStatuses(deploymentID uuid.UUID) ([]models.ComponentStatus, error) {
+	var records []ComponentDeployment
+	err := d.db.Where("deployment_id = ?", deploymentID).
+		Order("component_name, node_hostname").
+		Find(&records).Error
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]models.ComponentStatus, 0, len(records))
+	for _, record := range records {
+		status := models.ComponentStatus{
+			ComponentName: record.ComponentName,
+			NodeHostname:  record.NodeHostname,
+			Status:        record.Status,
+			DeployedAt:    record.DeployedAt,
+		}
+		if record.Message != "" {
+			message := record.Message
+			status.Message = &message
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
 func (d *ControllerDB) GetNodeDeployments(nodeHostname string) ([]ComponentDeployment, error) {
 	var deployments []ComponentDeployment
 	err := d.db.Where("node_hostname = ?", nodeHostname).Find(&deployments).Error
@@ -258,6 +856,13 @@ func (d *ControllerDB) DeleteComponentDeployments(componentName, nodeHostname st
 		componentName, nodeHostname).Delete(&ComponentDeployment{}).Error
 }
 
+// DeleteRemovedComponentDeployment deletes a component's record on a node
+// once the agent confirmed a removal the record was marked removing for
+func (d *ControllerDB) DeleteRemovedComponentDeployment(componentName, nodeHostname string) error {
+	return d.db.Where("component_name = ? AND node_hostname = ? AND status = ?",
+		componentName, nodeHostname, "removing").Delete(&ComponentDeployment{}).Error
+}
+
 func (d *ControllerDB) UpsertAgent(agent *Agent) error {
 	var existing Agent
 	err := d.db.Where("hostname = ?", agent.Hostname).First(&existing).Error
@@ -278,7 +883,7 @@ func (d *ControllerDB) UpsertAgent(agent *Agent) error {
 func (d *ControllerDB) GetAgent(hostname string) (*Agent, error) {
 	var agent Agent
 	if err := d.db.First(&agent, "hostname = ?", hostname).Error; err != nil {
-		return nil, err
+		return nil, notFound(err, "agent %s", hostname)
 	}
 	return &agent, nil
 }
@@ -293,6 +898,53 @@ func (d *ControllerDB) ListAgents(onlineOnly bool) ([]Agent, error) {
 	return agents, err
 }
 
+func (d *ControllerDB) ListAgentsPage(onlineOnly bool, limit, offset int) ([]Agent, error) {
+	query := d.db
+	if onlineOnly {
+		query = query.Where("online = ?", true)
+	}
+	var agents []Agent
+	err := query.Order("hostname").Limit(limit).Offset(offset).Find(&agents).Error
+	return agents, err
+}
+
+func (d *ControllerDB) CountAgents(onlineOnly bool) (int64, error) {
+	query := d.db.Model(&Agent{})
+	if onlineOnly {
+		query = query.Where("online = ?", true)
+	}
+	var count int64
+	err := query.Count(&count).Error
+	return count, err
+}
+
+// ListStaleAgents returns online agents whose last heartbeat is older than the
+// given time, i.e. agents approaching the offline timeout
+func (d *ControllerDB) ListStaleAgents(heartbeatBefore time.Time) ([]Agent, error) {
+	var agents []Agent
+	err := d.db.Where("online = ? AND last_heartbeat < ?", true, heartbeatBefore).
+		Order("last_heartbeat").
+		Find(&agents).Error
+	return agents, err
+}
+
+func (d *ControllerDB) ListStaleAgentsPage(heartbeatBefore time.Time, limit, offset int) ([]Agent, error) {
+	var agents []Agent
+	err := d.db.Where("online = ? AND last_heartbeat < ?", true, heartbeatBefore).
+		Order("last_heartbeat").Order("hostname").
+		Limit(limit).Offset(offset).
+		Find(&agents).Error
+	return agents, err
+}
+
+func (d *ControllerDB) CountStaleAgents(heartbeatBefore time.Time) (int64, error) {
+	var count int64
+	err := d.db.Model(&Agent{}).
+		Where("online = ? AND last_heartbeat < ?", true, heartbeatBefore).
+		Count(&count).Error
+	return count, err
+}
+
 func (d *ControllerDB) MarkAgentsOffline(beforeTime time.Time) error {
 	return d.db.Model(&Agent{}).
 		Where("last_heartbeat < ? AND online = ?", beforeTime, true).
@@ -325,13 +977,124 @@ func (d *ControllerDB) UpsertNode(node *Node) error {
 	}
 
 	node.ID = existing.ID
+	// Draining and the manual tags are only changed through the API, not by
+	// the node sync
+	node.Draining = existing.Draining
+	node.ManualTags = existing.ManualTags
+	node.Tags = addTags(node.Tags, existing.ManualTags)
+	// Sources that only know when a node is up leave LastSeen unset for
+	// unreachable ones
+	if node.LastSeen == nil {
+		node.LastSeen = existing.LastSeen
+	}
 	return d.db.Save(node).Error
 }
 
+// addTags returns tags with the ones in add appended, skipping duplicates
+func addTags(tags, add []string) pq.StringArray {
+	merged := append(pq.StringArray{}, tags...)
+	for _, tag := range add {
+		if !slices.Contains(merged, tag) {
+			merged = append(merged, tag)
+		}
+	}
+	return merged
+}
+
+// removeTags returns tags without the ones in remove
+func removeTags(tags, remove []string) pq.StringArray {
+	kept := pq.StringArray{}
+	for _, tag := range tags {
+		if !slices.Contains(remove, tag) {
+			kept = append(kept, tag)
+		}
+	}
+	return kept
+}
+
+// SetNodeTags replaces a node's tags with manually set ones
+func (d *ControllerDB) SetNodeTags(hostname string, tags []string) (*Node, error) {
+	return d.updateNodeTags(hostname, func(node *Node) {
+		node.Tags = addTags(nil, tags)
+		node.ManualTags = addTags(nil, tags)
+	})
+}
+
+// UpdateNodeTags adds and removes manually set tags. A removed tag that the
+// command-core sync reports comes back with the next sync.
+func (d *ControllerDB) UpdateNodeTags(hostname string, add, remove []string) (*Node, error) {
+	return d.updateNodeTags(hostname, func(node *Node) {
+		node.Tags = removeTags(addTags(node.Tags, add), remove)
+		node.ManualTags = removeTags(addTags(node.ManualTags, add), remove)
+	})
+}
+
+func (d *ControllerDB) updateNodeTags(hostname string, update func(*Node)) (*Node, error) {
+	var node Node
+	err := d.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&node, "hostname = ?", hostname).Error; err != nil {
+			return notFound(err, "node %s", hostname)
+		}
+
+		update(&node)
+		return tx.Model(&node).Updates(map[string]interface{}{
+			"tags":        node.Tags,
+			"manual_tags": node.ManualTags,
+		}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &node, nil
+}
+
+// SetNodeDraining marks a node as draining or clears the mark, returning
+// false if the node doesn't exist
+func (d *ControllerDB) SetNodeDraining(hostname string, draining bool) (bool, error) {
+	result := d.db.Model(&Node{}).Where("hostname = ?", hostname).Update("draining", draining)
+	return result.RowsAffected == 1, result.Error
+}
+
+// RecordNodeHeartbeat marks a node online with an agent and adds tags to the
+// ones it already has, creating the node if it isn't known yet. Everything
+// else, including the tags from the command-core sync, is left alone.
+func (d *ControllerDB) RecordNodeHeartbeat(hostname string, tags []string, seenAt time.Time) error {
+	var existing Node
+	err := d.db.Where("hostname = ?", hostname).First(&existing).Error
+
+	if err == gorm.ErrRecordNotFound {
+		return d.db.Create(&Node{
+			Hostname: hostname,
+			Tags:     tags,
+			Online:   true,
+			HasAgent: true,
+			LastSeen: &seenAt,
+		}).Error
+	}
+
+	if err != nil {
+		return err
+	}
+
+	merged := existing.Tags
+	for _, tag := range tags {
+		if !slices.Contains(merged, tag) {
+			merged = append(merged, tag)
+		}
+	}
+
+	return d.db.Model(&existing).Updates(map[string]interface{}{
+		"tags":      merged,
+		"online":    true,
+		"has_agent": true,
+		"last_seen": seenAt,
+	}).Error
+}
+
 func (d *ControllerDB) GetNode(hostname string) (*Node, error) {
 	var node Node
 	if err := d.db.First(&node, "hostname = ?", hostname).Error; err != nil {
-		return nil, err
+		return nil, notFound(err, "node %s", hostname)
 	}
 	return &node, nil
 }
@@ -346,15 +1109,100 @@ func (d *ControllerDB) ListNodes(onlineOnly bool) ([]Node, error) {
 	return nodes, err
 }
 
+// NodeFilter selects nodes for ListNodesFiltered. Nodes carrying any of Tags
+// match, like GetNodesByTags; empty fields match every node and a zero Limit
+// lists all of them.
+type NodeFilter struct {
+	OnlineOnly bool
+	Tags       []string
+	HasAgent   *bool
+
+	// Sort is "name" (the default) or "last_seen"
+	Sort   string
+	Desc   bool
+	Limit  int
+	Offset int
+}
+
+func (f NodeFilter) apply(query *gorm.DB) *gorm.DB {
+	if f.OnlineOnly {
+		query = query.Where("online = ?", true)
+	}
+	if len(f.Tags) > 0 {
+		query = withAnyTag(query, f.Tags)
+	}
+	if f.HasAgent != nil {
+		query = query.Where("has_agent = ?", *f.HasAgent)
+	}
+	return query
+}
+
+func (d *ControllerDB) ListNodesFiltered(filter NodeFilter) ([]Node, error) {
+	sort := "hostname"
+	if filter.Sort == "last_seen" {
+		sort = "last_seen"
+	}
+
+	query := filter.apply(d.db).Order(orderBy(sort, filter.Desc))
+	if filter.Limit > 0 {
+		query = query.Limit(filter.Limit).Offset(filter.Offset)
+	}
+
+	var nodes []Node
+	err := query.Find(&nodes).Error
+	return nodes, err
+}
+
+// CountNodesFiltered counts the nodes the filter matches, ignoring its paging
+func (d *ControllerDB) CountNodesFiltered(filter NodeFilter) (int64, error) {
+	var count int64
+	err := filter.apply(d.db.Model(&Node{})).Count(&count).Error
+	return count, err
+}
+
+// withAnyTag limits a node query to nodes carrying at least one of tags
+func withAnyTag(query *gorm.DB, tags []string) *gorm.DB {
+	return query.Where("tags && ?", pq.Array(tags))
+}
+
 func (d *ControllerDB) GetNodesByTags(tags []string) ([]Node, error) {
 	var nodes []Node
-	err := d.db.Where("tags && ?", pq.Array(tags)).Find(&nodes).Error
+	err := withAnyTag(d.db, tags).Find(&nodes).Error
 	return nodes, err
 }
 
-func (d *ControllerDB) CleanupOldDeployments(olderThan time.Time) error {
-	return d.db.Where("created_at < ? AND status IN (?)", olderThan,
-		[]string{"completed", "failed"}).Delete(&Deployment{}).Error
+// CleanupOldDeployments deletes finished deployments created before
+// olderThan along with their logs, returning how many were removed. Node
+// records still pointing at a removed deployment keep their current state
+// and lose only the reference.
+func (d *ControllerDB) CleanupOldDeployments(olderThan time.Time) (int64, error) {
+	var removed int64
+	err := d.db.Transaction(func(tx *gorm.DB) error {
+		var ids []uuid.UUID
+		if err := tx.Model(&Deployment{}).
+			Where("created_at < ? AND status IN (?)", olderThan, []string{"completed", "failed", "partial", "rolled_back", "cancelled", "rejected"}).
+			Pluck("id", &ids).Error; err != nil {
+			return err
+		}
+
+		if len(ids) == 0 {
+			return nil
+		}
+
+		if err := tx.Where("deployment_id IN (?)", ids).Delete(&DeploymentLog{}).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Model(&ComponentDeployment{}).Where("deployment_id IN (?)", ids).
+			Update("deployment_id", nil).Error; err != nil {
+			return err
+		}
+
+		result := tx.Where("id IN (?)", ids).Delete(&Deployment{})
+		removed = result.RowsAffected
+		return result.Error
+	})
+	return removed, err
 }
 
 func (d *ControllerDB) SaveComponentLog(log *ComponentLog) error {
@@ -409,3 +1257,93 @@ func (d *ControllerDB) CleanupComponentLogsKeepRecent(keepCount int) error {
 	result := d.db.Exec(query, keepCount)
 	return result.Error
 }
+
+// AcquireLease takes or renews the named lease for holder. It succeeds when
+// the lease is free, expired, or already held by holder. Expiry is computed
+// by the database so controllers don't depend on synchronized clocks.
+func (d *ControllerDB) AcquireLease(name, holder string, ttl time.Duration) (bool, error) {
+	result := d.db.Exec(`
+		INSERT INTO controller_leases (name, holder, expires_at)
+		VALUES (?, ?, now() + make_interval(secs => ?))
+		ON CONFLICT (name) DO UPDATE
+		SET holder = EXCLUDED.holder, expires_at = EXCLUDED.expires_at
+		WHERE controller_leases.holder = EXCLUDED.holder
+		   OR controller_leases.expires_at < now()`,
+		name, holder, ttl.Seconds())
+	return result.RowsAffected == 1, result.Error
+}
+
+func (d *ControllerDB) ReleaseLease(name, holder string) error {
+	return d.db.Where("name = ? AND holder = ?", name, holder).Delete(&ControllerLease{}).Error
+}
+
+func (d *ControllerDB) GetLease(name string) (*ControllerLease, error) {
+	var lease ControllerLease
+	if err := d.db.First(&lease, "name = ?", name).Error; err != nil {
+		return nil, notFound(err, "lease %s", name)
+	}
+	return &lease, nil
+}
+
+// HashAPIKey returns the hash an API key is stored and looked up by
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func (d *ControllerDB) CreateAPIKey(key *APIKey) error {
+	return d.db.Create(key).Error
+}
+
+func (d *ControllerDB) GetAPIKeyByHash(hash string) (*APIKey, error) {
+	var key APIKey
+	if err := d.db.First(&key, "key_hash = ?", hash).Error; err != nil {
+		return nil, notFound(err, "api key")
+	}
+	return &key, nil
+}
+
+func (d *ControllerDB) GetAPIKey(id uuid.UUID) (*APIKey, error) {
+	var key APIKey
+	if err := d.db.First(&key, "id = ?", id).Error; err != nil {
+		return nil, notFound(err, "api key %s", id)
+	}
+	return &key, nil
+}
+
+func (d *ControllerDB) ListAPIKeys() ([]APIKey, error) {
+	var keys []APIKey
+	err := d.db.Order("created_at").Find(&keys).Error
+	return keys, err
+}
+
+// DeleteAPIKey revokes a key, returning false if it doesn't exist
+func (d *ControllerDB) DeleteAPIKey(id uuid.UUID) (bool, error) {
+	result := d.db.Delete(&APIKey{}, "id = ?", id)
+	return result.RowsAffected == 1, result.Error
+}
+
+// BootstrapAPIKey stores key as an admin key named "bootstrap" unless an
+// admin key already exists, so a fresh installation can create its first
+// keys through the API. It reports whether the key was created.
+func (d *ControllerDB) BootstrapAPIKey(key string) (bool, error) {
+	created := false
+	err := d.db.Transaction(func(tx *gorm.DB) error {
+		// Serialize controllers starting at the same time
+		if err := tx.Exec("LOCK TABLE api_keys IN SHARE ROW EXCLUSIVE MODE").Error; err != nil {
+			return err
+		}
+
+		var admins int64
+		if err := tx.Model(&APIKey{}).Where("scope = ?", ScopeAdmin).Count(&admins).Error; err != nil {
+			return err
+		}
+		if admins > 0 {
+			return nil
+		}
+
+		created = true
+		return tx.Create(&APIKey{Name: "bootstrap", KeyHash: HashAPIKey(key), Scope: ScopeAdmin}).Error
+	})
+	return created, err
+}
@@ -0,0 +1,758 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/metorial/fleet/cosmos/internal/controller/database/dbtest"
+)
+
+func setupTestDB(t *testing.T) (*ControllerDB, func()) {
+	dsn := dbtest.URL(t)
+
+	db, err := NewControllerDB(dsn)
+	if err != nil {
+		t.Fatalf("Failed to create test database: %v", err)
+	}
+
+	cleanup := func() {
+		db.db.Where("component_name LIKE ?", "test-%").Delete(&ComponentDeployment{})
+		db.Close()
+	}
+
+	return db, cleanup
+}
+
+func TestUpsertComponentDeploymentPreservesFields(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	componentName := "test-" + uuid.New().String()
+	pid := 4242
+	started := time.Now().Add(-time.Minute).Truncate(time.Second)
+
+	status := &ComponentDeployment{
+		ComponentName: componentName,
+		NodeHostname:  "node-1",
+		Status:        "running",
+		PID:           &pid,
+		LastStartedAt: &started,
+	}
+	if err := db.UpsertComponentDeployment(status); err != nil {
+		t.Fatalf("Failed to insert component deployment: %v", err)
+	}
+
+	now := time.Now()
+	health := &ComponentDeployment{
+		ComponentName:   componentName,
+		NodeHostname:    "node-1",
+		HealthStatus:    "healthy",
+		LastHealthCheck: &now,
+	}
+	if err := db.UpsertComponentDeployment(health); err != nil {
+		t.Fatalf("Failed to upsert health result: %v", err)
+	}
+
+	deployments, err := db.GetComponentDeployments(componentName)
+	if err != nil {
+		t.Fatalf("Failed to get component deployments: %v", err)
+	}
+
+	if len(deployments) != 1 {
+		t.Fatalf("Expected 1 deployment, got %d", len(deployments))
+	}
+
+	dep := deployments[0]
+	if dep.Status != "running" {
+		t.Errorf("Expected Status to be running, got %s", dep.Status)
+	}
+
+	if dep.PID == nil || *dep.PID != pid {
+		t.Errorf("Expected PID to be %d, got %v", pid, dep.PID)
+	}
+
+	if dep.LastStartedAt == nil || !dep.LastStartedAt.Equal(started) {
+		t.Errorf("Expected LastStartedAt to be preserved, got %v", dep.LastStartedAt)
+	}
+
+	if dep.HealthStatus != "healthy" {
+		t.Errorf("Expected HealthStatus to be healthy, got %s", dep.HealthStatus)
+	}
+}
+
+func TestUpsertComponentDeploymentStatusPreservesHealth(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	componentName := "test-" + uuid.New().String()
+	now := time.Now()
+
+	health := &ComponentDeployment{
+		ComponentName:   componentName,
+		NodeHostname:    "node-1",
+		Status:          "running",
+		HealthStatus:    "unhealthy",
+		LastHealthCheck: &now,
+	}
+	if err := db.UpsertComponentDeployment(health); err != nil {
+		t.Fatalf("Failed to insert component deployment: %v", err)
+	}
+
+	status := &ComponentDeployment{
+		ComponentName: componentName,
+		NodeHostname:  "node-1",
+		Status:        "stopped",
+	}
+	if err := db.UpsertComponentDeployment(status); err != nil {
+		t.Fatalf("Failed to upsert status: %v", err)
+	}
+
+	deployments, err := db.GetComponentDeployments(componentName)
+	if err != nil {
+		t.Fatalf("Failed to get component deployments: %v", err)
+	}
+
+	if len(deployments) != 1 {
+		t.Fatalf("Expected 1 deployment, got %d", len(deployments))
+	}
+
+	if deployments[0].Status != "stopped" {
+		t.Errorf("Expected Status to be stopped, got %s", deployments[0].Status)
+	}
+
+	if deployments[0].HealthStatus != "unhealthy" {
+		t.Errorf("Expected HealthStatus to be preserved, got %s", deployments[0].HealthStatus)
+	}
+}
+
+func TestConcurrentUpsertsMergeIntoOneRow(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	componentName := "test-" + uuid.New().String()
+	pid := 4242
+
+	// Status and health results for the same component and node race
+	const writers = 20
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+	for i := 0; i < writers; i++ {
+		report := &ComponentDeployment{ComponentName: componentName, NodeHostname: "node-1"}
+		if i%2 == 0 {
+			report.Status = "running"
+			report.PID = &pid
+		} else {
+			now := time.Now()
+			report.HealthStatus = "healthy"
+			report.LastHealthCheck = &now
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- db.UpsertComponentDeployment(report)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Errorf("Concurrent upsert failed: %v", err)
+		}
+	}
+
+	deployments, err := db.GetComponentDeployments(componentName)
+	if err != nil {
+		t.Fatalf("Failed to get component deployments: %v", err)
+	}
+	if len(deployments) != 1 {
+		t.Fatalf("Expected 1 row for the component and node, got %d", len(deployments))
+	}
+
+	dep := deployments[0]
+	if dep.Status != "running" || dep.PID == nil || *dep.PID != pid {
+		t.Errorf("Expected the status report's fields, got status %q and PID %v", dep.Status, dep.PID)
+	}
+	if dep.HealthStatus != "healthy" || dep.LastHealthCheck == nil {
+		t.Errorf("Expected the health result's fields, got %q at %v", dep.HealthStatus, dep.LastHealthCheck)
+	}
+}
+
+func TestUpsertComponentRecordsHistory(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	name := "test-" + uuid.New().String()
+	defer db.DeleteComponent(name)
+
+	first, second, third := uuid.New(), uuid.New(), uuid.New()
+	deploys := []struct {
+		hash         string
+		env          string
+		deploymentID uuid.UUID
+	}{
+		{"hash-v1", `{"MODE":"a"}`, first},
+		{"hash-v2", `{"MODE":"a"}`, second},
+		// Redeploying the same version changes nothing, however its JSON
+		// is formatted
+		{"hash-v2", `{ "MODE": "a" }`, uuid.New()},
+		// Changing only the env is a new version with the same hash
+		{"hash-v2", `{"MODE":"b"}`, third},
+	}
+	for _, deploy := range deploys {
+		deploymentID := deploy.deploymentID
+		component := &Component{Name: name, Type: "script", Handler: "agent", Hash: deploy.hash,
+			Env: json.RawMessage(deploy.env), DeploymentID: &deploymentID}
+		if err := db.UpsertComponent(component); err != nil {
+			t.Fatalf("Failed to upsert component: %v", err)
+		}
+	}
+
+	history, err := db.GetComponentHistory(name, 10)
+	if err != nil {
+		t.Fatalf("Failed to get component history: %v", err)
+	}
+	if len(history) != 3 {
+		t.Fatalf("Expected 3 history rows, got %d", len(history))
+	}
+
+	envChange, hashChange, created := history[0], history[1], history[2]
+	if created.OldHash != "" || created.NewHash != "hash-v1" || created.DeploymentID == nil || *created.DeploymentID != first {
+		t.Errorf("Expected the creation of hash-v1 by %s, got %+v", first, created)
+	}
+	if hashChange.OldHash != "hash-v1" || hashChange.NewHash != "hash-v2" || hashChange.DeploymentID == nil || *hashChange.DeploymentID != second {
+		t.Errorf("Expected the change to hash-v2 by %s, got %+v", second, hashChange)
+	}
+	if envChange.OldHash != "hash-v2" || envChange.NewHash != "hash-v2" || envChange.DeploymentID == nil || *envChange.DeploymentID != third {
+		t.Errorf("Expected the env change by %s, got %+v", third, envChange)
+	}
+
+	// Rolling back undoes the env change, not the hash change before it
+	previous, err := db.RollbackComponent(name)
+	if err != nil {
+		t.Fatalf("Failed to roll back: %v", err)
+	}
+	var env map[string]string
+	if err := json.Unmarshal(previous.Env, &env); err != nil || env["MODE"] != "a" || previous.Hash != "hash-v2" {
+		t.Errorf("Expected the rollback to restore MODE=a at hash-v2, got %s at %s", previous.Env, previous.Hash)
+	}
+}
+
+func TestSameSpec(t *testing.T) {
+	base := func(modify func(c *Component)) Component {
+		deploymentID := uuid.New()
+		c := Component{Name: "web", Type: "program", Handler: "agent", Hash: "v1",
+			Env: json.RawMessage(`{"A":"1","B":"2"}`), DeploymentID: &deploymentID, UpdatedAt: time.Now()}
+		modify(&c)
+		return c
+	}
+	stored := base(func(c *Component) {
+		// As read back from Postgres
+		c.ID = uuid.New()
+		c.Tags = []string{}
+		c.Env = json.RawMessage(`{"B": "2", "A": "1"}`)
+	})
+
+	tests := []struct {
+		name   string
+		modify func(c *Component)
+		same   bool
+	}{
+		{"redeploy", func(c *Component) {}, true},
+		{"env", func(c *Component) { c.Env = json.RawMessage(`{"A":"1","B":"3"}`) }, false},
+		{"args", func(c *Component) { c.Args = []string{"--verbose"} }, false},
+		{"handler", func(c *Component) { c.Handler = "command-core" }, false},
+		{"health check", func(c *Component) { c.HealthCheck = json.RawMessage(`{"type":"tcp"}`) }, false},
+		{"affinity", func(c *Component) { c.Affinity = []string{"db"} }, false},
+		{"content url headers", func(c *Component) { c.ContentURLHeaders = json.RawMessage(`{"Authorization":"x"}`) }, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			same, err := SameSpec(stored, base(tt.modify))
+			if err != nil {
+				t.Fatalf("Failed to compare: %v", err)
+			}
+			if same != tt.same {
+				t.Errorf("Expected SameSpec to be %v", tt.same)
+			}
+		})
+	}
+}
+
+func TestApplyDeploymentPlanIsAtomic(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	name := "test-" + uuid.New().String()
+	defer db.DeleteComponent(name)
+
+	deployment := &Deployment{ID: uuid.New(), Configuration: []byte("{}"), Status: "running", CreatedAt: time.Now()}
+	if err := db.CreateDeployment(deployment); err != nil {
+		t.Fatalf("Failed to create deployment: %v", err)
+	}
+
+	plan := &DeploymentPlan{Add: []string{name, "invalid"}}
+	upserts := []*Component{
+		{Name: name, Type: "script", Handler: "agent", Hash: "v1"},
+		// Longer than the hash column, so the second upsert fails
+		{Name: "invalid", Type: "script", Handler: "agent", Hash: strings.Repeat("x", 100)},
+	}
+	if err := db.ApplyDeploymentPlan(deployment.ID, plan, upserts, nil); err == nil {
+		t.Fatal("Expected the plan to fail")
+	}
+
+	if _, err := db.GetComponent(name); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected the first component to be rolled back with the plan, got %v", err)
+	}
+	stored, err := db.GetDeployment(deployment.ID)
+	if err != nil {
+		t.Fatalf("Failed to get deployment: %v", err)
+	}
+	if len(stored.Plan) != 0 {
+		t.Errorf("Expected no plan to be stored, got %s", stored.Plan)
+	}
+}
+
+func TestGetMissingRecordReturnsErrNotFound(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	missing := "test-" + uuid.New().String()
+
+	if _, err := db.GetComponent(missing); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetComponent: expected ErrNotFound, got %v", err)
+	}
+	if _, err := db.GetNode(missing); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetNode: expected ErrNotFound, got %v", err)
+	}
+	if _, err := db.GetAgent(missing); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetAgent: expected ErrNotFound, got %v", err)
+	}
+	if _, err := db.GetDeployment(uuid.New()); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetDeployment: expected ErrNotFound, got %v", err)
+	}
+	if _, err := db.GetComponentDeployment(missing, "node-1"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetComponentDeployment: expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestGetWithFailedDatabaseIsNotErrNotFound(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	// A closed connection pool stands in for an unreachable database
+	db.Close()
+
+	_, err := db.GetComponent("test-" + uuid.New().String())
+	if err == nil {
+		t.Fatal("Expected an error from a closed database")
+	}
+	if errors.Is(err, ErrNotFound) {
+		t.Errorf("Database failure reported as ErrNotFound: %v", err)
+	}
+}
+
+func TestRollbackComponentRestoresPreviousVersion(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	name := "test-" + uuid.New().String()
+	defer db.DeleteComponent(name)
+
+	original := &Component{
+		Name:              name,
+		Type:              "program",
+		Handler:           "agent",
+		Hash:              "hash-v1",
+		Tags:              []string{"web"},
+		ContentURL:        "https://example.com/v1.tar.gz",
+		ContentURLHeaders: []byte(`{"Authorization":"Bearer secret"}`),
+	}
+	if err := db.UpsertComponent(original); err != nil {
+		t.Fatalf("Failed to create component: %v", err)
+	}
+
+	update := &Component{
+		Name:       name,
+		Type:       "program",
+		Handler:    "agent",
+		Hash:       "hash-v2",
+		Tags:       []string{"web"},
+		ContentURL: "https://example.com/v2.tar.gz",
+	}
+	if err := db.UpsertComponent(update); err != nil {
+		t.Fatalf("Failed to update component: %v", err)
+	}
+
+	previous, err := db.RollbackComponent(name)
+	if err != nil {
+		t.Fatalf("Failed to roll back component: %v", err)
+	}
+	if previous.Hash != "hash-v1" || previous.ContentURL != "https://example.com/v1.tar.gz" {
+		t.Errorf("Expected v1 to be restored, got %s from %s", previous.Hash, previous.ContentURL)
+	}
+
+	stored, err := db.GetComponent(name)
+	if err != nil {
+		t.Fatalf("Failed to get component: %v", err)
+	}
+	if stored.Hash != "hash-v1" {
+		t.Errorf("Expected stored hash hash-v1, got %s", stored.Hash)
+	}
+	if string(stored.ContentURLHeaders) == "" {
+		t.Error("Expected content URL headers to survive the rollback")
+	}
+
+	if _, err := db.RollbackComponent(name); err == nil {
+		t.Error("Expected a second rollback to fail without a previous version")
+	}
+}
+
+func TestRecordNodeHeartbeatKeepsSyncedTags(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	hostname := "test-" + uuid.New().String()
+	defer db.db.Where("hostname = ?", hostname).Delete(&Node{})
+
+	// As written by the command-core node sync
+	if err := db.UpsertNode(&Node{Hostname: hostname, Tags: []string{"web", "eu-west"}, SyncedAt: time.Now()}); err != nil {
+		t.Fatalf("Failed to sync node: %v", err)
+	}
+
+	if err := db.RecordNodeHeartbeat(hostname, []string{"all", "web"}, time.Now()); err != nil {
+		t.Fatalf("Failed to record heartbeat: %v", err)
+	}
+
+	node, err := db.GetNode(hostname)
+	if err != nil {
+		t.Fatalf("Failed to get node: %v", err)
+	}
+	if !node.Online || !node.HasAgent || node.LastSeen == nil {
+		t.Errorf("Expected heartbeat to mark node online with an agent, got %+v", node)
+	}
+
+	want := []string{"web", "eu-west", "all"}
+	if len(node.Tags) != len(want) {
+		t.Fatalf("Expected tags %v, got %v", want, node.Tags)
+	}
+	for i, tag := range want {
+		if node.Tags[i] != tag {
+			t.Errorf("Expected tags %v, got %v", want, node.Tags)
+			break
+		}
+	}
+
+	nodes, err := db.GetNodesByTags([]string{"eu-west"})
+	if err != nil {
+		t.Fatalf("Failed to get nodes by tag: %v", err)
+	}
+	found := false
+	for _, n := range nodes {
+		found = found || n.Hostname == hostname
+	}
+	if !found {
+		t.Error("Expected node to still be targetable by its synced tag")
+	}
+}
+
+func TestCleanupOldDeploymentsRemovesLogs(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	now := time.Now()
+	create := func(status string, age time.Duration) uuid.UUID {
+		t.Helper()
+		deployment := &Deployment{ID: uuid.New(), Configuration: []byte("{}"), Status: status, CreatedAt: now.Add(-age)}
+		if err := db.CreateDeployment(deployment); err != nil {
+			t.Fatalf("Failed to create deployment: %v", err)
+		}
+		if err := db.LogDeployment(&DeploymentLog{DeploymentID: deployment.ID, Operation: "deploy", Status: status}); err != nil {
+			t.Fatalf("Failed to log deployment: %v", err)
+		}
+		return deployment.ID
+	}
+
+	stale := create("completed", 48*time.Hour)
+	rejected := create("rejected", 48*time.Hour)
+	recent := create("completed", time.Minute)
+	// Still running deployments are kept however old they are
+	running := create("running", 48*time.Hour)
+
+	componentName := "test-" + uuid.New().String()
+	if err := db.UpsertComponentDeployment(&ComponentDeployment{ComponentName: componentName, NodeHostname: "node-1", Status: "running", DeploymentID: &stale}); err != nil {
+		t.Fatalf("Failed to create component deployment: %v", err)
+	}
+
+	if _, err := db.CleanupOldDeployments(now.Add(-24 * time.Hour)); err != nil {
+		t.Fatalf("Cleanup failed: %v", err)
+	}
+
+	for _, id := range []uuid.UUID{stale, rejected} {
+		if _, err := db.GetDeployment(id); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Expected stale deployment %s to be removed, got %v", id, err)
+		}
+	}
+	if logs, _ := db.GetDeploymentLogs(stale, 10); len(logs) != 0 {
+		t.Errorf("Expected logs of the stale deployment to be removed, got %d", len(logs))
+	}
+
+	for _, id := range []uuid.UUID{recent, running} {
+		if _, err := db.GetDeployment(id); err != nil {
+			t.Errorf("Expected deployment %s to be kept, got %v", id, err)
+		}
+		if logs, _ := db.GetDeploymentLogs(id, 10); len(logs) != 1 {
+			t.Errorf("Expected logs of deployment %s to be kept, got %d", id, len(logs))
+		}
+	}
+
+	record, err := db.GetComponentDeployment(componentName, "node-1")
+	if err != nil {
+		t.Fatalf("Expected node record to be kept, got %v", err)
+	}
+	if record.DeploymentID != nil || record.Status != "running" {
+		t.Errorf("Expected node record to keep its state without the removed deployment, got %+v", record)
+	}
+
+	db.db.Where("id IN (?)", []uuid.UUID{recent, running}).Delete(&Deployment{})
+	db.db.Where("deployment_id IN (?)", []uuid.UUID{recent, running}).Delete(&DeploymentLog{})
+}
+
+func TestBootstrapAPIKeyOnlyWithoutAdmins(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	admin := &APIKey{Name: "test-admin", KeyHash: HashAPIKey(uuid.New().String()), Scope: ScopeAdmin}
+	if err := db.CreateAPIKey(admin); err != nil {
+		t.Fatalf("Failed to create key: %v", err)
+	}
+	defer db.DeleteAPIKey(admin.ID)
+
+	bootstrap := uuid.New().String()
+	created, err := db.BootstrapAPIKey(bootstrap)
+	if err != nil {
+		t.Fatalf("Failed to bootstrap key: %v", err)
+	}
+	if created {
+		t.Error("Expected no bootstrap key while an admin key exists")
+	}
+	if _, err := db.GetAPIKeyByHash(HashAPIKey(bootstrap)); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected bootstrap key not to be stored, got %v", err)
+	}
+
+	found, err := db.GetAPIKeyByHash(admin.KeyHash)
+	if err != nil {
+		t.Fatalf("Failed to look up key: %v", err)
+	}
+	if found.Scope != ScopeAdmin {
+		t.Errorf("Expected admin scope, got %q", found.Scope)
+	}
+}
+
+func TestListComponentsPageMatchesCount(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	prefix := "test-" + uuid.New().String()[:8] + "-"
+	for _, name := range []string{"a", "b", "c"} {
+		if err := db.UpsertComponent(&Component{Name: prefix + name, Type: "script", Handler: "agent", Hash: name}); err != nil {
+			t.Fatalf("Failed to create component: %v", err)
+		}
+		defer db.DeleteComponent(prefix + name)
+	}
+
+	total, err := db.CountComponentsFiltered(ComponentFilter{NamePrefix: prefix})
+	if err != nil {
+		t.Fatalf("Failed to count components: %v", err)
+	}
+
+	var seen int64
+	for offset := 0; ; offset += 2 {
+		page, err := db.ListComponentsFiltered(ComponentFilter{NamePrefix: prefix, Limit: 2, Offset: offset})
+		if err != nil {
+			t.Fatalf("Failed to list components: %v", err)
+		}
+		if len(page) == 0 {
+			break
+		}
+		if len(page) > 2 {
+			t.Fatalf("Expected at most 2 components per page, got %d", len(page))
+		}
+		seen += int64(len(page))
+	}
+
+	if seen != total || total != 3 {
+		t.Errorf("Pages held %d components, count says %d, want 3", seen, total)
+	}
+}
+
+func TestListComponentsFiltered(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	prefix := "test-" + uuid.New().String()[:8] + "-"
+	tag := prefix + "tag"
+	components := []Component{
+		{Name: prefix + "web", Type: "program", Handler: "agent", Tags: []string{tag}},
+		{Name: prefix + "cron", Type: "script", Handler: "agent", Tags: []string{tag}},
+		{Name: prefix + "job", Type: "service", Handler: "nomad"},
+		// The underscore must not act as a LIKE wildcard for prefix "x_"
+		{Name: prefix + "x_y", Type: "script", Handler: "command-core"},
+		{Name: prefix + "xzy", Type: "script", Handler: "command-core"},
+	}
+	for i := range components {
+		components[i].Hash = "h"
+		if err := db.UpsertComponent(&components[i]); err != nil {
+			t.Fatalf("Failed to create component: %v", err)
+		}
+		defer db.DeleteComponent(components[i].Name)
+	}
+
+	tests := []struct {
+		name   string
+		filter ComponentFilter
+		want   []string
+	}{
+		{"prefix", ComponentFilter{}, []string{"cron", "job", "web", "x_y", "xzy"}},
+		{"type", ComponentFilter{Type: "script"}, []string{"cron", "x_y", "xzy"}},
+		{"handler", ComponentFilter{Handler: "nomad"}, []string{"job"}},
+		{"tag", ComponentFilter{Tag: tag}, []string{"cron", "web"}},
+		{"type and tag", ComponentFilter{Type: "program", Tag: tag}, []string{"web"}},
+		{"type and handler", ComponentFilter{Type: "script", Handler: "command-core"}, []string{"x_y", "xzy"}},
+		{"literal underscore", ComponentFilter{NamePrefix: prefix + "x_"}, []string{"x_y"}},
+		{"descending", ComponentFilter{Tag: tag, Desc: true}, []string{"web", "cron"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.filter.NamePrefix == "" {
+				tt.filter.NamePrefix = prefix
+			}
+			found, err := db.ListComponentsFiltered(tt.filter)
+			if err != nil {
+				t.Fatalf("Failed to list components: %v", err)
+			}
+
+			var got []string
+			for _, comp := range found {
+				got = append(got, comp.Name[len(prefix):])
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("Got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestListNodesFiltered(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	prefix := "test-" + uuid.New().String()[:8] + "-"
+	tag := prefix + "tag"
+	nodes := []Node{
+		{Hostname: prefix + "a", Tags: []string{tag}, HasAgent: true},
+		{Hostname: prefix + "b", Tags: []string{tag}},
+		{Hostname: prefix + "c", Tags: []string{prefix + "other"}, HasAgent: true},
+	}
+	for i := range nodes {
+		if err := db.db.Create(&nodes[i]).Error; err != nil {
+			t.Fatalf("Failed to create node: %v", err)
+		}
+		defer db.db.Delete(&Node{}, "hostname = ?", nodes[i].Hostname)
+	}
+
+	yes, no := true, false
+	tests := []struct {
+		name   string
+		filter NodeFilter
+		want   []string
+	}{
+		{"tag", NodeFilter{Tags: []string{tag}}, []string{"a", "b"}},
+		{"any tag", NodeFilter{Tags: []string{tag, prefix + "other"}}, []string{"a", "b", "c"}},
+		{"tag with agent", NodeFilter{Tags: []string{tag}, HasAgent: &yes}, []string{"a"}},
+		{"tag without agent", NodeFilter{Tags: []string{tag}, HasAgent: &no}, []string{"b"}},
+		{"descending", NodeFilter{Tags: []string{tag, prefix + "other"}, Desc: true}, []string{"c", "b", "a"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			found, err := db.ListNodesFiltered(tt.filter)
+			if err != nil {
+				t.Fatalf("Failed to list nodes: %v", err)
+			}
+
+			var got []string
+			for _, node := range found {
+				got = append(got, node.Hostname[len(prefix):])
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("Got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAddAndRemoveTags(t *testing.T) {
+	if got := addTags([]string{"a", "b"}, []string{"b", "c"}); fmt.Sprint(got) != "[a b c]" {
+		t.Errorf("addTags = %v, want [a b c]", got)
+	}
+	if got := removeTags([]string{"a", "b", "c"}, []string{"b", "x"}); fmt.Sprint(got) != "[a c]" {
+		t.Errorf("removeTags = %v, want [a c]", got)
+	}
+}
+
+func TestManualNodeTagsSurviveSync(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	hostname := "test-" + uuid.New().String()[:8]
+	sync := func(tags ...string) {
+		t.Helper()
+		if err := db.UpsertNode(&Node{Hostname: hostname, Tags: tags, Online: true}); err != nil {
+			t.Fatalf("Failed to sync node: %v", err)
+		}
+	}
+	tags := func() string {
+		t.Helper()
+		node, err := db.GetNode(hostname)
+		if err != nil {
+			t.Fatalf("Failed to get node: %v", err)
+		}
+		return fmt.Sprintf("%v manual=%v", node.Tags, node.ManualTags)
+	}
+	defer db.db.Delete(&Node{}, "hostname = ?", hostname)
+
+	sync("synced")
+
+	if _, err := db.SetNodeTags(hostname, []string{"gpu", "edge"}); err != nil {
+		t.Fatalf("Failed to set tags: %v", err)
+	}
+	if got := tags(); got != "[gpu edge] manual=[gpu edge]" {
+		t.Errorf("After set: %s", got)
+	}
+
+	if _, err := db.UpdateNodeTags(hostname, []string{"canary"}, []string{"edge"}); err != nil {
+		t.Fatalf("Failed to update tags: %v", err)
+	}
+	if got := tags(); got != "[gpu canary] manual=[gpu canary]" {
+		t.Errorf("After add and remove: %s", got)
+	}
+
+	sync("synced")
+	if got := tags(); got != "[synced gpu canary] manual=[gpu canary]" {
+		t.Errorf("After sync: %s", got)
+	}
+
+	if _, err := db.UpdateNodeTags("test-missing-node", []string{"x"}, nil); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound for an unknown node, got %v", err)
+	}
+}
@@ -0,0 +1,23 @@
+// Package dbtest points tests at the Postgres database named by
+// COSMOS_TEST_DB_URL.
+package dbtest
+
+import (
+	"os"
+	"testing"
+)
+
+// URL returns the test database URL. Without one the test is skipped
+// locally, but fails under CI, where the database tests must run.
+func URL(t testing.TB) string {
+	t.Helper()
+
+	dsn := os.Getenv("COSMOS_TEST_DB_URL")
+	if dsn == "" {
+		if os.Getenv("CI") != "" {
+			t.Fatal("COSMOS_TEST_DB_URL must be set to run the database tests in CI")
+		}
+		t.Skip("COSMOS_TEST_DB_URL not set, skipping database test")
+	}
+	return dsn
+}
@@ -0,0 +1,314 @@
+package database
+
+import (
+	"fmt"
+	"slices"
+
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// migration is one versioned change to the schema. Released migrations are
+// never edited: a schema change gets a new migration with the next version.
+type migration struct {
+	version int
+	name    string
+	up      func(tx *gorm.DB) error
+}
+
+// migrations are applied in order of version. Each version is applied once
+// and recorded in schema_migrations.
+var migrations = []migration{
+	{1, "initial_schema", execSQL(initialSchema...)},
+	{2, "auto_migrated_schema", execSQL(autoMigratedSchema...)},
+	{3, "component_deployments_unique", execSQL(
+		// Keep the newest row of any duplicates left by racing upserts
+		`DELETE FROM "component_deployments" a USING "component_deployments" b
+			WHERE a.component_name = b.component_name AND a.node_hostname = b.node_hostname
+			AND (COALESCE(a.last_updated, a.created_at), a.id) < (COALESCE(b.last_updated, b.created_at), b.id)`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS "idx_component_deployments_component_node" ON "component_deployments" ("component_name","node_hostname")`,
+	)},
+	{4, "component_histories", execSQL(
+		`CREATE TABLE IF NOT EXISTS "component_histories" (
+			"id" uuid DEFAULT gen_random_uuid(),
+			"component_name" varchar(255) NOT NULL,
+			"old_hash" varchar(64),
+			"new_hash" varchar(64) NOT NULL,
+			"deployment_id" uuid,
+			"created_at" timestamptz NOT NULL DEFAULT now(),
+			PRIMARY KEY ("id")
+		)`,
+		`CREATE INDEX IF NOT EXISTS "idx_component_histories_component_name" ON "component_histories" ("component_name")`,
+	)},
+	{5, "deployment_plans", execSQL(
+		`ALTER TABLE "deployments" ADD COLUMN IF NOT EXISTS "plan" jsonb`,
+	)},
+	{6, "component_nomad_scope", execSQL(
+		`ALTER TABLE "components" ADD COLUMN IF NOT EXISTS "nomad_namespace" varchar(255)`,
+		`ALTER TABLE "components" ADD COLUMN IF NOT EXISTS "nomad_region" varchar(255)`,
+	)},
+	{7, "component_job_format_and_rollout", execSQL(
+		`ALTER TABLE "components" ADD COLUMN IF NOT EXISTS "nomad_job_format" varchar(10)`,
+		`ALTER TABLE "components" ADD COLUMN IF NOT EXISTS "rollout" jsonb`,
+	)},
+	{8, "component_kubernetes", execSQL(
+		`ALTER TABLE "components" ADD COLUMN IF NOT EXISTS "k8s_manifest" text`,
+		`ALTER TABLE "components" ADD COLUMN IF NOT EXISTS "k8s_namespace" varchar(255)`,
+	)},
+	{9, "component_resource_limits", execSQL(
+		`ALTER TABLE "components" ADD COLUMN IF NOT EXISTS "memory_limit" bigint`,
+		`ALTER TABLE "components" ADD COLUMN IF NOT EXISTS "cpu_limit" double precision`,
+		`ALTER TABLE "components" ADD COLUMN IF NOT EXISTS "max_open_files" bigint`,
+	)},
+	{10, "component_run_as", execSQL(
+		`ALTER TABLE "components" ADD COLUMN IF NOT EXISTS "run_as_user" varchar(255)`,
+		`ALTER TABLE "components" ADD COLUMN IF NOT EXISTS "run_as_group" varchar(255)`,
+	)},
+	{11, "component_working_dir", execSQL(
+		`ALTER TABLE "components" ADD COLUMN IF NOT EXISTS "working_dir" text`,
+	)},
+	{12, "component_deployment_progress", execSQL(
+		`ALTER TABLE "component_deployments" ADD COLUMN IF NOT EXISTS "phase" varchar(20)`,
+		`ALTER TABLE "component_deployments" ADD COLUMN IF NOT EXISTS "progress_percent" integer`,
+	)},
+	{13, "component_depends_on", execSQL(
+		`ALTER TABLE "components" ADD COLUMN IF NOT EXISTS "depends_on" text[]`,
+	)},
+	{14, "component_replicas", execSQL(
+		`ALTER TABLE "components" ADD COLUMN IF NOT EXISTS "replicas" bigint DEFAULT 0`,
+	)},
+}
+
+// initialSchema is the schema AutoMigrate created before versioned
+// migrations, as of the first release. Everything is created only if
+// missing, so databases that were set up by AutoMigrate adopt it without
+// changes; columns and tables added since are later migrations.
+var initialSchema = []string{
+	`CREATE TABLE IF NOT EXISTS "deployments" (
+		"id" uuid DEFAULT gen_random_uuid(),
+		"configuration" jsonb NOT NULL,
+		"status" varchar(20) NOT NULL,
+		"created_at" timestamptz NOT NULL DEFAULT now(),
+		"started_at" timestamptz,
+		"completed_at" timestamptz,
+		"created_by" varchar(255),
+		"error_message" text,
+		PRIMARY KEY ("id")
+	)`,
+
+	`CREATE TABLE IF NOT EXISTS "components" (
+		"id" uuid DEFAULT gen_random_uuid(),
+		"name" varchar(255) NOT NULL,
+		"type" varchar(20) NOT NULL,
+		"handler" varchar(20) NOT NULL,
+		"hash" varchar(64) NOT NULL,
+		"tags" text[] NOT NULL,
+		"content" text,
+		"content_url" text,
+		"content_url_encoding" varchar(20),
+		"nomad_job" text,
+		"health_check" jsonb,
+		"env" jsonb,
+		"args" text[],
+		"managed" boolean DEFAULT false,
+		"external_id" varchar(255),
+		"deployment_id" uuid,
+		"created_at" timestamptz NOT NULL DEFAULT now(),
+		"updated_at" timestamptz NOT NULL DEFAULT now(),
+		PRIMARY KEY ("id")
+	)`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS "idx_components_name" ON "components" ("name")`,
+	`CREATE INDEX IF NOT EXISTS "idx_components_hash" ON "components" ("hash")`,
+
+	`CREATE TABLE IF NOT EXISTS "component_deployments" (
+		"id" uuid DEFAULT gen_random_uuid(),
+		"component_name" varchar(255) NOT NULL,
+		"node_hostname" varchar(255) NOT NULL,
+		"deployment_id" uuid,
+		"status" varchar(20) NOT NULL,
+		"message" text,
+		"p_id" bigint,
+		"last_started_at" timestamptz,
+		"last_health_check" timestamptz,
+		"health_status" varchar(20),
+		"deployed_at" timestamptz,
+		"last_updated" timestamptz,
+		"created_at" timestamptz NOT NULL DEFAULT now(),
+		PRIMARY KEY ("id")
+	)`,
+	`CREATE INDEX IF NOT EXISTS "idx_component_deployments_status" ON "component_deployments" ("status")`,
+	`CREATE INDEX IF NOT EXISTS "idx_component_deployments_node_hostname" ON "component_deployments" ("node_hostname")`,
+	`CREATE INDEX IF NOT EXISTS "idx_component_deployments_component_name" ON "component_deployments" ("component_name")`,
+
+	`CREATE TABLE IF NOT EXISTS "agents" (
+		"id" uuid DEFAULT gen_random_uuid(),
+		"hostname" varchar(255) NOT NULL,
+		"agent_version" varchar(50),
+		"last_heartbeat" timestamptz NOT NULL,
+		"online" boolean NOT NULL DEFAULT true,
+		"component_count" bigint DEFAULT 0,
+		"metadata" jsonb,
+		"created_at" timestamptz NOT NULL DEFAULT now(),
+		"updated_at" timestamptz NOT NULL DEFAULT now(),
+		PRIMARY KEY ("id")
+	)`,
+	`CREATE INDEX IF NOT EXISTS "idx_agents_online" ON "agents" ("online")`,
+	`CREATE INDEX IF NOT EXISTS "idx_agents_last_heartbeat" ON "agents" ("last_heartbeat")`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS "idx_agents_hostname" ON "agents" ("hostname")`,
+
+	`CREATE TABLE IF NOT EXISTS "deployment_logs" (
+		"id" uuid DEFAULT gen_random_uuid(),
+		"deployment_id" uuid NOT NULL,
+		"component_name" varchar(255),
+		"node_hostname" varchar(255),
+		"operation" varchar(20) NOT NULL,
+		"status" varchar(20) NOT NULL,
+		"message" text,
+		"details" jsonb,
+		"created_at" timestamptz NOT NULL DEFAULT now(),
+		PRIMARY KEY ("id")
+	)`,
+	`CREATE INDEX IF NOT EXISTS "idx_deployment_logs_created_at" ON "deployment_logs" ("created_at")`,
+	`CREATE INDEX IF NOT EXISTS "idx_deployment_logs_component_name" ON "deployment_logs" ("component_name")`,
+	`CREATE INDEX IF NOT EXISTS "idx_deployment_logs_deployment_id" ON "deployment_logs" ("deployment_id")`,
+
+	`CREATE TABLE IF NOT EXISTS "nodes" (
+		"id" uuid DEFAULT gen_random_uuid(),
+		"hostname" varchar(255) NOT NULL,
+		"ip" varchar(45),
+		"tags" text[] NOT NULL DEFAULT '{}',
+		"online" boolean NOT NULL DEFAULT false,
+		"has_agent" boolean NOT NULL DEFAULT false,
+		"last_seen" timestamptz,
+		"metadata" jsonb,
+		"synced_at" timestamptz NOT NULL DEFAULT now(),
+		PRIMARY KEY ("id")
+	)`,
+	`CREATE INDEX IF NOT EXISTS "idx_nodes_has_agent" ON "nodes" ("has_agent")`,
+	`CREATE INDEX IF NOT EXISTS "idx_nodes_online" ON "nodes" ("online")`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS "idx_nodes_hostname" ON "nodes" ("hostname")`,
+
+	`CREATE TABLE IF NOT EXISTS "component_logs" (
+		"id" uuid DEFAULT gen_random_uuid(),
+		"component_name" varchar(255) NOT NULL,
+		"node_hostname" varchar(255) NOT NULL,
+		"log_data" text NOT NULL,
+		"timestamp" timestamptz NOT NULL,
+		"offset" bigint NOT NULL,
+		"created_at" timestamptz NOT NULL DEFAULT now(),
+		PRIMARY KEY ("id")
+	)`,
+	`CREATE INDEX IF NOT EXISTS "idx_component_logs_timestamp" ON "component_logs" ("timestamp")`,
+	`CREATE INDEX IF NOT EXISTS "idx_component_node" ON "component_logs" ("component_name","node_hostname")`,
+}
+
+// autoMigratedSchema is what AutoMigrate added to the initial schema after
+// the first release, before versioned migrations. A database may have been
+// migrated by any of those releases, so every change applies only if it is
+// missing.
+var autoMigratedSchema = []string{
+	`ALTER TABLE "deployments" ADD COLUMN IF NOT EXISTS "approved_by" varchar(255)`,
+	`ALTER TABLE "deployments" ADD COLUMN IF NOT EXISTS "approved_at" timestamptz`,
+	`ALTER TABLE "deployments" ADD COLUMN IF NOT EXISTS "canary_decision" varchar(20)`,
+	`ALTER TABLE "deployments" ADD COLUMN IF NOT EXISTS "canary_decided_by" varchar(255)`,
+	`ALTER TABLE "deployments" ADD COLUMN IF NOT EXISTS "request_id" varchar(128)`,
+	`CREATE INDEX IF NOT EXISTS "idx_deployments_request_id" ON "deployments" ("request_id")`,
+
+	`ALTER TABLE "components" ADD COLUMN IF NOT EXISTS "content_mirrors" jsonb`,
+	`ALTER TABLE "components" ADD COLUMN IF NOT EXISTS "content_url_headers" jsonb`,
+	`ALTER TABLE "components" ADD COLUMN IF NOT EXISTS "entrypoint" text`,
+	`ALTER TABLE "components" ADD COLUMN IF NOT EXISTS "signature_url" text`,
+	`ALTER TABLE "components" ADD COLUMN IF NOT EXISTS "public_key" text`,
+	`ALTER TABLE "components" ADD COLUMN IF NOT EXISTS "nomad_job_compressed" bytea`,
+	`ALTER TABLE "components" ADD COLUMN IF NOT EXISTS "affinity" text[]`,
+	`ALTER TABLE "components" ADD COLUMN IF NOT EXISTS "anti_affinity" text[]`,
+	`ALTER TABLE "components" ADD COLUMN IF NOT EXISTS "wait_for" jsonb`,
+	`ALTER TABLE "components" ADD COLUMN IF NOT EXISTS "canary" jsonb`,
+	`ALTER TABLE "components" ADD COLUMN IF NOT EXISTS "previous_spec" jsonb`,
+
+	`ALTER TABLE "component_deployments" ADD COLUMN IF NOT EXISTS "restart_count" bigint DEFAULT 0`,
+	`ALTER TABLE "component_deployments" ADD COLUMN IF NOT EXISTS "restart_history" jsonb`,
+
+	`ALTER TABLE "agents" ADD COLUMN IF NOT EXISTS "load_average" decimal`,
+	`ALTER TABLE "agents" ADD COLUMN IF NOT EXISTS "cpu_count" bigint`,
+	`ALTER TABLE "agents" ADD COLUMN IF NOT EXISTS "memory_used_bytes" bigint`,
+	`ALTER TABLE "agents" ADD COLUMN IF NOT EXISTS "memory_total_bytes" bigint`,
+	`ALTER TABLE "agents" ADD COLUMN IF NOT EXISTS "disk_free_bytes" bigint`,
+	`ALTER TABLE "agents" ADD COLUMN IF NOT EXISTS "disk_total_bytes" bigint`,
+
+	`ALTER TABLE "nodes" ADD COLUMN IF NOT EXISTS "manual_tags" text[] NOT NULL DEFAULT '{}'`,
+	`ALTER TABLE "nodes" ADD COLUMN IF NOT EXISTS "draining" boolean NOT NULL DEFAULT false`,
+
+	`CREATE TABLE IF NOT EXISTS "controller_leases" (
+		"name" varchar(255),
+		"holder" varchar(255) NOT NULL,
+		"expires_at" timestamptz NOT NULL,
+		PRIMARY KEY ("name")
+	)`,
+
+	`CREATE TABLE IF NOT EXISTS "api_keys" (
+		"id" uuid DEFAULT gen_random_uuid(),
+		"name" varchar(255) NOT NULL,
+		"key_hash" varchar(64) NOT NULL,
+		"scope" varchar(20) NOT NULL DEFAULT 'admin',
+		"created_at" timestamptz NOT NULL DEFAULT now(),
+		PRIMARY KEY ("id")
+	)`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS "idx_api_keys_key_hash" ON "api_keys" ("key_hash")`,
+}
+
+// execSQL returns a migration step that runs the statements in order
+func execSQL(statements ...string) func(tx *gorm.DB) error {
+	return func(tx *gorm.DB) error {
+		for _, statement := range statements {
+			if err := tx.Exec(statement).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// migrate applies the migrations the database doesn't have yet, all in one
+// transaction
+func migrate(db *gorm.DB) error {
+	if err := db.Exec(`CREATE TABLE IF NOT EXISTS "schema_migrations" (
+		"version" integer PRIMARY KEY,
+		"name" varchar(255) NOT NULL,
+		"applied_at" timestamptz NOT NULL DEFAULT now()
+	)`).Error; err != nil {
+		return fmt.Errorf("failed to create schema_migrations: %w", err)
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		// Serialize controllers starting at the same time
+		if err := tx.Exec("LOCK TABLE schema_migrations IN SHARE ROW EXCLUSIVE MODE").Error; err != nil {
+			return fmt.Errorf("failed to lock schema_migrations: %w", err)
+		}
+
+		var applied []int
+		if err := tx.Table("schema_migrations").Pluck("version", &applied).Error; err != nil {
+			return fmt.Errorf("failed to read applied migrations: %w", err)
+		}
+
+		for _, m := range migrations {
+			if slices.Contains(applied, m.version) {
+				continue
+			}
+
+			if err := m.up(tx); err != nil {
+				return fmt.Errorf("migration %d (%s) failed: %w", m.version, m.name, err)
+			}
+			if err := tx.Exec("INSERT INTO schema_migrations (version, name) VALUES (?, ?)", m.version, m.name).Error; err != nil {
+				return fmt.Errorf("failed to record migration %d: %w", m.version, err)
+			}
+
+			log.WithFields(log.Fields{
+				"version": m.version,
+				"name":    m.name,
+			}).Info("Applied database migration")
+		}
+
+		return nil
+	})
+}
@@ -0,0 +1,317 @@
+package database
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+	"github.com/metorial/fleet/cosmos/internal/controller/database/dbtest"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// openEmptySchema connects to the test database with a fresh, empty schema
+// as the search path, dropped again when the test ends
+func openEmptySchema(t *testing.T) (*gorm.DB, string) {
+	t.Helper()
+
+	dsn := dbtest.URL(t)
+
+	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{Logger: logger.Default.LogMode(logger.Warn)})
+	if err != nil {
+		t.Fatalf("Failed to connect to database: %v", err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatalf("Failed to get connection pool: %v", err)
+	}
+	// search_path is per connection
+	sqlDB.SetMaxOpenConns(1)
+
+	schema := "test_" + strings.ReplaceAll(uuid.New().String(), "-", "")
+	if err := db.Exec(fmt.Sprintf("CREATE SCHEMA %s", schema)).Error; err != nil {
+		t.Fatalf("Failed to create schema: %v", err)
+	}
+	if err := db.Exec(fmt.Sprintf("SET search_path TO %s", schema)).Error; err != nil {
+		t.Fatalf("Failed to set search path: %v", err)
+	}
+
+	t.Cleanup(func() {
+		db.Exec(fmt.Sprintf("DROP SCHEMA %s CASCADE", schema))
+		sqlDB.Close()
+	})
+	return db, schema
+}
+
+type schemaColumn struct {
+	TableName              string
+	ColumnName             string
+	DataType               string
+	IsNullable             string
+	ColumnDefault          *string
+	CharacterMaximumLength *int
+}
+
+type schemaIndex struct {
+	Tablename string
+	Indexname string
+	Indexdef  string
+}
+
+// describeSchema lists the columns and indexes of every table in schema
+// except schema_migrations
+func describeSchema(t *testing.T, db *gorm.DB, schema string) ([]schemaColumn, []schemaIndex) {
+	t.Helper()
+
+	var columns []schemaColumn
+	if err := db.Raw(`SELECT table_name, column_name, data_type, is_nullable, column_default, character_maximum_length
+		FROM information_schema.columns
+		WHERE table_schema = ? AND table_name <> 'schema_migrations'
+		ORDER BY table_name, column_name`, schema).Scan(&columns).Error; err != nil {
+		t.Fatalf("Failed to read columns: %v", err)
+	}
+
+	var indexes []schemaIndex
+	if err := db.Raw(`SELECT tablename, indexname, indexdef
+		FROM pg_indexes
+		WHERE schemaname = ? AND tablename <> 'schema_migrations'
+		ORDER BY tablename, indexname`, schema).Scan(&indexes).Error; err != nil {
+		t.Fatalf("Failed to read indexes: %v", err)
+	}
+	for i := range indexes {
+		indexes[i].Indexdef = strings.ReplaceAll(indexes[i].Indexdef, schema+".", "")
+	}
+
+	return columns, indexes
+}
+
+func TestMigrationsMatchModels(t *testing.T) {
+	migrated, migratedSchema := openEmptySchema(t)
+	if err := migrate(migrated); err != nil {
+		t.Fatalf("Failed to apply migrations: %v", err)
+	}
+
+	automigrated, automigratedSchema := openEmptySchema(t)
+	if err := (&ControllerDB{db: automigrated}).AutoMigrate(); err != nil {
+		t.Fatalf("Failed to auto-migrate: %v", err)
+	}
+
+	gotColumns, gotIndexes := describeSchema(t, migrated, migratedSchema)
+	wantColumns, wantIndexes := describeSchema(t, automigrated, automigratedSchema)
+
+	if len(gotColumns) == 0 {
+		t.Fatal("Expected migrations to create tables")
+	}
+	if !reflect.DeepEqual(gotColumns, wantColumns) {
+		t.Errorf("Migrated columns differ from the models:\ngot  %+v\nwant %+v", gotColumns, wantColumns)
+	}
+	if !reflect.DeepEqual(gotIndexes, wantIndexes) {
+		t.Errorf("Migrated indexes differ from the models:\ngot  %+v\nwant %+v", gotIndexes, wantIndexes)
+	}
+}
+
+func TestMigrateIsIdempotent(t *testing.T) {
+	db, schema := openEmptySchema(t)
+
+	for i := 0; i < 2; i++ {
+		if err := migrate(db); err != nil {
+			t.Fatalf("Run %d: failed to apply migrations: %v", i+1, err)
+		}
+	}
+
+	var versions []int
+	if err := db.Table("schema_migrations").Order("version").Pluck("version", &versions).Error; err != nil {
+		t.Fatalf("Failed to read applied migrations: %v", err)
+	}
+	if len(versions) != len(migrations) {
+		t.Errorf("Expected %d applied migrations, got %v", len(migrations), versions)
+	}
+
+	// A database created by AutoMigrate before versioned migrations adopts
+	// the initial schema without errors
+	db.Exec("DROP TABLE schema_migrations")
+	if err := migrate(db); err != nil {
+		t.Errorf("Expected migrations to adopt an existing schema, got %v", err)
+	}
+
+	columns, _ := describeSchema(t, db, schema)
+	if len(columns) == 0 {
+		t.Error("Expected the schema to be kept")
+	}
+}
+
+// The models as of the first release, whose schema production databases
+// were created with by AutoMigrate
+
+type baselineDeployment struct {
+	ID            uuid.UUID       `gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
+	Configuration json.RawMessage `gorm:"type:jsonb;not null"`
+	Status        string          `gorm:"type:varchar(20);not null"`
+	CreatedAt     time.Time       `gorm:"not null;default:now()"`
+	StartedAt     *time.Time
+	CompletedAt   *time.Time
+	CreatedBy     string `gorm:"type:varchar(255)"`
+	ErrorMessage  string `gorm:"type:text"`
+}
+
+func (baselineDeployment) TableName() string { return "deployments" }
+
+type baselineComponent struct {
+	ID                 uuid.UUID       `gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
+	Name               string          `gorm:"type:varchar(255);not null;uniqueIndex"`
+	Type               string          `gorm:"type:varchar(20);not null"`
+	Handler            string          `gorm:"type:varchar(20);not null"`
+	Hash               string          `gorm:"type:varchar(64);not null;index"`
+	Tags               pq.StringArray  `gorm:"type:text[];not null"`
+	Content            string          `gorm:"type:text"`
+	ContentURL         string          `gorm:"type:text"`
+	ContentURLEncoding string          `gorm:"type:varchar(20)"`
+	NomadJob           string          `gorm:"type:text"`
+	HealthCheck        json.RawMessage `gorm:"type:jsonb"`
+	Env                json.RawMessage `gorm:"type:jsonb"`
+	Args               pq.StringArray  `gorm:"type:text[]"`
+	Managed            bool            `gorm:"default:false"`
+	ExternalID         string          `gorm:"type:varchar(255)"`
+	DeploymentID       *uuid.UUID      `gorm:"type:uuid"`
+	CreatedAt          time.Time       `gorm:"not null;default:now()"`
+	UpdatedAt          time.Time       `gorm:"not null;default:now()"`
+}
+
+func (baselineComponent) TableName() string { return "components" }
+
+type baselineComponentDeployment struct {
+	ID              uuid.UUID  `gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
+	ComponentName   string     `gorm:"type:varchar(255);not null;index"`
+	NodeHostname    string     `gorm:"type:varchar(255);not null;index"`
+	DeploymentID    *uuid.UUID `gorm:"type:uuid"`
+	Status          string     `gorm:"type:varchar(20);not null;index"`
+	Message         string     `gorm:"type:text"`
+	PID             *int
+	LastStartedAt   *time.Time
+	LastHealthCheck *time.Time
+	HealthStatus    string `gorm:"type:varchar(20)"`
+	DeployedAt      *time.Time
+	LastUpdated     *time.Time
+	CreatedAt       time.Time `gorm:"not null;default:now()"`
+}
+
+func (baselineComponentDeployment) TableName() string { return "component_deployments" }
+
+type baselineAgent struct {
+	ID             uuid.UUID       `gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
+	Hostname       string          `gorm:"type:varchar(255);not null;uniqueIndex"`
+	AgentVersion   string          `gorm:"type:varchar(50)"`
+	LastHeartbeat  time.Time       `gorm:"not null;index"`
+	Online         bool            `gorm:"not null;default:true;index"`
+	ComponentCount int             `gorm:"default:0"`
+	Metadata       json.RawMessage `gorm:"type:jsonb"`
+	CreatedAt      time.Time       `gorm:"not null;default:now()"`
+	UpdatedAt      time.Time       `gorm:"not null;default:now()"`
+}
+
+func (baselineAgent) TableName() string { return "agents" }
+
+type baselineDeploymentLog struct {
+	ID            uuid.UUID       `gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
+	DeploymentID  uuid.UUID       `gorm:"type:uuid;not null;index"`
+	ComponentName string          `gorm:"type:varchar(255);index"`
+	NodeHostname  string          `gorm:"type:varchar(255)"`
+	Operation     string          `gorm:"type:varchar(20);not null"`
+	Status        string          `gorm:"type:varchar(20);not null"`
+	Message       string          `gorm:"type:text"`
+	Details       json.RawMessage `gorm:"type:jsonb"`
+	CreatedAt     time.Time       `gorm:"not null;default:now();index"`
+}
+
+func (baselineDeploymentLog) TableName() string { return "deployment_logs" }
+
+type baselineNode struct {
+	ID       uuid.UUID      `gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
+	Hostname string         `gorm:"type:varchar(255);not null;uniqueIndex"`
+	IP       string         `gorm:"type:varchar(45)"`
+	Tags     pq.StringArray `gorm:"type:text[];not null;default:'{}'"`
+	Online   bool           `gorm:"not null;default:false;index"`
+	HasAgent bool           `gorm:"not null;default:false;index"`
+	LastSeen *time.Time
+	Metadata json.RawMessage `gorm:"type:jsonb"`
+	SyncedAt time.Time       `gorm:"not null;default:now()"`
+}
+
+func (baselineNode) TableName() string { return "nodes" }
+
+type baselineComponentLog struct {
+	ID            uuid.UUID `gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
+	ComponentName string    `gorm:"type:varchar(255);not null;index:idx_component_node"`
+	NodeHostname  string    `gorm:"type:varchar(255);not null;index:idx_component_node"`
+	LogData       string    `gorm:"type:text;not null"`
+	Timestamp     time.Time `gorm:"not null;index"`
+	Offset        int64     `gorm:"not null"`
+	CreatedAt     time.Time `gorm:"not null;default:now()"`
+}
+
+func (baselineComponentLog) TableName() string { return "component_logs" }
+
+func TestInitialMigrationMatchesBaseline(t *testing.T) {
+	migrated, migratedSchema := openEmptySchema(t)
+	if err := execSQL(initialSchema...)(migrated); err != nil {
+		t.Fatalf("Failed to apply the initial schema: %v", err)
+	}
+
+	baseline, baselineSchema := openEmptySchema(t)
+	if err := baseline.AutoMigrate(&baselineDeployment{}, &baselineComponent{}, &baselineComponentDeployment{},
+		&baselineAgent{}, &baselineDeploymentLog{}, &baselineNode{}, &baselineComponentLog{}); err != nil {
+		t.Fatalf("Failed to auto-migrate the baseline models: %v", err)
+	}
+
+	gotColumns, gotIndexes := describeSchema(t, migrated, migratedSchema)
+	wantColumns, wantIndexes := describeSchema(t, baseline, baselineSchema)
+	if !reflect.DeepEqual(gotColumns, wantColumns) {
+		t.Errorf("Initial schema columns differ from the baseline:\ngot  %+v\nwant %+v", gotColumns, wantColumns)
+	}
+	if !reflect.DeepEqual(gotIndexes, wantIndexes) {
+		t.Errorf("Initial schema indexes differ from the baseline:\ngot  %+v\nwant %+v", gotIndexes, wantIndexes)
+	}
+}
+
+func TestMigrateUpgradesBaselineDatabase(t *testing.T) {
+	db, schema := openEmptySchema(t)
+	if err := db.AutoMigrate(&baselineDeployment{}, &baselineComponent{}, &baselineComponentDeployment{},
+		&baselineAgent{}, &baselineDeploymentLog{}, &baselineNode{}, &baselineComponentLog{}); err != nil {
+		t.Fatalf("Failed to auto-migrate the baseline models: %v", err)
+	}
+	if err := db.Create(&baselineNode{Hostname: "node-1", Tags: pq.StringArray{"web"}}).Error; err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+
+	if err := migrate(db); err != nil {
+		t.Fatalf("Failed to upgrade the baseline database: %v", err)
+	}
+
+	automigrated, automigratedSchema := openEmptySchema(t)
+	if err := (&ControllerDB{db: automigrated}).AutoMigrate(); err != nil {
+		t.Fatalf("Failed to auto-migrate: %v", err)
+	}
+
+	gotColumns, gotIndexes := describeSchema(t, db, schema)
+	wantColumns, wantIndexes := describeSchema(t, automigrated, automigratedSchema)
+	if !reflect.DeepEqual(gotColumns, wantColumns) {
+		t.Errorf("Upgraded columns differ from the models:\ngot  %+v\nwant %+v", gotColumns, wantColumns)
+	}
+	if !reflect.DeepEqual(gotIndexes, wantIndexes) {
+		t.Errorf("Upgraded indexes differ from the models:\ngot  %+v\nwant %+v", gotIndexes, wantIndexes)
+	}
+
+	var node Node
+	if err := db.First(&node, "hostname = ?", "node-1").Error; err != nil {
+		t.Fatalf("Failed to read the existing node through the current model: %v", err)
+	}
+	if node.Draining || len(node.ManualTags) != 0 {
+		t.Errorf("Expected the existing node to get the column defaults, got %+v", node)
+	}
+}
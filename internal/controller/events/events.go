@@ -0,0 +1,88 @@
+package events
+
+import (
+	"sync"
+
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// subscriberBuffer is how many events a slow subscriber may fall behind
+// before further events are dropped for it
+const subscriberBuffer = 64
+
+// Event types
+const (
+	TypeLog    = "log"
+	TypeStatus = "status"
+)
+
+// Event is a change to a deployment: a DeploymentLog row for TypeLog or a
+// ComponentDeployment record for TypeStatus
+type Event struct {
+	DeploymentID uuid.UUID
+	Type         string
+	Data         any
+}
+
+// Bus fans deployment events out to the subscribers of each deployment. It
+// only carries events written by this controller. A nil Bus drops
+// everything, so publishers don't need to check whether one is configured.
+type Bus struct {
+	mu   sync.Mutex
+	subs map[uuid.UUID]map[chan Event]struct{}
+}
+
+func NewBus() *Bus {
+	return &Bus{subs: make(map[uuid.UUID]map[chan Event]struct{})}
+}
+
+// Subscribe returns the events of a deployment. The returned function
+// unsubscribes and must be called once the caller stops reading.
+func (b *Bus) Subscribe(deploymentID uuid.UUID) (<-chan Event, func()) {
+	if b == nil {
+		return nil, func() {}
+	}
+
+	ch := make(chan Event, subscriberBuffer)
+
+	b.mu.Lock()
+	if b.subs[deploymentID] == nil {
+		b.subs[deploymentID] = make(map[chan Event]struct{})
+	}
+	b.subs[deploymentID][ch] = struct{}{}
+	b.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			delete(b.subs[deploymentID], ch)
+			if len(b.subs[deploymentID]) == 0 {
+				delete(b.subs, deploymentID)
+			}
+		})
+	}
+}
+
+// Publish sends an event to the deployment's subscribers without blocking
+func (b *Bus) Publish(event Event) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for ch := range b.subs[event.DeploymentID] {
+		select {
+		case ch <- event:
+		default:
+			log.WithFields(log.Fields{
+				"deployment_id": event.DeploymentID,
+				"type":          event.Type,
+			}).Debug("Dropping event for slow subscriber")
+		}
+	}
+}
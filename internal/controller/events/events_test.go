@@ -0,0 +1,59 @@
+package events
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestSubscriberReceivesOwnDeployment(t *testing.T) {
+	bus := NewBus()
+	id := uuid.New()
+
+	ch, unsubscribe := bus.Subscribe(id)
+	defer unsubscribe()
+
+	bus.Publish(Event{DeploymentID: uuid.New(), Type: TypeLog, Data: "other"})
+	bus.Publish(Event{DeploymentID: id, Type: TypeStatus, Data: "mine"})
+
+	select {
+	case event := <-ch:
+		if event.Data != "mine" {
+			t.Errorf("Expected only this deployment's event, got %v", event.Data)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for event")
+	}
+
+	unsubscribe()
+	bus.Publish(Event{DeploymentID: id, Type: TypeLog})
+	if len(bus.subs) != 0 {
+		t.Errorf("Expected no subscriptions left, got %d", len(bus.subs))
+	}
+}
+
+func TestPublishDoesNotBlockOnSlowSubscriber(t *testing.T) {
+	bus := NewBus()
+	id := uuid.New()
+
+	_, unsubscribe := bus.Subscribe(id)
+	defer unsubscribe()
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < subscriberBuffer*2; i++ {
+			bus.Publish(Event{DeploymentID: id, Type: TypeLog})
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Publish blocked on a subscriber that isn't reading")
+	}
+
+	var nilBus *Bus
+	nilBus.Publish(Event{DeploymentID: id})
+}
@@ -1,58 +1,161 @@
 package grpc
 
 import (
+	"context"
 	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"sync"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/metorial/fleet/cosmos/internal/controller/database"
+	"github.com/metorial/fleet/cosmos/internal/controller/events"
 	pb "github.com/metorial/fleet/cosmos/internal/proto"
 	log "github.com/sirupsen/logrus"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/keepalive"
 	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
 )
 
+// ErrAgentNotConnected is returned when sending to an agent without a stream
+var ErrAgentNotConnected = errors.New("agent not connected")
+
+const defaultAgentTimeout = 90 * time.Second
+
 type Server struct {
 	pb.UnimplementedCosmosControllerServer
 
 	db         *database.ControllerDB
+	events     *events.Bus
 	port       int
 	tlsConfig  *tls.Config
 	grpcServer *grpc.Server
 
+	// Streams that haven't received a message within agentTimeout are
+	// closed by the reaper
+	agentTimeout time.Duration
+	ctx          context.Context
+	cancel       context.CancelFunc
+
 	streamsMu sync.RWMutex
-	streams   map[string]pb.CosmosController_StreamAgentMessagesServer
+	streams   map[string]*agentStream
+
+	// onConnect is called with the hostname of each newly registered stream
+	onConnect func(hostname string)
+
+	// isLeader reports whether this controller may hold agent streams. Only
+	// the leader deploys, so followers refuse streams and agents reconnect
+	// until they reach it. Nil accepts every stream.
+	isLeader func() bool
+
+	// pending holds the callers waiting for an agent's answer, by request ID
+	pendingMu sync.Mutex
+	pending   map[string]chan *pb.AgentMessage
+}
+
+// agentStream is an agent's connection. closed is closed, with closeErr
+// saying why, when the controller ends the stream: a newer stream registered
+// for the same hostname or the agent went silent.
+type agentStream struct {
+	stream   pb.CosmosController_StreamAgentMessagesServer
+	closed   chan struct{}
+	closeErr error
+	lastSeen time.Time
+
+	// sendMu serializes sends, which gRPC doesn't allow concurrently on one
+	// stream
+	sendMu sync.Mutex
+}
+
+func newAgentStream(stream pb.CosmosController_StreamAgentMessagesServer) *agentStream {
+	return &agentStream{stream: stream, closed: make(chan struct{}), lastSeen: time.Now()}
+}
+
+// send sends a message to the agent. Every message to an agent goes through
+// it.
+func (a *agentStream) send(msg *pb.ControllerMessage) error {
+	a.sendMu.Lock()
+	defer a.sendMu.Unlock()
+	return a.stream.Send(msg)
 }
 
 type ServerConfig struct {
-	DB        *database.ControllerDB
-	Port      int
-	TLSConfig *tls.Config
+	DB           *database.ControllerDB
+	Events       *events.Bus
+	Port         int
+	TLSConfig    *tls.Config
+	AgentTimeout time.Duration
 }
 
 func NewServer(config *ServerConfig) *Server {
+	agentTimeout := config.AgentTimeout
+	if agentTimeout <= 0 {
+		agentTimeout = defaultAgentTimeout
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
 	return &Server{
-		db:        config.DB,
-		port:      config.Port,
-		tlsConfig: config.TLSConfig,
-		streams:   make(map[string]pb.CosmosController_StreamAgentMessagesServer),
+		db:           config.DB,
+		events:       config.Events,
+		port:         config.Port,
+		tlsConfig:    config.TLSConfig,
+		agentTimeout: agentTimeout,
+		ctx:          ctx,
+		cancel:       cancel,
+		streams:      make(map[string]*agentStream),
+		pending:      make(map[string]chan *pb.AgentMessage),
 	}
 }
 
+// SetConnectHandler sets a function run whenever an agent opens a new
+// stream, such as to re-send it the desired state. It must be set before
+// Start.
+func (s *Server) SetConnectHandler(fn func(hostname string)) {
+	s.onConnect = fn
+}
+
+// SetLeaderCheck makes the server refuse agent streams while fn returns
+// false. It must be set before Start.
+func (s *Server) SetLeaderCheck(fn func() bool) {
+	s.isLeader = fn
+}
+
 func (s *Server) Start() error {
 	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", s.port))
 	if err != nil {
 		return fmt.Errorf("failed to listen: %w", err)
 	}
 
-	var opts []grpc.ServerOption
+	// Ping idle connections so half-open ones are noticed and their streams
+	// torn down instead of swallowing deployments
+	opts := []grpc.ServerOption{
+		grpc.KeepaliveParams(keepalive.ServerParameters{
+			Time:    30 * time.Second,
+			Timeout: 10 * time.Second,
+		}),
+		grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+			MinTime:             10 * time.Second,
+			PermitWithoutStream: true,
+		}),
+	}
 
 	if s.tlsConfig != nil {
-		creds := credentials.NewTLS(s.tlsConfig)
+		// Agents are identified by their client certificate, so one is
+		// requested and verified. Streams without one are refused by
+		// StreamAgentMessages with a clearer error than a failed handshake.
+		tlsConfig := s.tlsConfig.Clone()
+		if tlsConfig.ClientAuth == tls.NoClientCert {
+			tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+		creds := credentials.NewTLS(tlsConfig)
 		opts = append(opts, grpc.Creds(creds))
 		log.Info("gRPC server using TLS")
 	}
@@ -68,12 +171,16 @@ func (s *Server) Start() error {
 		}
 	}()
 
+	go s.reapStreams()
+
 	return nil
 }
 
 func (s *Server) Stop() error {
 	log.Info("Stopping gRPC server")
 
+	s.cancel()
+
 	if s.grpcServer != nil {
 		s.grpcServer.GracefulStop()
 	}
@@ -84,31 +191,70 @@ func (s *Server) Stop() error {
 func (s *Server) StreamAgentMessages(stream pb.CosmosController_StreamAgentMessagesServer) error {
 	ctx := stream.Context()
 
-	var hostname string
-	p, ok := peer.FromContext(ctx)
-	if ok && s.tlsConfig != nil {
-		if tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo); ok {
-			if len(tlsInfo.State.PeerCertificates) > 0 {
-				hostname = tlsInfo.State.PeerCertificates[0].Subject.CommonName
-				log.WithField("hostname", hostname).Info("Agent connected with mTLS")
-			}
-		}
+	if s.isLeader != nil && !s.isLeader() {
+		return status.Error(codes.Unavailable, "this controller is not the leader")
 	}
 
-	if hostname == "" {
-		log.Warn("Agent connected without valid certificate, waiting for heartbeat")
+	// With TLS an agent is who its certificate says, and may not claim any
+	// other hostname in its messages
+	var certHostname string
+	if s.tlsConfig != nil {
+		certHostname = peerCommonName(ctx)
+		if certHostname == "" {
+			log.Warn("Refusing agent stream without a client certificate")
+			return status.Error(codes.Unauthenticated, "a client certificate is required")
+		}
+		log.WithField("hostname", certHostname).Info("Agent connected with mTLS")
+	} else {
+		log.Warn("Agent connected without TLS, waiting for heartbeat")
 	}
 
-	for {
-		msg, err := stream.Recv()
-		if err == io.EOF {
-			log.WithField("hostname", hostname).Info("Agent stream closed")
-			s.removeStream(hostname)
-			return nil
+	hostname := certHostname
+
+	self := newAgentStream(stream)
+
+	// Receive in the background so the stream can be ended while its Recv
+	// is blocked on a dead connection
+	received := make(chan *pb.AgentMessage)
+	recvErr := make(chan error, 1)
+	go func() {
+		for {
+			msg, err := stream.Recv()
+			if err != nil {
+				recvErr <- err
+				return
+			}
+
+			select {
+			case received <- msg:
+			case <-self.closed:
+				return
+			case <-ctx.Done():
+				return
+			}
 		}
-		if err != nil {
+	}()
+
+	for {
+		var msg *pb.AgentMessage
+		select {
+		case <-self.closed:
+			return self.closeErr
+		case err := <-recvErr:
+			if err == io.EOF {
+				log.WithField("hostname", hostname).Info("Agent stream closed")
+				s.removeStream(hostname, self)
+				return nil
+			}
 			log.WithError(err).WithField("hostname", hostname).Warn("Error receiving message from agent")
-			s.removeStream(hostname)
+			s.removeStream(hostname, self)
+			return err
+		case msg = <-received:
+		}
+
+		if err := checkAgentHostname(certHostname, msg.Hostname); err != nil {
+			log.WithError(err).WithField("hostname", certHostname).Warn("Rejecting agent stream")
+			s.removeStream(hostname, self)
 			return err
 		}
 
@@ -117,8 +263,8 @@ func (s *Server) StreamAgentMessages(stream pb.CosmosController_StreamAgentMessa
 			log.WithField("hostname", hostname).Info("Agent identified via heartbeat")
 		}
 
-		if hostname != "" {
-			s.registerStream(hostname, stream)
+		if hostname != "" && !s.registerStream(hostname, self) {
+			continue
 		}
 
 		if err := s.handleAgentMessage(hostname, msg); err != nil {
@@ -127,6 +273,31 @@ func (s *Server) StreamAgentMessages(stream pb.CosmosController_StreamAgentMessa
 	}
 }
 
+// peerCommonName returns the CommonName of the verified client certificate
+// of a TLS connection, or "" without one
+func peerCommonName(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ""
+	}
+
+	tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(tlsInfo.State.PeerCertificates) == 0 {
+		return ""
+	}
+
+	return tlsInfo.State.PeerCertificates[0].Subject.CommonName
+}
+
+// checkAgentHostname rejects messages claiming a hostname other than the one
+// in the agent's certificate
+func checkAgentHostname(certHostname, claimed string) error {
+	if certHostname == "" || claimed == "" || claimed == certHostname {
+		return nil
+	}
+	return status.Errorf(codes.PermissionDenied, "hostname %q doesn't match the certificate's %q", claimed, certHostname)
+}
+
 func (s *Server) handleAgentMessage(hostname string, msg *pb.AgentMessage) error {
 	switch m := msg.Message.(type) {
 	case *pb.AgentMessage_Heartbeat:
@@ -136,9 +307,15 @@ func (s *Server) handleAgentMessage(hostname string, msg *pb.AgentMessage) error
 	case *pb.AgentMessage_HealthResult:
 		return s.handleHealthResult(hostname, m.HealthResult)
 	case *pb.AgentMessage_DeploymentResult:
-		return s.handleDeploymentResult(hostname, m.DeploymentResult)
+		err := s.handleDeploymentResult(hostname, m.DeploymentResult)
+		if m.DeploymentResult.RequestId != "" {
+			s.deliver(hostname, m.DeploymentResult.RequestId, msg)
+		}
+		return err
 	case *pb.AgentMessage_LogChunk:
 		return s.handleLogChunk(hostname, m.LogChunk)
+	case *pb.AgentMessage_LogResponse:
+		s.deliver(hostname, m.LogResponse.RequestId, msg)
 	default:
 		log.WithField("hostname", hostname).Warn("Received unknown message type from agent")
 	}
@@ -163,22 +340,31 @@ func (s *Server) handleHeartbeat(hostname string, heartbeat *pb.AgentHeartbeat)
 		ComponentCount: componentCount,
 	}
 
+	if len(heartbeat.Metadata) > 0 {
+		metadata, err := json.Marshal(heartbeat.Metadata)
+		if err == nil {
+			agent.Metadata = metadata
+		}
+	}
+
+	if metrics := heartbeat.SystemMetrics; metrics != nil {
+		agent.LoadAverage = metrics.LoadAverage
+		agent.CPUCount = int(metrics.CpuCount)
+		agent.MemoryUsedBytes = int64(metrics.MemoryUsedBytes)
+		agent.MemoryTotalBytes = int64(metrics.MemoryTotalBytes)
+		agent.DiskFreeBytes = int64(metrics.DiskFreeBytes)
+		agent.DiskTotalBytes = int64(metrics.DiskTotalBytes)
+	}
+
 	if err := s.db.UpsertAgent(agent); err != nil {
 		return err
 	}
 
-	// Merge agent tags with the "all" tag
+	// Only liveness is updated here: the node sync owns the node's tags, so
+	// the agent's tags and "all" are added to them rather than replacing them
 	tags := mergeTags(heartbeat.Tags, "all")
 
-	node := &database.Node{
-		Hostname: hostname,
-		Tags:     tags,
-		Online:   true,
-		HasAgent: true,
-		LastSeen: &agent.LastHeartbeat,
-	}
-
-	if err := s.db.UpsertNode(node); err != nil {
+	if err := s.db.RecordNodeHeartbeat(hostname, tags, agent.LastHeartbeat); err != nil {
 		return err
 	}
 
@@ -229,27 +415,42 @@ func (s *Server) handleComponentStatus(hostname string, status *pb.ComponentStat
 		"status":    status.Status,
 	}).Debug("Received component status")
 
-	deployment := &database.ComponentDeployment{
-		ComponentName: status.Name,
-		NodeHostname:  hostname,
-		Status:        status.Status,
-		Message:       status.Message,
+	// A status report owns the process state; health results and deployment
+	// outcomes are kept as they are
+	now := time.Now()
+	fields := map[string]interface{}{
+		"status":        status.Status,
+		"message":       status.Message,
+		"restart_count": int(status.RestartCount),
+		"last_updated":  &now,
 	}
 
 	if status.Pid > 0 {
-		pid := int(status.Pid)
-		deployment.PID = &pid
+		fields["p_id"] = int(status.Pid)
+	} else {
+		fields["p_id"] = nil
 	}
 
 	if status.LastStartedAt > 0 {
-		t := time.Unix(status.LastStartedAt, 0)
-		deployment.LastStartedAt = &t
+		fields["last_started_at"] = time.Unix(status.LastStartedAt, 0)
 	}
 
-	now := time.Now()
-	deployment.LastUpdated = &now
+	if len(status.RestartHistory) > 0 {
+		history := make([]database.RestartEvent, 0, len(status.RestartHistory))
+		for _, event := range status.RestartHistory {
+			history = append(history, database.RestartEvent{
+				Timestamp: time.Unix(event.Timestamp, 0),
+				Reason:    event.Reason,
+				ExitCode:  int(event.ExitCode),
+			})
+		}
 
-	return s.db.UpsertComponentDeployment(deployment)
+		if data, err := json.Marshal(history); err == nil {
+			fields["restart_history"] = json.RawMessage(data)
+		}
+	}
+
+	return s.db.UpdateComponentDeployment(status.Name, hostname, fields)
 }
 
 func (s *Server) handleHealthResult(hostname string, result *pb.HealthCheckResult) error {
@@ -265,18 +466,16 @@ func (s *Server) handleHealthResult(hostname string, result *pb.HealthCheckResul
 	}
 
 	now := time.Now()
-	deployment := &database.ComponentDeployment{
-		ComponentName:   result.ComponentName,
-		NodeHostname:    hostname,
-		HealthStatus:    healthStatus,
-		LastHealthCheck: &now,
+	fields := map[string]interface{}{
+		"health_status":     healthStatus,
+		"last_health_check": &now,
 	}
 
 	if result.Message != "" {
-		deployment.Message = result.Message
+		fields["message"] = result.Message
 	}
 
-	return s.db.UpsertComponentDeployment(deployment)
+	return s.db.UpdateComponentDeployment(result.ComponentName, hostname, fields)
 }
 
 func (s *Server) handleDeploymentResult(hostname string, result *pb.DeploymentResult) error {
@@ -289,8 +488,16 @@ func (s *Server) handleDeploymentResult(hostname string, result *pb.DeploymentRe
 	}).Info("Received deployment result")
 
 	status := "running"
-	if result.Result == "failure" || result.Result == "failed" {
+	switch {
+	case result.Result == "failure" || result.Result == "failed":
 		status = "failed"
+	case result.Result == "rolled_back":
+		status = "rolled_back"
+	case result.Result == "received" || result.Result == "started" || result.Result == "downloaded" || result.Result == "progress":
+		// Progress reports; the controller is still waiting for the outcome
+		status = "deploying"
+	case result.Operation == "stop":
+		status = "stopped"
 	}
 
 	now := time.Now()
@@ -301,10 +508,37 @@ func (s *Server) handleDeploymentResult(hostname string, result *pb.DeploymentRe
 		Message:       result.Message,
 		DeployedAt:    &now,
 		LastUpdated:   &now,
+		Phase:         result.Phase,
+	}
+	if result.Phase != "" && result.ProgressPercent >= 0 {
+		percent := int(result.ProgressPercent)
+		deployment.ProgressPercent = &percent
 	}
 
-	if err := s.db.UpsertComponentDeployment(deployment); err != nil {
-		return err
+	// After a successful removal the controller has already deleted the
+	// node's record, or marked it drained or removing; don't bring it back
+	// as running. A removing record has served its purpose.
+	removed := result.Operation == "remove" && status == "running"
+	if removed {
+		if err := s.db.DeleteRemovedComponentDeployment(result.ComponentName, hostname); err != nil {
+			return err
+		}
+	} else {
+		updates := map[string]interface{}{
+			"status":       deployment.Status,
+			"message":      deployment.Message,
+			"deployed_at":  deployment.DeployedAt,
+			"last_updated": deployment.LastUpdated,
+		}
+		// The phase is kept until the next one is reported, and cleared
+		// when a new deployment is received or this one finishes
+		if result.Phase != "" || status != "deploying" || result.Result == "received" {
+			updates["phase"] = deployment.Phase
+			updates["progress_percent"] = deployment.ProgressPercent
+		}
+		if err := s.db.UpdateComponentDeployment(result.ComponentName, hostname, updates); err != nil {
+			return err
+		}
 	}
 
 	// Look up the component to get its deployment_id for logging
@@ -314,7 +548,12 @@ func (s *Server) handleDeploymentResult(hostname string, result *pb.DeploymentRe
 		return nil // Don't fail the update if we can't log
 	}
 
-	// Log the deployment result to deployment_logs table
+	// Log the deployment result to deployment_logs table. Progress reports
+	// only update the status; logging each of them would flood the log.
+	if component.DeploymentID != nil && result.Result == "progress" {
+		s.events.Publish(events.Event{DeploymentID: *component.DeploymentID, Type: events.TypeStatus, Data: deployment})
+		return nil
+	}
 	if component.DeploymentID != nil {
 		deploymentLog := &database.DeploymentLog{
 			DeploymentID:  *component.DeploymentID,
@@ -328,6 +567,11 @@ func (s *Server) handleDeploymentResult(hostname string, result *pb.DeploymentRe
 		if err := s.db.LogDeployment(deploymentLog); err != nil {
 			log.WithError(err).Warn("Failed to log deployment result")
 		}
+
+		if !removed {
+			s.events.Publish(events.Event{DeploymentID: *component.DeploymentID, Type: events.TypeStatus, Data: deployment})
+		}
+		s.events.Publish(events.Event{DeploymentID: *component.DeploymentID, Type: events.TypeLog, Data: deploymentLog})
 	}
 
 	return nil
@@ -351,22 +595,136 @@ func (s *Server) handleLogChunk(hostname string, logChunk *pb.LogChunk) error {
 	return s.db.SaveComponentLog(componentLog)
 }
 
-func (s *Server) registerStream(hostname string, stream pb.CosmosController_StreamAgentMessagesServer) {
+// await registers a request and returns the channel its answer arrives on,
+// along with a function that unregisters it
+func (s *Server) await() (string, <-chan *pb.AgentMessage, func()) {
+	requestID := uuid.NewString()
+	waiting := make(chan *pb.AgentMessage, 1)
+
+	s.pendingMu.Lock()
+	s.pending[requestID] = waiting
+	s.pendingMu.Unlock()
+
+	return requestID, waiting, func() {
+		s.pendingMu.Lock()
+		delete(s.pending, requestID)
+		s.pendingMu.Unlock()
+	}
+}
+
+// deliver hands an agent's answer to the caller waiting on requestID
+func (s *Server) deliver(hostname, requestID string, msg *pb.AgentMessage) {
+	s.pendingMu.Lock()
+	waiting, ok := s.pending[requestID]
+	delete(s.pending, requestID)
+	s.pendingMu.Unlock()
+
+	if !ok {
+		log.WithFields(log.Fields{
+			"hostname":   hostname,
+			"request_id": requestID,
+		}).Debug("Dropping agent answer nobody is waiting for")
+		return
+	}
+
+	waiting <- msg
+}
+
+// registerStream makes stream the one used to reach the agent and marks it
+// as alive. A newer stream replaces an older one for the same hostname,
+// which is closed so a lingering connection can't receive deployments. It
+// returns false for a stream the controller has already closed.
+func (s *Server) registerStream(hostname string, stream *agentStream) bool {
 	s.streamsMu.Lock()
 	defer s.streamsMu.Unlock()
 
-	if _, exists := s.streams[hostname]; !exists {
+	select {
+	case <-stream.closed:
+		return false
+	default:
+	}
+
+	stream.lastSeen = time.Now()
+
+	existing, exists := s.streams[hostname]
+	if existing == stream {
+		return true
+	}
+
+	if exists {
+		log.WithField("hostname", hostname).Warn("Agent opened a new stream, replacing the existing one")
+		closeStream(existing, status.Error(codes.Aborted, "replaced by a newer connection from the same agent"))
+	} else {
 		log.WithField("hostname", hostname).Info("Registered agent stream")
 	}
 
 	s.streams[hostname] = stream
+
+	if s.onConnect != nil {
+		go s.onConnect(hostname)
+	}
+	return true
 }
 
-func (s *Server) removeStream(hostname string) {
+// closeStream ends a stream's handler with err. streamsMu must be held.
+func closeStream(stream *agentStream, err error) {
+	stream.closeErr = err
+	close(stream.closed)
+}
+
+// reapStreams closes streams that haven't received anything, not even a
+// heartbeat, within the agent timeout
+func (s *Server) reapStreams() {
+	ticker := time.NewTicker(s.agentTimeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			s.reapStaleStreams(time.Now())
+		}
+	}
+}
+
+func (s *Server) reapStaleStreams(now time.Time) {
+	s.streamsMu.Lock()
+	defer s.streamsMu.Unlock()
+
+	for hostname, stream := range s.streams {
+		if now.Sub(stream.lastSeen) <= s.agentTimeout {
+			continue
+		}
+
+		log.WithFields(log.Fields{
+			"hostname":  hostname,
+			"last_seen": stream.lastSeen,
+		}).Warn("Closing stream of unresponsive agent")
+
+		delete(s.streams, hostname)
+		closeStream(stream, status.Errorf(codes.Unavailable, "no message from agent within %s", s.agentTimeout))
+	}
+}
+
+// CloseStreams ends every agent stream, such as when this controller stops
+// leading, so the agents reconnect to whichever controller now leads
+func (s *Server) CloseStreams() {
 	s.streamsMu.Lock()
 	defer s.streamsMu.Unlock()
 
-	if _, exists := s.streams[hostname]; exists {
+	for hostname, stream := range s.streams {
+		delete(s.streams, hostname)
+		closeStream(stream, status.Error(codes.Unavailable, "this controller is no longer the leader"))
+	}
+}
+
+// removeStream forgets the agent's stream if it's still the registered one
+func (s *Server) removeStream(hostname string, stream *agentStream) {
+	s.streamsMu.Lock()
+	defer s.streamsMu.Unlock()
+
+	if existing, exists := s.streams[hostname]; exists && existing == stream {
 		delete(s.streams, hostname)
 		log.WithField("hostname", hostname).Info("Removed agent stream")
 	}
@@ -374,7 +732,7 @@ func (s *Server) removeStream(hostname string) {
 
 func (s *Server) SendDeployment(hostname string, deployment *pb.ComponentDeployment) error {
 	s.streamsMu.RLock()
-	stream, exists := s.streams[hostname]
+	entry, exists := s.streams[hostname]
 	s.streamsMu.RUnlock()
 
 	log.WithFields(log.Fields{
@@ -402,7 +760,7 @@ func (s *Server) SendDeployment(hostname string, deployment *pb.ComponentDeploym
 		"component": deployment.ComponentName,
 	}).Info("Sending deployment message to agent")
 
-	err := stream.Send(msg)
+	err := entry.send(msg)
 	if err != nil {
 		log.WithError(err).WithField("hostname", hostname).Error("Failed to send deployment message")
 	} else {
@@ -412,6 +770,19 @@ func (s *Server) SendDeployment(hostname string, deployment *pb.ComponentDeploym
 	return err
 }
 
+// getStream returns the active stream for an agent, or ErrAgentNotConnected
+func (s *Server) getStream(hostname string) (*agentStream, error) {
+	s.streamsMu.RLock()
+	entry, exists := s.streams[hostname]
+	s.streamsMu.RUnlock()
+
+	if !exists {
+		return nil, fmt.Errorf("no stream for agent %s: %w", hostname, ErrAgentNotConnected)
+	}
+
+	return entry, nil
+}
+
 func (s *Server) getStreamHostnames() []string {
 	hostnames := make([]string, 0, len(s.streams))
 	for h := range s.streams {
@@ -421,12 +792,9 @@ func (s *Server) getStreamHostnames() []string {
 }
 
 func (s *Server) SendRemoval(hostname, componentName string) error {
-	s.streamsMu.RLock()
-	stream, exists := s.streams[hostname]
-	s.streamsMu.RUnlock()
-
-	if !exists {
-		return fmt.Errorf("no stream for agent %s", hostname)
+	stream, err := s.getStream(hostname)
+	if err != nil {
+		return err
 	}
 
 	msg := &pb.ControllerMessage{
@@ -442,16 +810,13 @@ func (s *Server) SendRemoval(hostname, componentName string) error {
 		"component": componentName,
 	}).Info("Sending removal to agent")
 
-	return stream.Send(msg)
+	return stream.send(msg)
 }
 
 func (s *Server) SendHealthConfig(hostname string, config *pb.HealthCheckConfig) error {
-	s.streamsMu.RLock()
-	stream, exists := s.streams[hostname]
-	s.streamsMu.RUnlock()
-
-	if !exists {
-		return fmt.Errorf("no stream for agent %s", hostname)
+	stream, err := s.getStream(hostname)
+	if err != nil {
+		return err
 	}
 
 	msg := &pb.ControllerMessage{
@@ -460,16 +825,115 @@ func (s *Server) SendHealthConfig(hostname string, config *pb.HealthCheckConfig)
 		},
 	}
 
-	return stream.Send(msg)
+	return stream.send(msg)
 }
 
-func (s *Server) SendAck(hostname, message string) error {
-	s.streamsMu.RLock()
-	stream, exists := s.streams[hostname]
-	s.streamsMu.RUnlock()
+func (s *Server) SendLogLevel(hostname, level string) error {
+	stream, err := s.getStream(hostname)
+	if err != nil {
+		return err
+	}
 
-	if !exists {
-		return fmt.Errorf("no stream for agent %s", hostname)
+	msg := &pb.ControllerMessage{
+		Message: &pb.ControllerMessage_LogLevel{
+			LogLevel: &pb.LogLevelChange{
+				Level: level,
+			},
+		},
+	}
+
+	log.WithFields(log.Fields{
+		"hostname": hostname,
+		"level":    level,
+	}).Info("Sending log level change to agent")
+
+	return stream.send(msg)
+}
+
+// RequestLogs asks an agent for the last lines of a component's log and
+// waits for the answer until ctx is done
+func (s *Server) RequestLogs(ctx context.Context, hostname, componentName string, lines int) (string, error) {
+	stream, err := s.getStream(hostname)
+	if err != nil {
+		return "", err
+	}
+
+	requestID, waiting, done := s.await()
+	defer done()
+
+	msg := &pb.ControllerMessage{
+		Message: &pb.ControllerMessage_LogRequest{
+			LogRequest: &pb.LogRequest{
+				RequestId:     requestID,
+				ComponentName: componentName,
+				Lines:         int32(lines),
+			},
+		},
+	}
+
+	if err := stream.send(msg); err != nil {
+		return "", fmt.Errorf("failed to send log request: %w", err)
+	}
+
+	select {
+	case msg := <-waiting:
+		response := msg.GetLogResponse()
+		if response.Error != "" {
+			return "", fmt.Errorf("agent failed to read log: %s", response.Error)
+		}
+		return response.LogData, nil
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// SendControl asks an agent to restart, stop or start a component and waits
+// until ctx is done for the agent's result, returning its message
+func (s *Server) SendControl(ctx context.Context, hostname, action, componentName string) (string, error) {
+	stream, err := s.getStream(hostname)
+	if err != nil {
+		return "", err
+	}
+
+	requestID, waiting, done := s.await()
+	defer done()
+
+	msg := &pb.ControllerMessage{
+		Message: &pb.ControllerMessage_Control{
+			Control: &pb.ComponentControl{
+				RequestId:     requestID,
+				ComponentName: componentName,
+				Action:        action,
+			},
+		},
+	}
+
+	log.WithFields(log.Fields{
+		"hostname":  hostname,
+		"component": componentName,
+		"action":    action,
+	}).Info("Sending component control to agent")
+
+	if err := stream.send(msg); err != nil {
+		return "", fmt.Errorf("failed to send %s: %w", action, err)
+	}
+
+	select {
+	case msg := <-waiting:
+		result := msg.GetDeploymentResult()
+		if result.Result != "success" {
+			return "", fmt.Errorf("agent failed to %s component: %s", action, result.Message)
+		}
+		return result.Message, nil
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+func (s *Server) SendAck(hostname, message string) error {
+	stream, err := s.getStream(hostname)
+	if err != nil {
+		return err
 	}
 
 	msg := &pb.ControllerMessage{
@@ -480,7 +944,7 @@ func (s *Server) SendAck(hostname, message string) error {
 		},
 	}
 
-	return stream.Send(msg)
+	return stream.send(msg)
 }
 
 func (s *Server) GetConnectedAgents() []string {
@@ -0,0 +1,462 @@
+package grpc
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"io"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/metorial/fleet/cosmos/internal/controller/database"
+	"github.com/metorial/fleet/cosmos/internal/controller/database/dbtest"
+	pb "github.com/metorial/fleet/cosmos/internal/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// fakeAgentStream is an agent connection whose messages are fed by the test.
+// Closing incoming ends the stream with io.EOF.
+type fakeAgentStream struct {
+	grpc.ServerStream
+	ctx      context.Context
+	incoming chan *pb.AgentMessage
+}
+
+func newFakeAgentStream(t *testing.T) *fakeAgentStream {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	return &fakeAgentStream{ctx: ctx, incoming: make(chan *pb.AgentMessage)}
+}
+
+func (s *fakeAgentStream) Context() context.Context { return s.ctx }
+
+func (s *fakeAgentStream) Send(*pb.ControllerMessage) error { return nil }
+
+func (s *fakeAgentStream) Recv() (*pb.AgentMessage, error) {
+	select {
+	case msg, ok := <-s.incoming:
+		if !ok {
+			return nil, io.EOF
+		}
+		return msg, nil
+	case <-s.ctx.Done():
+		return nil, s.ctx.Err()
+	}
+}
+
+// newTLSAgentStream is an agent connection authenticated with a client
+// certificate for commonName, or without a certificate when it is empty
+func newTLSAgentStream(t *testing.T, commonName string) *fakeAgentStream {
+	stream := newFakeAgentStream(t)
+
+	var state tls.ConnectionState
+	if commonName != "" {
+		state.PeerCertificates = []*x509.Certificate{{Subject: pkix.Name{CommonName: commonName}}}
+	}
+	stream.ctx = peer.NewContext(stream.ctx, &peer.Peer{AuthInfo: credentials.TLSInfo{State: state}})
+	return stream
+}
+
+func TestNewerStreamReplacesExisting(t *testing.T) {
+	s := NewServer(&ServerConfig{})
+
+	// Messages without a body only identify the agent
+	hello := &pb.AgentMessage{Hostname: "node-1"}
+
+	serve := func(stream *fakeAgentStream) chan error {
+		done := make(chan error, 1)
+		go func() { done <- s.StreamAgentMessages(stream) }()
+		stream.incoming <- hello
+		return done
+	}
+
+	waitForStream := func(want *fakeAgentStream) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for time.Now().Before(deadline) {
+			if got, err := s.getStream("node-1"); err == nil && got.stream == want {
+				return
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		t.Fatal("Timed out waiting for stream to be registered")
+	}
+
+	old := newFakeAgentStream(t)
+	oldDone := serve(old)
+	waitForStream(old)
+
+	// The old connection is still open when the agent reconnects
+	fresh := newFakeAgentStream(t)
+	freshDone := serve(fresh)
+	waitForStream(fresh)
+
+	select {
+	case err := <-oldDone:
+		if status.Code(err) != codes.Aborted {
+			t.Errorf("Expected replaced stream to end with Aborted, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected replaced stream to be closed")
+	}
+
+	if connected := s.GetConnectedAgents(); len(connected) != 1 {
+		t.Errorf("Expected one stream for the hostname, got %v", connected)
+	}
+
+	close(fresh.incoming)
+	if err := <-freshDone; err != nil {
+		t.Errorf("Expected stream to end cleanly, got %v", err)
+	}
+
+	if _, err := s.getStream("node-1"); err == nil {
+		t.Error("Expected stream to be removed after the agent disconnected")
+	}
+}
+
+func TestReplacedStreamDoesNotRemoveNewer(t *testing.T) {
+	s := NewServer(&ServerConfig{})
+
+	old := newAgentStream(nil)
+	fresh := newAgentStream(nil)
+
+	s.registerStream("node-1", old)
+	s.registerStream("node-1", fresh)
+
+	// A late message or error on the old connection must not take over or
+	// drop the newer one
+	if s.registerStream("node-1", old) {
+		t.Error("Expected replaced stream not to register again")
+	}
+	s.removeStream("node-1", old)
+
+	s.streamsMu.RLock()
+	current := s.streams["node-1"]
+	s.streamsMu.RUnlock()
+
+	if current != fresh {
+		t.Error("Expected the newer stream to stay registered")
+	}
+}
+
+func TestStalledAgentIsReaped(t *testing.T) {
+	s := NewServer(&ServerConfig{AgentTimeout: 100 * time.Millisecond})
+	t.Cleanup(s.cancel)
+	go s.reapStreams()
+
+	stream := newFakeAgentStream(t)
+	done := make(chan error, 1)
+	go func() { done <- s.StreamAgentMessages(stream) }()
+
+	// The agent identifies itself and then goes silent without closing
+	stream.incoming <- &pb.AgentMessage{Hostname: "node-1"}
+
+	waitForAgents := func(want int) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for len(s.GetConnectedAgents()) != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected %d connected agents, got %v", want, s.GetConnectedAgents())
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	waitForAgents(1)
+	waitForAgents(0)
+
+	select {
+	case err := <-done:
+		if status.Code(err) != codes.Unavailable {
+			t.Errorf("Expected reaped stream to end with Unavailable, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected reaped stream to be closed")
+	}
+}
+
+func TestFollowerRefusesAgentStreams(t *testing.T) {
+	s := NewServer(&ServerConfig{})
+
+	var leading atomic.Bool
+	s.SetLeaderCheck(leading.Load)
+
+	if err := s.StreamAgentMessages(newFakeAgentStream(t)); status.Code(err) != codes.Unavailable {
+		t.Fatalf("Expected a follower to refuse the stream with Unavailable, got %v", err)
+	}
+
+	leading.Store(true)
+	stream := newFakeAgentStream(t)
+	done := make(chan error, 1)
+	go func() { done <- s.StreamAgentMessages(stream) }()
+	stream.incoming <- &pb.AgentMessage{Hostname: "node-1"}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for len(s.GetConnectedAgents()) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the leader to register the stream")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// Stepping down sends the agent off to find the new leader
+	leading.Store(false)
+	s.CloseStreams()
+
+	select {
+	case err := <-done:
+		if status.Code(err) != codes.Unavailable {
+			t.Errorf("Expected closed stream to end with Unavailable, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected the stream to be closed after stepping down")
+	}
+
+	if connected := s.GetConnectedAgents(); len(connected) != 0 {
+		t.Errorf("Expected no streams after stepping down, got %v", connected)
+	}
+}
+
+func TestConnectHandlerRunsForNewStreams(t *testing.T) {
+	s := NewServer(&ServerConfig{})
+
+	connected := make(chan string, 10)
+	s.SetConnectHandler(func(hostname string) { connected <- hostname })
+
+	first := newAgentStream(nil)
+	s.registerStream("node-1", first)
+	// Every message re-registers the stream; only the first one counts
+	s.registerStream("node-1", first)
+	s.registerStream("node-1", newAgentStream(nil))
+
+	for i := 0; i < 2; i++ {
+		select {
+		case hostname := <-connected:
+			if hostname != "node-1" {
+				t.Errorf("Expected node-1 to connect, got %s", hostname)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Expected %d connect calls, got %d", 2, i)
+		}
+	}
+
+	select {
+	case <-connected:
+		t.Error("Expected no connect call for an already registered stream")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// overlapDetectingStream records whether Send was ever called while another
+// Send was in progress
+type overlapDetectingStream struct {
+	fakeAgentStream
+	inFlight atomic.Int32
+	overlap  atomic.Bool
+	sent     atomic.Int32
+}
+
+func (s *overlapDetectingStream) Send(*pb.ControllerMessage) error {
+	if s.inFlight.Add(1) > 1 {
+		s.overlap.Store(true)
+	}
+	time.Sleep(time.Millisecond)
+	s.inFlight.Add(-1)
+	s.sent.Add(1)
+	return nil
+}
+
+func TestSendsToOneAgentAreSerialized(t *testing.T) {
+	s := NewServer(&ServerConfig{})
+	stream := &overlapDetectingStream{}
+	s.registerStream("node-1", newAgentStream(stream))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			s.SendDeployment("node-1", &pb.ComponentDeployment{ComponentName: "web"})
+		}()
+		go func() {
+			defer wg.Done()
+			s.SendRemoval("node-1", "web")
+		}()
+		go func() {
+			defer wg.Done()
+			s.SendAck("node-1", "ok")
+		}()
+	}
+	wg.Wait()
+
+	if stream.overlap.Load() {
+		t.Error("Expected sends on one stream never to overlap")
+	}
+	if got := stream.sent.Load(); got != 30 {
+		t.Errorf("Expected 30 messages to be sent, got %d", got)
+	}
+}
+
+func TestAgentHostnameMustMatchCertificate(t *testing.T) {
+	s := NewServer(&ServerConfig{TLSConfig: &tls.Config{}})
+
+	serve := func(stream *fakeAgentStream) chan error {
+		done := make(chan error, 1)
+		go func() { done <- s.StreamAgentMessages(stream) }()
+		return done
+	}
+
+	t.Run("matching", func(t *testing.T) {
+		stream := newTLSAgentStream(t, "node-1")
+		done := serve(stream)
+		stream.incoming <- &pb.AgentMessage{Hostname: "node-1"}
+
+		deadline := time.Now().Add(2 * time.Second)
+		for {
+			if _, err := s.getStream("node-1"); err == nil {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("Expected the agent's stream to be registered")
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+
+		close(stream.incoming)
+		if err := <-done; err != nil {
+			t.Errorf("Expected stream to end cleanly, got %v", err)
+		}
+	})
+
+	t.Run("mismatched", func(t *testing.T) {
+		stream := newTLSAgentStream(t, "node-1")
+		done := serve(stream)
+		stream.incoming <- &pb.AgentMessage{Hostname: "node-2"}
+
+		select {
+		case err := <-done:
+			if status.Code(err) != codes.PermissionDenied {
+				t.Errorf("Expected PermissionDenied, got %v", err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("Expected the stream to be rejected")
+		}
+
+		if connected := s.GetConnectedAgents(); len(connected) != 0 {
+			t.Errorf("Expected no registered streams, got %v", connected)
+		}
+	})
+
+	t.Run("missing certificate", func(t *testing.T) {
+		stream := newTLSAgentStream(t, "")
+		err := <-serve(stream)
+		if status.Code(err) != codes.Unauthenticated {
+			t.Errorf("Expected Unauthenticated, got %v", err)
+		}
+	})
+}
+
+func setupTestDB(t *testing.T) *database.ControllerDB {
+	dsn := dbtest.URL(t)
+
+	db, err := database.NewControllerDB(dsn)
+	if err != nil {
+		t.Fatalf("Failed to create test database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestHealthResultAndStatusKeepEachOthersFields(t *testing.T) {
+	db := setupTestDB(t)
+	s := NewServer(&ServerConfig{DB: db})
+
+	for _, healthFirst := range []bool{false, true} {
+		componentName := "test-" + uuid.New().String()
+		status := func() error {
+			return s.handleComponentStatus("node-1", &pb.ComponentStatus{Name: componentName, Status: "running", Pid: 4242})
+		}
+		health := func() error {
+			return s.handleHealthResult("node-1", &pb.HealthCheckResult{ComponentName: componentName, Result: "success"})
+		}
+
+		steps := []func() error{status, health}
+		if healthFirst {
+			steps = []func() error{health, status}
+		}
+		for _, step := range steps {
+			if err := step(); err != nil {
+				t.Fatalf("Failed to handle report: %v", err)
+			}
+		}
+
+		dep, err := db.GetComponentDeployment(componentName, "node-1")
+		if err != nil {
+			t.Fatalf("Failed to get component deployment: %v", err)
+		}
+		if dep.Status != "running" || dep.PID == nil || *dep.PID != 4242 {
+			t.Errorf("health first %v: expected status running with PID 4242, got %q and %v", healthFirst, dep.Status, dep.PID)
+		}
+		if dep.HealthStatus != "healthy" || dep.LastHealthCheck == nil {
+			t.Errorf("health first %v: expected a healthy result, got %q at %v", healthFirst, dep.HealthStatus, dep.LastHealthCheck)
+		}
+	}
+}
+
+func TestComponentStatusRecordsRestarts(t *testing.T) {
+	db := setupTestDB(t)
+	s := NewServer(&ServerConfig{DB: db})
+
+	componentName := "test-" + uuid.New().String()
+	t.Cleanup(func() { db.DeleteComponentDeployments(componentName, "node-1") })
+
+	history := []*pb.RestartEvent{
+		{Timestamp: 1700000060, Reason: "Health check failed", ExitCode: 1},
+		{Timestamp: 1700000000, Reason: "Component failed", ExitCode: 2},
+	}
+
+	tests := []struct {
+		name        string
+		status      *pb.ComponentStatus
+		wantCount   int
+		wantHistory int
+	}{
+		{"restarted", &pb.ComponentStatus{Name: componentName, Status: "running", RestartCount: 2, RestartHistory: history}, 2, 2},
+		// The count is the agent's current one, but a report without history
+		// keeps the history already recorded
+		{"count reset by a redeploy", &pb.ComponentStatus{Name: componentName, Status: "running"}, 0, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := s.handleComponentStatus("node-1", tt.status); err != nil {
+				t.Fatalf("Failed to handle status: %v", err)
+			}
+
+			dep, err := db.GetComponentDeployment(componentName, "node-1")
+			if err != nil {
+				t.Fatalf("Failed to get component deployment: %v", err)
+			}
+
+			var stored []database.RestartEvent
+			if err := json.Unmarshal(dep.RestartHistory, &stored); err != nil {
+				t.Fatalf("Failed to decode restart history %s: %v", dep.RestartHistory, err)
+			}
+			if dep.RestartCount != tt.wantCount || len(stored) != tt.wantHistory {
+				t.Fatalf("Expected %d restarts with %d events, got %d with %d", tt.wantCount, tt.wantHistory, dep.RestartCount, len(stored))
+			}
+			if !stored[0].Timestamp.Equal(time.Unix(1700000060, 0)) || stored[0].Reason != "Health check failed" || stored[0].ExitCode != 1 {
+				t.Errorf("Expected the newest restart first, got %+v", stored[0])
+			}
+		})
+	}
+}
@@ -3,7 +3,6 @@ package jobs
 import (
 	"context"
 	"encoding/json"
-	"fmt"
 	"net/http"
 	"time"
 
@@ -12,30 +11,74 @@ import (
 )
 
 type JobsManager struct {
-	db             *database.ControllerDB
-	commandCoreURL string
-	httpClient     *http.Client
-	ctx            context.Context
-	cancel         context.CancelFunc
+	db                  *database.ControllerDB
+	nodeSource          nodeSource
+	agentTimeout        time.Duration
+	nodeSyncInterval    time.Duration
+	cleanupInterval     time.Duration
+	deploymentRetention time.Duration
+	ctx                 context.Context
+	cancel              context.CancelFunc
 }
 
-func NewJobsManager(db *database.ControllerDB, commandCoreURL string) *JobsManager {
+// JobsConfig configures the background jobs. Agents are marked offline once
+// their last heartbeat is older than AgentTimeout, checked twice per
+// timeout. Zero values use the defaults.
+type JobsConfig struct {
+	DB             *database.ControllerDB
+	CommandCoreURL string
+	// NodeSource picks where the node sync reads hosts from:
+	// NodeSourceCommandCore, the default, or NodeSourceConsul
+	NodeSource          string
+	ConsulAddr          string
+	AgentTimeout        time.Duration
+	NodeSyncInterval    time.Duration
+	CleanupInterval     time.Duration
+	DeploymentRetention time.Duration
+}
+
+const (
+	defaultAgentTimeout        = 2 * time.Minute
+	defaultNodeSyncInterval    = 5 * time.Minute
+	defaultCleanupInterval     = 24 * time.Hour
+	defaultDeploymentRetention = 30 * 24 * time.Hour
+)
+
+func NewJobsManager(config *JobsConfig) *JobsManager {
 	ctx, cancel := context.WithCancel(context.Background())
 
+	httpClient := &http.Client{Timeout: 10 * time.Second}
+	var source nodeSource
+	if config.NodeSource == NodeSourceConsul {
+		source = &consulSource{addr: config.ConsulAddr, httpClient: httpClient}
+	} else {
+		source = &commandCoreSource{url: config.CommandCoreURL, httpClient: httpClient}
+	}
+
 	return &JobsManager{
-		db:             db,
-		commandCoreURL: commandCoreURL,
-		httpClient:     &http.Client{Timeout: 10 * time.Second},
-		ctx:            ctx,
-		cancel:         cancel,
+		db:                  config.DB,
+		nodeSource:          source,
+		agentTimeout:        orDefault(config.AgentTimeout, defaultAgentTimeout),
+		nodeSyncInterval:    orDefault(config.NodeSyncInterval, defaultNodeSyncInterval),
+		cleanupInterval:     orDefault(config.CleanupInterval, defaultCleanupInterval),
+		deploymentRetention: orDefault(config.DeploymentRetention, defaultDeploymentRetention),
+		ctx:                 ctx,
+		cancel:              cancel,
+	}
+}
+
+func orDefault(value, fallback time.Duration) time.Duration {
+	if value <= 0 {
+		return fallback
 	}
+	return value
 }
 
 func (jm *JobsManager) Start() {
 	log.Info("Starting background jobs")
 
 	go jm.markOfflineAgents()
-	go jm.syncNodesFromCommandCore()
+	go jm.syncNodes()
 	go jm.cleanupOldDeployments()
 	go jm.cleanupComponentLogs()
 }
@@ -46,7 +89,7 @@ func (jm *JobsManager) Stop() {
 }
 
 func (jm *JobsManager) markOfflineAgents() {
-	ticker := time.NewTicker(60 * time.Second)
+	ticker := time.NewTicker(jm.agentTimeout / 2)
 	defer ticker.Stop()
 
 	for {
@@ -54,7 +97,7 @@ func (jm *JobsManager) markOfflineAgents() {
 		case <-jm.ctx.Done():
 			return
 		case <-ticker.C:
-			threshold := time.Now().Add(-2 * time.Minute)
+			threshold := time.Now().Add(-jm.agentTimeout)
 
 			if err := jm.db.MarkAgentsOffline(threshold); err != nil {
 				log.WithError(err).Warn("Failed to mark agents offline")
@@ -65,8 +108,8 @@ func (jm *JobsManager) markOfflineAgents() {
 	}
 }
 
-func (jm *JobsManager) syncNodesFromCommandCore() {
-	ticker := time.NewTicker(5 * time.Minute)
+func (jm *JobsManager) syncNodes() {
+	ticker := time.NewTicker(jm.nodeSyncInterval)
 	defer ticker.Stop()
 
 	jm.performNodeSync()
@@ -82,41 +125,20 @@ func (jm *JobsManager) syncNodesFromCommandCore() {
 }
 
 func (jm *JobsManager) performNodeSync() {
-	if jm.commandCoreURL == "" {
-		log.Debug("Command-core URL not configured, skipping node sync")
+	if !jm.nodeSource.configured() {
+		log.Debugf("%s not configured, skipping node sync", jm.nodeSource.name())
 		return
 	}
 
-	log.Debug("Syncing nodes from command-core")
-
-	type CommandCoreHost struct {
-		Hostname string                 `json:"hostname"`
-		IP       string                 `json:"ip"`
-		Tags     []string               `json:"tags"`
-		Online   bool                   `json:"online"`
-		LastSeen time.Time              `json:"last_seen"`
-		Metadata map[string]interface{} `json:"metadata"`
-	}
+	log.Debugf("Syncing nodes from %s", jm.nodeSource.name())
 
-	resp, err := jm.httpClient.Get(fmt.Sprintf("%s/api/v1/hosts", jm.commandCoreURL))
+	hosts, err := jm.nodeSource.fetchHosts(jm.ctx)
 	if err != nil {
-		log.WithError(err).Warn("Failed to fetch nodes from command-core")
-		return
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		log.WithField("status", resp.StatusCode).Warn("Command-core returned error status")
-		return
-	}
-
-	var hosts []CommandCoreHost
-	if err := json.NewDecoder(resp.Body).Decode(&hosts); err != nil {
-		log.WithError(err).Warn("Failed to decode command-core response")
+		log.WithError(err).Warnf("Failed to fetch nodes from %s", jm.nodeSource.name())
 		return
 	}
 
-	log.WithField("count", len(hosts)).Info("Syncing nodes from command-core")
+	log.WithField("count", len(hosts)).Infof("Syncing nodes from %s", jm.nodeSource.name())
 
 	agents, err := jm.db.ListAgents(false)
 	if err != nil {
@@ -140,7 +162,7 @@ func (jm *JobsManager) performNodeSync() {
 			Tags:     host.Tags,
 			Online:   host.Online,
 			HasAgent: hasAgent,
-			LastSeen: &host.LastSeen,
+			LastSeen: host.LastSeen,
 			Metadata: metadata,
 			SyncedAt: time.Now(),
 		}
@@ -154,7 +176,7 @@ func (jm *JobsManager) performNodeSync() {
 }
 
 func (jm *JobsManager) cleanupOldDeployments() {
-	ticker := time.NewTicker(24 * time.Hour)
+	ticker := time.NewTicker(jm.cleanupInterval)
 	defer ticker.Stop()
 
 	for {
@@ -162,12 +184,15 @@ func (jm *JobsManager) cleanupOldDeployments() {
 		case <-jm.ctx.Done():
 			return
 		case <-ticker.C:
-			threshold := time.Now().Add(-30 * 24 * time.Hour)
+			threshold := time.Now().Add(-jm.deploymentRetention)
 
-			if err := jm.db.CleanupOldDeployments(threshold); err != nil {
+			if removed, err := jm.db.CleanupOldDeployments(threshold); err != nil {
 				log.WithError(err).Warn("Failed to cleanup old deployments")
 			} else {
-				log.Info("Cleaned up old deployments")
+				log.WithFields(log.Fields{
+					"removed":   removed,
+					"retention": jm.deploymentRetention,
+				}).Info("Cleaned up old deployments")
 			}
 		}
 	}
@@ -0,0 +1,175 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/metorial/fleet/cosmos/internal/controller/database"
+	"github.com/metorial/fleet/cosmos/internal/controller/database/dbtest"
+)
+
+func TestNewJobsManagerDefaults(t *testing.T) {
+	jm := NewJobsManager(&JobsConfig{NodeSyncInterval: time.Minute})
+
+	if jm.nodeSyncInterval != time.Minute {
+		t.Errorf("Expected configured node sync interval, got %s", jm.nodeSyncInterval)
+	}
+	if jm.agentTimeout != defaultAgentTimeout || jm.cleanupInterval != defaultCleanupInterval || jm.deploymentRetention != defaultDeploymentRetention {
+		t.Errorf("Expected defaults for unset intervals, got %s, %s, %s", jm.agentTimeout, jm.cleanupInterval, jm.deploymentRetention)
+	}
+}
+
+func TestNodeSyncInterval(t *testing.T) {
+	syncs := func(interval time.Duration) int64 {
+		var requests atomic.Int64
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests.Add(1)
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		defer server.Close()
+
+		jm := NewJobsManager(&JobsConfig{CommandCoreURL: server.URL, NodeSyncInterval: interval})
+		go jm.syncNodes()
+		time.Sleep(250 * time.Millisecond)
+		jm.Stop()
+
+		return requests.Load()
+	}
+
+	// Only the sync on startup runs within the default interval
+	if got := syncs(0); got != 1 {
+		t.Errorf("Expected 1 sync with the default interval, got %d", got)
+	}
+
+	if got := syncs(20 * time.Millisecond); got < 5 {
+		t.Errorf("Expected a short interval to sync repeatedly, got %d syncs", got)
+	}
+}
+
+func TestMarkOfflineAgentsUsesAgentTimeout(t *testing.T) {
+	dsn := dbtest.URL(t)
+
+	db, err := database.NewControllerDB(dsn)
+	if err != nil {
+		t.Fatalf("Failed to create test database: %v", err)
+	}
+	defer db.Close()
+
+	hostname := "test-" + uuid.New().String()[:8]
+	if err := db.UpsertAgent(&database.Agent{Hostname: hostname, LastHeartbeat: time.Now(), Online: true}); err != nil {
+		t.Fatalf("Failed to create agent: %v", err)
+	}
+
+	jm := NewJobsManager(&JobsConfig{DB: db, AgentTimeout: 100 * time.Millisecond})
+	go jm.markOfflineAgents()
+	defer jm.Stop()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		agent, err := db.GetAgent(hostname)
+		if err != nil {
+			t.Fatalf("Failed to get agent: %v", err)
+		}
+		if !agent.Online {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	t.Error("Expected agent to be marked offline after the configured timeout")
+}
+
+// fakeConsul serves a catalog of three nodes, one of them unreachable
+func fakeConsul(t *testing.T, prefix string) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/catalog/nodes":
+			json.NewEncoder(w).Encode([]map[string]interface{}{
+				{"Node": prefix + "web-1", "Address": "10.0.0.1", "Datacenter": "dc1", "Meta": map[string]string{"cosmos-tags": "web, edge,web", "rack": "a"}},
+				{"Node": prefix + "db-1", "Address": "10.0.0.2", "Datacenter": "dc1", "Meta": map[string]string{"cosmos-tags": "db"}},
+				{"Node": prefix + "bare-1", "Address": "10.0.0.3", "Datacenter": "dc2"},
+			})
+		case "/v1/health/state/critical":
+			json.NewEncoder(w).Encode([]map[string]string{
+				{"Node": prefix + "db-1", "CheckID": "serfHealth"},
+				// Failing service checks don't make a node unreachable
+				{"Node": prefix + "web-1", "CheckID": "service:web"},
+			})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestConsulSourceFetchesHosts(t *testing.T) {
+	server := fakeConsul(t, "")
+	source := &consulSource{addr: strings.TrimPrefix(server.URL, "http://"), httpClient: server.Client()}
+
+	hosts, err := source.fetchHosts(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to fetch hosts: %v", err)
+	}
+	if len(hosts) != 3 {
+		t.Fatalf("Expected 3 hosts, got %+v", hosts)
+	}
+
+	web, db, bare := hosts[0], hosts[1], hosts[2]
+	if web.Hostname != "web-1" || web.IP != "10.0.0.1" || !slices.Equal(web.Tags, []string{"edge", "web"}) || !web.Online || web.LastSeen == nil {
+		t.Errorf("Expected web-1 to be online with tags edge and web, got %+v", web)
+	}
+	if web.Metadata["datacenter"] != "dc1" || web.Metadata["meta"].(map[string]string)["rack"] != "a" {
+		t.Errorf("Expected the datacenter and meta as metadata, got %v", web.Metadata)
+	}
+	if db.Online || db.LastSeen != nil || !slices.Equal(db.Tags, []string{"db"}) {
+		t.Errorf("Expected db-1 to be offline with tag db, got %+v", db)
+	}
+	if bare.Tags == nil || len(bare.Tags) != 0 {
+		t.Errorf("Expected a node without the meta entry to have no tags, got %v", bare.Tags)
+	}
+}
+
+func TestNodeSyncFromConsul(t *testing.T) {
+	dsn := dbtest.URL(t)
+
+	db, err := database.NewControllerDB(dsn)
+	if err != nil {
+		t.Fatalf("Failed to create test database: %v", err)
+	}
+	defer db.Close()
+
+	prefix := "test-" + uuid.New().String()[:8] + "-"
+	if err := db.UpsertAgent(&database.Agent{Hostname: prefix + "web-1", LastHeartbeat: time.Now(), Online: true}); err != nil {
+		t.Fatalf("Failed to create agent: %v", err)
+	}
+
+	server := fakeConsul(t, prefix)
+	jm := NewJobsManager(&JobsConfig{DB: db, NodeSource: NodeSourceConsul, ConsulAddr: server.URL})
+	defer jm.Stop()
+	jm.performNodeSync()
+
+	web, err := db.GetNode(prefix + "web-1")
+	if err != nil {
+		t.Fatalf("Failed to get node: %v", err)
+	}
+	if !web.Online || !web.HasAgent || !slices.Equal(web.Tags, []string{"edge", "web"}) {
+		t.Errorf("Expected web-1 online with its agent and tags, got %+v", web)
+	}
+
+	dbNode, err := db.GetNode(prefix + "db-1")
+	if err != nil {
+		t.Fatalf("Failed to get node: %v", err)
+	}
+	if dbNode.Online || dbNode.HasAgent {
+		t.Errorf("Expected db-1 offline without an agent, got %+v", dbNode)
+	}
+}
@@ -0,0 +1,181 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	NodeSourceCommandCore = "command-core"
+	NodeSourceConsul      = "consul"
+
+	// consulTagsMetaKey is the Consul node meta entry holding a node's
+	// tags, separated by commas
+	consulTagsMetaKey = "cosmos-tags"
+)
+
+// syncedHost is a host as a node source reports it
+type syncedHost struct {
+	Hostname string
+	IP       string
+	Tags     []string
+	Online   bool
+	LastSeen *time.Time
+	Metadata map[string]interface{}
+}
+
+// nodeSource lists the hosts the node sync upserts as nodes
+type nodeSource interface {
+	name() string
+	configured() bool
+	fetchHosts(ctx context.Context) ([]syncedHost, error)
+}
+
+// getJSON fetches url and decodes its JSON body into out
+func getJSON(ctx context.Context, client *http.Client, url string, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("returned status %d", resp.StatusCode)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+	return nil
+}
+
+type commandCoreSource struct {
+	url        string
+	httpClient *http.Client
+}
+
+func (s *commandCoreSource) name() string     { return "command-core" }
+func (s *commandCoreSource) configured() bool { return s.url != "" }
+
+func (s *commandCoreSource) fetchHosts(ctx context.Context) ([]syncedHost, error) {
+	type CommandCoreHost struct {
+		Hostname string                 `json:"hostname"`
+		IP       string                 `json:"ip"`
+		Tags     []string               `json:"tags"`
+		Online   bool                   `json:"online"`
+		LastSeen time.Time              `json:"last_seen"`
+		Metadata map[string]interface{} `json:"metadata"`
+	}
+
+	var hosts []CommandCoreHost
+	if err := getJSON(ctx, s.httpClient, s.url+"/api/v1/hosts", &hosts); err != nil {
+		return nil, err
+	}
+
+	synced := make([]syncedHost, 0, len(hosts))
+	for _, host := range hosts {
+		synced = append(synced, syncedHost{
+			Hostname: host.Hostname,
+			IP:       host.IP,
+			Tags:     host.Tags,
+			Online:   host.Online,
+			LastSeen: &host.LastSeen,
+			Metadata: host.Metadata,
+		})
+	}
+	return synced, nil
+}
+
+// consulSource reads hosts from the Consul catalog. A node's tags come from
+// its cosmos-tags meta entry, and it is offline while its serfHealth check
+// is critical.
+type consulSource struct {
+	addr       string
+	httpClient *http.Client
+}
+
+func (s *consulSource) name() string     { return "Consul" }
+func (s *consulSource) configured() bool { return s.addr != "" }
+
+// baseURL accepts addresses with or without a scheme, like CONSUL_ADDR
+// values such as consul:8500
+func (s *consulSource) baseURL() string {
+	addr := strings.TrimSuffix(s.addr, "/")
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+	return addr
+}
+
+func (s *consulSource) fetchHosts(ctx context.Context) ([]syncedHost, error) {
+	type consulNode struct {
+		Node       string
+		Address    string
+		Datacenter string
+		Meta       map[string]string
+	}
+	type consulCheck struct {
+		Node    string
+		CheckID string
+	}
+
+	var nodes []consulNode
+	if err := getJSON(ctx, s.httpClient, s.baseURL()+"/v1/catalog/nodes", &nodes); err != nil {
+		return nil, fmt.Errorf("listing catalog nodes: %w", err)
+	}
+
+	var critical []consulCheck
+	if err := getJSON(ctx, s.httpClient, s.baseURL()+"/v1/health/state/critical", &critical); err != nil {
+		return nil, fmt.Errorf("listing critical checks: %w", err)
+	}
+
+	unreachable := make(map[string]bool)
+	for _, check := range critical {
+		if check.CheckID == "serfHealth" {
+			unreachable[check.Node] = true
+		}
+	}
+
+	now := time.Now()
+	synced := make([]syncedHost, 0, len(nodes))
+	for _, node := range nodes {
+		host := syncedHost{
+			Hostname: node.Node,
+			IP:       node.Address,
+			Tags:     consulTags(node.Meta[consulTagsMetaKey]),
+			Online:   !unreachable[node.Node],
+			Metadata: map[string]interface{}{
+				"datacenter": node.Datacenter,
+				"meta":       node.Meta,
+			},
+		}
+		if host.Online {
+			host.LastSeen = &now
+		}
+		synced = append(synced, host)
+	}
+	return synced, nil
+}
+
+// consulTags splits a cosmos-tags meta value into sorted, distinct tags
+func consulTags(value string) []string {
+	tags := []string{}
+	for _, tag := range strings.Split(value, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" && !slices.Contains(tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
+	sort.Strings(tags)
+	return tags
+}
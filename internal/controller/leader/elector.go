@@ -0,0 +1,189 @@
+package leader
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/metorial/fleet/cosmos/internal/controller/database"
+	log "github.com/sirupsen/logrus"
+)
+
+const leaseName = "controller-leader"
+
+// leaseStore is the part of the controller database the elector uses
+type leaseStore interface {
+	AcquireLease(name, holder string, ttl time.Duration) (bool, error)
+	ReleaseLease(name, holder string) error
+	GetLease(name string) (*database.ControllerLease, error)
+}
+
+type ElectorConfig struct {
+	DB            *database.ControllerDB
+	ID            string
+	LeaseDuration time.Duration
+
+	// OnStartedLeading is called when this controller becomes leader. The
+	// context is cancelled when leadership is lost.
+	OnStartedLeading func(ctx context.Context)
+	OnStoppedLeading func()
+}
+
+// Elector holds a lease row in Postgres so that only one controller runs the
+// background jobs and reconcile loops at a time.
+type Elector struct {
+	db               leaseStore
+	id               string
+	leaseDuration    time.Duration
+	onStartedLeading func(ctx context.Context)
+	onStoppedLeading func()
+
+	mu         sync.RWMutex
+	leader     bool
+	leadCancel context.CancelFunc
+
+	// expiresAt is the latest the lease held by this controller can expire,
+	// measured from before the last successful renewal was sent
+	expiresAt time.Time
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func NewElector(config *ElectorConfig) *Elector {
+	leaseDuration := config.LeaseDuration
+	if leaseDuration <= 0 {
+		leaseDuration = 15 * time.Second
+	}
+
+	return newElector(config.DB, config, leaseDuration)
+}
+
+func newElector(db leaseStore, config *ElectorConfig, leaseDuration time.Duration) *Elector {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &Elector{
+		db:               db,
+		id:               config.ID,
+		leaseDuration:    leaseDuration,
+		onStartedLeading: config.OnStartedLeading,
+		onStoppedLeading: config.OnStoppedLeading,
+		ctx:              ctx,
+		cancel:           cancel,
+		done:             make(chan struct{}),
+	}
+}
+
+func (e *Elector) Start() {
+	log.WithFields(log.Fields{
+		"controller_id":  e.id,
+		"lease_duration": e.leaseDuration,
+	}).Info("Starting leader election")
+
+	go e.run()
+}
+
+// Stop steps down and releases the lease so another controller can take over
+// without waiting for it to expire.
+func (e *Elector) Stop() {
+	e.cancel()
+	<-e.done
+
+	if e.IsLeader() {
+		e.stepDown()
+		if err := e.db.ReleaseLease(leaseName, e.id); err != nil {
+			log.WithError(err).Warn("Failed to release leader lease")
+		}
+	}
+}
+
+func (e *Elector) IsLeader() bool {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.leader
+}
+
+// Leader returns the ID of the controller currently holding the lease
+func (e *Elector) Leader() string {
+	lease, err := e.db.GetLease(leaseName)
+	if err != nil || lease.ExpiresAt.Before(time.Now()) {
+		return ""
+	}
+	return lease.Holder
+}
+
+func (e *Elector) ID() string {
+	return e.id
+}
+
+func (e *Elector) run() {
+	defer close(e.done)
+
+	// Renew well within the lease so a slow round trip doesn't lose it
+	ticker := time.NewTicker(e.leaseDuration / 3)
+	defer ticker.Stop()
+
+	e.tryAcquire()
+
+	for {
+		select {
+		case <-e.ctx.Done():
+			return
+		case <-ticker.C:
+			e.tryAcquire()
+		}
+	}
+}
+
+// tryAcquire takes or renews the lease. A failed round trip only costs
+// leadership once the lease it last renewed has run out, since no other
+// controller can take it before then.
+func (e *Elector) tryAcquire() {
+	sent := time.Now()
+	acquired, err := e.db.AcquireLease(leaseName, e.id, e.leaseDuration)
+	if err != nil {
+		log.WithError(err).Warn("Failed to acquire leader lease")
+		acquired = e.IsLeader() && sent.Before(e.expiresAt)
+	} else if acquired {
+		e.expiresAt = sent.Add(e.leaseDuration)
+	}
+
+	switch {
+	case acquired && !e.IsLeader():
+		e.startLeading()
+	case !acquired && e.IsLeader():
+		e.stepDown()
+	}
+}
+
+func (e *Elector) startLeading() {
+	log.WithField("controller_id", e.id).Info("Acquired leadership")
+
+	ctx, cancel := context.WithCancel(e.ctx)
+
+	e.mu.Lock()
+	e.leader = true
+	e.leadCancel = cancel
+	e.mu.Unlock()
+
+	if e.onStartedLeading != nil {
+		e.onStartedLeading(ctx)
+	}
+}
+
+func (e *Elector) stepDown() {
+	log.WithField("controller_id", e.id).Info("No longer leader")
+
+	e.mu.Lock()
+	e.leader = false
+	if e.leadCancel != nil {
+		e.leadCancel()
+		e.leadCancel = nil
+	}
+	e.mu.Unlock()
+
+	if e.onStoppedLeading != nil {
+		e.onStoppedLeading()
+	}
+}
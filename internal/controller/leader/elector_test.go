@@ -0,0 +1,148 @@
+package leader
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/metorial/fleet/cosmos/internal/controller/database"
+)
+
+// fakeLeaseStore answers lease calls with whatever the test last set
+type fakeLeaseStore struct {
+	mu       sync.Mutex
+	acquired bool
+	err      error
+	released bool
+}
+
+func (f *fakeLeaseStore) set(acquired bool, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.acquired, f.err = acquired, err
+}
+
+func (f *fakeLeaseStore) AcquireLease(name, holder string, ttl time.Duration) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return false, f.err
+	}
+	return f.acquired, nil
+}
+
+func (f *fakeLeaseStore) ReleaseLease(name, holder string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.released = true
+	return nil
+}
+
+func (f *fakeLeaseStore) GetLease(name string) (*database.ControllerLease, error) {
+	return nil, errors.New("not implemented")
+}
+
+// newTestElector returns an elector on store that counts how often it
+// started and stopped leading
+func newTestElector(store leaseStore, leaseDuration time.Duration) (*Elector, *int, *int) {
+	var started, stopped int
+	e := newElector(store, &ElectorConfig{
+		ID:               "controller-1",
+		OnStartedLeading: func(context.Context) { started++ },
+		OnStoppedLeading: func() { stopped++ },
+	}, leaseDuration)
+	return e, &started, &stopped
+}
+
+func TestElectorLeadsWhileHoldingLease(t *testing.T) {
+	store := &fakeLeaseStore{}
+	e, started, stopped := newTestElector(store, time.Minute)
+
+	tests := []struct {
+		name     string
+		acquired bool
+		leader   bool
+		started  int
+		stopped  int
+	}{
+		{name: "held by another controller", acquired: false, leader: false},
+		{name: "acquired", acquired: true, leader: true, started: 1},
+		{name: "renewed", acquired: true, leader: true, started: 1},
+		{name: "taken over", acquired: false, leader: false, started: 1, stopped: 1},
+		{name: "reacquired", acquired: true, leader: true, started: 2, stopped: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store.set(tt.acquired, nil)
+			e.tryAcquire()
+
+			if e.IsLeader() != tt.leader {
+				t.Errorf("Expected leader %v, got %v", tt.leader, e.IsLeader())
+			}
+			if *started != tt.started || *stopped != tt.stopped {
+				t.Errorf("Expected %d starts and %d stops, got %d and %d", tt.started, tt.stopped, *started, *stopped)
+			}
+		})
+	}
+}
+
+func TestElectorKeepsLeadingThroughErrorsUntilLeaseExpires(t *testing.T) {
+	store := &fakeLeaseStore{}
+	e, _, stopped := newTestElector(store, 100*time.Millisecond)
+
+	store.set(true, nil)
+	e.tryAcquire()
+
+	// No other controller can take the lease before it expires, so a failed
+	// renewal isn't a reason to step down yet
+	store.set(false, errors.New("connection reset"))
+	e.tryAcquire()
+	if !e.IsLeader() || *stopped != 0 {
+		t.Fatal("Expected to keep leading after a failed renewal within the lease")
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	e.tryAcquire()
+	if e.IsLeader() || *stopped != 1 {
+		t.Fatal("Expected to step down once the lease expired without a renewal")
+	}
+}
+
+func TestElectorErrorWithoutLeaseDoesNotLead(t *testing.T) {
+	store := &fakeLeaseStore{}
+	e, started, _ := newTestElector(store, time.Minute)
+
+	store.set(true, errors.New("connection refused"))
+	e.tryAcquire()
+	if e.IsLeader() || *started != 0 {
+		t.Error("Expected a follower not to lead after a failed acquire")
+	}
+}
+
+func TestElectorStopReleasesLease(t *testing.T) {
+	store := &fakeLeaseStore{acquired: true}
+	e, _, stopped := newTestElector(store, time.Minute)
+
+	e.Start()
+	deadline := time.Now().Add(2 * time.Second)
+	for !e.IsLeader() {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting to acquire leadership")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	e.Stop()
+
+	if e.IsLeader() || *stopped != 1 {
+		t.Error("Expected to step down on stop")
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if !store.released {
+		t.Error("Expected the lease to be released on stop")
+	}
+}
@@ -0,0 +1,288 @@
+package managers
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/metorial/fleet/cosmos/internal/controller/types"
+	log "github.com/sirupsen/logrus"
+)
+
+// kubernetesFieldManager owns the fields cosmos sets through server-side
+// apply
+const kubernetesFieldManager = "cosmos"
+
+// KubernetesManager deploys services to a Kubernetes cluster by applying
+// their manifests through the API server, and deletes the manifests' objects
+// when services are removed
+type KubernetesManager struct {
+	apiServer  string
+	token      string
+	namespace  string
+	httpClient *http.Client
+
+	// resources caches API discovery: group version, then kind
+	resourcesMu sync.Mutex
+	resources   map[string]map[string]kubernetesResource
+}
+
+type KubernetesManagerConfig struct {
+	APIServer string
+	// Token is the bearer token sent with every request
+	Token string
+	// CAPath is a PEM bundle the API server's certificate is verified
+	// against, in addition to the system roots
+	CAPath string
+	// Namespace applies to namespaced objects that don't set their own and
+	// services without a k8s_namespace; "default" if empty
+	Namespace string
+}
+
+// kubernetesResource is how the API serves one kind
+type kubernetesResource struct {
+	name       string
+	namespaced bool
+}
+
+func NewKubernetesManager(config *KubernetesManagerConfig) (*KubernetesManager, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if config.CAPath != "" {
+		pem, err := os.ReadFile(config.CAPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read kubernetes CA: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in kubernetes CA %s", config.CAPath)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+
+	namespace := config.Namespace
+	if namespace == "" {
+		namespace = "default"
+	}
+
+	return &KubernetesManager{
+		apiServer:  strings.TrimSuffix(config.APIServer, "/"),
+		token:      config.Token,
+		namespace:  namespace,
+		httpClient: &http.Client{Transport: transport, Timeout: 30 * time.Second},
+		resources:  make(map[string]map[string]kubernetesResource),
+	}, nil
+}
+
+// Apply creates or updates every object in a service's manifest, in order
+func (km *KubernetesManager) Apply(ctx context.Context, config *types.ComponentConfig) error {
+	if km.apiServer == "" {
+		return fmt.Errorf("kubernetes API server not configured")
+	}
+
+	objects, err := types.ParseK8sManifest(config.K8sManifest)
+	if err != nil {
+		return fmt.Errorf("invalid kubernetes manifest: %w", err)
+	}
+
+	log.WithFields(log.Fields{
+		"component": config.Name,
+		"objects":   len(objects),
+	}).Info("Applying service to Kubernetes")
+
+	for _, object := range objects {
+		path, err := km.objectPath(ctx, object, config.K8sNamespace)
+		if err != nil {
+			return err
+		}
+
+		body, err := json.Marshal(object)
+		if err != nil {
+			return fmt.Errorf("failed to marshal %s: %w", objectName(object), err)
+		}
+
+		query := url.Values{"fieldManager": {kubernetesFieldManager}, "force": {"true"}}
+		status, message, err := km.do(ctx, http.MethodPatch, path, query, "application/apply-patch+yaml", body)
+		if err != nil {
+			return fmt.Errorf("failed to apply %s: %w", objectName(object), err)
+		}
+		if status != http.StatusOK && status != http.StatusCreated {
+			return fmt.Errorf("applying %s: kubernetes returned status %d: %s", objectName(object), status, message)
+		}
+	}
+
+	log.WithField("component", config.Name).Info("Service applied to Kubernetes")
+
+	return nil
+}
+
+// Remove deletes the objects in a service's manifest, in reverse order.
+// Objects that are already gone are skipped.
+func (km *KubernetesManager) Remove(ctx context.Context, componentName, manifest, namespace string) error {
+	if km.apiServer == "" {
+		return fmt.Errorf("kubernetes API server not configured")
+	}
+
+	objects, err := types.ParseK8sManifest(manifest)
+	if err != nil {
+		return fmt.Errorf("invalid kubernetes manifest: %w", err)
+	}
+
+	log.WithField("component", componentName).Info("Removing service from Kubernetes")
+
+	for i := len(objects) - 1; i >= 0; i-- {
+		path, err := km.objectPath(ctx, objects[i], namespace)
+		if err != nil {
+			return err
+		}
+
+		query := url.Values{"propagationPolicy": {"Background"}}
+		status, message, err := km.do(ctx, http.MethodDelete, path, query, "", nil)
+		if err != nil {
+			return fmt.Errorf("failed to delete %s: %w", objectName(objects[i]), err)
+		}
+		if status != http.StatusOK && status != http.StatusAccepted && status != http.StatusNotFound {
+			return fmt.Errorf("deleting %s: kubernetes returned status %d: %s", objectName(objects[i]), status, message)
+		}
+	}
+
+	log.WithField("component", componentName).Info("Service removed from Kubernetes")
+
+	return nil
+}
+
+// objectPath returns the API path of an object, in its own namespace, the
+// service's or the default one
+func (km *KubernetesManager) objectPath(ctx context.Context, object map[string]interface{}, namespace string) (string, error) {
+	apiVersion := object["apiVersion"].(string)
+	kind := object["kind"].(string)
+	metadata := object["metadata"].(map[string]interface{})
+
+	resource, err := km.resource(ctx, apiVersion, kind)
+	if err != nil {
+		return "", err
+	}
+
+	path := "/apis/" + apiVersion
+	if !strings.Contains(apiVersion, "/") {
+		path = "/api/" + apiVersion
+	}
+
+	if resource.namespaced {
+		if own, _ := metadata["namespace"].(string); own != "" {
+			namespace = own
+		}
+		if namespace == "" {
+			namespace = km.namespace
+		}
+		// Applied objects must name the namespace they are sent to
+		metadata["namespace"] = namespace
+		path += "/namespaces/" + url.PathEscape(namespace)
+	}
+
+	return path + "/" + resource.name + "/" + url.PathEscape(metadata["name"].(string)), nil
+}
+
+// resource looks up how the API serves a kind, discovering the group
+// version's resources the first time it is used
+func (km *KubernetesManager) resource(ctx context.Context, apiVersion, kind string) (kubernetesResource, error) {
+	km.resourcesMu.Lock()
+	defer km.resourcesMu.Unlock()
+
+	kinds, ok := km.resources[apiVersion]
+	if !ok {
+		path := "/apis/" + apiVersion
+		if !strings.Contains(apiVersion, "/") {
+			path = "/api/" + apiVersion
+		}
+
+		status, body, err := km.do(ctx, http.MethodGet, path, nil, "", nil)
+		if err != nil {
+			return kubernetesResource{}, fmt.Errorf("failed to discover %s: %w", apiVersion, err)
+		}
+		if status != http.StatusOK {
+			return kubernetesResource{}, fmt.Errorf("discovering %s: kubernetes returned status %d: %s", apiVersion, status, body)
+		}
+
+		var list struct {
+			Resources []struct {
+				Name       string `json:"name"`
+				Kind       string `json:"kind"`
+				Namespaced bool   `json:"namespaced"`
+			} `json:"resources"`
+		}
+		if err := json.Unmarshal([]byte(body), &list); err != nil {
+			return kubernetesResource{}, fmt.Errorf("failed to decode %s discovery: %w", apiVersion, err)
+		}
+
+		kinds = make(map[string]kubernetesResource)
+		for _, r := range list.Resources {
+			// Subresources like deployments/scale share their parent's kind
+			if strings.Contains(r.Name, "/") {
+				continue
+			}
+			kinds[r.Kind] = kubernetesResource{name: r.Name, namespaced: r.Namespaced}
+		}
+		km.resources[apiVersion] = kinds
+	}
+
+	resource, ok := kinds[kind]
+	if !ok {
+		return kubernetesResource{}, fmt.Errorf("kubernetes doesn't serve kind %s in %s", kind, apiVersion)
+	}
+	return resource, nil
+}
+
+// do sends an authenticated request and returns the response status and up
+// to 1MiB of its body
+func (km *KubernetesManager) do(ctx context.Context, method, path string, query url.Values, contentType string, body []byte) (int, string, error) {
+	target := km.apiServer + path
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, target, reader)
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Accept", "application/json")
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if km.token != "" {
+		req.Header.Set("Authorization", "Bearer "+km.token)
+	}
+
+	resp, err := km.httpClient.Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+
+	message, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	return resp.StatusCode, strings.TrimSpace(string(message)), nil
+}
+
+// objectName describes an object in errors, like Deployment web
+func objectName(object map[string]interface{}) string {
+	metadata, _ := object["metadata"].(map[string]interface{})
+	name, _ := metadata["name"].(string)
+	return fmt.Sprintf("%v %s", object["kind"], name)
+}
@@ -0,0 +1,217 @@
+package managers
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/metorial/fleet/cosmos/internal/controller/types"
+)
+
+// fakeKubernetes serves discovery for core v1 and apps/v1 and keeps applied
+// objects by path
+type fakeKubernetes struct {
+	mu      sync.Mutex
+	objects map[string]map[string]interface{}
+	calls   []string
+	auth    []string
+}
+
+func (f *fakeKubernetes) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.auth = append(f.auth, r.Header.Get("Authorization"))
+
+	switch r.URL.Path {
+	case "/api/v1":
+		w.Write([]byte(`{"resources":[
+			{"name":"configmaps","kind":"ConfigMap","namespaced":true},
+			{"name":"namespaces","kind":"Namespace","namespaced":false},
+			{"name":"services","kind":"Service","namespaced":true},
+			{"name":"services/status","kind":"Service","namespaced":true}]}`))
+		return
+	case "/apis/apps/v1":
+		w.Write([]byte(`{"resources":[
+			{"name":"deployments","kind":"Deployment","namespaced":true},
+			{"name":"deployments/scale","kind":"Scale","namespaced":true}]}`))
+		return
+	}
+
+	f.calls = append(f.calls, r.Method+" "+r.URL.Path)
+
+	switch r.Method {
+	case http.MethodPatch:
+		query := r.URL.Query()
+		if r.Header.Get("Content-Type") != "application/apply-patch+yaml" || query.Get("fieldManager") != "cosmos" || query.Get("force") != "true" {
+			http.Error(w, "not a server-side apply", http.StatusUnsupportedMediaType)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		var object map[string]interface{}
+		if err := json.Unmarshal(body, &object); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		_, exists := f.objects[r.URL.Path]
+		f.objects[r.URL.Path] = object
+		if exists {
+			w.WriteHeader(http.StatusOK)
+		} else {
+			w.WriteHeader(http.StatusCreated)
+		}
+		w.Write(body)
+	case http.MethodDelete:
+		if _, exists := f.objects[r.URL.Path]; !exists {
+			http.Error(w, `{"reason":"NotFound"}`, http.StatusNotFound)
+			return
+		}
+		delete(f.objects, r.URL.Path)
+		w.Write([]byte(`{"status":"Success"}`))
+	case http.MethodGet:
+		http.NotFound(w, r)
+	default:
+		http.Error(w, "unexpected request", http.StatusMethodNotAllowed)
+	}
+}
+
+func newTestKubernetesManager(t *testing.T) (*KubernetesManager, *fakeKubernetes) {
+	cluster := &fakeKubernetes{objects: make(map[string]map[string]interface{})}
+	server := httptest.NewServer(cluster)
+	t.Cleanup(server.Close)
+
+	km, err := NewKubernetesManager(&KubernetesManagerConfig{APIServer: server.URL, Token: "secret", Namespace: "apps"})
+	if err != nil {
+		t.Fatalf("Failed to create manager: %v", err)
+	}
+	return km, cluster
+}
+
+const testK8sManifest = `apiVersion: v1
+kind: Namespace
+metadata:
+  name: web
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+spec:
+  replicas: 2
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: web
+  namespace: edge
+`
+
+func TestKubernetesApplyCreatesAndUpdates(t *testing.T) {
+	km, cluster := newTestKubernetesManager(t)
+	config := &types.ComponentConfig{Name: "web", Type: "service", K8sManifest: testK8sManifest}
+
+	for i := 0; i < 2; i++ {
+		if err := km.Apply(context.Background(), config); err != nil {
+			t.Fatalf("Apply %d: %v", i, err)
+		}
+	}
+
+	cluster.mu.Lock()
+	defer cluster.mu.Unlock()
+
+	want := []string{
+		"PATCH /api/v1/namespaces/web",
+		"PATCH /apis/apps/v1/namespaces/apps/deployments/web",
+		"PATCH /api/v1/namespaces/edge/services/web",
+	}
+	if got := strings.Join(cluster.calls, ", "); got != strings.Join(append(want, want...), ", ") {
+		t.Errorf("Expected each object to be applied in order twice, got %s", got)
+	}
+
+	deployment := cluster.objects["/apis/apps/v1/namespaces/apps/deployments/web"]
+	if ns := deployment["metadata"].(map[string]interface{})["namespace"]; ns != "apps" {
+		t.Errorf("Expected the default namespace to be set on the object, got %v", ns)
+	}
+	if replicas := deployment["spec"].(map[string]interface{})["replicas"]; replicas != float64(2) {
+		t.Errorf("Expected the spec to be applied, got %v", deployment["spec"])
+	}
+	for _, auth := range cluster.auth {
+		if auth != "Bearer secret" {
+			t.Fatalf("Expected every request to carry the token, got %q", auth)
+		}
+	}
+}
+
+func TestKubernetesApplyUsesServiceNamespace(t *testing.T) {
+	km, cluster := newTestKubernetesManager(t)
+	config := &types.ComponentConfig{Name: "web", Type: "service", K8sManifest: testK8sManifest, K8sNamespace: "team"}
+
+	if err := km.Apply(context.Background(), config); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+
+	cluster.mu.Lock()
+	defer cluster.mu.Unlock()
+	for _, path := range []string{"/apis/apps/v1/namespaces/team/deployments/web", "/api/v1/namespaces/edge/services/web"} {
+		if _, ok := cluster.objects[path]; !ok {
+			t.Errorf("Expected %s to be applied, got %v", path, cluster.calls)
+		}
+	}
+}
+
+func TestKubernetesRemoveDeletesInReverse(t *testing.T) {
+	km, cluster := newTestKubernetesManager(t)
+	config := &types.ComponentConfig{Name: "web", Type: "service", K8sManifest: testK8sManifest}
+	if err := km.Apply(context.Background(), config); err != nil {
+		t.Fatalf("Apply: %v", err)
+	}
+
+	// Removing twice finds nothing the second time, which isn't an error
+	for i := 0; i < 2; i++ {
+		if err := km.Remove(context.Background(), "web", testK8sManifest, ""); err != nil {
+			t.Fatalf("Remove %d: %v", i, err)
+		}
+	}
+
+	cluster.mu.Lock()
+	defer cluster.mu.Unlock()
+	if len(cluster.objects) != 0 {
+		t.Errorf("Expected every object to be deleted, got %v", cluster.objects)
+	}
+	deletes := cluster.calls[3:6]
+	want := "DELETE /api/v1/namespaces/edge/services/web, DELETE /apis/apps/v1/namespaces/apps/deployments/web, DELETE /api/v1/namespaces/web"
+	if got := strings.Join(deletes, ", "); got != want {
+		t.Errorf("Expected objects to be deleted in reverse order, got %s", got)
+	}
+}
+
+func TestKubernetesApplyErrors(t *testing.T) {
+	km, _ := newTestKubernetesManager(t)
+
+	tests := []struct {
+		manifest string
+		wantErr  string
+	}{
+		{"apiVersion: apps/v1\nkind: StatefulSet\nmetadata:\n  name: db\n", "doesn't serve kind StatefulSet in apps/v1"},
+		{"apiVersion: batch/v1\nkind: Job\nmetadata:\n  name: once\n", "discovering batch/v1: kubernetes returned status 404"},
+		{"kind: ConfigMap\n", "apiVersion, kind and metadata.name are required"},
+	}
+
+	for _, tt := range tests {
+		err := km.Apply(context.Background(), &types.ComponentConfig{Name: "web", K8sManifest: tt.manifest})
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s: expected an error containing %q, got %v", strings.SplitN(tt.manifest, "\n", 2)[0], tt.wantErr, err)
+		}
+	}
+
+	unconfigured, _ := NewKubernetesManager(&KubernetesManagerConfig{})
+	err := unconfigured.Apply(context.Background(), &types.ComponentConfig{Name: "web", K8sManifest: testK8sManifest})
+	if err == nil || err.Error() != "kubernetes API server not configured" {
+		t.Errorf("Expected an unconfigured manager to refuse, got %v", err)
+	}
+}
@@ -2,33 +2,84 @@ package managers
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/metorial/fleet/cosmos/internal/controller/types"
 	log "github.com/sirupsen/logrus"
 )
 
+const (
+	defaultCommandCoreTimeout      = 30 * time.Second
+	defaultCommandCoreRetryBackoff = time.Second
+	maxCommandCoreRetryBackoff     = 30 * time.Second
+)
+
 type ScriptManager struct {
 	commandCoreURL string
 	httpClient     *http.Client
+	maxRetries     int
+	retryBackoff   time.Duration
+}
+
+type ScriptManagerConfig struct {
+	CommandCoreURL string
+	// Timeout bounds each submission attempt
+	Timeout time.Duration
+	// MaxRetries is how many times a submission that failed with a network
+	// error, 429 or 5xx is retried, doubling RetryBackoff between tries
+	MaxRetries   int
+	RetryBackoff time.Duration
 }
 
-func NewScriptManager(commandCoreURL string) *ScriptManager {
+func NewScriptManager(config *ScriptManagerConfig) *ScriptManager {
+	timeout := config.Timeout
+	if timeout <= 0 {
+		timeout = defaultCommandCoreTimeout
+	}
+	retryBackoff := config.RetryBackoff
+	if retryBackoff <= 0 {
+		retryBackoff = defaultCommandCoreRetryBackoff
+	}
+
 	return &ScriptManager{
-		commandCoreURL: commandCoreURL,
-		httpClient:     &http.Client{},
+		commandCoreURL: config.CommandCoreURL,
+		httpClient:     &http.Client{Timeout: timeout},
+		maxRetries:     max(config.MaxRetries, 0),
+		retryBackoff:   retryBackoff,
 	}
 }
 
+// CommandCoreScriptRequest is a script submission. Env and Args are left out
+// when empty, so scripts without them submit exactly as before.
 type CommandCoreScriptRequest struct {
-	Content string   `json:"content"`
-	Targets []string `json:"targets"`
-	Hash    string   `json:"hash"`
+	Content string            `json:"content"`
+	Targets []string          `json:"targets"`
+	Hash    string            `json:"hash"`
+	Env     map[string]string `json:"env,omitempty"`
+	Args    []string          `json:"args,omitempty"`
 }
 
-func (sm *ScriptManager) DeployViaCommandCore(config *types.ComponentConfig, targetNodes []string) error {
+// commandCoreError is a failed submission; retryable ones are worth sending
+// again
+type commandCoreError struct {
+	err       error
+	retryable bool
+}
+
+func (e *commandCoreError) Error() string { return e.err.Error() }
+func (e *commandCoreError) Unwrap() error { return e.err }
+
+// DeployViaCommandCore submits a script to command-core for the target
+// nodes. Submissions carry the script's hash, so command-core treats a
+// resubmission as the same deployment and failed attempts can be retried.
+func (sm *ScriptManager) DeployViaCommandCore(ctx context.Context, config *types.ComponentConfig, targetNodes []string) error {
 	if sm.commandCoreURL == "" {
 		return fmt.Errorf("command-core URL not configured")
 	}
@@ -42,6 +93,8 @@ func (sm *ScriptManager) DeployViaCommandCore(config *types.ComponentConfig, tar
 		Content: config.Content,
 		Targets: targetNodes,
 		Hash:    config.Hash,
+		Env:     config.Env,
+		Args:    config.Args,
 	}
 
 	body, err := json.Marshal(req)
@@ -49,21 +102,65 @@ func (sm *ScriptManager) DeployViaCommandCore(config *types.ComponentConfig, tar
 		return fmt.Errorf("failed to marshal request: %w", err)
 	}
 
-	resp, err := sm.httpClient.Post(
-		fmt.Sprintf("%s/api/v1/scripts", sm.commandCoreURL),
-		"application/json",
-		bytes.NewBuffer(body),
-	)
-	if err != nil {
-		return fmt.Errorf("failed to send request: %w", err)
-	}
-	defer resp.Body.Close()
+	backoff := sm.retryBackoff
+	for attempt := 0; ; attempt++ {
+		err := sm.submit(ctx, body)
+		if err == nil {
+			break
+		}
+
+		var ccErr *commandCoreError
+		if !errors.As(err, &ccErr) || !ccErr.retryable || attempt == sm.maxRetries {
+			if attempt > 0 {
+				return fmt.Errorf("giving up after %d attempts: %w", attempt+1, err)
+			}
+			return err
+		}
 
-	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
-		return fmt.Errorf("command-core returned status %d", resp.StatusCode)
+		log.WithError(err).WithFields(log.Fields{
+			"component":    config.Name,
+			"attempt":      attempt + 1,
+			"max_attempts": sm.maxRetries + 1,
+			"retry_in":     backoff,
+		}).Warn("Failed to submit script to command-core, retrying")
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%w (last error: %v)", ctx.Err(), err)
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, maxCommandCoreRetryBackoff)
 	}
 
 	log.WithField("component", config.Name).Info("Script deployment submitted to command-core")
 
 	return nil
 }
+
+// submit makes one submission attempt
+func (sm *ScriptManager) submit(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sm.commandCoreURL+"/api/v1/scripts", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := sm.httpClient.Do(req)
+	if err != nil {
+		return &commandCoreError{
+			err:       fmt.Errorf("failed to send request: %w", err),
+			retryable: ctx.Err() == nil,
+		}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusCreated {
+		return nil
+	}
+
+	message, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	return &commandCoreError{
+		err:       fmt.Errorf("command-core returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(message))),
+		retryable: resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500,
+	}
+}
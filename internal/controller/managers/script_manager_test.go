@@ -0,0 +1,141 @@
+package managers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/metorial/fleet/cosmos/internal/controller/types"
+)
+
+// newTestScriptManager serves command-core with handler, recording how many
+// submissions it received
+func newTestScriptManager(t *testing.T, config *ScriptManagerConfig, handler func(w http.ResponseWriter, attempt int)) (*ScriptManager, *atomic.Int32) {
+	var attempts atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/api/v1/scripts" {
+			http.NotFound(w, r)
+			return
+		}
+		handler(w, int(attempts.Add(1)))
+	}))
+	t.Cleanup(server.Close)
+
+	config.CommandCoreURL = server.URL
+	config.RetryBackoff = time.Millisecond
+	return NewScriptManager(config), &attempts
+}
+
+var testScript = &types.ComponentConfig{Name: "setup", Type: "script", Content: "echo hi", Hash: "abc"}
+
+func TestDeployViaCommandCoreRetriesTransientFailures(t *testing.T) {
+	sm, attempts := newTestScriptManager(t, &ScriptManagerConfig{MaxRetries: 3}, func(w http.ResponseWriter, attempt int) {
+		if attempt < 3 {
+			http.Error(w, "upstream unavailable", http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	})
+
+	if err := sm.DeployViaCommandCore(context.Background(), testScript, []string{"node-1"}); err != nil {
+		t.Fatalf("Expected the submission to succeed after retries, got %v", err)
+	}
+	if got := attempts.Load(); got != 3 {
+		t.Errorf("Expected 3 attempts, got %d", got)
+	}
+}
+
+func TestDeployViaCommandCoreGivesUpAfterMaxRetries(t *testing.T) {
+	sm, attempts := newTestScriptManager(t, &ScriptManagerConfig{MaxRetries: 2}, func(w http.ResponseWriter, attempt int) {
+		http.Error(w, "upstream unavailable", http.StatusBadGateway)
+	})
+
+	err := sm.DeployViaCommandCore(context.Background(), testScript, []string{"node-1"})
+	if err == nil || !strings.Contains(err.Error(), "giving up after 3 attempts: command-core returned status 502: upstream unavailable") {
+		t.Errorf("Expected the last failure after 3 attempts, got %v", err)
+	}
+	if got := attempts.Load(); got != 3 {
+		t.Errorf("Expected 3 attempts, got %d", got)
+	}
+}
+
+func TestDeployViaCommandCoreDoesNotRetryClientErrors(t *testing.T) {
+	sm, attempts := newTestScriptManager(t, &ScriptManagerConfig{MaxRetries: 3}, func(w http.ResponseWriter, attempt int) {
+		http.Error(w, `{"error":"unknown target node-9"}`, http.StatusBadRequest)
+	})
+
+	err := sm.DeployViaCommandCore(context.Background(), testScript, []string{"node-9"})
+	want := `command-core returned status 400: {"error":"unknown target node-9"}`
+	if err == nil || err.Error() != want {
+		t.Errorf("Expected %q, got %v", want, err)
+	}
+	if got := attempts.Load(); got != 1 {
+		t.Errorf("Expected a single attempt, got %d", got)
+	}
+}
+
+func TestDeployViaCommandCoreTimesOut(t *testing.T) {
+	release := make(chan struct{})
+	sm, attempts := newTestScriptManager(t, &ScriptManagerConfig{Timeout: 50 * time.Millisecond, MaxRetries: 1}, func(w http.ResponseWriter, attempt int) {
+		<-release
+	})
+	// Cleanups run last-registered first, so this releases the handlers
+	// before the server waits for them to finish
+	t.Cleanup(func() { close(release) })
+
+	start := time.Now()
+	err := sm.DeployViaCommandCore(context.Background(), testScript, []string{"node-1"})
+	if err == nil || !strings.Contains(err.Error(), "Client.Timeout exceeded") {
+		t.Errorf("Expected a timeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Expected the submission to time out quickly, took %s", elapsed)
+	}
+	if got := attempts.Load(); got != 2 {
+		t.Errorf("Expected the timed out attempt to be retried once, got %d attempts", got)
+	}
+}
+
+func TestDeployViaCommandCoreSendsEnvAndArgs(t *testing.T) {
+	bodies := make(chan map[string]json.RawMessage, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]json.RawMessage
+		json.NewDecoder(r.Body).Decode(&body)
+		bodies <- body
+		w.WriteHeader(http.StatusCreated)
+	}))
+	t.Cleanup(server.Close)
+	sm := NewScriptManager(&ScriptManagerConfig{CommandCoreURL: server.URL})
+
+	config := *testScript
+	config.Env = map[string]string{"REGION": "eu"}
+	config.Args = []string{"--verbose", "--dry-run"}
+	if err := sm.DeployViaCommandCore(context.Background(), &config, []string{"node-1"}); err != nil {
+		t.Fatalf("Expected the submission to succeed, got %v", err)
+	}
+
+	body := <-bodies
+	if got := string(body["env"]); got != `{"REGION":"eu"}` {
+		t.Errorf("Expected env to be sent, got %s", got)
+	}
+	if got := string(body["args"]); got != `["--verbose","--dry-run"]` {
+		t.Errorf("Expected args to be sent, got %s", got)
+	}
+
+	// Scripts without env or args submit the same body as before
+	if err := sm.DeployViaCommandCore(context.Background(), testScript, []string{"node-1"}); err != nil {
+		t.Fatalf("Expected the submission to succeed, got %v", err)
+	}
+	body = <-bodies
+	if _, ok := body["env"]; ok {
+		t.Errorf("Expected no env field, got %s", body["env"])
+	}
+	if _, ok := body["args"]; ok {
+		t.Errorf("Expected no args field, got %s", body["args"])
+	}
+}
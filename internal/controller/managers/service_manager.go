@@ -2,41 +2,153 @@ package managers
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/metorial/fleet/cosmos/internal/controller/types"
 	log "github.com/sirupsen/logrus"
 )
 
+const (
+	defaultNomadDeployTimeout = 10 * time.Minute
+	defaultNomadPollInterval  = 2 * time.Second
+)
+
 type ServiceManager struct {
-	nomadAddr  string
-	httpClient *http.Client
+	nomadAddr     string
+	namespace     string
+	region        string
+	token         string
+	httpClient    *http.Client
+	deployTimeout time.Duration
+	pollInterval  time.Duration
 }
 
-func NewServiceManager(nomadAddr string) *ServiceManager {
+type ServiceManagerConfig struct {
+	NomadAddr string
+	// Namespace and Region apply to services that don't set their own
+	Namespace string
+	Region    string
+	// Token is the Nomad ACL token sent with every request
+	Token string
+	// DeployTimeout bounds how long Deploy waits for Nomad to place the job
+	// and finish its deployment
+	DeployTimeout time.Duration
+}
+
+func NewServiceManager(config *ServiceManagerConfig) *ServiceManager {
+	deployTimeout := config.DeployTimeout
+	if deployTimeout <= 0 {
+		deployTimeout = defaultNomadDeployTimeout
+	}
+
 	return &ServiceManager{
-		nomadAddr:  nomadAddr,
-		httpClient: &http.Client{},
+		nomadAddr:     config.NomadAddr,
+		namespace:     config.Namespace,
+		region:        config.Region,
+		token:         config.Token,
+		httpClient:    &http.Client{},
+		deployTimeout: deployTimeout,
+		pollInterval:  defaultNomadPollInterval,
+	}
+}
+
+// scope returns the namespace and region query parameters for a service,
+// falling back to the configured defaults
+func (sm *ServiceManager) scope(namespace, region string) url.Values {
+	if namespace == "" {
+		namespace = sm.namespace
+	}
+	if region == "" {
+		region = sm.region
+	}
+
+	query := url.Values{}
+	if namespace != "" {
+		query.Set("namespace", namespace)
+	}
+	if region != "" {
+		query.Set("region", region)
+	}
+	return query
+}
+
+// newRequest builds an authenticated request for a Nomad API path
+func (sm *ServiceManager) newRequest(ctx context.Context, method, path string, scope url.Values, body io.Reader) (*http.Request, error) {
+	target := sm.nomadAddr + path
+	if len(scope) > 0 {
+		target += "?" + scope.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
 	}
+	if sm.token != "" {
+		req.Header.Set("X-Nomad-Token", sm.token)
+	}
+	return req, nil
 }
 
-func (sm *ServiceManager) Deploy(config *types.ComponentConfig) error {
+// nomadEvaluation is the part of a Nomad evaluation Deploy inspects
+type nomadEvaluation struct {
+	Status            string
+	StatusDescription string
+	DeploymentID      string
+	FailedTGAllocs    map[string]json.RawMessage
+	// BlockedEval is the evaluation that places the failed allocations once
+	// the cluster has capacity
+	BlockedEval string
+}
+
+// nomadDeployment is the part of a Nomad deployment Deploy inspects
+type nomadDeployment struct {
+	Status            string
+	StatusDescription string
+}
+
+// Deploy submits a service's job to Nomad and waits until Nomad has placed
+// it and its deployment is successful, returning an error if either fails
+// or DeployTimeout passes first
+func (sm *ServiceManager) Deploy(ctx context.Context, config *types.ComponentConfig) error {
 	if sm.nomadAddr == "" {
 		return fmt.Errorf("nomad address not configured")
 	}
 
 	log.WithField("component", config.Name).Info("Deploying service to Nomad")
 
-	if config.NomadJob == "" {
-		return fmt.Errorf("nomad_job specification is required")
-	}
+	scope := sm.scope(config.NomadNamespace, config.NomadRegion)
 
 	var jobSpec map[string]interface{}
-	if err := json.Unmarshal([]byte(config.NomadJob), &jobSpec); err != nil {
-		return fmt.Errorf("failed to parse nomad job: %w", err)
+	var err error
+	if config.NomadJobIsHCL() {
+		jobSpec, err = sm.parseHCL(ctx, scope, config.NomadJob)
+	} else {
+		jobSpec, err = parseNomadJob(config)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := validateNomadJob(jobSpec); err != nil {
+		return fmt.Errorf("invalid nomad job: %w", err)
+	}
+
+	if namespace := scope.Get("namespace"); namespace != "" {
+		jobSpec["Namespace"] = namespace
+	}
+	if region := scope.Get("region"); region != "" {
+		jobSpec["Region"] = region
 	}
 
 	body, err := json.Marshal(map[string]interface{}{
@@ -46,8 +158,11 @@ func (sm *ServiceManager) Deploy(config *types.ComponentConfig) error {
 		return fmt.Errorf("failed to marshal job: %w", err)
 	}
 
-	url := fmt.Sprintf("%s/v1/jobs", sm.nomadAddr)
-	resp, err := sm.httpClient.Post(url, "application/json", bytes.NewBuffer(body))
+	req, err := sm.newRequest(ctx, http.MethodPost, "/v1/jobs", scope, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp, err := sm.httpClient.Do(req)
 	if err != nil {
 		return fmt.Errorf("failed to submit job: %w", err)
 	}
@@ -58,22 +173,158 @@ func (sm *ServiceManager) Deploy(config *types.ComponentConfig) error {
 		return fmt.Errorf("nomad returned status %d: %s", resp.StatusCode, string(body))
 	}
 
+	var registered struct {
+		EvalID string
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&registered); err != nil {
+		return fmt.Errorf("failed to decode job registration: %w", err)
+	}
+
+	// Periodic and parameterized jobs aren't evaluated until they run
+	if registered.EvalID == "" {
+		log.WithField("component", config.Name).Info("Service registered with Nomad")
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, sm.deployTimeout)
+	defer cancel()
+
+	if err := sm.awaitJob(ctx, scope, registered.EvalID); err != nil {
+		return err
+	}
+
 	log.WithField("component", config.Name).Info("Service deployed to Nomad")
 
 	return nil
 }
 
-func (sm *ServiceManager) Remove(componentName string) error {
+// awaitJob waits for the evaluation of a job submission and the deployment
+// it started, if any
+func (sm *ServiceManager) awaitJob(ctx context.Context, scope url.Values, evalID string) error {
+	eval, err := sm.awaitEvaluation(ctx, scope, evalID)
+	if err != nil {
+		return err
+	}
+	deploymentID := eval.DeploymentID
+
+	// Allocations Nomad has no room for are left to a blocked evaluation,
+	// which places them when capacity frees up; that's waited for like any
+	// other part of the deployment
+	if len(eval.FailedTGAllocs) > 0 && eval.BlockedEval != "" {
+		log.WithFields(log.Fields{
+			"evaluation":  eval.BlockedEval,
+			"task_groups": failedTaskGroups(eval),
+		}).Info("Waiting for Nomad to find capacity for the job")
+
+		if eval, err = sm.awaitEvaluation(ctx, scope, eval.BlockedEval); err != nil {
+			return err
+		}
+		if deploymentID == "" {
+			deploymentID = eval.DeploymentID
+		}
+	}
+	if len(eval.FailedTGAllocs) > 0 {
+		return fmt.Errorf("nomad could not place task groups %s", failedTaskGroups(eval))
+	}
+
+	// Jobs without an update strategy, and unchanged ones, have no deployment
+	if deploymentID == "" {
+		return nil
+	}
+
+	var deployment nomadDeployment
+	err = sm.poll(ctx, "/v1/deployment/"+deploymentID, scope, &deployment, func() bool {
+		return deployment.Status == "successful" || deployment.Status == "failed" || deployment.Status == "cancelled"
+	})
+	if err != nil {
+		return fmt.Errorf("waiting for nomad deployment: %w", err)
+	}
+
+	if deployment.Status != "successful" {
+		return fmt.Errorf("nomad deployment %s: %s", deployment.Status, deployment.StatusDescription)
+	}
+	return nil
+}
+
+// awaitEvaluation waits for an evaluation to finish, through its pending
+// and blocked states, and fails unless it completed
+func (sm *ServiceManager) awaitEvaluation(ctx context.Context, scope url.Values, evalID string) (*nomadEvaluation, error) {
+	var eval nomadEvaluation
+	err := sm.poll(ctx, "/v1/evaluation/"+evalID, scope, &eval, func() bool {
+		return eval.Status == "complete" || eval.Status == "failed" || eval.Status == "canceled"
+	})
+	if err != nil {
+		return nil, fmt.Errorf("waiting for nomad evaluation: %w", err)
+	}
+
+	if eval.Status != "complete" {
+		return nil, fmt.Errorf("nomad evaluation %s: %s", eval.Status, eval.StatusDescription)
+	}
+	return &eval, nil
+}
+
+func failedTaskGroups(eval *nomadEvaluation) string {
+	groups := make([]string, 0, len(eval.FailedTGAllocs))
+	for group := range eval.FailedTGAllocs {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+	return strings.Join(groups, ", ")
+}
+
+// poll fetches path into out until done reports true or ctx ends
+func (sm *ServiceManager) poll(ctx context.Context, path string, scope url.Values, out interface{}, done func() bool) error {
+	ticker := time.NewTicker(sm.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := sm.get(ctx, path, scope, out); err != nil {
+			return err
+		}
+		if done() {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (sm *ServiceManager) get(ctx context.Context, path string, scope url.Values, out interface{}) error {
+	req, err := sm.newRequest(ctx, http.MethodGet, path, scope, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := sm.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("nomad returned status %d: %s", resp.StatusCode, string(body))
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// Remove stops a service's job. An empty namespace or region uses the
+// configured default.
+func (sm *ServiceManager) Remove(componentName, namespace, region string) error {
 	if sm.nomadAddr == "" {
 		return fmt.Errorf("nomad address not configured")
 	}
 
 	log.WithField("component", componentName).Info("Removing service from Nomad")
 
-	url := fmt.Sprintf("%s/v1/job/%s", sm.nomadAddr, componentName)
-	req, err := http.NewRequest(http.MethodDelete, url, nil)
+	req, err := sm.newRequest(context.Background(), http.MethodDelete, "/v1/job/"+url.PathEscape(componentName), sm.scope(namespace, region), nil)
 	if err != nil {
-		return fmt.Errorf("failed to create request: %w", err)
+		return err
 	}
 
 	resp, err := sm.httpClient.Do(req)
@@ -90,3 +341,118 @@ func (sm *ServiceManager) Remove(componentName string) error {
 
 	return nil
 }
+
+// parseNomadJob returns the job spec for a service component. NomadJobData is
+// the canonical form; NomadJob is still accepted for older configurations.
+func parseNomadJob(config *types.ComponentConfig) (map[string]interface{}, error) {
+	var raw []byte
+	switch {
+	case config.NomadJobData != nil && len(*config.NomadJobData) > 0:
+		raw = *config.NomadJobData
+	case config.NomadJob != "":
+		raw = []byte(config.NomadJob)
+	default:
+		return nil, fmt.Errorf("nomad_job specification is required")
+	}
+
+	var jobSpec map[string]interface{}
+	if err := json.Unmarshal(raw, &jobSpec); err != nil {
+		return nil, fmt.Errorf("failed to parse nomad job: %w", err)
+	}
+
+	// Accept specs copied from the Nomad API, which wrap the job in {"Job": ...}
+	if inner, ok := jobSpec["Job"].(map[string]interface{}); ok && len(jobSpec) == 1 {
+		jobSpec = inner
+	}
+
+	return jobSpec, nil
+}
+
+// parseHCL converts an HCL job specification to its JSON form through
+// Nomad's parse endpoint
+func (sm *ServiceManager) parseHCL(ctx context.Context, scope url.Values, hcl string) (map[string]interface{}, error) {
+	body, err := json.Marshal(map[string]interface{}{
+		"JobHCL":       hcl,
+		"Canonicalize": true,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal job: %w", err)
+	}
+
+	req, err := sm.newRequest(ctx, http.MethodPost, "/v1/jobs/parse", scope, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	resp, err := sm.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse HCL job: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("nomad could not parse HCL job (status %d): %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	var jobSpec map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&jobSpec); err != nil {
+		return nil, fmt.Errorf("failed to decode parsed job: %w", err)
+	}
+	return jobSpec, nil
+}
+
+// validateNomadJob checks the parts of the job structure Nomad requires
+// before it will register a job, so bad specs fail before submission.
+func validateNomadJob(jobSpec map[string]interface{}) error {
+	id, _ := jobSpec["ID"].(string)
+	if id == "" {
+		return fmt.Errorf("job ID is required")
+	}
+
+	if jobType, ok := jobSpec["Type"].(string); ok && jobType != "" {
+		switch jobType {
+		case "service", "batch", "system", "sysbatch":
+		default:
+			return fmt.Errorf("unsupported job type: %s", jobType)
+		}
+	}
+
+	groups, ok := jobSpec["TaskGroups"].([]interface{})
+	if !ok || len(groups) == 0 {
+		return fmt.Errorf("job must define at least one task group")
+	}
+
+	for i, g := range groups {
+		group, ok := g.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("task group %d is not an object", i)
+		}
+
+		groupName, _ := group["Name"].(string)
+		if groupName == "" {
+			return fmt.Errorf("task group %d is missing a name", i)
+		}
+
+		tasks, ok := group["Tasks"].([]interface{})
+		if !ok || len(tasks) == 0 {
+			return fmt.Errorf("task group %s must define at least one task", groupName)
+		}
+
+		for j, t := range tasks {
+			task, ok := t.(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("task %d in group %s is not an object", j, groupName)
+			}
+
+			if name, _ := task["Name"].(string); name == "" {
+				return fmt.Errorf("task %d in group %s is missing a name", j, groupName)
+			}
+
+			if driver, _ := task["Driver"].(string); driver == "" {
+				return fmt.Errorf("task %d in group %s is missing a driver", j, groupName)
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,347 @@
+package managers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/metorial/fleet/cosmos/internal/controller/types"
+)
+
+const testNomadJob = `{"ID":"web","Type":"service","TaskGroups":[{"Name":"web","Tasks":[{"Name":"web","Driver":"docker"}]}]}`
+
+// fakeNomad serves a job registration, its evaluation, a blocked evaluation
+// and a deployment; the blocked evaluation and the deployment report each
+// of their statuses in turn, repeating the last one
+type fakeNomad struct {
+	mu                  sync.Mutex
+	evaluation          map[string]interface{}
+	blockedEvalStatuses []string
+	blockedEvalPolls    int
+	deploymentStatuses  []string
+	deploymentPolls     int
+	requests            []*http.Request
+	submittedJob        map[string]interface{}
+	parsedHCL           []string
+}
+
+func (f *fakeNomad) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, r)
+
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/v1/jobs":
+		var body struct{ Job map[string]interface{} }
+		json.NewDecoder(r.Body).Decode(&body)
+		f.submittedJob = body.Job
+		json.NewEncoder(w).Encode(map[string]string{"EvalID": "eval-1"})
+	case r.Method == http.MethodPost && r.URL.Path == "/v1/jobs/parse":
+		var body struct {
+			JobHCL       string
+			Canonicalize bool
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		if !strings.HasPrefix(body.JobHCL, "job ") || !body.Canonicalize {
+			http.Error(w, "1 error occurred: invalid job", http.StatusBadRequest)
+			return
+		}
+		f.parsedHCL = append(f.parsedHCL, body.JobHCL)
+		w.Write([]byte(testNomadJob))
+	case r.Method == http.MethodDelete && r.URL.Path == "/v1/job/web":
+		json.NewEncoder(w).Encode(map[string]string{"EvalID": "eval-2"})
+	case r.URL.Path == "/v1/evaluation/eval-1":
+		json.NewEncoder(w).Encode(f.evaluation)
+	case r.URL.Path == "/v1/evaluation/eval-blocked":
+		status := f.blockedEvalStatuses[min(f.blockedEvalPolls, len(f.blockedEvalStatuses)-1)]
+		f.blockedEvalPolls++
+		json.NewEncoder(w).Encode(map[string]string{"Status": status})
+	case r.URL.Path == "/v1/deployment/deploy-1":
+		status := f.deploymentStatuses[min(f.deploymentPolls, len(f.deploymentStatuses)-1)]
+		f.deploymentPolls++
+		json.NewEncoder(w).Encode(map[string]string{"Status": status, "StatusDescription": "Deployment " + status})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func newTestServiceManager(t *testing.T, nomad *fakeNomad, timeout time.Duration) *ServiceManager {
+	return newScopedTestServiceManager(t, nomad, &ServiceManagerConfig{DeployTimeout: timeout})
+}
+
+func newScopedTestServiceManager(t *testing.T, nomad *fakeNomad, config *ServiceManagerConfig) *ServiceManager {
+	server := httptest.NewServer(nomad)
+	t.Cleanup(server.Close)
+
+	config.NomadAddr = server.URL
+	sm := NewServiceManager(config)
+	sm.pollInterval = 10 * time.Millisecond
+	return sm
+}
+
+func TestDeployWaitsForNomadDeployment(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []string
+		wantErr  string
+	}{
+		{"healthy", []string{"running", "running", "successful"}, ""},
+		{"initializing", []string{"initializing", "pending", "running", "successful"}, ""},
+		{"blocked", []string{"running", "blocked", "unblocking", "successful"}, ""},
+		{"failed", []string{"running", "failed"}, "nomad deployment failed"},
+		{"cancelled", []string{"initializing", "cancelled"}, "nomad deployment cancelled"},
+		{"never finishes initializing", []string{"initializing"}, "waiting for nomad deployment"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nomad := &fakeNomad{
+				evaluation:         map[string]interface{}{"Status": "complete", "DeploymentID": "deploy-1"},
+				deploymentStatuses: tt.statuses,
+			}
+			sm := newTestServiceManager(t, nomad, time.Second)
+
+			err := sm.Deploy(context.Background(), &types.ComponentConfig{Name: "web", NomadJob: testNomadJob})
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("Expected the deployment to succeed, got %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("Expected an error containing %q, got %v", tt.wantErr, err)
+			}
+			nomad.mu.Lock()
+			defer nomad.mu.Unlock()
+			if len(tt.statuses) > 1 && nomad.deploymentPolls != len(tt.statuses) {
+				t.Errorf("Expected %d deployment polls, got %d", len(tt.statuses), nomad.deploymentPolls)
+			}
+		})
+	}
+}
+
+func TestDeployFailsWhenNomadCannotPlaceJob(t *testing.T) {
+	nomad := &fakeNomad{evaluation: map[string]interface{}{
+		"Status":         "complete",
+		"FailedTGAllocs": map[string]interface{}{"web": map[string]interface{}{"NodesExhausted": 3}},
+	}}
+	sm := newTestServiceManager(t, nomad, time.Second)
+
+	err := sm.Deploy(context.Background(), &types.ComponentConfig{Name: "web", NomadJob: testNomadJob})
+	if err == nil || !strings.Contains(err.Error(), "could not place task groups web") {
+		t.Errorf("Expected a placement failure, got %v", err)
+	}
+}
+
+func TestDeployWaitsForBlockedEvaluation(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []string
+		wantErr  string
+	}{
+		{"placed", []string{"blocked", "blocked", "complete"}, ""},
+		{"cancelled", []string{"blocked", "canceled"}, "nomad evaluation canceled"},
+		{"never placed", []string{"blocked"}, "waiting for nomad evaluation"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nomad := &fakeNomad{
+				evaluation: map[string]interface{}{
+					"Status":         "complete",
+					"DeploymentID":   "deploy-1",
+					"BlockedEval":    "eval-blocked",
+					"FailedTGAllocs": map[string]interface{}{"web": map[string]interface{}{"NodesExhausted": 3}},
+				},
+				blockedEvalStatuses: tt.statuses,
+				deploymentStatuses:  []string{"running", "successful"},
+			}
+			sm := newTestServiceManager(t, nomad, 200*time.Millisecond)
+
+			err := sm.Deploy(context.Background(), &types.ComponentConfig{Name: "web", NomadJob: testNomadJob})
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("Expected the deployment to succeed, got %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("Expected an error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestDeployTimesOut(t *testing.T) {
+	nomad := &fakeNomad{
+		evaluation:         map[string]interface{}{"Status": "complete", "DeploymentID": "deploy-1"},
+		deploymentStatuses: []string{"running"},
+	}
+	sm := newTestServiceManager(t, nomad, 100*time.Millisecond)
+
+	err := sm.Deploy(context.Background(), &types.ComponentConfig{Name: "web", NomadJob: testNomadJob})
+	if err == nil || !strings.Contains(err.Error(), "waiting for nomad deployment") {
+		t.Errorf("Expected the deployment to time out, got %v", err)
+	}
+}
+
+func TestRequestsCarryNamespaceRegionAndToken(t *testing.T) {
+	nomad := &fakeNomad{evaluation: map[string]interface{}{"Status": "complete"}}
+	sm := newScopedTestServiceManager(t, nomad, &ServiceManagerConfig{
+		Namespace:     "default-ns",
+		Region:        "us-east",
+		Token:         "secret-token",
+		DeployTimeout: time.Second,
+	})
+
+	config := &types.ComponentConfig{Name: "web", NomadJob: testNomadJob, NomadNamespace: "apps"}
+	if err := sm.Deploy(context.Background(), config); err != nil {
+		t.Fatalf("Failed to deploy: %v", err)
+	}
+	if err := sm.Remove("web", "", ""); err != nil {
+		t.Fatalf("Failed to remove: %v", err)
+	}
+
+	nomad.mu.Lock()
+	defer nomad.mu.Unlock()
+
+	if nomad.submittedJob["Namespace"] != "apps" || nomad.submittedJob["Region"] != "us-east" {
+		t.Errorf("Expected the job to be scoped to apps/us-east, got %v/%v", nomad.submittedJob["Namespace"], nomad.submittedJob["Region"])
+	}
+
+	if len(nomad.requests) != 3 {
+		t.Fatalf("Expected submit, evaluation and remove requests, got %d", len(nomad.requests))
+	}
+	wantNamespaces := []string{"apps", "apps", "default-ns"}
+	for i, req := range nomad.requests {
+		if got := req.Header.Get("X-Nomad-Token"); got != "secret-token" {
+			t.Errorf("%s %s: expected the ACL token, got %q", req.Method, req.URL.Path, got)
+		}
+		if got := req.URL.Query().Get("namespace"); got != wantNamespaces[i] {
+			t.Errorf("%s %s: expected namespace %q, got %q", req.Method, req.URL.Path, wantNamespaces[i], got)
+		}
+		if got := req.URL.Query().Get("region"); got != "us-east" {
+			t.Errorf("%s %s: expected region us-east, got %q", req.Method, req.URL.Path, got)
+		}
+	}
+}
+
+func TestDeployConvertsHCLThroughNomad(t *testing.T) {
+	const hclJob = "job \"web\" {\n  group \"web\" {\n    task \"web\" {\n      driver = \"docker\"\n    }\n  }\n}"
+
+	tests := []struct {
+		name    string
+		config  types.ComponentConfig
+		wantErr string
+	}{
+		{"detected", types.ComponentConfig{Name: "web", NomadJob: hclJob}, ""},
+		{"rejected by nomad", types.ComponentConfig{Name: "web", NomadJob: "# web\n" + hclJob, NomadJobFormat: "hcl"}, "nomad could not parse HCL job (status 400): 1 error occurred"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nomad := &fakeNomad{evaluation: map[string]interface{}{"Status": "complete"}}
+			sm := newTestServiceManager(t, nomad, time.Second)
+
+			err := sm.Deploy(context.Background(), &tt.config)
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("Expected the deployment to succeed, got %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("Expected an error containing %q, got %v", tt.wantErr, err)
+			}
+
+			nomad.mu.Lock()
+			defer nomad.mu.Unlock()
+			if tt.wantErr != "" {
+				if nomad.submittedJob != nil {
+					t.Error("Expected no job to be submitted after a parse failure")
+				}
+				return
+			}
+			if len(nomad.parsedHCL) != 1 || nomad.parsedHCL[0] != hclJob {
+				t.Errorf("Expected the HCL to be parsed once, got %q", nomad.parsedHCL)
+			}
+			if nomad.submittedJob["ID"] != "web" {
+				t.Errorf("Expected the parsed job to be submitted, got %v", nomad.submittedJob)
+			}
+		})
+	}
+}
+
+func TestParseNomadJob(t *testing.T) {
+	data := json.RawMessage(`{"ID":"data"}`)
+	empty := json.RawMessage(``)
+
+	tests := []struct {
+		name      string
+		config    types.ComponentConfig
+		wantID    string
+		wantError string
+	}{
+		{"job data", types.ComponentConfig{NomadJobData: &data}, "data", ""},
+		{"job data wins over the inline spec", types.ComponentConfig{NomadJobData: &data, NomadJob: `{"ID":"inline"}`}, "data", ""},
+		{"inline spec", types.ComponentConfig{NomadJob: `{"ID":"inline"}`}, "inline", ""},
+		{"empty job data falls back to the inline spec", types.ComponentConfig{NomadJobData: &empty, NomadJob: `{"ID":"inline"}`}, "inline", ""},
+		{"wrapped in Job", types.ComponentConfig{NomadJob: `{"Job":{"ID":"wrapped"}}`}, "wrapped", ""},
+		{"missing", types.ComponentConfig{}, "", "nomad_job specification is required"},
+		{"invalid JSON", types.ComponentConfig{NomadJob: `{"ID":`}, "", "failed to parse nomad job"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			jobSpec, err := parseNomadJob(&tt.config)
+			if tt.wantError != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantError) {
+					t.Errorf("Expected an error containing %q, got %v", tt.wantError, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseNomadJob failed: %v", err)
+			}
+			if id, _ := jobSpec["ID"].(string); id != tt.wantID {
+				t.Errorf("Expected job %q, got %v", tt.wantID, jobSpec)
+			}
+		})
+	}
+}
+
+func TestValidateNomadJob(t *testing.T) {
+	tests := []struct {
+		name      string
+		job       string
+		wantError string
+	}{
+		{"valid", testNomadJob, ""},
+		{"type omitted", `{"ID":"web","TaskGroups":[{"Name":"web","Tasks":[{"Name":"web","Driver":"docker"}]}]}`, ""},
+		{"missing ID", `{"TaskGroups":[{"Name":"web","Tasks":[{"Name":"web","Driver":"docker"}]}]}`, "job ID is required"},
+		{"unsupported type", `{"ID":"web","Type":"cron","TaskGroups":[{"Name":"web","Tasks":[{"Name":"web","Driver":"docker"}]}]}`, "unsupported job type: cron"},
+		{"no task groups", `{"ID":"web","TaskGroups":[]}`, "at least one task group"},
+		{"task group not an object", `{"ID":"web","TaskGroups":["web"]}`, "task group 0 is not an object"},
+		{"unnamed task group", `{"ID":"web","TaskGroups":[{"Tasks":[{"Name":"web","Driver":"docker"}]}]}`, "task group 0 is missing a name"},
+		{"no tasks", `{"ID":"web","TaskGroups":[{"Name":"web"}]}`, "task group web must define at least one task"},
+		{"task not an object", `{"ID":"web","TaskGroups":[{"Name":"web","Tasks":[1]}]}`, "task 0 in group web is not an object"},
+		{"unnamed task", `{"ID":"web","TaskGroups":[{"Name":"web","Tasks":[{"Driver":"docker"}]}]}`, "task 0 in group web is missing a name"},
+		{"task without a driver", `{"ID":"web","TaskGroups":[{"Name":"web","Tasks":[{"Name":"web"}]}]}`, "task 0 in group web is missing a driver"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var jobSpec map[string]interface{}
+			if err := json.Unmarshal([]byte(tt.job), &jobSpec); err != nil {
+				t.Fatal(err)
+			}
+
+			err := validateNomadJob(jobSpec)
+			if tt.wantError == "" {
+				if err != nil {
+					t.Errorf("Expected the job to be valid, got %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantError) {
+				t.Errorf("Expected an error containing %q, got %v", tt.wantError, err)
+			}
+		})
+	}
+}
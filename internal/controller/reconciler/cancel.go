@@ -0,0 +1,68 @@
+package reconciler
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrDeploymentCancelled is returned when a deployment was cancelled before
+// it finished processing
+var ErrDeploymentCancelled = errors.New("deployment cancelled")
+
+func (r *Reconciler) trackDeployment(id uuid.UUID, cancel context.CancelFunc) {
+	r.activeMu.Lock()
+	defer r.activeMu.Unlock()
+	r.active[id] = cancel
+}
+
+func (r *Reconciler) untrackDeployment(id uuid.UUID) {
+	r.activeMu.Lock()
+	defer r.activeMu.Unlock()
+	delete(r.active, id)
+}
+
+// CancelDeployment stops a deployment this controller is processing or has
+// queued, returning false if it isn't. Operations already sent to agents
+// are not recalled.
+func (r *Reconciler) CancelDeployment(id uuid.UUID) bool {
+	r.activeMu.Lock()
+	defer r.activeMu.Unlock()
+
+	cancel, ok := r.active[id]
+	if ok {
+		cancel()
+	}
+	return ok
+}
+
+// watchCancellation cancels a running deployment once its status in the
+// database says it was cancelled. Cancelling through another controller's
+// API only updates the row, so this is how the leader processing the
+// deployment finds out. It returns when ctx is done.
+func (r *Reconciler) watchCancellation(ctx context.Context, id uuid.UUID, cancel context.CancelFunc) {
+	ticker := time.NewTicker(r.rolloutPoll)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		deployment, err := r.db.GetDeployment(id)
+		if err != nil {
+			log.WithError(err).WithField("deployment_id", id).Warn("Failed to check deployment status")
+			continue
+		}
+		if deployment.Status == "cancelled" {
+			log.WithField("deployment_id", id).Info("Deployment was cancelled, stopping")
+			cancel()
+			return
+		}
+	}
+}
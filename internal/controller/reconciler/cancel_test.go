@@ -0,0 +1,72 @@
+package reconciler
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/metorial/fleet/cosmos/internal/controller/database"
+	"github.com/metorial/fleet/cosmos/internal/controller/types"
+)
+
+func TestCancelQueuedDeployment(t *testing.T) {
+	r := NewReconciler(&ReconcilerConfig{})
+	id := uuid.New()
+
+	// Another deployment holds the slot, so this one waits its turn
+	r.deploySlot <- struct{}{}
+	defer func() { <-r.deploySlot }()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- r.ProcessDeployment(id, types.ConfigurationRequest{})
+	}()
+
+	deadline := time.Now().Add(time.Second)
+	for !r.CancelDeployment(id) {
+		if time.Now().After(deadline) {
+			t.Fatal("Deployment was never tracked")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrDeploymentCancelled) {
+			t.Errorf("Expected ErrDeploymentCancelled, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Cancelled deployment kept waiting for its turn")
+	}
+
+	if r.CancelDeployment(id) {
+		t.Error("Expected a finished deployment to no longer be cancellable")
+	}
+}
+
+func TestCancelledInDatabaseStopsDeployment(t *testing.T) {
+	r, db := setupTestReconciler(t)
+	r.rolloutPoll = 10 * time.Millisecond
+
+	// Another controller's API cancels by updating the row only
+	deployment := &database.Deployment{ID: uuid.New(), Configuration: []byte("{}"), Status: "running", CreatedAt: time.Now()}
+	if err := db.CreateDeployment(deployment); err != nil {
+		t.Fatalf("Failed to create deployment: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.watchCancellation(ctx, deployment.ID, cancel)
+
+	if cancelled, err := db.CancelDeployment(deployment.ID, "Cancelled via API"); err != nil || !cancelled {
+		t.Fatalf("Failed to cancel deployment: %v", err)
+	}
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("Deployment kept running after it was cancelled in the database")
+	}
+}
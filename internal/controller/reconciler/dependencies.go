@@ -0,0 +1,62 @@
+package reconciler
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/metorial/fleet/cosmos/internal/controller/database"
+	"github.com/metorial/fleet/cosmos/internal/controller/types"
+	log "github.com/sirupsen/logrus"
+)
+
+// awaitDependencies waits until the components config depends on are running
+// on every node this deployment sent them to. Dependencies the deployment
+// doesn't change are already deployed and aren't waited for. It returns why
+// a dependency isn't running, or ctx's error if the deployment is cancelled
+// while waiting.
+func (r *Reconciler) awaitDependencies(ctx context.Context, deploymentID uuid.UUID, config *types.ComponentConfig, deploying map[string]bool, componentErrors map[string]error) error {
+	for _, dependency := range config.DependsOn {
+		if !deploying[dependency] {
+			continue
+		}
+		if err, failed := componentErrors[dependency]; failed {
+			return fmt.Errorf("dependency %s failed: %v", dependency, err)
+		}
+
+		log.WithFields(log.Fields{
+			"deployment_id": deploymentID,
+			"component":     config.Name,
+			"dependency":    dependency,
+		}).Info("Waiting for dependency to be running")
+
+		records, err := r.awaitNodeDeployments(ctx, deploymentID, func(record *database.ComponentDeployment) bool {
+			return record.ComponentName == dependency
+		})
+		if err != nil {
+			return err
+		}
+		for _, record := range records {
+			if record.Status != "running" {
+				return fmt.Errorf("dependency %s is %s on %s", dependency, record.Status, record.NodeHostname)
+			}
+		}
+	}
+	return nil
+}
+
+// skipComponent undoes the stored change of an add or update that won't be
+// sent because a dependency isn't running, so the records match what the
+// nodes run
+func (r *Reconciler) skipComponent(deploymentID uuid.UUID, name string, isNew bool, reason error) {
+	var err error
+	if isNew {
+		err = r.db.DeleteComponent(name)
+	} else {
+		_, err = r.db.RollbackComponent(name)
+	}
+	if err != nil {
+		log.WithError(err).WithField("component", name).Error("Failed to revert skipped component")
+	}
+	r.logDeployment(deploymentID, name, "", "deploy", "skipped", reason.Error())
+}
@@ -0,0 +1,81 @@
+package reconciler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/metorial/fleet/cosmos/internal/controller/database"
+	"github.com/metorial/fleet/cosmos/internal/controller/types"
+)
+
+func TestAwaitDependencies(t *testing.T) {
+	r := &Reconciler{}
+	config := &types.ComponentConfig{Name: "app", DependsOn: []string{"db", "cache"}}
+
+	// Neither dependency is part of this deployment, so both already run
+	if err := r.awaitDependencies(context.Background(), uuid.New(), config, map[string]bool{"app": true}, nil); err != nil {
+		t.Errorf("Expected unchanged dependencies not to be waited for, got %v", err)
+	}
+
+	deploying := map[string]bool{"app": true, "db": true}
+	componentErrors := map[string]error{"db": errors.New("no agents available on target nodes")}
+	err := r.awaitDependencies(context.Background(), uuid.New(), config, deploying, componentErrors)
+	if err == nil || err.Error() != "dependency db failed: no agents available on target nodes" {
+		t.Errorf("Expected the failed dependency to be reported, got %v", err)
+	}
+}
+
+func TestProcessDeploymentSkipsDependentsOfFailedComponents(t *testing.T) {
+	r, db := setupTestReconciler(t)
+
+	prefix := "test-" + uuid.New().String()[:8] + "-"
+	// No node carries this tag, so the agent components fail to deploy
+	tag := prefix + "nowhere"
+	component := func(name, handler string, dependsOn ...string) types.ComponentConfig {
+		for i := range dependsOn {
+			dependsOn[i] = prefix + dependsOn[i]
+		}
+		return types.ComponentConfig{Type: "script", Name: prefix + name, Hash: name, Tags: []string{tag}, Handler: handler, Content: "true", DependsOn: dependsOn}
+	}
+
+	req := types.ConfigurationRequest{Components: []types.ComponentConfig{
+		component("app", "command-core", "db"),
+		component("db", "agent"),
+		component("tool", "command-core"),
+	}}
+	configuration, _ := json.Marshal(req)
+	deployment := &database.Deployment{ID: uuid.New(), Configuration: configuration, Status: "pending", CreatedAt: time.Now()}
+	if err := db.CreateDeployment(deployment); err != nil {
+		t.Fatalf("Failed to create deployment: %v", err)
+	}
+	t.Cleanup(func() {
+		for _, name := range []string{"app", "db", "tool"} {
+			db.DeleteComponent(prefix + name)
+		}
+	})
+
+	if err := r.ProcessDeployment(deployment.ID, req); err != nil {
+		t.Fatalf("Failed to process deployment: %v", err)
+	}
+
+	// The dependent was never sent, so it isn't left recorded as deployed
+	if _, err := db.GetComponent(prefix + "app"); err == nil {
+		t.Error("Expected the dependent of the failed component to be reverted")
+	}
+	if _, err := db.GetComponent(prefix + "tool"); err != nil {
+		t.Errorf("Expected the independent component to be deployed, got %v", err)
+	}
+
+	stored, err := db.GetDeployment(deployment.ID)
+	if err != nil {
+		t.Fatalf("Failed to get deployment: %v", err)
+	}
+	if !strings.Contains(stored.ErrorMessage, "dependency "+prefix+"db failed") {
+		t.Errorf("Expected the skipped dependent in the outcome, got %q", stored.ErrorMessage)
+	}
+}
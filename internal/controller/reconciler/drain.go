@@ -0,0 +1,70 @@
+package reconciler
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/metorial/fleet/cosmos/internal/controller/database"
+	log "github.com/sirupsen/logrus"
+)
+
+// DrainNode removes the agent components from a node that has been marked
+// draining, returning the removal error for each component name (nil on
+// success). Removed components are recorded as drained, which SyncNode
+// deploys again once the node is uncordoned. Other nodes keep running their
+// copies; components aren't placed elsewhere.
+func (r *Reconciler) DrainNode(hostname string) (map[string]error, error) {
+	defer r.takeDeploySlot()()
+
+	records, err := r.db.GetNodeDeployments(hostname)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get node deployments: %w", err)
+	}
+
+	results := make(map[string]error, len(records))
+	for _, record := range records {
+		// Removing records are already on their way off the node
+		if record.Status == "drained" || record.Status == "removing" {
+			continue
+		}
+
+		component, err := r.db.GetComponent(record.ComponentName)
+		if errors.Is(err, database.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			results[record.ComponentName] = fmt.Errorf("failed to get component: %w", err)
+			continue
+		}
+		if component.Handler != "agent" {
+			continue
+		}
+
+		if err := r.grpcServer.SendRemoval(hostname, component.Name); err != nil {
+			log.WithError(err).WithFields(log.Fields{
+				"hostname":  hostname,
+				"component": component.Name,
+			}).Warn("Failed to remove component from draining node")
+			results[component.Name] = err
+			continue
+		}
+
+		now := time.Now()
+		r.db.UpsertComponentDeployment(&database.ComponentDeployment{
+			ComponentName: component.Name,
+			NodeHostname:  hostname,
+			Status:        "drained",
+			Message:       "Removed while the node is draining",
+			LastUpdated:   &now,
+		})
+		results[component.Name] = nil
+	}
+
+	log.WithFields(log.Fields{
+		"hostname":   hostname,
+		"components": len(results),
+	}).Info("Drained node")
+
+	return results, nil
+}
@@ -0,0 +1,69 @@
+package reconciler
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/metorial/fleet/cosmos/internal/controller/database"
+)
+
+func TestSchedulableNodesSkipsDraining(t *testing.T) {
+	nodes := []database.Node{
+		{Hostname: "a", Online: true},
+		{Hostname: "b", Online: true, Draining: true},
+		{Hostname: "c", Online: false},
+	}
+
+	got := schedulableNodes(nodes)
+	if len(got) != 1 || got[0].Hostname != "a" {
+		t.Errorf("Expected only node a to be schedulable, got %v", got)
+	}
+}
+
+func TestDrainedNodeExcludedFromTargeting(t *testing.T) {
+	r, db := setupTestReconciler(t)
+
+	prefix := "test-" + uuid.New().String()[:8] + "-"
+	tag := prefix + "tag"
+	for _, name := range []string{"a", "b"} {
+		if err := db.UpsertNode(&database.Node{Hostname: prefix + name, Tags: []string{tag}, Online: true, HasAgent: true}); err != nil {
+			t.Fatalf("Failed to create node: %v", err)
+		}
+	}
+
+	targets := func() string {
+		t.Helper()
+		nodes, err := r.resolveTargetNodes([]string{tag})
+		if err != nil {
+			t.Fatalf("Failed to resolve nodes: %v", err)
+		}
+		var names []string
+		for _, node := range nodes {
+			names = append(names, node.Hostname[len(prefix):])
+		}
+		return fmt.Sprint(names)
+	}
+
+	if found, err := db.SetNodeDraining(prefix+"b", true); err != nil || !found {
+		t.Fatalf("Failed to drain node: found=%v err=%v", found, err)
+	}
+	if got := targets(); got != "[a]" {
+		t.Errorf("Expected the drained node to be skipped, got %s", got)
+	}
+
+	// The node sync rewrites the whole row and must not undo the drain
+	if err := db.UpsertNode(&database.Node{Hostname: prefix + "b", Tags: []string{tag}, Online: true, HasAgent: true}); err != nil {
+		t.Fatalf("Failed to sync node: %v", err)
+	}
+	if got := targets(); got != "[a]" {
+		t.Errorf("Expected the node to stay drained after a sync, got %s", got)
+	}
+
+	if _, err := db.SetNodeDraining(prefix+"b", false); err != nil {
+		t.Fatalf("Failed to uncordon node: %v", err)
+	}
+	if got := targets(); got != "[a b]" {
+		t.Errorf("Expected the uncordoned node to be targeted again, got %s", got)
+	}
+}
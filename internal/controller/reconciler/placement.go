@@ -0,0 +1,153 @@
+package reconciler
+
+import (
+	"hash/fnv"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/metorial/fleet/cosmos/internal/controller/database"
+	"github.com/metorial/fleet/cosmos/internal/controller/types"
+	log "github.com/sirupsen/logrus"
+)
+
+// placeReplicas narrows the eligible nodes to the component's replica count.
+// Nodes the component is already placed on keep it, so updates go to the
+// same nodes; the rest are chosen by selectReplicas. Without a replica count
+// every node is kept.
+func (r *Reconciler) placeReplicas(config *types.ComponentConfig, handler string, nodes []database.Node) ([]database.Node, error) {
+	if config.Replicas <= 0 {
+		return nodes, nil
+	}
+
+	// Nodes without an agent would be skipped, leaving the component short
+	if handler == "agent" {
+		nodes = slices.DeleteFunc(slices.Clone(nodes), func(node database.Node) bool {
+			return !node.HasAgent
+		})
+	}
+
+	records, err := r.db.GetComponentDeployments(config.Name)
+	if err != nil {
+		return nil, err
+	}
+	placed := make(map[string]bool, len(records))
+	for _, record := range records {
+		placed[record.NodeHostname] = record.Status != "removing"
+	}
+
+	return selectReplicas(config.Name, config.Replicas, nodes, placed), nil
+}
+
+// selectReplicas picks replicas of the nodes, preferring those in placed.
+// The others are ranked by a hash of the component name and the hostname, so
+// the choice doesn't depend on the order of the nodes, and a node joining or
+// leaving moves at most one replica. The chosen nodes are sorted by hostname.
+func selectReplicas(name string, replicas int, nodes []database.Node, placed map[string]bool) []database.Node {
+	ranked := slices.Clone(nodes)
+	sort.Slice(ranked, func(i, j int) bool {
+		a, b := ranked[i].Hostname, ranked[j].Hostname
+		if placed[a] != placed[b] {
+			return placed[a]
+		}
+		if scoreA, scoreB := placementScore(name, a), placementScore(name, b); scoreA != scoreB {
+			return scoreA > scoreB
+		}
+		return a < b
+	})
+
+	chosen := ranked[:min(replicas, len(ranked))]
+	sort.Slice(chosen, func(i, j int) bool {
+		return chosen[i].Hostname < chosen[j].Hostname
+	})
+	return chosen
+}
+
+func placementScore(name, hostname string) uint64 {
+	hash := fnv.New64a()
+	hash.Write([]byte(name))
+	hash.Write([]byte{0})
+	hash.Write([]byte(hostname))
+	return hash.Sum64()
+}
+
+// removeUnplacedReplicas removes each component with a replica count from
+// the nodes it was placed on before that weren't chosen this time, such as
+// when the count went down or a node went offline. A component is only
+// removed once every node of the new placement runs it, so a failed update
+// leaves the old replicas in place.
+func (r *Reconciler) removeUnplacedReplicas(deploymentID uuid.UUID, components []types.ComponentConfig, records []database.ComponentDeployment, componentErrors map[string]error) {
+	for i := range components {
+		config := &components[i]
+		if config.Replicas <= 0 || componentErrors[config.Name] != nil {
+			continue
+		}
+		if handler := config.Handler; handler != "agent" && (handler != "" || r.determineHandler(config) != "agent") {
+			continue
+		}
+
+		placed := 0
+		converged := true
+		for _, record := range records {
+			if record.ComponentName != config.Name {
+				continue
+			}
+			placed++
+			converged = converged && record.Status == "running"
+		}
+		if placed == 0 || !converged {
+			log.WithFields(log.Fields{
+				"deployment_id": deploymentID,
+				"component":     config.Name,
+			}).Info("Keeping replicas outside the placement until every placed node runs the component")
+			continue
+		}
+
+		r.removeUnplaced(deploymentID, config.Name)
+	}
+}
+
+// removeUnplaced sends removals for the component to the nodes whose record
+// the deployment didn't update. The records are kept as removing until the
+// agent confirms, and SyncNode sends the removal again to an agent that
+// didn't get it.
+func (r *Reconciler) removeUnplaced(deploymentID uuid.UUID, name string) {
+	records, err := r.db.GetComponentDeployments(name)
+	if err != nil {
+		log.WithError(err).WithField("component", name).Warn("Failed to get component placement")
+		return
+	}
+
+	var unplaced []string
+	for _, record := range records {
+		if record.DeploymentID == nil || *record.DeploymentID != deploymentID {
+			unplaced = append(unplaced, record.NodeHostname)
+		}
+	}
+	if len(unplaced) == 0 {
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"component": name,
+		"nodes":     strings.Join(unplaced, ", "),
+	}).Info("Removing component from nodes outside its placement")
+
+	now := time.Now()
+	for _, node := range unplaced {
+		r.db.UpdateComponentDeployment(name, node, map[string]interface{}{
+			"status":       "removing",
+			"message":      "Node is no longer among the component's replicas",
+			"last_updated": &now,
+		})
+	}
+
+	if errors := r.grpcServer.BroadcastRemoval(name, unplaced); len(errors) > 0 {
+		log.WithField("errors", len(errors)).Warn("Some removals failed to send, they are sent again when the agents reconnect")
+	}
+	for _, node := range unplaced {
+		r.logDeployment(deploymentID, name, node, "remove", "initiated", "Node is no longer among the component's replicas")
+	}
+}
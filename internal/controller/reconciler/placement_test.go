@@ -0,0 +1,257 @@
+package reconciler
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/metorial/fleet/cosmos/internal/controller/database"
+	grpcserver "github.com/metorial/fleet/cosmos/internal/controller/grpc"
+	"github.com/metorial/fleet/cosmos/internal/controller/types"
+)
+
+func hostnames(nodes []database.Node) []string {
+	names := make([]string, len(nodes))
+	for i, node := range nodes {
+		names[i] = node.Hostname
+	}
+	return names
+}
+
+func workerNodes(count int) []database.Node {
+	nodes := make([]database.Node, count)
+	for i := range nodes {
+		nodes[i] = database.Node{Hostname: fmt.Sprintf("worker-%02d", i), HasAgent: true}
+	}
+	return nodes
+}
+
+func TestSelectReplicasIsStable(t *testing.T) {
+	nodes := workerNodes(10)
+	chosen := hostnames(selectReplicas("app", 3, nodes, nil))
+	if len(chosen) != 3 {
+		t.Fatalf("Expected 3 nodes, got %v", chosen)
+	}
+
+	// The order the nodes are listed in doesn't matter
+	reversed := slices.Clone(nodes)
+	slices.Reverse(reversed)
+	if again := hostnames(selectReplicas("app", 3, reversed, nil)); !slices.Equal(again, chosen) {
+		t.Errorf("Expected the same nodes regardless of order, got %v and %v", chosen, again)
+	}
+
+	// Other components are spread differently
+	spread := false
+	for i := 0; i < 10 && !spread; i++ {
+		spread = !slices.Equal(hostnames(selectReplicas(fmt.Sprintf("other-%d", i), 3, nodes, nil)), chosen)
+	}
+	if !spread {
+		t.Error("Expected other components to be placed on other nodes")
+	}
+
+	// A new node takes at most one replica
+	grown := hostnames(selectReplicas("app", 3, workerNodes(11), nil))
+	moved := 0
+	for _, name := range grown {
+		if !slices.Contains(chosen, name) {
+			moved++
+		}
+	}
+	if moved > 1 {
+		t.Errorf("Expected a new node to move at most one replica, got %v then %v", chosen, grown)
+	}
+}
+
+func TestSelectReplicasKeepsPlacedNodes(t *testing.T) {
+	nodes := workerNodes(10)
+	placed := map[string]bool{"worker-07": true, "worker-02": true, "gone": true}
+
+	chosen := hostnames(selectReplicas("app", 3, nodes, placed))
+	if len(chosen) != 3 || !slices.Contains(chosen, "worker-02") || !slices.Contains(chosen, "worker-07") {
+		t.Errorf("Expected the placed nodes to be kept, got %v", chosen)
+	}
+
+	// Fewer replicas keep some of the placed nodes
+	if chosen := hostnames(selectReplicas("app", 1, nodes, placed)); len(chosen) != 1 || !placed[chosen[0]] {
+		t.Errorf("Expected one of the placed nodes, got %v", chosen)
+	}
+
+	// More replicas than nodes keep every node
+	if chosen := selectReplicas("app", 20, nodes, placed); len(chosen) != len(nodes) {
+		t.Errorf("Expected every node, got %v", hostnames(chosen))
+	}
+}
+
+func TestPlaceReplicasFollowsRecordedPlacement(t *testing.T) {
+	r, db := setupTestReconciler(t)
+
+	name := "test-" + uuid.New().String()[:8] + "-app"
+	config := &types.ComponentConfig{Type: "program", Name: name, Replicas: 2}
+	nodes := workerNodes(6)
+	nodes[0].HasAgent = false
+
+	first, err := r.placeReplicas(config, "agent", nodes)
+	if err != nil {
+		t.Fatalf("Failed to place replicas: %v", err)
+	}
+	if len(first) != 2 || slices.Contains(hostnames(first), nodes[0].Hostname) {
+		t.Fatalf("Expected 2 nodes with agents, got %v", hostnames(first))
+	}
+
+	t.Cleanup(func() {
+		for _, node := range nodes {
+			db.DeleteComponentDeployments(name, node.Hostname)
+		}
+	})
+	for _, node := range first {
+		if err := db.UpsertComponentDeployment(&database.ComponentDeployment{ComponentName: name, NodeHostname: node.Hostname, Status: "running"}); err != nil {
+			t.Fatalf("Failed to record deployment: %v", err)
+		}
+	}
+
+	// A redeploy goes to the same nodes, even with more of them eligible
+	again, err := r.placeReplicas(config, "agent", append(workerNodes(6), workerNodes(20)[6:]...))
+	if err != nil {
+		t.Fatalf("Failed to place replicas: %v", err)
+	}
+	if !slices.Equal(hostnames(again), hostnames(first)) {
+		t.Errorf("Expected the redeploy to keep %v, got %v", hostnames(first), hostnames(again))
+	}
+}
+
+func TestRemoveUnplacedReplicasWaitsForPlacement(t *testing.T) {
+	r, db := setupTestReconciler(t)
+	// No agent is connected, so every removal fails to send
+	r.grpcServer = grpcserver.NewServer(&grpcserver.ServerConfig{DB: db})
+
+	name := "test-" + uuid.New().String()[:8] + "-app"
+	config := types.ComponentConfig{Type: "program", Name: name, Replicas: 1}
+	t.Cleanup(func() {
+		db.DeleteComponentDeployments(name, "worker-new")
+		db.DeleteComponentDeployments(name, "worker-old")
+	})
+
+	previous, deploymentID := uuid.New(), uuid.New()
+	for _, id := range []uuid.UUID{previous, deploymentID} {
+		if err := db.CreateDeployment(&database.Deployment{ID: id, Configuration: []byte("{}"), Status: "completed", CreatedAt: time.Now()}); err != nil {
+			t.Fatalf("Failed to create deployment: %v", err)
+		}
+	}
+
+	record := func(node string, id uuid.UUID, status string) database.ComponentDeployment {
+		t.Helper()
+		deployment := database.ComponentDeployment{ComponentName: name, NodeHostname: node, DeploymentID: &id, Status: status}
+		if err := db.UpsertComponentDeployment(&deployment); err != nil {
+			t.Fatalf("Failed to record deployment: %v", err)
+		}
+		return deployment
+	}
+	statusOn := func(node string) string {
+		t.Helper()
+		deployment, err := db.GetComponentDeployment(name, node)
+		if err != nil {
+			return "deleted"
+		}
+		return deployment.Status
+	}
+
+	record("worker-old", previous, "running")
+
+	tests := []struct {
+		name    string
+		status  string
+		err     error
+		wantOld string
+	}{
+		{name: "still deploying", status: "deploying", wantOld: "running"},
+		{name: "failed on the new node", status: "failed", wantOld: "running"},
+		{name: "component failed", status: "running", err: fmt.Errorf("rollout halted"), wantOld: "running"},
+		// The send fails, but the record waits for the agent to confirm
+		{name: "running on the new node", status: "running", wantOld: "removing"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			records := []database.ComponentDeployment{record("worker-new", deploymentID, tt.status)}
+			errs := map[string]error{}
+			if tt.err != nil {
+				errs[name] = tt.err
+			}
+
+			r.removeUnplacedReplicas(deploymentID, []types.ComponentConfig{config}, records, errs)
+
+			if got := statusOn("worker-old"); got != tt.wantOld {
+				t.Errorf("Expected the old replica to be %s, got %s", tt.wantOld, got)
+			}
+		})
+	}
+
+	// A removing record no longer counts as a placement
+	placed, err := r.placeReplicas(&config, "agent", []database.Node{{Hostname: "worker-old", HasAgent: true}, {Hostname: "worker-new", HasAgent: true}})
+	if err != nil || len(placed) != 1 || placed[0].Hostname != "worker-new" {
+		t.Errorf("Expected the replica to stay on worker-new, got %v (%v)", hostnames(placed), err)
+	}
+
+	if err := db.DeleteRemovedComponentDeployment(name, "worker-old"); err != nil {
+		t.Fatalf("Failed to confirm removal: %v", err)
+	}
+	if got := statusOn("worker-old"); got != "deleted" {
+		t.Errorf("Expected the confirmed removal to delete the record, got %s", got)
+	}
+}
+
+func TestApplyAffinity(t *testing.T) {
+	r, db := setupTestReconciler(t)
+
+	prefix := "test-" + uuid.New().String()[:8] + "-"
+	dbName, cacheName, self := prefix+"db", prefix+"cache", prefix+"app"
+	nodes := workerNodes(4)
+
+	seeded := []database.ComponentDeployment{
+		{ComponentName: dbName, NodeHostname: "worker-00", Status: "running"},
+		{ComponentName: dbName, NodeHostname: "worker-01", Status: "failed"},
+		{ComponentName: cacheName, NodeHostname: "worker-02", Status: "running"},
+		{ComponentName: self, NodeHostname: "worker-03", Status: "running"},
+	}
+	t.Cleanup(func() {
+		for _, dep := range seeded {
+			db.DeleteComponentDeployments(dep.ComponentName, dep.NodeHostname)
+		}
+	})
+	for i := range seeded {
+		if err := db.UpsertComponentDeployment(&seeded[i]); err != nil {
+			t.Fatalf("Failed to record deployment: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name         string
+		affinity     []string
+		antiAffinity []string
+		want         []string
+	}{
+		{name: "no rules", want: hostnames(nodes)},
+		// A failed deployment doesn't count as running there
+		{name: "anti-affinity", antiAffinity: []string{dbName}, want: []string{"worker-01", "worker-02", "worker-03"}},
+		{name: "affinity", affinity: []string{dbName}, want: []string{"worker-00"}},
+		{name: "affinity to either component", affinity: []string{dbName, cacheName}, want: []string{"worker-00", "worker-02"}},
+		{name: "unsatisfiable affinity falls back", affinity: []string{prefix + "missing"}, want: hostnames(nodes)},
+		{name: "affinity after anti-affinity", affinity: []string{cacheName, dbName}, antiAffinity: []string{dbName}, want: []string{"worker-02"}},
+		{name: "rules naming the component itself are ignored", antiAffinity: []string{self}, want: hostnames(nodes)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &types.ComponentConfig{Type: "program", Name: self, Affinity: tt.affinity, AntiAffinity: tt.antiAffinity}
+			got, err := r.applyAffinity(config, nodes)
+			if err != nil {
+				t.Fatalf("Failed to apply affinity: %v", err)
+			}
+			if !slices.Equal(hostnames(got), tt.want) {
+				t.Errorf("Expected %v, got %v", tt.want, hostnames(got))
+			}
+		})
+	}
+}
@@ -0,0 +1,136 @@
+package reconciler
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/metorial/fleet/cosmos/internal/controller/database"
+	"github.com/metorial/fleet/cosmos/internal/controller/types"
+	log "github.com/sirupsen/logrus"
+)
+
+// applyPlan stores the deployment's plan and, in the same transaction, the
+// component records it adds and updates. Removals that involve no node are
+// applied with it; the others wait for their step.
+func (r *Reconciler) applyPlan(deploymentID uuid.UUID, toAdd, toUpdate []types.ComponentConfig, toRemove []database.Component) (*database.DeploymentPlan, error) {
+	plan := &database.DeploymentPlan{}
+	var upserts []*database.Component
+	var deletes []string
+
+	for i := range toUpdate {
+		plan.Update = append(plan.Update, toUpdate[i].Name)
+		upserts = append(upserts, r.componentRecord(deploymentID, &toUpdate[i]))
+	}
+	for i := range toAdd {
+		plan.Add = append(plan.Add, toAdd[i].Name)
+		upserts = append(upserts, r.componentRecord(deploymentID, &toAdd[i]))
+	}
+	for _, comp := range toRemove {
+		plan.Remove = append(plan.Remove, comp.Name)
+		if comp.Handler == "command-core" {
+			deletes = append(deletes, comp.Name)
+		}
+	}
+
+	if err := r.db.ApplyDeploymentPlan(deploymentID, plan, upserts, deletes); err != nil {
+		return nil, fmt.Errorf("failed to apply deployment plan: %w", err)
+	}
+	return plan, nil
+}
+
+// specChanged reports whether deploying config would change the stored
+// component. Settings like env or args can change while the content hash
+// stays the same.
+func (r *Reconciler) specChanged(deploymentID uuid.UUID, current *database.Component, config *types.ComponentConfig) bool {
+	if current.Hash != config.Hash {
+		return true
+	}
+
+	same, err := database.SameSpec(*current, *r.componentRecord(deploymentID, config))
+	if err != nil {
+		log.WithError(err).WithField("component", config.Name).Warn("Failed to compare component versions, updating it")
+		return true
+	}
+	return !same
+}
+
+// startPlanStep records that the deployment is about to act on a component's
+// nodes
+func (r *Reconciler) startPlanStep(deploymentID uuid.UUID, plan *database.DeploymentPlan, name string) {
+	plan.Started = append(plan.Started, name)
+	if err := r.db.MarkPlanStepStarted(deploymentID, name); err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"deployment_id": deploymentID,
+			"component":     name,
+		}).Warn("Failed to record deployment progress")
+	}
+}
+
+// revertNotStarted undoes the stored changes of the adds and updates the
+// deployment never sent, so the records match what the nodes run. It
+// returns every component whose step didn't start.
+func (r *Reconciler) revertNotStarted(deploymentID uuid.UUID, plan *database.DeploymentPlan) []string {
+	for _, name := range plan.NotStarted(plan.Add) {
+		if err := r.db.DeleteComponent(name); err != nil {
+			log.WithError(err).WithField("component", name).Error("Failed to revert unsent component")
+			continue
+		}
+		r.logDeployment(deploymentID, name, "", "deploy", "skipped", "Deployment stopped before the component was sent")
+	}
+
+	for _, name := range plan.NotStarted(plan.Update) {
+		if _, err := r.db.RollbackComponent(name); err != nil {
+			log.WithError(err).WithField("component", name).Error("Failed to revert unsent component")
+			continue
+		}
+		r.logDeployment(deploymentID, name, "", "deploy", "skipped", "Deployment stopped before the update was sent")
+	}
+
+	var pending []string
+	for _, names := range [][]string{plan.Remove, plan.Update, plan.Add} {
+		pending = append(pending, plan.NotStarted(names)...)
+	}
+	slices.Sort(pending)
+	return pending
+}
+
+// RecoverInterruptedDeployments fails the deployments that were left running
+// with a plan by a controller that stopped, reverting the changes they
+// stored but never sent. Deployments this controller is processing are left
+// alone.
+func (r *Reconciler) RecoverInterruptedDeployments() {
+	deployments, err := r.db.ListInterruptedDeployments()
+	if err != nil {
+		log.WithError(err).Warn("Failed to list interrupted deployments")
+		return
+	}
+
+	for _, deployment := range deployments {
+		r.activeMu.Lock()
+		_, active := r.active[deployment.ID]
+		r.activeMu.Unlock()
+		if active {
+			continue
+		}
+
+		var plan database.DeploymentPlan
+		if err := json.Unmarshal(deployment.Plan, &plan); err != nil {
+			log.WithError(err).WithField("deployment_id", deployment.ID).Error("Invalid deployment plan")
+			continue
+		}
+
+		message := "Interrupted before it finished"
+		if pending := r.revertNotStarted(deployment.ID, &plan); len(pending) > 0 {
+			message += "; not started: " + strings.Join(pending, ", ")
+		}
+
+		log.WithFields(log.Fields{
+			"deployment_id": deployment.ID,
+			"message":       message,
+		}).Warn("Recovered interrupted deployment")
+		r.db.UpdateDeploymentStatus(deployment.ID, "failed", message)
+	}
+}
@@ -0,0 +1,110 @@
+package reconciler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/metorial/fleet/cosmos/internal/controller/database"
+	"github.com/metorial/fleet/cosmos/internal/controller/types"
+)
+
+func TestRecoverInterruptedDeployment(t *testing.T) {
+	r, db := setupTestReconciler(t)
+
+	prefix := "test-" + uuid.New().String()[:8] + "-"
+	component := func(name, hash string) *database.Component {
+		return &database.Component{Name: prefix + name, Type: "script", Handler: "agent", Hash: hash, Content: "true"}
+	}
+	t.Cleanup(func() {
+		for _, name := range []string{"updated", "sent", "unsent"} {
+			db.DeleteComponent(prefix + name)
+		}
+	})
+
+	if err := db.UpsertComponent(component("updated", "v1")); err != nil {
+		t.Fatalf("Failed to create component: %v", err)
+	}
+
+	deployment := &database.Deployment{ID: uuid.New(), Configuration: []byte("{}"), Status: "running", CreatedAt: time.Now()}
+	if err := db.CreateDeployment(deployment); err != nil {
+		t.Fatalf("Failed to create deployment: %v", err)
+	}
+
+	// The controller stored the plan, sent one new component and stopped
+	plan := &database.DeploymentPlan{Update: []string{prefix + "updated"}, Add: []string{prefix + "sent", prefix + "unsent"}}
+	upserts := []*database.Component{component("updated", "v2"), component("sent", "v1"), component("unsent", "v1")}
+	if err := db.ApplyDeploymentPlan(deployment.ID, plan, upserts, nil); err != nil {
+		t.Fatalf("Failed to apply plan: %v", err)
+	}
+	if err := db.MarkPlanStepStarted(deployment.ID, prefix+"sent"); err != nil {
+		t.Fatalf("Failed to mark step started: %v", err)
+	}
+
+	r.RecoverInterruptedDeployments()
+
+	updated, err := db.GetComponent(prefix + "updated")
+	if err != nil || updated.Hash != "v1" {
+		t.Errorf("Expected the unsent update to be reverted to v1, got %v (%v)", updated, err)
+	}
+	if _, err := db.GetComponent(prefix + "sent"); err != nil {
+		t.Errorf("Expected the sent component to be kept, got %v", err)
+	}
+	if _, err := db.GetComponent(prefix + "unsent"); err == nil {
+		t.Error("Expected the unsent component to be removed")
+	}
+
+	stored, err := db.GetDeployment(deployment.ID)
+	if err != nil {
+		t.Fatalf("Failed to get deployment: %v", err)
+	}
+	if stored.Status != "failed" {
+		t.Errorf("Expected the deployment to be failed, got %s", stored.Status)
+	}
+	want := "Interrupted before it finished; not started: " + prefix + "unsent, " + prefix + "updated"
+	if stored.ErrorMessage != want {
+		t.Errorf("Expected message %q, got %q", want, stored.ErrorMessage)
+	}
+}
+
+func TestSpecChanged(t *testing.T) {
+	r, db := setupTestReconciler(t)
+
+	name := "test-" + uuid.New().String()[:8]
+	t.Cleanup(func() { db.DeleteComponent(name) })
+
+	base := func(modify func(c *types.ComponentConfig)) *types.ComponentConfig {
+		config := &types.ComponentConfig{Type: "program", Name: name, Hash: "v1", ContentURL: "https://example.com/app.tar.gz",
+			Env: map[string]string{"A": "1", "B": "2"}, Args: []string{"--port", "8080"}}
+		modify(config)
+		return config
+	}
+
+	if err := db.UpsertComponent(r.componentRecord(uuid.New(), base(func(c *types.ComponentConfig) {}))); err != nil {
+		t.Fatalf("Failed to store component: %v", err)
+	}
+	stored, err := db.GetComponent(name)
+	if err != nil {
+		t.Fatalf("Failed to get component: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		modify  func(c *types.ComponentConfig)
+		changed bool
+	}{
+		{"redeploy", func(c *types.ComponentConfig) {}, false},
+		{"hash", func(c *types.ComponentConfig) { c.Hash = "v2" }, true},
+		{"env", func(c *types.ComponentConfig) { c.Env["B"] = "3" }, true},
+		{"args", func(c *types.ComponentConfig) { c.Args = nil }, true},
+		{"memory limit", func(c *types.ComponentConfig) { c.MemoryLimit = 1 << 30 }, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if changed := r.specChanged(uuid.New(), stored, base(tt.modify)); changed != tt.changed {
+				t.Errorf("Expected specChanged to be %v", tt.changed)
+			}
+		})
+	}
+}
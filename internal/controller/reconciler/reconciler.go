@@ -1,11 +1,18 @@
 package reconciler
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/metorial/fleet/cosmos/internal/controller/database"
+	"github.com/metorial/fleet/cosmos/internal/controller/events"
 	grpcserver "github.com/metorial/fleet/cosmos/internal/controller/grpc"
 	"github.com/metorial/fleet/cosmos/internal/controller/managers"
 	"github.com/metorial/fleet/cosmos/internal/controller/types"
@@ -13,36 +20,143 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+// ErrDeploymentClaimed is returned when a deployment was already picked up by
+// another worker
+var ErrDeploymentClaimed = errors.New("deployment already claimed")
+
 type Reconciler struct {
 	db         *database.ControllerDB
 	grpcServer *grpcserver.Server
+	events     *events.Bus
 	scriptMgr  *managers.ScriptManager
 	programMgr *managers.ProgramManager
 	serviceMgr *managers.ServiceManager
+	k8sMgr     *managers.KubernetesManager
+
+	defaultHealthCheck      *types.HealthCheckConfig
+	defaultHealthCheckTypes map[string]bool
+
+	deploymentTimeout time.Duration
+	rolloutPoll       time.Duration
+
+	// deploySlot serializes deployments so each plan is computed against the
+	// components the previous one left. Blocked channel sends are served in
+	// arrival order, which keeps overlapping deployments in the order they
+	// were submitted. Removals, redeploys, drains and node resyncs outside of
+	// a deployment take it too, so they can't interleave with a plan being
+	// applied.
+	deploySlot chan struct{}
+
+	activeMu   sync.Mutex
+	active     map[uuid.UUID]context.CancelFunc
+	requestIDs map[uuid.UUID]string
 }
 
 type ReconcilerConfig struct {
 	DB         *database.ControllerDB
 	GRPCServer *grpcserver.Server
+	// Events receives the deployment logs and node statuses the reconciler
+	// writes
+	Events     *events.Bus
 	ScriptMgr  *managers.ScriptManager
 	ProgramMgr *managers.ProgramManager
 	ServiceMgr *managers.ServiceManager
+	K8sMgr     *managers.KubernetesManager
+
+	// DefaultHealthCheck is applied to managed components of the
+	// DefaultHealthCheckTypes component types that don't define their own
+	DefaultHealthCheck      *types.HealthCheckConfig
+	DefaultHealthCheckTypes []string
+
+	// DeploymentTimeout bounds how long a deployment waits for agents to
+	// confirm it before unconfirmed nodes count as failed
+	DeploymentTimeout time.Duration
 }
 
 func NewReconciler(config *ReconcilerConfig) *Reconciler {
+	deploymentTimeout := config.DeploymentTimeout
+	if deploymentTimeout == 0 {
+		deploymentTimeout = defaultDeploymentTimeout
+	}
+
 	return &Reconciler{
 		db:         config.DB,
 		grpcServer: config.GRPCServer,
+		events:     config.Events,
 		scriptMgr:  config.ScriptMgr,
 		programMgr: config.ProgramMgr,
 		serviceMgr: config.ServiceMgr,
+		k8sMgr:     config.K8sMgr,
+
+		defaultHealthCheck:      config.DefaultHealthCheck,
+		defaultHealthCheckTypes: toSet(config.DefaultHealthCheckTypes),
+
+		deploymentTimeout: deploymentTimeout,
+		rolloutPoll:       defaultRolloutPoll,
+		deploySlot:        make(chan struct{}, 1),
+		active:            make(map[uuid.UUID]context.CancelFunc),
+		requestIDs:        make(map[uuid.UUID]string),
+	}
+}
+
+func toSet(items []string) map[string]bool {
+	set := make(map[string]bool, len(items))
+	for _, item := range items {
+		set[item] = true
 	}
+	return set
 }
 
+// healthCheckFor returns the component's own health check, or the configured
+// default if the component is eligible for one
+func (r *Reconciler) healthCheckFor(config *types.ComponentConfig) *types.HealthCheckConfig {
+	if config.HealthCheck != nil {
+		return config.HealthCheck
+	}
+
+	if r.defaultHealthCheck == nil || !config.Managed || !r.defaultHealthCheckTypes[config.Type] {
+		return nil
+	}
+
+	return r.defaultHealthCheck
+}
+
+// ProcessDeployment applies a deployment and waits for the agents to confirm
+// it, then records whether it completed, failed or partially failed. Updates
+// that don't come up healthy are rolled back to the version they replaced,
+// which marks the deployment rolled_back. A returned error means the
+// deployment couldn't be processed at all. Deployments are processed one at
+// a time; a deployment stays pending while it waits for its turn. A
+// cancelled deployment stops before sending anything more to the nodes and
+// returns ErrDeploymentCancelled.
 func (r *Reconciler) ProcessDeployment(deploymentID uuid.UUID, config types.ConfigurationRequest) error {
-	log.WithField("deployment_id", deploymentID).Info("Processing deployment")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r.trackDeployment(deploymentID, cancel)
+	defer r.untrackDeployment(deploymentID)
+
+	select {
+	case r.deploySlot <- struct{}{}:
+	case <-ctx.Done():
+		return ErrDeploymentCancelled
+	}
+	defer func() { <-r.deploySlot }()
 
-	r.db.UpdateDeploymentStatus(deploymentID, "running", "")
+	claimed, err := r.db.ClaimDeployment(deploymentID)
+	if err != nil {
+		return fmt.Errorf("failed to claim deployment: %w", err)
+	}
+	if !claimed {
+		return ErrDeploymentClaimed
+	}
+	defer r.trackRequestID(deploymentID)()
+	go r.watchCancellation(ctx, deploymentID, cancel)
+
+	log.WithFields(log.Fields{
+		"deployment_id": deploymentID,
+		"request_id":    r.requestID(deploymentID),
+	}).Info("Processing deployment")
+	startedAt := time.Now()
 
 	currentComponents, err := r.db.ListComponents()
 	if err != nil {
@@ -65,7 +179,7 @@ func (r *Reconciler) ProcessDeployment(deploymentID uuid.UUID, config types.Conf
 
 	for name, newComp := range newMap {
 		if curr, exists := currentMap[name]; exists {
-			if curr.Hash != newComp.Hash {
+			if r.specChanged(deploymentID, curr, newComp) {
 				toUpdate = append(toUpdate, *newComp)
 			}
 		} else {
@@ -86,31 +200,321 @@ func (r *Reconciler) ProcessDeployment(deploymentID uuid.UUID, config types.Conf
 		"to_remove":     len(toRemove),
 	}).Info("Deployment plan calculated")
 
+	for _, list := range [][]types.ComponentConfig{toUpdate, toAdd} {
+		for i := range list {
+			if list[i].Rollout == nil {
+				list[i].Rollout = config.Rollout
+			}
+		}
+	}
+
+	// Updates and adds go out in dependency order, updates first otherwise
+	toDeploy := slices.Concat(toUpdate, toAdd)
+	order, cycle := types.DependencyOrder(toDeploy)
+	if cycle != nil {
+		return fmt.Errorf("dependency cycle: %s", strings.Join(cycle, " -> "))
+	}
+	isNew := make(map[string]bool, len(toAdd))
+	for _, comp := range toAdd {
+		isNew[comp.Name] = true
+	}
+	deploying := make(map[string]bool, len(toDeploy))
+	for _, comp := range toDeploy {
+		deploying[comp.Name] = true
+	}
+
+	plan, err := r.applyPlan(deploymentID, toAdd, toUpdate, toRemove)
+	if err != nil {
+		return err
+	}
+
 	for _, comp := range toRemove {
+		if ctx.Err() != nil {
+			break
+		}
+		// Components without a node step were deleted with the plan
+		if slices.Contains(plan.Started, comp.Name) {
+			continue
+		}
+		r.startPlanStep(deploymentID, plan, comp.Name)
 		if err := r.removeComponent(deploymentID, &comp); err != nil {
 			log.WithError(err).WithField("component", comp.Name).Error("Failed to remove component")
 			r.logDeployment(deploymentID, comp.Name, "", "remove", "failure", err.Error())
 		}
 	}
 
-	for _, comp := range toUpdate {
-		if err := r.deployComponent(deploymentID, &comp, false); err != nil {
-			log.WithError(err).WithField("component", comp.Name).Error("Failed to update component")
+	componentErrors := make(map[string]error)
+
+	for _, i := range order {
+		comp := toDeploy[i]
+		if ctx.Err() != nil {
+			break
+		}
+
+		if err := r.awaitDependencies(ctx, deploymentID, &comp, deploying, componentErrors); err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			log.WithError(err).WithField("component", comp.Name).Error("Component dependency not running")
+			r.startPlanStep(deploymentID, plan, comp.Name)
+			r.skipComponent(deploymentID, comp.Name, isNew[comp.Name], err)
+			componentErrors[comp.Name] = err
+			continue
+		}
+
+		r.startPlanStep(deploymentID, plan, comp.Name)
+		if err := r.deployComponent(ctx, deploymentID, &comp, isNew[comp.Name]); err != nil {
+			if isNew[comp.Name] {
+				log.WithError(err).WithField("component", comp.Name).Error("Failed to add component")
+			} else {
+				log.WithError(err).WithField("component", comp.Name).Error("Failed to update component")
+			}
+			componentErrors[comp.Name] = err
+		}
+	}
+
+	records, err := r.awaitNodeDeployments(ctx, deploymentID, nil)
+	if ctx.Err() != nil {
+		log.WithField("deployment_id", deploymentID).Info("Deployment cancelled")
+		r.revertNotStarted(deploymentID, plan)
+		return ErrDeploymentCancelled
+	}
+	if err != nil {
+		r.db.UpdateDeploymentStatus(deploymentID, "failed", err.Error())
+		return err
+	}
+
+	status, message := deploymentOutcome(records, componentErrors)
+	for _, err := range componentErrors {
+		if errors.Is(err, errRolloutHalted) {
+			status = "failed"
 		}
 	}
 
-	for _, comp := range toAdd {
-		if err := r.deployComponent(deploymentID, &comp, true); err != nil {
-			log.WithError(err).WithField("component", comp.Name).Error("Failed to add component")
+	r.removeUnplacedReplicas(deploymentID, toDeploy, records, componentErrors)
+
+	if failed := r.failedUpdates(toUpdate, records, componentErrors, startedAt); len(failed) > 0 {
+		if rolledBack := r.rollBack(ctx, deploymentID, failed); len(rolledBack) > 0 {
+			summary := "Rolled back " + strings.Join(rolledBack, ", ")
+			if message != "" {
+				summary += ": " + message
+			}
+			status, message = "rolled_back", summary
 		}
 	}
 
-	log.WithField("deployment_id", deploymentID).Info("Deployment processing completed")
+	r.db.UpdateDeploymentStatus(deploymentID, status, message)
+
+	log.WithFields(log.Fields{
+		"deployment_id": deploymentID,
+		"status":        status,
+		"message":       message,
+	}).Info("Deployment processing completed")
 
 	return nil
 }
 
-func (r *Reconciler) deployComponent(deploymentID uuid.UUID, config *types.ComponentConfig, isNew bool) error {
+// RunPendingDeployments processes deployments queued while no leader was
+// processing them (for example ones accepted by a follower controller) until
+// ctx is cancelled.
+func (r *Reconciler) RunPendingDeployments(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		r.processPendingDeployments()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (r *Reconciler) processPendingDeployments() {
+	deployments, err := r.db.ListPendingDeployments()
+	if err != nil {
+		log.WithError(err).Warn("Failed to list pending deployments")
+		return
+	}
+
+	for _, deployment := range deployments {
+		var config types.ConfigurationRequest
+		if err := json.Unmarshal(deployment.Configuration, &config); err != nil {
+			log.WithError(err).WithField("deployment_id", deployment.ID).Error("Invalid pending deployment configuration")
+			r.db.UpdateDeploymentStatus(deployment.ID, "failed", fmt.Sprintf("invalid configuration: %v", err))
+			continue
+		}
+
+		err := r.ProcessDeployment(deployment.ID, config)
+		switch {
+		case errors.Is(err, ErrDeploymentClaimed), errors.Is(err, ErrDeploymentCancelled):
+			continue
+		case err != nil:
+			log.WithError(err).WithField("deployment_id", deployment.ID).Error("Deployment failed")
+			r.db.UpdateDeploymentStatus(deployment.ID, "failed", err.Error())
+		}
+	}
+}
+
+// takeDeploySlot waits for the deployment in progress, if any, and holds
+// off the next one until the returned function is called
+func (r *Reconciler) takeDeploySlot() func() {
+	r.deploySlot <- struct{}{}
+	return func() { <-r.deploySlot }
+}
+
+// RemoveComponents removes components outside of a full deployment, returning
+// the removal error for each component name (nil on success)
+func (r *Reconciler) RemoveComponents(deploymentID uuid.UUID, components []database.Component) map[string]error {
+	defer r.takeDeploySlot()()
+
+	log.WithFields(log.Fields{
+		"deployment_id": deploymentID,
+		"count":         len(components),
+	}).Info("Removing components")
+
+	defer r.trackRequestID(deploymentID)()
+
+	r.db.UpdateDeploymentStatus(deploymentID, "running", "")
+
+	results := make(map[string]error, len(components))
+	failed := 0
+
+	for i := range components {
+		comp := &components[i]
+		err := r.removeComponent(deploymentID, comp)
+		if err != nil {
+			log.WithError(err).WithField("component", comp.Name).Error("Failed to remove component")
+			r.logDeployment(deploymentID, comp.Name, "", "remove", "failure", err.Error())
+			failed++
+		}
+		results[comp.Name] = err
+	}
+
+	if failed > 0 {
+		r.db.UpdateDeploymentStatus(deploymentID, "failed", fmt.Sprintf("%d of %d removals failed", failed, len(components)))
+	} else {
+		r.db.UpdateDeploymentStatus(deploymentID, "completed", "")
+	}
+
+	return results
+}
+
+// RedeployToNode re-sends a stored agent component to a single node, e.g.
+// after an operator cleared a stuck deployment record
+func (r *Reconciler) RedeployToNode(deploymentID uuid.UUID, component *database.Component, hostname string) error {
+	if component.Handler != "agent" {
+		return fmt.Errorf("component %s uses the %s handler and can't be redeployed to a node", component.Name, component.Handler)
+	}
+
+	node, err := r.db.GetNode(hostname)
+	if err != nil {
+		return fmt.Errorf("failed to get node %s: %w", hostname, err)
+	}
+
+	config, err := componentConfigFromRecord(component)
+	if err != nil {
+		return err
+	}
+
+	defer r.takeDeploySlot()()
+
+	r.db.UpdateDeploymentStatus(deploymentID, "running", "")
+	defer r.trackRequestID(deploymentID)()
+
+	if err := r.deployViaAgent(context.Background(), deploymentID, config, []database.Node{*node}); err != nil {
+		r.db.UpdateDeploymentStatus(deploymentID, "failed", err.Error())
+		return err
+	}
+
+	r.db.UpdateDeploymentStatus(deploymentID, "completed", "")
+	return nil
+}
+
+// componentConfigFromRecord rebuilds the deployment config of a stored component
+func componentConfigFromRecord(component *database.Component) (*types.ComponentConfig, error) {
+	config := &types.ComponentConfig{
+		Type:               component.Type,
+		Name:               component.Name,
+		Hash:               component.Hash,
+		Tags:               component.Tags,
+		Handler:            component.Handler,
+		Content:            component.Content,
+		ContentURL:         component.ContentURL,
+		ContentURLEncoding: component.ContentURLEncoding,
+		Entrypoint:         component.Entrypoint,
+		SignatureURL:       component.SignatureURL,
+		PublicKey:          component.PublicKey,
+		NomadJob:           component.NomadJob,
+		NomadJobFormat:     component.NomadJobFormat,
+		NomadNamespace:     component.NomadNamespace,
+		NomadRegion:        component.NomadRegion,
+		K8sManifest:        component.K8sManifest,
+		K8sNamespace:       component.K8sNamespace,
+		Managed:            component.Managed,
+		MemoryLimit:        component.MemoryLimit,
+		CPULimit:           component.CPULimit,
+		MaxOpenFiles:       component.MaxOpenFiles,
+		RunAsUser:          component.RunAsUser,
+		RunAsGroup:         component.RunAsGroup,
+		WorkingDir:         component.WorkingDir,
+		Args:               component.Args,
+		Affinity:           component.Affinity,
+		AntiAffinity:       component.AntiAffinity,
+		DependsOn:          component.DependsOn,
+		Replicas:           component.Replicas,
+	}
+
+	if len(component.HealthCheck) > 0 {
+		if err := json.Unmarshal(component.HealthCheck, &config.HealthCheck); err != nil {
+			return nil, fmt.Errorf("failed to parse stored health check: %w", err)
+		}
+	}
+
+	if len(component.Env) > 0 {
+		if err := json.Unmarshal(component.Env, &config.Env); err != nil {
+			return nil, fmt.Errorf("failed to parse stored env: %w", err)
+		}
+	}
+
+	if len(component.WaitFor) > 0 {
+		if err := json.Unmarshal(component.WaitFor, &config.WaitFor); err != nil {
+			return nil, fmt.Errorf("failed to parse stored wait_for: %w", err)
+		}
+	}
+
+	if len(component.ContentMirrors) > 0 {
+		if err := json.Unmarshal(component.ContentMirrors, &config.ContentMirrors); err != nil {
+			return nil, fmt.Errorf("failed to parse stored content_mirrors: %w", err)
+		}
+	}
+
+	if len(component.ContentURLHeaders) > 0 {
+		if err := json.Unmarshal(component.ContentURLHeaders, &config.ContentURLHeaders); err != nil {
+			return nil, fmt.Errorf("failed to parse stored content_url_headers: %w", err)
+		}
+	}
+
+	if len(component.Canary) > 0 {
+		if err := json.Unmarshal(component.Canary, &config.Canary); err != nil {
+			return nil, fmt.Errorf("failed to parse stored canary: %w", err)
+		}
+	}
+
+	if len(component.Rollout) > 0 {
+		if err := json.Unmarshal(component.Rollout, &config.Rollout); err != nil {
+			return nil, fmt.Errorf("failed to parse stored rollout: %w", err)
+		}
+	}
+
+	return config, nil
+}
+
+// componentRecord builds the stored form of a component a deployment
+// applies
+func (r *Reconciler) componentRecord(deploymentID uuid.UUID, config *types.ComponentConfig) *database.Component {
 	handler := config.Handler
 	if handler == "" {
 		handler = r.determineHandler(config)
@@ -125,11 +529,29 @@ func (r *Reconciler) deployComponent(deploymentID uuid.UUID, config *types.Compo
 		Content:            config.Content,
 		ContentURL:         config.ContentURL,
 		ContentURLEncoding: config.ContentURLEncoding,
+		Entrypoint:         config.Entrypoint,
+		SignatureURL:       config.SignatureURL,
+		PublicKey:          config.PublicKey,
 		NomadJob:           config.NomadJob,
+		NomadJobFormat:     config.NomadJobFormat,
+		NomadNamespace:     config.NomadNamespace,
+		NomadRegion:        config.NomadRegion,
+		K8sManifest:        config.K8sManifest,
+		K8sNamespace:       config.K8sNamespace,
 		Managed:            config.Managed,
+		MemoryLimit:        config.MemoryLimit,
+		CPULimit:           config.CPULimit,
+		MaxOpenFiles:       config.MaxOpenFiles,
+		RunAsUser:          config.RunAsUser,
+		RunAsGroup:         config.RunAsGroup,
+		WorkingDir:         config.WorkingDir,
 		DeploymentID:       &deploymentID,
 	}
 
+	if config.NomadJobData != nil {
+		component.NomadJob = string(*config.NomadJobData)
+	}
+
 	if config.HealthCheck != nil {
 		hc, _ := json.Marshal(config.HealthCheck)
 		component.HealthCheck = hc
@@ -141,9 +563,45 @@ func (r *Reconciler) deployComponent(deploymentID uuid.UUID, config *types.Compo
 	}
 
 	component.Args = config.Args
+	component.Affinity = config.Affinity
+	component.AntiAffinity = config.AntiAffinity
+	component.DependsOn = config.DependsOn
+	component.Replicas = config.Replicas
+
+	if len(config.WaitFor) > 0 {
+		waitFor, _ := json.Marshal(config.WaitFor)
+		component.WaitFor = waitFor
+	}
 
-	if err := r.db.UpsertComponent(component); err != nil {
-		return fmt.Errorf("failed to save component: %w", err)
+	if len(config.ContentMirrors) > 0 {
+		mirrors, _ := json.Marshal(config.ContentMirrors)
+		component.ContentMirrors = mirrors
+	}
+
+	if len(config.ContentURLHeaders) > 0 {
+		headers, _ := json.Marshal(config.ContentURLHeaders)
+		component.ContentURLHeaders = headers
+	}
+
+	if config.Canary != nil {
+		canary, _ := json.Marshal(config.Canary)
+		component.Canary = canary
+	}
+
+	if config.Rollout != nil {
+		rollout, _ := json.Marshal(config.Rollout)
+		component.Rollout = rollout
+	}
+
+	return component
+}
+
+// deployComponent sends a component whose record the deployment plan has
+// already stored
+func (r *Reconciler) deployComponent(ctx context.Context, deploymentID uuid.UUID, config *types.ComponentConfig, isNew bool) error {
+	handler := config.Handler
+	if handler == "" {
+		handler = r.determineHandler(config)
 	}
 
 	nodes, err := r.resolveTargetNodes(config.Tags)
@@ -151,6 +609,16 @@ func (r *Reconciler) deployComponent(deploymentID uuid.UUID, config *types.Compo
 		return fmt.Errorf("failed to resolve target nodes: %w", err)
 	}
 
+	nodes, err = r.applyAffinity(config, nodes)
+	if err != nil {
+		return fmt.Errorf("failed to apply affinity rules: %w", err)
+	}
+
+	nodes, err = r.placeReplicas(config, handler, nodes)
+	if err != nil {
+		return fmt.Errorf("failed to place replicas: %w", err)
+	}
+
 	log.WithFields(log.Fields{
 		"component":    config.Name,
 		"type":         config.Type,
@@ -160,11 +628,13 @@ func (r *Reconciler) deployComponent(deploymentID uuid.UUID, config *types.Compo
 
 	switch handler {
 	case "agent":
-		return r.deployViaAgent(deploymentID, config, nodes)
+		return r.deployViaAgent(ctx, deploymentID, config, nodes)
 	case "command-core":
-		return r.deployViaCommandCore(deploymentID, config, nodes)
+		return r.deployViaCommandCore(ctx, deploymentID, config, nodes)
 	case "nomad":
-		return r.deployViaNomad(deploymentID, config)
+		return r.deployViaNomad(ctx, deploymentID, config)
+	case "kubernetes":
+		return r.deployViaKubernetes(ctx, deploymentID, config)
 	default:
 		return fmt.Errorf("unknown handler: %s", handler)
 	}
@@ -178,6 +648,8 @@ func (r *Reconciler) removeComponent(deploymentID uuid.UUID, component *database
 		return r.removeViaAgent(deploymentID, component)
 	case "nomad":
 		return r.removeViaNomad(deploymentID, component)
+	case "kubernetes":
+		return r.removeViaKubernetes(deploymentID, component)
 	case "command-core":
 		r.db.DeleteComponent(component.Name)
 		return nil
@@ -186,21 +658,25 @@ func (r *Reconciler) removeComponent(deploymentID uuid.UUID, component *database
 	}
 }
 
-func (r *Reconciler) deployViaAgent(deploymentID uuid.UUID, config *types.ComponentConfig, nodes []database.Node) error {
-	log.WithFields(log.Fields{
-		"deployment_id": deploymentID,
-		"component":     config.Name,
-		"nodes_count":   len(nodes),
-	}).Info("Starting agent-based deployment")
-
+// agentDeployment builds the message that deploys a component on an agent
+func (r *Reconciler) agentDeployment(config *types.ComponentConfig) *pb.ComponentDeployment {
 	deployment := &pb.ComponentDeployment{
 		ComponentName:      config.Name,
 		ComponentType:      config.Type,
 		Hash:               config.Hash,
 		ContentUrl:         config.ContentURL,
 		ContentUrlEncoding: config.ContentURLEncoding,
+		Entrypoint:         config.Entrypoint,
+		SignatureUrl:       config.SignatureURL,
+		PublicKey:          config.PublicKey,
 		Content:            config.Content,
 		Managed:            config.Managed,
+		MemoryLimit:        config.MemoryLimit,
+		CpuLimit:           config.CPULimit,
+		MaxOpenFiles:       config.MaxOpenFiles,
+		RunAsUser:          config.RunAsUser,
+		RunAsGroup:         config.RunAsGroup,
+		WorkingDir:         config.WorkingDir,
 	}
 
 	if config.Env != nil {
@@ -211,22 +687,89 @@ func (r *Reconciler) deployViaAgent(deploymentID uuid.UUID, config *types.Compon
 		deployment.Args = config.Args
 	}
 
-	if config.HealthCheck != nil {
+	if config.ContentURLHeaders != nil {
+		deployment.ContentUrlHeaders = config.ContentURLHeaders
+	}
+
+	for _, wait := range config.WaitFor {
+		deployment.WaitFor = append(deployment.WaitFor, &pb.WaitForEndpoint{
+			Type:           wait.Type,
+			Endpoint:       wait.Endpoint,
+			TimeoutSeconds: wait.TimeoutSeconds,
+		})
+	}
+
+	for _, mirror := range config.ContentMirrors {
+		deployment.ContentMirrors = append(deployment.ContentMirrors, &pb.ContentMirror{
+			Url:    mirror.URL,
+			Weight: mirror.Weight,
+		})
+	}
+
+	if config.Canary != nil {
+		deployment.Canary = &pb.CanaryAnalysis{
+			WindowSeconds:         config.Canary.WindowSeconds,
+			MaxDegradationPercent: config.Canary.MaxDegradationPercent,
+			MinSamples:            config.Canary.MinSamples,
+		}
+	}
+
+	if healthCheck := r.healthCheckFor(config); healthCheck != nil {
 		deployment.HealthCheck = &pb.HealthCheckConfig{
 			ComponentName:   config.Name,
-			Type:            config.HealthCheck.Type,
-			Endpoint:        config.HealthCheck.Endpoint,
-			IntervalSeconds: config.HealthCheck.IntervalSeconds,
-			TimeoutSeconds:  config.HealthCheck.TimeoutSeconds,
-			Retries:         config.HealthCheck.Retries,
+			Type:            healthCheck.Type,
+			Endpoint:        healthCheck.Endpoint,
+			IntervalSeconds: healthCheck.IntervalSeconds,
+			TimeoutSeconds:  healthCheck.TimeoutSeconds,
+			Retries:         healthCheck.Retries,
+			Pattern:         healthCheck.Pattern,
+			ErrorPattern:    healthCheck.ErrorPattern,
+			Port:            healthCheck.Port,
+			Scheme:          healthCheck.Scheme,
+			Path:            healthCheck.Path,
+			Tls:             healthCheck.TLS,
+			Method:          healthCheck.Method,
+			Headers:         healthCheck.Headers,
+			ExpectedBody:    healthCheck.ExpectedBody,
+			ExpectedStatus:  healthCheck.ExpectedStatus,
+
+			RestartOnUnhealthy: healthCheck.RestartOnUnhealthy,
+			StartPeriodSeconds: healthCheck.StartPeriodSeconds,
 		}
 	}
 
+	return deployment
+}
+
+func (r *Reconciler) deployViaAgent(ctx context.Context, deploymentID uuid.UUID, config *types.ComponentConfig, nodes []database.Node) error {
+	log.WithFields(log.Fields{
+		"deployment_id": deploymentID,
+		"component":     config.Name,
+		"nodes_count":   len(nodes),
+	}).Info("Starting agent-based deployment")
+
+	deployment := r.agentDeployment(config)
+	deployment.DeploymentId = deploymentID.String()
+	deployment.RequestId = r.requestID(deploymentID)
+
+	unmanagedScript := config.Type == "script" && !config.Managed
+
 	targetNodes := make([]string, 0, len(nodes))
 	for _, node := range nodes {
-		if node.HasAgent {
-			targetNodes = append(targetNodes, node.Hostname)
+		if !node.HasAgent {
+			continue
 		}
+
+		if unmanagedScript && !r.supportsUnmanagedScripts(node.Hostname) {
+			log.WithFields(log.Fields{
+				"component": config.Name,
+				"node":      node.Hostname,
+			}).Warn("Skipping node that cannot run unmanaged scripts")
+			r.logDeployment(deploymentID, config.Name, node.Hostname, "deploy", "skipped", "Agent cannot run unmanaged scripts (nsenter unavailable)")
+			continue
+		}
+
+		targetNodes = append(targetNodes, node.Hostname)
 	}
 
 	log.WithFields(log.Fields{
@@ -238,12 +781,34 @@ func (r *Reconciler) deployViaAgent(deploymentID uuid.UUID, config *types.Compon
 		return fmt.Errorf("no agents available on target nodes")
 	}
 
+	if canaries := config.Rollout.Canaries(); canaries > 0 && canaries < len(targetNodes) {
+		if err := r.runCanary(ctx, deploymentID, config, deployment, targetNodes[:canaries]); err != nil {
+			return err
+		}
+		targetNodes = targetNodes[canaries:]
+	}
+
+	if batch := config.Rollout.Batch(); batch > 0 && batch < len(targetNodes) {
+		return r.rollOut(ctx, deploymentID, config, deployment, targetNodes, batch)
+	}
+
 	log.WithFields(log.Fields{
 		"component":    config.Name,
 		"target_nodes": targetNodes,
 		"node_count":   len(targetNodes),
 	}).Info("Broadcasting deployment to agents")
 
+	r.sendToNodes(ctx, deploymentID, config, deployment, targetNodes)
+	return nil
+}
+
+// sendToNodes records the component as deploying on each node and sends it
+// to their agents, unless the deployment was cancelled
+func (r *Reconciler) sendToNodes(ctx context.Context, deploymentID uuid.UUID, config *types.ComponentConfig, deployment *pb.ComponentDeployment, targetNodes []string) {
+	if ctx.Err() != nil {
+		return
+	}
+
 	// Create "deploying" records BEFORE broadcasting to avoid race condition
 	for _, node := range targetNodes {
 		componentDep := &database.ComponentDeployment{
@@ -254,23 +819,32 @@ func (r *Reconciler) deployViaAgent(deploymentID uuid.UUID, config *types.Compon
 			Message:       "Deployment command sent to agent",
 		}
 		r.db.UpsertComponentDeployment(componentDep)
+		r.events.Publish(events.Event{DeploymentID: deploymentID, Type: events.TypeStatus, Data: componentDep})
 
 		r.logDeployment(deploymentID, config.Name, node, "deploy", "initiated", "Sent to agent")
 	}
 
-	errors := r.grpcServer.BroadcastDeployment(deployment, targetNodes)
-
-	if len(errors) > 0 {
-		log.WithField("errors", len(errors)).Warn("Some deployments failed to send")
-		for _, err := range errors {
-			log.WithError(err).Warn("Deployment send error")
+	for _, node := range targetNodes {
+		if err := r.grpcServer.SendDeployment(node, deployment); err != nil {
+			log.WithError(err).WithField("node", node).Warn("Deployment send error")
+
+			// The agent will never answer, so don't leave the node waiting
+			now := time.Now()
+			failed := &database.ComponentDeployment{
+				ComponentName: config.Name,
+				NodeHostname:  node,
+				Status:        "failed",
+				Message:       fmt.Sprintf("Failed to send deployment: %v", err),
+				LastUpdated:   &now,
+			}
+			r.db.UpsertComponentDeployment(failed)
+			r.events.Publish(events.Event{DeploymentID: deploymentID, Type: events.TypeStatus, Data: failed})
+			r.logDeployment(deploymentID, config.Name, node, "deploy", "failure", err.Error())
 		}
 	}
-
-	return nil
 }
 
-func (r *Reconciler) deployViaCommandCore(deploymentID uuid.UUID, config *types.ComponentConfig, nodes []database.Node) error {
+func (r *Reconciler) deployViaCommandCore(ctx context.Context, deploymentID uuid.UUID, config *types.ComponentConfig, nodes []database.Node) error {
 	if config.Type != "script" {
 		return fmt.Errorf("command-core handler only supports scripts")
 	}
@@ -284,7 +858,7 @@ func (r *Reconciler) deployViaCommandCore(deploymentID uuid.UUID, config *types.
 		return fmt.Errorf("no target nodes found")
 	}
 
-	if err := r.scriptMgr.DeployViaCommandCore(config, targetNodes); err != nil {
+	if err := r.scriptMgr.DeployViaCommandCore(ctx, config, targetNodes); err != nil {
 		return err
 	}
 
@@ -295,12 +869,14 @@ func (r *Reconciler) deployViaCommandCore(deploymentID uuid.UUID, config *types.
 	return nil
 }
 
-func (r *Reconciler) deployViaNomad(deploymentID uuid.UUID, config *types.ComponentConfig) error {
+func (r *Reconciler) deployViaNomad(ctx context.Context, deploymentID uuid.UUID, config *types.ComponentConfig) error {
 	if config.Type != "service" {
 		return fmt.Errorf("nomad handler only supports services")
 	}
 
-	if err := r.serviceMgr.Deploy(config); err != nil {
+	r.logDeployment(deploymentID, config.Name, "", "deploy", "initiated", "Submitting to Nomad")
+
+	if err := r.serviceMgr.Deploy(ctx, config); err != nil {
 		r.logDeployment(deploymentID, config.Name, "", "deploy", "failure", err.Error())
 		return err
 	}
@@ -310,6 +886,26 @@ func (r *Reconciler) deployViaNomad(deploymentID uuid.UUID, config *types.Compon
 	return nil
 }
 
+func (r *Reconciler) deployViaKubernetes(ctx context.Context, deploymentID uuid.UUID, config *types.ComponentConfig) error {
+	if config.Type != "service" {
+		return fmt.Errorf("kubernetes handler only supports services")
+	}
+	if r.k8sMgr == nil {
+		return fmt.Errorf("kubernetes not configured")
+	}
+
+	r.logDeployment(deploymentID, config.Name, "", "deploy", "initiated", "Applying to Kubernetes")
+
+	if err := r.k8sMgr.Apply(ctx, config); err != nil {
+		r.logDeployment(deploymentID, config.Name, "", "deploy", "failure", err.Error())
+		return err
+	}
+
+	r.logDeployment(deploymentID, config.Name, "", "deploy", "success", "Applied to Kubernetes")
+
+	return nil
+}
+
 func (r *Reconciler) removeViaAgent(deploymentID uuid.UUID, component *database.Component) error {
 	deployments, err := r.db.GetComponentDeployments(component.Name)
 	if err != nil {
@@ -344,7 +940,7 @@ func (r *Reconciler) removeViaAgent(deploymentID uuid.UUID, component *database.
 }
 
 func (r *Reconciler) removeViaNomad(deploymentID uuid.UUID, component *database.Component) error {
-	if err := r.serviceMgr.Remove(component.Name); err != nil {
+	if err := r.serviceMgr.Remove(component.Name, component.NomadNamespace, component.NomadRegion); err != nil {
 		r.logDeployment(deploymentID, component.Name, "", "remove", "failure", err.Error())
 		return err
 	}
@@ -355,24 +951,142 @@ func (r *Reconciler) removeViaNomad(deploymentID uuid.UUID, component *database.
 	return nil
 }
 
+func (r *Reconciler) removeViaKubernetes(deploymentID uuid.UUID, component *database.Component) error {
+	if r.k8sMgr == nil {
+		return fmt.Errorf("kubernetes not configured")
+	}
+
+	if err := r.k8sMgr.Remove(context.Background(), component.Name, component.K8sManifest, component.K8sNamespace); err != nil {
+		r.logDeployment(deploymentID, component.Name, "", "remove", "failure", err.Error())
+		return err
+	}
+
+	r.db.DeleteComponent(component.Name)
+	r.logDeployment(deploymentID, component.Name, "", "remove", "success", "Removed from Kubernetes")
+
+	return nil
+}
+
 func (r *Reconciler) resolveTargetNodes(tags []string) ([]database.Node, error) {
+	var nodes []database.Node
+	var err error
 	if len(tags) == 0 {
-		return r.db.ListNodes(true)
+		nodes, err = r.db.ListNodes(true)
+	} else {
+		nodes, err = r.db.GetNodesByTags(tags)
 	}
-
-	nodes, err := r.db.GetNodesByTags(tags)
 	if err != nil {
 		return nil, err
 	}
 
-	onlineNodes := make([]database.Node, 0, len(nodes))
+	return schedulableNodes(nodes), nil
+}
+
+// schedulableNodes keeps the nodes that can take new deployments: online and
+// not draining
+func schedulableNodes(nodes []database.Node) []database.Node {
+	schedulable := make([]database.Node, 0, len(nodes))
 	for _, node := range nodes {
-		if node.Online {
-			onlineNodes = append(onlineNodes, node)
+		if node.Online && !node.Draining {
+			schedulable = append(schedulable, node)
+		}
+	}
+	return schedulable
+}
+
+// supportsUnmanagedScripts checks the capability the agent reports in its
+// heartbeat metadata. Agents that don't report it are assumed capable.
+func (r *Reconciler) supportsUnmanagedScripts(hostname string) bool {
+	agent, err := r.db.GetAgent(hostname)
+	if err != nil || len(agent.Metadata) == 0 {
+		return true
+	}
+
+	var metadata map[string]string
+	if err := json.Unmarshal(agent.Metadata, &metadata); err != nil {
+		return true
+	}
+
+	return metadata["unmanaged_scripts"] != "false"
+}
+
+// applyAffinity filters target nodes using the component's placement rules.
+// Anti-affinity excludes nodes running any of the listed components; affinity
+// prefers nodes running one of them, falling back to all nodes if none do.
+func (r *Reconciler) applyAffinity(config *types.ComponentConfig, nodes []database.Node) ([]database.Node, error) {
+	if len(config.AntiAffinity) > 0 {
+		excluded, err := r.nodesRunning(config.AntiAffinity, config.Name)
+		if err != nil {
+			return nil, err
+		}
+
+		filtered := make([]database.Node, 0, len(nodes))
+		for _, node := range nodes {
+			if excluded[node.Hostname] {
+				log.WithFields(log.Fields{
+					"component": config.Name,
+					"node":      node.Hostname,
+				}).Info("Node excluded by anti-affinity rule")
+				continue
+			}
+			filtered = append(filtered, node)
+		}
+		nodes = filtered
+	}
+
+	if len(config.Affinity) > 0 {
+		preferred, err := r.nodesRunning(config.Affinity, config.Name)
+		if err != nil {
+			return nil, err
+		}
+
+		filtered := make([]database.Node, 0, len(nodes))
+		for _, node := range nodes {
+			if preferred[node.Hostname] {
+				filtered = append(filtered, node)
+			}
+		}
+
+		if len(filtered) > 0 {
+			if len(filtered) < len(nodes) {
+				log.WithFields(log.Fields{
+					"component":      config.Name,
+					"preferred":      len(filtered),
+					"filtered_count": len(nodes) - len(filtered),
+				}).Info("Nodes filtered by affinity rule")
+			}
+			nodes = filtered
+		} else {
+			log.WithField("component", config.Name).Info("No nodes satisfy affinity rule, using all target nodes")
 		}
 	}
 
-	return onlineNodes, nil
+	return nodes, nil
+}
+
+// nodesRunning returns the set of nodes with a non-failed deployment of any
+// of the given components, ignoring the component being placed
+func (r *Reconciler) nodesRunning(componentNames []string, self string) (map[string]bool, error) {
+	hostnames := make(map[string]bool)
+
+	for _, name := range componentNames {
+		if name == self {
+			continue
+		}
+
+		deployments, err := r.db.GetComponentDeployments(name)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, dep := range deployments {
+			if dep.Status != "failed" && dep.Status != "drained" && dep.Status != "removing" {
+				hostnames[dep.NodeHostname] = true
+			}
+		}
+	}
+
+	return hostnames, nil
 }
 
 func (r *Reconciler) determineHandler(config *types.ComponentConfig) string {
@@ -385,6 +1099,9 @@ func (r *Reconciler) determineHandler(config *types.ComponentConfig) string {
 	case "program":
 		return "agent"
 	case "service":
+		if config.UsesKubernetes() {
+			return "kubernetes"
+		}
 		return "nomad"
 	default:
 		return "agent"
@@ -399,7 +1116,9 @@ func (r *Reconciler) logDeployment(deploymentID uuid.UUID, componentName, nodeHo
 		Operation:     operation,
 		Status:        status,
 		Message:       message,
+		Details:       r.logDetails(deploymentID),
 	}
 
 	r.db.LogDeployment(log)
+	r.events.Publish(events.Event{DeploymentID: deploymentID, Type: events.TypeLog, Data: log})
 }
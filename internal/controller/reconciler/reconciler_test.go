@@ -0,0 +1,225 @@
+package reconciler
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/metorial/fleet/cosmos/internal/controller/database"
+	"github.com/metorial/fleet/cosmos/internal/controller/database/dbtest"
+	"github.com/metorial/fleet/cosmos/internal/controller/types"
+)
+
+func setupTestReconciler(t *testing.T) (*Reconciler, *database.ControllerDB) {
+	dsn := dbtest.URL(t)
+
+	db, err := database.NewControllerDB(dsn)
+	if err != nil {
+		t.Fatalf("Failed to create test database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	return NewReconciler(&ReconcilerConfig{DB: db, DeploymentTimeout: time.Second}), db
+}
+
+func TestConcurrentDeploymentsAreSerialized(t *testing.T) {
+	r, db := setupTestReconciler(t)
+
+	prefix := "test-" + uuid.New().String()[:8] + "-"
+	// No node carries this tag, so components are stored but never sent
+	tag := prefix + "nowhere"
+
+	component := func(name string) types.ComponentConfig {
+		return types.ComponentConfig{Type: "script", Name: prefix + name, Hash: name, Tags: []string{tag}, Handler: "agent", Content: "true"}
+	}
+
+	requests := []types.ConfigurationRequest{
+		{Components: []types.ComponentConfig{component("a"), component("b")}},
+		{Components: []types.ComponentConfig{component("b"), component("c")}},
+	}
+
+	ids := make([]uuid.UUID, len(requests))
+	for i, req := range requests {
+		configuration, _ := json.Marshal(req)
+		deployment := &database.Deployment{ID: uuid.New(), Configuration: configuration, Status: "pending", CreatedAt: time.Now()}
+		if err := db.CreateDeployment(deployment); err != nil {
+			t.Fatalf("Failed to create deployment: %v", err)
+		}
+		ids[i] = deployment.ID
+	}
+
+	t.Cleanup(func() {
+		for _, name := range []string{"a", "b", "c"} {
+			db.DeleteComponent(prefix + name)
+		}
+	})
+
+	var wg sync.WaitGroup
+	for i := range requests {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := r.ProcessDeployment(ids[i], requests[i]); err != nil {
+				t.Errorf("Deployment %d failed to process: %v", i, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	components, err := db.ListComponents()
+	if err != nil {
+		t.Fatalf("Failed to list components: %v", err)
+	}
+
+	var names []string
+	for _, comp := range components {
+		if strings.HasPrefix(comp.Name, prefix) {
+			names = append(names, strings.TrimPrefix(comp.Name, prefix))
+		}
+	}
+	sort.Strings(names)
+
+	// Each deployment is a full desired state, so exactly one of them must
+	// be left in place, never a mix of both
+	got := strings.Join(names, ",")
+	if got != "a,b" && got != "b,c" {
+		t.Errorf("Expected components a,b or b,c after both deployments, got %q", got)
+	}
+}
+
+func TestRemovalsAndDrainsWaitForTheRunningDeployment(t *testing.T) {
+	r, _ := setupTestReconciler(t)
+
+	// A deployment holds the slot
+	r.deploySlot <- struct{}{}
+
+	done := make(chan string, 2)
+	go func() {
+		r.RemoveComponents(uuid.New(), nil)
+		done <- "remove"
+	}()
+	go func() {
+		r.DrainNode("test-" + uuid.New().String()[:8])
+		done <- "drain"
+	}()
+
+	select {
+	case op := <-done:
+		t.Fatalf("Expected %s to wait for the running deployment", op)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	<-r.deploySlot
+	for i := 0; i < 2; i++ {
+		select {
+		case <-done:
+		case <-time.After(2 * time.Second):
+			t.Fatal("Expected the waiting operations to run once the deployment finished")
+		}
+	}
+}
+
+func TestComponentRecordRoundTrip(t *testing.T) {
+	jobData := json.RawMessage(`{"ID":"web"}`)
+	configs := []*types.ComponentConfig{
+		{
+			Type:           "service",
+			Name:           "web",
+			Hash:           "abc",
+			Tags:           []string{"edge"},
+			Handler:        "nomad",
+			NomadJob:       `job "web" {}`,
+			NomadJobFormat: "hcl",
+			NomadNamespace: "apps",
+			NomadRegion:    "eu",
+			Rollout:        &types.RolloutStrategy{BatchSize: 2, CanaryCount: 1, CanaryBakeSeconds: 30},
+		},
+		{
+			Type:         "service",
+			Name:         "api",
+			Hash:         "def",
+			Tags:         []string{"edge"},
+			Handler:      "nomad",
+			NomadJobData: &jobData,
+		},
+		{
+			Type:         "service",
+			Name:         "k8s",
+			Hash:         "ghi",
+			Tags:         []string{"edge"},
+			Handler:      "kubernetes",
+			K8sManifest:  "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: k8s\n",
+			K8sNamespace: "apps",
+		},
+		{
+			Type:         "program",
+			Name:         "worker",
+			Hash:         "jkl",
+			Tags:         []string{"edge"},
+			Handler:      "agent",
+			ContentURL:   "https://example.com/worker.tar.gz",
+			MemoryLimit:  256 << 20,
+			CPULimit:     1.5,
+			MaxOpenFiles: 4096,
+			RunAsUser:    "worker",
+			RunAsGroup:   "staff",
+			WorkingDir:   "/srv/worker",
+			DependsOn:    []string{"db", "cache"},
+			Replicas:     3,
+		},
+	}
+
+	r := &Reconciler{}
+	for _, config := range configs {
+		got, err := componentConfigFromRecord(r.componentRecord(uuid.New(), config))
+		if err != nil {
+			t.Fatalf("%s: failed to read stored component: %v", config.Name, err)
+		}
+
+		want := *config
+		if want.NomadJobData != nil {
+			// Stored as the job itself, which is what Deploy reads back
+			want.NomadJob, want.NomadJobData = string(*want.NomadJobData), nil
+		}
+
+		gotJSON, _ := json.Marshal(got)
+		wantJSON, _ := json.Marshal(&want)
+		if string(gotJSON) != string(wantJSON) {
+			t.Errorf("%s: expected %s to come back from the record, got %s", config.Name, wantJSON, gotJSON)
+		}
+	}
+}
+
+func TestRedeployToNodeRejectsOtherHandlers(t *testing.T) {
+	r := &Reconciler{}
+	for _, handler := range []string{"nomad", "kubernetes", "command-core"} {
+		err := r.RedeployToNode(uuid.New(), &database.Component{Name: "web", Handler: handler}, "node-1")
+		if err == nil || !strings.Contains(err.Error(), "can't be redeployed to a node") {
+			t.Errorf("%s: expected the redeploy to be refused, got %v", handler, err)
+		}
+	}
+}
+
+func TestDetermineHandler(t *testing.T) {
+	tests := []struct {
+		config types.ComponentConfig
+		want   string
+	}{
+		{types.ComponentConfig{Type: "script"}, "command-core"},
+		{types.ComponentConfig{Type: "script", Managed: true}, "agent"},
+		{types.ComponentConfig{Type: "program"}, "agent"},
+		{types.ComponentConfig{Type: "service", NomadJob: "{}"}, "nomad"},
+		{types.ComponentConfig{Type: "service", K8sManifest: "kind: ConfigMap"}, "kubernetes"},
+	}
+
+	r := &Reconciler{}
+	for _, tt := range tests {
+		if got := r.determineHandler(&tt.config); got != tt.want {
+			t.Errorf("determineHandler(%+v) = %s, want %s", tt.config, got, tt.want)
+		}
+	}
+}
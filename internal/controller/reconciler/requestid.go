@@ -0,0 +1,54 @@
+package reconciler
+
+import (
+	"encoding/json"
+
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// trackRequestID remembers the request ID the deployment was created with so
+// its logs and agent messages can be correlated with the API request. The
+// returned function forgets it again.
+func (r *Reconciler) trackRequestID(deploymentID uuid.UUID) func() {
+	deployment, err := r.db.GetDeployment(deploymentID)
+	if err != nil {
+		log.WithError(err).WithField("deployment_id", deploymentID).Warn("Failed to get deployment request ID")
+		return func() {}
+	}
+	if deployment.RequestID == "" {
+		return func() {}
+	}
+
+	r.activeMu.Lock()
+	r.requestIDs[deploymentID] = deployment.RequestID
+	r.activeMu.Unlock()
+
+	return func() {
+		r.activeMu.Lock()
+		defer r.activeMu.Unlock()
+		delete(r.requestIDs, deploymentID)
+	}
+}
+
+// requestID returns the request ID of a deployment being processed, or "" if
+// it has none
+func (r *Reconciler) requestID(deploymentID uuid.UUID) string {
+	r.activeMu.Lock()
+	defer r.activeMu.Unlock()
+	return r.requestIDs[deploymentID]
+}
+
+// logDetails returns the details stored with the deployment's logs
+func (r *Reconciler) logDetails(deploymentID uuid.UUID) json.RawMessage {
+	id := r.requestID(deploymentID)
+	if id == "" {
+		return nil
+	}
+
+	details, err := json.Marshal(map[string]string{"request_id": id})
+	if err != nil {
+		return nil
+	}
+	return details
+}
@@ -0,0 +1,116 @@
+package reconciler
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/metorial/fleet/cosmos/internal/controller/database"
+	pb "github.com/metorial/fleet/cosmos/internal/proto"
+	log "github.com/sirupsen/logrus"
+)
+
+// SyncNode re-sends the agent components recorded on a node to its agent so
+// one that reconnects with a stale or wiped database converges. The messages
+// are marked as resyncs, which agents skip for components they already have
+// with the same spec. Removals the agent hasn't confirmed are sent again.
+// Draining nodes are left empty until uncordoned. A deployment in progress
+// finishes first, so the desired state is the one it leaves.
+func (r *Reconciler) SyncNode(hostname string) {
+	defer r.takeDeploySlot()()
+
+	if node, err := r.db.GetNode(hostname); err == nil && node.Draining {
+		log.WithField("hostname", hostname).Info("Not re-sending desired state to draining node")
+		return
+	}
+
+	r.resendRemovals(hostname)
+
+	deployments, err := r.resyncDeployments(hostname)
+	if err != nil {
+		log.WithError(err).WithField("hostname", hostname).Warn("Failed to load desired state for node")
+		return
+	}
+
+	if len(deployments) == 0 {
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"hostname":   hostname,
+		"components": len(deployments),
+	}).Info("Re-sending desired state to agent")
+
+	for _, deployment := range deployments {
+		if err := r.grpcServer.SendDeployment(hostname, deployment); err != nil {
+			log.WithError(err).WithFields(log.Fields{
+				"hostname":  hostname,
+				"component": deployment.ComponentName,
+			}).Warn("Failed to re-send deployment")
+			return
+		}
+	}
+}
+
+// resyncDeployments builds the deployment messages for the agent components
+// recorded on a node. Components stopped through the API stay stopped, and
+// ones being removed aren't sent.
+func (r *Reconciler) resyncDeployments(hostname string) ([]*pb.ComponentDeployment, error) {
+	records, err := r.db.GetNodeDeployments(hostname)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get node deployments: %w", err)
+	}
+
+	var deployments []*pb.ComponentDeployment
+	for _, record := range records {
+		if record.Status == "stopped" || record.Status == "removing" {
+			continue
+		}
+
+		component, err := r.db.GetComponent(record.ComponentName)
+		if errors.Is(err, database.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to get component %s: %w", record.ComponentName, err)
+		}
+
+		if component.Handler != "agent" {
+			continue
+		}
+
+		config, err := componentConfigFromRecord(component)
+		if err != nil {
+			log.WithError(err).WithField("component", component.Name).Warn("Skipping component with invalid stored config")
+			continue
+		}
+
+		deployment := r.agentDeployment(config)
+		deployment.Resync = true
+		deployments = append(deployments, deployment)
+	}
+
+	return deployments, nil
+}
+
+// resendRemovals sends the removals of the components marked removing on a
+// node again, in case the agent missed them
+func (r *Reconciler) resendRemovals(hostname string) {
+	records, err := r.db.GetNodeDeployments(hostname)
+	if err != nil {
+		log.WithError(err).WithField("hostname", hostname).Warn("Failed to get node deployments")
+		return
+	}
+
+	for _, record := range records {
+		if record.Status != "removing" {
+			continue
+		}
+		if err := r.grpcServer.SendRemoval(hostname, record.ComponentName); err != nil {
+			log.WithError(err).WithFields(log.Fields{
+				"hostname":  hostname,
+				"component": record.ComponentName,
+			}).Warn("Failed to re-send removal")
+			return
+		}
+	}
+}
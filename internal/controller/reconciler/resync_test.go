@@ -0,0 +1,103 @@
+package reconciler
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/metorial/fleet/cosmos/internal/controller/database"
+	grpcserver "github.com/metorial/fleet/cosmos/internal/controller/grpc"
+	pb "github.com/metorial/fleet/cosmos/internal/proto"
+	"google.golang.org/grpc"
+)
+
+// agentStream stands in for an agent connection, sending one identifying
+// message and collecting what the controller sends back
+type agentStream struct {
+	grpc.ServerStream
+	ctx      context.Context
+	hello    chan *pb.AgentMessage
+	received chan *pb.ControllerMessage
+}
+
+func (s *agentStream) Context() context.Context { return s.ctx }
+
+func (s *agentStream) Send(msg *pb.ControllerMessage) error {
+	s.received <- msg
+	return nil
+}
+
+func (s *agentStream) Recv() (*pb.AgentMessage, error) {
+	select {
+	case msg, ok := <-s.hello:
+		if !ok {
+			return nil, io.EOF
+		}
+		return msg, nil
+	case <-s.ctx.Done():
+		return nil, s.ctx.Err()
+	}
+}
+
+func TestReconnectedAgentReceivesDesiredState(t *testing.T) {
+	r, db := setupTestReconciler(t)
+
+	server := grpcserver.NewServer(&grpcserver.ServerConfig{DB: db})
+	server.SetConnectHandler(r.SyncNode)
+	r.grpcServer = server
+
+	prefix := "test-" + uuid.New().String()[:8] + "-"
+	hostname := prefix + "node"
+
+	for _, name := range []string{"api", "stopped", "nomad"} {
+		handler := "agent"
+		if name == "nomad" {
+			handler = "nomad"
+		}
+		if err := db.UpsertComponent(&database.Component{Name: prefix + name, Type: "program", Handler: handler, Hash: name + "-hash", Tags: []string{"all"}, ContentURL: "https://example.com/" + name}); err != nil {
+			t.Fatalf("Failed to create component: %v", err)
+		}
+
+		status := "running"
+		if name == "stopped" {
+			status = "stopped"
+		}
+		if err := db.UpsertComponentDeployment(&database.ComponentDeployment{ComponentName: prefix + name, NodeHostname: hostname, Status: status}); err != nil {
+			t.Fatalf("Failed to create component deployment: %v", err)
+		}
+	}
+	t.Cleanup(func() {
+		for _, name := range []string{"api", "stopped", "nomad"} {
+			db.DeleteComponent(prefix + name)
+		}
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stream := &agentStream{ctx: ctx, hello: make(chan *pb.AgentMessage, 1), received: make(chan *pb.ControllerMessage, 10)}
+	stream.hello <- &pb.AgentMessage{Hostname: hostname}
+	go server.StreamAgentMessages(stream)
+
+	select {
+	case msg := <-stream.received:
+		deployment := msg.GetDeployment()
+		if deployment == nil {
+			t.Fatalf("Expected a deployment message, got %v", msg)
+		}
+		if deployment.ComponentName != prefix+"api" || deployment.Hash != "api-hash" || !deployment.Resync {
+			t.Errorf("Expected a resync of %sapi, got %s (hash %s, resync %v)", prefix, deployment.ComponentName, deployment.Hash, deployment.Resync)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the connected agent to receive its components")
+	}
+
+	// Stopped components and those of other handlers aren't re-sent
+	select {
+	case msg := <-stream.received:
+		t.Errorf("Expected only one deployment, also got %v", msg)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
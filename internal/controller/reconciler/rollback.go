@@ -0,0 +1,132 @@
+package reconciler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/metorial/fleet/cosmos/internal/controller/database"
+	"github.com/metorial/fleet/cosmos/internal/controller/types"
+	log "github.com/sirupsen/logrus"
+)
+
+// failedUpdates returns the updated agent components that didn't come up
+// healthy: a node isn't running the new version or failed a health check
+// since the deployment started, or their rollout was halted
+func (r *Reconciler) failedUpdates(updated []types.ComponentConfig, records []database.ComponentDeployment, componentErrors map[string]error, since time.Time) []string {
+	byComponent := make(map[string][]database.ComponentDeployment)
+	for _, record := range records {
+		byComponent[record.ComponentName] = append(byComponent[record.ComponentName], record)
+	}
+
+	var failed []string
+	for i := range updated {
+		config := &updated[i]
+
+		handler := config.Handler
+		if handler == "" {
+			handler = r.determineHandler(config)
+		}
+		if handler != "agent" {
+			continue
+		}
+
+		if errors.Is(componentErrors[config.Name], errRolloutHalted) || len(unhealthyNodes(byComponent[config.Name], since)) > 0 {
+			failed = append(failed, config.Name)
+		}
+	}
+
+	sort.Strings(failed)
+	return failed
+}
+
+// rollBack redeploys the previous version of each component and waits for
+// the agents to confirm it, returning the components that were rolled back
+func (r *Reconciler) rollBack(ctx context.Context, deploymentID uuid.UUID, names []string) []string {
+	var rolledBack []string
+	for _, name := range names {
+		if err := r.rollBackComponent(ctx, deploymentID, name); err != nil {
+			log.WithError(err).WithField("component", name).Error("Failed to roll back component")
+			r.logDeployment(deploymentID, name, "", "rollback", "failure", err.Error())
+			continue
+		}
+		rolledBack = append(rolledBack, name)
+	}
+
+	if len(rolledBack) == 0 {
+		return nil
+	}
+
+	inRollback := make(map[string]bool, len(rolledBack))
+	for _, name := range rolledBack {
+		inRollback[name] = true
+	}
+
+	records, err := r.awaitNodeDeployments(ctx, deploymentID, func(record *database.ComponentDeployment) bool {
+		return inRollback[record.ComponentName]
+	})
+	if err != nil {
+		log.WithError(err).WithField("deployment_id", deploymentID).Warn("Failed to wait for rollback")
+		return rolledBack
+	}
+
+	failed := make(map[string][]string)
+	for _, record := range records {
+		if record.Status != "running" {
+			failed[record.ComponentName] = append(failed[record.ComponentName], fmt.Sprintf("%s (%s)", record.NodeHostname, record.Status))
+		}
+	}
+
+	for _, name := range rolledBack {
+		if nodes := failed[name]; len(nodes) > 0 {
+			r.logDeployment(deploymentID, name, "", "rollback", "failure",
+				fmt.Sprintf("Previous version failed on %s", strings.Join(nodes, ", ")))
+			continue
+		}
+		r.logDeployment(deploymentID, name, "", "rollback", "completed", "Previous version running")
+	}
+
+	return rolledBack
+}
+
+func (r *Reconciler) rollBackComponent(ctx context.Context, deploymentID uuid.UUID, name string) error {
+	previous, err := r.db.RollbackComponent(name)
+	if err != nil {
+		return err
+	}
+
+	config, err := componentConfigFromRecord(previous)
+	if err != nil {
+		return err
+	}
+
+	nodes, err := r.resolveTargetNodes(config.Tags)
+	if err != nil {
+		return fmt.Errorf("failed to resolve target nodes: %w", err)
+	}
+
+	nodes, err = r.applyAffinity(config, nodes)
+	if err != nil {
+		return fmt.Errorf("failed to apply affinity rules: %w", err)
+	}
+
+	nodes, err = r.placeReplicas(config, "agent", nodes)
+	if err != nil {
+		return fmt.Errorf("failed to place replicas: %w", err)
+	}
+
+	log.WithFields(log.Fields{
+		"deployment_id": deploymentID,
+		"component":     name,
+		"hash":          previous.Hash,
+	}).Warn("Rolling back component to previous version")
+
+	r.logDeployment(deploymentID, name, "", "rollback", "initiated",
+		fmt.Sprintf("Redeploying previous version %s", previous.Hash))
+
+	return r.deployViaAgent(ctx, deploymentID, config, nodes)
+}
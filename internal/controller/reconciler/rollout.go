@@ -0,0 +1,311 @@
+package reconciler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/metorial/fleet/cosmos/internal/controller/database"
+	"github.com/metorial/fleet/cosmos/internal/controller/types"
+	pb "github.com/metorial/fleet/cosmos/internal/proto"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultDeploymentTimeout = 10 * time.Minute
+	defaultRolloutPoll       = 2 * time.Second
+	defaultCanaryBake        = 5 * time.Minute
+)
+
+// errRolloutHalted marks a rollout stopped by a failed batch or canary. The
+// whole deployment fails even though some nodes are running.
+var errRolloutHalted = errors.New("rollout halted")
+
+// isTerminalNodeStatus reports whether an agent has finished acting on a
+// deployment sent to it
+func isTerminalNodeStatus(status string) bool {
+	switch status {
+	case "running", "failed", "rolled_back", "stopped":
+		return true
+	default:
+		return false
+	}
+}
+
+// awaitNodeDeployments polls the per-node records of a deployment, limited to
+// those match accepts when it is set, until every agent reports a terminal
+// status or the deployment timeout elapses, returning the records as last
+// seen. Records taken over by a newer deployment are no longer listed. It
+// returns ctx's error if the deployment is cancelled while waiting.
+func (r *Reconciler) awaitNodeDeployments(ctx context.Context, deploymentID uuid.UUID, match func(*database.ComponentDeployment) bool) ([]database.ComponentDeployment, error) {
+	deadline := time.Now().Add(r.deploymentTimeout)
+
+	for {
+		all, err := r.db.ListDeploymentNodes(deploymentID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list node deployments: %w", err)
+		}
+
+		records := all[:0]
+		for i := range all {
+			if match == nil || match(&all[i]) {
+				records = append(records, all[i])
+			}
+		}
+
+		pending := 0
+		for _, record := range records {
+			if !isTerminalNodeStatus(record.Status) {
+				pending++
+			}
+		}
+
+		if pending == 0 || time.Now().After(deadline) {
+			return records, nil
+		}
+
+		log.WithFields(log.Fields{
+			"deployment_id": deploymentID,
+			"pending":       pending,
+			"total":         len(records),
+		}).Debug("Waiting for agents to confirm deployment")
+
+		if err := sleepCtx(ctx, r.rolloutPoll); err != nil {
+			return records, err
+		}
+	}
+}
+
+// sleepCtx waits for d, returning early with ctx's error if it's cancelled
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// deploymentOutcome decides the final status of a deployment from its
+// per-node records and the components that failed before reaching any node.
+// It is completed when everything succeeded, failed when nothing did, and
+// partial otherwise.
+func deploymentOutcome(records []database.ComponentDeployment, componentErrors map[string]error) (string, string) {
+	var failures []string
+	for name, err := range componentErrors {
+		failures = append(failures, fmt.Sprintf("%s: %v", name, err))
+	}
+
+	for _, record := range records {
+		switch {
+		case record.Status == "running":
+			continue
+		case !isTerminalNodeStatus(record.Status):
+			failures = append(failures, fmt.Sprintf("%s on %s: timed out waiting for agent (%s)", record.ComponentName, record.NodeHostname, record.Status))
+		default:
+			failures = append(failures, strings.TrimSpace(fmt.Sprintf("%s on %s: %s %s", record.ComponentName, record.NodeHostname, record.Status, record.Message)))
+		}
+	}
+
+	if len(failures) == 0 {
+		return "completed", ""
+	}
+
+	total := len(records) + len(componentErrors)
+	status := "partial"
+	if len(failures) == total {
+		status = "failed"
+	}
+
+	// Map iteration order is random; keep the message stable
+	sort.Strings(failures)
+	return status, fmt.Sprintf("%d of %d failed: %s", len(failures), total, strings.Join(failures, "; "))
+}
+
+// rollOut sends a deployment to the target nodes batch by batch, waiting for
+// each batch to be running before moving on
+func (r *Reconciler) rollOut(ctx context.Context, deploymentID uuid.UUID, config *types.ComponentConfig, deployment *pb.ComponentDeployment, targetNodes []string, batchSize int) error {
+	batches := (len(targetNodes) + batchSize - 1) / batchSize
+	pause := time.Duration(config.Rollout.PauseBetweenBatchesSeconds) * time.Second
+
+	for batch := 0; batch < batches; batch++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		nodes := targetNodes[batch*batchSize : min((batch+1)*batchSize, len(targetNodes))]
+
+		log.WithFields(log.Fields{
+			"component": config.Name,
+			"batch":     batch + 1,
+			"batches":   batches,
+			"nodes":     nodes,
+		}).Info("Rolling out batch")
+
+		r.sendToNodes(ctx, deploymentID, config, deployment, nodes)
+
+		inBatch := make(map[string]bool, len(nodes))
+		for _, node := range nodes {
+			inBatch[node] = true
+		}
+
+		records, err := r.awaitNodeDeployments(ctx, deploymentID, func(record *database.ComponentDeployment) bool {
+			return record.ComponentName == config.Name && inBatch[record.NodeHostname]
+		})
+		if err != nil {
+			return err
+		}
+
+		var failed []string
+		for _, record := range records {
+			if record.Status != "running" {
+				failed = append(failed, fmt.Sprintf("%s (%s)", record.NodeHostname, record.Status))
+			}
+		}
+
+		if len(failed) > 0 {
+			message := fmt.Sprintf("Batch %d of %d failed on %s", batch+1, batches, strings.Join(failed, ", "))
+			if remaining := len(targetNodes) - (batch+1)*batchSize; remaining > 0 {
+				message += fmt.Sprintf("; %d nodes not updated", remaining)
+			}
+			r.logDeployment(deploymentID, config.Name, "", "rollout", "halted", message)
+			return fmt.Errorf("%w: %s", errRolloutHalted, message)
+		}
+
+		r.logDeployment(deploymentID, config.Name, "", "rollout", "batch_completed",
+			fmt.Sprintf("Batch %d of %d running on %s", batch+1, batches, strings.Join(nodes, ", ")))
+
+		if batch+1 < batches && pause > 0 {
+			if err := sleepCtx(ctx, pause); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// runCanary deploys to the canary nodes and watches them for the bake time.
+// It returns nil once the canaries have baked or the rollout is promoted,
+// and a wrapped errRolloutHalted when a canary fails or the rollout is
+// aborted.
+func (r *Reconciler) runCanary(ctx context.Context, deploymentID uuid.UUID, config *types.ComponentConfig, deployment *pb.ComponentDeployment, nodes []string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	bake := time.Duration(config.Rollout.CanaryBakeSeconds) * time.Second
+	if bake <= 0 {
+		bake = defaultCanaryBake
+	}
+
+	log.WithFields(log.Fields{
+		"component": config.Name,
+		"canaries":  nodes,
+		"bake":      bake,
+	}).Info("Deploying to canary nodes")
+
+	r.logDeployment(deploymentID, config.Name, "", "canary", "started",
+		fmt.Sprintf("Deploying to canary nodes %s", strings.Join(nodes, ", ")))
+	r.sendToNodes(ctx, deploymentID, config, deployment, nodes)
+
+	inCanary := make(map[string]bool, len(nodes))
+	for _, node := range nodes {
+		inCanary[node] = true
+	}
+	match := func(record *database.ComponentDeployment) bool {
+		return record.ComponentName == config.Name && inCanary[record.NodeHostname]
+	}
+
+	records, err := r.awaitNodeDeployments(ctx, deploymentID, match)
+	if err != nil {
+		return err
+	}
+
+	bakeStart := time.Now()
+	if failed := unhealthyNodes(records, bakeStart); len(failed) > 0 {
+		return r.haltCanary(deploymentID, config, "failed", fmt.Sprintf("Canary deployment failed on %s", strings.Join(failed, ", ")))
+	}
+
+	r.logDeployment(deploymentID, config.Name, "", "canary", "baking",
+		fmt.Sprintf("Canaries running, baking for %s", bake))
+
+	deadline := bakeStart.Add(bake)
+	for {
+		dep, err := r.db.GetDeployment(deploymentID)
+		if err != nil {
+			return fmt.Errorf("failed to get deployment: %w", err)
+		}
+
+		switch dep.CanaryDecision {
+		case "promote":
+			r.logDeployment(deploymentID, config.Name, "", "canary", "promoted",
+				fmt.Sprintf("Promoted by %s after %s", dep.CanaryDecidedBy, time.Since(bakeStart).Round(time.Second)))
+			return nil
+		case "abort":
+			return r.haltCanary(deploymentID, config, "aborted", fmt.Sprintf("Aborted by %s", dep.CanaryDecidedBy))
+		}
+
+		all, err := r.db.ListDeploymentNodes(deploymentID)
+		if err != nil {
+			return fmt.Errorf("failed to list node deployments: %w", err)
+		}
+
+		records = records[:0]
+		for i := range all {
+			if match(&all[i]) {
+				records = append(records, all[i])
+			}
+		}
+
+		if failed := unhealthyNodes(records, bakeStart); len(failed) > 0 {
+			return r.haltCanary(deploymentID, config, "failed", fmt.Sprintf("Canary unhealthy during bake on %s", strings.Join(failed, ", ")))
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			r.logDeployment(deploymentID, config.Name, "", "canary", "passed",
+				fmt.Sprintf("Canaries healthy for %s", bake))
+			return nil
+		}
+
+		if err := sleepCtx(ctx, min(r.rolloutPoll, remaining)); err != nil {
+			return err
+		}
+	}
+}
+
+// haltCanary records a canary phase that stopped the rollout
+func (r *Reconciler) haltCanary(deploymentID uuid.UUID, config *types.ComponentConfig, status, message string) error {
+	log.WithFields(log.Fields{
+		"deployment_id": deploymentID,
+		"component":     config.Name,
+		"status":        status,
+	}).Warn(message)
+
+	r.logDeployment(deploymentID, config.Name, "", "canary", status, message)
+	return fmt.Errorf("%w: canary %s: %s", errRolloutHalted, status, message)
+}
+
+// unhealthyNodes lists the nodes that stopped running or reported a failed
+// health check since the given time. Older health results belong to the
+// previous version and are ignored.
+func unhealthyNodes(records []database.ComponentDeployment, since time.Time) []string {
+	var failed []string
+	for _, record := range records {
+		switch {
+		case record.Status != "running":
+			failed = append(failed, fmt.Sprintf("%s (%s)", record.NodeHostname, record.Status))
+		case record.HealthStatus == "unhealthy" && record.LastHealthCheck != nil && !record.LastHealthCheck.Before(since):
+			failed = append(failed, fmt.Sprintf("%s (unhealthy)", record.NodeHostname))
+		}
+	}
+	return failed
+}
@@ -0,0 +1,138 @@
+package reconciler
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/metorial/fleet/cosmos/internal/controller/database"
+	"github.com/metorial/fleet/cosmos/internal/controller/types"
+)
+
+func TestDeploymentOutcome(t *testing.T) {
+	record := func(node, status string) database.ComponentDeployment {
+		return database.ComponentDeployment{ComponentName: "web", NodeHostname: node, Status: status}
+	}
+
+	tests := []struct {
+		name            string
+		records         []database.ComponentDeployment
+		componentErrors map[string]error
+		wantStatus      string
+		wantMessage     string
+	}{
+		{
+			name:       "all running",
+			records:    []database.ComponentDeployment{record("node-1", "running"), record("node-2", "running")},
+			wantStatus: "completed",
+		},
+		{
+			name:        "one node failed",
+			records:     []database.ComponentDeployment{record("node-1", "running"), record("node-2", "failed")},
+			wantStatus:  "partial",
+			wantMessage: "1 of 2 failed: web on node-2: failed",
+		},
+		{
+			name:        "agent never answered",
+			records:     []database.ComponentDeployment{record("node-1", "deploying")},
+			wantStatus:  "failed",
+			wantMessage: "timed out waiting for agent",
+		},
+		{
+			name:            "component failed before reaching nodes",
+			records:         []database.ComponentDeployment{record("node-1", "running")},
+			componentErrors: map[string]error{"api": errors.New("no agents available on target nodes")},
+			wantStatus:      "partial",
+			wantMessage:     "api: no agents available",
+		},
+		{
+			name:       "nothing to deploy",
+			wantStatus: "completed",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, message := deploymentOutcome(tt.records, tt.componentErrors)
+			if status != tt.wantStatus {
+				t.Errorf("Expected status %q, got %q (%s)", tt.wantStatus, status, message)
+			}
+			if !strings.Contains(message, tt.wantMessage) {
+				t.Errorf("Expected message to contain %q, got %q", tt.wantMessage, message)
+			}
+		})
+	}
+}
+
+func TestRolloutBatch(t *testing.T) {
+	tests := []struct {
+		name     string
+		strategy *types.RolloutStrategy
+		want     int
+	}{
+		{name: "no strategy", want: 0},
+		{name: "batch size", strategy: &types.RolloutStrategy{BatchSize: 3}, want: 3},
+		{name: "max unavailable", strategy: &types.RolloutStrategy{MaxUnavailable: 2}, want: 2},
+		{name: "smaller of both", strategy: &types.RolloutStrategy{BatchSize: 5, MaxUnavailable: 2}, want: 2},
+		{name: "pause only", strategy: &types.RolloutStrategy{PauseBetweenBatchesSeconds: 30}, want: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.strategy.Batch(); got != tt.want {
+				t.Errorf("Expected batch %d, got %d", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestUnhealthyNodes(t *testing.T) {
+	bakeStart := time.Now()
+	before := bakeStart.Add(-time.Minute)
+	after := bakeStart.Add(time.Second)
+
+	records := []database.ComponentDeployment{
+		{NodeHostname: "a", Status: "running", HealthStatus: "healthy", LastHealthCheck: &after},
+		{NodeHostname: "b", Status: "running", HealthStatus: "unhealthy", LastHealthCheck: &before},
+		{NodeHostname: "c", Status: "running", HealthStatus: "unhealthy", LastHealthCheck: &after},
+		{NodeHostname: "d", Status: "failed"},
+	}
+
+	got := unhealthyNodes(records, bakeStart)
+	want := []string{"c (unhealthy)", "d (failed)"}
+	if len(got) != len(want) {
+		t.Fatalf("Expected %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Expected %q, got %q", want[i], got[i])
+		}
+	}
+}
+
+func TestFailedUpdates(t *testing.T) {
+	since := time.Now()
+	later := since.Add(time.Second)
+
+	updated := []types.ComponentConfig{
+		{Name: "api", Handler: "agent"},
+		{Name: "web", Handler: "agent"},
+		{Name: "worker", Handler: "agent"},
+		{Name: "job", Handler: "nomad"},
+	}
+	records := []database.ComponentDeployment{
+		{ComponentName: "api", NodeHostname: "a", Status: "running"},
+		{ComponentName: "web", NodeHostname: "a", Status: "running", HealthStatus: "unhealthy", LastHealthCheck: &later},
+	}
+	componentErrors := map[string]error{
+		"worker": errRolloutHalted,
+		"job":    errors.New("nomad unavailable"),
+	}
+
+	r := &Reconciler{}
+	got := r.failedUpdates(updated, records, componentErrors, since)
+	if strings.Join(got, ",") != "web,worker" {
+		t.Errorf("Expected web and worker to need a rollback, got %v", got)
+	}
+}
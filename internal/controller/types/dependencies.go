@@ -0,0 +1,59 @@
+package types
+
+// DependencyOrder orders components so each comes after the components it
+// depends on, keeping their order otherwise. It returns indexes into
+// components. Dependencies on components that aren't listed are ignored.
+// When the dependencies form a cycle, it returns the names around the cycle
+// instead, starting and ending with the same component.
+func DependencyOrder(components []ComponentConfig) (order []int, cycle []string) {
+	index := make(map[string]int, len(components))
+	for i := range components {
+		index[components[i].Name] = i
+	}
+
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make([]int, len(components))
+	var path []int
+
+	var visit func(i int) bool
+	visit = func(i int) bool {
+		switch state[i] {
+		case visited:
+			return true
+		case visiting:
+			// The cycle is the part of the path from the first visit
+			start := len(path) - 1
+			for path[start] != i {
+				start--
+			}
+			for _, j := range path[start:] {
+				cycle = append(cycle, components[j].Name)
+			}
+			cycle = append(cycle, components[i].Name)
+			return false
+		}
+
+		state[i] = visiting
+		path = append(path, i)
+		for _, dependency := range components[i].DependsOn {
+			if j, ok := index[dependency]; ok && !visit(j) {
+				return false
+			}
+		}
+		path = path[:len(path)-1]
+		state[i] = visited
+		order = append(order, i)
+		return true
+	}
+
+	for i := range components {
+		if !visit(i) {
+			return nil, cycle
+		}
+	}
+	return order, nil
+}
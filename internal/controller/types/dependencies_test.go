@@ -0,0 +1,68 @@
+package types
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDependencyOrder(t *testing.T) {
+	component := func(name string, dependsOn ...string) ComponentConfig {
+		return ComponentConfig{Name: name, DependsOn: dependsOn}
+	}
+
+	tests := []struct {
+		name       string
+		components []ComponentConfig
+		want       string
+	}{
+		{"no dependencies keep their order", []ComponentConfig{component("a"), component("b"), component("c")}, "a,b,c"},
+		{"dependency listed later", []ComponentConfig{component("app", "db"), component("db")}, "db,app"},
+		{"chain", []ComponentConfig{component("web", "api"), component("api", "db"), component("db")}, "db,api,web"},
+		{"shared dependency", []ComponentConfig{component("a", "db"), component("b", "db", "cache"), component("cache"), component("db")}, "db,a,cache,b"},
+		{"unlisted dependency ignored", []ComponentConfig{component("app", "existing"), component("db")}, "app,db"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			order, cycle := DependencyOrder(tt.components)
+			if cycle != nil {
+				t.Fatalf("Expected no cycle, got %v", cycle)
+			}
+			names := make([]string, len(order))
+			for i, index := range order {
+				names[i] = tt.components[index].Name
+			}
+			if got := strings.Join(names, ","); got != tt.want {
+				t.Errorf("Expected order %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestDependencyOrderDetectsCycles(t *testing.T) {
+	tests := []struct {
+		name       string
+		components []ComponentConfig
+		want       string
+	}{
+		{"self", []ComponentConfig{{Name: "a", DependsOn: []string{"a"}}}, "a -> a"},
+		{"pair", []ComponentConfig{{Name: "a", DependsOn: []string{"b"}}, {Name: "b", DependsOn: []string{"a"}}}, "a -> b -> a"},
+		{"behind another component", []ComponentConfig{
+			{Name: "app", DependsOn: []string{"api"}},
+			{Name: "api", DependsOn: []string{"db"}},
+			{Name: "db", DependsOn: []string{"api"}},
+		}, "api -> db -> api"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			order, cycle := DependencyOrder(tt.components)
+			if order != nil {
+				t.Errorf("Expected no order for a cycle, got %v", order)
+			}
+			if got := strings.Join(cycle, " -> "); got != tt.want {
+				t.Errorf("Expected cycle %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
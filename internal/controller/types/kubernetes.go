@@ -0,0 +1,53 @@
+package types
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// UsesKubernetes reports whether a service is deployed with the kubernetes
+// handler: it names the handler, or leaves it unset and has a manifest
+func (c *ComponentConfig) UsesKubernetes() bool {
+	return c.Handler == "kubernetes" || (c.Handler == "" && c.K8sManifest != "")
+}
+
+// ParseK8sManifest returns the objects of a Kubernetes manifest, in order.
+// The manifest is YAML or JSON and may hold several documents separated by
+// ---. Every object needs an apiVersion, a kind and a name.
+func ParseK8sManifest(manifest string) ([]map[string]interface{}, error) {
+	decoder := yaml.NewDecoder(strings.NewReader(manifest))
+
+	var objects []map[string]interface{}
+	for i := 0; ; i++ {
+		var object map[string]interface{}
+		err := decoder.Decode(&object)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("document %d: %w", i, err)
+		}
+		// Empty documents, like one after a trailing ---, are skipped
+		if object == nil {
+			continue
+		}
+
+		apiVersion, _ := object["apiVersion"].(string)
+		kind, _ := object["kind"].(string)
+		metadata, _ := object["metadata"].(map[string]interface{})
+		name, _ := metadata["name"].(string)
+		if apiVersion == "" || kind == "" || name == "" {
+			return nil, fmt.Errorf("document %d: apiVersion, kind and metadata.name are required", i)
+		}
+		objects = append(objects, object)
+	}
+
+	if len(objects) == 0 {
+		return nil, fmt.Errorf("manifest has no objects")
+	}
+	return objects, nil
+}
@@ -1,9 +1,19 @@
 package types
 
-import "encoding/json"
+import (
+	"encoding/json"
+	"regexp"
+)
 
 type ConfigurationRequest struct {
 	Components []ComponentConfig `json:"components"`
+
+	// RequireApproval holds the deployment in pending-approval until it is
+	// approved through the API
+	RequireApproval bool `json:"require_approval,omitempty"`
+
+	// Rollout applies to every component that doesn't set its own
+	Rollout *RolloutStrategy `json:"rollout,omitempty"`
 }
 
 type ComponentConfig struct {
@@ -15,12 +25,118 @@ type ComponentConfig struct {
 	Content            string             `json:"content,omitempty"`
 	ContentURL         string             `json:"content_url,omitempty"`
 	ContentURLEncoding string             `json:"content_url_encoding,omitempty"`
+	ContentMirrors     []ContentMirror    `json:"content_mirrors,omitempty"`
+	ContentURLHeaders  map[string]string  `json:"content_url_headers,omitempty"`
+	Entrypoint         string             `json:"entrypoint,omitempty"`
+	SignatureURL       string             `json:"signature_url,omitempty"`
+	PublicKey          string             `json:"public_key,omitempty"`
 	NomadJob           string             `json:"nomad_job,omitempty"`
 	NomadJobData       *json.RawMessage   `json:"nomad_job_data,omitempty"`
+	NomadJobFormat     string             `json:"nomad_job_format,omitempty"`
+	NomadNamespace     string             `json:"nomad_namespace,omitempty"`
+	NomadRegion        string             `json:"nomad_region,omitempty"`
+	K8sManifest        string             `json:"k8s_manifest,omitempty"`
+	K8sNamespace       string             `json:"k8s_namespace,omitempty"`
 	Managed            bool               `json:"managed,omitempty"`
+	MemoryLimit        int64              `json:"memory_limit,omitempty"`
+	CPULimit           float64            `json:"cpu_limit,omitempty"`
+	MaxOpenFiles       int64              `json:"max_open_files,omitempty"`
+	RunAsUser          string             `json:"run_as_user,omitempty"`
+	RunAsGroup         string             `json:"run_as_group,omitempty"`
+	WorkingDir         string             `json:"working_dir,omitempty"`
 	HealthCheck        *HealthCheckConfig `json:"health_check,omitempty"`
 	Env                map[string]string  `json:"env,omitempty"`
 	Args               []string           `json:"args,omitempty"`
+	Affinity           []string           `json:"affinity,omitempty"`
+	AntiAffinity       []string           `json:"anti_affinity,omitempty"`
+	WaitFor            []WaitForConfig    `json:"wait_for,omitempty"`
+	DependsOn          []string           `json:"depends_on,omitempty"`
+	Replicas           int                `json:"replicas,omitempty"`
+	Canary             *CanaryConfig      `json:"canary,omitempty"`
+	Rollout            *RolloutStrategy   `json:"rollout,omitempty"`
+}
+
+// hclJobPattern matches the job block that opens an HCL job specification
+var hclJobPattern = regexp.MustCompile(`(?m)^\s*job\s+"[^"]*"\s*\{`)
+
+// NomadJobIsHCL reports whether a service's nomad_job is HCL, which Nomad
+// has to convert to JSON before it can be submitted. NomadJobFormat decides
+// when it is set; otherwise the job is HCL if it opens with a job block.
+func (c *ComponentConfig) NomadJobIsHCL() bool {
+	switch c.NomadJobFormat {
+	case "hcl":
+		return true
+	case "json":
+		return false
+	}
+	return c.NomadJobData == nil && hclJobPattern.MatchString(c.NomadJob)
+}
+
+// RolloutStrategy deploys a component to its agents in batches: each batch
+// must be running before the next one starts, and a failed batch halts the
+// rollout. MaxUnavailable is the same limit under its Kubernetes name; when
+// both are set the smaller one applies. Without a strategy every node is
+// deployed at once.
+//
+// With CanaryCount set, that many nodes are deployed first and watched for
+// CanaryBakeSeconds (5 minutes by default). The rest of the nodes are only
+// deployed if the canaries stay running and healthy, or earlier if the
+// rollout is promoted through the API.
+type RolloutStrategy struct {
+	BatchSize                  int `json:"batch_size,omitempty"`
+	MaxUnavailable             int `json:"max_unavailable,omitempty"`
+	PauseBetweenBatchesSeconds int `json:"pause_between_batches_seconds,omitempty"`
+	CanaryCount                int `json:"canary_count,omitempty"`
+	CanaryBakeSeconds          int `json:"canary_bake_seconds,omitempty"`
+}
+
+// Batch returns how many nodes are deployed at a time, or 0 for all of them
+func (s *RolloutStrategy) Batch() int {
+	if s == nil {
+		return 0
+	}
+	switch {
+	case s.BatchSize > 0 && s.MaxUnavailable > 0:
+		return min(s.BatchSize, s.MaxUnavailable)
+	case s.BatchSize > 0:
+		return s.BatchSize
+	default:
+		return max(s.MaxUnavailable, 0)
+	}
+}
+
+// Canaries returns how many nodes are deployed ahead of the rest, or 0 for
+// no canary phase
+func (s *RolloutStrategy) Canaries() int {
+	if s == nil {
+		return 0
+	}
+	return max(s.CanaryCount, 0)
+}
+
+// CanaryConfig enables canary analysis of updates on the agent: the health
+// check success rate over the window after an update is compared with the
+// window before it, and the update is rolled back if it dropped by more
+// than MaxDegradationPercent points.
+type CanaryConfig struct {
+	WindowSeconds         int32 `json:"window_seconds,omitempty"`
+	MaxDegradationPercent int32 `json:"max_degradation_percent,omitempty"`
+	MinSamples            int32 `json:"min_samples,omitempty"`
+}
+
+// WaitForConfig is an external endpoint that must be reachable before the
+// agent starts the component
+type WaitForConfig struct {
+	Type           string `json:"type"`
+	Endpoint       string `json:"endpoint"`
+	TimeoutSeconds int32  `json:"timeout_seconds,omitempty"`
+}
+
+// ContentMirror is an alternative location for a program's archive. Agents
+// fall back to mirrors when content_url can't be downloaded.
+type ContentMirror struct {
+	URL    string `json:"url"`
+	Weight int32  `json:"weight,omitempty"`
 }
 
 type HealthCheckConfig struct {
@@ -29,4 +145,30 @@ type HealthCheckConfig struct {
 	IntervalSeconds int32  `json:"interval_seconds"`
 	TimeoutSeconds  int32  `json:"timeout_seconds"`
 	Retries         int32  `json:"retries"`
+	Pattern         string `json:"pattern,omitempty"`
+	ErrorPattern    string `json:"error_pattern,omitempty"`
+
+	// Port-only checks target localhost on the component's node
+	Port   int32  `json:"port,omitempty"`
+	Scheme string `json:"scheme,omitempty"`
+	Path   string `json:"path,omitempty"`
+
+	// TLS makes grpc checks connect over TLS
+	TLS bool `json:"tls,omitempty"`
+
+	// HTTP checks: the request method and headers, a substring or regular
+	// expression the body must match, and the allowed status codes (any 2xx
+	// when empty)
+	Method         string            `json:"method,omitempty"`
+	Headers        map[string]string `json:"headers,omitempty"`
+	ExpectedBody   string            `json:"expected_body,omitempty"`
+	ExpectedStatus []int32           `json:"expected_status,omitempty"`
+
+	// RestartOnUnhealthy restarts a managed component that is still running
+	// but has failed Retries checks in a row
+	RestartOnUnhealthy bool `json:"restart_on_unhealthy,omitempty"`
+
+	// StartPeriodSeconds is a grace period after the component starts during
+	// which failed checks aren't counted
+	StartPeriodSeconds int32 `json:"start_period_seconds,omitempty"`
 }
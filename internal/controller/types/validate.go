@@ -0,0 +1,272 @@
+package types
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/metorial/fleet/cosmos/internal/util"
+	"golang.org/x/net/http/httpguts"
+)
+
+// handlersByType lists the handlers each component type can be deployed with
+var handlersByType = map[string][]string{
+	"script":  {"agent", "command-core"},
+	"program": {"agent"},
+	"service": {"nomad", "kubernetes"},
+}
+
+var healthCheckTypes = map[string]bool{
+	"http":    true,
+	"tcp":     true,
+	"grpc":    true,
+	"process": true,
+	"log":     true,
+	"exec":    true,
+}
+
+// FieldError is a problem with one field of a configuration request. Field is
+// the JSON path of the field, e.g. components[0].content_url.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationErrors is every problem found in a configuration request
+type ValidationErrors []FieldError
+
+func (e ValidationErrors) Error() string {
+	messages := make([]string, len(e))
+	for i, fieldErr := range e {
+		messages[i] = fieldErr.Field + ": " + fieldErr.Message
+	}
+	return strings.Join(messages, "; ")
+}
+
+func (e *ValidationErrors) add(field, format string, args ...any) {
+	*e = append(*e, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// ValidateConfiguration checks a configuration request before it is accepted
+// and returns every problem found, or nil if there are none. Component names
+// are expected to be normalized already.
+func ValidateConfiguration(req *ConfigurationRequest) ValidationErrors {
+	var errs ValidationErrors
+
+	seen := make(map[string]bool, len(req.Components))
+	for i := range req.Components {
+		comp := &req.Components[i]
+		prefix := fmt.Sprintf("components[%d]", i)
+
+		if err := util.ValidateComponentName(comp.Name); err != nil {
+			errs.add(prefix+".name", "%v", err)
+		} else if seen[comp.Name] {
+			errs.add(prefix+".name", "duplicate component name %q", comp.Name)
+		}
+		seen[comp.Name] = true
+
+		validateComponent(&errs, prefix, comp)
+	}
+
+	validateDependencies(&errs, req.Components)
+
+	if !validRollout(req.Rollout) {
+		errs.add("rollout", "values must not be negative")
+	}
+
+	return errs
+}
+
+func validateComponent(errs *ValidationErrors, prefix string, comp *ComponentConfig) {
+	handlers, known := handlersByType[comp.Type]
+	switch {
+	case comp.Type == "":
+		errs.add(prefix+".type", "type is required")
+	case !known:
+		errs.add(prefix+".type", "unknown type %q: must be script, program or service", comp.Type)
+	case comp.Handler != "" && !slices.Contains(handlers, comp.Handler):
+		errs.add(prefix+".handler", "handler %q can't deploy %s components: must be %s", comp.Handler, comp.Type, strings.Join(handlers, " or "))
+	}
+
+	switch comp.Type {
+	case "script":
+		if comp.Content != "" && comp.ContentURL != "" {
+			errs.add(prefix+".content", "content and content_url are mutually exclusive")
+		} else if comp.Content == "" && comp.ContentURL == "" {
+			errs.add(prefix+".content", "content or content_url is required for scripts")
+		}
+	case "program":
+		if comp.ContentURL == "" {
+			errs.add(prefix+".content_url", "content_url is required for programs")
+		}
+	case "service":
+		if comp.UsesKubernetes() {
+			if comp.K8sManifest == "" {
+				errs.add(prefix+".k8s_manifest", "k8s_manifest is required for the kubernetes handler")
+			} else if _, err := ParseK8sManifest(comp.K8sManifest); err != nil {
+				errs.add(prefix+".k8s_manifest", "invalid manifest: %v", err)
+			}
+			break
+		}
+
+		switch {
+		case comp.NomadJobFormat != "" && comp.NomadJobFormat != "json" && comp.NomadJobFormat != "hcl":
+			errs.add(prefix+".nomad_job_format", "invalid format %q: must be json or hcl", comp.NomadJobFormat)
+		case comp.NomadJobIsHCL() && comp.NomadJob == "":
+			errs.add(prefix+".nomad_job", "nomad_job is required for HCL jobs")
+		case comp.NomadJob == "" && comp.NomadJobData == nil:
+			errs.add(prefix+".nomad_job", "nomad_job is required for services")
+		case comp.NomadJob != "" && !comp.NomadJobIsHCL() && !json.Valid([]byte(comp.NomadJob)):
+			errs.add(prefix+".nomad_job", "not valid JSON")
+		}
+	}
+
+	for j, wait := range comp.WaitFor {
+		field := fmt.Sprintf("%s.wait_for[%d]", prefix, j)
+		if wait.Type != "tcp" && wait.Type != "http" {
+			errs.add(field+".type", "invalid type %q: must be tcp or http", wait.Type)
+		}
+		if wait.Endpoint == "" {
+			errs.add(field+".endpoint", "endpoint is required")
+		}
+	}
+
+	for j, mirror := range comp.ContentMirrors {
+		field := fmt.Sprintf("%s.content_mirrors[%d]", prefix, j)
+		if mirror.URL == "" {
+			errs.add(field+".url", "url is required")
+		}
+		if mirror.Weight < 0 {
+			errs.add(field+".weight", "weight must not be negative")
+		}
+	}
+
+	for name := range comp.ContentURLHeaders {
+		if !httpguts.ValidHeaderFieldName(name) {
+			errs.add(prefix+".content_url_headers", "invalid header name %q", name)
+		}
+	}
+
+	if hc := comp.HealthCheck; hc != nil {
+		validateHealthCheck(errs, prefix+".health_check", hc)
+	}
+
+	if comp.Entrypoint != "" {
+		entrypoint := filepath.Clean(comp.Entrypoint)
+		if filepath.IsAbs(entrypoint) || entrypoint == ".." || strings.HasPrefix(entrypoint, "../") {
+			errs.add(prefix+".entrypoint", "must be a path inside the archive")
+		}
+	}
+
+	if comp.SignatureURL != "" && comp.PublicKey == "" {
+		errs.add(prefix+".public_key", "public_key is required with signature_url")
+	}
+
+	limits := []struct {
+		field string
+		value float64
+	}{
+		{"memory_limit", float64(comp.MemoryLimit)},
+		{"cpu_limit", comp.CPULimit},
+		{"max_open_files", float64(comp.MaxOpenFiles)},
+	}
+	for _, limit := range limits {
+		switch {
+		case limit.value < 0:
+			errs.add(prefix+"."+limit.field, "must not be negative")
+		case limit.value > 0 && comp.Type != "program":
+			errs.add(prefix+"."+limit.field, "only applies to programs")
+		}
+	}
+
+	if comp.WorkingDir != "" {
+		if comp.Type == "service" {
+			errs.add(prefix+".working_dir", "only applies to programs and scripts")
+		} else if !filepath.IsAbs(comp.WorkingDir) {
+			errs.add(prefix+".working_dir", "must be an absolute path")
+		}
+	}
+
+	// Unmanaged scripts run in the host's namespaces, where the agent can't
+	// resolve users
+	if comp.RunAsUser != "" || comp.RunAsGroup != "" {
+		if comp.Type == "service" || (comp.Type == "script" && !comp.Managed) {
+			errs.add(prefix+".run_as_user", "only applies to programs and managed scripts")
+		}
+	}
+
+	if comp.Replicas < 0 {
+		errs.add(prefix+".replicas", "must not be negative")
+	} else if comp.Replicas > 0 && comp.Type == "service" {
+		errs.add(prefix+".replicas", "only applies to programs and scripts")
+	}
+
+	if !validRollout(comp.Rollout) {
+		errs.add(prefix+".rollout", "values must not be negative")
+	}
+
+	if canary := comp.Canary; canary != nil {
+		if canary.WindowSeconds < 0 || canary.MinSamples < 0 {
+			errs.add(prefix+".canary", "window_seconds and min_samples must not be negative")
+		}
+		if canary.MaxDegradationPercent < 0 || canary.MaxDegradationPercent > 100 {
+			errs.add(prefix+".canary.max_degradation_percent", "must be between 0 and 100")
+		}
+	}
+}
+
+// validateDependencies checks that components only depend on components in
+// the same request, and that they can be deployed in some order
+func validateDependencies(errs *ValidationErrors, components []ComponentConfig) {
+	names := make(map[string]bool, len(components))
+	for i := range components {
+		names[components[i].Name] = true
+	}
+
+	for i := range components {
+		for j, dependency := range components[i].DependsOn {
+			if !names[dependency] {
+				errs.add(fmt.Sprintf("components[%d].depends_on[%d]", i, j), "unknown component %q", dependency)
+			}
+		}
+	}
+
+	if _, cycle := DependencyOrder(components); cycle != nil {
+		for i := range components {
+			if components[i].Name == cycle[0] {
+				errs.add(fmt.Sprintf("components[%d].depends_on", i), "dependency cycle: %s", strings.Join(cycle, " -> "))
+				break
+			}
+		}
+	}
+}
+
+func validateHealthCheck(errs *ValidationErrors, prefix string, hc *HealthCheckConfig) {
+	if !healthCheckTypes[hc.Type] {
+		errs.add(prefix+".type", "invalid type %q: must be http, tcp, grpc, process, log or exec", hc.Type)
+	}
+	if hc.StartPeriodSeconds < 0 {
+		errs.add(prefix+".start_period_seconds", "must not be negative")
+	}
+	if hc.Method != "" && !httpguts.ValidHeaderFieldName(hc.Method) {
+		errs.add(prefix+".method", "invalid method %q", hc.Method)
+	}
+	for name := range hc.Headers {
+		if !httpguts.ValidHeaderFieldName(name) {
+			errs.add(prefix+".headers", "invalid header name %q", name)
+		}
+	}
+	for _, code := range hc.ExpectedStatus {
+		if code < 100 || code > 599 {
+			errs.add(prefix+".expected_status", "invalid status %d", code)
+		}
+	}
+}
+
+func validRollout(rollout *RolloutStrategy) bool {
+	return rollout == nil ||
+		(rollout.BatchSize >= 0 && rollout.MaxUnavailable >= 0 && rollout.PauseBetweenBatchesSeconds >= 0 &&
+			rollout.CanaryCount >= 0 && rollout.CanaryBakeSeconds >= 0)
+}
@@ -0,0 +1,135 @@
+package types
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestValidateConfigurationAcceptsValidComponents(t *testing.T) {
+	job := json.RawMessage(`{"ID":"web"}`)
+	req := &ConfigurationRequest{Components: []ComponentConfig{
+		{Type: "script", Name: "setup", Content: "echo hi"},
+		{Type: "script", Name: "daemon", ContentURL: "https://example.com/d.sh", Managed: true, Handler: "agent"},
+		{Type: "program", Name: "app", ContentURL: "https://example.com/app.tar.gz",
+			HealthCheck: &HealthCheckConfig{Type: "http", Endpoint: "http://localhost:8080/health"}},
+		{Type: "program", Name: "bounded", ContentURL: "https://example.com/app.tar.gz",
+			MemoryLimit: 512 << 20, CPULimit: 0.5, MaxOpenFiles: 1024, RunAsUser: "app", RunAsGroup: "app", WorkingDir: "/srv/app"},
+		{Type: "service", Name: "web", NomadJobData: &job},
+		{Type: "service", Name: "api", NomadJob: `{"ID":"api"}`},
+		{Type: "service", Name: "worker", NomadJob: "job \"worker\" {\n  type = \"batch\"\n}"},
+		{Type: "service", Name: "cron", NomadJob: "variable \"image\" {}", NomadJobFormat: "hcl"},
+		{Type: "service", Name: "k8s", K8sManifest: "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: k8s\n---\n"},
+	}}
+
+	if errs := ValidateConfiguration(req); len(errs) != 0 {
+		t.Errorf("Expected no errors, got %v", errs)
+	}
+}
+
+func TestValidateConfiguration(t *testing.T) {
+	program := func(modify func(*ComponentConfig)) ComponentConfig {
+		comp := ComponentConfig{Type: "program", Name: "app", ContentURL: "https://example.com/app.tar.gz"}
+		modify(&comp)
+		return comp
+	}
+
+	tests := []struct {
+		name      string
+		component ComponentConfig
+		field     string
+	}{
+		{"empty name", program(func(c *ComponentConfig) { c.Name = "" }), "components[0].name"},
+		{"invalid name", program(func(c *ComponentConfig) { c.Name = "../app" }), "components[0].name"},
+		{"missing type", program(func(c *ComponentConfig) { c.Type = "" }), "components[0].type"},
+		{"unknown type", program(func(c *ComponentConfig) { c.Type = "container" }), "components[0].type"},
+		{"program without content_url", program(func(c *ComponentConfig) { c.ContentURL = "" }), "components[0].content_url"},
+		{"program with nomad handler", program(func(c *ComponentConfig) { c.Handler = "nomad" }), "components[0].handler"},
+		{"service without nomad_job", ComponentConfig{Type: "service", Name: "web"}, "components[0].nomad_job"},
+		{"service with invalid nomad_job", ComponentConfig{Type: "service", Name: "web", NomadJob: "job {"}, "components[0].nomad_job"},
+		{"service with unknown job format", ComponentConfig{Type: "service", Name: "web", NomadJob: "{}", NomadJobFormat: "yaml"}, "components[0].nomad_job_format"},
+		{"HCL service without nomad_job", ComponentConfig{Type: "service", Name: "web", NomadJobFormat: "hcl"}, "components[0].nomad_job"},
+		{"kubernetes service without manifest", ComponentConfig{Type: "service", Name: "web", Handler: "kubernetes"}, "components[0].k8s_manifest"},
+		{"kubernetes object without name", ComponentConfig{Type: "service", Name: "web", K8sManifest: "apiVersion: v1\nkind: ConfigMap\n"}, "components[0].k8s_manifest"},
+		{"service with agent handler", ComponentConfig{Type: "service", Name: "web", NomadJob: "{}", Handler: "agent"}, "components[0].handler"},
+		{"script with content and url", ComponentConfig{Type: "script", Name: "s", Content: "echo", ContentURL: "https://example.com/s.sh"}, "components[0].content"},
+		{"script without content", ComponentConfig{Type: "script", Name: "s"}, "components[0].content"},
+		{"invalid health check type", program(func(c *ComponentConfig) { c.HealthCheck = &HealthCheckConfig{Type: "ping"} }), "components[0].health_check.type"},
+		{"invalid expected status", program(func(c *ComponentConfig) {
+			c.HealthCheck = &HealthCheckConfig{Type: "http", ExpectedStatus: []int32{700}}
+		}), "components[0].health_check.expected_status"},
+		{"invalid wait_for type", program(func(c *ComponentConfig) {
+			c.WaitFor = []WaitForConfig{{Type: "udp", Endpoint: "db:5432"}}
+		}), "components[0].wait_for[0].type"},
+		{"wait_for without endpoint", program(func(c *ComponentConfig) {
+			c.WaitFor = []WaitForConfig{{Type: "tcp"}}
+		}), "components[0].wait_for[0].endpoint"},
+		{"mirror without url", program(func(c *ComponentConfig) { c.ContentMirrors = []ContentMirror{{Weight: 1}} }), "components[0].content_mirrors[0].url"},
+		{"entrypoint outside archive", program(func(c *ComponentConfig) { c.Entrypoint = "../bin/app" }), "components[0].entrypoint"},
+		{"signature without public key", program(func(c *ComponentConfig) { c.SignatureURL = "https://example.com/app.sig" }), "components[0].public_key"},
+		{"negative rollout", program(func(c *ComponentConfig) { c.Rollout = &RolloutStrategy{BatchSize: -1} }), "components[0].rollout"},
+		{"canary degradation over 100", program(func(c *ComponentConfig) {
+			c.Canary = &CanaryConfig{MaxDegradationPercent: 150}
+		}), "components[0].canary.max_degradation_percent"},
+		{"negative memory limit", program(func(c *ComponentConfig) { c.MemoryLimit = -1 }), "components[0].memory_limit"},
+		{"cpu limit on a script", ComponentConfig{Type: "script", Name: "setup", Content: "echo hi", CPULimit: 1}, "components[0].cpu_limit"},
+		{"relative working dir", program(func(c *ComponentConfig) { c.WorkingDir = "srv/app" }), "components[0].working_dir"},
+		{"negative replicas", program(func(c *ComponentConfig) { c.Replicas = -1 }), "components[0].replicas"},
+		{"replicas on a service", ComponentConfig{Type: "service", Name: "web", NomadJob: "{}", Replicas: 2}, "components[0].replicas"},
+		{"run_as_user on an unmanaged script", ComponentConfig{Type: "script", Name: "setup", Content: "echo hi", RunAsUser: "app"}, "components[0].run_as_user"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errs := ValidateConfiguration(&ConfigurationRequest{Components: []ComponentConfig{tt.component}})
+			if len(errs) != 1 || errs[0].Field != tt.field {
+				t.Errorf("Expected one error for %s, got %v", tt.field, errs)
+			}
+		})
+	}
+}
+
+func TestValidateConfigurationReportsEveryError(t *testing.T) {
+	req := &ConfigurationRequest{
+		Components: []ComponentConfig{
+			{Type: "program", Name: "app", ContentURL: "https://example.com/app.tar.gz"},
+			{Type: "program", Name: "app"},
+			{Type: "daemon", Name: "other"},
+		},
+		Rollout: &RolloutStrategy{PauseBetweenBatchesSeconds: -5},
+	}
+
+	errs := ValidateConfiguration(req)
+
+	want := []string{"components[1].name", "components[1].content_url", "components[2].type", "rollout"}
+	if len(errs) != len(want) {
+		t.Fatalf("Expected %d errors, got %v", len(want), errs)
+	}
+	for i, field := range want {
+		if errs[i].Field != field {
+			t.Errorf("Expected error %d for %s, got %s", i, field, errs[i].Field)
+		}
+	}
+}
+
+func TestValidateConfigurationDependencies(t *testing.T) {
+	script := func(name string, dependsOn ...string) ComponentConfig {
+		return ComponentConfig{Type: "script", Name: name, Content: "echo hi", DependsOn: dependsOn}
+	}
+
+	req := &ConfigurationRequest{Components: []ComponentConfig{script("app", "db"), script("db")}}
+	if errs := ValidateConfiguration(req); len(errs) != 0 {
+		t.Errorf("Expected no errors, got %v", errs)
+	}
+
+	req = &ConfigurationRequest{Components: []ComponentConfig{script("app", "db", "cache"), script("db")}}
+	errs := ValidateConfiguration(req)
+	if len(errs) != 1 || errs[0].Field != "components[0].depends_on[1]" {
+		t.Errorf("Expected the unknown dependency to be reported, got %v", errs)
+	}
+
+	req = &ConfigurationRequest{Components: []ComponentConfig{script("setup"), script("app", "db"), script("db", "app")}}
+	errs = ValidateConfiguration(req)
+	if len(errs) != 1 || errs[0].Field != "components[1].depends_on" || errs[0].Message != "dependency cycle: app -> db -> app" {
+		t.Errorf("Expected the cycle to be reported, got %v", errs)
+	}
+}
@@ -32,6 +32,7 @@ type AgentMessage struct {
 	//	*AgentMessage_HealthResult
 	//	*AgentMessage_DeploymentResult
 	//	*AgentMessage_LogChunk
+	//	*AgentMessage_LogResponse
 	Message       isAgentMessage_Message `protobuf_oneof:"message"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
@@ -133,6 +134,15 @@ func (x *AgentMessage) GetLogChunk() *LogChunk {
 	return nil
 }
 
+func (x *AgentMessage) GetLogResponse() *LogResponse {
+	if x != nil {
+		if x, ok := x.Message.(*AgentMessage_LogResponse); ok {
+			return x.LogResponse
+		}
+	}
+	return nil
+}
+
 type isAgentMessage_Message interface {
 	isAgentMessage_Message()
 }
@@ -157,6 +167,10 @@ type AgentMessage_LogChunk struct {
 	LogChunk *LogChunk `protobuf:"bytes,7,opt,name=log_chunk,json=logChunk,proto3,oneof"`
 }
 
+type AgentMessage_LogResponse struct {
+	LogResponse *LogResponse `protobuf:"bytes,8,opt,name=log_response,json=logResponse,proto3,oneof"`
+}
+
 func (*AgentMessage_Heartbeat) isAgentMessage_Message() {}
 
 func (*AgentMessage_ComponentStatus) isAgentMessage_Message() {}
@@ -167,6 +181,8 @@ func (*AgentMessage_DeploymentResult) isAgentMessage_Message() {}
 
 func (*AgentMessage_LogChunk) isAgentMessage_Message() {}
 
+func (*AgentMessage_LogResponse) isAgentMessage_Message() {}
+
 type ControllerMessage struct {
 	state protoimpl.MessageState `protogen:"open.v1"`
 	// Types that are valid to be assigned to Message:
@@ -175,6 +191,9 @@ type ControllerMessage struct {
 	//	*ControllerMessage_Deployment
 	//	*ControllerMessage_Removal
 	//	*ControllerMessage_HealthConfig
+	//	*ControllerMessage_LogLevel
+	//	*ControllerMessage_LogRequest
+	//	*ControllerMessage_Control
 	Message       isControllerMessage_Message `protobuf_oneof:"message"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
@@ -253,6 +272,33 @@ func (x *ControllerMessage) GetHealthConfig() *HealthCheckConfig {
 	return nil
 }
 
+func (x *ControllerMessage) GetLogLevel() *LogLevelChange {
+	if x != nil {
+		if x, ok := x.Message.(*ControllerMessage_LogLevel); ok {
+			return x.LogLevel
+		}
+	}
+	return nil
+}
+
+func (x *ControllerMessage) GetLogRequest() *LogRequest {
+	if x != nil {
+		if x, ok := x.Message.(*ControllerMessage_LogRequest); ok {
+			return x.LogRequest
+		}
+	}
+	return nil
+}
+
+func (x *ControllerMessage) GetControl() *ComponentControl {
+	if x != nil {
+		if x, ok := x.Message.(*ControllerMessage_Control); ok {
+			return x.Control
+		}
+	}
+	return nil
+}
+
 type isControllerMessage_Message interface {
 	isControllerMessage_Message()
 }
@@ -273,6 +319,18 @@ type ControllerMessage_HealthConfig struct {
 	HealthConfig *HealthCheckConfig `protobuf:"bytes,4,opt,name=health_config,json=healthConfig,proto3,oneof"`
 }
 
+type ControllerMessage_LogLevel struct {
+	LogLevel *LogLevelChange `protobuf:"bytes,5,opt,name=log_level,json=logLevel,proto3,oneof"`
+}
+
+type ControllerMessage_LogRequest struct {
+	LogRequest *LogRequest `protobuf:"bytes,6,opt,name=log_request,json=logRequest,proto3,oneof"`
+}
+
+type ControllerMessage_Control struct {
+	Control *ComponentControl `protobuf:"bytes,7,opt,name=control,proto3,oneof"`
+}
+
 func (*ControllerMessage_Ack) isControllerMessage_Message() {}
 
 func (*ControllerMessage_Deployment) isControllerMessage_Message() {}
@@ -281,12 +339,19 @@ func (*ControllerMessage_Removal) isControllerMessage_Message() {}
 
 func (*ControllerMessage_HealthConfig) isControllerMessage_Message() {}
 
+func (*ControllerMessage_LogLevel) isControllerMessage_Message() {}
+
+func (*ControllerMessage_LogRequest) isControllerMessage_Message() {}
+
+func (*ControllerMessage_Control) isControllerMessage_Message() {}
+
 type AgentHeartbeat struct {
 	state             protoimpl.MessageState `protogen:"open.v1"`
 	AgentVersion      string                 `protobuf:"bytes,1,opt,name=agent_version,json=agentVersion,proto3" json:"agent_version,omitempty"`
 	Metadata          map[string]string      `protobuf:"bytes,2,rep,name=metadata,proto3" json:"metadata,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
 	ComponentStatuses []*ComponentStatus     `protobuf:"bytes,3,rep,name=component_statuses,json=componentStatuses,proto3" json:"component_statuses,omitempty"`
 	Tags              []string               `protobuf:"bytes,4,rep,name=tags,proto3" json:"tags,omitempty"`
+	SystemMetrics     *SystemMetrics         `protobuf:"bytes,5,opt,name=system_metrics,json=systemMetrics,proto3" json:"system_metrics,omitempty"`
 	unknownFields     protoimpl.UnknownFields
 	sizeCache         protoimpl.SizeCache
 }
@@ -349,21 +414,114 @@ func (x *AgentHeartbeat) GetTags() []string {
 	return nil
 }
 
+func (x *AgentHeartbeat) GetSystemMetrics() *SystemMetrics {
+	if x != nil {
+		return x.SystemMetrics
+	}
+	return nil
+}
+
+// SystemMetrics is the node's resource usage when the heartbeat was sent
+type SystemMetrics struct {
+	state            protoimpl.MessageState `protogen:"open.v1"`
+	LoadAverage      float64                `protobuf:"fixed64,1,opt,name=load_average,json=loadAverage,proto3" json:"load_average,omitempty"`
+	CpuCount         int32                  `protobuf:"varint,2,opt,name=cpu_count,json=cpuCount,proto3" json:"cpu_count,omitempty"`
+	MemoryUsedBytes  uint64                 `protobuf:"varint,3,opt,name=memory_used_bytes,json=memoryUsedBytes,proto3" json:"memory_used_bytes,omitempty"`
+	MemoryTotalBytes uint64                 `protobuf:"varint,4,opt,name=memory_total_bytes,json=memoryTotalBytes,proto3" json:"memory_total_bytes,omitempty"`
+	DiskFreeBytes    uint64                 `protobuf:"varint,5,opt,name=disk_free_bytes,json=diskFreeBytes,proto3" json:"disk_free_bytes,omitempty"`
+	DiskTotalBytes   uint64                 `protobuf:"varint,6,opt,name=disk_total_bytes,json=diskTotalBytes,proto3" json:"disk_total_bytes,omitempty"`
+	unknownFields    protoimpl.UnknownFields
+	sizeCache        protoimpl.SizeCache
+}
+
+func (x *SystemMetrics) Reset() {
+	*x = SystemMetrics{}
+	mi := &file_internal_proto_cosmos_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SystemMetrics) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SystemMetrics) ProtoMessage() {}
+
+func (x *SystemMetrics) ProtoReflect() protoreflect.Message {
+	mi := &file_internal_proto_cosmos_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SystemMetrics.ProtoReflect.Descriptor instead.
+func (*SystemMetrics) Descriptor() ([]byte, []int) {
+	return file_internal_proto_cosmos_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *SystemMetrics) GetLoadAverage() float64 {
+	if x != nil {
+		return x.LoadAverage
+	}
+	return 0
+}
+
+func (x *SystemMetrics) GetCpuCount() int32 {
+	if x != nil {
+		return x.CpuCount
+	}
+	return 0
+}
+
+func (x *SystemMetrics) GetMemoryUsedBytes() uint64 {
+	if x != nil {
+		return x.MemoryUsedBytes
+	}
+	return 0
+}
+
+func (x *SystemMetrics) GetMemoryTotalBytes() uint64 {
+	if x != nil {
+		return x.MemoryTotalBytes
+	}
+	return 0
+}
+
+func (x *SystemMetrics) GetDiskFreeBytes() uint64 {
+	if x != nil {
+		return x.DiskFreeBytes
+	}
+	return 0
+}
+
+func (x *SystemMetrics) GetDiskTotalBytes() uint64 {
+	if x != nil {
+		return x.DiskTotalBytes
+	}
+	return 0
+}
+
 type ComponentStatus struct {
-	state         protoimpl.MessageState `protogen:"open.v1"`
-	Name          string                 `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
-	Status        string                 `protobuf:"bytes,2,opt,name=status,proto3" json:"status,omitempty"`
-	Message       string                 `protobuf:"bytes,3,opt,name=message,proto3" json:"message,omitempty"`
-	Pid           int32                  `protobuf:"varint,4,opt,name=pid,proto3" json:"pid,omitempty"`
-	LastStartedAt int64                  `protobuf:"varint,5,opt,name=last_started_at,json=lastStartedAt,proto3" json:"last_started_at,omitempty"`
-	RestartCount  int32                  `protobuf:"varint,6,opt,name=restart_count,json=restartCount,proto3" json:"restart_count,omitempty"`
-	unknownFields protoimpl.UnknownFields
-	sizeCache     protoimpl.SizeCache
+	state          protoimpl.MessageState `protogen:"open.v1"`
+	Name           string                 `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	Status         string                 `protobuf:"bytes,2,opt,name=status,proto3" json:"status,omitempty"`
+	Message        string                 `protobuf:"bytes,3,opt,name=message,proto3" json:"message,omitempty"`
+	Pid            int32                  `protobuf:"varint,4,opt,name=pid,proto3" json:"pid,omitempty"`
+	LastStartedAt  int64                  `protobuf:"varint,5,opt,name=last_started_at,json=lastStartedAt,proto3" json:"last_started_at,omitempty"`
+	RestartCount   int32                  `protobuf:"varint,6,opt,name=restart_count,json=restartCount,proto3" json:"restart_count,omitempty"`
+	RestartHistory []*RestartEvent        `protobuf:"bytes,7,rep,name=restart_history,json=restartHistory,proto3" json:"restart_history,omitempty"`
+	unknownFields  protoimpl.UnknownFields
+	sizeCache      protoimpl.SizeCache
 }
 
 func (x *ComponentStatus) Reset() {
 	*x = ComponentStatus{}
-	mi := &file_internal_proto_cosmos_proto_msgTypes[3]
+	mi := &file_internal_proto_cosmos_proto_msgTypes[4]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -375,7 +533,7 @@ func (x *ComponentStatus) String() string {
 func (*ComponentStatus) ProtoMessage() {}
 
 func (x *ComponentStatus) ProtoReflect() protoreflect.Message {
-	mi := &file_internal_proto_cosmos_proto_msgTypes[3]
+	mi := &file_internal_proto_cosmos_proto_msgTypes[4]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -388,7 +546,7 @@ func (x *ComponentStatus) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use ComponentStatus.ProtoReflect.Descriptor instead.
 func (*ComponentStatus) Descriptor() ([]byte, []int) {
-	return file_internal_proto_cosmos_proto_rawDescGZIP(), []int{3}
+	return file_internal_proto_cosmos_proto_rawDescGZIP(), []int{4}
 }
 
 func (x *ComponentStatus) GetName() string {
@@ -433,6 +591,73 @@ func (x *ComponentStatus) GetRestartCount() int32 {
 	return 0
 }
 
+func (x *ComponentStatus) GetRestartHistory() []*RestartEvent {
+	if x != nil {
+		return x.RestartHistory
+	}
+	return nil
+}
+
+type RestartEvent struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Timestamp     int64                  `protobuf:"varint,1,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
+	Reason        string                 `protobuf:"bytes,2,opt,name=reason,proto3" json:"reason,omitempty"`
+	ExitCode      int32                  `protobuf:"varint,3,opt,name=exit_code,json=exitCode,proto3" json:"exit_code,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *RestartEvent) Reset() {
+	*x = RestartEvent{}
+	mi := &file_internal_proto_cosmos_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *RestartEvent) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*RestartEvent) ProtoMessage() {}
+
+func (x *RestartEvent) ProtoReflect() protoreflect.Message {
+	mi := &file_internal_proto_cosmos_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use RestartEvent.ProtoReflect.Descriptor instead.
+func (*RestartEvent) Descriptor() ([]byte, []int) {
+	return file_internal_proto_cosmos_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *RestartEvent) GetTimestamp() int64 {
+	if x != nil {
+		return x.Timestamp
+	}
+	return 0
+}
+
+func (x *RestartEvent) GetReason() string {
+	if x != nil {
+		return x.Reason
+	}
+	return ""
+}
+
+func (x *RestartEvent) GetExitCode() int32 {
+	if x != nil {
+		return x.ExitCode
+	}
+	return 0
+}
+
 type HealthCheckResult struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
 	ComponentName string                 `protobuf:"bytes,1,opt,name=component_name,json=componentName,proto3" json:"component_name,omitempty"`
@@ -446,7 +671,7 @@ type HealthCheckResult struct {
 
 func (x *HealthCheckResult) Reset() {
 	*x = HealthCheckResult{}
-	mi := &file_internal_proto_cosmos_proto_msgTypes[4]
+	mi := &file_internal_proto_cosmos_proto_msgTypes[6]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -458,7 +683,7 @@ func (x *HealthCheckResult) String() string {
 func (*HealthCheckResult) ProtoMessage() {}
 
 func (x *HealthCheckResult) ProtoReflect() protoreflect.Message {
-	mi := &file_internal_proto_cosmos_proto_msgTypes[4]
+	mi := &file_internal_proto_cosmos_proto_msgTypes[6]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -471,7 +696,7 @@ func (x *HealthCheckResult) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use HealthCheckResult.ProtoReflect.Descriptor instead.
 func (*HealthCheckResult) Descriptor() ([]byte, []int) {
-	return file_internal_proto_cosmos_proto_rawDescGZIP(), []int{4}
+	return file_internal_proto_cosmos_proto_rawDescGZIP(), []int{6}
 }
 
 func (x *HealthCheckResult) GetComponentName() string {
@@ -516,13 +741,19 @@ type DeploymentResult struct {
 	Result        string                 `protobuf:"bytes,3,opt,name=result,proto3" json:"result,omitempty"`
 	Message       string                 `protobuf:"bytes,4,opt,name=message,proto3" json:"message,omitempty"`
 	Timestamp     int64                  `protobuf:"varint,5,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
-	unknownFields protoimpl.UnknownFields
-	sizeCache     protoimpl.SizeCache
+	// request_id is set when the result answers a ComponentControl
+	RequestId string `protobuf:"bytes,6,opt,name=request_id,json=requestId,proto3" json:"request_id,omitempty"`
+	// phase and progress_percent are set on progress results: the deployment
+	// step underway and how far it has got, or -1 when that isn't known
+	Phase           string `protobuf:"bytes,7,opt,name=phase,proto3" json:"phase,omitempty"`
+	ProgressPercent int32  `protobuf:"varint,8,opt,name=progress_percent,json=progressPercent,proto3" json:"progress_percent,omitempty"`
+	unknownFields   protoimpl.UnknownFields
+	sizeCache       protoimpl.SizeCache
 }
 
 func (x *DeploymentResult) Reset() {
 	*x = DeploymentResult{}
-	mi := &file_internal_proto_cosmos_proto_msgTypes[5]
+	mi := &file_internal_proto_cosmos_proto_msgTypes[7]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -534,7 +765,7 @@ func (x *DeploymentResult) String() string {
 func (*DeploymentResult) ProtoMessage() {}
 
 func (x *DeploymentResult) ProtoReflect() protoreflect.Message {
-	mi := &file_internal_proto_cosmos_proto_msgTypes[5]
+	mi := &file_internal_proto_cosmos_proto_msgTypes[7]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -547,7 +778,7 @@ func (x *DeploymentResult) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use DeploymentResult.ProtoReflect.Descriptor instead.
 func (*DeploymentResult) Descriptor() ([]byte, []int) {
-	return file_internal_proto_cosmos_proto_rawDescGZIP(), []int{5}
+	return file_internal_proto_cosmos_proto_rawDescGZIP(), []int{7}
 }
 
 func (x *DeploymentResult) GetComponentName() string {
@@ -585,6 +816,27 @@ func (x *DeploymentResult) GetTimestamp() int64 {
 	return 0
 }
 
+func (x *DeploymentResult) GetRequestId() string {
+	if x != nil {
+		return x.RequestId
+	}
+	return ""
+}
+
+func (x *DeploymentResult) GetPhase() string {
+	if x != nil {
+		return x.Phase
+	}
+	return ""
+}
+
+func (x *DeploymentResult) GetProgressPercent() int32 {
+	if x != nil {
+		return x.ProgressPercent
+	}
+	return 0
+}
+
 type LogChunk struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
 	ComponentName string                 `protobuf:"bytes,1,opt,name=component_name,json=componentName,proto3" json:"component_name,omitempty"`
@@ -597,7 +849,7 @@ type LogChunk struct {
 
 func (x *LogChunk) Reset() {
 	*x = LogChunk{}
-	mi := &file_internal_proto_cosmos_proto_msgTypes[6]
+	mi := &file_internal_proto_cosmos_proto_msgTypes[8]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -609,7 +861,7 @@ func (x *LogChunk) String() string {
 func (*LogChunk) ProtoMessage() {}
 
 func (x *LogChunk) ProtoReflect() protoreflect.Message {
-	mi := &file_internal_proto_cosmos_proto_msgTypes[6]
+	mi := &file_internal_proto_cosmos_proto_msgTypes[8]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -622,7 +874,7 @@ func (x *LogChunk) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use LogChunk.ProtoReflect.Descriptor instead.
 func (*LogChunk) Descriptor() ([]byte, []int) {
-	return file_internal_proto_cosmos_proto_rawDescGZIP(), []int{6}
+	return file_internal_proto_cosmos_proto_rawDescGZIP(), []int{8}
 }
 
 func (x *LogChunk) GetComponentName() string {
@@ -653,29 +905,32 @@ func (x *LogChunk) GetOffset() int64 {
 	return 0
 }
 
-type Acknowledgment struct {
+// LogRequest asks the agent for the last lines of a component's log. The
+// agent answers with a LogResponse carrying the same request_id.
+type LogRequest struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
-	Success       bool                   `protobuf:"varint,1,opt,name=success,proto3" json:"success,omitempty"`
-	Message       string                 `protobuf:"bytes,2,opt,name=message,proto3" json:"message,omitempty"`
+	RequestId     string                 `protobuf:"bytes,1,opt,name=request_id,json=requestId,proto3" json:"request_id,omitempty"`
+	ComponentName string                 `protobuf:"bytes,2,opt,name=component_name,json=componentName,proto3" json:"component_name,omitempty"`
+	Lines         int32                  `protobuf:"varint,3,opt,name=lines,proto3" json:"lines,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
 
-func (x *Acknowledgment) Reset() {
-	*x = Acknowledgment{}
-	mi := &file_internal_proto_cosmos_proto_msgTypes[7]
+func (x *LogRequest) Reset() {
+	*x = LogRequest{}
+	mi := &file_internal_proto_cosmos_proto_msgTypes[9]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
 
-func (x *Acknowledgment) String() string {
+func (x *LogRequest) String() string {
 	return protoimpl.X.MessageStringOf(x)
 }
 
-func (*Acknowledgment) ProtoMessage() {}
+func (*LogRequest) ProtoMessage() {}
 
-func (x *Acknowledgment) ProtoReflect() protoreflect.Message {
-	mi := &file_internal_proto_cosmos_proto_msgTypes[7]
+func (x *LogRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_internal_proto_cosmos_proto_msgTypes[9]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -686,56 +941,57 @@ func (x *Acknowledgment) ProtoReflect() protoreflect.Message {
 	return mi.MessageOf(x)
 }
 
-// Deprecated: Use Acknowledgment.ProtoReflect.Descriptor instead.
-func (*Acknowledgment) Descriptor() ([]byte, []int) {
-	return file_internal_proto_cosmos_proto_rawDescGZIP(), []int{7}
+// Deprecated: Use LogRequest.ProtoReflect.Descriptor instead.
+func (*LogRequest) Descriptor() ([]byte, []int) {
+	return file_internal_proto_cosmos_proto_rawDescGZIP(), []int{9}
 }
 
-func (x *Acknowledgment) GetSuccess() bool {
+func (x *LogRequest) GetRequestId() string {
 	if x != nil {
-		return x.Success
+		return x.RequestId
 	}
-	return false
+	return ""
 }
 
-func (x *Acknowledgment) GetMessage() string {
+func (x *LogRequest) GetComponentName() string {
 	if x != nil {
-		return x.Message
+		return x.ComponentName
 	}
 	return ""
 }
 
-type ComponentDeployment struct {
-	state              protoimpl.MessageState `protogen:"open.v1"`
-	ComponentName      string                 `protobuf:"bytes,1,opt,name=component_name,json=componentName,proto3" json:"component_name,omitempty"`
-	ComponentType      string                 `protobuf:"bytes,2,opt,name=component_type,json=componentType,proto3" json:"component_type,omitempty"`
-	Hash               string                 `protobuf:"bytes,3,opt,name=hash,proto3" json:"hash,omitempty"`
-	ContentUrl         string                 `protobuf:"bytes,4,opt,name=content_url,json=contentUrl,proto3" json:"content_url,omitempty"`
-	ContentUrlEncoding string                 `protobuf:"bytes,5,opt,name=content_url_encoding,json=contentUrlEncoding,proto3" json:"content_url_encoding,omitempty"`
-	Content            string                 `protobuf:"bytes,6,opt,name=content,proto3" json:"content,omitempty"`
-	HealthCheck        *HealthCheckConfig     `protobuf:"bytes,7,opt,name=health_check,json=healthCheck,proto3" json:"health_check,omitempty"`
-	Env                map[string]string      `protobuf:"bytes,8,rep,name=env,proto3" json:"env,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
-	Args               []string               `protobuf:"bytes,9,rep,name=args,proto3" json:"args,omitempty"`
-	Managed            bool                   `protobuf:"varint,10,opt,name=managed,proto3" json:"managed,omitempty"`
-	unknownFields      protoimpl.UnknownFields
-	sizeCache          protoimpl.SizeCache
+func (x *LogRequest) GetLines() int32 {
+	if x != nil {
+		return x.Lines
+	}
+	return 0
 }
 
-func (x *ComponentDeployment) Reset() {
-	*x = ComponentDeployment{}
-	mi := &file_internal_proto_cosmos_proto_msgTypes[8]
+type LogResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	RequestId     string                 `protobuf:"bytes,1,opt,name=request_id,json=requestId,proto3" json:"request_id,omitempty"`
+	ComponentName string                 `protobuf:"bytes,2,opt,name=component_name,json=componentName,proto3" json:"component_name,omitempty"`
+	LogData       string                 `protobuf:"bytes,3,opt,name=log_data,json=logData,proto3" json:"log_data,omitempty"`
+	Error         string                 `protobuf:"bytes,4,opt,name=error,proto3" json:"error,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *LogResponse) Reset() {
+	*x = LogResponse{}
+	mi := &file_internal_proto_cosmos_proto_msgTypes[10]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
 
-func (x *ComponentDeployment) String() string {
+func (x *LogResponse) String() string {
 	return protoimpl.X.MessageStringOf(x)
 }
 
-func (*ComponentDeployment) ProtoMessage() {}
+func (*LogResponse) ProtoMessage() {}
 
-func (x *ComponentDeployment) ProtoReflect() protoreflect.Message {
-	mi := &file_internal_proto_cosmos_proto_msgTypes[8]
+func (x *LogResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_internal_proto_cosmos_proto_msgTypes[10]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -746,28 +1002,180 @@ func (x *ComponentDeployment) ProtoReflect() protoreflect.Message {
 	return mi.MessageOf(x)
 }
 
-// Deprecated: Use ComponentDeployment.ProtoReflect.Descriptor instead.
-func (*ComponentDeployment) Descriptor() ([]byte, []int) {
-	return file_internal_proto_cosmos_proto_rawDescGZIP(), []int{8}
+// Deprecated: Use LogResponse.ProtoReflect.Descriptor instead.
+func (*LogResponse) Descriptor() ([]byte, []int) {
+	return file_internal_proto_cosmos_proto_rawDescGZIP(), []int{10}
 }
 
-func (x *ComponentDeployment) GetComponentName() string {
+func (x *LogResponse) GetRequestId() string {
 	if x != nil {
-		return x.ComponentName
+		return x.RequestId
 	}
 	return ""
 }
 
-func (x *ComponentDeployment) GetComponentType() string {
+func (x *LogResponse) GetComponentName() string {
 	if x != nil {
-		return x.ComponentType
+		return x.ComponentName
 	}
 	return ""
 }
 
-func (x *ComponentDeployment) GetHash() string {
+func (x *LogResponse) GetLogData() string {
 	if x != nil {
-		return x.Hash
+		return x.LogData
+	}
+	return ""
+}
+
+func (x *LogResponse) GetError() string {
+	if x != nil {
+		return x.Error
+	}
+	return ""
+}
+
+type Acknowledgment struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Success       bool                   `protobuf:"varint,1,opt,name=success,proto3" json:"success,omitempty"`
+	Message       string                 `protobuf:"bytes,2,opt,name=message,proto3" json:"message,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Acknowledgment) Reset() {
+	*x = Acknowledgment{}
+	mi := &file_internal_proto_cosmos_proto_msgTypes[11]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Acknowledgment) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Acknowledgment) ProtoMessage() {}
+
+func (x *Acknowledgment) ProtoReflect() protoreflect.Message {
+	mi := &file_internal_proto_cosmos_proto_msgTypes[11]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Acknowledgment.ProtoReflect.Descriptor instead.
+func (*Acknowledgment) Descriptor() ([]byte, []int) {
+	return file_internal_proto_cosmos_proto_rawDescGZIP(), []int{11}
+}
+
+func (x *Acknowledgment) GetSuccess() bool {
+	if x != nil {
+		return x.Success
+	}
+	return false
+}
+
+func (x *Acknowledgment) GetMessage() string {
+	if x != nil {
+		return x.Message
+	}
+	return ""
+}
+
+type ComponentDeployment struct {
+	state              protoimpl.MessageState `protogen:"open.v1"`
+	ComponentName      string                 `protobuf:"bytes,1,opt,name=component_name,json=componentName,proto3" json:"component_name,omitempty"`
+	ComponentType      string                 `protobuf:"bytes,2,opt,name=component_type,json=componentType,proto3" json:"component_type,omitempty"`
+	Hash               string                 `protobuf:"bytes,3,opt,name=hash,proto3" json:"hash,omitempty"`
+	ContentUrl         string                 `protobuf:"bytes,4,opt,name=content_url,json=contentUrl,proto3" json:"content_url,omitempty"`
+	ContentUrlEncoding string                 `protobuf:"bytes,5,opt,name=content_url_encoding,json=contentUrlEncoding,proto3" json:"content_url_encoding,omitempty"`
+	Content            string                 `protobuf:"bytes,6,opt,name=content,proto3" json:"content,omitempty"`
+	HealthCheck        *HealthCheckConfig     `protobuf:"bytes,7,opt,name=health_check,json=healthCheck,proto3" json:"health_check,omitempty"`
+	Env                map[string]string      `protobuf:"bytes,8,rep,name=env,proto3" json:"env,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	Args               []string               `protobuf:"bytes,9,rep,name=args,proto3" json:"args,omitempty"`
+	Managed            bool                   `protobuf:"varint,10,opt,name=managed,proto3" json:"managed,omitempty"`
+	WaitFor            []*WaitForEndpoint     `protobuf:"bytes,11,rep,name=wait_for,json=waitFor,proto3" json:"wait_for,omitempty"`
+	ContentMirrors     []*ContentMirror       `protobuf:"bytes,12,rep,name=content_mirrors,json=contentMirrors,proto3" json:"content_mirrors,omitempty"`
+	Canary             *CanaryAnalysis        `protobuf:"bytes,13,opt,name=canary,proto3" json:"canary,omitempty"`
+	Entrypoint         string                 `protobuf:"bytes,14,opt,name=entrypoint,proto3" json:"entrypoint,omitempty"`
+	SignatureUrl       string                 `protobuf:"bytes,15,opt,name=signature_url,json=signatureUrl,proto3" json:"signature_url,omitempty"`
+	PublicKey          string                 `protobuf:"bytes,16,opt,name=public_key,json=publicKey,proto3" json:"public_key,omitempty"`
+	ContentUrlHeaders  map[string]string      `protobuf:"bytes,17,rep,name=content_url_headers,json=contentUrlHeaders,proto3" json:"content_url_headers,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	// resync is set when the controller re-sends desired state to a
+	// reconnected agent; the agent skips it if it already has the same hash
+	Resync bool `protobuf:"varint,18,opt,name=resync,proto3" json:"resync,omitempty"`
+	// deployment_id and request_id identify the deployment and the API
+	// request that caused it, for correlating agent logs
+	DeploymentId string `protobuf:"bytes,19,opt,name=deployment_id,json=deploymentId,proto3" json:"deployment_id,omitempty"`
+	RequestId    string `protobuf:"bytes,20,opt,name=request_id,json=requestId,proto3" json:"request_id,omitempty"`
+	// Resource limits for programs; zero means unlimited. memory_limit is in
+	// bytes and cpu_limit in cores.
+	MemoryLimit  int64   `protobuf:"varint,21,opt,name=memory_limit,json=memoryLimit,proto3" json:"memory_limit,omitempty"`
+	CpuLimit     float64 `protobuf:"fixed64,22,opt,name=cpu_limit,json=cpuLimit,proto3" json:"cpu_limit,omitempty"`
+	MaxOpenFiles int64   `protobuf:"varint,23,opt,name=max_open_files,json=maxOpenFiles,proto3" json:"max_open_files,omitempty"`
+	// run_as_user and run_as_group are names or numeric ids on the agent's
+	// node; empty runs the component as the agent's user
+	RunAsUser  string `protobuf:"bytes,24,opt,name=run_as_user,json=runAsUser,proto3" json:"run_as_user,omitempty"`
+	RunAsGroup string `protobuf:"bytes,25,opt,name=run_as_group,json=runAsGroup,proto3" json:"run_as_group,omitempty"`
+	// working_dir is the component's working directory; empty keeps the
+	// executable's directory, or the default for unmanaged scripts
+	WorkingDir    string `protobuf:"bytes,26,opt,name=working_dir,json=workingDir,proto3" json:"working_dir,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ComponentDeployment) Reset() {
+	*x = ComponentDeployment{}
+	mi := &file_internal_proto_cosmos_proto_msgTypes[12]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ComponentDeployment) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ComponentDeployment) ProtoMessage() {}
+
+func (x *ComponentDeployment) ProtoReflect() protoreflect.Message {
+	mi := &file_internal_proto_cosmos_proto_msgTypes[12]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ComponentDeployment.ProtoReflect.Descriptor instead.
+func (*ComponentDeployment) Descriptor() ([]byte, []int) {
+	return file_internal_proto_cosmos_proto_rawDescGZIP(), []int{12}
+}
+
+func (x *ComponentDeployment) GetComponentName() string {
+	if x != nil {
+		return x.ComponentName
+	}
+	return ""
+}
+
+func (x *ComponentDeployment) GetComponentType() string {
+	if x != nil {
+		return x.ComponentType
+	}
+	return ""
+}
+
+func (x *ComponentDeployment) GetHash() string {
+	if x != nil {
+		return x.Hash
 	}
 	return ""
 }
@@ -821,6 +1229,334 @@ func (x *ComponentDeployment) GetManaged() bool {
 	return false
 }
 
+func (x *ComponentDeployment) GetWaitFor() []*WaitForEndpoint {
+	if x != nil {
+		return x.WaitFor
+	}
+	return nil
+}
+
+func (x *ComponentDeployment) GetContentMirrors() []*ContentMirror {
+	if x != nil {
+		return x.ContentMirrors
+	}
+	return nil
+}
+
+func (x *ComponentDeployment) GetCanary() *CanaryAnalysis {
+	if x != nil {
+		return x.Canary
+	}
+	return nil
+}
+
+func (x *ComponentDeployment) GetEntrypoint() string {
+	if x != nil {
+		return x.Entrypoint
+	}
+	return ""
+}
+
+func (x *ComponentDeployment) GetSignatureUrl() string {
+	if x != nil {
+		return x.SignatureUrl
+	}
+	return ""
+}
+
+func (x *ComponentDeployment) GetPublicKey() string {
+	if x != nil {
+		return x.PublicKey
+	}
+	return ""
+}
+
+func (x *ComponentDeployment) GetContentUrlHeaders() map[string]string {
+	if x != nil {
+		return x.ContentUrlHeaders
+	}
+	return nil
+}
+
+func (x *ComponentDeployment) GetResync() bool {
+	if x != nil {
+		return x.Resync
+	}
+	return false
+}
+
+func (x *ComponentDeployment) GetDeploymentId() string {
+	if x != nil {
+		return x.DeploymentId
+	}
+	return ""
+}
+
+func (x *ComponentDeployment) GetRequestId() string {
+	if x != nil {
+		return x.RequestId
+	}
+	return ""
+}
+
+func (x *ComponentDeployment) GetMemoryLimit() int64 {
+	if x != nil {
+		return x.MemoryLimit
+	}
+	return 0
+}
+
+func (x *ComponentDeployment) GetCpuLimit() float64 {
+	if x != nil {
+		return x.CpuLimit
+	}
+	return 0
+}
+
+func (x *ComponentDeployment) GetMaxOpenFiles() int64 {
+	if x != nil {
+		return x.MaxOpenFiles
+	}
+	return 0
+}
+
+func (x *ComponentDeployment) GetRunAsUser() string {
+	if x != nil {
+		return x.RunAsUser
+	}
+	return ""
+}
+
+func (x *ComponentDeployment) GetRunAsGroup() string {
+	if x != nil {
+		return x.RunAsGroup
+	}
+	return ""
+}
+
+func (x *ComponentDeployment) GetWorkingDir() string {
+	if x != nil {
+		return x.WorkingDir
+	}
+	return ""
+}
+
+type CanaryAnalysis struct {
+	state                 protoimpl.MessageState `protogen:"open.v1"`
+	WindowSeconds         int32                  `protobuf:"varint,1,opt,name=window_seconds,json=windowSeconds,proto3" json:"window_seconds,omitempty"`
+	MaxDegradationPercent int32                  `protobuf:"varint,2,opt,name=max_degradation_percent,json=maxDegradationPercent,proto3" json:"max_degradation_percent,omitempty"`
+	MinSamples            int32                  `protobuf:"varint,3,opt,name=min_samples,json=minSamples,proto3" json:"min_samples,omitempty"`
+	unknownFields         protoimpl.UnknownFields
+	sizeCache             protoimpl.SizeCache
+}
+
+func (x *CanaryAnalysis) Reset() {
+	*x = CanaryAnalysis{}
+	mi := &file_internal_proto_cosmos_proto_msgTypes[13]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *CanaryAnalysis) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CanaryAnalysis) ProtoMessage() {}
+
+func (x *CanaryAnalysis) ProtoReflect() protoreflect.Message {
+	mi := &file_internal_proto_cosmos_proto_msgTypes[13]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CanaryAnalysis.ProtoReflect.Descriptor instead.
+func (*CanaryAnalysis) Descriptor() ([]byte, []int) {
+	return file_internal_proto_cosmos_proto_rawDescGZIP(), []int{13}
+}
+
+func (x *CanaryAnalysis) GetWindowSeconds() int32 {
+	if x != nil {
+		return x.WindowSeconds
+	}
+	return 0
+}
+
+func (x *CanaryAnalysis) GetMaxDegradationPercent() int32 {
+	if x != nil {
+		return x.MaxDegradationPercent
+	}
+	return 0
+}
+
+func (x *CanaryAnalysis) GetMinSamples() int32 {
+	if x != nil {
+		return x.MinSamples
+	}
+	return 0
+}
+
+type ContentMirror struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Url           string                 `protobuf:"bytes,1,opt,name=url,proto3" json:"url,omitempty"`
+	Weight        int32                  `protobuf:"varint,2,opt,name=weight,proto3" json:"weight,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ContentMirror) Reset() {
+	*x = ContentMirror{}
+	mi := &file_internal_proto_cosmos_proto_msgTypes[14]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ContentMirror) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ContentMirror) ProtoMessage() {}
+
+func (x *ContentMirror) ProtoReflect() protoreflect.Message {
+	mi := &file_internal_proto_cosmos_proto_msgTypes[14]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ContentMirror.ProtoReflect.Descriptor instead.
+func (*ContentMirror) Descriptor() ([]byte, []int) {
+	return file_internal_proto_cosmos_proto_rawDescGZIP(), []int{14}
+}
+
+func (x *ContentMirror) GetUrl() string {
+	if x != nil {
+		return x.Url
+	}
+	return ""
+}
+
+func (x *ContentMirror) GetWeight() int32 {
+	if x != nil {
+		return x.Weight
+	}
+	return 0
+}
+
+type WaitForEndpoint struct {
+	state          protoimpl.MessageState `protogen:"open.v1"`
+	Type           string                 `protobuf:"bytes,1,opt,name=type,proto3" json:"type,omitempty"`
+	Endpoint       string                 `protobuf:"bytes,2,opt,name=endpoint,proto3" json:"endpoint,omitempty"`
+	TimeoutSeconds int32                  `protobuf:"varint,3,opt,name=timeout_seconds,json=timeoutSeconds,proto3" json:"timeout_seconds,omitempty"`
+	unknownFields  protoimpl.UnknownFields
+	sizeCache      protoimpl.SizeCache
+}
+
+func (x *WaitForEndpoint) Reset() {
+	*x = WaitForEndpoint{}
+	mi := &file_internal_proto_cosmos_proto_msgTypes[15]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *WaitForEndpoint) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*WaitForEndpoint) ProtoMessage() {}
+
+func (x *WaitForEndpoint) ProtoReflect() protoreflect.Message {
+	mi := &file_internal_proto_cosmos_proto_msgTypes[15]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use WaitForEndpoint.ProtoReflect.Descriptor instead.
+func (*WaitForEndpoint) Descriptor() ([]byte, []int) {
+	return file_internal_proto_cosmos_proto_rawDescGZIP(), []int{15}
+}
+
+func (x *WaitForEndpoint) GetType() string {
+	if x != nil {
+		return x.Type
+	}
+	return ""
+}
+
+func (x *WaitForEndpoint) GetEndpoint() string {
+	if x != nil {
+		return x.Endpoint
+	}
+	return ""
+}
+
+func (x *WaitForEndpoint) GetTimeoutSeconds() int32 {
+	if x != nil {
+		return x.TimeoutSeconds
+	}
+	return 0
+}
+
+type LogLevelChange struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Level         string                 `protobuf:"bytes,1,opt,name=level,proto3" json:"level,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *LogLevelChange) Reset() {
+	*x = LogLevelChange{}
+	mi := &file_internal_proto_cosmos_proto_msgTypes[16]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *LogLevelChange) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*LogLevelChange) ProtoMessage() {}
+
+func (x *LogLevelChange) ProtoReflect() protoreflect.Message {
+	mi := &file_internal_proto_cosmos_proto_msgTypes[16]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use LogLevelChange.ProtoReflect.Descriptor instead.
+func (*LogLevelChange) Descriptor() ([]byte, []int) {
+	return file_internal_proto_cosmos_proto_rawDescGZIP(), []int{16}
+}
+
+func (x *LogLevelChange) GetLevel() string {
+	if x != nil {
+		return x.Level
+	}
+	return ""
+}
+
 type ComponentRemoval struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
 	ComponentName string                 `protobuf:"bytes,1,opt,name=component_name,json=componentName,proto3" json:"component_name,omitempty"`
@@ -830,7 +1566,7 @@ type ComponentRemoval struct {
 
 func (x *ComponentRemoval) Reset() {
 	*x = ComponentRemoval{}
-	mi := &file_internal_proto_cosmos_proto_msgTypes[9]
+	mi := &file_internal_proto_cosmos_proto_msgTypes[17]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -842,7 +1578,7 @@ func (x *ComponentRemoval) String() string {
 func (*ComponentRemoval) ProtoMessage() {}
 
 func (x *ComponentRemoval) ProtoReflect() protoreflect.Message {
-	mi := &file_internal_proto_cosmos_proto_msgTypes[9]
+	mi := &file_internal_proto_cosmos_proto_msgTypes[17]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -855,7 +1591,7 @@ func (x *ComponentRemoval) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use ComponentRemoval.ProtoReflect.Descriptor instead.
 func (*ComponentRemoval) Descriptor() ([]byte, []int) {
-	return file_internal_proto_cosmos_proto_rawDescGZIP(), []int{9}
+	return file_internal_proto_cosmos_proto_rawDescGZIP(), []int{17}
 }
 
 func (x *ComponentRemoval) GetComponentName() string {
@@ -865,21 +1601,95 @@ func (x *ComponentRemoval) GetComponentName() string {
 	return ""
 }
 
+// ComponentControl restarts, stops or starts a deployed component. The agent
+// answers with a DeploymentResult carrying the same request_id.
+type ComponentControl struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	RequestId     string                 `protobuf:"bytes,1,opt,name=request_id,json=requestId,proto3" json:"request_id,omitempty"`
+	ComponentName string                 `protobuf:"bytes,2,opt,name=component_name,json=componentName,proto3" json:"component_name,omitempty"`
+	Action        string                 `protobuf:"bytes,3,opt,name=action,proto3" json:"action,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ComponentControl) Reset() {
+	*x = ComponentControl{}
+	mi := &file_internal_proto_cosmos_proto_msgTypes[18]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ComponentControl) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ComponentControl) ProtoMessage() {}
+
+func (x *ComponentControl) ProtoReflect() protoreflect.Message {
+	mi := &file_internal_proto_cosmos_proto_msgTypes[18]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ComponentControl.ProtoReflect.Descriptor instead.
+func (*ComponentControl) Descriptor() ([]byte, []int) {
+	return file_internal_proto_cosmos_proto_rawDescGZIP(), []int{18}
+}
+
+func (x *ComponentControl) GetRequestId() string {
+	if x != nil {
+		return x.RequestId
+	}
+	return ""
+}
+
+func (x *ComponentControl) GetComponentName() string {
+	if x != nil {
+		return x.ComponentName
+	}
+	return ""
+}
+
+func (x *ComponentControl) GetAction() string {
+	if x != nil {
+		return x.Action
+	}
+	return ""
+}
+
 type HealthCheckConfig struct {
-	state           protoimpl.MessageState `protogen:"open.v1"`
-	ComponentName   string                 `protobuf:"bytes,1,opt,name=component_name,json=componentName,proto3" json:"component_name,omitempty"`
-	Type            string                 `protobuf:"bytes,2,opt,name=type,proto3" json:"type,omitempty"`
-	Endpoint        string                 `protobuf:"bytes,3,opt,name=endpoint,proto3" json:"endpoint,omitempty"`
-	IntervalSeconds int32                  `protobuf:"varint,4,opt,name=interval_seconds,json=intervalSeconds,proto3" json:"interval_seconds,omitempty"`
-	TimeoutSeconds  int32                  `protobuf:"varint,5,opt,name=timeout_seconds,json=timeoutSeconds,proto3" json:"timeout_seconds,omitempty"`
-	Retries         int32                  `protobuf:"varint,6,opt,name=retries,proto3" json:"retries,omitempty"`
-	unknownFields   protoimpl.UnknownFields
-	sizeCache       protoimpl.SizeCache
+	state              protoimpl.MessageState `protogen:"open.v1"`
+	ComponentName      string                 `protobuf:"bytes,1,opt,name=component_name,json=componentName,proto3" json:"component_name,omitempty"`
+	Type               string                 `protobuf:"bytes,2,opt,name=type,proto3" json:"type,omitempty"`
+	Endpoint           string                 `protobuf:"bytes,3,opt,name=endpoint,proto3" json:"endpoint,omitempty"`
+	IntervalSeconds    int32                  `protobuf:"varint,4,opt,name=interval_seconds,json=intervalSeconds,proto3" json:"interval_seconds,omitempty"`
+	TimeoutSeconds     int32                  `protobuf:"varint,5,opt,name=timeout_seconds,json=timeoutSeconds,proto3" json:"timeout_seconds,omitempty"`
+	Retries            int32                  `protobuf:"varint,6,opt,name=retries,proto3" json:"retries,omitempty"`
+	Pattern            string                 `protobuf:"bytes,7,opt,name=pattern,proto3" json:"pattern,omitempty"`
+	ErrorPattern       string                 `protobuf:"bytes,8,opt,name=error_pattern,json=errorPattern,proto3" json:"error_pattern,omitempty"`
+	Port               int32                  `protobuf:"varint,9,opt,name=port,proto3" json:"port,omitempty"`
+	Scheme             string                 `protobuf:"bytes,10,opt,name=scheme,proto3" json:"scheme,omitempty"`
+	Path               string                 `protobuf:"bytes,11,opt,name=path,proto3" json:"path,omitempty"`
+	Tls                bool                   `protobuf:"varint,12,opt,name=tls,proto3" json:"tls,omitempty"`
+	Method             string                 `protobuf:"bytes,13,opt,name=method,proto3" json:"method,omitempty"`
+	Headers            map[string]string      `protobuf:"bytes,14,rep,name=headers,proto3" json:"headers,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	ExpectedBody       string                 `protobuf:"bytes,15,opt,name=expected_body,json=expectedBody,proto3" json:"expected_body,omitempty"`
+	ExpectedStatus     []int32                `protobuf:"varint,16,rep,packed,name=expected_status,json=expectedStatus,proto3" json:"expected_status,omitempty"`
+	RestartOnUnhealthy bool                   `protobuf:"varint,17,opt,name=restart_on_unhealthy,json=restartOnUnhealthy,proto3" json:"restart_on_unhealthy,omitempty"`
+	StartPeriodSeconds int32                  `protobuf:"varint,18,opt,name=start_period_seconds,json=startPeriodSeconds,proto3" json:"start_period_seconds,omitempty"`
+	unknownFields      protoimpl.UnknownFields
+	sizeCache          protoimpl.SizeCache
 }
 
 func (x *HealthCheckConfig) Reset() {
 	*x = HealthCheckConfig{}
-	mi := &file_internal_proto_cosmos_proto_msgTypes[10]
+	mi := &file_internal_proto_cosmos_proto_msgTypes[19]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
@@ -891,7 +1701,7 @@ func (x *HealthCheckConfig) String() string {
 func (*HealthCheckConfig) ProtoMessage() {}
 
 func (x *HealthCheckConfig) ProtoReflect() protoreflect.Message {
-	mi := &file_internal_proto_cosmos_proto_msgTypes[10]
+	mi := &file_internal_proto_cosmos_proto_msgTypes[19]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -904,7 +1714,7 @@ func (x *HealthCheckConfig) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use HealthCheckConfig.ProtoReflect.Descriptor instead.
 func (*HealthCheckConfig) Descriptor() ([]byte, []int) {
-	return file_internal_proto_cosmos_proto_rawDescGZIP(), []int{10}
+	return file_internal_proto_cosmos_proto_rawDescGZIP(), []int{19}
 }
 
 func (x *HealthCheckConfig) GetComponentName() string {
@@ -949,11 +1759,95 @@ func (x *HealthCheckConfig) GetRetries() int32 {
 	return 0
 }
 
+func (x *HealthCheckConfig) GetPattern() string {
+	if x != nil {
+		return x.Pattern
+	}
+	return ""
+}
+
+func (x *HealthCheckConfig) GetErrorPattern() string {
+	if x != nil {
+		return x.ErrorPattern
+	}
+	return ""
+}
+
+func (x *HealthCheckConfig) GetPort() int32 {
+	if x != nil {
+		return x.Port
+	}
+	return 0
+}
+
+func (x *HealthCheckConfig) GetScheme() string {
+	if x != nil {
+		return x.Scheme
+	}
+	return ""
+}
+
+func (x *HealthCheckConfig) GetPath() string {
+	if x != nil {
+		return x.Path
+	}
+	return ""
+}
+
+func (x *HealthCheckConfig) GetTls() bool {
+	if x != nil {
+		return x.Tls
+	}
+	return false
+}
+
+func (x *HealthCheckConfig) GetMethod() string {
+	if x != nil {
+		return x.Method
+	}
+	return ""
+}
+
+func (x *HealthCheckConfig) GetHeaders() map[string]string {
+	if x != nil {
+		return x.Headers
+	}
+	return nil
+}
+
+func (x *HealthCheckConfig) GetExpectedBody() string {
+	if x != nil {
+		return x.ExpectedBody
+	}
+	return ""
+}
+
+func (x *HealthCheckConfig) GetExpectedStatus() []int32 {
+	if x != nil {
+		return x.ExpectedStatus
+	}
+	return nil
+}
+
+func (x *HealthCheckConfig) GetRestartOnUnhealthy() bool {
+	if x != nil {
+		return x.RestartOnUnhealthy
+	}
+	return false
+}
+
+func (x *HealthCheckConfig) GetStartPeriodSeconds() int32 {
+	if x != nil {
+		return x.StartPeriodSeconds
+	}
+	return 0
+}
+
 var File_internal_proto_cosmos_proto protoreflect.FileDescriptor
 
 const file_internal_proto_cosmos_proto_rawDesc = "" +
 	"\n" +
-	"\x1binternal/proto/cosmos.proto\x12\x06cosmos\"\x8d\x03\n" +
+	"\x1binternal/proto/cosmos.proto\x12\x06cosmos\"\xc7\x03\n" +
 	"\fAgentMessage\x12\x1a\n" +
 	"\bhostname\x18\x01 \x01(\tR\bhostname\x12\x1c\n" +
 	"\ttimestamp\x18\x02 \x01(\x03R\ttimestamp\x126\n" +
@@ -961,52 +1855,86 @@ const file_internal_proto_cosmos_proto_rawDesc = "" +
 	"\x10component_status\x18\x04 \x01(\v2\x17.cosmos.ComponentStatusH\x00R\x0fcomponentStatus\x12@\n" +
 	"\rhealth_result\x18\x05 \x01(\v2\x19.cosmos.HealthCheckResultH\x00R\fhealthResult\x12G\n" +
 	"\x11deployment_result\x18\x06 \x01(\v2\x18.cosmos.DeploymentResultH\x00R\x10deploymentResult\x12/\n" +
-	"\tlog_chunk\x18\a \x01(\v2\x10.cosmos.LogChunkH\x00R\blogChunkB\t\n" +
-	"\amessage\"\x81\x02\n" +
+	"\tlog_chunk\x18\a \x01(\v2\x10.cosmos.LogChunkH\x00R\blogChunk\x128\n" +
+	"\flog_response\x18\b \x01(\v2\x13.cosmos.LogResponseH\x00R\vlogResponseB\t\n" +
+	"\amessage\"\xa5\x03\n" +
 	"\x11ControllerMessage\x12*\n" +
 	"\x03ack\x18\x01 \x01(\v2\x16.cosmos.AcknowledgmentH\x00R\x03ack\x12=\n" +
 	"\n" +
 	"deployment\x18\x02 \x01(\v2\x1b.cosmos.ComponentDeploymentH\x00R\n" +
 	"deployment\x124\n" +
 	"\aremoval\x18\x03 \x01(\v2\x18.cosmos.ComponentRemovalH\x00R\aremoval\x12@\n" +
-	"\rhealth_config\x18\x04 \x01(\v2\x19.cosmos.HealthCheckConfigH\x00R\fhealthConfigB\t\n" +
-	"\amessage\"\x90\x02\n" +
+	"\rhealth_config\x18\x04 \x01(\v2\x19.cosmos.HealthCheckConfigH\x00R\fhealthConfig\x125\n" +
+	"\tlog_level\x18\x05 \x01(\v2\x16.cosmos.LogLevelChangeH\x00R\blogLevel\x125\n" +
+	"\vlog_request\x18\x06 \x01(\v2\x12.cosmos.LogRequestH\x00R\n" +
+	"logRequest\x124\n" +
+	"\acontrol\x18\a \x01(\v2\x18.cosmos.ComponentControlH\x00R\acontrolB\t\n" +
+	"\amessage\"\xce\x02\n" +
 	"\x0eAgentHeartbeat\x12#\n" +
 	"\ragent_version\x18\x01 \x01(\tR\fagentVersion\x12@\n" +
 	"\bmetadata\x18\x02 \x03(\v2$.cosmos.AgentHeartbeat.MetadataEntryR\bmetadata\x12F\n" +
 	"\x12component_statuses\x18\x03 \x03(\v2\x17.cosmos.ComponentStatusR\x11componentStatuses\x12\x12\n" +
-	"\x04tags\x18\x04 \x03(\tR\x04tags\x1a;\n" +
+	"\x04tags\x18\x04 \x03(\tR\x04tags\x12<\n" +
+	"\x0esystem_metrics\x18\x05 \x01(\v2\x15.cosmos.SystemMetricsR\rsystemMetrics\x1a;\n" +
 	"\rMetadataEntry\x12\x10\n" +
 	"\x03key\x18\x01 \x01(\tR\x03key\x12\x14\n" +
-	"\x05value\x18\x02 \x01(\tR\x05value:\x028\x01\"\xb6\x01\n" +
+	"\x05value\x18\x02 \x01(\tR\x05value:\x028\x01\"\xfb\x01\n" +
+	"\rSystemMetrics\x12!\n" +
+	"\fload_average\x18\x01 \x01(\x01R\vloadAverage\x12\x1b\n" +
+	"\tcpu_count\x18\x02 \x01(\x05R\bcpuCount\x12*\n" +
+	"\x11memory_used_bytes\x18\x03 \x01(\x04R\x0fmemoryUsedBytes\x12,\n" +
+	"\x12memory_total_bytes\x18\x04 \x01(\x04R\x10memoryTotalBytes\x12&\n" +
+	"\x0fdisk_free_bytes\x18\x05 \x01(\x04R\rdiskFreeBytes\x12(\n" +
+	"\x10disk_total_bytes\x18\x06 \x01(\x04R\x0ediskTotalBytes\"\xf5\x01\n" +
 	"\x0fComponentStatus\x12\x12\n" +
 	"\x04name\x18\x01 \x01(\tR\x04name\x12\x16\n" +
 	"\x06status\x18\x02 \x01(\tR\x06status\x12\x18\n" +
 	"\amessage\x18\x03 \x01(\tR\amessage\x12\x10\n" +
 	"\x03pid\x18\x04 \x01(\x05R\x03pid\x12&\n" +
 	"\x0flast_started_at\x18\x05 \x01(\x03R\rlastStartedAt\x12#\n" +
-	"\rrestart_count\x18\x06 \x01(\x05R\frestartCount\"\xa9\x01\n" +
+	"\rrestart_count\x18\x06 \x01(\x05R\frestartCount\x12=\n" +
+	"\x0frestart_history\x18\a \x03(\v2\x14.cosmos.RestartEventR\x0erestartHistory\"a\n" +
+	"\fRestartEvent\x12\x1c\n" +
+	"\ttimestamp\x18\x01 \x01(\x03R\ttimestamp\x12\x16\n" +
+	"\x06reason\x18\x02 \x01(\tR\x06reason\x12\x1b\n" +
+	"\texit_code\x18\x03 \x01(\x05R\bexitCode\"\xa9\x01\n" +
 	"\x11HealthCheckResult\x12%\n" +
 	"\x0ecomponent_name\x18\x01 \x01(\tR\rcomponentName\x12\x1d\n" +
 	"\n" +
 	"check_type\x18\x02 \x01(\tR\tcheckType\x12\x16\n" +
 	"\x06result\x18\x03 \x01(\tR\x06result\x12\x18\n" +
 	"\amessage\x18\x04 \x01(\tR\amessage\x12\x1c\n" +
-	"\ttimestamp\x18\x05 \x01(\x03R\ttimestamp\"\xa7\x01\n" +
+	"\ttimestamp\x18\x05 \x01(\x03R\ttimestamp\"\x87\x02\n" +
 	"\x10DeploymentResult\x12%\n" +
 	"\x0ecomponent_name\x18\x01 \x01(\tR\rcomponentName\x12\x1c\n" +
 	"\toperation\x18\x02 \x01(\tR\toperation\x12\x16\n" +
 	"\x06result\x18\x03 \x01(\tR\x06result\x12\x18\n" +
 	"\amessage\x18\x04 \x01(\tR\amessage\x12\x1c\n" +
-	"\ttimestamp\x18\x05 \x01(\x03R\ttimestamp\"\x82\x01\n" +
+	"\ttimestamp\x18\x05 \x01(\x03R\ttimestamp\x12\x1d\n" +
+	"\n" +
+	"request_id\x18\x06 \x01(\tR\trequestId\x12\x14\n" +
+	"\x05phase\x18\a \x01(\tR\x05phase\x12)\n" +
+	"\x10progress_percent\x18\b \x01(\x05R\x0fprogressPercent\"\x82\x01\n" +
 	"\bLogChunk\x12%\n" +
 	"\x0ecomponent_name\x18\x01 \x01(\tR\rcomponentName\x12\x19\n" +
 	"\blog_data\x18\x02 \x01(\tR\alogData\x12\x1c\n" +
 	"\ttimestamp\x18\x03 \x01(\x03R\ttimestamp\x12\x16\n" +
-	"\x06offset\x18\x04 \x01(\x03R\x06offset\"D\n" +
+	"\x06offset\x18\x04 \x01(\x03R\x06offset\"h\n" +
+	"\n" +
+	"LogRequest\x12\x1d\n" +
+	"\n" +
+	"request_id\x18\x01 \x01(\tR\trequestId\x12%\n" +
+	"\x0ecomponent_name\x18\x02 \x01(\tR\rcomponentName\x12\x14\n" +
+	"\x05lines\x18\x03 \x01(\x05R\x05lines\"\x84\x01\n" +
+	"\vLogResponse\x12\x1d\n" +
+	"\n" +
+	"request_id\x18\x01 \x01(\tR\trequestId\x12%\n" +
+	"\x0ecomponent_name\x18\x02 \x01(\tR\rcomponentName\x12\x19\n" +
+	"\blog_data\x18\x03 \x01(\tR\alogData\x12\x14\n" +
+	"\x05error\x18\x04 \x01(\tR\x05error\"D\n" +
 	"\x0eAcknowledgment\x12\x18\n" +
 	"\asuccess\x18\x01 \x01(\bR\asuccess\x12\x18\n" +
-	"\amessage\x18\x02 \x01(\tR\amessage\"\xc0\x03\n" +
+	"\amessage\x18\x02 \x01(\tR\amessage\"\x97\t\n" +
 	"\x13ComponentDeployment\x12%\n" +
 	"\x0ecomponent_name\x18\x01 \x01(\tR\rcomponentName\x12%\n" +
 	"\x0ecomponent_type\x18\x02 \x01(\tR\rcomponentType\x12\x12\n" +
@@ -1019,19 +1947,79 @@ const file_internal_proto_cosmos_proto_rawDesc = "" +
 	"\x03env\x18\b \x03(\v2$.cosmos.ComponentDeployment.EnvEntryR\x03env\x12\x12\n" +
 	"\x04args\x18\t \x03(\tR\x04args\x12\x18\n" +
 	"\amanaged\x18\n" +
-	" \x01(\bR\amanaged\x1a6\n" +
+	" \x01(\bR\amanaged\x122\n" +
+	"\bwait_for\x18\v \x03(\v2\x17.cosmos.WaitForEndpointR\awaitFor\x12>\n" +
+	"\x0fcontent_mirrors\x18\f \x03(\v2\x15.cosmos.ContentMirrorR\x0econtentMirrors\x12.\n" +
+	"\x06canary\x18\r \x01(\v2\x16.cosmos.CanaryAnalysisR\x06canary\x12\x1e\n" +
+	"\n" +
+	"entrypoint\x18\x0e \x01(\tR\n" +
+	"entrypoint\x12#\n" +
+	"\rsignature_url\x18\x0f \x01(\tR\fsignatureUrl\x12\x1d\n" +
+	"\n" +
+	"public_key\x18\x10 \x01(\tR\tpublicKey\x12b\n" +
+	"\x13content_url_headers\x18\x11 \x03(\v22.cosmos.ComponentDeployment.ContentUrlHeadersEntryR\x11contentUrlHeaders\x12\x16\n" +
+	"\x06resync\x18\x12 \x01(\bR\x06resync\x12#\n" +
+	"\rdeployment_id\x18\x13 \x01(\tR\fdeploymentId\x12\x1d\n" +
+	"\n" +
+	"request_id\x18\x14 \x01(\tR\trequestId\x12!\n" +
+	"\fmemory_limit\x18\x15 \x01(\x03R\vmemoryLimit\x12\x1b\n" +
+	"\tcpu_limit\x18\x16 \x01(\x01R\bcpuLimit\x12$\n" +
+	"\x0emax_open_files\x18\x17 \x01(\x03R\fmaxOpenFiles\x12\x1e\n" +
+	"\vrun_as_user\x18\x18 \x01(\tR\trunAsUser\x12 \n" +
+	"\frun_as_group\x18\x19 \x01(\tR\n" +
+	"runAsGroup\x12\x1f\n" +
+	"\vworking_dir\x18\x1a \x01(\tR\n" +
+	"workingDir\x1a6\n" +
 	"\bEnvEntry\x12\x10\n" +
 	"\x03key\x18\x01 \x01(\tR\x03key\x12\x14\n" +
-	"\x05value\x18\x02 \x01(\tR\x05value:\x028\x01\"9\n" +
+	"\x05value\x18\x02 \x01(\tR\x05value:\x028\x01\x1aD\n" +
+	"\x16ContentUrlHeadersEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\tR\x05value:\x028\x01\"\x90\x01\n" +
+	"\x0eCanaryAnalysis\x12%\n" +
+	"\x0ewindow_seconds\x18\x01 \x01(\x05R\rwindowSeconds\x126\n" +
+	"\x17max_degradation_percent\x18\x02 \x01(\x05R\x15maxDegradationPercent\x12\x1f\n" +
+	"\vmin_samples\x18\x03 \x01(\x05R\n" +
+	"minSamples\"9\n" +
+	"\rContentMirror\x12\x10\n" +
+	"\x03url\x18\x01 \x01(\tR\x03url\x12\x16\n" +
+	"\x06weight\x18\x02 \x01(\x05R\x06weight\"j\n" +
+	"\x0fWaitForEndpoint\x12\x12\n" +
+	"\x04type\x18\x01 \x01(\tR\x04type\x12\x1a\n" +
+	"\bendpoint\x18\x02 \x01(\tR\bendpoint\x12'\n" +
+	"\x0ftimeout_seconds\x18\x03 \x01(\x05R\x0etimeoutSeconds\"&\n" +
+	"\x0eLogLevelChange\x12\x14\n" +
+	"\x05level\x18\x01 \x01(\tR\x05level\"9\n" +
 	"\x10ComponentRemoval\x12%\n" +
-	"\x0ecomponent_name\x18\x01 \x01(\tR\rcomponentName\"\xd8\x01\n" +
+	"\x0ecomponent_name\x18\x01 \x01(\tR\rcomponentName\"p\n" +
+	"\x10ComponentControl\x12\x1d\n" +
+	"\n" +
+	"request_id\x18\x01 \x01(\tR\trequestId\x12%\n" +
+	"\x0ecomponent_name\x18\x02 \x01(\tR\rcomponentName\x12\x16\n" +
+	"\x06action\x18\x03 \x01(\tR\x06action\"\xb1\x05\n" +
 	"\x11HealthCheckConfig\x12%\n" +
 	"\x0ecomponent_name\x18\x01 \x01(\tR\rcomponentName\x12\x12\n" +
 	"\x04type\x18\x02 \x01(\tR\x04type\x12\x1a\n" +
 	"\bendpoint\x18\x03 \x01(\tR\bendpoint\x12)\n" +
 	"\x10interval_seconds\x18\x04 \x01(\x05R\x0fintervalSeconds\x12'\n" +
 	"\x0ftimeout_seconds\x18\x05 \x01(\x05R\x0etimeoutSeconds\x12\x18\n" +
-	"\aretries\x18\x06 \x01(\x05R\aretries2^\n" +
+	"\aretries\x18\x06 \x01(\x05R\aretries\x12\x18\n" +
+	"\apattern\x18\a \x01(\tR\apattern\x12#\n" +
+	"\rerror_pattern\x18\b \x01(\tR\ferrorPattern\x12\x12\n" +
+	"\x04port\x18\t \x01(\x05R\x04port\x12\x16\n" +
+	"\x06scheme\x18\n" +
+	" \x01(\tR\x06scheme\x12\x12\n" +
+	"\x04path\x18\v \x01(\tR\x04path\x12\x10\n" +
+	"\x03tls\x18\f \x01(\bR\x03tls\x12\x16\n" +
+	"\x06method\x18\r \x01(\tR\x06method\x12@\n" +
+	"\aheaders\x18\x0e \x03(\v2&.cosmos.HealthCheckConfig.HeadersEntryR\aheaders\x12#\n" +
+	"\rexpected_body\x18\x0f \x01(\tR\fexpectedBody\x12'\n" +
+	"\x0fexpected_status\x18\x10 \x03(\x05R\x0eexpectedStatus\x120\n" +
+	"\x14restart_on_unhealthy\x18\x11 \x01(\bR\x12restartOnUnhealthy\x120\n" +
+	"\x14start_period_seconds\x18\x12 \x01(\x05R\x12startPeriodSeconds\x1a:\n" +
+	"\fHeadersEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\tR\x05value:\x028\x012^\n" +
 	"\x10CosmosController\x12J\n" +
 	"\x13StreamAgentMessages\x12\x14.cosmos.AgentMessage\x1a\x19.cosmos.ControllerMessage(\x010\x01B7Z5github.com/metorial/fleet/cosmos/internal/proto;protob\x06proto3"
 
@@ -1047,43 +2035,65 @@ func file_internal_proto_cosmos_proto_rawDescGZIP() []byte {
 	return file_internal_proto_cosmos_proto_rawDescData
 }
 
-var file_internal_proto_cosmos_proto_msgTypes = make([]protoimpl.MessageInfo, 13)
+var file_internal_proto_cosmos_proto_msgTypes = make([]protoimpl.MessageInfo, 24)
 var file_internal_proto_cosmos_proto_goTypes = []any{
 	(*AgentMessage)(nil),        // 0: cosmos.AgentMessage
 	(*ControllerMessage)(nil),   // 1: cosmos.ControllerMessage
 	(*AgentHeartbeat)(nil),      // 2: cosmos.AgentHeartbeat
-	(*ComponentStatus)(nil),     // 3: cosmos.ComponentStatus
-	(*HealthCheckResult)(nil),   // 4: cosmos.HealthCheckResult
-	(*DeploymentResult)(nil),    // 5: cosmos.DeploymentResult
-	(*LogChunk)(nil),            // 6: cosmos.LogChunk
-	(*Acknowledgment)(nil),      // 7: cosmos.Acknowledgment
-	(*ComponentDeployment)(nil), // 8: cosmos.ComponentDeployment
-	(*ComponentRemoval)(nil),    // 9: cosmos.ComponentRemoval
-	(*HealthCheckConfig)(nil),   // 10: cosmos.HealthCheckConfig
-	nil,                         // 11: cosmos.AgentHeartbeat.MetadataEntry
-	nil,                         // 12: cosmos.ComponentDeployment.EnvEntry
+	(*SystemMetrics)(nil),       // 3: cosmos.SystemMetrics
+	(*ComponentStatus)(nil),     // 4: cosmos.ComponentStatus
+	(*RestartEvent)(nil),        // 5: cosmos.RestartEvent
+	(*HealthCheckResult)(nil),   // 6: cosmos.HealthCheckResult
+	(*DeploymentResult)(nil),    // 7: cosmos.DeploymentResult
+	(*LogChunk)(nil),            // 8: cosmos.LogChunk
+	(*LogRequest)(nil),          // 9: cosmos.LogRequest
+	(*LogResponse)(nil),         // 10: cosmos.LogResponse
+	(*Acknowledgment)(nil),      // 11: cosmos.Acknowledgment
+	(*ComponentDeployment)(nil), // 12: cosmos.ComponentDeployment
+	(*CanaryAnalysis)(nil),      // 13: cosmos.CanaryAnalysis
+	(*ContentMirror)(nil),       // 14: cosmos.ContentMirror
+	(*WaitForEndpoint)(nil),     // 15: cosmos.WaitForEndpoint
+	(*LogLevelChange)(nil),      // 16: cosmos.LogLevelChange
+	(*ComponentRemoval)(nil),    // 17: cosmos.ComponentRemoval
+	(*ComponentControl)(nil),    // 18: cosmos.ComponentControl
+	(*HealthCheckConfig)(nil),   // 19: cosmos.HealthCheckConfig
+	nil,                         // 20: cosmos.AgentHeartbeat.MetadataEntry
+	nil,                         // 21: cosmos.ComponentDeployment.EnvEntry
+	nil,                         // 22: cosmos.ComponentDeployment.ContentUrlHeadersEntry
+	nil,                         // 23: cosmos.HealthCheckConfig.HeadersEntry
 }
 var file_internal_proto_cosmos_proto_depIdxs = []int32{
 	2,  // 0: cosmos.AgentMessage.heartbeat:type_name -> cosmos.AgentHeartbeat
-	3,  // 1: cosmos.AgentMessage.component_status:type_name -> cosmos.ComponentStatus
-	4,  // 2: cosmos.AgentMessage.health_result:type_name -> cosmos.HealthCheckResult
-	5,  // 3: cosmos.AgentMessage.deployment_result:type_name -> cosmos.DeploymentResult
-	6,  // 4: cosmos.AgentMessage.log_chunk:type_name -> cosmos.LogChunk
-	7,  // 5: cosmos.ControllerMessage.ack:type_name -> cosmos.Acknowledgment
-	8,  // 6: cosmos.ControllerMessage.deployment:type_name -> cosmos.ComponentDeployment
-	9,  // 7: cosmos.ControllerMessage.removal:type_name -> cosmos.ComponentRemoval
-	10, // 8: cosmos.ControllerMessage.health_config:type_name -> cosmos.HealthCheckConfig
-	11, // 9: cosmos.AgentHeartbeat.metadata:type_name -> cosmos.AgentHeartbeat.MetadataEntry
-	3,  // 10: cosmos.AgentHeartbeat.component_statuses:type_name -> cosmos.ComponentStatus
-	10, // 11: cosmos.ComponentDeployment.health_check:type_name -> cosmos.HealthCheckConfig
-	12, // 12: cosmos.ComponentDeployment.env:type_name -> cosmos.ComponentDeployment.EnvEntry
-	0,  // 13: cosmos.CosmosController.StreamAgentMessages:input_type -> cosmos.AgentMessage
-	1,  // 14: cosmos.CosmosController.StreamAgentMessages:output_type -> cosmos.ControllerMessage
-	14, // [14:15] is the sub-list for method output_type
-	13, // [13:14] is the sub-list for method input_type
-	13, // [13:13] is the sub-list for extension type_name
-	13, // [13:13] is the sub-list for extension extendee
-	0,  // [0:13] is the sub-list for field type_name
+	4,  // 1: cosmos.AgentMessage.component_status:type_name -> cosmos.ComponentStatus
+	6,  // 2: cosmos.AgentMessage.health_result:type_name -> cosmos.HealthCheckResult
+	7,  // 3: cosmos.AgentMessage.deployment_result:type_name -> cosmos.DeploymentResult
+	8,  // 4: cosmos.AgentMessage.log_chunk:type_name -> cosmos.LogChunk
+	10, // 5: cosmos.AgentMessage.log_response:type_name -> cosmos.LogResponse
+	11, // 6: cosmos.ControllerMessage.ack:type_name -> cosmos.Acknowledgment
+	12, // 7: cosmos.ControllerMessage.deployment:type_name -> cosmos.ComponentDeployment
+	17, // 8: cosmos.ControllerMessage.removal:type_name -> cosmos.ComponentRemoval
+	19, // 9: cosmos.ControllerMessage.health_config:type_name -> cosmos.HealthCheckConfig
+	16, // 10: cosmos.ControllerMessage.log_level:type_name -> cosmos.LogLevelChange
+	9,  // 11: cosmos.ControllerMessage.log_request:type_name -> cosmos.LogRequest
+	18, // 12: cosmos.ControllerMessage.control:type_name -> cosmos.ComponentControl
+	20, // 13: cosmos.AgentHeartbeat.metadata:type_name -> cosmos.AgentHeartbeat.MetadataEntry
+	4,  // 14: cosmos.AgentHeartbeat.component_statuses:type_name -> cosmos.ComponentStatus
+	3,  // 15: cosmos.AgentHeartbeat.system_metrics:type_name -> cosmos.SystemMetrics
+	5,  // 16: cosmos.ComponentStatus.restart_history:type_name -> cosmos.RestartEvent
+	19, // 17: cosmos.ComponentDeployment.health_check:type_name -> cosmos.HealthCheckConfig
+	21, // 18: cosmos.ComponentDeployment.env:type_name -> cosmos.ComponentDeployment.EnvEntry
+	15, // 19: cosmos.ComponentDeployment.wait_for:type_name -> cosmos.WaitForEndpoint
+	14, // 20: cosmos.ComponentDeployment.content_mirrors:type_name -> cosmos.ContentMirror
+	13, // 21: cosmos.ComponentDeployment.canary:type_name -> cosmos.CanaryAnalysis
+	22, // 22: cosmos.ComponentDeployment.content_url_headers:type_name -> cosmos.ComponentDeployment.ContentUrlHeadersEntry
+	23, // 23: cosmos.HealthCheckConfig.headers:type_name -> cosmos.HealthCheckConfig.HeadersEntry
+	0,  // 24: cosmos.CosmosController.StreamAgentMessages:input_type -> cosmos.AgentMessage
+	1,  // 25: cosmos.CosmosController.StreamAgentMessages:output_type -> cosmos.ControllerMessage
+	25, // [25:26] is the sub-list for method output_type
+	24, // [24:25] is the sub-list for method input_type
+	24, // [24:24] is the sub-list for extension type_name
+	24, // [24:24] is the sub-list for extension extendee
+	0,  // [0:24] is the sub-list for field type_name
 }
 
 func init() { file_internal_proto_cosmos_proto_init() }
@@ -1097,12 +2107,16 @@ func file_internal_proto_cosmos_proto_init() {
 		(*AgentMessage_HealthResult)(nil),
 		(*AgentMessage_DeploymentResult)(nil),
 		(*AgentMessage_LogChunk)(nil),
+		(*AgentMessage_LogResponse)(nil),
 	}
 	file_internal_proto_cosmos_proto_msgTypes[1].OneofWrappers = []any{
 		(*ControllerMessage_Ack)(nil),
 		(*ControllerMessage_Deployment)(nil),
 		(*ControllerMessage_Removal)(nil),
 		(*ControllerMessage_HealthConfig)(nil),
+		(*ControllerMessage_LogLevel)(nil),
+		(*ControllerMessage_LogRequest)(nil),
+		(*ControllerMessage_Control)(nil),
 	}
 	type x struct{}
 	out := protoimpl.TypeBuilder{
@@ -1110,7 +2124,7 @@ func file_internal_proto_cosmos_proto_init() {
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: unsafe.Slice(unsafe.StringData(file_internal_proto_cosmos_proto_rawDesc), len(file_internal_proto_cosmos_proto_rawDesc)),
 			NumEnums:      0,
-			NumMessages:   13,
+			NumMessages:   24,
 			NumExtensions: 0,
 			NumServices:   1,
 		},
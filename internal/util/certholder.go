@@ -0,0 +1,46 @@
+package util
+
+import (
+	"crypto/tls"
+	"fmt"
+	"sync/atomic"
+)
+
+// CertHolder holds the current certificate pair of a TLS config. The config
+// reads it on every handshake, so a renewed certificate is used by new
+// connections once Reload is called, without rebuilding servers or clients.
+type CertHolder struct {
+	certPath string
+	keyPath  string
+	cert     atomic.Pointer[tls.Certificate]
+}
+
+// NewCertHolder loads the certificate pair from certPath and keyPath
+func NewCertHolder(certPath, keyPath string) (*CertHolder, error) {
+	h := &CertHolder{certPath: certPath, keyPath: keyPath}
+	if err := h.Reload(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// Reload reads the certificate pair from disk again. The previous pair stays
+// in use if it can't be loaded.
+func (h *CertHolder) Reload() error {
+	cert, err := tls.LoadX509KeyPair(h.certPath, h.keyPath)
+	if err != nil {
+		return fmt.Errorf("failed to load certificate pair: %w", err)
+	}
+	h.cert.Store(&cert)
+	return nil
+}
+
+// GetCertificate is the tls.Config callback for servers
+func (h *CertHolder) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return h.cert.Load(), nil
+}
+
+// GetClientCertificate is the tls.Config callback for clients
+func (h *CertHolder) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return h.cert.Load(), nil
+}
@@ -0,0 +1,169 @@
+package util
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+// newTestCert issues a certificate for commonName, signed by parent or
+// self-signed as a CA when parent is nil
+func newTestCert(t *testing.T, commonName string, serial int64, parent *testCert) *testCert {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{commonName},
+	}
+
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Failed to parse certificate: %v", err)
+	}
+
+	return &testCert{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// write stores the certificate and its key as PEM files in dir
+func (c *testCert) write(t *testing.T, dir, name string) (certPath, keyPath string) {
+	t.Helper()
+
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+
+	certPath = filepath.Join(dir, name+".crt")
+	keyPath = filepath.Join(dir, name+".key")
+	if err := os.WriteFile(certPath, c.pem, 0644); err != nil {
+		t.Fatalf("Failed to write certificate: %v", err)
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatalf("Failed to write key: %v", err)
+	}
+	return certPath, keyPath
+}
+
+func TestReloadedCertificateUsedByNewHandshakes(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "cosmos-ca", 1, nil)
+	caPath, _ := ca.write(t, dir, "ca")
+	certPath, keyPath := newTestCert(t, "localhost", 100, ca).write(t, dir, "server")
+
+	certs, err := NewCertHolder(certPath, keyPath)
+	if err != nil {
+		t.Fatalf("Failed to load certificate: %v", err)
+	}
+	serverConfig, err := newTLSConfig(certs, caPath)
+	if err != nil {
+		t.Fatalf("Failed to load TLS config: %v", err)
+	}
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", serverConfig)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	serverSerial := func() int64 {
+		conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{RootCAs: pool, ServerName: "localhost"})
+		if err != nil {
+			t.Fatalf("Handshake failed: %v", err)
+		}
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64()
+	}
+
+	if got := serverSerial(); got != 100 {
+		t.Fatalf("Expected the first certificate, got serial %d", got)
+	}
+
+	newTestCert(t, "localhost", 200, ca).write(t, dir, "server")
+	if got := serverSerial(); got != 100 {
+		t.Errorf("Expected the loaded certificate until reload, got serial %d", got)
+	}
+
+	if err := certs.Reload(); err != nil {
+		t.Fatalf("Failed to reload certificate: %v", err)
+	}
+	if got := serverSerial(); got != 200 {
+		t.Errorf("Expected the renewed certificate after reload, got serial %d", got)
+	}
+}
+
+func TestReloadKeepsCertificateOnError(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := newTestCert(t, "localhost", 100, nil).write(t, dir, "server")
+
+	certs, err := NewCertHolder(certPath, keyPath)
+	if err != nil {
+		t.Fatalf("Failed to load certificate: %v", err)
+	}
+
+	if err := os.WriteFile(keyPath, []byte("not a key"), 0600); err != nil {
+		t.Fatalf("Failed to corrupt key: %v", err)
+	}
+	if err := certs.Reload(); err == nil {
+		t.Error("Expected reloading a corrupt key to fail")
+	}
+
+	cert, _ := certs.GetCertificate(nil)
+	if cert == nil {
+		t.Fatal("Expected the previous certificate to stay in use")
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil || leaf.SerialNumber.Int64() != 100 {
+		t.Errorf("Expected the previous certificate to stay in use, got %v", leaf)
+	}
+}
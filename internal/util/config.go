@@ -1,92 +1,317 @@
 package util
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"strconv"
+	"strings"
 	"time"
+
+	"gopkg.in/yaml.v3"
 )
 
 type AgentConfig struct {
-	ControllerURL string
-	AgentPort     string
-	DataDir       string
-	LogLevel      string
-	Tags          string
-
-	TLSEnabled  bool
-	TLSCertPath string
-	TLSKeyPath  string
-	TLSCAPath   string
-
-	VaultEnabled    bool
-	VaultAddr       string
-	VaultToken      string
-	VaultPKIPath    string
-	VaultPKIRole    string
-	CertTTL         string
-	CertRenewBefore time.Duration
-
-	ReconcileInterval time.Duration
-	HeartbeatInterval time.Duration
+	ControllerURL string `yaml:"controller_url"`
+	AgentPort     string `yaml:"agent_port"`
+	DataDir       string `yaml:"data_dir"`
+	LogLevel      string `yaml:"log_level"`
+	Tags          string `yaml:"tags"`
+
+	TLSEnabled  bool   `yaml:"tls_enabled"`
+	TLSCertPath string `yaml:"tls_cert_path"`
+	TLSKeyPath  string `yaml:"tls_key_path"`
+	// TLSCAPath is a PEM file or a directory of them with the trusted CAs
+	TLSCAPath string `yaml:"tls_ca_path"`
+
+	VaultEnabled bool   `yaml:"vault_enabled"`
+	VaultAddr    string `yaml:"vault_addr"`
+	VaultToken   string `yaml:"vault_token"`
+	// VaultRoleID and VaultSecretID authenticate through AppRole instead of
+	// VaultToken
+	VaultRoleID      string        `yaml:"vault_role_id"`
+	VaultSecretID    string        `yaml:"vault_secret_id"`
+	VaultAppRolePath string        `yaml:"vault_approle_path"`
+	VaultPKIPath     string        `yaml:"vault_pki_path"`
+	VaultPKIRole     string        `yaml:"vault_pki_role"`
+	CertTTL          string        `yaml:"cert_ttl"`
+	CertRenewBefore  time.Duration `yaml:"cert_renew_before"`
+
+	// Startup certificate issuance is retried so a brief Vault outage
+	// doesn't stop the process
+	VaultRetryAttempts int           `yaml:"vault_retry_attempts"`
+	VaultRetryBackoff  time.Duration `yaml:"vault_retry_backoff"`
+
+	ReconcileInterval time.Duration `yaml:"reconcile_interval"`
+	HeartbeatInterval time.Duration `yaml:"heartbeat_interval"`
+
+	// Exited components are restarted with exponential backoff, and given
+	// up on after RestartMaxCount restarts within RestartWindow. The count
+	// is checked against the last 20 restarts the agent keeps.
+	RestartBackoff    time.Duration `yaml:"restart_backoff"`
+	RestartMaxBackoff time.Duration `yaml:"restart_max_backoff"`
+	RestartMaxCount   int           `yaml:"restart_max_count"`
+	RestartWindow     time.Duration `yaml:"restart_window"`
+
+	// HealthCheckJitter spreads each component's checks by up to this
+	// percentage of its interval so they don't all fire on the same tick
+	HealthCheckJitter int `yaml:"health_check_jitter"`
+
+	DownloadConcurrency       int           `yaml:"download_concurrency"`
+	DownloadChunkSize         int64         `yaml:"download_chunk_size"`
+	DownloadParallelThreshold int64         `yaml:"download_parallel_threshold"`
+	DownloadTimeout           time.Duration `yaml:"download_timeout"`
+	DownloadStallTimeout      time.Duration `yaml:"download_stall_timeout"`
+	DownloadRetryAttempts     int           `yaml:"download_retry_attempts"`
+	DownloadRetryDelay        time.Duration `yaml:"download_retry_delay"`
+	// DownloadMinFreeSpace is how many bytes must stay free in the data dir
+	// after a program is downloaded and extracted
+	DownloadMinFreeSpace int64 `yaml:"download_min_free_space"`
+	// Downloaded archives are cached in the data dir by hash, up to
+	// DownloadCacheMaxSize bytes, and evicted once unused for
+	// DownloadCacheMaxAge
+	DownloadCacheMaxSize int64         `yaml:"download_cache_max_size"`
+	DownloadCacheMaxAge  time.Duration `yaml:"download_cache_max_age"`
+
+	// CgroupRoot is the cgroup v2 directory that components with memory or
+	// CPU limits get their own cgroups in
+	CgroupRoot string `yaml:"cgroup_root"`
+
+	// Unmanaged scripts run in the namespaces of UnmanagedScriptTarget
+	// through nsenter, for agents in a container, or as children of the
+	// agent in "direct" mode. The host sees the agent's scripts directory
+	// at UnmanagedScriptHostDir. Scripts still running after
+	// UnmanagedScriptTimeout are killed.
+	UnmanagedScriptMode       string        `yaml:"unmanaged_script_mode"`
+	UnmanagedScriptTarget     int           `yaml:"unmanaged_script_target"`
+	UnmanagedScriptNamespaces []string      `yaml:"unmanaged_script_namespaces"`
+	UnmanagedScriptWorkingDir string        `yaml:"unmanaged_script_working_dir"`
+	UnmanagedScriptHostDir    string        `yaml:"unmanaged_script_host_dir"`
+	UnmanagedScriptTimeout    time.Duration `yaml:"unmanaged_script_timeout"`
+
+	// The metrics and status server listens on AgentPort
+	MetricsEnabled  bool   `yaml:"metrics_enabled"`
+	MetricsBindAddr string `yaml:"metrics_bind_addr"`
 }
 
 type ControllerConfig struct {
-	HTTPPort    int
-	GRPCPort    int
-	DatabaseURL string
-	LogLevel    string
-
-	TLSEnabled  bool
-	TLSCertPath string
-	TLSKeyPath  string
-	TLSCAPath   string
-
-	VaultEnabled    bool
-	VaultAddr       string
-	VaultToken      string
-	VaultPKIPath    string
-	VaultPKIRole    string
-	CertTTL         string
-	CertRenewBefore time.Duration
-
-	CommandCoreURL string
-	NomadAddr      string
-	ConsulAddr     string
-
-	AgentTimeout        time.Duration
-	NodeSyncInterval    time.Duration
-	CleanupInterval     time.Duration
-	DeploymentRetention time.Duration
+	HTTPPort    int    `yaml:"http_port"`
+	GRPCPort    int    `yaml:"grpc_port"`
+	DatabaseURL string `yaml:"database_url"`
+	LogLevel    string `yaml:"log_level"`
+
+	// DatabaseAutoMigrate also runs gorm's AutoMigrate after the versioned
+	// migrations, for development against models without a migration yet
+	DatabaseAutoMigrate bool `yaml:"database_auto_migrate"`
+
+	// APIAuthEnabled requires a bearer token on the HTTP API: APIToken or a
+	// key stored in the database. APIBootstrapKey is stored as the first
+	// admin key when there is none yet.
+	APIAuthEnabled  bool   `yaml:"api_auth_enabled"`
+	APIToken        string `yaml:"api_token"`
+	APIBootstrapKey string `yaml:"api_bootstrap_key"`
+
+	TLSEnabled  bool   `yaml:"tls_enabled"`
+	TLSCertPath string `yaml:"tls_cert_path"`
+	TLSKeyPath  string `yaml:"tls_key_path"`
+	// TLSCAPath is a PEM file or a directory of them with the trusted CAs
+	TLSCAPath string `yaml:"tls_ca_path"`
+
+	VaultEnabled bool   `yaml:"vault_enabled"`
+	VaultAddr    string `yaml:"vault_addr"`
+	VaultToken   string `yaml:"vault_token"`
+	// VaultRoleID and VaultSecretID authenticate through AppRole instead of
+	// VaultToken
+	VaultRoleID      string        `yaml:"vault_role_id"`
+	VaultSecretID    string        `yaml:"vault_secret_id"`
+	VaultAppRolePath string        `yaml:"vault_approle_path"`
+	VaultPKIPath     string        `yaml:"vault_pki_path"`
+	VaultPKIRole     string        `yaml:"vault_pki_role"`
+	CertTTL          string        `yaml:"cert_ttl"`
+	CertRenewBefore  time.Duration `yaml:"cert_renew_before"`
+
+	// Startup certificate issuance is retried so a brief Vault outage
+	// doesn't stop the process
+	VaultRetryAttempts int           `yaml:"vault_retry_attempts"`
+	VaultRetryBackoff  time.Duration `yaml:"vault_retry_backoff"`
+
+	CommandCoreURL string `yaml:"command_core_url"`
+	// Script submissions to command-core time out after CommandCoreTimeout
+	// and are retried on network errors, 429 and 5xx
+	CommandCoreTimeout      time.Duration `yaml:"command_core_timeout"`
+	CommandCoreRetries      int           `yaml:"command_core_retries"`
+	CommandCoreRetryBackoff time.Duration `yaml:"command_core_retry_backoff"`
+
+	NomadAddr string `yaml:"nomad_addr"`
+	// NomadNamespace and NomadRegion are the defaults for services that
+	// don't set their own; NomadToken is the ACL token
+	NomadNamespace string `yaml:"nomad_namespace"`
+	NomadRegion    string `yaml:"nomad_region"`
+	NomadToken     string `yaml:"nomad_token"`
+	ConsulAddr     string `yaml:"consul_addr"`
+
+	// Services with a k8s_manifest are applied to this Kubernetes API
+	// server. K8sCAPath verifies its certificate and K8sNamespace is the
+	// default namespace.
+	K8sAPIServer string `yaml:"k8s_api_server"`
+	K8sToken     string `yaml:"k8s_token"`
+	K8sCAPath    string `yaml:"k8s_ca_path"`
+	K8sNamespace string `yaml:"k8s_namespace"`
+
+	// NodeSource is where the node sync reads hosts from: "command-core"
+	// or "consul"
+	NodeSource string `yaml:"node_source"`
+
+	AgentTimeout        time.Duration `yaml:"agent_timeout"`
+	NodeSyncInterval    time.Duration `yaml:"node_sync_interval"`
+	CleanupInterval     time.Duration `yaml:"cleanup_interval"`
+	DeploymentRetention time.Duration `yaml:"deployment_retention"`
+	// DeploymentTimeout is how long a deployment waits for agent results, and
+	// for Nomad to finish deploying a service
+	DeploymentTimeout time.Duration `yaml:"deployment_timeout"`
+
+	LeaderElection      bool          `yaml:"leader_election"`
+	LeaderLeaseDuration time.Duration `yaml:"leader_lease_duration"`
+	ControllerID        string        `yaml:"controller_id"`
+
+	// Default health check for managed components that don't define one.
+	// An empty type disables it.
+	DefaultHealthCheckType           string        `yaml:"default_health_check_type"`
+	DefaultHealthCheckEndpoint       string        `yaml:"default_health_check_endpoint"`
+	DefaultHealthCheckInterval       time.Duration `yaml:"default_health_check_interval"`
+	DefaultHealthCheckTimeout        time.Duration `yaml:"default_health_check_timeout"`
+	DefaultHealthCheckRetries        int           `yaml:"default_health_check_retries"`
+	DefaultHealthCheckComponentTypes []string      `yaml:"default_health_check_component_types"`
 }
 
 func LoadAgentConfig() (*AgentConfig, error) {
 	config := &AgentConfig{
-		ControllerURL: getEnv("COSMOS_CONTROLLER_URL", "controller:9091"),
-		AgentPort:     getEnv("COSMOS_AGENT_PORT", "9092"),
-		DataDir:       getEnv("COSMOS_DATA_DIR", "/var/lib/cosmos/agent"),
-		LogLevel:      getEnv("COSMOS_LOG_LEVEL", "info"),
-		Tags:          getEnv("COSMOS_TAGS", ""),
+		ControllerURL: "controller:9091",
+		AgentPort:     "9092",
+		DataDir:       "/var/lib/cosmos/agent",
+		LogLevel:      "info",
 
-		TLSEnabled:  getEnvBool("COSMOS_TLS_ENABLED", true),
-		TLSCertPath: getEnv("COSMOS_TLS_CERT", "/etc/cosmos/agent/agent.crt"),
-		TLSKeyPath:  getEnv("COSMOS_TLS_KEY", "/etc/cosmos/agent/agent.key"),
-		TLSCAPath:   getEnv("COSMOS_TLS_CA", "/etc/cosmos/agent/ca.crt"),
+		TLSEnabled:  true,
+		TLSCertPath: "/etc/cosmos/agent/agent.crt",
+		TLSKeyPath:  "/etc/cosmos/agent/agent.key",
+		TLSCAPath:   "/etc/cosmos/agent/ca.crt",
 
-		VaultEnabled:    getEnvBool("VAULT_ENABLED", true),
-		VaultAddr:       os.Getenv("VAULT_ADDR"),
-		VaultToken:      os.Getenv("VAULT_TOKEN"),
-		VaultPKIPath:    getEnv("COSMOS_VAULT_PKI_PATH", "cosmos-pki"),
-		VaultPKIRole:    getEnv("COSMOS_VAULT_PKI_ROLE", "agent"),
-		CertTTL:         getEnv("COSMOS_CERT_TTL", "72h"),
-		CertRenewBefore: getEnvDuration("COSMOS_CERT_RENEW_BEFORE", 24*time.Hour),
+		VaultEnabled:     true,
+		VaultAppRolePath: "approle",
+		VaultPKIPath:     "cosmos-pki",
+		VaultPKIRole:     "agent",
+		CertTTL:          "72h",
+		CertRenewBefore:  24 * time.Hour,
 
-		ReconcileInterval: getEnvDuration("COSMOS_AGENT_RECONCILE_INTERVAL", 30*time.Second),
-		HeartbeatInterval: getEnvDuration("COSMOS_AGENT_HEARTBEAT_INTERVAL", 30*time.Second),
+		VaultRetryAttempts: 10,
+		VaultRetryBackoff:  2 * time.Second,
+
+		ReconcileInterval: 30 * time.Second,
+		HeartbeatInterval: 30 * time.Second,
+
+		RestartBackoff:    5 * time.Second,
+		RestartMaxBackoff: 5 * time.Minute,
+		RestartMaxCount:   5,
+		RestartWindow:     10 * time.Minute,
+
+		HealthCheckJitter: 10,
+
+		DownloadConcurrency:       4,
+		DownloadChunkSize:         16 * 1024 * 1024,
+		DownloadParallelThreshold: 64 * 1024 * 1024,
+		DownloadTimeout:           10 * time.Minute,
+		DownloadStallTimeout:      30 * time.Second,
+		DownloadRetryAttempts:     4,
+		DownloadRetryDelay:        time.Second,
+		DownloadMinFreeSpace:      256 * 1024 * 1024,
+		DownloadCacheMaxSize:      2 * 1024 * 1024 * 1024,
+		DownloadCacheMaxAge:       7 * 24 * time.Hour,
+
+		CgroupRoot: "/sys/fs/cgroup/cosmos",
+
+		UnmanagedScriptMode:       "nsenter",
+		UnmanagedScriptTarget:     1,
+		UnmanagedScriptNamespaces: []string{"mount", "uts", "ipc", "net", "pid"},
+		UnmanagedScriptWorkingDir: "/home/ubuntu",
+		UnmanagedScriptHostDir:    "/opt/cosmos-agent/scripts",
+		UnmanagedScriptTimeout:    30 * time.Minute,
+
+		MetricsEnabled:  true,
+		MetricsBindAddr: "127.0.0.1",
 	}
 
-	if config.VaultEnabled && (config.VaultAddr == "" || config.VaultToken == "") {
-		return nil, fmt.Errorf("vault enabled but VAULT_ADDR or VAULT_TOKEN not set")
+	if err := loadConfigFile(config); err != nil {
+		return nil, err
+	}
+
+	config.ControllerURL = getEnv("COSMOS_CONTROLLER_URL", config.ControllerURL)
+	config.AgentPort = getEnv("COSMOS_AGENT_PORT", config.AgentPort)
+	config.DataDir = getEnv("COSMOS_DATA_DIR", config.DataDir)
+	config.LogLevel = getEnv("COSMOS_LOG_LEVEL", config.LogLevel)
+	config.Tags = getEnv("COSMOS_TAGS", config.Tags)
+
+	config.TLSEnabled = getEnvBool("COSMOS_TLS_ENABLED", config.TLSEnabled)
+	config.TLSCertPath = getEnv("COSMOS_TLS_CERT", config.TLSCertPath)
+	config.TLSKeyPath = getEnv("COSMOS_TLS_KEY", config.TLSKeyPath)
+	config.TLSCAPath = getEnv("COSMOS_TLS_CA", config.TLSCAPath)
+
+	config.VaultEnabled = getEnvBool("VAULT_ENABLED", config.VaultEnabled)
+	config.VaultAddr = getEnv("VAULT_ADDR", config.VaultAddr)
+	config.VaultToken = getEnv("VAULT_TOKEN", config.VaultToken)
+	config.VaultRoleID = getEnv("VAULT_ROLE_ID", config.VaultRoleID)
+	config.VaultSecretID = getEnv("VAULT_SECRET_ID", config.VaultSecretID)
+	config.VaultAppRolePath = getEnv("COSMOS_VAULT_APPROLE_PATH", config.VaultAppRolePath)
+	config.VaultPKIPath = getEnv("COSMOS_VAULT_PKI_PATH", config.VaultPKIPath)
+	config.VaultPKIRole = getEnv("COSMOS_VAULT_PKI_ROLE", config.VaultPKIRole)
+	config.CertTTL = getEnv("COSMOS_CERT_TTL", config.CertTTL)
+	config.CertRenewBefore = getEnvDuration("COSMOS_CERT_RENEW_BEFORE", config.CertRenewBefore)
+
+	config.VaultRetryAttempts = getEnvInt("COSMOS_VAULT_RETRY_ATTEMPTS", config.VaultRetryAttempts)
+	config.VaultRetryBackoff = getEnvDuration("COSMOS_VAULT_RETRY_BACKOFF", config.VaultRetryBackoff)
+
+	config.ReconcileInterval = getEnvDuration("COSMOS_AGENT_RECONCILE_INTERVAL", config.ReconcileInterval)
+	config.HeartbeatInterval = getEnvDuration("COSMOS_AGENT_HEARTBEAT_INTERVAL", config.HeartbeatInterval)
+
+	config.RestartBackoff = getEnvDuration("COSMOS_AGENT_RESTART_BACKOFF", config.RestartBackoff)
+	config.RestartMaxBackoff = getEnvDuration("COSMOS_AGENT_RESTART_MAX_BACKOFF", config.RestartMaxBackoff)
+	config.RestartMaxCount = getEnvInt("COSMOS_AGENT_RESTART_MAX_COUNT", config.RestartMaxCount)
+	config.RestartWindow = getEnvDuration("COSMOS_AGENT_RESTART_WINDOW", config.RestartWindow)
+
+	config.HealthCheckJitter = getEnvInt("COSMOS_AGENT_HEALTH_CHECK_JITTER", config.HealthCheckJitter)
+
+	config.DownloadConcurrency = getEnvInt("COSMOS_DOWNLOAD_CONCURRENCY", config.DownloadConcurrency)
+	config.DownloadChunkSize = int64(getEnvInt("COSMOS_DOWNLOAD_CHUNK_SIZE", int(config.DownloadChunkSize)))
+	config.DownloadParallelThreshold = int64(getEnvInt("COSMOS_DOWNLOAD_PARALLEL_THRESHOLD", int(config.DownloadParallelThreshold)))
+	config.DownloadTimeout = getEnvDuration("COSMOS_DOWNLOAD_TIMEOUT", config.DownloadTimeout)
+	config.DownloadStallTimeout = getEnvDuration("COSMOS_DOWNLOAD_STALL_TIMEOUT", config.DownloadStallTimeout)
+	config.DownloadRetryAttempts = getEnvInt("COSMOS_DOWNLOAD_RETRY_ATTEMPTS", config.DownloadRetryAttempts)
+	config.DownloadRetryDelay = getEnvDuration("COSMOS_DOWNLOAD_RETRY_DELAY", config.DownloadRetryDelay)
+	config.DownloadMinFreeSpace = int64(getEnvInt("COSMOS_DOWNLOAD_MIN_FREE_SPACE", int(config.DownloadMinFreeSpace)))
+	config.DownloadCacheMaxSize = int64(getEnvInt("COSMOS_DOWNLOAD_CACHE_MAX_SIZE", int(config.DownloadCacheMaxSize)))
+	config.DownloadCacheMaxAge = getEnvDuration("COSMOS_DOWNLOAD_CACHE_MAX_AGE", config.DownloadCacheMaxAge)
+
+	config.CgroupRoot = getEnv("COSMOS_AGENT_CGROUP_ROOT", config.CgroupRoot)
+
+	config.UnmanagedScriptMode = getEnv("COSMOS_UNMANAGED_SCRIPT_MODE", config.UnmanagedScriptMode)
+	config.UnmanagedScriptTarget = getEnvInt("COSMOS_UNMANAGED_SCRIPT_TARGET", config.UnmanagedScriptTarget)
+	config.UnmanagedScriptNamespaces = getEnvList("COSMOS_UNMANAGED_SCRIPT_NAMESPACES", config.UnmanagedScriptNamespaces)
+	config.UnmanagedScriptWorkingDir = getEnv("COSMOS_UNMANAGED_SCRIPT_WORKING_DIR", config.UnmanagedScriptWorkingDir)
+	config.UnmanagedScriptHostDir = getEnv("COSMOS_UNMANAGED_SCRIPT_HOST_DIR", config.UnmanagedScriptHostDir)
+	config.UnmanagedScriptTimeout = getEnvDuration("COSMOS_UNMANAGED_SCRIPT_TIMEOUT", config.UnmanagedScriptTimeout)
+
+	config.MetricsEnabled = getEnvBool("COSMOS_AGENT_METRICS_ENABLED", config.MetricsEnabled)
+	config.MetricsBindAddr = getEnv("COSMOS_AGENT_METRICS_BIND", config.MetricsBindAddr)
+
+	if err := validateVaultAuth(config.VaultEnabled, config.VaultAddr, config.VaultToken, config.VaultRoleID, config.VaultSecretID); err != nil {
+		return nil, err
+	}
+
+	switch config.UnmanagedScriptMode {
+	case "nsenter", "direct":
+	default:
+		return nil, fmt.Errorf("unknown unmanaged script mode %q, expected nsenter or direct", config.UnmanagedScriptMode)
 	}
 
 	return config, nil
@@ -94,43 +319,185 @@ func LoadAgentConfig() (*AgentConfig, error) {
 
 func LoadControllerConfig() (*ControllerConfig, error) {
 	config := &ControllerConfig{
-		HTTPPort:    getEnvInt("COSMOS_HTTP_PORT", 8090),
-		GRPCPort:    getEnvInt("COSMOS_GRPC_PORT", 9091),
-		DatabaseURL: os.Getenv("COSMOS_DB_URL"),
-		LogLevel:    getEnv("COSMOS_LOG_LEVEL", "info"),
+		HTTPPort: 8090,
+		GRPCPort: 9091,
+		LogLevel: "info",
+
+		TLSEnabled:  true,
+		TLSCertPath: "/etc/cosmos/controller/controller.crt",
+		TLSKeyPath:  "/etc/cosmos/controller/controller.key",
+		TLSCAPath:   "/etc/cosmos/controller/ca.crt",
 
-		TLSEnabled:  getEnvBool("COSMOS_TLS_ENABLED", true),
-		TLSCertPath: getEnv("COSMOS_TLS_CERT", "/etc/cosmos/controller/controller.crt"),
-		TLSKeyPath:  getEnv("COSMOS_TLS_KEY", "/etc/cosmos/controller/controller.key"),
-		TLSCAPath:   getEnv("COSMOS_TLS_CA", "/etc/cosmos/controller/ca.crt"),
+		VaultEnabled:     true,
+		VaultAppRolePath: "approle",
+		VaultPKIPath:     "cosmos-pki",
+		VaultPKIRole:     "controller",
+		CertTTL:          "8760h",
+		CertRenewBefore:  720 * time.Hour,
 
-		VaultEnabled:    getEnvBool("VAULT_ENABLED", true),
-		VaultAddr:       os.Getenv("VAULT_ADDR"),
-		VaultToken:      os.Getenv("VAULT_TOKEN"),
-		VaultPKIPath:    getEnv("COSMOS_VAULT_PKI_PATH", "cosmos-pki"),
-		VaultPKIRole:    getEnv("COSMOS_VAULT_PKI_ROLE", "controller"),
-		CertTTL:         getEnv("COSMOS_CERT_TTL", "8760h"),
-		CertRenewBefore: getEnvDuration("COSMOS_CERT_RENEW_BEFORE", 720*time.Hour),
+		VaultRetryAttempts: 10,
+		VaultRetryBackoff:  2 * time.Second,
 
-		NomadAddr: getEnv("NOMAD_ADDR", "http://nomad.service.consul:4646"),
+		CommandCoreTimeout:      30 * time.Second,
+		CommandCoreRetries:      3,
+		CommandCoreRetryBackoff: time.Second,
 
-		AgentTimeout:        getEnvDuration("COSMOS_CONTROLLER_AGENT_TIMEOUT", 90*time.Second),
-		NodeSyncInterval:    getEnvDuration("COSMOS_CONTROLLER_NODE_SYNC_INTERVAL", 5*time.Minute),
-		CleanupInterval:     getEnvDuration("COSMOS_CONTROLLER_CLEANUP_INTERVAL", 24*time.Hour),
-		DeploymentRetention: getEnvDuration("COSMOS_CONTROLLER_DEPLOYMENT_RETENTION", 720*time.Hour),
+		NomadAddr: "http://nomad.service.consul:4646",
+
+		NodeSource: "command-core",
+
+		AgentTimeout:        90 * time.Second,
+		NodeSyncInterval:    5 * time.Minute,
+		CleanupInterval:     24 * time.Hour,
+		DeploymentRetention: 720 * time.Hour,
+		DeploymentTimeout:   10 * time.Minute,
+
+		LeaderLeaseDuration: 15 * time.Second,
+
+		DefaultHealthCheckInterval:       30 * time.Second,
+		DefaultHealthCheckTimeout:        5 * time.Second,
+		DefaultHealthCheckRetries:        3,
+		DefaultHealthCheckComponentTypes: []string{"program"},
+	}
+
+	if err := loadConfigFile(config); err != nil {
+		return nil, err
+	}
+
+	config.HTTPPort = getEnvInt("COSMOS_HTTP_PORT", config.HTTPPort)
+	config.GRPCPort = getEnvInt("COSMOS_GRPC_PORT", config.GRPCPort)
+	config.DatabaseURL = getEnv("COSMOS_DB_URL", config.DatabaseURL)
+	config.DatabaseAutoMigrate = getEnvBool("COSMOS_DB_AUTO_MIGRATE", config.DatabaseAutoMigrate)
+	config.LogLevel = getEnv("COSMOS_LOG_LEVEL", config.LogLevel)
+
+	config.APIAuthEnabled = getEnvBool("COSMOS_API_AUTH_ENABLED", config.APIAuthEnabled)
+	config.APIToken = getEnv("COSMOS_API_TOKEN", config.APIToken)
+	config.APIBootstrapKey = getEnv("COSMOS_API_BOOTSTRAP_KEY", config.APIBootstrapKey)
+
+	config.TLSEnabled = getEnvBool("COSMOS_TLS_ENABLED", config.TLSEnabled)
+	config.TLSCertPath = getEnv("COSMOS_TLS_CERT", config.TLSCertPath)
+	config.TLSKeyPath = getEnv("COSMOS_TLS_KEY", config.TLSKeyPath)
+	config.TLSCAPath = getEnv("COSMOS_TLS_CA", config.TLSCAPath)
+
+	config.VaultEnabled = getEnvBool("VAULT_ENABLED", config.VaultEnabled)
+	config.VaultAddr = getEnv("VAULT_ADDR", config.VaultAddr)
+	config.VaultToken = getEnv("VAULT_TOKEN", config.VaultToken)
+	config.VaultRoleID = getEnv("VAULT_ROLE_ID", config.VaultRoleID)
+	config.VaultSecretID = getEnv("VAULT_SECRET_ID", config.VaultSecretID)
+	config.VaultAppRolePath = getEnv("COSMOS_VAULT_APPROLE_PATH", config.VaultAppRolePath)
+	config.VaultPKIPath = getEnv("COSMOS_VAULT_PKI_PATH", config.VaultPKIPath)
+	config.VaultPKIRole = getEnv("COSMOS_VAULT_PKI_ROLE", config.VaultPKIRole)
+	config.CertTTL = getEnv("COSMOS_CERT_TTL", config.CertTTL)
+	config.CertRenewBefore = getEnvDuration("COSMOS_CERT_RENEW_BEFORE", config.CertRenewBefore)
+
+	config.VaultRetryAttempts = getEnvInt("COSMOS_VAULT_RETRY_ATTEMPTS", config.VaultRetryAttempts)
+	config.VaultRetryBackoff = getEnvDuration("COSMOS_VAULT_RETRY_BACKOFF", config.VaultRetryBackoff)
+
+	config.CommandCoreTimeout = getEnvDuration("COSMOS_COMMAND_CORE_TIMEOUT", config.CommandCoreTimeout)
+	config.CommandCoreRetries = getEnvInt("COSMOS_COMMAND_CORE_RETRIES", config.CommandCoreRetries)
+	config.CommandCoreRetryBackoff = getEnvDuration("COSMOS_COMMAND_CORE_RETRY_BACKOFF", config.CommandCoreRetryBackoff)
+
+	config.NomadAddr = getEnv("NOMAD_ADDR", config.NomadAddr)
+	config.NomadNamespace = getEnv("NOMAD_NAMESPACE", config.NomadNamespace)
+	config.NomadRegion = getEnv("NOMAD_REGION", config.NomadRegion)
+	config.NomadToken = getEnv("NOMAD_TOKEN", config.NomadToken)
+	config.ConsulAddr = getEnv("CONSUL_ADDR", config.ConsulAddr)
+
+	config.K8sAPIServer = getEnv("COSMOS_K8S_API_SERVER", config.K8sAPIServer)
+	config.K8sToken = getEnv("COSMOS_K8S_TOKEN", config.K8sToken)
+	config.K8sCAPath = getEnv("COSMOS_K8S_CA", config.K8sCAPath)
+	config.K8sNamespace = getEnv("COSMOS_K8S_NAMESPACE", config.K8sNamespace)
+
+	config.NodeSource = getEnv("COSMOS_NODE_SOURCE", config.NodeSource)
+
+	config.AgentTimeout = getEnvDuration("COSMOS_CONTROLLER_AGENT_TIMEOUT", config.AgentTimeout)
+	config.NodeSyncInterval = getEnvDuration("COSMOS_CONTROLLER_NODE_SYNC_INTERVAL", config.NodeSyncInterval)
+	config.CleanupInterval = getEnvDuration("COSMOS_CONTROLLER_CLEANUP_INTERVAL", config.CleanupInterval)
+	config.DeploymentRetention = getEnvDuration("COSMOS_CONTROLLER_DEPLOYMENT_RETENTION", config.DeploymentRetention)
+	config.DeploymentTimeout = getEnvDuration("COSMOS_CONTROLLER_DEPLOYMENT_TIMEOUT", config.DeploymentTimeout)
+
+	config.LeaderElection = getEnvBool("COSMOS_LEADER_ELECTION", config.LeaderElection)
+	config.LeaderLeaseDuration = getEnvDuration("COSMOS_LEADER_LEASE_DURATION", config.LeaderLeaseDuration)
+	config.ControllerID = getEnv("COSMOS_CONTROLLER_ID", config.ControllerID)
+
+	config.DefaultHealthCheckType = getEnv("COSMOS_DEFAULT_HEALTH_CHECK_TYPE", config.DefaultHealthCheckType)
+	config.DefaultHealthCheckEndpoint = getEnv("COSMOS_DEFAULT_HEALTH_CHECK_ENDPOINT", config.DefaultHealthCheckEndpoint)
+	config.DefaultHealthCheckInterval = getEnvDuration("COSMOS_DEFAULT_HEALTH_CHECK_INTERVAL", config.DefaultHealthCheckInterval)
+	config.DefaultHealthCheckTimeout = getEnvDuration("COSMOS_DEFAULT_HEALTH_CHECK_TIMEOUT", config.DefaultHealthCheckTimeout)
+	config.DefaultHealthCheckRetries = getEnvInt("COSMOS_DEFAULT_HEALTH_CHECK_RETRIES", config.DefaultHealthCheckRetries)
+	config.DefaultHealthCheckComponentTypes = getEnvList("COSMOS_DEFAULT_HEALTH_CHECK_COMPONENT_TYPES", config.DefaultHealthCheckComponentTypes)
+
+	if config.ControllerID == "" {
+		hostname, _ := os.Hostname()
+		config.ControllerID = fmt.Sprintf("%s-%d", hostname, os.Getpid())
 	}
 
 	if config.DatabaseURL == "" {
 		return nil, fmt.Errorf("COSMOS_DB_URL is required")
 	}
 
-	if config.VaultEnabled && (config.VaultAddr == "" || config.VaultToken == "") {
-		return nil, fmt.Errorf("vault enabled but VAULT_ADDR or VAULT_TOKEN not set")
+	switch config.NodeSource {
+	case "command-core":
+	case "consul":
+		if config.ConsulAddr == "" {
+			return nil, fmt.Errorf("node source consul but CONSUL_ADDR not set")
+		}
+	default:
+		return nil, fmt.Errorf("unknown node source %q, expected command-core or consul", config.NodeSource)
+	}
+
+	if err := validateVaultAuth(config.VaultEnabled, config.VaultAddr, config.VaultToken, config.VaultRoleID, config.VaultSecretID); err != nil {
+		return nil, err
 	}
 
 	return config, nil
 }
 
+// validateVaultAuth checks that Vault, when enabled, has an address and
+// either a token or both AppRole credentials
+func validateVaultAuth(enabled bool, addr, token, roleID, secretID string) error {
+	if !enabled {
+		return nil
+	}
+	if addr == "" {
+		return fmt.Errorf("vault enabled but VAULT_ADDR not set")
+	}
+	if (roleID == "") != (secretID == "") {
+		return fmt.Errorf("VAULT_ROLE_ID and VAULT_SECRET_ID must be set together")
+	}
+	if token == "" && roleID == "" {
+		return fmt.Errorf("vault enabled but neither VAULT_TOKEN nor VAULT_ROLE_ID and VAULT_SECRET_ID set")
+	}
+	return nil
+}
+
+// configFileEnv names an optional YAML file with configuration values, keyed
+// like the config struct's yaml tags. Environment variables override it and
+// defaults fill in whatever neither sets.
+const configFileEnv = "COSMOS_CONFIG_FILE"
+
+// loadConfigFile reads the config file, if there is one, over the defaults
+// in config. Unknown keys are rejected so typos don't go unnoticed.
+func loadConfigFile(config any) error {
+	path := os.Getenv(configFileEnv)
+	if path == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(config); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+
+	return nil
+}
+
 func getEnv(key, defaultValue string) string {
 	if value := os.Getenv(key); value != "" {
 		return value
@@ -164,6 +531,21 @@ func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
 	return duration
 }
 
+func getEnvList(key string, defaultValue []string) []string {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
 func getEnvInt(key string, defaultValue int) int {
 	value := os.Getenv(key)
 	if value == "" {
@@ -0,0 +1,118 @@
+package util
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func writeConfigFile(t *testing.T, content string) {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "cosmos.yaml")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+	t.Setenv(configFileEnv, path)
+}
+
+func TestLoadControllerConfigFromFile(t *testing.T) {
+	writeConfigFile(t, `
+database_url: postgres://cosmos@db/cosmos
+http_port: 8000
+grpc_port: 9000
+vault_enabled: false
+agent_timeout: 2m
+default_health_check_component_types: [program, script]
+`)
+	t.Setenv("COSMOS_DB_URL", "")
+	t.Setenv("COSMOS_HTTP_PORT", "")
+	t.Setenv("COSMOS_GRPC_PORT", "7000")
+
+	config, err := LoadControllerConfig()
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	if config.DatabaseURL != "postgres://cosmos@db/cosmos" || config.HTTPPort != 8000 || config.AgentTimeout != 2*time.Minute {
+		t.Errorf("Expected values from the file, got %+v", config)
+	}
+	if !slices.Equal(config.DefaultHealthCheckComponentTypes, []string{"program", "script"}) {
+		t.Errorf("Expected component types from the file, got %v", config.DefaultHealthCheckComponentTypes)
+	}
+	if config.GRPCPort != 7000 {
+		t.Errorf("Expected the environment to override the file, got grpc port %d", config.GRPCPort)
+	}
+	if config.NomadAddr != "http://nomad.service.consul:4646" || config.DeploymentTimeout != 10*time.Minute {
+		t.Errorf("Expected defaults for values set nowhere, got %+v", config)
+	}
+}
+
+func TestLoadAgentConfigFromFile(t *testing.T) {
+	writeConfigFile(t, `
+controller_url: controller.example.com:9091
+vault_enabled: false
+download_chunk_size: 1048576
+unmanaged_script_namespaces: [mount, net]
+`)
+	t.Setenv("COSMOS_CONTROLLER_URL", "")
+	t.Setenv("COSMOS_TAGS", "gpu,edge")
+
+	config, err := LoadAgentConfig()
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	if config.ControllerURL != "controller.example.com:9091" || config.DownloadChunkSize != 1<<20 {
+		t.Errorf("Expected values from the file, got %+v", config)
+	}
+	if config.Tags != "gpu,edge" {
+		t.Errorf("Expected tags from the environment, got %q", config.Tags)
+	}
+	if !slices.Equal(config.UnmanagedScriptNamespaces, []string{"mount", "net"}) {
+		t.Errorf("Expected namespaces from the file, got %v", config.UnmanagedScriptNamespaces)
+	}
+	if config.HeartbeatInterval != 30*time.Second || !config.TLSEnabled || config.UnmanagedScriptMode != "nsenter" {
+		t.Errorf("Expected defaults for values set nowhere, got %+v", config)
+	}
+}
+
+func TestLoadConfigFileErrors(t *testing.T) {
+	writeConfigFile(t, "vault_enabled: false\ndatabase_url: postgres://db\nhttp_prot: 8000\n")
+	if _, err := LoadControllerConfig(); err == nil {
+		t.Error("Expected an unknown key to be rejected")
+	}
+
+	t.Setenv("COSMOS_NODE_SOURCE", "")
+	t.Setenv("CONSUL_ADDR", "")
+	writeConfigFile(t, "vault_enabled: false\ndatabase_url: postgres://db\nnode_source: serf\n")
+	if _, err := LoadControllerConfig(); err == nil {
+		t.Error("Expected an unknown node source to be rejected")
+	}
+	writeConfigFile(t, "vault_enabled: false\ndatabase_url: postgres://db\nnode_source: consul\n")
+	if _, err := LoadControllerConfig(); err == nil {
+		t.Error("Expected the consul node source without an address to be rejected")
+	}
+
+	t.Setenv("COSMOS_UNMANAGED_SCRIPT_MODE", "")
+	writeConfigFile(t, "vault_enabled: false\nunmanaged_script_mode: chroot\n")
+	if _, err := LoadAgentConfig(); err == nil {
+		t.Error("Expected an unknown unmanaged script mode to be rejected")
+	}
+
+	// The merged config is validated like one from the environment alone
+	writeConfigFile(t, "vault_enabled: true\nvault_addr: http://vault:8200\n")
+	t.Setenv("VAULT_TOKEN", "")
+	t.Setenv("VAULT_ROLE_ID", "")
+	t.Setenv("VAULT_SECRET_ID", "")
+	if _, err := LoadAgentConfig(); err == nil {
+		t.Error("Expected Vault without credentials to be rejected")
+	}
+
+	t.Setenv(configFileEnv, filepath.Join(t.TempDir(), "missing.yaml"))
+	if _, err := LoadAgentConfig(); err == nil {
+		t.Error("Expected a missing config file to be an error")
+	}
+}
@@ -0,0 +1,41 @@
+package util
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// MaxComponentNameLength bounds component names, which are used as file names
+// and database keys
+const MaxComponentNameLength = 128
+
+var componentNamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]*$`)
+
+// NormalizeComponentName trims surrounding whitespace from a component name
+func NormalizeComponentName(name string) string {
+	return strings.TrimSpace(name)
+}
+
+// ValidateComponentName checks that a component name is safe to use as a
+// path element: letters, digits, '.', '_' and '-', starting with a letter or
+// digit, with no path separators or "..".
+func ValidateComponentName(name string) error {
+	if name == "" {
+		return fmt.Errorf("component name is required")
+	}
+
+	if len(name) > MaxComponentNameLength {
+		return fmt.Errorf("component name %q is longer than %d characters", name, MaxComponentNameLength)
+	}
+
+	if !componentNamePattern.MatchString(name) {
+		return fmt.Errorf("component name %q may only contain letters, digits, '.', '_' and '-' and must start with a letter or digit", name)
+	}
+
+	if strings.Contains(name, "..") {
+		return fmt.Errorf("component name %q must not contain \"..\"", name)
+	}
+
+	return nil
+}
@@ -0,0 +1,46 @@
+package util
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateComponentName(t *testing.T) {
+	tests := []struct {
+		name      string
+		component string
+		wantError string
+	}{
+		{"simple", "web", ""},
+		{"punctuation", "api-v2.worker_1", ""},
+		{"longest allowed", strings.Repeat("a", MaxComponentNameLength), ""},
+		{"empty", "", "is required"},
+		{"too long", strings.Repeat("a", MaxComponentNameLength+1), "longer than"},
+		{"path separator", "web/../../etc", "may only contain"},
+		{"leading dot", ".hidden", "must start with a letter or digit"},
+		{"leading dash", "-web", "must start with a letter or digit"},
+		{"whitespace", "web app", "may only contain"},
+		{"parent directory", "web..backup", "must not contain"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateComponentName(tt.component)
+			if tt.wantError == "" {
+				if err != nil {
+					t.Errorf("Expected %q to be valid, got %v", tt.component, err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantError) {
+				t.Errorf("Expected an error containing %q, got %v", tt.wantError, err)
+			}
+		})
+	}
+}
+
+func TestNormalizeComponentName(t *testing.T) {
+	if name := NormalizeComponentName("  web\n"); name != "web" {
+		t.Errorf("Expected surrounding whitespace to be trimmed, got %q", name)
+	}
+}
@@ -0,0 +1,39 @@
+package util
+
+import (
+	"context"
+	"regexp"
+
+	"github.com/google/uuid"
+)
+
+// RequestIDHeader carries the request ID of an API request. Clients may set it
+// to correlate their own logs; it is always set on the response.
+const RequestIDHeader = "X-Request-ID"
+
+var requestIDPattern = regexp.MustCompile(`^[a-zA-Z0-9._:-]{1,128}$`)
+
+type requestIDKey struct{}
+
+// NewRequestID returns a new random request ID
+func NewRequestID() string {
+	return uuid.New().String()
+}
+
+// ValidRequestID reports whether a client supplied request ID is safe to log
+// and store
+func ValidRequestID(id string) bool {
+	return requestIDPattern.MatchString(id)
+}
+
+// WithRequestID returns a copy of ctx carrying the request ID
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestIDFromContext returns the request ID carried by ctx, or "" if it has
+// none
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
@@ -6,14 +6,33 @@ import (
 	"encoding/pem"
 	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 
 	vault "github.com/hashicorp/vault/api"
 	log "github.com/sirupsen/logrus"
 )
 
+// vaultCAFile is the name the issuing CA is stored under when the CA path
+// is a directory
+const vaultCAFile = "vault-ca.crt"
+
+// tokenRetryDelay is how long a failed token renewal waits before it is
+// tried again
+const tokenRetryDelay = 10 * time.Second
+
+// vaultLogical is the part of the Vault logical API the certificate manager
+// uses
+type vaultLogical interface {
+	Read(path string) (*vault.Secret, error)
+	Write(path string, data map[string]interface{}) (*vault.Secret, error)
+}
+
 type VaultCertManager struct {
 	client   *vault.Client
+	logical  vaultLogical
 	pkiPath  string
 	role     string
 	hostname string
@@ -21,17 +40,38 @@ type VaultCertManager struct {
 	keyPath  string
 	caPath   string
 	ttl      string
+
+	appRole *appRoleLogin
+
+	// certs is set by LoadTLSConfig and reloaded after each renewal
+	certs *CertHolder
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+type appRoleLogin struct {
+	mount    string
+	roleID   string
+	secretID string
 }
 
+// VaultCertConfig configures how the certificate manager authenticates to
+// Vault. With RoleID and SecretID set it logs in through AppRole, mounted at
+// AppRolePath ("approle" by default). Otherwise VaultToken is used. Either
+// way the token is renewed in the background before its lease expires.
 type VaultCertConfig struct {
-	VaultAddr  string
-	VaultToken string
-	PKIPath    string
-	Role       string
-	CertPath   string
-	KeyPath    string
-	CAPath     string
-	TTL        string
+	VaultAddr   string
+	VaultToken  string
+	RoleID      string
+	SecretID    string
+	AppRolePath string
+	PKIPath     string
+	Role        string
+	CertPath    string
+	KeyPath     string
+	CAPath      string
+	TTL         string
 }
 
 type TLSConfigWrapper struct {
@@ -49,8 +89,6 @@ func NewVaultCertManager(config *VaultCertConfig) (*VaultCertManager, error) {
 		return nil, fmt.Errorf("failed to create vault client: %w", err)
 	}
 
-	client.SetToken(config.VaultToken)
-
 	// Allow overriding hostname via environment variable (for Consul DNS names)
 	hostname := os.Getenv("COSMOS_CERT_HOSTNAME")
 	if hostname == "" {
@@ -61,8 +99,9 @@ func NewVaultCertManager(config *VaultCertConfig) (*VaultCertManager, error) {
 		}
 	}
 
-	return &VaultCertManager{
+	v := &VaultCertManager{
 		client:   client,
+		logical:  client.Logical(),
 		pkiPath:  config.PKIPath,
 		role:     config.Role,
 		hostname: hostname,
@@ -70,7 +109,142 @@ func NewVaultCertManager(config *VaultCertConfig) (*VaultCertManager, error) {
 		keyPath:  config.KeyPath,
 		caPath:   config.CAPath,
 		ttl:      config.TTL,
-	}, nil
+		stop:     make(chan struct{}),
+	}
+
+	if config.RoleID == "" || config.SecretID == "" {
+		client.SetToken(config.VaultToken)
+
+		leaseDuration, err := v.lookupTokenTTL()
+		if err != nil {
+			log.WithError(err).Warn("Failed to look up Vault token, it won't be renewed")
+			return v, nil
+		}
+		go v.renewToken(leaseDuration)
+		return v, nil
+	}
+
+	mount := config.AppRolePath
+	if mount == "" {
+		mount = "approle"
+	}
+	v.appRole = &appRoleLogin{mount: mount, roleID: config.RoleID, secretID: config.SecretID}
+
+	leaseDuration, err := v.loginAppRole()
+	if err != nil {
+		return nil, err
+	}
+	go v.renewToken(leaseDuration)
+
+	return v, nil
+}
+
+// Hostname returns the name certificates are issued for
+func (v *VaultCertManager) Hostname() string {
+	return v.hostname
+}
+
+// Stop ends background token renewal
+func (v *VaultCertManager) Stop() {
+	v.stopOnce.Do(func() { close(v.stop) })
+}
+
+// loginAppRole logs in with the AppRole credentials, switches the client to
+// the new token and returns how long the token is valid for
+func (v *VaultCertManager) loginAppRole() (time.Duration, error) {
+	secret, err := v.logical.Write(fmt.Sprintf("auth/%s/login", v.appRole.mount), map[string]interface{}{
+		"role_id":   v.appRole.roleID,
+		"secret_id": v.appRole.secretID,
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to log in to vault with approle: %w", err)
+	}
+	if secret == nil || secret.Auth == nil || secret.Auth.ClientToken == "" {
+		return 0, fmt.Errorf("vault approle login returned no token")
+	}
+
+	v.client.SetToken(secret.Auth.ClientToken)
+
+	leaseDuration := time.Duration(secret.Auth.LeaseDuration) * time.Second
+	log.WithField("lease_duration", leaseDuration).Info("Logged in to Vault with AppRole")
+	return leaseDuration, nil
+}
+
+// lookupTokenTTL returns how long the static token is still valid for, or 0
+// if it doesn't expire or can't be renewed
+func (v *VaultCertManager) lookupTokenTTL() (time.Duration, error) {
+	secret, err := v.logical.Read("auth/token/lookup-self")
+	if err != nil {
+		return 0, fmt.Errorf("failed to look up vault token: %w", err)
+	}
+
+	ttl, err := secret.TokenTTL()
+	if err != nil {
+		return 0, fmt.Errorf("failed to read vault token ttl: %w", err)
+	}
+	if ttl <= 0 {
+		return 0, nil
+	}
+
+	renewable, err := secret.TokenIsRenewable()
+	if err != nil {
+		return 0, fmt.Errorf("failed to read vault token renewability: %w", err)
+	}
+	if !renewable {
+		log.WithField("ttl", ttl).Warn("Vault token isn't renewable and will expire")
+		return 0, nil
+	}
+
+	return ttl, nil
+}
+
+// renewSelf extends the lease of the client's token and returns the new
+// lease duration
+func (v *VaultCertManager) renewSelf() (time.Duration, error) {
+	secret, err := v.logical.Write("auth/token/renew-self", map[string]interface{}{})
+	if err != nil {
+		return 0, fmt.Errorf("failed to renew vault token: %w", err)
+	}
+	if secret == nil || secret.Auth == nil {
+		return 0, fmt.Errorf("vault token renewal returned no lease")
+	}
+
+	leaseDuration := time.Duration(secret.Auth.LeaseDuration) * time.Second
+	log.WithField("lease_duration", leaseDuration).Info("Renewed Vault token")
+	return leaseDuration, nil
+}
+
+// renewToken renews the token once two thirds of its lease have passed,
+// until the manager is stopped. If renewal fails and AppRole is configured
+// it logs in again instead. Tokens without a lease don't need renewing.
+func (v *VaultCertManager) renewToken(leaseDuration time.Duration) {
+	if leaseDuration <= 0 {
+		return
+	}
+
+	wait := leaseDuration * 2 / 3
+	for {
+		select {
+		case <-v.stop:
+			return
+		case <-time.After(wait):
+		}
+
+		leaseDuration, err := v.renewSelf()
+		if err != nil && v.appRole != nil {
+			log.WithError(err).Warn("Failed to renew Vault token, logging in with AppRole again")
+			leaseDuration, err = v.loginAppRole()
+		}
+		if err != nil {
+			log.WithError(err).WithField("retry_in", tokenRetryDelay).Error("Failed to renew Vault token")
+			wait = tokenRetryDelay
+			continue
+		}
+		if leaseDuration <= 0 {
+			return
+		}
+		wait = leaseDuration * 2 / 3
+	}
 }
 
 func (v *VaultCertManager) ObtainCertificate() error {
@@ -80,7 +254,7 @@ func (v *VaultCertManager) ObtainCertificate() error {
 		"ttl":      v.ttl,
 	}).Info("Requesting certificate from Vault")
 
-	secret, err := v.client.Logical().Write(
+	secret, err := v.logical.Write(
 		fmt.Sprintf("%s/issue/%s", v.pkiPath, v.role),
 		map[string]interface{}{
 			"common_name": v.hostname,
@@ -103,7 +277,11 @@ func (v *VaultCertManager) ObtainCertificate() error {
 		return fmt.Errorf("failed to write private key: %w", err)
 	}
 
-	if err := os.WriteFile(v.caPath, []byte(ca), 0644); err != nil {
+	caPath := v.caPath
+	if info, err := os.Stat(caPath); err == nil && info.IsDir() {
+		caPath = filepath.Join(caPath, vaultCAFile)
+	}
+	if err := os.WriteFile(caPath, []byte(ca), 0644); err != nil {
 		return fmt.Errorf("failed to write CA certificate: %w", err)
 	}
 
@@ -111,6 +289,41 @@ func (v *VaultCertManager) ObtainCertificate() error {
 	return nil
 }
 
+// maxVaultRetryBackoff caps the wait between certificate issue attempts
+const maxVaultRetryBackoff = time.Minute
+
+// ObtainCertificateWithRetry calls ObtainCertificate up to attempts times,
+// doubling the wait between tries from initialBackoff. It returns the last
+// error once every attempt has failed.
+func (v *VaultCertManager) ObtainCertificateWithRetry(attempts int, initialBackoff time.Duration) error {
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	backoff := initialBackoff
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if err = v.ObtainCertificate(); err == nil {
+			return nil
+		}
+
+		if attempt == attempts {
+			break
+		}
+
+		log.WithError(err).WithFields(log.Fields{
+			"attempt":      attempt,
+			"max_attempts": attempts,
+			"retry_in":     backoff,
+		}).Warn("Failed to obtain certificate from Vault, retrying")
+
+		time.Sleep(backoff)
+		backoff = min(backoff*2, maxVaultRetryBackoff)
+	}
+
+	return fmt.Errorf("giving up after %d attempts: %w", attempts, err)
+}
+
 func (v *VaultCertManager) ShouldRenew(renewBefore time.Duration) (bool, error) {
 	certPEM, err := os.ReadFile(v.certPath)
 	if err != nil {
@@ -144,7 +357,7 @@ func (v *VaultCertManager) RenewCertificate() error {
 	tmpCertPath := v.certPath + ".tmp"
 	tmpKeyPath := v.keyPath + ".tmp"
 
-	secret, err := v.client.Logical().Write(
+	secret, err := v.logical.Write(
 		fmt.Sprintf("%s/issue/%s", v.pkiPath, v.role),
 		map[string]interface{}{
 			"common_name": v.hostname,
@@ -174,32 +387,31 @@ func (v *VaultCertManager) RenewCertificate() error {
 		return fmt.Errorf("failed to replace private key: %w", err)
 	}
 
+	if v.certs != nil {
+		if err := v.certs.Reload(); err != nil {
+			return fmt.Errorf("failed to reload certificate: %w", err)
+		}
+	}
+
 	log.Info("Certificate renewed successfully")
 	return nil
 }
 
+// LoadTLSConfig returns a TLS config that uses the manager's certificate,
+// including the renewed one after RenewCertificate
 func (v *VaultCertManager) LoadTLSConfig() (*tls.Config, error) {
-	cert, err := tls.LoadX509KeyPair(v.certPath, v.keyPath)
+	certs, err := NewCertHolder(v.certPath, v.keyPath)
 	if err != nil {
-		return nil, fmt.Errorf("failed to load certificate pair: %w", err)
+		return nil, err
 	}
 
-	caCert, err := os.ReadFile(v.caPath)
+	config, err := newTLSConfig(certs, v.caPath)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read CA certificate: %w", err)
-	}
-
-	caCertPool := x509.NewCertPool()
-	if !caCertPool.AppendCertsFromPEM(caCert) {
-		return nil, fmt.Errorf("failed to append CA certificate")
+		return nil, err
 	}
 
-	return &tls.Config{
-		Certificates: []tls.Certificate{cert},
-		RootCAs:      caCertPool,
-		ClientCAs:    caCertPool,
-		MinVersion:   tls.VersionTLS12,
-	}, nil
+	v.certs = certs
+	return config, nil
 }
 
 func parseCertificate(certPEM []byte) (*x509.Certificate, error) {
@@ -217,25 +429,113 @@ func parseCertificate(certPEM []byte) (*x509.Certificate, error) {
 }
 
 func LoadTLSConfigFromFiles(certPath, keyPath, caPath string) (*tls.Config, error) {
-	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	certs, err := NewCertHolder(certPath, keyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return newTLSConfig(certs, caPath)
+}
+
+func newTLSConfig(certs *CertHolder, caPath string) (*tls.Config, error) {
+	caCertPool, err := LoadCAPool(caPath)
 	if err != nil {
-		return nil, fmt.Errorf("failed to load certificate pair: %w", err)
+		return nil, err
 	}
 
-	caCert, err := os.ReadFile(caPath)
+	return &tls.Config{
+		GetCertificate:       certs.GetCertificate,
+		GetClientCertificate: certs.GetClientCertificate,
+		RootCAs:              caCertPool,
+		ClientCAs:            caCertPool,
+		MinVersion:           tls.VersionTLS12,
+	}, nil
+}
+
+// LoadCAPool reads the trusted CA certificates from caPath: a PEM file with
+// one or more certificates, or a directory of such files. Trusting several
+// CAs lets certificates from the old and the new CA work during a rotation.
+func LoadCAPool(caPath string) (*x509.CertPool, error) {
+	info, err := os.Stat(caPath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read CA certificate: %w", err)
 	}
 
-	caCertPool := x509.NewCertPool()
-	if !caCertPool.AppendCertsFromPEM(caCert) {
-		return nil, fmt.Errorf("failed to append CA certificate")
+	files := []string{caPath}
+	if info.IsDir() {
+		if files, err = caBundleFiles(caPath); err != nil {
+			return nil, err
+		}
 	}
 
-	return &tls.Config{
-		Certificates: []tls.Certificate{cert},
-		RootCAs:      caCertPool,
-		ClientCAs:    caCertPool,
-		MinVersion:   tls.VersionTLS12,
-	}, nil
+	pool := x509.NewCertPool()
+	loaded := 0
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA certificate: %w", err)
+		}
+
+		n, err := appendCerts(pool, data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse CA certificate %s: %w", file, err)
+		}
+		loaded += n
+	}
+
+	if loaded == 0 {
+		return nil, fmt.Errorf("no CA certificates found in %s", caPath)
+	}
+
+	return pool, nil
+}
+
+// caBundleFiles lists the files in a CA directory. Hidden entries are
+// skipped, like the ..data links of mounted Kubernetes secrets.
+func caBundleFiles(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA directory: %w", err)
+	}
+
+	var files []string
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+
+		path := filepath.Join(dir, entry.Name())
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA certificate: %w", err)
+		}
+		if info.Mode().IsRegular() {
+			files = append(files, path)
+		}
+	}
+
+	return files, nil
+}
+
+// appendCerts adds every certificate in the PEM data to the pool and
+// returns how many there were. Other PEM blocks are ignored.
+func appendCerts(pool *x509.CertPool, data []byte) (int, error) {
+	count := 0
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return count, nil
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return count, err
+		}
+		pool.AddCert(cert)
+		count++
+	}
 }
@@ -0,0 +1,317 @@
+package util
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	vault "github.com/hashicorp/vault/api"
+)
+
+type fakeVaultWriter struct {
+	mu     sync.Mutex
+	writes []string
+	data   []map[string]interface{}
+	write  func(path string, calls int) (*vault.Secret, error)
+	read   func(path string) (*vault.Secret, error)
+}
+
+func (f *fakeVaultWriter) Read(path string) (*vault.Secret, error) {
+	return f.read(path)
+}
+
+func (f *fakeVaultWriter) Write(path string, data map[string]interface{}) (*vault.Secret, error) {
+	f.mu.Lock()
+	f.writes = append(f.writes, path)
+	f.data = append(f.data, data)
+	calls := len(f.writes)
+	f.mu.Unlock()
+	return f.write(path, calls)
+}
+
+func (f *fakeVaultWriter) calls() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.writes)
+}
+
+func (f *fakeVaultWriter) paths() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.writes...)
+}
+
+func newTestCertManager(t *testing.T, writer vaultLogical) *VaultCertManager {
+	t.Helper()
+
+	client, err := vault.NewClient(vault.DefaultConfig())
+	if err != nil {
+		t.Fatalf("Failed to create vault client: %v", err)
+	}
+	client.ClearToken()
+
+	v := &VaultCertManager{
+		client:  client,
+		logical: writer,
+		appRole: &appRoleLogin{mount: "approle", roleID: "role", secretID: "secret"},
+		stop:    make(chan struct{}),
+	}
+	t.Cleanup(v.Stop)
+	return v
+}
+
+func TestLoginAppRole(t *testing.T) {
+	writer := &fakeVaultWriter{write: func(path string, calls int) (*vault.Secret, error) {
+		return &vault.Secret{Auth: &vault.SecretAuth{ClientToken: "s.approle", LeaseDuration: 3600}}, nil
+	}}
+	v := newTestCertManager(t, writer)
+
+	leaseDuration, err := v.loginAppRole()
+	if err != nil {
+		t.Fatalf("Login failed: %v", err)
+	}
+
+	if writer.writes[0] != "auth/approle/login" {
+		t.Errorf("Expected login at auth/approle/login, got %s", writer.writes[0])
+	}
+	if writer.data[0]["role_id"] != "role" || writer.data[0]["secret_id"] != "secret" {
+		t.Errorf("Expected role and secret IDs to be sent, got %v", writer.data[0])
+	}
+	if got := v.client.Token(); got != "s.approle" {
+		t.Errorf("Expected client to use the login token, got %q", got)
+	}
+	if leaseDuration != time.Hour {
+		t.Errorf("Expected a 1h lease, got %s", leaseDuration)
+	}
+}
+
+func TestLoginAppRoleFailures(t *testing.T) {
+	responses := map[string]func(string, int) (*vault.Secret, error){
+		"error": func(string, int) (*vault.Secret, error) {
+			return nil, fmt.Errorf("invalid role or secret ID")
+		},
+		"no auth": func(string, int) (*vault.Secret, error) {
+			return &vault.Secret{}, nil
+		},
+		"empty token": func(string, int) (*vault.Secret, error) {
+			return &vault.Secret{Auth: &vault.SecretAuth{}}, nil
+		},
+	}
+
+	for name, write := range responses {
+		t.Run(name, func(t *testing.T) {
+			v := newTestCertManager(t, &fakeVaultWriter{write: write})
+			if _, err := v.loginAppRole(); err == nil {
+				t.Error("Expected login to fail")
+			}
+			if v.client.Token() != "" {
+				t.Errorf("Expected no token after a failed login, got %q", v.client.Token())
+			}
+		})
+	}
+}
+
+func TestRenewTokenBeforeExpiry(t *testing.T) {
+	writer := &fakeVaultWriter{write: func(path string, calls int) (*vault.Secret, error) {
+		return &vault.Secret{Auth: &vault.SecretAuth{LeaseDuration: 1}}, nil
+	}}
+	v := newTestCertManager(t, writer)
+	v.appRole = nil
+
+	start := time.Now()
+	go v.renewToken(time.Second)
+
+	for writer.calls() == 0 {
+		if time.Since(start) > time.Second {
+			t.Fatal("Expected the token to be renewed before it expired")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if paths := writer.paths(); paths[0] != "auth/token/renew-self" {
+		t.Errorf("Expected renewal through auth/token/renew-self, got %s", paths[0])
+	}
+
+	v.Stop()
+	calls := writer.calls()
+	time.Sleep(1500 * time.Millisecond)
+	if writer.calls() > calls+1 {
+		t.Errorf("Expected renewal to stop, got %d more renewals", writer.calls()-calls)
+	}
+}
+
+func TestRenewTokenFallsBackToAppRoleLogin(t *testing.T) {
+	writer := &fakeVaultWriter{write: func(path string, calls int) (*vault.Secret, error) {
+		if path == "auth/token/renew-self" {
+			return nil, fmt.Errorf("token expired")
+		}
+		return &vault.Secret{Auth: &vault.SecretAuth{ClientToken: "s.relogin", LeaseDuration: 3600}}, nil
+	}}
+	v := newTestCertManager(t, writer)
+
+	go v.renewToken(300 * time.Millisecond)
+
+	deadline := time.Now().Add(time.Second)
+	for v.client.Token() != "s.relogin" {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected a new AppRole login after renewal failed, got %v", writer.paths())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if paths := writer.paths(); len(paths) != 2 || paths[1] != "auth/approle/login" {
+		t.Errorf("Expected a renewal then a login, got %v", paths)
+	}
+}
+
+func TestLookupTokenTTL(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    map[string]interface{}
+		wantTTL time.Duration
+	}{
+		{"renewable", map[string]interface{}{"ttl": json.Number("3600"), "renewable": true}, time.Hour},
+		{"not renewable", map[string]interface{}{"ttl": json.Number("3600"), "renewable": false}, 0},
+		{"no expiry", map[string]interface{}{"ttl": json.Number("0"), "renewable": false}, 0},
+	}
+
+	for _, tt := range tests {
+		writer := &fakeVaultWriter{read: func(path string) (*vault.Secret, error) {
+			if path != "auth/token/lookup-self" {
+				t.Errorf("Unexpected read of %s", path)
+			}
+			return &vault.Secret{Data: tt.data}, nil
+		}}
+		v := newTestCertManager(t, writer)
+
+		ttl, err := v.lookupTokenTTL()
+		if err != nil {
+			t.Fatalf("%s: lookup failed: %v", tt.name, err)
+		}
+		if ttl != tt.wantTTL {
+			t.Errorf("%s: got ttl %s, want %s", tt.name, ttl, tt.wantTTL)
+		}
+	}
+}
+
+func TestValidateVaultAuth(t *testing.T) {
+	tests := []struct {
+		name                    string
+		token, roleID, secretID string
+		wantErr                 bool
+	}{
+		{"static token", "s.token", "", "", false},
+		{"approle", "", "role", "secret", false},
+		{"no credentials", "", "", "", true},
+		{"role without secret", "s.token", "role", "", true},
+	}
+
+	for _, tt := range tests {
+		err := validateVaultAuth(true, "http://vault:8200", tt.token, tt.roleID, tt.secretID)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: got error %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+
+	if err := validateVaultAuth(false, "", "", "", ""); err != nil {
+		t.Errorf("Expected disabled Vault to need no credentials, got %v", err)
+	}
+}
+
+func TestLoadCAPoolFromDirectory(t *testing.T) {
+	dir := t.TempDir()
+	caDir := filepath.Join(dir, "ca")
+	if err := os.Mkdir(caDir, 0755); err != nil {
+		t.Fatalf("Failed to create CA directory: %v", err)
+	}
+
+	oldCA := newTestCert(t, "cosmos-ca-old", 1, nil)
+	newCA := newTestCert(t, "cosmos-ca-new", 2, nil)
+	oldCA.write(t, caDir, "old")
+	newCA.write(t, caDir, "new")
+	// Only the certificates in the directory are trusted, not their keys
+	for _, name := range []string{"old.key", "new.key"} {
+		os.Remove(filepath.Join(caDir, name))
+	}
+
+	serverCert, serverKey := newTestCert(t, "localhost", 10, oldCA).write(t, dir, "server")
+	clientCert, clientKey := newTestCert(t, "agent-1", 20, newCA).write(t, dir, "client")
+
+	serverConfig, err := LoadTLSConfigFromFiles(serverCert, serverKey, caDir)
+	if err != nil {
+		t.Fatalf("Failed to load server TLS config: %v", err)
+	}
+	serverConfig.ClientAuth = tls.RequireAndVerifyClientCert
+
+	clientConfig, err := LoadTLSConfigFromFiles(clientCert, clientKey, caDir)
+	if err != nil {
+		t.Fatalf("Failed to load client TLS config: %v", err)
+	}
+	clientConfig.ServerName = "localhost"
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", serverConfig)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	accepted := make(chan error, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			accepted <- err
+			return
+		}
+		defer conn.Close()
+		accepted <- conn.(*tls.Conn).Handshake()
+	}()
+
+	conn, err := tls.Dial("tcp", listener.Addr().String(), clientConfig)
+	if err != nil {
+		t.Fatalf("Handshake failed: %v", err)
+	}
+	defer conn.Close()
+
+	if err := <-accepted; err != nil {
+		t.Errorf("Expected the server to accept a client certificate from the second CA, got %v", err)
+	}
+}
+
+func TestLoadCAPool(t *testing.T) {
+	dir := t.TempDir()
+	first := newTestCert(t, "ca-1", 1, nil)
+	second := newTestCert(t, "ca-2", 2, nil)
+
+	bundle := filepath.Join(dir, "bundle.pem")
+	if err := os.WriteFile(bundle, append(append([]byte{}, first.pem...), second.pem...), 0644); err != nil {
+		t.Fatalf("Failed to write bundle: %v", err)
+	}
+	pool, err := LoadCAPool(bundle)
+	if err != nil {
+		t.Fatalf("Failed to load bundle: %v", err)
+	}
+	for _, ca := range []*testCert{first, second} {
+		if _, err := ca.cert.Verify(x509.VerifyOptions{Roots: pool, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}}); err != nil {
+			t.Errorf("Expected %s to be trusted from the bundle: %v", ca.cert.Subject.CommonName, err)
+		}
+	}
+
+	empty := filepath.Join(dir, "empty")
+	if err := os.Mkdir(empty, 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	os.WriteFile(filepath.Join(empty, "README"), []byte("no certificates here"), 0644)
+	if _, err := LoadCAPool(empty); err == nil {
+		t.Error("Expected a directory without certificates to fail")
+	}
+
+	if _, err := LoadCAPool(filepath.Join(dir, "missing.pem")); err == nil {
+		t.Error("Expected a missing CA file to fail")
+	}
+}